@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+
+	"runebird/internal/config"
+)
+
+// parseFlags parses the command-line flags in args into the options to load the configuration
+// with. Flags take precedence over the config file and the environment, and only those given
+// override a setting.
+func parseFlags(name string, args []string, output io.Writer) (config.Options, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	options := configFlags(fs)
+	if err := parseArgs(fs, args); err != nil {
+		return config.Options{}, err
+	}
+	return options(), nil
+}
+
+// configFlags defines the flags overriding the configuration on fs, returning a function that
+// builds the options from those given once fs is parsed.
+func configFlags(fs *flag.FlagSet) func() config.Options {
+	path := fs.String("config", "", "path of the config file, instead of EMAILER_CONFIG_PATH")
+	port := fs.Int("port", 0, "HTTP port to listen on (server.port)")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn or error (logging.level)")
+	dryRun := fs.Bool("dry-run", false, "capture emails instead of delivering them (delivery.dry_run)")
+	templatesPath := fs.String("templates-path", "", "directory to load templates from (templates.path)")
+	return func() config.Options {
+		opts := config.Options{Path: *path, Set: make(map[string]string)}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "port":
+				opts.Set["server.port"] = strconv.Itoa(*port)
+			case "log-level":
+				opts.Set["logging.level"] = *logLevel
+			case "dry-run":
+				opts.Set["delivery.dry_run"] = strconv.FormatBool(*dryRun)
+			case "templates-path":
+				opts.Set["templates.path"] = *templatesPath
+			}
+		})
+		return opts
+	}
+}
+
+// parseArgs parses args with fs, refusing positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("unexpected argument %q", fs.Arg(0))
+		_, _ = fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"runebird/internal/config"
+)
+
+// genConfig runs the gen-config subcommand, which writes an annotated configuration file with
+// every setting to stdout, to start a configuration from. It returns the exit status.
+func genConfig(name string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	if err := parseArgs(fs, args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if _, err := fmt.Fprint(stdout, config.Sample()); err != nil {
+		_, _ = fmt.Fprintf(stderr, "Failed to write configuration: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"go.uber.org/zap"
 	"html/template"
@@ -8,17 +10,39 @@ import (
 	"os/signal"
 	"syscall"
 
+	"runebird/internal/bounce"
 	"runebird/internal/config"
 	"runebird/internal/email"
 	"runebird/internal/logger"
+	"runebird/internal/messages"
 	"runebird/internal/rate"
 	"runebird/internal/scheduler"
 	"runebird/internal/server"
+	"runebird/internal/store"
+	"runebird/internal/suppression"
 	"runebird/internal/templates"
+	"runebird/internal/webhook"
 )
 
 func main() {
-	cfg, err := config.Load()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[0]+" validate", os.Args[2:], os.Stdout, os.Stderr))
+		case "gen-config":
+			os.Exit(genConfig(os.Args[0]+" gen-config", os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	opts, err := parseFlags(os.Args[0], os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	cfg, err := config.LoadWith(opts)
 	if err != nil {
 		_, err := fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
 		if err != nil {
@@ -45,31 +69,245 @@ func main() {
 		}
 	}(log)
 
-	sender, err := email.New(&cfg.SMTP)
+	sender, err := email.New(cfg)
 	if err != nil {
 		log.Error("Failed to initialize email sender", zap.Error(err))
 		os.Exit(1)
 	}
+	smtpSender, _ := sender.(*email.SMTPSender)
+	if len(cfg.Delivery.Profiles) > 0 {
+		sender, err = email.NewRouter(sender, cfg.Delivery.Profiles)
+		if err != nil {
+			log.Error("Failed to initialize delivery profiles", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+	sender = email.NewMetrics(sender, cfg)
+	sender = email.NewArchive(sender, &cfg.Delivery.Archive)
+	sender = email.NewDryRun(sender, cfg, log)
+	sender = email.NewSizeLimit(sender, cfg)
+	sender = email.NewDomainFilter(sender, cfg, log)
+	if cfg.Delivery.DryRun {
+		log.Warn("Dry-run mode enabled, emails will not be delivered", zap.String("capture_dir", cfg.Delivery.CaptureDir))
+	}
+
+	var remote *templates.RemoteSource
+	if cfg.Templates.Remote.Bucket != "" {
+		remote, err = templates.NewRemote(&cfg.Templates)
+		if err != nil {
+			log.Error("Failed to initialize remote templates", zap.Error(err))
+			os.Exit(1)
+		}
+		if _, err := remote.Sync(context.Background()); err != nil {
+			log.Error("Failed to sync remote templates, using the local copies", zap.Error(err))
+		}
+	}
 
-	tm, err := templates.New(&cfg.Templates)
+	var templateStore templates.VersionStore
+	switch cfg.Templates.Store.Driver {
+	case "bolt":
+		ts, err := store.NewBolt(cfg.Templates.Store.Path)
+		if err != nil {
+			log.Error("Failed to open template store", zap.Error(err))
+			os.Exit(1)
+		}
+		defer func(ts *store.Bolt) {
+			if err := ts.Close(); err != nil {
+				log.Error("Failed to close template store", zap.Error(err))
+			}
+		}(ts)
+		templateStore = ts.Templates()
+	case "redis":
+		ts, err := store.NewRedis(&cfg.Store.Redis)
+		if err != nil {
+			log.Error("Failed to initialize redis template store", zap.Error(err))
+			os.Exit(1)
+		}
+		defer func(ts *store.Redis) {
+			if err := ts.Close(); err != nil {
+				log.Error("Failed to close redis template store", zap.Error(err))
+			}
+		}(ts)
+		templateStore = ts.Templates()
+	}
+
+	tm, err := templates.NewWithStore(&cfg.Templates, templateStore)
 	if err != nil {
 		log.Error("Failed to initialize template manager", zap.Error(err))
 		tm = &templates.TemplateManager{Templates: make(map[string]*template.Template)}
+	} else {
+		if cfg.Templates.Watch {
+			tm.Watch(cfg.Templates.WatchInterval, log)
+			defer tm.Stop()
+		}
+		if remote != nil {
+			remote.Start(tm, log)
+			defer remote.Stop()
+		}
+	}
+
+	taskStore := scheduler.NewMemoryStore(cfg.Scheduler.StatusRetention)
+	messageStore := messages.NewMemoryStore(cfg.Store.MessageRetention)
+	subscriptionStore := webhook.NewMemoryStore()
+	suppressionStore := suppression.NewMemoryStore()
+	queue := rate.NewMemoryQueue()
+	var queueDB *store.Bolt
+	if cfg.RateLimit.QueuePath != "" && cfg.Store.Driver != "redis" {
+		bs, err := store.NewBolt(cfg.RateLimit.QueuePath)
+		if err != nil {
+			log.Error("Failed to open rate limit queue", zap.Error(err))
+			os.Exit(1)
+		}
+		defer func(bs *store.Bolt) {
+			if err := bs.Close(); err != nil {
+				log.Error("Failed to close rate limit queue", zap.Error(err))
+			}
+		}(bs)
+		queue = bs.Queue()
+		queueDB = bs
+	}
+	if cfg.Store.SuppressionPath != "" && cfg.Store.Driver != "redis" {
+		// The suppression list may share the file of the queue, which can only be opened once.
+		ss := queueDB
+		if ss == nil || cfg.Store.SuppressionPath != cfg.RateLimit.QueuePath {
+			ss, err = store.NewBolt(cfg.Store.SuppressionPath)
+			if err != nil {
+				log.Error("Failed to open suppression list", zap.Error(err))
+				os.Exit(1)
+			}
+			defer func(ss *store.Bolt) {
+				if err := ss.Close(); err != nil {
+					log.Error("Failed to close suppression list", zap.Error(err))
+				}
+			}(ss)
+		}
+		suppressionStore = ss.Suppressions()
+	}
+	bucket := rate.NewMemoryBucket(&cfg.RateLimit)
+	if cfg.RateLimit.StatePath != "" && cfg.RateLimit.Driver != "redis" {
+		// The queue and the bucket state may share a file, which can only be opened once.
+		ss := queueDB
+		if ss == nil || cfg.RateLimit.StatePath != cfg.RateLimit.QueuePath {
+			ss, err = store.NewBolt(cfg.RateLimit.StatePath)
+			if err != nil {
+				log.Error("Failed to open rate limit state", zap.Error(err))
+				os.Exit(1)
+			}
+			defer func(ss *store.Bolt) {
+				if err := ss.Close(); err != nil {
+					log.Error("Failed to close rate limit state", zap.Error(err))
+				}
+			}(ss)
+		}
+		bucket, err = rate.NewPersistentBucket(&cfg.RateLimit, ss.BucketStore())
+		if err != nil {
+			log.Error("Failed to restore rate limit bucket", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+	// Each delivery profile draws from a bucket of its own, shared between instances like the
+	// global one with the redis driver.
+	profileBuckets := make([]rate.Bucket, len(cfg.Delivery.Profiles))
+	for i, p := range cfg.Delivery.Profiles {
+		profileBuckets[i] = rate.NewMemoryBucket(p.RateLimit.Bucket())
+	}
+	if cfg.Store.Driver == "redis" || cfg.RateLimit.Driver == "redis" {
+		rs, err := store.NewRedis(&cfg.Store.Redis)
+		if err != nil {
+			log.Error("Failed to initialize redis store", zap.Error(err))
+			os.Exit(1)
+		}
+		defer func(rs *store.Redis) {
+			if err := rs.Close(); err != nil {
+				log.Error("Failed to close redis store", zap.Error(err))
+			}
+		}(rs)
+		if cfg.Store.Driver == "redis" {
+			taskStore = rs.Tasks(cfg.Scheduler.StatusRetention)
+			queue = rs.Queue()
+			messageStore = rs.Messages(cfg.Store.MessageRetention)
+			subscriptionStore = rs.Webhooks()
+			suppressionStore = rs.Suppressions()
+		}
+		if cfg.RateLimit.Driver == "redis" {
+			bucket = rs.Bucket(&cfg.RateLimit)
+			for i, p := range cfg.Delivery.Profiles {
+				profileBuckets[i] = rs.ProfileBucket(p.Name, p.RateLimit.Bucket())
+			}
+		}
+	}
+
+	var spill rate.Queue
+	if cfg.RateLimit.OverflowPolicy == rate.OverflowSpill {
+		ss, err := store.NewBolt(cfg.RateLimit.SpillPath)
+		if err != nil {
+			log.Error("Failed to open rate limit spill queue", zap.Error(err))
+			os.Exit(1)
+		}
+		defer func(ss *store.Bolt) {
+			if err := ss.Close(); err != nil {
+				log.Error("Failed to close rate limit spill queue", zap.Error(err))
+			}
+		}(ss)
+		spill = ss.Queue()
 	}
 
-	rl, err := rate.New(&cfg.RateLimit, log)
+	webhooks := webhook.New(&cfg.Webhooks, log)
+	defer webhooks.Stop()
+
+	// Every send and every email put on the rate limit queue is recorded in the message log,
+	// which notifies the webhook subscriptions of the changes.
+	msgLog := messages.NewLog(messageStore, log)
+	hooks := webhook.NewSubscriptions(subscriptionStore, webhooks, log)
+	msgLog.Observe(func(msg messages.Message, event messages.Event) {
+		switch event.Status {
+		case messages.StatusSent:
+			hooks.Publish(webhook.EventEmailSent, msg)
+		case messages.StatusFailed:
+			hooks.Publish(webhook.EventEmailFailed, msg)
+		case messages.StatusQueued:
+			hooks.Publish(webhook.EventEmailQueued, msg)
+		case messages.StatusBounced:
+			hooks.Publish(webhook.EventEmailBounced, msg)
+		case messages.StatusComplained:
+			hooks.Publish(webhook.EventEmailComplained, msg)
+		}
+	})
+	// Suppressed recipients are left out of every send, and reported in its record.
+	suppressions := suppression.NewList(suppressionStore, log)
+	sender = messages.NewSender(suppression.NewSender(sender, suppressions), msgLog)
+	queue = messages.NewQueue(queue, msgLog)
+	if spill != nil {
+		spill = messages.NewQueue(spill, msgLog)
+	}
+
+	rl, err := rate.New(&cfg.RateLimit, log, sender, queue, bucket, spill)
 	if err != nil {
 		log.Error("Failed to initialize rate limiter", zap.Error(err))
 		os.Exit(1)
 	}
+	for i, p := range cfg.Delivery.Profiles {
+		if err := rl.AddProfile(p.Name, &p.RateLimit, profileBuckets[i]); err != nil {
+			log.Error("Failed to initialize rate limiter", zap.Error(err))
+			os.Exit(1)
+		}
+	}
 	rl.Start()
 	defer rl.Stop()
 
-	sched := scheduler.New(log, sender, tm, rl)
+	sched := scheduler.New(&cfg.Scheduler, log, sender, tm, rl, taskStore, webhooks)
 	sched.Start()
 	defer sched.Stop()
 
-	srv := server.New(cfg, log, sender, tm, rl, sched)
+	health := email.NewHealthChecker(sender, &cfg.Delivery.HealthCheck, log)
+	health.Start()
+	defer health.Stop()
+
+	bounces := bounce.NewPoller(&cfg.Bounces, msgLog, suppressions, log)
+	bounces.Start()
+	defer bounces.Stop()
+
+	srv := server.New(cfg, log, sender, tm, rl, sched, msgLog, hooks, suppressions, health)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -77,13 +315,46 @@ func main() {
 			os.Exit(1)
 		}
 	}()
+	go func() {
+		if err := srv.StartGRPC(); err != nil {
+			log.Error("Failed to start gRPC server", zap.Error(err))
+			os.Exit(1)
+		}
+	}()
+	go func() {
+		if err := srv.StartAdmin(); err != nil {
+			log.Error("Failed to start admin server", zap.Error(err))
+			os.Exit(1)
+		}
+	}()
 
+	// SIGHUP reloads the configuration and the templates, and the TLS certificate. The
+	// configuration in effect only changes for the settings the reload applied.
+	reloader := &reloader{opts: opts, log: log, smtp: smtpSender, rl: rl, tm: tm}
+	reloader.watchVault(cfg)
+	defer reloader.stopVault()
+	current := cfg
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		current = reloader.reload(current)
+		if err := srv.ReloadCertificate(); err != nil {
+			log.Error("Failed to reload TLS certificate, keeping the previous one", zap.Error(err))
+		} else if cfg.Server.TLS.CertFile != "" {
+			log.Info("TLS certificate reloaded", zap.String("cert_file", cfg.Server.TLS.CertFile))
+		}
+	}
 
-	log.Info("Received shutdown signal, stopping services")
-	if err := srv.Shutdown(); err != nil {
+	log.Info("Received shutdown signal, stopping services", zap.Duration("timeout", cfg.Server.ShutdownTimeout))
+	// Requests in progress, scheduled emails being sent and queued emails share the timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
 		log.Error("Failed to shutdown HTTP server", zap.Error(err))
 	}
+	sched.Shutdown(ctx)
+	rl.Shutdown(ctx)
 }
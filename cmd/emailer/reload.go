@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/email"
+	"runebird/internal/logger"
+	"runebird/internal/rate"
+	"runebird/internal/templates"
+)
+
+// reloader applies the configuration file again on SIGHUP, without restarting the listeners
+// or the scheduler.
+type reloader struct {
+	// opts are the command-line flags, which keep overriding the config file.
+	opts config.Options
+	log  *logger.Logger
+	smtp *email.SMTPSender
+	rl   *rate.Limiter
+	tm   *templates.TemplateManager
+	// stopVault stops renewing the secrets read from Vault.
+	stopVault func()
+}
+
+// reloadable reports whether a change to field takes effect on reload: the log level, the
+// send rate and burst size, and the SMTP profiles if emails are delivered over SMTP. Other
+// settings take effect on restart.
+func (r *reloader) reloadable(field string) bool {
+	switch field {
+	case "logging.level", "rate_limit.per_hour", "rate_limit.burst":
+		return true
+	}
+	return r.smtp != nil && (field == "smtp" || strings.HasPrefix(field, "smtp."))
+}
+
+// reload loads the configuration again and applies the settings in which it differs from
+// current that can change while RuneBird runs, then reloads the templates. Every changed
+// setting is logged. It returns current with the settings that were applied.
+func (r *reloader) reload(current *config.Config) *config.Config {
+	r.log.Info("Reloading configuration")
+	next, err := config.LoadWith(r.opts)
+	if err != nil {
+		r.log.Error("Failed to reload configuration, keeping the current one", zap.Error(err))
+		r.reloadTemplates()
+		return current
+	}
+
+	applied := *current
+	var logLevel, limits, smtp bool
+	for _, change := range config.Diff(current, next) {
+		fields := []zap.Field{zap.String("field", change.Field), zap.String("old", change.Old), zap.String("new", change.New)}
+		if !r.reloadable(change.Field) {
+			r.log.Warn("Configuration setting changed, restart to apply it", fields...)
+			continue
+		}
+		r.log.Info("Configuration setting changed", fields...)
+		switch {
+		case change.Field == "logging.level":
+			logLevel = true
+		case strings.HasPrefix(change.Field, "rate_limit."):
+			limits = true
+		default:
+			smtp = true
+		}
+	}
+
+	if logLevel {
+		if err := r.log.SetLevel(next.Logging.Level); err != nil {
+			r.log.Error("Failed to change log level", zap.Error(err))
+		} else {
+			applied.Logging.Level = next.Logging.Level
+		}
+	}
+	if limits {
+		if err := r.rl.SetLimits(&next.RateLimit); err != nil {
+			r.log.Error("Failed to change rate limits", zap.Error(err))
+		} else {
+			applied.RateLimit.PerHour, applied.RateLimit.Burst = next.RateLimit.PerHour, next.RateLimit.Burst
+		}
+	}
+	if smtp {
+		if err := r.smtp.Reload(&next.SMTP); err != nil {
+			r.log.Error("Failed to reload SMTP profiles", zap.Error(err))
+		} else {
+			applied.SMTP = next.SMTP
+			// The SMTP credentials now renewed are those the new configuration references.
+			r.watchVault(next)
+		}
+	}
+	r.reloadTemplates()
+	r.log.Info("Configuration reloaded")
+	return &applied
+}
+
+func (r *reloader) reloadTemplates() {
+	if err := r.tm.Reload(); err != nil {
+		r.log.Error("Failed to reload some templates, keeping their previous versions", zap.Error(err))
+		return
+	}
+	r.log.Info("Templates reloaded", zap.Int("count", len(r.tm.ListTemplates())))
+}
+
+// watchVault renews the secrets of cfg read from Vault until stopVault is called, replacing the
+// SMTP credentials as they are renewed, and stops renewing those of the previous configuration.
+// Other secrets keep the values read when the configuration was loaded.
+func (r *reloader) watchVault(cfg *config.Config) {
+	if r.stopVault != nil {
+		r.stopVault()
+	}
+	r.stopVault = func() {}
+	vault := cfg.VaultClient()
+	if vault == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopVault = cancel
+	go vault.Watch(ctx, cfg, func(renewed *config.Config) {
+		if r.smtp != nil {
+			if err := r.smtp.UpdateCredentials(&renewed.SMTP); err != nil {
+				r.log.Error("Failed to update SMTP credentials from Vault", zap.Error(err))
+				return
+			}
+		}
+		r.log.Info("Secrets renewed from Vault")
+	}, func(err error) {
+		r.log.Error("Failed to renew secrets from Vault, retrying", zap.Error(err))
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"runebird/internal/config"
+	"runebird/internal/email"
+	"runebird/internal/templates"
+)
+
+// validate runs the validate subcommand, which checks the configuration and the templates as
+// the service would load them on startup, without starting it. With -probe it also connects
+// to the delivery provider of the default sender and of every delivery profile. Each check is
+// reported on a line of stdout, and the exit status is 1 if any of them failed.
+func validate(name string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	options := configFlags(fs)
+	probe := fs.Bool("probe", false, "also connect to the delivery providers")
+	if err := parseArgs(fs, args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	failed := false
+	report := func(check string, err error) {
+		if err != nil {
+			failed = true
+			_, _ = fmt.Fprintf(stdout, "FAIL  %s: %v\n", check, err)
+			return
+		}
+		_, _ = fmt.Fprintf(stdout, "ok    %s\n", check)
+	}
+
+	cfg, err := config.LoadWith(options())
+	report("config", err)
+	if err != nil {
+		return 1
+	}
+
+	reports, err := templates.Preflight(&cfg.Templates)
+	if err != nil {
+		report("templates", err)
+	}
+	for _, r := range reports {
+		err := r.Err
+		if err == nil && len(r.Issues) > 0 {
+			messages := make([]string, len(r.Issues))
+			for i, issue := range r.Issues {
+				messages[i] = issue.Message
+			}
+			err = fmt.Errorf("%s", strings.Join(messages, "; "))
+		}
+		report("template "+r.Name, err)
+	}
+
+	if *probe {
+		report("delivery "+cfg.Delivery.Provider, probeDelivery(cfg))
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// probeDelivery creates the senders of cfg and probes them within the health check timeout.
+func probeDelivery(cfg *config.Config) error {
+	sender, err := email.New(cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Delivery.Profiles) > 0 {
+		sender, err = email.NewRouter(sender, cfg.Delivery.Profiles)
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Delivery.HealthCheck.Timeout)
+	defer cancel()
+	return sender.Probe(ctx)
+}
@@ -0,0 +1,428 @@
+// Package auth authenticates API requests by validating the JWT bearer tokens of an OpenID
+// Connect or OAuth 2.0 issuer against the keys it publishes as a JSON Web Key Set.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"runebird/internal/config"
+)
+
+var (
+	// ErrInvalidToken is returned for a token that is malformed, not signed by the issuer, or
+	// not valid for this service at this time.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrKeysUnavailable is returned when the issuer's signing keys cannot be fetched, so that
+	// no token can be validated.
+	ErrKeysUnavailable = errors.New("signing keys unavailable")
+)
+
+// minRefetchInterval is how long after fetching the keys a token signed with an unknown key
+// causes them to be fetched again, so that such tokens cannot flood the issuer with requests.
+const minRefetchInterval = 30 * time.Second
+
+// maxDocumentSize bounds the discovery documents and key sets read from the issuer.
+const maxDocumentSize = 1 << 20
+
+// Claims are the claims of a validated token used by the service.
+type Claims struct {
+	Subject string
+	Scopes  []string
+}
+
+// HasScope reports whether the token grants scope.
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
+
+// Verifier validates tokens against the issuer's keys, which it caches.
+type Verifier struct {
+	cfg  *config.JWTConfig
+	http *http.Client
+	now  func() time.Time
+
+	mu      sync.Mutex
+	jwksURL string
+	keys    map[string][]jwk
+	fetched time.Time
+}
+
+// New creates a new Verifier based on the provided JWT configuration.
+func New(cfg *config.JWTConfig) *Verifier {
+	return &Verifier{
+		cfg:     cfg,
+		http:    &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+		jwksURL: cfg.JWKSURL,
+	}
+}
+
+// Verify validates token and returns its claims. It returns an error wrapping ErrInvalidToken
+// if the token is not valid, or ErrKeysUnavailable if the keys to validate it with could not
+// be fetched.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header: %v", ErrInvalidToken, err)
+	}
+	alg, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature: %v", ErrInvalidToken, err)
+	}
+
+	keys, err := v.keysFor(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if key.Alg != "" && key.Alg != header.Alg {
+			continue
+		}
+		if alg.verify(key.public, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature does not match the issuer's keys", ErrInvalidToken)
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.validate(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return &Claims{Subject: claims.Subject, Scopes: claims.scopes()}, nil
+}
+
+// tokenClaims are the registered claims of a token and the claims granting it scopes: scope, a
+// space-separated string, or scp, a string or a list of strings as issued by some providers.
+type tokenClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  stringList      `json:"aud"`
+	Expiry    *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scp       json.RawMessage `json:"scp"`
+}
+
+func (c *tokenClaims) scopes() []string {
+	scopes := strings.Fields(c.Scope)
+	var scp stringList
+	if json.Unmarshal(c.Scp, &scp) == nil {
+		for _, s := range scp {
+			scopes = append(scopes, strings.Fields(s)...)
+		}
+	}
+	return scopes
+}
+
+// stringList is a JSON string or list of strings.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+func (v *Verifier) validate(c *tokenClaims) error {
+	if c.Issuer != v.cfg.Issuer {
+		return fmt.Errorf("issued by %q, not %q", c.Issuer, v.cfg.Issuer)
+	}
+	if v.cfg.Audience != "" && !slices.Contains(c.Audience, v.cfg.Audience) {
+		return fmt.Errorf("not intended for audience %q", v.cfg.Audience)
+	}
+	now := v.now()
+	if c.Expiry == nil {
+		return errors.New("no expiry")
+	}
+	if now.After(unixTime(*c.Expiry).Add(v.cfg.Leeway)) {
+		return errors.New("expired")
+	}
+	if c.NotBefore != nil && now.Add(v.cfg.Leeway).Before(unixTime(*c.NotBefore)) {
+		return errors.New("not valid yet")
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// algorithm verifies signatures made with a JWS algorithm.
+type algorithm struct {
+	verify func(key crypto.PublicKey, signed, signature []byte) bool
+}
+
+// algorithms are the asymmetric JWS algorithms accepted. Unsecured tokens and HMAC, which
+// would need a secret shared with the issuer, are not.
+var algorithms = map[string]algorithm{
+	"RS256": rsaPKCS1(crypto.SHA256),
+	"RS384": rsaPKCS1(crypto.SHA384),
+	"RS512": rsaPKCS1(crypto.SHA512),
+	"PS256": rsaPSS(crypto.SHA256),
+	"PS384": rsaPSS(crypto.SHA384),
+	"PS512": rsaPSS(crypto.SHA512),
+	"ES256": ecdsaSignature(crypto.SHA256, elliptic.P256()),
+	"ES384": ecdsaSignature(crypto.SHA384, elliptic.P384()),
+	"ES512": ecdsaSignature(crypto.SHA512, elliptic.P521()),
+	"EdDSA": {verify: func(key crypto.PublicKey, signed, signature []byte) bool {
+		k, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, signed, signature)
+	}},
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func rsaPKCS1(hash crypto.Hash) algorithm {
+	return algorithm{verify: func(key crypto.PublicKey, signed, signature []byte) bool {
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, hash, digest(hash, signed), signature) == nil
+	}}
+}
+
+func rsaPSS(hash crypto.Hash) algorithm {
+	return algorithm{verify: func(key crypto.PublicKey, signed, signature []byte) bool {
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(k, hash, digest(hash, signed), signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	}}
+}
+
+// ecdsaSignature verifies the JWS encoding of ECDSA signatures, the two integers r and s
+// padded to the size of the curve and concatenated.
+func ecdsaSignature(hash crypto.Hash, curve elliptic.Curve) algorithm {
+	return algorithm{verify: func(key crypto.PublicKey, signed, signature []byte) bool {
+		k, ok := key.(*ecdsa.PublicKey)
+		size := (curve.Params().BitSize + 7) / 8
+		if !ok || k.Curve != curve || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest(hash, signed), r, s)
+	}}
+}
+
+// jwk is a signing key of a JSON Web Key Set, with its public key once parsed.
+type jwk struct {
+	Kty    string `json:"kty"`
+	Kid    string `json:"kid"`
+	Use    string `json:"use"`
+	Alg    string `json:"alg"`
+	N      string `json:"n"`
+	E      string `json:"e"`
+	Crv    string `json:"crv"`
+	X      string `json:"x"`
+	Y      string `json:"y"`
+	public crypto.PublicKey
+}
+
+// keysFor returns the keys a token with key ID kid may be signed with: those with that ID, or
+// all of them for a token without one. The keys are fetched if they have not been within the
+// refresh interval or, not more often than minRefetchInterval, if none has that ID. Keys that
+// cannot be fetched again are used until they can.
+func (v *Verifier) keysFor(ctx context.Context, kid string) ([]jwk, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	stale := v.keys == nil || now.Sub(v.fetched) >= v.cfg.RefreshInterval
+	unknown := v.keys != nil && len(v.keys[kid]) == 0 && now.Sub(v.fetched) >= minRefetchInterval
+	if stale || unknown {
+		keys, err := v.fetchKeys(ctx)
+		if err == nil {
+			v.keys = keys
+		} else if v.keys == nil {
+			return nil, fmt.Errorf("%w: %v", ErrKeysUnavailable, err)
+		}
+		// A failed fetch is not retried until minRefetchInterval has passed either.
+		v.fetched = now
+	}
+
+	if keys := v.keys[kid]; len(keys) > 0 {
+		return keys, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// fetchKeys fetches the key set, indexed by key ID and, for tokens without one, under "".
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string][]jwk, error) {
+	if v.jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, strings.TrimSuffix(v.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("failed to discover the issuer's keys: %v", err)
+		}
+		if discovery.Issuer != v.cfg.Issuer {
+			return nil, fmt.Errorf("discovery document is for issuer %q, not %q", discovery.Issuer, v.cfg.Issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("discovery document has no jwks_uri")
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(ctx, v.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch the issuer's keys: %v", err)
+	}
+	keys := make(map[string][]jwk)
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		public, err := key.publicKey()
+		if err != nil {
+			// Keys of unsupported types are skipped, as RFC 7517 requires.
+			continue
+		}
+		key.public = public
+		keys[key.Kid] = append(keys[key.Kid], key)
+		if key.Kid != "" {
+			keys[""] = append(keys[""], key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key set has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (v *Verifier) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxDocumentSize)).Decode(dst)
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var point ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, point = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, point = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, point = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key")
+		}
+		// Parsing the uncompressed point checks that it is on the curve.
+		if _, err := point.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
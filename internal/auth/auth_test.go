@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"runebird/internal/config"
+)
+
+// signer signs tokens with a private key published under kid.
+type signer struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func (s signer) jwk() map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": b64(pub)}
+	}
+	return nil
+}
+
+func (s signer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	var err error
+	switch s.alg {
+	case "RS256":
+		signature, err = s.key.Sign(rand.Reader, digest(crypto.SHA256, []byte(signed)), crypto.SHA256)
+	case "PS256":
+		signature, err = s.key.Sign(rand.Reader, digest(crypto.SHA256, []byte(signed)), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	case "ES256":
+		var r, sv *big.Int
+		r, sv, err = ecdsa.Sign(rand.Reader, s.key.(*ecdsa.PrivateKey), digest(crypto.SHA256, []byte(signed)))
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), sv.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(s.key.(ed25519.PrivateKey), []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate EC key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate Ed25519 key: %v", err)
+	}
+	signers := []signer{
+		{kid: "rsa", alg: "RS256", key: rsaKey},
+		{kid: "rsa", alg: "PS256", key: rsaKey},
+		{kid: "ec", alg: "ES256", key: ecKey},
+		{kid: "ed", alg: "EdDSA", key: edKey},
+	}
+
+	var published atomic.Value
+	published.Store([]signer{signers[0], signers[2], signers[3]})
+	var fetches atomic.Int32
+	var issuer string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/keys"})
+		case "/keys":
+			fetches.Add(1)
+			var keys []map[string]string
+			for _, s := range published.Load().([]signer) {
+				keys = append(keys, s.jwk())
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	issuer = srv.URL
+
+	now := time.Now()
+	cfg := &config.JWTConfig{Issuer: issuer, Audience: "runebird", Leeway: time.Minute, RefreshInterval: time.Hour}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   issuer,
+			"sub":   "client-1",
+			"aud":   []string{"runebird", "other"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"scope": "send schedule",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	t.Run("ValidTokens", func(t *testing.T) {
+		v := New(cfg)
+		for _, s := range signers {
+			got, err := v.Verify(context.Background(), s.sign(t, claims(nil)))
+			if err != nil {
+				t.Fatalf("%s: expected token to be valid, got %v", s.alg, err)
+			}
+			if got.Subject != "client-1" || !got.HasScope("send") || !got.HasScope("schedule") || got.HasScope("admin") {
+				t.Errorf("%s: unexpected claims %+v", s.alg, got)
+			}
+		}
+		if n := fetches.Load(); n != 1 {
+			t.Errorf("expected the keys to be fetched once, got %d", n)
+		}
+	})
+
+	t.Run("ScpClaim", func(t *testing.T) {
+		token := signers[3].sign(t, claims(map[string]interface{}{"scope": nil, "scp": []string{"admin"}}))
+		got, err := New(cfg).Verify(context.Background(), token)
+		if err != nil {
+			t.Fatalf("expected token to be valid, got %v", err)
+		}
+		if !got.HasScope("admin") || got.HasScope("send") {
+			t.Errorf("expected only the admin scope, got %v", got.Scopes)
+		}
+	})
+
+	t.Run("InvalidTokens", func(t *testing.T) {
+		v := New(cfg)
+		valid := signers[0].sign(t, claims(nil))
+		parts := strings.Split(valid, ".")
+		none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+		tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+issuer+`","exp":9999999999,"scope":"admin"}`)) + "." + parts[2]
+
+		tests := map[string]string{
+			"Malformed":         "not-a-token",
+			"AlgorithmNone":     none,
+			"Tampered":          tampered,
+			"WrongIssuer":       signers[0].sign(t, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			"WrongAudience":     signers[0].sign(t, claims(map[string]interface{}{"aud": "other"})),
+			"Expired":           signers[0].sign(t, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+			"NoExpiry":          signers[0].sign(t, claims(map[string]interface{}{"exp": nil})),
+			"NotYetValid":       signers[0].sign(t, claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})),
+			"UnknownKey":        signer{kid: "unknown", alg: "EdDSA", key: edKey}.sign(t, claims(nil)),
+			"KeyTypeMismatched": signer{kid: "ec", alg: "RS256", key: rsaKey}.sign(t, claims(nil)),
+		}
+		for name, token := range tests {
+			if _, err := v.Verify(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("%s: expected ErrInvalidToken, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("Leeway", func(t *testing.T) {
+		token := signers[0].sign(t, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}))
+		if _, err := New(cfg).Verify(context.Background(), token); err != nil {
+			t.Errorf("expected a token expired within the leeway to be valid, got %v", err)
+		}
+	})
+
+	t.Run("KeyRotation", func(t *testing.T) {
+		v := New(cfg)
+		if _, err := v.Verify(context.Background(), signers[0].sign(t, claims(nil))); err != nil {
+			t.Fatalf("expected token to be valid, got %v", err)
+		}
+
+		_, rotated, _ := ed25519.GenerateKey(rand.Reader)
+		next := signer{kid: "rotated", alg: "EdDSA", key: rotated}
+		published.Store([]signer{next})
+		token := next.sign(t, claims(nil))
+		if _, err := v.Verify(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("expected the new key not to be fetched again so soon, got %v", err)
+		}
+
+		v.now = func() time.Time { return time.Now().Add(minRefetchInterval) }
+		if _, err := v.Verify(context.Background(), token); err != nil {
+			t.Errorf("expected the new key to be fetched, got %v", err)
+		}
+		published.Store([]signer{signers[0], signers[2], signers[3]})
+	})
+
+	t.Run("KeysUnavailable", func(t *testing.T) {
+		v := New(&config.JWTConfig{Issuer: issuer, JWKSURL: issuer + "/missing", RefreshInterval: time.Hour})
+		if _, err := v.Verify(context.Background(), signers[0].sign(t, claims(nil))); !errors.Is(err, ErrKeysUnavailable) {
+			t.Errorf("expected ErrKeysUnavailable, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,172 @@
+// Package bounce receives the bounce and complaint notifications of email providers, traces them
+// to the messages they are about and puts the addresses that must not be sent to again on the
+// suppression list.
+package bounce
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/logger"
+	"runebird/internal/messages"
+	"runebird/internal/suppression"
+)
+
+// The providers notifications are received from.
+const (
+	ProviderSES      = "ses"
+	ProviderSendGrid = "sendgrid"
+	ProviderMailgun  = "mailgun"
+)
+
+// ErrProviderDisabled is returned for notifications from a provider that is not enabled.
+var ErrProviderDisabled = errors.New("bounce notifications are not enabled for the provider")
+
+// ErrInvalidSignature is returned, wrapped with the reason, for a notification whose signature
+// does not verify.
+var ErrInvalidSignature = errors.New("invalid notification signature")
+
+// ErrInvalidNotification is returned, wrapped with the reason, for a notification that cannot
+// be parsed.
+var ErrInvalidNotification = errors.New("invalid notification")
+
+// Type is what a notification reports.
+type Type string
+
+const (
+	TypeBounce    Type = "bounce"
+	TypeComplaint Type = "complaint"
+)
+
+// Notification is a bounce or complaint for one recipient of a message. MessageID is the
+// provider's ID for the message, and Permanent marks a hard bounce, after which the address
+// must not be sent to again.
+type Notification struct {
+	Provider   string
+	Type       Type
+	MessageID  string
+	Recipient  string
+	Permanent  bool
+	Code       int
+	Diagnostic string
+}
+
+// Receiver handles the notifications of the providers enabled in its config: each bounce or
+// complaint is recorded on the message it is about, and hard bounces and complaints add the
+// address to the suppression list.
+type Receiver struct {
+	cfg          *config.BouncesConfig
+	messages     *messages.Log
+	suppressions *suppression.List
+	logger       *logger.Logger
+	// http fetches SNS signing certificates and confirms SNS subscriptions.
+	http *http.Client
+	// trustedSNSHost reports whether SNS certificates and subscriptions may be fetched from a
+	// host.
+	trustedSNSHost func(host string) bool
+	certs          map[string]*x509.Certificate
+	mu             sync.Mutex
+}
+
+// NewReceiver creates a Receiver recording notifications in msgs and suppressions.
+func NewReceiver(cfg *config.BouncesConfig, msgs *messages.Log, suppressions *suppression.List, log *logger.Logger) *Receiver {
+	return &Receiver{
+		cfg:            cfg,
+		messages:       msgs,
+		suppressions:   suppressions,
+		logger:         log,
+		http:           &http.Client{Timeout: 10 * time.Second},
+		trustedSNSHost: isSNSHost,
+		certs:          make(map[string]*x509.Certificate),
+	}
+}
+
+// Receive verifies and handles the request body of a notification from provider, with the
+// request's header, and returns the notifications it carried.
+func (r *Receiver) Receive(ctx context.Context, provider string, header http.Header, body []byte) ([]Notification, error) {
+	var notifications []Notification
+	var err error
+	switch {
+	case provider == ProviderSES && r.cfg.SES.Enabled:
+		notifications, err = r.parseSES(ctx, body)
+	case provider == ProviderSendGrid && r.cfg.SendGrid.Enabled:
+		notifications, err = parseSendGrid(r.cfg.SendGrid.PublicKey, header, body)
+	case provider == ProviderMailgun && r.cfg.Mailgun.Enabled:
+		notifications, err = parseMailgun(r.cfg.Mailgun.SigningKey, body)
+	default:
+		return nil, ErrProviderDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range notifications {
+		if err := r.handle(n); err != nil {
+			return nil, err
+		}
+	}
+	return notifications, nil
+}
+
+// handle records n on its message, if the message is still known, and suppresses the recipient
+// of a hard bounce or a complaint.
+func (r *Receiver) handle(n Notification) error {
+	n.Recipient = suppression.Normalize(n.Recipient)
+	fields := []zap.Field{zap.String("provider", n.Provider), zap.String("type", string(n.Type)), zap.String("message_id", n.MessageID), zap.String("recipient", n.Recipient), zap.Bool("permanent", n.Permanent)}
+
+	status := messages.StatusBounced
+	if n.Type == TypeComplaint {
+		status = messages.StatusComplained
+	}
+	msg, err := r.messages.Bounce(n.MessageID, messages.Event{Status: status, Recipient: n.Recipient, ResponseCode: n.Code, Response: n.Diagnostic})
+	switch {
+	case err == nil:
+		fields = append(fields, zap.String("id", msg.ID))
+	case errors.Is(err, messages.ErrMessageNotFound):
+		r.logger.Info("Notification for an unknown message", fields...)
+	default:
+		r.logger.Error("Failed to record notification", append(fields, zap.Error(err))...)
+	}
+
+	if n.Type != TypeComplaint && !n.Permanent {
+		r.logger.Info("Soft bounce received", fields...)
+		return nil
+	}
+	if n.Recipient == "" {
+		r.logger.Warn("Notification without a recipient", fields...)
+		return nil
+	}
+	entry := suppression.Entry{Address: n.Recipient, Reason: suppression.ReasonBounced, Note: n.Provider + " bounce"}
+	if n.Type == TypeComplaint {
+		entry.Reason, entry.Note = suppression.ReasonComplained, n.Provider+" complaint"
+	}
+	if n.Diagnostic != "" {
+		entry.Note += ": " + n.Diagnostic
+	}
+	if _, err := r.suppressions.Add(entry); err != nil {
+		if errors.Is(err, suppression.ErrInvalidEntry) {
+			r.logger.Warn("Notification for an invalid address", append(fields, zap.Error(err))...)
+			return nil
+		}
+		return fmt.Errorf("failed to suppress %s: %v", n.Recipient, err)
+	}
+	r.logger.Info("Address suppressed after a notification", append(fields, zap.String("reason", string(entry.Reason)))...)
+	return nil
+}
+
+// truncate shortens a diagnostic from a provider to the length kept in a note.
+func truncate(s string) string {
+	const maxDiagnostic = 500
+	s = strings.TrimSpace(s)
+	if len(s) > maxDiagnostic {
+		return s[:maxDiagnostic]
+	}
+	return s
+}
@@ -0,0 +1,452 @@
+package bounce
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+	"runebird/internal/config"
+	"runebird/internal/email"
+	"runebird/internal/logger"
+	"runebird/internal/messages"
+	"runebird/internal/suppression"
+)
+
+func TestReceiver(t *testing.T) {
+	newReceiver := func(t *testing.T, cfg *config.BouncesConfig) (*Receiver, *messages.Log, *suppression.List) {
+		log := &logger.Logger{Logger: zaptest.NewLogger(t)}
+		msgs := messages.NewLog(messages.NewMemoryStore(time.Hour), log)
+		suppressions := suppression.NewList(suppression.NewMemoryStore(), log)
+		return NewReceiver(cfg, msgs, suppressions, log), msgs, suppressions
+	}
+	sent := func(msgs *messages.Log, id, messageID string) {
+		msg := email.Message{ID: id, Recipients: []string{"user@example.com", "other@example.com"}}
+		msgs.Accept(msg)
+		msgs.Sent(msg, email.Result{Provider: "test", MessageID: messageID})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		r, _, _ := newReceiver(t, &config.BouncesConfig{})
+		for _, provider := range []string{ProviderSES, ProviderSendGrid, ProviderMailgun, "other"} {
+			if _, err := r.Receive(context.Background(), provider, http.Header{}, []byte("{}")); !errors.Is(err, ErrProviderDisabled) {
+				t.Errorf("expected %v for %s, got: %v", ErrProviderDisabled, provider, err)
+			}
+		}
+	})
+
+	t.Run("SES", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sns.amazonaws.com"}, NotAfter: time.Now().Add(time.Hour)}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+		if err != nil {
+			t.Fatalf("failed to create certificate: %v", err)
+		}
+		var confirmed atomic.Bool
+		sns := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/cert.pem":
+				_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+			case "/confirm":
+				confirmed.Store(true)
+			default:
+				http.NotFound(w, req)
+			}
+		}))
+		defer sns.Close()
+
+		r, msgs, suppressions := newReceiver(t, &config.BouncesConfig{SES: config.SESBouncesConfig{Enabled: true, TopicARNs: []string{"arn:aws:sns:eu-west-1:123:bounces"}}})
+		r.http = sns.Client()
+		r.trustedSNSHost = func(host string) bool { return host == "127.0.0.1" }
+		sign := func(msg snsMessage) []byte {
+			msg.SignatureVersion, msg.SigningCertURL = "2", sns.URL+"/cert.pem"
+			digest := sha256.Sum256([]byte(snsStringToSign(msg)))
+			sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+			msg.Signature = base64.StdEncoding.EncodeToString(sig)
+			body, _ := json.Marshal(msg)
+			return body
+		}
+
+		confirmation := snsMessage{Type: "SubscriptionConfirmation", MessageID: "1", Token: "token", TopicARN: "arn:aws:sns:eu-west-1:123:bounces", Message: "confirm", Timestamp: "2025-06-10T15:00:00Z", SubscribeURL: sns.URL + "/confirm"}
+		if _, err := r.Receive(context.Background(), ProviderSES, http.Header{}, sign(confirmation)); err != nil || !confirmed.Load() {
+			t.Fatalf("expected the subscription to be confirmed, got: %v", err)
+		}
+
+		sent(msgs, "msg-1", "0100018f-ses")
+		notification := snsMessage{Type: "Notification", MessageID: "2", TopicARN: "arn:aws:sns:eu-west-1:123:bounces", Timestamp: "2025-06-10T15:00:00Z",
+			Message: `{"notificationType":"Bounce","mail":{"messageId":"0100018f-ses"},"bounce":{"bounceType":"Permanent","bouncedRecipients":[{"emailAddress":"User@Example.com","status":"5.1.1","diagnosticCode":"smtp; 550 5.1.1 user unknown"}]}}`}
+		body := sign(notification)
+		tampered := strings.Replace(string(body), "Permanent", "Transient", 1)
+		if _, err := r.Receive(context.Background(), ProviderSES, http.Header{}, []byte(tampered)); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %v for a tampered message, got: %v", ErrInvalidSignature, err)
+		}
+		other := notification
+		other.TopicARN = "arn:aws:sns:eu-west-1:123:other"
+		if _, err := r.Receive(context.Background(), ProviderSES, http.Header{}, sign(other)); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %v for another topic, got: %v", ErrInvalidSignature, err)
+		}
+
+		notifications, err := r.Receive(context.Background(), ProviderSES, http.Header{}, body)
+		if err != nil || len(notifications) != 1 || !notifications[0].Permanent {
+			t.Fatalf("expected a hard bounce, got: %+v (%v)", notifications, err)
+		}
+		msg, _ := msgs.Get("msg-1")
+		last := msg.Events[len(msg.Events)-1]
+		if msg.Status != messages.StatusBounced || last.Recipient != "user@example.com" || !strings.Contains(last.Response, "user unknown") {
+			t.Errorf("expected the message to be bounced for the recipient, got: %+v", msg)
+		}
+		if entry, err := suppressions.Get("user@example.com"); err != nil || entry.Reason != suppression.ReasonBounced {
+			t.Errorf("expected the address to be suppressed, got: %+v (%v)", entry, err)
+		}
+	})
+
+	t.Run("SendGrid", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		r, msgs, suppressions := newReceiver(t, &config.BouncesConfig{SendGrid: config.SendGridBouncesConfig{Enabled: true, PublicKey: base64.StdEncoding.EncodeToString(der)}})
+		sent(msgs, "msg-1", "sg-abc")
+
+		body := []byte(`[{"email":"user@example.com","event":"bounce","type":"blocked","sg_message_id":"sg-abc.filter0001","reason":"mailbox full"},` +
+			`{"email":"other@example.com","event":"spamreport","sg_message_id":"sg-abc.filter0001"},{"email":"user@example.com","event":"delivered"}]`)
+		header := http.Header{}
+		header.Set(SendGridTimestampHeader, "1718031600")
+		digest := sha256.Sum256(append([]byte("1718031600"), body...))
+		sig, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		header.Set(SendGridSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+
+		if _, err := r.Receive(context.Background(), ProviderSendGrid, http.Header{}, body); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %v for an unsigned request, got: %v", ErrInvalidSignature, err)
+		}
+		notifications, err := r.Receive(context.Background(), ProviderSendGrid, header, body)
+		if err != nil || len(notifications) != 2 {
+			t.Fatalf("expected a bounce and a complaint, got: %+v (%v)", notifications, err)
+		}
+		if _, err := suppressions.Get("user@example.com"); !errors.Is(err, suppression.ErrNotSuppressed) {
+			t.Errorf("expected a soft bounce not to suppress the address, got: %v", err)
+		}
+		if entry, err := suppressions.Get("other@example.com"); err != nil || entry.Reason != suppression.ReasonComplained {
+			t.Errorf("expected the complaint to suppress the address, got: %+v (%v)", entry, err)
+		}
+		if msg, _ := msgs.Get("msg-1"); msg.Status != messages.StatusComplained {
+			t.Errorf("expected the message to be complained about, got: %s", msg.Status)
+		}
+	})
+
+	t.Run("Mailgun", func(t *testing.T) {
+		r, msgs, suppressions := newReceiver(t, &config.BouncesConfig{Mailgun: config.MailgunBouncesConfig{Enabled: true, SigningKey: "key"}})
+		sent(msgs, "msg-1", "<1718031600.abc@example.com>")
+
+		body := func(signature string) []byte {
+			return []byte(`{"signature":{"timestamp":"1718031600","token":"tok","signature":"` + signature + `"},"event-data":{"event":"failed","severity":"permanent","recipient":"user@example.com",` +
+				`"message":{"headers":{"message-id":"1718031600.abc@example.com"}},"delivery-status":{"code":550,"message":"No such user"}}}`)
+		}
+		if _, err := r.Receive(context.Background(), ProviderMailgun, http.Header{}, body("forged")); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %v, got: %v", ErrInvalidSignature, err)
+		}
+		notifications, err := r.Receive(context.Background(), ProviderMailgun, http.Header{}, body(MailgunSignature("key", "1718031600", "tok")))
+		if err != nil || len(notifications) != 1 || notifications[0].Code != 550 {
+			t.Fatalf("expected a hard bounce, got: %+v (%v)", notifications, err)
+		}
+		if msg, _ := msgs.Get("msg-1"); msg.Status != messages.StatusBounced {
+			t.Errorf("expected the message to be traced by its Message-ID, got: %s", msg.Status)
+		}
+		if _, err := suppressions.Get("user@example.com"); err != nil {
+			t.Errorf("expected the address to be suppressed, got: %v", err)
+		}
+	})
+
+	dsn := strings.ReplaceAll(`From: Mail Delivery System <MAILER-DAEMON@mx.example.com>
+To: bounces@runebird.app
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="b1"
+
+--b1
+Content-Type: text/plain
+
+Your message could not be delivered.
+
+--b1
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+Arrival-Date: Tue, 10 Jun 2025 15:00:00 +0000
+
+Final-Recipient: rfc822; user@example.com
+Original-Recipient: rfc822;user@example.com
+Action: failed
+Status: 5.1.1
+Diagnostic-Code: smtp; 550 5.1.1 <user@example.com>: Recipient address rejected:
+ User unknown
+
+Final-Recipient: rfc822; other@example.com
+Action: failed
+Status: 5.2.2
+Diagnostic-Code: smtp; 552 5.2.2 Mailbox full
+
+Final-Recipient: rfc822; third@example.com
+Action: delayed
+Status: 4.4.1
+
+--b1
+Content-Type: text/rfc822-headers
+
+From: RuneBird <noreply@runebird.app>
+To: user@example.com, other@example.com
+Message-ID: <1718031600.abc@runebird.app>
+Subject: Welcome
+
+--b1--
+`, "\n", "\r\n")
+	arf := strings.ReplaceAll(`From: abuse@isp.example
+To: bounces@runebird.app
+Subject: Abuse report
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=feedback-report; boundary="b2"
+
+--b2
+Content-Type: text/plain
+
+This is an abuse report.
+
+--b2
+Content-Type: message/feedback-report
+
+Feedback-Type: abuse
+User-Agent: ISP-FBL/1.0
+Version: 1
+
+--b2
+Content-Type: message/rfc822
+
+From: RuneBird <noreply@runebird.app>
+To: Other <other@example.com>
+Message-ID: <1718031600.abc@runebird.app>
+Subject: Welcome
+
+Hello
+--b2--
+`, "\n", "\r\n")
+	reply := "From: user@example.com\r\nTo: bounces@runebird.app\r\nSubject: Out of office\r\n\r\nI am away.\r\n"
+
+	t.Run("Reports", func(t *testing.T) {
+		notifications, ok := parseReport([]byte(dsn))
+		if !ok || len(notifications) != 2 {
+			t.Fatalf("expected two failed recipients, got: %+v (%v)", notifications, ok)
+		}
+		if n := notifications[0]; n.Recipient != "user@example.com" || !n.Permanent || n.Code != 550 || n.MessageID != "<1718031600.abc@runebird.app>" || !strings.Contains(n.Diagnostic, "User unknown") {
+			t.Errorf("expected a hard bounce for user@example.com, got: %+v", n)
+		}
+		if n := notifications[1]; n.Recipient != "other@example.com" || n.Permanent {
+			t.Errorf("expected a full mailbox to be a soft bounce, got: %+v", n)
+		}
+
+		notifications, ok = parseReport([]byte(arf))
+		if !ok || len(notifications) != 1 || notifications[0].Type != TypeComplaint || notifications[0].Recipient != "other@example.com" || notifications[0].Diagnostic != "abuse" {
+			t.Errorf("expected a complaint for other@example.com, got: %+v (%v)", notifications, ok)
+		}
+		if _, ok := parseReport([]byte(reply)); ok {
+			t.Error("expected a message that is not a report to be skipped")
+		}
+	})
+
+	pollMailbox := func(t *testing.T, protocol string, serve func(net.Conn, map[string]string, map[string]int)) {
+		mailbox := map[string]string{"1": dsn, "2": arf, "3": reply}
+		reads := make(map[string]int)
+		var mu sync.Mutex
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer func() {
+			_ = ln.Close()
+		}()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				serve(conn, mailbox, reads)
+				mu.Unlock()
+				_ = conn.Close()
+			}
+		}()
+
+		host, port, _ := net.SplitHostPort(ln.Addr().String())
+		cfg := &config.BouncesConfig{Mailbox: config.MailboxBouncesConfig{Enabled: true, Protocol: protocol, Host: host, Username: "bounces", Password: "secret", TLSMode: "none", Folder: "INBOX"}}
+		cfg.Mailbox.Port, _ = strconv.Atoi(port)
+		log := &logger.Logger{Logger: zaptest.NewLogger(t)}
+		msgs := messages.NewLog(messages.NewMemoryStore(time.Hour), log)
+		suppressions := suppression.NewList(suppression.NewMemoryStore(), log)
+		p := NewPoller(cfg, msgs, suppressions, log)
+		sent(msgs, "msg-1", "1718031600.abc@runebird.app")
+
+		notifications, err := p.Poll(context.Background())
+		if err != nil || len(notifications) != 3 {
+			t.Fatalf("expected the bounces and the complaint, got: %+v (%v)", notifications, err)
+		}
+		if msg, _ := msgs.Get("msg-1"); msg.Status != messages.StatusComplained {
+			t.Errorf("expected the reports to be recorded on the message, got: %s", msg.Status)
+		}
+		if entry, err := suppressions.Get("user@example.com"); err != nil || entry.Reason != suppression.ReasonBounced || !strings.HasPrefix(entry.Note, "mailbox bounce: 5.1.1") {
+			t.Errorf("expected the hard bounce to suppress the address, got: %+v (%v)", entry, err)
+		}
+		if entry, err := suppressions.Get("other@example.com"); err != nil || entry.Reason != suppression.ReasonComplained {
+			t.Errorf("expected the complaint to suppress the address, got: %+v (%v)", entry, err)
+		}
+
+		if notifications, err := p.Poll(context.Background()); err != nil || len(notifications) != 0 {
+			t.Errorf("expected nothing new, got: %+v (%v)", notifications, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := mailbox["3"]; len(mailbox) != 1 || !ok {
+			t.Errorf("expected only the message that is not a report to be left, got: %v", slices.Collect(maps.Keys(mailbox)))
+		}
+		if reads["3"] != 1 {
+			t.Errorf("expected the message that is not a report to be read once, got: %d", reads["3"])
+		}
+	}
+
+	t.Run("IMAP", func(t *testing.T) {
+		seen := make(map[string]bool)
+		pollMailbox(t, "imap", func(conn net.Conn, mailbox map[string]string, reads map[string]int) {
+			r := bufio.NewReader(conn)
+			_, _ = io.WriteString(conn, "* OK IMAP ready\r\n")
+			deleted := make(map[string]bool)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				fields := strings.Fields(line)
+				tag, cmd := fields[0], strings.Join(fields[1:], " ")
+				switch {
+				case strings.HasPrefix(cmd, "LOGIN"):
+					if cmd != `LOGIN "bounces" "secret"` {
+						_, _ = io.WriteString(conn, tag+" NO invalid credentials\r\n")
+						continue
+					}
+				case cmd == "UID SEARCH UNSEEN":
+					var uids []string
+					for uid := range mailbox {
+						if !seen[uid] {
+							uids = append(uids, uid)
+						}
+					}
+					slices.Sort(uids)
+					_, _ = io.WriteString(conn, strings.TrimSpace("* SEARCH "+strings.Join(uids, " "))+"\r\n")
+				case strings.HasPrefix(cmd, "UID FETCH "):
+					uid := fields[3]
+					seen[uid] = true
+					reads[uid]++
+					_, _ = fmt.Fprintf(conn, "* %s FETCH (UID %s FLAGS (\\Seen) BODY[] {%d}\r\n%s)\r\n", uid, uid, len(mailbox[uid]), mailbox[uid])
+				case strings.HasPrefix(cmd, "UID STORE "):
+					for _, uid := range strings.Split(fields[3], ",") {
+						deleted[uid] = true
+					}
+				case cmd == "EXPUNGE":
+					for uid := range deleted {
+						delete(mailbox, uid)
+					}
+				case cmd == "LOGOUT":
+					_, _ = io.WriteString(conn, "* BYE\r\n"+tag+" OK LOGOUT completed\r\n")
+					return
+				}
+				_, _ = io.WriteString(conn, tag+" OK completed\r\n")
+			}
+		})
+	})
+
+	t.Run("POP3", func(t *testing.T) {
+		pollMailbox(t, "pop3", func(conn net.Conn, mailbox map[string]string, reads map[string]int) {
+			text := textproto.NewConn(conn)
+			_ = text.PrintfLine("+OK POP3 ready")
+			// Messages are numbered by their order in the session, and named by their unique ID.
+			var ids []string
+			for id := range mailbox {
+				ids = append(ids, "uid-"+id)
+			}
+			slices.Sort(ids)
+			deleted := make(map[string]bool)
+			for {
+				line, err := text.ReadLine()
+				if err != nil {
+					return
+				}
+				cmd, arg, _ := strings.Cut(line, " ")
+				switch cmd {
+				case "USER", "PASS", "DELE":
+					if cmd == "PASS" && arg != "secret" {
+						_ = text.PrintfLine("-ERR invalid credentials")
+						continue
+					}
+					if cmd == "DELE" {
+						n, _ := strconv.Atoi(arg)
+						deleted[strings.TrimPrefix(ids[n-1], "uid-")] = true
+					}
+					_ = text.PrintfLine("+OK")
+				case "UIDL":
+					_ = text.PrintfLine("+OK")
+					w := text.DotWriter()
+					for i, id := range ids {
+						_, _ = fmt.Fprintf(w, "%d %s\n", i+1, id)
+					}
+					_ = w.Close()
+				case "RETR":
+					n, _ := strconv.Atoi(arg)
+					id := strings.TrimPrefix(ids[n-1], "uid-")
+					reads[id]++
+					_ = text.PrintfLine("+OK")
+					w := text.DotWriter()
+					_, _ = io.WriteString(w, strings.ReplaceAll(mailbox[id], "\r\n", "\n"))
+					_ = w.Close()
+				case "QUIT":
+					for id := range deleted {
+						delete(mailbox, id)
+					}
+					_ = text.PrintfLine("+OK bye")
+					return
+				default:
+					_ = text.PrintfLine("-ERR unknown command")
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,187 @@
+package bounce
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ProviderMailbox names the notifications read from the bounce mailbox.
+const ProviderMailbox = "mailbox"
+
+// parseReport returns the notifications in raw, a message from the bounce mailbox, and whether
+// it is a report at all: a delivery status notification (RFC 3464) or an abuse report in the
+// Abuse Reporting Format (RFC 5965). The message the report is about is named by the Message-ID
+// of the original message or headers the report includes.
+func parseReport(raw []byte) ([]Notification, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, false
+	}
+	reportType := strings.ToLower(params["report-type"])
+	if reportType != "delivery-status" && reportType != "feedback-report" {
+		return nil, false
+	}
+
+	var status, feedback []textproto.MIMEHeader
+	var original textproto.MIMEHeader
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			break
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch strings.ToLower(partType) {
+		case "message/delivery-status", "message/global-delivery-status":
+			status = readFieldGroups(part)
+		case "message/feedback-report":
+			feedback = readFieldGroups(part)
+		case "message/rfc822", "message/global", "text/rfc822-headers", "message/rfc822-headers", "message/global-headers":
+			original = readFieldGroup(bufio.NewReader(part))
+		}
+	}
+	messageID := original.Get("Message-Id")
+
+	if reportType == "feedback-report" {
+		return parseFeedbackReport(feedback, original, messageID), true
+	}
+	// The first group of a delivery status holds the fields about the message, and each of the
+	// others those about one recipient.
+	var notifications []Notification
+	for i, fields := range status {
+		if i == 0 {
+			continue
+		}
+		// Only failed deliveries are bounces; delays, deliveries and relays are not.
+		if !strings.EqualFold(strings.TrimSpace(fields.Get("Action")), "failed") {
+			continue
+		}
+		recipient := addressField(fields.Get("Final-Recipient"))
+		if recipient == "" {
+			recipient = addressField(fields.Get("Original-Recipient"))
+		}
+		code := strings.TrimSpace(fields.Get("Status"))
+		diagnostic := addressField(fields.Get("Diagnostic-Code"))
+		notifications = append(notifications, Notification{
+			Provider:   ProviderMailbox,
+			Type:       TypeBounce,
+			MessageID:  messageID,
+			Recipient:  recipient,
+			Permanent:  permanentStatus(code, diagnostic),
+			Code:       replyCode(diagnostic),
+			Diagnostic: truncate(strings.TrimSpace(code + " " + diagnostic)),
+		})
+	}
+	return notifications, true
+}
+
+// parseFeedbackReport returns the complaint in an abuse report, about the recipient the report
+// names or else the recipient the original message was addressed to.
+func parseFeedbackReport(feedback []textproto.MIMEHeader, original textproto.MIMEHeader, messageID string) []Notification {
+	if len(feedback) == 0 {
+		return nil
+	}
+	fields := feedback[0]
+	// A not-spam report withdraws an earlier complaint rather than making one.
+	kind := strings.ToLower(strings.TrimSpace(fields.Get("Feedback-Type")))
+	if kind == "not-spam" {
+		return nil
+	}
+	recipient := addressField(fields.Get("Original-Rcpt-To"))
+	if recipient == "" {
+		recipient = addressField(fields.Get("Removal-Recipient"))
+	}
+	if recipient == "" {
+		if addrs, err := mail.ParseAddressList(original.Get("To")); err == nil && len(addrs) == 1 {
+			recipient = addrs[0].Address
+		}
+	}
+	return []Notification{{
+		Provider:   ProviderMailbox,
+		Type:       TypeComplaint,
+		MessageID:  messageID,
+		Recipient:  recipient,
+		Diagnostic: truncate(kind),
+	}}
+}
+
+// readFieldGroups reads the groups of header fields, separated by blank lines, that make up the
+// body of a delivery status or feedback report.
+func readFieldGroups(r io.Reader) []textproto.MIMEHeader {
+	br := bufio.NewReader(r)
+	var groups []textproto.MIMEHeader
+	for {
+		// Blank lines between the groups are skipped, so that each read starts at a field.
+		for {
+			b, err := br.Peek(1)
+			if err != nil {
+				return groups
+			}
+			if b[0] != '\r' && b[0] != '\n' {
+				break
+			}
+			_, _ = br.ReadByte()
+		}
+		fields := readFieldGroup(br)
+		if len(fields) == 0 {
+			return groups
+		}
+		groups = append(groups, fields)
+	}
+}
+
+// readFieldGroup reads header fields up to the first blank line, keeping those read before an
+// error.
+func readFieldGroup(br *bufio.Reader) textproto.MIMEHeader {
+	fields, err := textproto.NewReader(br).ReadMIMEHeader()
+	if fields == nil && err != nil {
+		return textproto.MIMEHeader{}
+	}
+	return fields
+}
+
+// addressField returns the value of a field typed as "type; value", such as
+// "rfc822; user@example.com", without its type.
+func addressField(value string) string {
+	if _, v, ok := strings.Cut(value, ";"); ok {
+		value = v
+	}
+	return strings.Trim(strings.TrimSpace(value), "<>")
+}
+
+// permanentStatus reports whether a delivery failed permanently by its status code, such as
+// 5.1.1, or by the SMTP reply in its diagnostic if it has none. A full mailbox is reported as
+// permanent by some servers but is usually temporary, so it is not.
+func permanentStatus(status, diagnostic string) bool {
+	switch {
+	case status == "5.2.2":
+		return false
+	case status != "":
+		return strings.HasPrefix(status, "5.")
+	default:
+		return replyCode(diagnostic) >= 500
+	}
+}
+
+// replyCode returns the SMTP reply code a diagnostic starts with, or 0.
+func replyCode(diagnostic string) int {
+	if len(diagnostic) < 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(diagnostic[:3])
+	if err != nil || code < 200 || code > 599 {
+		return 0
+	}
+	return code
+}
@@ -0,0 +1,172 @@
+package bounce
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// imapMailbox reads the unseen messages of a folder over IMAP (RFC 3501), by UID. Reading a
+// message marks it seen, so that messages that are not reports are not read again, and removed
+// messages are expunged.
+type imapMailbox struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is an untagged response, with the literals it carried replaced by "{}" in line.
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// openIMAP logs in on conn, upgrading it to TLS first with tlsConfig if it is not nil, and
+// selects folder.
+func openIMAP(conn net.Conn, tlsConfig *tls.Config, username, password, folder string) (*imapMailbox, error) {
+	m := &imapMailbox{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := m.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting.line, "* OK") && !strings.HasPrefix(greeting.line, "* PREAUTH") {
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", greeting.line)
+	}
+	if tlsConfig != nil {
+		if _, err := m.command("STARTTLS"); err != nil {
+			return nil, err
+		}
+		m.conn = tls.Client(conn, tlsConfig)
+		m.r = bufio.NewReader(m.conn)
+	}
+	if _, err := m.command("LOGIN " + imapQuote(username) + " " + imapQuote(password)); err != nil {
+		return nil, err
+	}
+	if _, err := m.command("SELECT " + imapQuote(folder)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *imapMailbox) list() ([]string, error) {
+	responses, err := m.command("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []string
+	for _, resp := range responses {
+		if rest, ok := strings.CutPrefix(resp.line, "* SEARCH"); ok {
+			uids = append(uids, strings.Fields(rest)...)
+		}
+	}
+	return uids, nil
+}
+
+func (m *imapMailbox) read(uid string) ([]byte, error) {
+	responses, err := m.command("UID FETCH " + uid + " BODY[]")
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range responses {
+		if strings.Contains(resp.line, " FETCH ") && len(resp.literals) > 0 {
+			return resp.literals[len(resp.literals)-1], nil
+		}
+	}
+	return nil, fmt.Errorf("IMAP server returned no message for UID %s", uid)
+}
+
+func (m *imapMailbox) remove(uids []string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	if _, err := m.command("UID STORE " + strings.Join(uids, ",") + ` +FLAGS.SILENT (\Deleted)`); err != nil {
+		return err
+	}
+	_, err := m.command("EXPUNGE")
+	return err
+}
+
+func (m *imapMailbox) close() error {
+	_, err := m.command("LOGOUT")
+	return err
+}
+
+// command sends a command and returns the untagged responses to it, or an error if it did not
+// complete with OK.
+func (m *imapMailbox) command(cmd string) ([]imapResponse, error) {
+	m.tag++
+	tag := "a" + strconv.Itoa(m.tag)
+	if _, err := io.WriteString(m.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return nil, err
+	}
+	verb, _, _ := strings.Cut(cmd, " ")
+	var responses []imapResponse
+	for {
+		resp, err := m.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if status, ok := strings.CutPrefix(resp.line, tag+" "); ok {
+			if !strings.HasPrefix(status, "OK") {
+				return nil, fmt.Errorf("IMAP %s failed: %s", verb, status)
+			}
+			return responses, nil
+		}
+		if strings.HasPrefix(resp.line, "+") {
+			return nil, fmt.Errorf("unexpected IMAP continuation request for %s", verb)
+		}
+		responses = append(responses, resp)
+	}
+}
+
+// readResponse reads a response line, with the literals it carries.
+func (m *imapMailbox) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := m.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		n, rest, ok := literalSize(line)
+		if !ok {
+			resp.line += line
+			return resp, nil
+		}
+		if n > maxMailboxMessageSize {
+			return resp, fmt.Errorf("IMAP literal of %d bytes is larger than %d bytes", n, maxMailboxMessageSize)
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(m.r, literal); err != nil {
+			return resp, err
+		}
+		resp.line += rest + "{}"
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// literalSize returns the size of the literal that line announces at its end, as in
+// "* 1 FETCH (BODY[] {42}", and line without the announcement.
+func literalSize(line string) (int, string, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, "", false
+	}
+	i := strings.LastIndexByte(line, '{')
+	if i < 0 {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[i+1:len(line)-1], "+"))
+	if err != nil || n < 0 {
+		return 0, "", false
+	}
+	return n, line[:i], true
+}
+
+// imapQuote returns s as an IMAP quoted string.
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,241 @@
+package bounce
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/logger"
+	"runebird/internal/messages"
+	"runebird/internal/suppression"
+)
+
+const (
+	// maxMailboxMessages is the number of messages read from the mailbox in one poll; the rest
+	// are read by the next ones.
+	maxMailboxMessages = 100
+	// maxMailboxMessageSize is the size of the largest message read from the mailbox.
+	maxMailboxMessageSize = 10 << 20
+)
+
+// mailbox is a session with the server of the bounce mailbox. Messages are named by keys that
+// stay the same from one session to the next.
+type mailbox interface {
+	list() ([]string, error)
+	read(key string) ([]byte, error)
+	remove(keys []string) error
+	close() error
+}
+
+// Poller polls the bounce mailbox configured under bounces.mailbox for delivery status
+// notifications and abuse reports, which are handled like the notifications of a provider and
+// then deleted.
+type Poller struct {
+	cfg      *config.MailboxBouncesConfig
+	receiver *Receiver
+	logger   *logger.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// pollMu serializes polls, which share skipped.
+	pollMu sync.Mutex
+	// skipped holds the keys of the messages that were not reports, so that they are not read
+	// again while they stay in the mailbox.
+	skipped   map[string]bool
+	mu        sync.Mutex
+	isRunning bool
+}
+
+// NewPoller creates a Poller recording the reports it finds in msgs and suppressions.
+func NewPoller(cfg *config.BouncesConfig, msgs *messages.Log, suppressions *suppression.List, log *logger.Logger) *Poller {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Poller{
+		cfg:      &cfg.Mailbox,
+		receiver: NewReceiver(cfg, msgs, suppressions, log),
+		logger:   log,
+		ctx:      ctx,
+		cancel:   cancel,
+		skipped:  make(map[string]bool),
+	}
+}
+
+// Start begins polling the mailbox, immediately and then every interval. It does nothing if the
+// mailbox is not enabled.
+func (p *Poller) Start() {
+	if !p.cfg.Enabled {
+		return
+	}
+	p.mu.Lock()
+	if p.isRunning {
+		p.mu.Unlock()
+		return
+	}
+	p.isRunning = true
+	p.mu.Unlock()
+
+	go p.run()
+	p.logger.Info("Bounce mailbox polling started", zap.String("protocol", p.cfg.Protocol), zap.String("host", p.cfg.Host), zap.Duration("interval", p.cfg.Interval))
+}
+
+// Stop halts the polling, interrupting a poll in progress.
+func (p *Poller) Stop() {
+	p.mu.Lock()
+	if !p.isRunning {
+		p.mu.Unlock()
+		return
+	}
+	p.isRunning = false
+	p.mu.Unlock()
+
+	p.cancel()
+	p.logger.Info("Bounce mailbox polling stopped")
+}
+
+func (p *Poller) run() {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(p.ctx, p.cfg.Timeout)
+		if _, err := p.Poll(ctx); err != nil && p.ctx.Err() == nil {
+			p.logger.Error("Failed to poll bounce mailbox", zap.Error(err))
+		}
+		cancel()
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll reads the mailbox once and returns the notifications it handled. The reports that were
+// handled are deleted; a report whose notifications could not all be handled is left in the
+// mailbox and read again by the next poll.
+func (p *Poller) Poll(ctx context.Context) ([]Notification, error) {
+	p.pollMu.Lock()
+	defer p.pollMu.Unlock()
+
+	box, err := p.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := box.list()
+	if err != nil {
+		_ = box.close()
+		return nil, fmt.Errorf("failed to list bounce mailbox: %v", err)
+	}
+
+	var handled []Notification
+	var reports []string
+	skipped := make(map[string]bool)
+	read := 0
+	for _, key := range keys {
+		if p.skipped[key] {
+			skipped[key] = true
+			continue
+		}
+		if read == maxMailboxMessages {
+			break
+		}
+		read++
+		raw, err := box.read(key)
+		if err != nil {
+			_ = box.close()
+			return handled, fmt.Errorf("failed to read bounce mailbox message: %v", err)
+		}
+		notifications, ok := parseReport(raw)
+		if !ok {
+			p.logger.Debug("Skipped bounce mailbox message that is not a report", zap.String("key", key))
+			skipped[key] = true
+			continue
+		}
+		if p.handleAll(notifications) {
+			handled = append(handled, notifications...)
+			reports = append(reports, key)
+		}
+	}
+	// Keys of messages no longer in the mailbox are forgotten.
+	p.skipped = skipped
+
+	if err := box.remove(reports); err != nil {
+		_ = box.close()
+		return handled, fmt.Errorf("failed to delete bounce mailbox messages: %v", err)
+	}
+	if err := box.close(); err != nil {
+		return handled, fmt.Errorf("failed to close bounce mailbox: %v", err)
+	}
+	if len(reports) > 0 {
+		p.logger.Info("Bounce mailbox polled", zap.Int("reports", len(reports)), zap.Int("notifications", len(handled)))
+	}
+	return handled, nil
+}
+
+// handleAll handles notifications and reports whether they were all handled.
+func (p *Poller) handleAll(notifications []Notification) bool {
+	for _, n := range notifications {
+		if err := p.receiver.handle(n); err != nil {
+			p.logger.Error("Failed to handle bounce mailbox report", zap.String("message_id", n.MessageID), zap.Error(err))
+			return false
+		}
+	}
+	return true
+}
+
+// open connects and logs in to the mailbox. The connection is closed when ctx is done, which
+// interrupts the session.
+func (p *Poller) open(ctx context.Context) (mailbox, error) {
+	addr := net.JoinHostPort(p.cfg.Host, strconv.Itoa(p.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: p.cfg.Host, InsecureSkipVerify: p.cfg.InsecureSkipVerify}
+	var conn net.Conn
+	var err error
+	if p.cfg.TLSMode == "implicit" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to bounce mailbox: %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var upgrade *tls.Config
+	if p.cfg.TLSMode == "starttls" {
+		upgrade = tlsConfig
+	}
+	var box mailbox
+	if p.cfg.Protocol == "pop3" {
+		box, err = openPOP3(conn, upgrade, p.cfg.Username, p.cfg.Password)
+	} else {
+		box, err = openIMAP(conn, upgrade, p.cfg.Username, p.cfg.Password, p.cfg.Folder)
+	}
+	if err != nil {
+		stop()
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to log in to bounce mailbox: %v", err)
+	}
+	return &session{mailbox: box, conn: conn, stop: stop}, nil
+}
+
+// session closes the connection of a mailbox along with it.
+type session struct {
+	mailbox
+	conn net.Conn
+	stop func() bool
+}
+
+func (s *session) close() error {
+	err := s.mailbox.close()
+	s.stop()
+	_ = s.conn.Close()
+	return err
+}
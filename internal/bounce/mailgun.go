@@ -0,0 +1,82 @@
+package bounce
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// mailgunWebhook is the body of a Mailgun webhook request, signed by an HMAC of its timestamp
+// and token.
+type mailgunWebhook struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event     string `json:"event"`
+		Severity  string `json:"severity"`
+		Recipient string `json:"recipient"`
+		Reason    string `json:"reason"`
+		Message   struct {
+			Headers struct {
+				MessageID string `json:"message-id"`
+			} `json:"headers"`
+		} `json:"message"`
+		DeliveryStatus struct {
+			Code        int    `json:"code"`
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// parseMailgun verifies the signature of a Mailgun webhook request with signingKey and returns
+// the failure or complaint it reports. Mailgun names a message by its Message-ID header.
+func parseMailgun(signingKey string, body []byte) ([]Notification, error) {
+	var hook mailgunWebhook
+	if err := json.Unmarshal(body, &hook); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+	sig := hook.Signature
+	if !VerifyMailgun(signingKey, sig.Timestamp, sig.Token, sig.Signature) {
+		return nil, fmt.Errorf("%w: signature does not match", ErrInvalidSignature)
+	}
+
+	event := hook.EventData
+	n := Notification{Provider: ProviderMailgun, MessageID: event.Message.Headers.MessageID, Recipient: event.Recipient}
+	switch event.Event {
+	case "failed":
+		status := event.DeliveryStatus
+		n.Type = TypeBounce
+		n.Permanent = event.Severity == "permanent"
+		n.Code = status.Code
+		n.Diagnostic = truncate(strings.TrimSpace(status.Message + " " + status.Description))
+		if n.Diagnostic == "" {
+			n.Diagnostic = truncate(event.Reason)
+		}
+	case "complained":
+		n.Type = TypeComplaint
+	default:
+		// Deliveries, opens and other events are not about bounces.
+		return nil, nil
+	}
+	return []Notification{n}, nil
+}
+
+// MailgunSignature returns the signature Mailgun sends with a webhook request: the hex-encoded
+// HMAC-SHA256 of its timestamp and token, keyed with the webhook signing key.
+func MailgunSignature(signingKey, timestamp, token string) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(timestamp + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyMailgun reports whether signature was made by MailgunSignature for timestamp and token.
+func VerifyMailgun(signingKey, timestamp, token, signature string) bool {
+	return timestamp != "" && token != "" && hmac.Equal([]byte(MailgunSignature(signingKey, timestamp, token)), []byte(signature))
+}
@@ -0,0 +1,112 @@
+package bounce
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// pop3Mailbox reads the messages of a mailbox over POP3 (RFC 1939), by their unique IDs.
+// Removed messages are deleted when the session is closed.
+type pop3Mailbox struct {
+	text *textproto.Conn
+	// numbers maps the unique ID of each message to its number in the session.
+	numbers map[string]string
+}
+
+// openPOP3 logs in on conn, upgrading it to TLS first with tlsConfig if it is not nil.
+func openPOP3(conn net.Conn, tlsConfig *tls.Config, username, password string) (*pop3Mailbox, error) {
+	m := &pop3Mailbox{text: textproto.NewConn(conn)}
+	if _, err := m.reply(); err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if _, err := m.command("STLS"); err != nil {
+			return nil, err
+		}
+		m.text = textproto.NewConn(tls.Client(conn, tlsConfig))
+	}
+	if _, err := m.command("USER " + username); err != nil {
+		return nil, err
+	}
+	if _, err := m.command("PASS " + password); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *pop3Mailbox) list() ([]string, error) {
+	if _, err := m.command("UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := m.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+	m.numbers = make(map[string]string, len(lines))
+	ids := make([]string, 0, len(lines))
+	for _, line := range lines {
+		number, id, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		m.numbers[id] = number
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m *pop3Mailbox) read(id string) ([]byte, error) {
+	if _, err := m.command("RETR " + m.numbers[id]); err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(io.LimitReader(m.text.DotReader(), maxMailboxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxMailboxMessageSize {
+		return nil, fmt.Errorf("POP3 message %s is larger than %d bytes", id, maxMailboxMessageSize)
+	}
+	return raw, nil
+}
+
+func (m *pop3Mailbox) remove(ids []string) error {
+	for _, id := range ids {
+		if _, err := m.command("DELE " + m.numbers[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *pop3Mailbox) close() error {
+	_, err := m.command("QUIT")
+	return err
+}
+
+// command sends a command and returns the text of its positive reply.
+func (m *pop3Mailbox) command(cmd string) (string, error) {
+	if err := m.text.PrintfLine("%s", cmd); err != nil {
+		return "", err
+	}
+	text, err := m.reply()
+	if err != nil {
+		verb, _, _ := strings.Cut(cmd, " ")
+		return "", fmt.Errorf("POP3 %s failed: %v", verb, err)
+	}
+	return text, nil
+}
+
+func (m *pop3Mailbox) reply() (string, error) {
+	line, err := m.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if text, ok := strings.CutPrefix(line, "+OK"); ok {
+		return strings.TrimSpace(text), nil
+	}
+	return "", fmt.Errorf("%s", line)
+}
@@ -0,0 +1,107 @@
+package bounce
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The headers of a signed SendGrid Event Webhook request.
+const (
+	SendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	SendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// sendGridEvent is an event posted by the SendGrid Event Webhook. A bounce of type blocked is
+// a soft bounce.
+type sendGridEvent struct {
+	Email       string `json:"email"`
+	Event       string `json:"event"`
+	Type        string `json:"type"`
+	SGMessageID string `json:"sg_message_id"`
+	Reason      string `json:"reason"`
+	Status      string `json:"status"`
+}
+
+// parseSendGrid verifies the signature of a SendGrid Event Webhook request with publicKey and
+// returns its bounces and spam reports.
+func parseSendGrid(publicKey string, header http.Header, body []byte) ([]Notification, error) {
+	if err := verifySendGrid(publicKey, header.Get(SendGridSignatureHeader), header.Get(SendGridTimestampHeader), body); err != nil {
+		return nil, err
+	}
+	var events []sendGridEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+
+	var notifications []Notification
+	for _, e := range events {
+		// SendGrid's ID for a delivery is the X-Message-Id returned by the send, followed by the
+		// ID of the filter that delivered it.
+		messageID, _, _ := strings.Cut(e.SGMessageID, ".")
+		n := Notification{Provider: ProviderSendGrid, MessageID: messageID, Recipient: e.Email}
+		switch e.Event {
+		case "bounce":
+			n.Type = TypeBounce
+			n.Permanent = e.Type != "blocked"
+			n.Diagnostic = truncate(strings.TrimSpace(e.Status + " " + e.Reason))
+		case "spamreport":
+			n.Type = TypeComplaint
+		default:
+			// Deliveries, opens and other events are not about bounces.
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+// verifySendGrid checks the ECDSA signature of a SendGrid Event Webhook request, made over the
+// timestamp followed by the body.
+func verifySendGrid(publicKey, signature, timestamp string, body []byte) error {
+	if signature == "" || timestamp == "" {
+		return fmt.Errorf("%w: the request is not signed", ErrInvalidSignature)
+	}
+	key, err := parseSendGridKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid SendGrid public key: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.VerifyASN1(key, digest[:], sig) {
+		return fmt.Errorf("%w: signature does not match", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// parseSendGridKey decodes the verification key of a signed Event Webhook, given as SendGrid
+// shows it, in base64, or in PEM.
+func parseSendGridKey(publicKey string) (*ecdsa.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(publicKey)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey)); err != nil {
+			return nil, err
+		}
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA key")
+	}
+	return ecKey, nil
+}
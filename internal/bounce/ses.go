@@ -0,0 +1,262 @@
+package bounce
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// snsMessage is a message posted by SNS to a subscribed HTTP endpoint.
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicARN         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// sesNotification is an SES bounce or complaint notification, or an event of the same types
+// published through a configuration set, which names its type in eventType instead.
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Mail             struct {
+		MessageID string `json:"messageId"`
+	} `json:"mail"`
+	Bounce struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			Status         string `json:"status"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// snsHost matches the hosts SNS serves its signing certificates and subscription confirmations
+// from.
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+func isSNSHost(host string) bool {
+	return snsHost.MatchString(host)
+}
+
+// parseSES verifies an SNS message and returns the SES notifications it carries. A subscription
+// confirmation is confirmed, and carries none.
+func (r *Receiver) parseSES(ctx context.Context, body []byte) ([]Notification, error) {
+	var msg snsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+	if err := r.verifySNS(ctx, msg); err != nil {
+		return nil, err
+	}
+	if topics := r.cfg.SES.TopicARNs; len(topics) > 0 && !slices.Contains(topics, msg.TopicARN) {
+		return nil, fmt.Errorf("%w: topic %s is not accepted", ErrInvalidSignature, msg.TopicARN)
+	}
+
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		if err := r.confirmSNS(ctx, msg); err != nil {
+			return nil, err
+		}
+		r.logger.Info("Confirmed SNS subscription", zap.String("topic", msg.TopicARN))
+		return nil, nil
+	case "UnsubscribeConfirmation":
+		r.logger.Warn("SNS subscription removed", zap.String("topic", msg.TopicARN))
+		return nil, nil
+	case "Notification":
+	default:
+		return nil, fmt.Errorf("%w: unknown SNS message type %q", ErrInvalidNotification, msg.Type)
+	}
+
+	var n sesNotification
+	if err := json.Unmarshal([]byte(msg.Message), &n); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+	kind := n.NotificationType
+	if kind == "" {
+		kind = n.EventType
+	}
+	var notifications []Notification
+	switch kind {
+	case "Bounce":
+		for _, rcpt := range n.Bounce.BouncedRecipients {
+			notifications = append(notifications, Notification{
+				Provider:   ProviderSES,
+				Type:       TypeBounce,
+				MessageID:  n.Mail.MessageID,
+				Recipient:  rcpt.EmailAddress,
+				Permanent:  n.Bounce.BounceType == "Permanent",
+				Diagnostic: truncate(strings.TrimSpace(rcpt.Status + " " + rcpt.DiagnosticCode)),
+			})
+		}
+	case "Complaint":
+		for _, rcpt := range n.Complaint.ComplainedRecipients {
+			notifications = append(notifications, Notification{
+				Provider:   ProviderSES,
+				Type:       TypeComplaint,
+				MessageID:  n.Mail.MessageID,
+				Recipient:  rcpt.EmailAddress,
+				Diagnostic: truncate(n.Complaint.ComplaintFeedbackType),
+			})
+		}
+	}
+	// Other notifications, such as deliveries, are not about bounces and are ignored.
+	return notifications, nil
+}
+
+// verifySNS checks the signature of msg with the certificate it names, which must be served
+// by SNS.
+func (r *Receiver) verifySNS(ctx context.Context, msg snsMessage) error {
+	var hash crypto.Hash
+	switch msg.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("%w: unsupported SNS signature version %q", ErrInvalidSignature, msg.SignatureVersion)
+	}
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	cert, err := r.snsCertificate(ctx, msg.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: SNS certificate does not hold an RSA key", ErrInvalidSignature)
+	}
+
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(snsStringToSign(msg)))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(snsStringToSign(msg)))
+		digest = sum[:]
+	}
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// snsStringToSign returns the fields of msg that SNS signs, in the form it signs them.
+func snsStringToSign(msg snsMessage) string {
+	fields := [][2]string{{"Message", msg.Message}, {"MessageId", msg.MessageID}}
+	if msg.Type == "Notification" {
+		if msg.Subject != "" {
+			fields = append(fields, [2]string{"Subject", msg.Subject})
+		}
+		fields = append(fields, [2]string{"Timestamp", msg.Timestamp})
+	} else {
+		fields = append(fields, [2]string{"SubscribeURL", msg.SubscribeURL}, [2]string{"Timestamp", msg.Timestamp}, [2]string{"Token", msg.Token})
+	}
+	fields = append(fields, [2]string{"TopicArn", msg.TopicARN}, [2]string{"Type", msg.Type})
+
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f[0] + "\n" + f[1] + "\n")
+	}
+	return b.String()
+}
+
+// snsCertificate returns the signing certificate at rawURL, fetching it only the first time.
+func (r *Receiver) snsCertificate(ctx context.Context, rawURL string) (*x509.Certificate, error) {
+	if err := r.checkSNSURL(rawURL); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	cert, ok := r.certs[rawURL]
+	r.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	data, err := r.fetch(ctx, rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch SNS certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: SNS certificate is not PEM encoded", ErrInvalidSignature)
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	r.mu.Lock()
+	r.certs[rawURL] = cert
+	r.mu.Unlock()
+	return cert, nil
+}
+
+// confirmSNS confirms the subscription of the endpoint to the topic of msg.
+func (r *Receiver) confirmSNS(ctx context.Context, msg snsMessage) error {
+	if err := r.checkSNSURL(msg.SubscribeURL); err != nil {
+		return err
+	}
+	if _, err := r.fetch(ctx, msg.SubscribeURL); err != nil {
+		return fmt.Errorf("failed to confirm SNS subscription: %v", err)
+	}
+	return nil
+}
+
+// checkSNSURL refuses URLs that are not served over https by SNS, so that a forged message
+// cannot make RuneBird fetch other URLs.
+func (r *Receiver) checkSNSURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || !r.trustedSNSHost(u.Hostname()) {
+		return fmt.Errorf("%w: %q is not an SNS URL", ErrInvalidSignature, rawURL)
+	}
+	return nil
+}
+
+func (r *Receiver) fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SNS responded with status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
@@ -1,38 +1,484 @@
 package config
 
 import (
+	"context"
 	"fmt"
-	"gopkg.in/yaml.v3"
+	"net/mail"
+	"net/url"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	Server    ServerConfig    `yaml:"server"`
+	Admin     AdminConfig     `yaml:"admin"`
 	SMTP      SMTPConfig      `yaml:"smtp"`
 	Templates TemplatesConfig `yaml:"templates"`
 	RateLimit RateLimitConfig `yaml:"rate_limit"`
 	Logging   LoggingConfig   `yaml:"logging"`
+	Store     StoreConfig     `yaml:"store"`
+	Scheduler SchedulerConfig `yaml:"scheduler"`
+	Webhooks  WebhookConfig   `yaml:"webhooks"`
+	Bounces   BouncesConfig   `yaml:"bounces"`
+	Delivery  DeliveryConfig  `yaml:"delivery"`
+	Vault     VaultConfig     `yaml:"vault"`
+
+	// vault is the Vault secrets were read from, if any.
+	vault *Vault
+}
+
+// DeliveryConfig selects the provider emails are delivered through. The smtp provider uses
+// the settings under smtp; HTTP API providers have their own sections here.
+type DeliveryConfig struct {
+	Provider         string                 `yaml:"provider"`
+	DryRun           bool                   `yaml:"dry_run"`
+	CaptureDir       string                 `yaml:"capture_dir"`
+	AllowedFrom      []string               `yaml:"allowed_from"`
+	RecipientDomains RecipientDomainsConfig `yaml:"recipient_domains"`
+	Archive          ArchiveConfig          `yaml:"archive"`
+	HealthCheck      HealthCheckConfig      `yaml:"health_check"`
+	SendGrid         SendGridConfig         `yaml:"sendgrid"`
+	SES              SESConfig              `yaml:"ses"`
+	Profiles         []DeliveryProfile      `yaml:"profiles"`
+}
+
+// DeliveryProfile is a named way of delivering email that requests and templates can select
+// instead of the default one, such as a marketing profile sending through a server of its own
+// at a rate of its own. Provider and the section it names are configured as under delivery,
+// with the from address, retry policy, SendGrid base URL and SES region of the default
+// provider used for those left out. The emails of the profile draw from a token bucket of
+// their own, sized by RateLimit, which defaults to the global per_hour and burst.
+type DeliveryProfile struct {
+	Name      string                 `yaml:"name"`
+	Provider  string                 `yaml:"provider"`
+	SMTP      SMTPConfig             `yaml:"smtp"`
+	SendGrid  SendGridConfig         `yaml:"sendgrid"`
+	SES       SESConfig              `yaml:"ses"`
+	RateLimit ProfileRateLimitConfig `yaml:"rate_limit"`
+}
+
+// ProfileRateLimitConfig sizes the token bucket of a delivery profile: PerHour tokens per hour
+// up to Burst tokens. Quotas, the send window and the circuit breaker stay global.
+type ProfileRateLimitConfig struct {
+	PerHour int `yaml:"per_hour"`
+	Burst   int `yaml:"burst"`
+}
+
+// Bucket returns the rate limit settings a token bucket of the profile is created with.
+func (r ProfileRateLimitConfig) Bucket() *RateLimitConfig {
+	return &RateLimitConfig{PerHour: r.PerHour, Burst: r.Burst}
+}
+
+// Profile returns the delivery profile named name, or false if there is none.
+func (c *DeliveryConfig) Profile(name string) (*DeliveryProfile, bool) {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == name {
+			return &c.Profiles[i], true
+		}
+	}
+	return nil, false
+}
+
+// RecipientDomainsConfig restricts the domains emails may be sent to, such as a staging
+// environment that must only email the company's own domain. An entry matches its domain and
+// every subdomain of it. If Allow is set, only recipients in one of its domains may be emailed;
+// recipients in a domain of Deny never may, even if it is allowed.
+type RecipientDomainsConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// ArchiveConfig sets an address that is blind-copied on every outgoing email for compliance
+// retention, except for emails rendered from one of ExcludeTemplates. The copy is added to the
+// envelope only, so recipients cannot see it.
+type ArchiveConfig struct {
+	Address          string   `yaml:"address"`
+	ExcludeTemplates []string `yaml:"exclude_templates"`
+}
+
+// HealthCheckConfig configures the periodic probe of the delivery provider whose outcome is
+// reported by the /health endpoint.
+type HealthCheckConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+type SendGridConfig struct {
+	APIKey      string `yaml:"api_key" secret:"true"`
+	FromAddress string `yaml:"from_address"`
+	BaseURL     string `yaml:"base_url"`
+}
+
+// SESConfig configures delivery through the Amazon SES v2 API. If the access key is not set,
+// the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables are used.
+type SESConfig struct {
+	Region           string `yaml:"region"`
+	AccessKeyID      string `yaml:"access_key_id"`
+	SecretAccessKey  string `yaml:"secret_access_key" secret:"true"`
+	SessionToken     string `yaml:"session_token" secret:"true"`
+	ConfigurationSet string `yaml:"configuration_set"`
+	FromAddress      string `yaml:"from_address"`
+	Endpoint         string `yaml:"endpoint"`
 }
 
 type ServerConfig struct {
+	Port              int                `yaml:"port"`
+	IdempotencyTTL    time.Duration      `yaml:"idempotency_ttl"`
+	MaxAttachmentSize int                `yaml:"max_attachment_size"`
+	MaxMessageSize    int                `yaml:"max_message_size"`
+	CheckMX           bool               `yaml:"check_mx"`
+	MXCacheTTL        time.Duration      `yaml:"mx_cache_ttl"`
+	ShutdownTimeout   time.Duration      `yaml:"shutdown_timeout"`
+	AsyncSend         bool               `yaml:"async_send"`
+	ClientLimits      ClientLimitsConfig `yaml:"client_limits"`
+	HTTP              HTTPConfig         `yaml:"http"`
+	Auth              AuthConfig         `yaml:"auth"`
+	TLS               TLSConfig          `yaml:"tls"`
+	GRPC              GRPCConfig         `yaml:"grpc"`
+}
+
+// AdminConfig moves the operational endpoints to a listener of their own on Port, bound to
+// Address if it is set: /metrics, /debug/pprof, /health and the endpoints requiring the admin
+// scope are then served there instead of on the port of the API, which keeps /health. Without
+// a port they stay on the API port, and pprof is not served.
+type AdminConfig struct {
+	Port    int    `yaml:"port"`
+	Address string `yaml:"address"`
+}
+
+// HTTPConfig bounds the connections and requests of the HTTP API. ReadHeaderTimeout and
+// ReadTimeout limit how long reading the headers and the whole of a request may take,
+// WriteTimeout how long a request may take from the end of its headers to the end of its
+// response, including the send of a synchronous /send, and IdleTimeout how long a keep-alive
+// connection waits for its next request. MaxBodySize is the largest request body accepted, in
+// bytes; it must leave room for the attachments of a request, which are base64-encoded.
+type HTTPConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxBodySize       int           `yaml:"max_body_size"`
+}
+
+// ClientLimitsConfig limits each client of the API to RequestsPerMinute requests and to
+// EmailsPerDay emails sent or scheduled in a rolling 24 hours, so that one client cannot use up
+// the send budget of all of them. A client is identified by the subject of its bearer token,
+// the common name of its client certificate, or else its IP address, and Clients gives limits
+// of their own to the clients it names. A limit of 0 is unlimited.
+type ClientLimitsConfig struct {
+	RequestsPerMinute int                    `yaml:"requests_per_minute"`
+	EmailsPerDay      int                    `yaml:"emails_per_day"`
+	Clients           map[string]ClientLimit `yaml:"clients"`
+}
+
+// ClientLimit is the limits of a client named in ClientLimitsConfig.Clients.
+type ClientLimit struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	EmailsPerDay      int `yaml:"emails_per_day"`
+}
+
+// GRPCConfig serves the gRPC API on Port, alongside the HTTP API, with the same TLS
+// certificate, client certificates and authentication. It is disabled while Port is 0.
+type GRPCConfig struct {
 	Port int `yaml:"port"`
 }
 
+// TLSConfig serves the API over HTTPS with the certificate and key in CertFile and KeyFile.
+// The files are checked for changes every ReloadInterval, and the certificate is reloaded
+// when they change or on SIGHUP, so that rotated certificates are served without a restart.
+// With ClientCAFile set, the API endpoints other than /health and /metrics also require a client
+// certificate issued by one of the CAs in that PEM bundle and, if AllowedClients is set, whose
+// common name or a DNS name of which is listed there.
+type TLSConfig struct {
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	ClientCAFile   string        `yaml:"client_ca_file"`
+	AllowedClients []string      `yaml:"allowed_clients"`
+}
+
+// AuthConfig selects how API requests are authenticated: not at all with Mode "none", the
+// default, or with Mode "jwt" by a bearer token validated as configured under JWT.
+type AuthConfig struct {
+	Mode string    `yaml:"mode"`
+	JWT  JWTConfig `yaml:"jwt"`
+}
+
+// JWTConfig validates bearer tokens as JWTs issued by Issuer, signed with a key published at
+// JWKSURL or, if it is not set, at the jwks_uri of the issuer's OpenID Connect discovery
+// document. Tokens must be intended for Audience, if it is set, and are accepted up to Leeway
+// past their expiry. The keys are fetched again every RefreshInterval, or sooner for a token
+// signed with an unknown key. Scopes names the scopes that grant access to each group of
+// endpoints.
+type JWTConfig struct {
+	Issuer          string        `yaml:"issuer"`
+	JWKSURL         string        `yaml:"jwks_url"`
+	Audience        string        `yaml:"audience"`
+	Leeway          time.Duration `yaml:"leeway"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	Scopes          ScopesConfig  `yaml:"scopes"`
+}
+
+// ScopesConfig names the scopes required by the endpoints that send email, those that
+// schedule email and manage scheduled emails, and the administrative ones managing templates
+// and the scheduler.
+type ScopesConfig struct {
+	Send     string `yaml:"send"`
+	Schedule string `yaml:"schedule"`
+	Admin    string `yaml:"admin"`
+}
+
 type SMTPConfig struct {
-	Host        string `yaml:"host"`
-	Port        int    `yaml:"port"`
-	Username    string `yaml:"username"`
-	Password    string `yaml:"password"`
-	FromAddress string `yaml:"from_address"`
+	Host               string        `yaml:"host"`
+	Port               int           `yaml:"port"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password" secret:"true"`
+	FromAddress        string        `yaml:"from_address"`
+	EnvelopeFrom       string        `yaml:"envelope_from"`
+	TLSMode            string        `yaml:"tls_mode"`
+	CAFile             string        `yaml:"ca_file"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	AuthMethod         string        `yaml:"auth_method"`
+	OAuth2             OAuth2Config  `yaml:"oauth2"`
+	MessageIDDomain    string        `yaml:"message_id_domain"`
+	DialTimeout        time.Duration `yaml:"dial_timeout"`
+	SendTimeout        time.Duration `yaml:"send_timeout"`
+	Retry              RetryConfig   `yaml:"retry"`
+	Name               string        `yaml:"name"`
+	Fallbacks          []SMTPConfig  `yaml:"fallbacks"`
+}
+
+// OAuth2Config holds the client credentials and refresh token used to obtain access tokens
+// for XOAUTH2 authentication.
+type OAuth2Config struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret" secret:"true"`
+	RefreshToken string `yaml:"refresh_token" secret:"true"`
+	TokenURL     string `yaml:"token_url"`
 }
 
+// TemplatesConfig locates the templates. With Watch set, the templates directory is checked
+// for changes every WatchInterval and the templates are reloaded without a restart.
+// MJMLCommand is the command that compiles .mjml templates to HTML, reading MJML on standard
+// input and writing HTML to standard output; .mjml templates cannot be loaded without it.
+// DisableUnsafeFuncs removes the template helpers that read the environment or bypass HTML
+// escaping, for templates written by untrusted users. DefaultLocale is the locale whose
+// template variants are used when neither the requested locale nor an unlocalized template
+// exists. With Strict set, templates that reference undefined templates, or do not render
+// with the sample data declared next to them, fail to load. Store keeps the templates saved
+// through the API in a database, with their version history. Globals are passed to every
+// template under .Global, and Defaults holds per-template data used for the fields a request
+// leaves out. With InlineCSS set, the rules of <style> elements are moved into the style
+// attributes of the elements they select; templates can override it in their front matter.
+// RenderCacheSize is the number of rendered emails kept, to be reused for the same template and
+// data, except for templates calling now or written for another engine; 0 disables the cache.
 type TemplatesConfig struct {
-	Path string `yaml:"path"`
+	Path               string                            `yaml:"path"`
+	Watch              bool                              `yaml:"watch"`
+	WatchInterval      time.Duration                     `yaml:"watch_interval"`
+	MJMLCommand        []string                          `yaml:"mjml_command"`
+	Markdown           MarkdownConfig                    `yaml:"markdown"`
+	DisableUnsafeFuncs bool                              `yaml:"disable_unsafe_funcs"`
+	DefaultLocale      string                            `yaml:"default_locale"`
+	Strict             bool                              `yaml:"strict"`
+	Remote             RemoteConfig                      `yaml:"remote"`
+	Store              TemplateStoreConfig               `yaml:"store"`
+	Unsubscribe        UnsubscribeConfig                 `yaml:"unsubscribe"`
+	Tracking           TrackingConfig                    `yaml:"tracking"`
+	InlineCSS          bool                              `yaml:"inline_css"`
+	RenderCacheSize    int                               `yaml:"render_cache_size"`
+	Globals            map[string]interface{}            `yaml:"globals"`
+	Defaults           map[string]map[string]interface{} `yaml:"defaults"`
+}
+
+// TemplateStoreConfig selects where the templates saved through the API are kept: as files in
+// the templates directory, or with every version in a BoltDB file at Path or in the Redis
+// server configured under store.redis.
+type TemplateStoreConfig struct {
+	Driver string `yaml:"driver"`
+	Path   string `yaml:"path"`
+}
+
+// MarkdownConfig styles the HTML that .md templates are converted to. Layout is an HTML file
+// with a <!-- content --> marker where the converted Markdown goes and a <!-- style --> marker
+// where the CSS in the file CSS goes. Built-in ones are used for either if it is not set.
+type MarkdownConfig struct {
+	Layout string `yaml:"layout"`
+	CSS    string `yaml:"css"`
+}
+
+// RemoteConfig syncs the templates directory from the objects under Prefix in an S3 bucket, or
+// a bucket in a storage service with an S3-compatible API such as Google Cloud Storage, every
+// SyncInterval. It is enabled when Bucket is set. Endpoint overrides the AWS S3 endpoint for
+// the region, and the AWS_* environment variables are used if no access key is configured.
+type RemoteConfig struct {
+	Bucket          string        `yaml:"bucket"`
+	Prefix          string        `yaml:"prefix"`
+	Region          string        `yaml:"region"`
+	Endpoint        string        `yaml:"endpoint"`
+	AccessKeyID     string        `yaml:"access_key_id"`
+	SecretAccessKey string        `yaml:"secret_access_key" secret:"true"`
+	SessionToken    string        `yaml:"session_token" secret:"true"`
+	SyncInterval    time.Duration `yaml:"sync_interval"`
+}
+
+// UnsubscribeConfig adds List-Unsubscribe headers to emails rendered from Templates, or from
+// every template if Templates is empty. Headers are added only if Mailto or URL is set.
+type UnsubscribeConfig struct {
+	Mailto    string   `yaml:"mailto"`
+	URL       string   `yaml:"url"`
+	Secret    string   `yaml:"secret" secret:"true"`
+	Templates []string `yaml:"templates"`
+}
+
+// TrackingConfig tracks the emails rendered from Templates, or from every template if Templates
+// is empty, through links to the RuneBird server at URL. With Opens set, a tracking pixel is
+// added to the HTML of each email. With Clicks set, the links of each email are rewritten to be
+// redirected through the server, signed with Secret so that they cannot be used to redirect to
+// other sites; ClickDomains limits the links rewritten to those to the listed domains and their
+// subdomains. Links to the unsubscribe URL, and links that are not http or https, are never
+// rewritten.
+type TrackingConfig struct {
+	URL          string   `yaml:"url"`
+	Opens        bool     `yaml:"opens"`
+	Clicks       bool     `yaml:"clicks"`
+	Secret       string   `yaml:"secret" secret:"true"`
+	ClickDomains []string `yaml:"click_domains"`
+	Templates    []string `yaml:"templates"`
 }
 
 type RateLimitConfig struct {
-	PerHour int `yaml:"per_hour"`
-	Burst   int `yaml:"burst"`
+	PerHour          int              `yaml:"per_hour"`
+	Burst            int              `yaml:"burst"`
+	DailyLimit       int              `yaml:"daily_limit"`
+	MonthlyLimit     int              `yaml:"monthly_limit"`
+	OnLimit          string           `yaml:"on_limit"`
+	Driver           string           `yaml:"driver"`
+	QueuePath        string           `yaml:"queue_path"`
+	MaxQueueSize     int              `yaml:"max_queue_size"`
+	OverflowPolicy   string           `yaml:"overflow_policy"`
+	SpillPath        string           `yaml:"spill_path"`
+	SendWindow       SendWindowConfig `yaml:"send_window"`
+	Adaptive         AdaptiveConfig   `yaml:"adaptive"`
+	CircuitBreaker   BreakerConfig    `yaml:"circuit_breaker"`
+	PerRecipient     bool             `yaml:"per_recipient"`
+	StatePath        string           `yaml:"state_path"`
+	SnapshotInterval time.Duration    `yaml:"snapshot_interval"`
+	Retry            RetryConfig      `yaml:"retry"`
+}
+
+type AdaptiveConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Backoff   float64       `yaml:"backoff"`
+	MinFactor float64       `yaml:"min_factor"`
+	Cooldown  time.Duration `yaml:"cooldown"`
+}
+
+// BreakerConfig configures the circuit breaker that holds sends in the queue after Failures
+// consecutive transient send failures, until a trial send succeeds. A trial is made every
+// Cooldown while the breaker is open.
+type BreakerConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Failures int           `yaml:"failures"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+type SendWindowConfig struct {
+	Start           string   `yaml:"start"`
+	End             string   `yaml:"end"`
+	Timezone        string   `yaml:"timezone"`
+	ExemptTemplates []string `yaml:"exempt_templates"`
+}
+
+// StoreConfig selects where scheduled tasks, deferred emails and message records are kept.
+// MessageRetention is how long the record of a message stays available after its last change.
+// SuppressionPath keeps the suppression list in a BoltDB file with the memory driver; the
+// redis driver keeps it in Redis.
+type StoreConfig struct {
+	Driver           string        `yaml:"driver"`
+	Redis            RedisConfig   `yaml:"redis"`
+	MessageRetention time.Duration `yaml:"message_retention"`
+	SuppressionPath  string        `yaml:"suppression_path"`
+}
+
+type RedisConfig struct {
+	Addr      string `yaml:"addr"`
+	Password  string `yaml:"password" secret:"true"`
+	DB        int    `yaml:"db"`
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+type SchedulerConfig struct {
+	StatusRetention time.Duration `yaml:"status_retention"`
+	Workers         int           `yaml:"workers"`
+	Retry           RetryConfig   `yaml:"retry"`
+}
+
+type RetryConfig struct {
+	MaxAttempts  int           `yaml:"max_attempts"`
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	Multiplier   float64       `yaml:"multiplier"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+}
+
+type WebhookConfig struct {
+	Secret      string        `yaml:"secret" secret:"true"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	RetryDelay  time.Duration `yaml:"retry_delay"`
+}
+
+// BouncesConfig enables the endpoints at /bounces/{provider} that receive the bounce and
+// complaint notifications of each provider, and the polling of a mailbox receiving the bounces
+// of emails sent over SMTP.
+type BouncesConfig struct {
+	SES      SESBouncesConfig      `yaml:"ses"`
+	SendGrid SendGridBouncesConfig `yaml:"sendgrid"`
+	Mailgun  MailgunBouncesConfig  `yaml:"mailgun"`
+	Mailbox  MailboxBouncesConfig  `yaml:"mailbox"`
+}
+
+// SESBouncesConfig receives the SES notifications published to an SNS topic, and confirms the
+// subscription of the endpoint to it. The signature of every SNS message is verified, and with
+// TopicARNs set, messages from other topics are refused.
+type SESBouncesConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	TopicARNs []string `yaml:"topic_arns"`
+}
+
+// SendGridBouncesConfig receives the events of the SendGrid Event Webhook, which must be signed.
+// PublicKey is the verification key SendGrid shows for the webhook.
+type SendGridBouncesConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	PublicKey string `yaml:"public_key"`
+}
+
+// MailgunBouncesConfig receives the events of Mailgun webhooks, signed with SigningKey.
+type MailgunBouncesConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	SigningKey string `yaml:"signing_key" secret:"true"`
+}
+
+// MailboxBouncesConfig polls the mailbox that bounces are returned to, usually that of
+// smtp.envelope_from, every Interval over IMAP or POP3. Delivery status notifications and abuse
+// reports found in it are handled like those of the providers and then deleted; other messages
+// are left in the mailbox. Folder is the IMAP folder to poll.
+type MailboxBouncesConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	Protocol           string        `yaml:"protocol"`
+	Host               string        `yaml:"host"`
+	Port               int           `yaml:"port"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password" secret:"true"`
+	TLSMode            string        `yaml:"tls_mode"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	Folder             string        `yaml:"folder"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
 }
 
 type LoggingConfig struct {
@@ -44,20 +490,119 @@ func (c *Config) setDefaults() {
 	if c.Server.Port == 0 {
 		c.Server.Port = 8080
 	}
+	if c.Server.IdempotencyTTL == 0 {
+		c.Server.IdempotencyTTL = 24 * time.Hour
+	}
+	if c.Server.MXCacheTTL == 0 {
+		c.Server.MXCacheTTL = time.Hour
+	}
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = 30 * time.Second
+	}
+	if c.Server.MaxAttachmentSize == 0 {
+		c.Server.MaxAttachmentSize = 10 << 20
+	}
+	if c.Server.HTTP.ReadHeaderTimeout == 0 {
+		c.Server.HTTP.ReadHeaderTimeout = 10 * time.Second
+	}
+	if c.Server.HTTP.ReadTimeout == 0 {
+		c.Server.HTTP.ReadTimeout = time.Minute
+	}
+	if c.Server.HTTP.WriteTimeout == 0 {
+		c.Server.HTTP.WriteTimeout = 2 * time.Minute
+	}
+	if c.Server.HTTP.IdleTimeout == 0 {
+		c.Server.HTTP.IdleTimeout = 2 * time.Minute
+	}
+	if c.Server.HTTP.MaxBodySize == 0 {
+		c.Server.HTTP.MaxBodySize = 16 << 20
+	}
+	if c.Server.TLS.ReloadInterval == 0 {
+		c.Server.TLS.ReloadInterval = time.Minute
+	}
+	if c.Server.Auth.Mode == "" {
+		c.Server.Auth.Mode = "none"
+	}
+	if c.Server.Auth.JWT.Leeway == 0 {
+		c.Server.Auth.JWT.Leeway = time.Minute
+	}
+	if c.Server.Auth.JWT.RefreshInterval == 0 {
+		c.Server.Auth.JWT.RefreshInterval = time.Hour
+	}
+	if c.Server.Auth.JWT.Scopes.Send == "" {
+		c.Server.Auth.JWT.Scopes.Send = "send"
+	}
+	if c.Server.Auth.JWT.Scopes.Schedule == "" {
+		c.Server.Auth.JWT.Scopes.Schedule = "schedule"
+	}
+	if c.Server.Auth.JWT.Scopes.Admin == "" {
+		c.Server.Auth.JWT.Scopes.Admin = "admin"
+	}
 
 	if c.SMTP.Host == "" {
 		c.SMTP.Host = "localhost"
 	}
-	if c.SMTP.Port == 0 {
-		c.SMTP.Port = 587
-	}
 	if c.SMTP.FromAddress == "" {
 		c.SMTP.FromAddress = "no-reply@runebird.app"
 	}
+	if c.SMTP.Name == "" {
+		c.SMTP.Name = "primary"
+	}
+	c.SMTP.setDefaults()
+	if c.SMTP.Retry.MaxAttempts == 0 {
+		c.SMTP.Retry.MaxAttempts = 3
+	}
+	if c.SMTP.Retry.InitialDelay == 0 {
+		c.SMTP.Retry.InitialDelay = time.Second
+	}
+	if c.SMTP.Retry.Multiplier == 0 {
+		c.SMTP.Retry.Multiplier = 2
+	}
+	if c.SMTP.Retry.MaxDelay == 0 {
+		c.SMTP.Retry.MaxDelay = 10 * time.Second
+	}
+	c.SMTP.setFallbackDefaults("")
+
+	if c.Delivery.Provider == "" {
+		c.Delivery.Provider = "smtp"
+	}
+	if c.Delivery.HealthCheck.Interval == 0 {
+		c.Delivery.HealthCheck.Interval = 30 * time.Second
+	}
+	if c.Delivery.HealthCheck.Timeout == 0 {
+		c.Delivery.HealthCheck.Timeout = 10 * time.Second
+	}
+	if c.Delivery.SendGrid.FromAddress == "" {
+		c.Delivery.SendGrid.FromAddress = c.SMTP.FromAddress
+	}
+	if c.Delivery.SendGrid.BaseURL == "" {
+		c.Delivery.SendGrid.BaseURL = "https://api.sendgrid.com"
+	}
+	if c.Delivery.SES.FromAddress == "" {
+		c.Delivery.SES.FromAddress = c.SMTP.FromAddress
+	}
+	if c.Delivery.SES.Region == "" {
+		c.Delivery.SES.Region = os.Getenv("AWS_REGION")
+	}
 
 	if c.Templates.Path == "" {
 		c.Templates.Path = "./templates"
 	}
+	if c.Templates.WatchInterval == 0 {
+		c.Templates.WatchInterval = 2 * time.Second
+	}
+	if c.Templates.Remote.Region == "" {
+		c.Templates.Remote.Region = os.Getenv("AWS_REGION")
+	}
+	if c.Templates.Remote.SyncInterval == 0 {
+		c.Templates.Remote.SyncInterval = time.Minute
+	}
+	if c.Templates.Store.Driver == "" {
+		c.Templates.Store.Driver = "files"
+	}
+	if c.Templates.Store.Path == "" {
+		c.Templates.Store.Path = "./data/templates.db"
+	}
 
 	if c.RateLimit.PerHour == 0 {
 		c.RateLimit.PerHour = 100
@@ -65,6 +610,45 @@ func (c *Config) setDefaults() {
 	if c.RateLimit.Burst == 0 {
 		c.RateLimit.Burst = 5
 	}
+	if c.RateLimit.OnLimit == "" {
+		c.RateLimit.OnLimit = "queue"
+	}
+	if c.RateLimit.Driver == "" {
+		c.RateLimit.Driver = "memory"
+	}
+	if c.RateLimit.OverflowPolicy == "" {
+		c.RateLimit.OverflowPolicy = "reject"
+	}
+	if c.RateLimit.Adaptive.Backoff == 0 {
+		c.RateLimit.Adaptive.Backoff = 0.5
+	}
+	if c.RateLimit.Adaptive.MinFactor == 0 {
+		c.RateLimit.Adaptive.MinFactor = 0.1
+	}
+	if c.RateLimit.Retry.MaxAttempts == 0 {
+		c.RateLimit.Retry.MaxAttempts = 3
+	}
+	if c.RateLimit.Retry.InitialDelay == 0 {
+		c.RateLimit.Retry.InitialDelay = 10 * time.Second
+	}
+	if c.RateLimit.Retry.Multiplier == 0 {
+		c.RateLimit.Retry.Multiplier = 2
+	}
+	if c.RateLimit.Retry.MaxDelay == 0 {
+		c.RateLimit.Retry.MaxDelay = 10 * time.Minute
+	}
+	if c.RateLimit.SnapshotInterval == 0 {
+		c.RateLimit.SnapshotInterval = 10 * time.Second
+	}
+	if c.RateLimit.Adaptive.Cooldown == 0 {
+		c.RateLimit.Adaptive.Cooldown = 5 * time.Minute
+	}
+	if c.RateLimit.CircuitBreaker.Failures == 0 {
+		c.RateLimit.CircuitBreaker.Failures = 5
+	}
+	if c.RateLimit.CircuitBreaker.Cooldown == 0 {
+		c.RateLimit.CircuitBreaker.Cooldown = 30 * time.Second
+	}
 
 	if c.Logging.Level == "" {
 		c.Logging.Level = "info"
@@ -72,32 +656,466 @@ func (c *Config) setDefaults() {
 	if c.Logging.FilePath == "" {
 		c.Logging.FilePath = "./logs/runebird.log"
 	}
+
+	if c.Scheduler.StatusRetention == 0 {
+		c.Scheduler.StatusRetention = 24 * time.Hour
+	}
+	if c.Scheduler.Workers == 0 {
+		c.Scheduler.Workers = 4
+	}
+	if c.Scheduler.Retry.MaxAttempts == 0 {
+		c.Scheduler.Retry.MaxAttempts = 3
+	}
+	if c.Scheduler.Retry.InitialDelay == 0 {
+		c.Scheduler.Retry.InitialDelay = 30 * time.Second
+	}
+	if c.Scheduler.Retry.Multiplier == 0 {
+		c.Scheduler.Retry.Multiplier = 2
+	}
+	if c.Scheduler.Retry.MaxDelay == 0 {
+		c.Scheduler.Retry.MaxDelay = time.Hour
+	}
+
+	if c.Webhooks.Timeout == 0 {
+		c.Webhooks.Timeout = 10 * time.Second
+	}
+	if c.Webhooks.MaxAttempts == 0 {
+		c.Webhooks.MaxAttempts = 5
+	}
+	if c.Webhooks.RetryDelay == 0 {
+		c.Webhooks.RetryDelay = 5 * time.Second
+	}
+
+	mb := &c.Bounces.Mailbox
+	if mb.Protocol == "" {
+		mb.Protocol = "imap"
+	}
+	if mb.TLSMode == "" {
+		mb.TLSMode = "implicit"
+	}
+	if mb.Port == 0 {
+		switch {
+		case mb.Protocol == "pop3" && mb.TLSMode == "implicit":
+			mb.Port = 995
+		case mb.Protocol == "pop3":
+			mb.Port = 110
+		case mb.TLSMode == "implicit":
+			mb.Port = 993
+		default:
+			mb.Port = 143
+		}
+	}
+	if mb.Folder == "" {
+		mb.Folder = "INBOX"
+	}
+	if mb.Interval == 0 {
+		mb.Interval = time.Minute
+	}
+	if mb.Timeout == 0 {
+		mb.Timeout = 30 * time.Second
+	}
+
+	if c.Store.Driver == "" {
+		c.Store.Driver = "memory"
+	}
+	if c.Store.Redis.Addr == "" {
+		c.Store.Redis.Addr = "localhost:6379"
+	}
+	if c.Store.Redis.KeyPrefix == "" {
+		c.Store.Redis.KeyPrefix = "runebird"
+	}
+	if c.Store.MessageRetention == 0 {
+		c.Store.MessageRetention = 7 * 24 * time.Hour
+	}
+
+	for i := range c.Delivery.Profiles {
+		c.Delivery.Profiles[i].setDefaults(c)
+	}
 }
 
-func (c *Config) Validate() error {
-	if c.Server.Port < 1 || c.Server.Port > 65535 {
-		return fmt.Errorf("server port must be between 1 and 65535, got %d", c.Server.Port)
+// setDefaults fills in the defaults shared by the primary SMTP profile and its fallbacks.
+// setFallbackDefaults fills in the fallbacks of s from s, naming those without a name after
+// their position with prefix.
+func (s *SMTPConfig) setFallbackDefaults(prefix string) {
+	for i := range s.Fallbacks {
+		fallback := &s.Fallbacks[i]
+		if fallback.FromAddress == "" {
+			fallback.FromAddress = s.FromAddress
+		}
+		if fallback.EnvelopeFrom == "" {
+			fallback.EnvelopeFrom = s.EnvelopeFrom
+		}
+		if fallback.Name == "" {
+			fallback.Name = fmt.Sprintf("%sfallback-%d", prefix, i+1)
+		}
+		fallback.setDefaults()
 	}
+}
 
-	if c.SMTP.Host == "" {
+// setDefaults fills in the settings p leaves out from those of the default provider in c,
+// whose defaults must already be set.
+func (p *DeliveryProfile) setDefaults(c *Config) {
+	if p.Provider == "" {
+		p.Provider = "smtp"
+	}
+	if p.SMTP.FromAddress == "" {
+		p.SMTP.FromAddress = c.SMTP.FromAddress
+	}
+	if p.SMTP.Name == "" {
+		p.SMTP.Name = p.Name
+	}
+	p.SMTP.setDefaults()
+	if p.SMTP.Retry == (RetryConfig{}) {
+		p.SMTP.Retry = c.SMTP.Retry
+	}
+	p.SMTP.setFallbackDefaults(p.Name + "-")
+	if p.SendGrid.FromAddress == "" {
+		p.SendGrid.FromAddress = p.SMTP.FromAddress
+	}
+	if p.SendGrid.BaseURL == "" {
+		p.SendGrid.BaseURL = c.Delivery.SendGrid.BaseURL
+	}
+	if p.SES.FromAddress == "" {
+		p.SES.FromAddress = p.SMTP.FromAddress
+	}
+	if p.SES.Region == "" {
+		p.SES.Region = c.Delivery.SES.Region
+	}
+	if p.RateLimit.PerHour == 0 {
+		p.RateLimit.PerHour = c.RateLimit.PerHour
+	}
+	if p.RateLimit.Burst == 0 {
+		p.RateLimit.Burst = c.RateLimit.Burst
+	}
+}
+
+func (s *SMTPConfig) setDefaults() {
+	if s.Port == 0 {
+		s.Port = 587
+	}
+	if s.TLSMode == "" {
+		s.TLSMode = "starttls"
+	}
+	if s.AuthMethod == "" {
+		s.AuthMethod = "plain"
+	}
+	if s.DialTimeout == 0 {
+		s.DialTimeout = 10 * time.Second
+	}
+	if s.SendTimeout == 0 {
+		s.SendTimeout = time.Minute
+	}
+}
+
+// validate checks the settings of a single SMTP profile.
+func (s *SMTPConfig) validate() error {
+	if s.Host == "" {
 		return fmt.Errorf("SMTP host is required")
 	}
-	if c.SMTP.Port < 1 || c.SMTP.Port > 65535 {
-		return fmt.Errorf("SMTP port must be between 1 and 65535, got %d", c.SMTP.Port)
+	if s.Port < 1 || s.Port > 65535 {
+		return fmt.Errorf("SMTP port must be between 1 and 65535, got %d", s.Port)
 	}
-	if c.SMTP.Username == "" {
+	if s.Username == "" {
 		return fmt.Errorf("SMTP username is required")
 	}
-	if c.SMTP.Password == "" {
-		return fmt.Errorf("SMTP password is required")
+	switch s.AuthMethod {
+	case "plain":
+		if s.Password == "" {
+			return fmt.Errorf("SMTP password is required")
+		}
+	case "xoauth2":
+		if s.OAuth2.ClientID == "" || s.OAuth2.RefreshToken == "" || s.OAuth2.TokenURL == "" {
+			return fmt.Errorf("SMTP oauth2 client_id, refresh_token and token_url are required for xoauth2")
+		}
+	default:
+		return fmt.Errorf("SMTP auth_method must be one of plain, xoauth2; got %s", s.AuthMethod)
 	}
-	if c.SMTP.FromAddress == "" {
+	if s.FromAddress == "" {
 		return fmt.Errorf("SMTP from address is required")
 	}
+	if s.EnvelopeFrom != "" {
+		if addr, err := mail.ParseAddress(s.EnvelopeFrom); err != nil || addr.Name != "" {
+			return fmt.Errorf("SMTP envelope_from must be a plain email address, got %s", s.EnvelopeFrom)
+		}
+	}
+	if s.TLSMode != "none" && s.TLSMode != "starttls" && s.TLSMode != "implicit" {
+		return fmt.Errorf("SMTP tls_mode must be one of none, starttls, implicit; got %s", s.TLSMode)
+	}
+	if s.DialTimeout < 0 || s.SendTimeout < 0 {
+		return fmt.Errorf("SMTP dial and send timeouts must not be negative, got %s and %s", s.DialTimeout, s.SendTimeout)
+	}
+	return nil
+}
+
+// validateProvider checks the settings of the delivery provider named provider. smtpNames holds
+// the names of the SMTP profiles already checked, to which those of smtp are added.
+func validateProvider(provider string, smtp *SMTPConfig, sendGrid *SendGridConfig, ses *SESConfig, smtpNames map[string]bool) error {
+	switch provider {
+	case "smtp":
+		if err := smtp.validate(); err != nil {
+			return err
+		}
+		if smtp.Retry.MaxAttempts < 1 {
+			return fmt.Errorf("SMTP retry max attempts must be greater than 0, got %d", smtp.Retry.MaxAttempts)
+		}
+		if smtp.Retry.InitialDelay < 0 {
+			return fmt.Errorf("SMTP retry initial delay must not be negative, got %s", smtp.Retry.InitialDelay)
+		}
+		if smtp.Retry.Multiplier < 1 {
+			return fmt.Errorf("SMTP retry multiplier must be at least 1, got %g", smtp.Retry.Multiplier)
+		}
+		if smtp.Retry.MaxDelay < smtp.Retry.InitialDelay {
+			return fmt.Errorf("SMTP retry max delay must not be less than the initial delay, got %s", smtp.Retry.MaxDelay)
+		}
+		if smtpNames[smtp.Name] {
+			return fmt.Errorf("SMTP profile names must be unique, got %s more than once", smtp.Name)
+		}
+		smtpNames[smtp.Name] = true
+		for _, fallback := range smtp.Fallbacks {
+			if len(fallback.Fallbacks) > 0 {
+				return fmt.Errorf("SMTP fallback %s must not have fallbacks of its own", fallback.Name)
+			}
+			if err := fallback.validate(); err != nil {
+				return fmt.Errorf("SMTP fallback %s: %v", fallback.Name, err)
+			}
+			if smtpNames[fallback.Name] {
+				return fmt.Errorf("SMTP profile names must be unique, got %s more than once", fallback.Name)
+			}
+			smtpNames[fallback.Name] = true
+		}
+	case "sendgrid":
+		if sendGrid.APIKey == "" {
+			return fmt.Errorf("SendGrid API key is required")
+		}
+		if sendGrid.FromAddress == "" {
+			return fmt.Errorf("SendGrid from address is required")
+		}
+	case "ses":
+		if ses.Region == "" {
+			return fmt.Errorf("SES region is required")
+		}
+		if (ses.AccessKeyID == "") != (ses.SecretAccessKey == "") {
+			return fmt.Errorf("SES access_key_id and secret_access_key must be set together")
+		}
+		if ses.FromAddress == "" {
+			return fmt.Errorf("SES from address is required")
+		}
+	default:
+		return fmt.Errorf("delivery provider must be one of smtp, sendgrid, ses; got %s", provider)
+	}
+	return nil
+}
+
+// validProfileName reports whether name can name a delivery profile, in Redis keys and metric
+// labels among others.
+func validProfileName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Config) Validate() error {
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		return fmt.Errorf("server port must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.GRPC.Port != 0 && (c.Server.GRPC.Port < 1 || c.Server.GRPC.Port > 65535) {
+		return fmt.Errorf("server gRPC port must be between 1 and 65535, got %d", c.Server.GRPC.Port)
+	}
+	if c.Server.GRPC.Port == c.Server.Port {
+		return fmt.Errorf("server gRPC port must differ from the HTTP port %d", c.Server.Port)
+	}
+	if c.Admin.Port != 0 && (c.Admin.Port < 1 || c.Admin.Port > 65535) {
+		return fmt.Errorf("admin port must be between 1 and 65535, got %d", c.Admin.Port)
+	}
+	if c.Admin.Port != 0 && (c.Admin.Port == c.Server.Port || c.Admin.Port == c.Server.GRPC.Port) {
+		return fmt.Errorf("admin port must differ from the HTTP and gRPC ports, got %d", c.Admin.Port)
+	}
+	if c.Server.IdempotencyTTL < 0 {
+		return fmt.Errorf("server idempotency TTL must not be negative, got %s", c.Server.IdempotencyTTL)
+	}
+	if c.Server.MXCacheTTL < 0 {
+		return fmt.Errorf("server MX cache TTL must not be negative, got %s", c.Server.MXCacheTTL)
+	}
+	if c.Server.MaxAttachmentSize < 0 {
+		return fmt.Errorf("server max attachment size must not be negative, got %d", c.Server.MaxAttachmentSize)
+	}
+	if c.Server.MaxMessageSize < 0 {
+		return fmt.Errorf("server max message size must not be negative, got %d", c.Server.MaxMessageSize)
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		return fmt.Errorf("server shutdown timeout must not be negative, got %s", c.Server.ShutdownTimeout)
+	}
+	if h := c.Server.HTTP; h.ReadHeaderTimeout < 0 || h.ReadTimeout < 0 || h.WriteTimeout < 0 || h.IdleTimeout < 0 {
+		return fmt.Errorf("server HTTP timeouts must not be negative")
+	}
+	if c.Server.HTTP.MaxBodySize < 0 {
+		return fmt.Errorf("server HTTP max body size must not be negative, got %d", c.Server.HTTP.MaxBodySize)
+	}
+	if c.Server.ClientLimits.RequestsPerMinute < 0 || c.Server.ClientLimits.EmailsPerDay < 0 {
+		return fmt.Errorf("server client limits must not be negative")
+	}
+	for name, limit := range c.Server.ClientLimits.Clients {
+		if limit.RequestsPerMinute < 0 || limit.EmailsPerDay < 0 {
+			return fmt.Errorf("server client limits of %s must not be negative", name)
+		}
+	}
+	if (c.Server.TLS.CertFile == "") != (c.Server.TLS.KeyFile == "") {
+		return fmt.Errorf("server TLS requires both a cert file and a key file")
+	}
+	if c.Server.TLS.ClientCAFile != "" && c.Server.TLS.CertFile == "" {
+		return fmt.Errorf("server TLS client CA file requires a cert file and a key file")
+	}
+	if len(c.Server.TLS.AllowedClients) > 0 && c.Server.TLS.ClientCAFile == "" {
+		return fmt.Errorf("server TLS allowed clients require a client CA file")
+	}
+	if c.Server.TLS.ReloadInterval < 0 {
+		return fmt.Errorf("server TLS reload interval must not be negative, got %s", c.Server.TLS.ReloadInterval)
+	}
+	switch c.Server.Auth.Mode {
+	case "", "none":
+	case "jwt":
+		jwt := c.Server.Auth.JWT
+		if jwt.Issuer == "" {
+			return fmt.Errorf("server auth JWT issuer is required")
+		}
+		for _, u := range []string{jwt.Issuer, jwt.JWKSURL} {
+			if u == "" {
+				continue
+			}
+			if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("server auth JWT URL must be an absolute http or https URL, got %s", u)
+			}
+		}
+		if jwt.Leeway < 0 {
+			return fmt.Errorf("server auth JWT leeway must not be negative, got %s", jwt.Leeway)
+		}
+		if jwt.RefreshInterval <= 0 {
+			return fmt.Errorf("server auth JWT refresh interval must be greater than 0, got %s", jwt.RefreshInterval)
+		}
+	default:
+		return fmt.Errorf("server auth mode must be one of none, jwt; got %s", c.Server.Auth.Mode)
+	}
+
+	for _, allowed := range c.Delivery.AllowedFrom {
+		if strings.HasPrefix(allowed, "@") && len(allowed) > 1 {
+			continue
+		}
+		if addr, err := mail.ParseAddress(allowed); err != nil || addr.Name != "" {
+			return fmt.Errorf("delivery allowed_from entries must be plain email addresses or @domain, got %s", allowed)
+		}
+	}
+
+	for _, domains := range [][]string{c.Delivery.RecipientDomains.Allow, c.Delivery.RecipientDomains.Deny} {
+		for _, domain := range domains {
+			if domain == "" || strings.ContainsAny(domain, "@ \t") {
+				return fmt.Errorf("delivery recipient_domains entries must be domain names, got %q", domain)
+			}
+		}
+	}
+
+	if c.Delivery.Archive.Address != "" {
+		if addr, err := mail.ParseAddress(c.Delivery.Archive.Address); err != nil || addr.Name != "" {
+			return fmt.Errorf("delivery archive address must be a plain email address, got %s", c.Delivery.Archive.Address)
+		}
+	}
+	if c.Delivery.HealthCheck.Enabled {
+		if c.Delivery.HealthCheck.Interval <= 0 {
+			return fmt.Errorf("delivery health check interval must be greater than 0, got %s", c.Delivery.HealthCheck.Interval)
+		}
+		if c.Delivery.HealthCheck.Timeout <= 0 {
+			return fmt.Errorf("delivery health check timeout must be greater than 0, got %s", c.Delivery.HealthCheck.Timeout)
+		}
+	}
+
+	// SMTP profile names label the SMTP metrics, so they must be unique across delivery profiles.
+	smtpNames := make(map[string]bool)
+	if err := validateProvider(c.Delivery.Provider, &c.SMTP, &c.Delivery.SendGrid, &c.Delivery.SES, smtpNames); err != nil {
+		return err
+	}
+	profileNames := make(map[string]bool, len(c.Delivery.Profiles))
+	for _, p := range c.Delivery.Profiles {
+		if !validProfileName(p.Name) {
+			return fmt.Errorf("delivery profile name must be made of letters, digits, - and _, got %q", p.Name)
+		}
+		if profileNames[p.Name] {
+			return fmt.Errorf("delivery profile names must be unique, got %s more than once", p.Name)
+		}
+		profileNames[p.Name] = true
+		if err := validateProvider(p.Provider, &p.SMTP, &p.SendGrid, &p.SES, smtpNames); err != nil {
+			return fmt.Errorf("delivery profile %s: %v", p.Name, err)
+		}
+		if p.RateLimit.PerHour <= 0 || p.RateLimit.Burst <= 0 {
+			return fmt.Errorf("delivery profile %s: rate limit per_hour and burst must be greater than 0, got %d and %d", p.Name, p.RateLimit.PerHour, p.RateLimit.Burst)
+		}
+	}
 
 	if c.Templates.Path == "" {
 		return fmt.Errorf("templates path is required")
 	}
+	if c.Templates.Watch && c.Templates.WatchInterval <= 0 {
+		return fmt.Errorf("templates watch interval must be greater than 0, got %s", c.Templates.WatchInterval)
+	}
+	if c.Templates.RenderCacheSize < 0 {
+		return fmt.Errorf("templates render cache size must not be negative, got %d", c.Templates.RenderCacheSize)
+	}
+	if remote := c.Templates.Remote; remote.Bucket != "" {
+		if remote.Region == "" {
+			return fmt.Errorf("templates remote region is required")
+		}
+		if (remote.AccessKeyID == "") != (remote.SecretAccessKey == "") {
+			return fmt.Errorf("templates remote access_key_id and secret_access_key must be set together")
+		}
+		if remote.Endpoint != "" {
+			if u, err := url.Parse(remote.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("templates remote endpoint must be an absolute http or https URL, got %s", remote.Endpoint)
+			}
+		}
+		if remote.SyncInterval <= 0 {
+			return fmt.Errorf("templates remote sync interval must be greater than 0, got %s", remote.SyncInterval)
+		}
+	}
+	switch c.Templates.Store.Driver {
+	case "files":
+	case "redis":
+		if c.Store.Redis.Addr == "" {
+			return fmt.Errorf("redis address is required when templates store driver is redis")
+		}
+	case "bolt":
+		if c.Templates.Store.Path == "" {
+			return fmt.Errorf("templates store path is required when templates store driver is bolt")
+		}
+	default:
+		return fmt.Errorf("templates store driver must be one of files, bolt, redis; got %s", c.Templates.Store.Driver)
+	}
+	if unsubscribe := c.Templates.Unsubscribe; unsubscribe.URL != "" {
+		u, err := url.Parse(unsubscribe.URL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("templates unsubscribe url must be an absolute https URL, got %s", unsubscribe.URL)
+		}
+		if unsubscribe.Secret == "" {
+			return fmt.Errorf("templates unsubscribe secret is required with an unsubscribe url")
+		}
+	}
+	if mailto := c.Templates.Unsubscribe.Mailto; mailto != "" {
+		if _, err := mail.ParseAddress(mailto); err != nil {
+			return fmt.Errorf("templates unsubscribe mailto must be an email address, got %s", mailto)
+		}
+	}
+	if tracking := c.Templates.Tracking; tracking.Opens || tracking.Clicks {
+		u, err := url.Parse(tracking.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("templates tracking url must be an absolute http or https URL, got %q", tracking.URL)
+		}
+		if tracking.Clicks && tracking.Secret == "" {
+			return fmt.Errorf("templates tracking secret is required with click tracking")
+		}
+	}
 
 	if c.RateLimit.PerHour < 1 {
 		return fmt.Errorf("rate limit per hour must be greater than 0, got %d", c.RateLimit.PerHour)
@@ -105,17 +1123,173 @@ func (c *Config) Validate() error {
 	if c.RateLimit.Burst < 1 {
 		return fmt.Errorf("rate limit burst must be greater than 0, got %d", c.RateLimit.Burst)
 	}
+	if c.RateLimit.DailyLimit < 0 {
+		return fmt.Errorf("rate limit daily limit must not be negative, got %d", c.RateLimit.DailyLimit)
+	}
+	if c.RateLimit.MonthlyLimit < 0 {
+		return fmt.Errorf("rate limit monthly limit must not be negative, got %d", c.RateLimit.MonthlyLimit)
+	}
 
 	if c.Logging.Level != "debug" && c.Logging.Level != "info" && c.Logging.Level != "warn" && c.Logging.Level != "error" {
 		return fmt.Errorf("logging level must be one of debug, info, warn, error; got %s", c.Logging.Level)
 	}
 
+	if c.Scheduler.StatusRetention < 0 {
+		return fmt.Errorf("scheduler status retention must not be negative, got %s", c.Scheduler.StatusRetention)
+	}
+	if c.Scheduler.Workers < 1 {
+		return fmt.Errorf("scheduler workers must be greater than 0, got %d", c.Scheduler.Workers)
+	}
+	if c.Scheduler.Retry.MaxAttempts < 1 {
+		return fmt.Errorf("scheduler retry max attempts must be greater than 0, got %d", c.Scheduler.Retry.MaxAttempts)
+	}
+	if c.Scheduler.Retry.InitialDelay < 0 {
+		return fmt.Errorf("scheduler retry initial delay must not be negative, got %s", c.Scheduler.Retry.InitialDelay)
+	}
+	if c.Scheduler.Retry.Multiplier < 1 {
+		return fmt.Errorf("scheduler retry multiplier must be at least 1, got %g", c.Scheduler.Retry.Multiplier)
+	}
+	if c.Scheduler.Retry.MaxDelay < c.Scheduler.Retry.InitialDelay {
+		return fmt.Errorf("scheduler retry max delay must not be less than the initial delay, got %s", c.Scheduler.Retry.MaxDelay)
+	}
+
+	if c.Webhooks.Timeout < 0 {
+		return fmt.Errorf("webhook timeout must not be negative, got %s", c.Webhooks.Timeout)
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		return fmt.Errorf("webhook max attempts must be greater than 0, got %d", c.Webhooks.MaxAttempts)
+	}
+	if c.Webhooks.RetryDelay < 0 {
+		return fmt.Errorf("webhook retry delay must not be negative, got %s", c.Webhooks.RetryDelay)
+	}
+	if c.Bounces.SendGrid.Enabled && c.Bounces.SendGrid.PublicKey == "" {
+		return fmt.Errorf("sendgrid bounces public key is required when sendgrid bounces are enabled")
+	}
+	if c.Bounces.Mailgun.Enabled && c.Bounces.Mailgun.SigningKey == "" {
+		return fmt.Errorf("mailgun bounces signing key is required when mailgun bounces are enabled")
+	}
+	if mb := c.Bounces.Mailbox; mb.Enabled {
+		if mb.Protocol != "imap" && mb.Protocol != "pop3" {
+			return fmt.Errorf("bounce mailbox protocol must be one of imap, pop3; got %s", mb.Protocol)
+		}
+		if mb.Host == "" || mb.Username == "" {
+			return fmt.Errorf("bounce mailbox host and username are required when the bounce mailbox is enabled")
+		}
+		if mb.TLSMode != "none" && mb.TLSMode != "starttls" && mb.TLSMode != "implicit" {
+			return fmt.Errorf("bounce mailbox tls_mode must be one of none, starttls, implicit; got %s", mb.TLSMode)
+		}
+		if mb.Interval <= 0 || mb.Timeout <= 0 {
+			return fmt.Errorf("bounce mailbox interval and timeout must be greater than 0, got %s and %s", mb.Interval, mb.Timeout)
+		}
+	}
+
+	if c.Store.Driver != "memory" && c.Store.Driver != "redis" {
+		return fmt.Errorf("store driver must be one of memory, redis; got %s", c.Store.Driver)
+	}
+	if c.Store.Driver == "redis" && c.Store.Redis.Addr == "" {
+		return fmt.Errorf("redis address is required when store driver is redis")
+	}
+	if c.Store.MessageRetention < 0 {
+		return fmt.Errorf("store message retention must not be negative, got %s", c.Store.MessageRetention)
+	}
+	if c.RateLimit.OnLimit != "queue" && c.RateLimit.OnLimit != "reject" {
+		return fmt.Errorf("rate limit on_limit must be one of queue, reject; got %s", c.RateLimit.OnLimit)
+	}
+	if c.RateLimit.MaxQueueSize < 0 {
+		return fmt.Errorf("rate limit max queue size must not be negative, got %d", c.RateLimit.MaxQueueSize)
+	}
+	if c.RateLimit.OverflowPolicy != "reject" && c.RateLimit.OverflowPolicy != "drop_oldest" && c.RateLimit.OverflowPolicy != "spill" {
+		return fmt.Errorf("rate limit overflow policy must be one of reject, drop_oldest, spill; got %s", c.RateLimit.OverflowPolicy)
+	}
+	if c.RateLimit.OverflowPolicy == "spill" && c.RateLimit.SpillPath == "" {
+		return fmt.Errorf("rate limit spill path is required when overflow policy is spill")
+	}
+	if (c.RateLimit.SendWindow.Start == "") != (c.RateLimit.SendWindow.End == "") {
+		return fmt.Errorf("rate limit send window requires both start and end")
+	}
+	if c.RateLimit.SendWindow.Start != "" {
+		start, err := time.Parse("15:04", c.RateLimit.SendWindow.Start)
+		if err != nil {
+			return fmt.Errorf("rate limit send window start must be in HH:MM form, got %s", c.RateLimit.SendWindow.Start)
+		}
+		end, err := time.Parse("15:04", c.RateLimit.SendWindow.End)
+		if err != nil {
+			return fmt.Errorf("rate limit send window end must be in HH:MM form, got %s", c.RateLimit.SendWindow.End)
+		}
+		if start.Equal(end) {
+			return fmt.Errorf("rate limit send window start and end must differ, got %s", c.RateLimit.SendWindow.Start)
+		}
+		if _, err := time.LoadLocation(c.RateLimit.SendWindow.Timezone); err != nil {
+			return fmt.Errorf("rate limit send window timezone is invalid: %v", err)
+		}
+	}
+	if c.RateLimit.Retry.MaxAttempts < 1 {
+		return fmt.Errorf("rate limit retry max attempts must be greater than 0, got %d", c.RateLimit.Retry.MaxAttempts)
+	}
+	if c.RateLimit.Retry.InitialDelay < 0 {
+		return fmt.Errorf("rate limit retry initial delay must not be negative, got %s", c.RateLimit.Retry.InitialDelay)
+	}
+	if c.RateLimit.Retry.Multiplier < 1 {
+		return fmt.Errorf("rate limit retry multiplier must be at least 1, got %g", c.RateLimit.Retry.Multiplier)
+	}
+	if c.RateLimit.Retry.MaxDelay < c.RateLimit.Retry.InitialDelay {
+		return fmt.Errorf("rate limit retry max delay must not be less than the initial delay, got %s", c.RateLimit.Retry.MaxDelay)
+	}
+	if c.RateLimit.SnapshotInterval < 0 {
+		return fmt.Errorf("rate limit snapshot interval must not be negative, got %s", c.RateLimit.SnapshotInterval)
+	}
+	if c.RateLimit.Adaptive.Enabled {
+		if c.RateLimit.Adaptive.Backoff <= 0 || c.RateLimit.Adaptive.Backoff >= 1 {
+			return fmt.Errorf("rate limit adaptive backoff must be between 0 and 1, got %g", c.RateLimit.Adaptive.Backoff)
+		}
+		if c.RateLimit.Adaptive.MinFactor <= 0 || c.RateLimit.Adaptive.MinFactor > 1 {
+			return fmt.Errorf("rate limit adaptive min factor must be greater than 0 and at most 1, got %g", c.RateLimit.Adaptive.MinFactor)
+		}
+		if c.RateLimit.Adaptive.Cooldown <= 0 {
+			return fmt.Errorf("rate limit adaptive cooldown must be greater than 0, got %s", c.RateLimit.Adaptive.Cooldown)
+		}
+	}
+	if c.RateLimit.CircuitBreaker.Enabled {
+		if c.RateLimit.CircuitBreaker.Failures < 1 {
+			return fmt.Errorf("rate limit circuit breaker failures must be at least 1, got %d", c.RateLimit.CircuitBreaker.Failures)
+		}
+		if c.RateLimit.CircuitBreaker.Cooldown <= 0 {
+			return fmt.Errorf("rate limit circuit breaker cooldown must be greater than 0, got %s", c.RateLimit.CircuitBreaker.Cooldown)
+		}
+	}
+	if c.RateLimit.Driver != "memory" && c.RateLimit.Driver != "redis" {
+		return fmt.Errorf("rate limit driver must be one of memory, redis; got %s", c.RateLimit.Driver)
+	}
+	if c.RateLimit.Driver == "redis" && c.Store.Redis.Addr == "" {
+		return fmt.Errorf("redis address is required when rate limit driver is redis")
+	}
+
 	return nil
 
 }
 
+// Options are the command-line settings of LoadWith, which take precedence over the config file
+// and the environment.
+type Options struct {
+	// Path is the config file, instead of EMAILER_CONFIG_PATH.
+	Path string
+	// Set holds the values of config fields by their path in the YAML file, as in server.port,
+	// written as in environment variables.
+	Set map[string]string
+}
+
+// Load reads the config file named by EMAILER_CONFIG_PATH, or emailer.yaml, applies the
+// environment overrides and validates the result.
 func Load() (*Config, error) {
-	path := os.Getenv("EMAILER_CONFIG_PATH")
+	return LoadWith(Options{})
+}
+
+// LoadWith is Load with the config file and field values given in opts.
+func LoadWith(opts Options) (*Config, error) {
+	path := opts.Path
+	if path == "" {
+		path = os.Getenv("EMAILER_CONFIG_PATH")
+	}
 	if path == "" {
 		path = "emailer.yaml"
 	}
@@ -125,10 +1299,28 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
 	}
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	root, err := parseFile(path, data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %v", err)
 	}
+	var cfg Config
+	if err := resolveSecretFiles(&root, reflect.TypeOf(cfg), ""); err != nil {
+		return nil, fmt.Errorf("failed to read secret files: %v", err)
+	}
+	if root.Kind != 0 {
+		if err := root.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal config: %v", err)
+		}
+	}
+	if err := applyEnv(&cfg, os.Environ()); err != nil {
+		return nil, fmt.Errorf("failed to apply environment overrides: %v", err)
+	}
+	if err := applySet(&cfg, opts.Set); err != nil {
+		return nil, fmt.Errorf("failed to apply command-line overrides: %v", err)
+	}
+	if err := cfg.resolveVault(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to read secrets from vault: %v", err)
+	}
 
 	cfg.setDefaults()
 
@@ -1,10 +1,20 @@
 package config
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -75,6 +85,24 @@ smtp:
 		if cfg.Logging.Level != "info" {
 			t.Errorf("expected default log level 'info', got: %s", cfg.Logging.Level)
 		}
+		if cfg.Scheduler.StatusRetention != 24*time.Hour {
+			t.Errorf("expected default status retention 24h, got: %s", cfg.Scheduler.StatusRetention)
+		}
+		if cfg.Store.MessageRetention != 7*24*time.Hour {
+			t.Errorf("expected default message retention 168h, got: %s", cfg.Store.MessageRetention)
+		}
+		if h := cfg.Server.HTTP; h.ReadHeaderTimeout != 10*time.Second || h.WriteTimeout != 2*time.Minute || h.MaxBodySize != 16<<20 {
+			t.Errorf("expected default HTTP timeouts and a 16 MiB body limit, got: %+v", h)
+		}
+		if cfg.Scheduler.Workers != 4 {
+			t.Errorf("expected default of 4 scheduler workers, got: %d", cfg.Scheduler.Workers)
+		}
+		if cfg.Scheduler.Retry.MaxAttempts != 3 || cfg.Scheduler.Retry.InitialDelay != 30*time.Second {
+			t.Errorf("expected default retry policy of 3 attempts from 30s, got: %+v", cfg.Scheduler.Retry)
+		}
+		if cfg.Webhooks.MaxAttempts != 5 || cfg.Webhooks.Timeout != 10*time.Second {
+			t.Errorf("expected default webhook policy of 5 attempts with 10s timeout, got: %+v", cfg.Webhooks)
+		}
 	})
 
 	t.Run("InvalidPort", func(t *testing.T) {
@@ -183,6 +211,785 @@ logging:
 		}
 	})
 
+	t.Run("InvalidRateLimitDriver", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+smtp:
+  host: "smtp.example.com"
+  port: 587
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+rate_limit:
+  driver: "memcached"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		err := os.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		if err != nil {
+			t.Fatalf("failed to set env var: %v", err)
+		}
+		defer func() {
+			err := os.Unsetenv("EMAILER_CONFIG_PATH")
+			if err != nil {
+				fmt.Printf("failed to unset env var: %v", err)
+			}
+		}()
+
+		_, err = Load()
+		if err == nil {
+			t.Fatal("expected error for invalid rate limit driver, got none")
+		}
+	})
+
+	t.Run("InvalidSMTPTLSMode", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+smtp:
+  host: "smtp.example.com"
+  port: 587
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+  tls_mode: "ssl"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		err := os.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		if err != nil {
+			t.Fatalf("failed to set env var: %v", err)
+		}
+		defer func() {
+			err := os.Unsetenv("EMAILER_CONFIG_PATH")
+			if err != nil {
+				fmt.Printf("failed to unset env var: %v", err)
+			}
+		}()
+
+		_, err = Load()
+		if err == nil {
+			t.Fatal("expected error for invalid SMTP TLS mode, got none")
+		}
+	})
+
+	t.Run("SendGridWithoutAPIKey", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+delivery:
+  provider: "sendgrid"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		err := os.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		if err != nil {
+			t.Fatalf("failed to set env var: %v", err)
+		}
+		defer func() {
+			err := os.Unsetenv("EMAILER_CONFIG_PATH")
+			if err != nil {
+				fmt.Printf("failed to unset env var: %v", err)
+			}
+		}()
+
+		_, err = Load()
+		if err == nil {
+			t.Fatal("expected error for SendGrid without an API key, got none")
+		}
+	})
+
+	t.Run("XOAUTH2MissingRefreshToken", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+smtp:
+  host: "smtp.example.com"
+  port: 587
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+  auth_method: "xoauth2"
+  oauth2:
+    client_id: "client"
+    token_url: "https://oauth2.googleapis.com/token"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		err := os.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		if err != nil {
+			t.Fatalf("failed to set env var: %v", err)
+		}
+		defer func() {
+			err := os.Unsetenv("EMAILER_CONFIG_PATH")
+			if err != nil {
+				fmt.Printf("failed to unset env var: %v", err)
+			}
+		}()
+
+		_, err = Load()
+		if err == nil {
+			t.Fatal("expected error for xoauth2 without a refresh token, got none")
+		}
+	})
+
+	t.Run("JWTAuthWithoutIssuer", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+  auth:
+    mode: "jwt"
+    jwt:
+      audience: "runebird"
+smtp:
+  host: "smtp.example.com"
+  port: 587
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		err := os.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		if err != nil {
+			t.Fatalf("failed to set env var: %v", err)
+		}
+		defer func() {
+			err := os.Unsetenv("EMAILER_CONFIG_PATH")
+			if err != nil {
+				fmt.Printf("failed to unset env var: %v", err)
+			}
+		}()
+
+		_, err = Load()
+		if err == nil || !strings.Contains(err.Error(), "issuer") {
+			t.Fatalf("expected error for JWT auth without an issuer, got %v", err)
+		}
+	})
+
+	t.Run("GRPCPortMatchesHTTPPort", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+  grpc:
+    port: 8080
+smtp:
+  host: "smtp.example.com"
+  port: 587
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		err := os.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		if err != nil {
+			t.Fatalf("failed to set env var: %v", err)
+		}
+		defer func() {
+			err := os.Unsetenv("EMAILER_CONFIG_PATH")
+			if err != nil {
+				fmt.Printf("failed to unset env var: %v", err)
+			}
+		}()
+
+		_, err = Load()
+		if err == nil || !strings.Contains(err.Error(), "gRPC port") {
+			t.Fatalf("expected error for a gRPC port matching the HTTP port, got %v", err)
+		}
+	})
+
+	t.Run("AdminPortConflict", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+admin:
+  port: 8080
+smtp:
+  host: "smtp.example.com"
+  port: 587
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		err := os.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		if err != nil {
+			t.Fatalf("failed to set env var: %v", err)
+		}
+		defer func() {
+			err := os.Unsetenv("EMAILER_CONFIG_PATH")
+			if err != nil {
+				fmt.Printf("failed to unset env var: %v", err)
+			}
+		}()
+
+		_, err = Load()
+		if err == nil || !strings.Contains(err.Error(), "admin port") {
+			t.Fatalf("expected error for an admin port matching the HTTP port, got %v", err)
+		}
+	})
+
+	t.Run("EnvOverrides", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+smtp:
+  host: "smtp.example.com"
+  username: "user"
+  from_address: "test@example.com"
+  fallbacks:
+    - host: "backup.example.com"
+      username: "backup"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		t.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		t.Setenv("RUNEBIRD_SMTP__PASSWORD", "s3cret: #1")
+		t.Setenv("RUNEBIRD_SERVER__PORT", "9000")
+		t.Setenv("RUNEBIRD_SERVER__HTTP__READ_TIMEOUT", "45s")
+		t.Setenv("RUNEBIRD_DELIVERY__DRY_RUN", "true")
+		t.Setenv("RUNEBIRD_DELIVERY__ALLOWED_FROM", "@example.com, @example.org")
+		t.Setenv("RUNEBIRD_SMTP__FALLBACKS__0__PASSWORD", "backup")
+		t.Setenv("RUNEBIRD_SMTP__FALLBACKS__1__HOST", "third.example.com")
+		t.Setenv("RUNEBIRD_TEMPLATES__GLOBALS", "{company: Acme}")
+		t.Setenv("RUNEBIRD_SMTP__FALLBACKS__1__USERNAME", "third")
+		t.Setenv("RUNEBIRD_SMTP__FALLBACKS__1__PASSWORD", "third")
+
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if cfg.SMTP.Password != "s3cret: #1" {
+			t.Errorf("expected SMTP password from the environment, got: %q", cfg.SMTP.Password)
+		}
+		if cfg.Server.Port != 9000 {
+			t.Errorf("expected server port 9000, got: %d", cfg.Server.Port)
+		}
+		if cfg.Server.HTTP.ReadTimeout != 45*time.Second {
+			t.Errorf("expected read timeout 45s, got: %s", cfg.Server.HTTP.ReadTimeout)
+		}
+		if !cfg.Delivery.DryRun {
+			t.Error("expected dry run enabled from the environment")
+		}
+		if len(cfg.Delivery.AllowedFrom) != 2 || cfg.Delivery.AllowedFrom[1] != "@example.org" {
+			t.Errorf("expected two allowed senders, got: %v", cfg.Delivery.AllowedFrom)
+		}
+		if len(cfg.SMTP.Fallbacks) != 2 || cfg.SMTP.Fallbacks[0].Password != "backup" || cfg.SMTP.Fallbacks[1].Host != "third.example.com" {
+			t.Errorf("expected the first fallback overridden and a second appended, got: %+v", cfg.SMTP.Fallbacks)
+		}
+
+		if cfg.Templates.Globals["company"] != "Acme" {
+			t.Errorf("expected template globals from the environment, got: %v", cfg.Templates.Globals)
+		}
+
+		t.Setenv("RUNEBIRD_SMTP__PASWORD", "typo")
+		if _, err := Load(); err == nil || !strings.Contains(err.Error(), "RUNEBIRD_SMTP__PASWORD") {
+			t.Fatalf("expected error for an unknown field, got %v", err)
+		}
+	})
+
+	t.Run("SecretFiles", func(t *testing.T) {
+		dir := t.TempDir()
+		for name, secret := range map[string]string{"smtp": "smtp-pass\n", "backup": "backup-pass", "webhooks": "hook-secret\n"} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(secret), 0600); err != nil {
+				t.Fatalf("failed to write secret file: %v", err)
+			}
+		}
+		content := `
+server:
+  port: 8080
+smtp:
+  host: "smtp.example.com"
+  username: "user"
+  password_file: "` + filepath.Join(dir, "smtp") + `"
+  from_address: "test@example.com"
+  fallbacks:
+    - host: "backup.example.com"
+      username: "backup"
+      password_file: "` + filepath.Join(dir, "backup") + `"
+vault:
+  token: ""
+  token_file: "/var/run/secrets/token"
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+
+		t.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+		t.Setenv("RUNEBIRD_WEBHOOKS__SECRET_FILE", filepath.Join(dir, "webhooks"))
+
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if cfg.SMTP.Password != "smtp-pass" {
+			t.Errorf("expected SMTP password read from its file, got: %q", cfg.SMTP.Password)
+		}
+		if cfg.SMTP.Fallbacks[0].Password != "backup-pass" {
+			t.Errorf("expected fallback password read from its file, got: %q", cfg.SMTP.Fallbacks[0].Password)
+		}
+		if cfg.Webhooks.Secret != "hook-secret" {
+			t.Errorf("expected webhook secret read from its file, got: %q", cfg.Webhooks.Secret)
+		}
+		if cfg.Vault.TokenFile != "/var/run/secrets/token" {
+			t.Errorf("expected vault.token_file kept as a field of its own, got: %q", cfg.Vault.TokenFile)
+		}
+
+		t.Setenv("RUNEBIRD_WEBHOOKS__SECRET", "inline")
+		if _, err := Load(); err == nil || !strings.Contains(err.Error(), "both set") {
+			t.Fatalf("expected error for a secret set both ways, got %v", err)
+		}
+
+		if err := os.Unsetenv("RUNEBIRD_WEBHOOKS__SECRET"); err != nil {
+			t.Fatalf("failed to unset env var: %v", err)
+		}
+		t.Setenv("RUNEBIRD_WEBHOOKS__SECRET_FILE", filepath.Join(dir, "missing"))
+		if _, err := Load(); err == nil || !strings.Contains(err.Error(), "secret file") {
+			t.Fatalf("expected error for a missing secret file, got %v", err)
+		}
+	})
+
+	t.Run("Vault", func(t *testing.T) {
+		var password atomic.Value
+		password.Store("vault-pass")
+		var logins, renewals atomic.Int32
+		vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/auth/approle/login":
+				var body map[string]string
+				_ = json.NewDecoder(r.Body).Decode(&body)
+				if body["role_id"] != "role" || body["secret_id"] != "secret" {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+					return
+				}
+				logins.Add(1)
+				_, _ = w.Write([]byte(`{"auth":{"client_token":"s.token","lease_duration":3600,"renewable":true}}`))
+			case "/v1/auth/token/renew-self":
+				renewals.Add(1)
+				_, _ = w.Write([]byte(`{"auth":{"client_token":"s.token","lease_duration":3600,"renewable":true}}`))
+			case "/v1/secret/data/runebird":
+				if r.Header.Get("X-Vault-Token") != "s.token" {
+					w.WriteHeader(http.StatusForbidden)
+					_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+					return
+				}
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+					"data":     map[string]interface{}{"smtp_password": password.Load(), "webhook_secret": "hook"},
+					"metadata": map[string]interface{}{"version": 1},
+				}})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errors":[]}`))
+			}
+		}))
+		defer vault.Close()
+
+		content := `
+server:
+  port: 8080
+  http:
+    read_timeout: 45s
+smtp:
+  host: "smtp.example.com"
+  username: "user"
+  password: "vault:secret/data/runebird#smtp_password"
+  from_address: "test@example.com"
+webhooks:
+  secret: "vault:secret/data/runebird#webhook_secret"
+vault:
+  address: "` + vault.URL + `"
+  auth_method: approle
+  role_id: role
+  secret_id: secret
+`
+		tmpPath := createTempYAML(t, content)
+		defer func(name string) {
+			err := os.Remove(name)
+			if err != nil {
+				fmt.Printf("failed to remove temp file: %v", err)
+			}
+		}(tmpPath)
+		t.Setenv("EMAILER_CONFIG_PATH", tmpPath)
+
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if cfg.SMTP.Password != "vault-pass" || cfg.Webhooks.Secret != "hook" {
+			t.Errorf("expected secrets read from Vault, got %q and %q", cfg.SMTP.Password, cfg.Webhooks.Secret)
+		}
+		if logins.Load() != 1 {
+			t.Errorf("expected one login, got %d", logins.Load())
+		}
+		if at := cfg.VaultClient().renewAt(); at.IsZero() || time.Until(at) > time.Hour {
+			t.Errorf("expected a renewal within the token TTL, got %v", at)
+		}
+
+		password.Store("rotated")
+		renewed, err := cfg.VaultClient().Renew(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if renewed.SMTP.Password != "rotated" || cfg.SMTP.Password != "vault-pass" {
+			t.Errorf("expected the renewed copy alone to have the new password, got %q and %q", renewed.SMTP.Password, cfg.SMTP.Password)
+		}
+		if renewed.Server.HTTP.ReadTimeout != 45*time.Second || renewed.VaultClient() == nil {
+			t.Errorf("expected the renewed copy to keep the rest of the configuration, got %+v", renewed.Server.HTTP)
+		}
+		if renewals.Load() != 1 || logins.Load() != 1 {
+			t.Errorf("expected the token to be renewed without logging in again, got %d renewals and %d logins", renewals.Load(), logins.Load())
+		}
+
+		t.Setenv("RUNEBIRD_SMTP__PASSWORD", "vault:secret/data/runebird#missing")
+		if _, err := Load(); err == nil || !strings.Contains(err.Error(), "no key missing") {
+			t.Fatalf("expected error for a missing key, got %v", err)
+		}
+		t.Setenv("RUNEBIRD_SMTP__PASSWORD", "vault:secret/data/runebird")
+		if _, err := Load(); err == nil || !strings.Contains(err.Error(), "vault:<path>#<key>") {
+			t.Fatalf("expected error for a reference without a key, got %v", err)
+		}
+		t.Setenv("RUNEBIRD_VAULT__SECRET_ID", "wrong")
+		t.Setenv("RUNEBIRD_SMTP__PASSWORD", "vault:secret/data/runebird#smtp_password")
+		if _, err := Load(); err == nil || !strings.Contains(err.Error(), "invalid role or secret ID") {
+			t.Fatalf("expected error for a failed login, got %v", err)
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		old := &Config{
+			Logging:   LoggingConfig{Level: "info"},
+			RateLimit: RateLimitConfig{PerHour: 100, Burst: 5},
+			SMTP:      SMTPConfig{Password: "old", Fallbacks: []SMTPConfig{{Host: "a.example.com"}}},
+		}
+		changed := *old
+		changed.Logging.Level = "debug"
+		changed.RateLimit.Retry.InitialDelay = time.Minute
+		changed.SMTP.Password = "new"
+		changed.SMTP.Fallbacks = []SMTPConfig{{Host: "b.example.com"}}
+
+		want := []Change{
+			{Field: "smtp.password", Old: "[redacted]", New: "[redacted]"},
+			{Field: "smtp.fallbacks.0.host", Old: "a.example.com", New: "b.example.com"},
+			{Field: "rate_limit.retry.initial_delay", Old: "0s", New: "1m0s"},
+			{Field: "logging.level", Old: "info", New: "debug"},
+		}
+		got := Diff(old, &changed)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("expected changes %v, got %v", want, got)
+		}
+		if got := Diff(old, old); len(got) != 0 {
+			t.Errorf("expected no changes between equal configurations, got %v", got)
+		}
+	})
+
+	t.Run("JSONAndTOML", func(t *testing.T) {
+		dir := t.TempDir()
+		files := map[string]string{
+			"emailer.json": `{
+	"server": {"port": 8081, "http": {"read_timeout": "45s"}},
+	"smtp": {
+		"host": "smtp.example.com",
+		"username": "user",
+		"password": "pass",
+		"from_address": "test@example.com",
+		"fallbacks": [{"host": "backup.example.com", "username": "backup", "password": "backup-pass"}]
+	},
+	"rate_limit": {"per_hour": 50}
+}`,
+			"emailer.toml": `
+[server]
+port = 8081
+
+[server.http]
+read_timeout = "45s"
+
+[smtp]
+host = "smtp.example.com"
+username = "user"
+password = "pass"
+from_address = "test@example.com"
+
+[[smtp.fallbacks]]
+host = "backup.example.com"
+username = "backup"
+password = "backup-pass"
+
+[rate_limit]
+per_hour = 50
+`,
+		}
+		for name, content := range files {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+			t.Setenv("EMAILER_CONFIG_PATH", path)
+
+			cfg, err := Load()
+			if err != nil {
+				t.Fatalf("%s: expected no error, got %v", name, err)
+			}
+			if cfg.Server.Port != 8081 || cfg.Server.HTTP.ReadTimeout != 45*time.Second || cfg.RateLimit.PerHour != 50 {
+				t.Errorf("%s: expected settings from the file, got port %d, read timeout %s, per hour %d", name, cfg.Server.Port, cfg.Server.HTTP.ReadTimeout, cfg.RateLimit.PerHour)
+			}
+			if len(cfg.SMTP.Fallbacks) != 1 || cfg.SMTP.Fallbacks[0].Password != "backup-pass" {
+				t.Errorf("%s: expected one SMTP fallback, got %+v", name, cfg.SMTP.Fallbacks)
+			}
+			if cfg.RateLimit.Burst != 5 {
+				t.Errorf("%s: expected default burst 5, got %d", name, cfg.RateLimit.Burst)
+			}
+		}
+
+		for name, content := range map[string]string{"broken.json": `{"server": {"port": 8081,}}`, "broken.toml": "[server\nport = 8081"} {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+			t.Setenv("EMAILER_CONFIG_PATH", path)
+			format := strings.ToUpper(strings.TrimPrefix(filepath.Ext(name), "."))
+			if _, err := Load(); err == nil || !strings.Contains(err.Error(), "invalid "+format) {
+				t.Errorf("%s: expected invalid %s error, got %v", name, format, err)
+			}
+		}
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		content := `
+server:
+  port: 8080
+smtp:
+  host: "smtp.example.com"
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+logging:
+  level: "info"
+`
+		path := filepath.Join(t.TempDir(), "custom.yaml")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+		t.Setenv("EMAILER_CONFIG_PATH", "nonexistent.yaml")
+		t.Setenv("RUNEBIRD_SERVER__PORT", "8081")
+		t.Setenv("RUNEBIRD_LOGGING__LEVEL", "warn")
+
+		cfg, err := LoadWith(Options{Path: path, Set: map[string]string{"server.port": "9090", "delivery.dry_run": "true"}})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if cfg.Server.Port != 9090 {
+			t.Errorf("expected port 9090 from the options over the environment, got %d", cfg.Server.Port)
+		}
+		if cfg.Logging.Level != "warn" {
+			t.Errorf("expected log level warn from the environment, got %s", cfg.Logging.Level)
+		}
+		if !cfg.Delivery.DryRun {
+			t.Error("expected dry run enabled by the options")
+		}
+
+		if _, err := LoadWith(Options{Path: path, Set: map[string]string{"server.prot": "9090"}}); err == nil || !strings.Contains(err.Error(), "unknown config field") {
+			t.Errorf("expected error for an unknown field, got %v", err)
+		}
+		if _, err := LoadWith(Options{Path: path, Set: map[string]string{"server.port": "70000"}}); err == nil || !strings.Contains(err.Error(), "invalid configuration") {
+			t.Errorf("expected validation error for an invalid port, got %v", err)
+		}
+	})
+
+	t.Run("DeliveryProfiles", func(t *testing.T) {
+		content := `
+smtp:
+  host: "smtp.example.com"
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+rate_limit:
+  per_hour: 100
+  burst: 5
+delivery:
+  profiles:
+    - name: marketing
+      smtp:
+        host: "marketing.example.com"
+        username: "news"
+        password: "news-pass"
+        fallbacks:
+          - host: "backup.example.com"
+            username: "news"
+            password: "news-pass"
+      rate_limit:
+        per_hour: 20
+    - name: bulk
+      provider: sendgrid
+      sendgrid:
+        api_key: "key"
+`
+		path := filepath.Join(t.TempDir(), "emailer.yaml")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+		cfg, err := LoadWith(Options{Path: path})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		marketing, ok := cfg.Delivery.Profile("marketing")
+		if !ok {
+			t.Fatal("expected the marketing profile")
+		}
+		if marketing.Provider != "smtp" || marketing.SMTP.Name != "marketing" || marketing.SMTP.Fallbacks[0].Name != "marketing-fallback-1" {
+			t.Errorf("expected SMTP profile defaults named after the delivery profile, got %+v", marketing.SMTP)
+		}
+		if marketing.SMTP.FromAddress != "test@example.com" || marketing.SMTP.Retry != cfg.SMTP.Retry {
+			t.Errorf("expected the default from address and retry policy, got %s and %+v", marketing.SMTP.FromAddress, marketing.SMTP.Retry)
+		}
+		if marketing.RateLimit != (ProfileRateLimitConfig{PerHour: 20, Burst: 5}) {
+			t.Errorf("expected the global burst with the profile rate, got %+v", marketing.RateLimit)
+		}
+		if bulk, _ := cfg.Delivery.Profile("bulk"); bulk.SendGrid.FromAddress != "test@example.com" || bulk.SendGrid.BaseURL != "https://api.sendgrid.com" {
+			t.Errorf("expected SendGrid defaults, got %+v", bulk.SendGrid)
+		}
+		if _, ok := cfg.Delivery.Profile("missing"); ok {
+			t.Error("expected no profile named missing")
+		}
+
+		for name, set := range map[string]map[string]string{
+			"must be made of":  {"delivery.profiles.1.name": "bulk mail"},
+			"must be unique":   {"delivery.profiles.1.name": "marketing"},
+			"API key":          {"delivery.profiles.1.sendgrid.api_key": ""},
+			"SMTP profile":     {"delivery.profiles.0.smtp.name": "primary"},
+			"provider must be": {"delivery.profiles.1.provider": "carrier-pigeon"},
+		} {
+			if _, err := LoadWith(Options{Path: path, Set: set}); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("expected error containing %q for %v, got %v", name, set, err)
+			}
+		}
+	})
+
+	t.Run("RecipientDomains", func(t *testing.T) {
+		content := `
+smtp:
+  host: "smtp.example.com"
+  username: "user"
+  password: "pass"
+  from_address: "test@example.com"
+delivery:
+  recipient_domains:
+    allow: ["example.com"]
+`
+		path := filepath.Join(t.TempDir(), "emailer.yaml")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+		cfg, err := LoadWith(Options{Path: path, Set: map[string]string{"delivery.recipient_domains.deny": "test.example.com"}})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if domains := cfg.Delivery.RecipientDomains; len(domains.Allow) != 1 || len(domains.Deny) != 1 || domains.Deny[0] != "test.example.com" {
+			t.Errorf("expected the allowed and denied domains, got %+v", domains)
+		}
+		if _, err := LoadWith(Options{Path: path, Set: map[string]string{"delivery.recipient_domains.deny": "@example.org"}}); err == nil || !strings.Contains(err.Error(), "must be domain names") {
+			t.Errorf("expected error for an address in the denied domains, got %v", err)
+		}
+	})
+
+	t.Run("Sample", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "emailer.yaml")
+		if err := os.WriteFile(path, []byte(Sample()), 0644); err != nil {
+			t.Fatalf("failed to write sample: %v", err)
+		}
+		if _, err := LoadWith(Options{Path: path}); err != nil {
+			t.Fatalf("expected the sample to load, got %v", err)
+		}
+
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(Sample()), &doc); err != nil {
+			t.Fatalf("failed to parse sample: %v", err)
+		}
+		// Every field must be in the sample, down to those of nested structs; the elements of
+		// lists and maps are only shown in comments.
+		var missing []string
+		var walk func(typ reflect.Type, node *yaml.Node, path string)
+		walk = func(typ reflect.Type, node *yaml.Node, path string) {
+			for i := 0; i < typ.NumField(); i++ {
+				tag, _, _ := strings.Cut(typ.Field(i).Tag.Get("yaml"), ",")
+				if tag == "" || tag == "-" {
+					continue
+				}
+				var value *yaml.Node
+				for j := 0; node != nil && j+1 < len(node.Content); j += 2 {
+					if node.Content[j].Value == tag {
+						value = node.Content[j+1]
+					}
+				}
+				if value == nil {
+					missing = append(missing, path+tag)
+				}
+				if ft := typ.Field(i).Type; ft.Kind() == reflect.Struct {
+					walk(ft, value, path+tag+".")
+				}
+			}
+		}
+		walk(reflect.TypeOf(Config{}), doc.Content[0], "")
+		if len(missing) > 0 {
+			t.Errorf("expected every field in the sample, missing: %s", strings.Join(missing, ", "))
+		}
+	})
+
 	t.Run("FileNotFound", func(t *testing.T) {
 		err := os.Setenv("EMAILER_CONFIG_PATH", "nonexistent.yaml")
 		if err != nil {
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redacted replaces the values of secret fields in a Change.
+const redacted = "[redacted]"
+
+// Change is a setting that differs between two configurations. Field is its path in the YAML
+// file, as in rate_limit.per_hour.
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Diff returns the settings that differ between old and new, in the order of the file. The
+// values of secret fields are redacted.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	diffValues(reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), nil, false, &changes)
+	return changes
+}
+
+func diffValues(a, b reflect.Value, field []string, secret bool, changes *[]Change) {
+	switch {
+	case a.Kind() == reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			f := a.Type().Field(i)
+			tag, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if tag == "" || tag == "-" {
+				continue
+			}
+			diffValues(a.Field(i), b.Field(i), append(field[:len(field):len(field)], tag), f.Tag.Get("secret") == "true", changes)
+		}
+	case a.Kind() == reflect.Slice && a.Type().Elem().Kind() == reflect.Struct && a.Len() == b.Len():
+		for i := 0; i < a.Len(); i++ {
+			diffValues(a.Index(i), b.Index(i), append(field[:len(field):len(field)], strconv.Itoa(i)), false, changes)
+		}
+	case !reflect.DeepEqual(a.Interface(), b.Interface()):
+		change := Change{Field: strings.Join(field, "."), Old: redacted, New: redacted}
+		if !secret {
+			change.Old, change.New = formatValue(a), formatValue(b)
+		}
+		*changes = append(*changes, change)
+	}
+}
+
+// formatValue formats a setting as it would be written in the YAML file.
+func formatValue(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct {
+		return fmt.Sprintf("%d entries", v.Len())
+	}
+	return fmt.Sprint(v.Interface())
+}
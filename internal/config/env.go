@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the names of the environment variables that override config fields.
+const EnvPrefix = "RUNEBIRD_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv overrides the fields of c with the environment variables in environ, as returned by
+// os.Environ, whose names start with EnvPrefix. The rest of the name is the path of the field
+// in the YAML file, in upper case with "__" between keys, as in RUNEBIRD_SMTP__PASSWORD for
+// smtp.password. An element of a list is named by its index, as in
+// RUNEBIRD_SMTP__FALLBACKS__0__PASSWORD, and may be one past the end to append it.
+//
+// Strings are taken as is, lists of strings are separated by commas and durations are written
+// as in the YAML file. Maps and lists of other values are written in YAML as a whole. A secret
+// field may instead be read from the file named by the variable with the suffix _FILE, as in
+// RUNEBIRD_SMTP__PASSWORD_FILE.
+func applyEnv(c *Config, environ []string) error {
+	names := make(map[string]bool, len(environ))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		names[name] = true
+	}
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, EnvPrefix)
+		if !ok {
+			continue
+		}
+		if field, ok := strings.CutSuffix(name, strings.ToUpper(secretFileSuffix)); ok && names[field] {
+			return fmt.Errorf("environment variables %s and %s are both set", field, name)
+		}
+		path := strings.Split(strings.ToLower(rest), "__")
+		if err := setEnvField(reflect.ValueOf(c).Elem(), path, value); err != nil {
+			return fmt.Errorf("environment variable %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// applySet overrides the fields of c with the values in set, keyed by the path of the field in
+// the YAML file with "." between keys, as in smtp.fallbacks.0.host. Values are written as in
+// environment variables.
+func applySet(c *Config, set map[string]string) error {
+	fields := make([]string, 0, len(set))
+	for field := range set {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if err := setEnvField(reflect.ValueOf(c).Elem(), strings.Split(field, "."), set[field]); err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+	}
+	return nil
+}
+
+// setEnvField sets the field of v at path to value.
+func setEnvField(v reflect.Value, path []string, value string) error {
+	if len(path) == 0 {
+		return setEnvValue(v, value)
+	}
+	switch {
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if tag != "" && tag != "-" && tag == path[0] {
+				return setEnvField(v.Field(i), path[1:], value)
+			}
+		}
+		if i, ok := secretField(v.Type(), path[0]); ok && len(path) == 1 {
+			secret, err := readSecretFile(value)
+			if err != nil {
+				return err
+			}
+			v.Field(i).SetString(secret)
+			return nil
+		}
+		return fmt.Errorf("unknown config field %s", path[0])
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i > v.Len() {
+			return fmt.Errorf("invalid list index %s, there are %d elements", path[0], v.Len())
+		}
+		if i == v.Len() {
+			v.Set(reflect.Append(v, reflect.New(v.Type().Elem()).Elem()))
+		}
+		return setEnvField(v.Index(i), path[1:], value)
+	}
+	return fmt.Errorf("unknown config field %s", path[0])
+}
+
+// setEnvValue sets v, a config field, to value.
+func setEnvValue(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %v", value, err)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			var list []string
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+			v.Set(reflect.ValueOf(list))
+			return nil
+		}
+		fallthrough
+	default:
+		// Maps and lists of structs are replaced as a whole.
+		fresh := reflect.New(v.Type())
+		if err := yaml.Unmarshal([]byte(value), fresh.Interface()); err != nil {
+			return fmt.Errorf("invalid YAML: %v", err)
+		}
+		v.Set(fresh.Elem())
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// parseFile parses data, the config file at path, in the format its extension names: JSON for
+// .json, TOML for .toml and YAML otherwise. The keys are the same in every format, so the
+// file is returned as YAML for the secret files to be resolved and the Config decoded alike.
+func parseFile(path string, data []byte) (yaml.Node, error) {
+	var root yaml.Node
+	var doc any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return root, fmt.Errorf("invalid JSON: %v", err)
+		}
+		if dec.More() {
+			return root, fmt.Errorf("invalid JSON: unexpected data after the top-level value")
+		}
+		doc = jsonNumbers(doc)
+	case ".toml":
+		var table map[string]any
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return root, fmt.Errorf("invalid TOML: %v", err)
+		}
+		doc = table
+	default:
+		err := yaml.Unmarshal(data, &root)
+		return root, err
+	}
+	if err := root.Encode(doc); err != nil {
+		return root, err
+	}
+	return root, nil
+}
+
+// jsonNumbers replaces the numbers of doc, decoded with json.Decoder.UseNumber, with integers
+// where they are whole and floats otherwise, as YAML decodes them.
+func jsonNumbers(doc any) any {
+	switch v := doc.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]any:
+		for key, value := range v {
+			v[key] = jsonNumbers(value)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = jsonNumbers(value)
+		}
+	}
+	return doc
+}
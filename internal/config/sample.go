@@ -0,0 +1,17 @@
+package config
+
+import (
+	_ "embed"
+)
+
+// sample is the annotated configuration file returned by Sample. A test fails if a field of
+// Config is missing from it, so that it follows the structs.
+//
+//go:embed sample.yaml
+var sample string
+
+// Sample returns an annotated configuration file setting every field to its default, or to an
+// example where it has none, as printed by emailer gen-config.
+func Sample() string {
+	return sample
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretFileSuffix names the key, or environment variable, giving the path of a file to read a
+// secret field from, as in smtp.password_file for smtp.password. Fields are secret if they are
+// tagged secret:"true".
+const secretFileSuffix = "_file"
+
+// secretField returns the secret field of struct type t that key names the file of. A key that
+// is itself a field of t, such as vault.token_file, names no secret file.
+func secretField(t reflect.Type, key string) (int, bool) {
+	name, ok := strings.CutSuffix(key, secretFileSuffix)
+	if !ok {
+		return 0, false
+	}
+	field, found := 0, false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch tag, _, _ := strings.Cut(f.Tag.Get("yaml"), ","); tag {
+		case key:
+			return 0, false
+		case name:
+			field, found = i, f.Tag.Get("secret") == "true"
+		}
+	}
+	return field, found
+}
+
+// readSecretFile returns the content of the secret file at path, without the line break it
+// usually ends with. Errors do not include the content.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// resolveSecretFiles replaces the keys naming secret files in node, the YAML of a value of
+// type t, with the secret fields they name, set to the content of the files. path is the
+// prefix of the keys of node in errors.
+func resolveSecretFiles(node *yaml.Node, t reflect.Type, path string) error {
+	switch {
+	case node.Kind == yaml.DocumentNode:
+		for _, n := range node.Content {
+			if err := resolveSecretFiles(n, t, path); err != nil {
+				return err
+			}
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, n := range node.Content {
+			if err := resolveSecretFiles(n, t.Elem(), fmt.Sprintf("%s[%d].", strings.TrimSuffix(path, "."), i)); err != nil {
+				return err
+			}
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		keys := make(map[string]bool, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keys[node.Content[i].Value] = true
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if _, ok := secretField(t, key.Value); ok {
+				name := strings.TrimSuffix(key.Value, secretFileSuffix)
+				if keys[name] {
+					return fmt.Errorf("%s%s and %s%s are both set", path, name, path, key.Value)
+				}
+				secret, err := readSecretFile(value.Value)
+				if err != nil {
+					return fmt.Errorf("%s%s: %v", path, key.Value, err)
+				}
+				key.Value = name
+				*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: secret}
+				continue
+			}
+			for j := 0; j < t.NumField(); j++ {
+				if tag, _, _ := strings.Cut(t.Field(j).Tag.Get("yaml"), ","); tag == key.Value {
+					if err := resolveSecretFiles(value, t.Field(j).Type, path+key.Value+"."); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
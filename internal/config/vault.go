@@ -0,0 +1,437 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// vaultPrefix starts the value of a secret field read from Vault, as in
+// "vault:secret/data/runebird#smtp_password" for the key smtp_password of the secret at
+// secret/data/runebird.
+const vaultPrefix = "vault:"
+
+const (
+	defaultVaultTimeout   = 10 * time.Second
+	defaultVaultTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// vaultRetryDelay is how long Watch waits to try again after a failed renewal.
+	vaultRetryDelay = 30 * time.Second
+)
+
+// VaultConfig reads the secret fields whose value starts with "vault:" from HashiCorp Vault at
+// Address. AuthMethod is token, which uses Token, approle, which logs in with RoleID and
+// SecretID, or kubernetes, which logs in as Role with the service account token in TokenFile;
+// AuthMount is the path the auth method is mounted at, which defaults to its name.
+type VaultConfig struct {
+	Address            string        `yaml:"address"`
+	Namespace          string        `yaml:"namespace"`
+	AuthMethod         string        `yaml:"auth_method"`
+	AuthMount          string        `yaml:"auth_mount"`
+	Token              string        `yaml:"token" secret:"true"`
+	RoleID             string        `yaml:"role_id"`
+	SecretID           string        `yaml:"secret_id" secret:"true"`
+	Role               string        `yaml:"role"`
+	TokenFile          string        `yaml:"token_file"`
+	CAFile             string        `yaml:"ca_file"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	Timeout            time.Duration `yaml:"timeout"`
+}
+
+// Vault reads the secret fields of a Config from Vault, and keeps its token and the leases of
+// the secrets alive.
+type Vault struct {
+	cfg    *VaultConfig
+	client *http.Client
+	// refs holds the path of each field read from Vault, as named in the environment, and the
+	// reference it was read from.
+	refs []vaultRef
+
+	mu    sync.Mutex
+	token string
+	// renewable tells whether the token can be renewed, until expires if it is not zero.
+	renewable bool
+	expires   time.Time
+	// leaseExpires is when the first lease of the secrets read runs out, if any has one.
+	leaseExpires time.Time
+}
+
+type vaultRef struct {
+	field []string
+	path  string
+	key   string
+}
+
+// vaultResponse holds the fields of the responses of Vault that RuneBird uses.
+type vaultResponse struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// VaultClient returns the Vault the secrets of c were read from, or nil if none were.
+func (c *Config) VaultClient() *Vault {
+	return c.vault
+}
+
+// resolveVault reads the secret fields of c that reference Vault from it. It does nothing if
+// no field does.
+func (c *Config) resolveVault(ctx context.Context) error {
+	var refs []vaultRef
+	if err := findVaultRefs(reflect.ValueOf(c).Elem(), nil, &refs); err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	// Like the Vault CLI, the standard VAULT_ADDR and VAULT_TOKEN environment variables are
+	// used if the address or token is not configured.
+	if c.Vault.Address == "" {
+		c.Vault.Address = os.Getenv("VAULT_ADDR")
+	}
+	if c.Vault.Token == "" && (c.Vault.AuthMethod == "" || c.Vault.AuthMethod == "token") {
+		c.Vault.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if c.Vault.Address == "" {
+		return fmt.Errorf("vault address is required to read %s from Vault", strings.Join(refs[0].field, "."))
+	}
+	v, err := newVault(&c.Vault, refs)
+	if err != nil {
+		return err
+	}
+	if err := v.login(ctx); err != nil {
+		return err
+	}
+	if err := v.apply(ctx, c); err != nil {
+		return err
+	}
+	c.vault = v
+	return nil
+}
+
+// findVaultRefs appends the secret fields of v, at field, that reference Vault to refs. The
+// fields of the vault section are never read from Vault.
+func findVaultRefs(v reflect.Value, field []string, refs *[]vaultRef) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			tag, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if tag == "" || tag == "-" || (len(field) == 0 && tag == "vault") {
+				continue
+			}
+			path := append(field[:len(field):len(field)], tag)
+			if f.Tag.Get("secret") == "true" && f.Type.Kind() == reflect.String {
+				ref, ok := strings.CutPrefix(v.Field(i).String(), vaultPrefix)
+				if !ok {
+					continue
+				}
+				secretPath, key, ok := strings.Cut(ref, "#")
+				if !ok || secretPath == "" || key == "" {
+					return fmt.Errorf("%s: Vault reference must be vault:<path>#<key>, got %q", strings.Join(path, "."), v.Field(i).String())
+				}
+				*refs = append(*refs, vaultRef{field: path, path: strings.Trim(secretPath, "/"), key: key})
+				continue
+			}
+			if err := findVaultRefs(v.Field(i), path, refs); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := findVaultRefs(v.Index(i), append(field[:len(field):len(field)], strconv.Itoa(i)), refs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newVault(cfg *VaultConfig, refs []vaultRef) (*Vault, error) {
+	switch cfg.AuthMethod {
+	case "", "token", "approle", "kubernetes":
+	default:
+		return nil, fmt.Errorf("vault auth_method must be one of token, approle, kubernetes; got %s", cfg.AuthMethod)
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultVaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vault CA file %s: %v", cfg.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in vault CA file %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	return &Vault{cfg: cfg, client: &http.Client{Timeout: timeout, Transport: transport}, refs: refs}, nil
+}
+
+// login obtains a token with the auth method, or looks up the configured token.
+func (v *Vault) login(ctx context.Context) error {
+	method := v.cfg.AuthMethod
+	if method == "" {
+		method = "token"
+	}
+	if method == "token" {
+		if v.cfg.Token == "" {
+			return fmt.Errorf("vault token is required with the token auth method")
+		}
+		v.mu.Lock()
+		v.token = v.cfg.Token
+		v.mu.Unlock()
+		var resp vaultResponse
+		if err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &resp); err != nil {
+			return fmt.Errorf("failed to look up vault token: %v", err)
+		}
+		ttl, _ := resp.Data["ttl"].(float64)
+		renewable, _ := resp.Data["renewable"].(bool)
+		v.setToken(v.cfg.Token, int(ttl), renewable)
+		return nil
+	}
+
+	body := map[string]string{}
+	switch method {
+	case "approle":
+		if v.cfg.RoleID == "" || v.cfg.SecretID == "" {
+			return fmt.Errorf("vault role_id and secret_id are required with the approle auth method")
+		}
+		body["role_id"], body["secret_id"] = v.cfg.RoleID, v.cfg.SecretID
+	case "kubernetes":
+		if v.cfg.Role == "" {
+			return fmt.Errorf("vault role is required with the kubernetes auth method")
+		}
+		tokenFile := v.cfg.TokenFile
+		if tokenFile == "" {
+			tokenFile = defaultVaultTokenFile
+		}
+		jwt, err := readSecretFile(tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read service account token: %v", err)
+		}
+		body["role"], body["jwt"] = v.cfg.Role, jwt
+	}
+	mount := v.cfg.AuthMount
+	if mount == "" {
+		mount = method
+	}
+	var resp vaultResponse
+	if err := v.do(ctx, http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", body, &resp); err != nil {
+		return fmt.Errorf("failed to log in to vault: %v", err)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return fmt.Errorf("failed to log in to vault: no token returned")
+	}
+	v.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+	return nil
+}
+
+func (v *Vault) setToken(token string, ttl int, renewable bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.token = token
+	v.renewable = renewable
+	v.expires = time.Time{}
+	if ttl > 0 {
+		v.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+}
+
+// apply reads the secrets that c references and sets its fields to them.
+func (v *Vault) apply(ctx context.Context, c *Config) error {
+	secrets := make(map[string]map[string]interface{})
+	var leaseExpires time.Time
+	for _, ref := range v.refs {
+		data, ok := secrets[ref.path]
+		if !ok {
+			var resp vaultResponse
+			if err := v.do(ctx, http.MethodGet, ref.path, nil, &resp); err != nil {
+				return fmt.Errorf("failed to read vault secret %s: %v", ref.path, err)
+			}
+			data = resp.Data
+			// Secrets of the KV version 2 engine hold their data under data.
+			if inner, ok := data["data"].(map[string]interface{}); ok {
+				if _, ok := data["metadata"]; ok {
+					data = inner
+				}
+			}
+			secrets[ref.path] = data
+			if resp.LeaseDuration > 0 {
+				expires := time.Now().Add(time.Duration(resp.LeaseDuration) * time.Second)
+				if leaseExpires.IsZero() || expires.Before(leaseExpires) {
+					leaseExpires = expires
+				}
+			}
+		}
+		value, ok := data[ref.key]
+		if !ok {
+			return fmt.Errorf("vault secret %s has no key %s", ref.path, ref.key)
+		}
+		var s string
+		if str, ok := value.(string); ok {
+			s = str
+		} else {
+			s = fmt.Sprint(value)
+		}
+		if err := setEnvField(reflect.ValueOf(c).Elem(), ref.field, s); err != nil {
+			return err
+		}
+	}
+	v.mu.Lock()
+	v.leaseExpires = leaseExpires
+	v.mu.Unlock()
+	return nil
+}
+
+// renewAt returns when the token or the secrets should next be renewed, two thirds into the
+// shortest of their lifetimes, or the zero time if neither expires.
+func (v *Vault) renewAt() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var at time.Time
+	for _, expires := range []time.Time{v.expires, v.leaseExpires} {
+		if expires.IsZero() {
+			continue
+		}
+		t := time.Now().Add(time.Until(expires) * 2 / 3)
+		if at.IsZero() || t.Before(at) {
+			at = t
+		}
+	}
+	return at
+}
+
+// Renew renews the token, or logs in again if it cannot be renewed, then reads the secrets
+// again and returns a copy of c with the fields read from Vault set to them.
+func (v *Vault) Renew(ctx context.Context, c *Config) (*Config, error) {
+	v.mu.Lock()
+	renewable := v.renewable && (v.expires.IsZero() || time.Now().Before(v.expires))
+	v.mu.Unlock()
+	renewed := false
+	if renewable {
+		var resp vaultResponse
+		if err := v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{}, &resp); err == nil && resp.Auth != nil {
+			v.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+			renewed = true
+		}
+	}
+	if !renewed {
+		if err := v.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// The copy shares nothing with c, which stays in use.
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy config: %v", err)
+	}
+	fresh := &Config{}
+	if err := yaml.Unmarshal(data, fresh); err != nil {
+		return nil, fmt.Errorf("failed to copy config: %v", err)
+	}
+	if err := v.apply(ctx, fresh); err != nil {
+		return nil, err
+	}
+	fresh.vault = v
+	return fresh, nil
+}
+
+// Watch renews the token and the secrets before they expire until ctx is done, passing each
+// renewed copy of c to renewed. A failed renewal is passed to failed and tried again shortly.
+// It returns at once if neither the token nor the secrets expire.
+func (v *Vault) Watch(ctx context.Context, c *Config, renewed func(*Config), failed func(error)) {
+	for {
+		at := v.renewAt()
+		if at.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		fresh, err := v.Renew(ctx, c)
+		if err != nil {
+			failed(err)
+			retry := time.NewTimer(vaultRetryDelay)
+			select {
+			case <-ctx.Done():
+				retry.Stop()
+				return
+			case <-retry.C:
+			}
+			continue
+		}
+		c = fresh
+		renewed(fresh)
+	}
+}
+
+// do sends a request to the Vault API at path and decodes the response into out.
+func (v *Vault) do(ctx context.Context, method, path string, body interface{}, out *vaultResponse) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(v.cfg.Address, "/")+"/v1/"+path, r)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	token := v.token
+	v.mu.Unlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid response from vault: %v", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(out.Errors, "; "))
+		}
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+	return nil
+}
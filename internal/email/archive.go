@@ -0,0 +1,45 @@
+package email
+
+import (
+	"context"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"runebird/internal/config"
+)
+
+// ArchiveSender wraps a Sender to blind-copy every message to a compliance archive address,
+// unless it was rendered from one of the excluded templates. The archive address is added to
+// the envelope only, so recipients never see it.
+type ArchiveSender struct {
+	next    Sender
+	address string
+	exclude []string
+}
+
+// NewArchive wraps next in an ArchiveSender configured by the archive settings. It returns
+// next unchanged if no archive address is configured.
+func NewArchive(next Sender, cfg *config.ArchiveConfig) Sender {
+	if cfg.Address == "" {
+		return next
+	}
+	return &ArchiveSender{next: next, address: cfg.Address, exclude: cfg.ExcludeTemplates}
+}
+
+// SendMessage adds the archive address to the Bcc recipients of msg and sends it.
+func (s *ArchiveSender) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	if !slices.Contains(s.exclude, msg.Template) {
+		msg.Bcc = append(slices.Clip(msg.Bcc), s.address)
+	}
+	return s.next.SendMessage(ctx, msg)
+}
+
+// Probe probes the wrapped sender.
+func (s *ArchiveSender) Probe(ctx context.Context) error {
+	return s.next.Probe(ctx)
+}
+
+// Collectors returns the collectors of the wrapped sender.
+func (s *ArchiveSender) Collectors() []prometheus.Collector {
+	return s.next.Collectors()
+}
@@ -0,0 +1,124 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/logger"
+)
+
+// ErrRecipientDomain is wrapped by errors for messages whose recipients are all in domains that
+// may not be emailed.
+var ErrRecipientDomain = errors.New("all recipients are in domains that may not be emailed")
+
+// Stages at which recipients are refused for their domain, as counted by
+// runebird_recipients_blocked_total.
+const (
+	// BlockedAtRequest counts recipients of requests rejected by the API.
+	BlockedAtRequest = "request"
+	// BlockedAtSend counts recipients left out of an email when it is sent, such as a
+	// scheduled or queued email whose domain stopped being allowed.
+	BlockedAtSend = "send"
+)
+
+// recipientsBlockedTotal counts the recipients refused for their domain, by stage and by the
+// list that refused them. It is shared by every stage, and registered by the
+// DomainFilterSender, which exists whenever a recipient can be refused.
+var recipientsBlockedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "runebird_recipients_blocked_total",
+		Help: "Total number of recipients refused because their domain may not be emailed",
+	},
+	[]string{"stage", "list"},
+)
+
+// CheckRecipientDomain returns why recipient may not be emailed under cfg, or "" if it may, and
+// counts a refused recipient as blocked at stage.
+func CheckRecipientDomain(cfg *config.RecipientDomainsConfig, recipient, stage string) string {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 {
+		return ""
+	}
+	address := recipient
+	if addr, err := mail.ParseAddress(recipient); err == nil {
+		address = addr.Address
+	}
+	_, domain := splitAddress(address)
+	domain = strings.ToLower(ASCIIDomain(domain))
+	if matchDomain(cfg.Deny, domain) {
+		recipientsBlockedTotal.WithLabelValues(stage, "deny").Inc()
+		return fmt.Sprintf("domain %s may not be emailed", domain)
+	}
+	if len(cfg.Allow) > 0 && !matchDomain(cfg.Allow, domain) {
+		recipientsBlockedTotal.WithLabelValues(stage, "allow").Inc()
+		return fmt.Sprintf("domain %s is not allowed", domain)
+	}
+	return ""
+}
+
+// matchDomain reports whether domain is one of domains or a subdomain of one.
+func matchDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(ASCIIDomain(strings.TrimPrefix(d, ".")))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// DomainFilterSender wraps a Sender to leave the recipients in domains that may not be emailed
+// out of every message, whichever of the server, the scheduler or the rate limit queue sends
+// it, so that emails scheduled or queued before a domain was blocked are not delivered there.
+type DomainFilterSender struct {
+	next   Sender
+	cfg    config.RecipientDomainsConfig
+	logger *logger.Logger
+}
+
+// NewDomainFilter wraps next in a DomainFilterSender enforcing delivery.recipient_domains. It
+// returns next unchanged if no domain is restricted.
+func NewDomainFilter(next Sender, cfg *config.Config, log *logger.Logger) Sender {
+	domains := cfg.Delivery.RecipientDomains
+	if len(domains.Allow) == 0 && len(domains.Deny) == 0 {
+		return next
+	}
+	return &DomainFilterSender{next: next, cfg: domains, logger: log}
+}
+
+// SendMessage sends msg to its recipients that may be emailed. If none of them may, it fails
+// with a permanent *SendError wrapping ErrRecipientDomain.
+func (s *DomainFilterSender) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	var allowed, blocked []string
+	for _, recipient := range msg.Recipients {
+		if CheckRecipientDomain(&s.cfg, recipient, BlockedAtSend) != "" {
+			blocked = append(blocked, recipient)
+		} else {
+			allowed = append(allowed, recipient)
+		}
+	}
+	if len(blocked) == 0 {
+		return s.next.SendMessage(ctx, msg)
+	}
+	s.logger.Warn("Recipients in blocked domains left out of email", zap.String("id", msg.ID), zap.Strings("blocked", blocked))
+	if len(allowed) == 0 {
+		return Result{}, &SendError{Err: fmt.Errorf("failed to send email: %w", ErrRecipientDomain)}
+	}
+	msg.Recipients = allowed
+	return s.next.SendMessage(ctx, msg)
+}
+
+// Probe probes the wrapped sender.
+func (s *DomainFilterSender) Probe(ctx context.Context) error {
+	return s.next.Probe(ctx)
+}
+
+// Collectors returns the collectors of the wrapped sender and the count of blocked recipients.
+func (s *DomainFilterSender) Collectors() []prometheus.Collector {
+	return append(s.next.Collectors(), recipientsBlockedTotal)
+}
@@ -0,0 +1,88 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/logger"
+)
+
+// DryRunProvider is the Result provider of messages captured by a DryRunSender.
+const DryRunProvider = "dry_run"
+
+// DryRunSender wraps a Sender for staging environments. Messages marked DryRun, or every
+// message if dry-run mode is enabled globally, are built as they would be sent but written
+// to the capture directory, or to the log if there is none, instead of being delivered.
+type DryRunSender struct {
+	next       Sender
+	enabled    bool
+	captureDir string
+	from       string
+	logger     *logger.Logger
+}
+
+// NewDryRun wraps next in a DryRunSender configured by the delivery settings.
+func NewDryRun(next Sender, cfg *config.Config, log *logger.Logger) *DryRunSender {
+	return &DryRunSender{
+		next:       next,
+		enabled:    cfg.Delivery.DryRun,
+		captureDir: cfg.Delivery.CaptureDir,
+		from:       cfg.SMTP.FromAddress,
+		logger:     log,
+	}
+}
+
+// SendMessage captures msg if it is a dry run and passes it to the wrapped sender otherwise.
+func (s *DryRunSender) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	if !s.enabled && !msg.DryRun {
+		return s.next.SendMessage(ctx, msg)
+	}
+	if len(msg.Recipients) == 0 {
+		return Result{}, fmt.Errorf("no recipients provided")
+	}
+
+	messageID := newMessageID("", msg.sender(s.from))
+	data, err := build(msg, msg.sender(s.from), messageID)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to build email: %v", err)
+	}
+
+	if s.captureDir == "" {
+		// The body may hold personal data and be large, so it is only logged at debug level.
+		header, _, _ := strings.Cut(string(data), "\r\n\r\n")
+		s.logger.Info("Dry run: email not delivered", zap.String("message_id", messageID), zap.Any("recipients", msg.Recipients), zap.String("subject", msg.Subject), zap.String("headers", header), zap.Int("size", len(data)))
+		s.logger.Debug("Dry run: email message", zap.String("message_id", messageID), zap.String("message", string(data)))
+		return Result{Provider: DryRunProvider, MessageID: messageID, Accepted: msg.Recipients}, nil
+	}
+
+	if err := os.MkdirAll(s.captureDir, 0o755); err != nil {
+		return Result{}, fmt.Errorf("failed to create capture directory %s: %v", s.captureDir, err)
+	}
+	path := filepath.Join(s.captureDir, fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000Z"), messageID))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return Result{}, fmt.Errorf("failed to capture email: %v", err)
+	}
+	s.logger.Info("Dry run: email captured", zap.String("message_id", messageID), zap.Any("recipients", msg.Recipients), zap.String("path", path))
+	return Result{Provider: DryRunProvider, MessageID: messageID, Accepted: msg.Recipients}, nil
+}
+
+// Probe probes the wrapped sender, unless dry-run mode is enabled globally and nothing is
+// delivered through it.
+func (s *DryRunSender) Probe(ctx context.Context) error {
+	if s.enabled {
+		return nil
+	}
+	return s.next.Probe(ctx)
+}
+
+// Collectors returns the collectors of the wrapped sender.
+func (s *DryRunSender) Collectors() []prometheus.Collector {
+	return s.next.Collectors()
+}
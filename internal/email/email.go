@@ -1,59 +1,122 @@
 package email
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net/smtp"
+	"net/textproto"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 	"runebird/internal/config"
 )
 
-type Sender struct {
-	cfg  *config.SMTPConfig
-	auth smtp.Auth
-	from string
+// ErrThrottled is wrapped by errors from SendMessage when the provider refuses the message
+// because the client is sending too much, such as a 421 or 450 SMTP reply or an HTTP 429.
+var ErrThrottled = errors.New("throttled by email provider")
+
+// Sender delivers messages through an email provider.
+type Sender interface {
+	// SendMessage sends msg, including any attachments. The send is abandoned with an error
+	// once ctx is done.
+	SendMessage(ctx context.Context, msg Message) (Result, error)
+	// Probe checks that the provider can be reached and accepts the configured credentials,
+	// without sending a message.
+	Probe(ctx context.Context) error
+	// Collectors returns the Prometheus collectors describing the provider, to be registered
+	// alongside the server metrics.
+	Collectors() []prometheus.Collector
 }
 
-func New(cfg *config.SMTPConfig) (*Sender, error) {
-	if cfg.Host == "" || cfg.Port == 0 || cfg.Username == "" || cfg.Password == "" || cfg.FromAddress == "" {
-		return nil, fmt.Errorf("invalid SMTP configuration: missing required fields")
-	}
+// Result describes a delivered message. MessageID is the provider's ID for the message, if
+// it reports one, and can be used to correlate later delivery events such as bounces.
+// Accepted lists the recipients the provider took the message for, and Rejected those an SMTP
+// server refused while accepting the others. Suppressed lists the recipients left out because
+// they are on the suppression list. ResponseCode and Response hold the provider's
+// reply to the message: the SMTP reply to DATA, or the HTTP status of an API provider.
+type Result struct {
+	Provider     string        `json:"provider"`
+	MessageID    string        `json:"message_id,omitempty"`
+	Attempts     int           `json:"attempts,omitempty"`
+	Accepted     []string      `json:"accepted,omitempty"`
+	Rejected     []Rejection   `json:"rejected,omitempty"`
+	Suppressed   []string      `json:"suppressed,omitempty"`
+	ResponseCode int           `json:"response_code,omitempty"`
+	Response     string        `json:"response,omitempty"`
+	Duration     time.Duration `json:"-"`
+}
 
-	auth := smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
-	return &Sender{
-		cfg:  cfg,
-		auth: auth,
-		from: cfg.FromAddress,
-	}, nil
+// Rejection is a recipient refused by the SMTP server, with the server's reply.
+type Rejection struct {
+	Recipient string `json:"recipient"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
 }
 
-func (s *Sender) Send(recipients []string, subject, htmlBody string) error {
-	if len(recipients) == 0 {
-		return fmt.Errorf("no recipients provided")
+// LogFields returns the fields describing r in log entries.
+func (r Result) LogFields() []zap.Field {
+	return []zap.Field{
+		zap.String("message_id", r.MessageID),
+		zap.String("provider", r.Provider),
+		zap.Int("response_code", r.ResponseCode),
+		zap.String("response", r.Response),
+		zap.Any("rejected", r.Rejected),
+		zap.Strings("suppressed", r.Suppressed),
+		zap.Duration("duration", r.Duration),
 	}
+}
 
-	msg := []byte(fmt.Sprintf(
-		"To: %s\r\n"+
-			"From: %s\r\n"+
-			"Subject: %s\r\n"+
-			"Content-Type: text/html; charset=UTF-8\r\n"+
-			"\r\n"+
-			"%s\r\n",
-		joinRecipients(recipients), s.from, subject, htmlBody))
-
-	addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
-	err := smtp.SendMail(addr, s.auth, s.from, recipients, msg)
-	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
-	}
-	return nil
+// SendError is returned by senders that retry transient failures. Transient reports whether
+// the last failure was temporary, such as a 4xx SMTP reply, so that the send may still succeed
+// later, or permanent, such as a rejected recipient.
+type SendError struct {
+	Err       error
+	Transient bool
+	Attempts  int
 }
 
-func joinRecipients(recipients []string) string {
-	if len(recipients) == 0 {
-		return ""
-	}
-	result := recipients[0]
-	for i := 1; i < len(recipients); i++ {
-		result += ", " + recipients[i]
+func (e *SendError) Error() string { return e.Err.Error() }
+
+func (e *SendError) Unwrap() error { return e.Err }
+
+// IsTransient reports whether err is a *SendError for a transient failure.
+func IsTransient(err error) bool {
+	var sendErr *SendError
+	return errors.As(err, &sendErr) && sendErr.Transient
+}
+
+// ErrSuppressed is wrapped by errors for messages whose recipients are all on the suppression
+// list.
+var ErrSuppressed = errors.New("all recipients are suppressed")
+
+// Retryable reports whether a send that failed with err may succeed if retried later. Messages
+// over the maximum size or without a recipient left to send to would fail again.
+func Retryable(err error) bool {
+	return !errors.Is(err, ErrMessageTooLarge) && !errors.Is(err, ErrSuppressed) && !errors.Is(err, ErrRecipientDomain)
+}
+
+// New creates the Sender for the provider selected in cfg.Delivery.
+func New(cfg *config.Config) (Sender, error) {
+	return newProvider(cfg.Delivery.Provider, &cfg.SMTP, &cfg.Delivery.SendGrid, &cfg.Delivery.SES)
+}
+
+// newProvider creates the Sender for provider, configured by the section of its name.
+func newProvider(provider string, smtp *config.SMTPConfig, sendGrid *config.SendGridConfig, ses *config.SESConfig) (Sender, error) {
+	switch provider {
+	case "", "smtp":
+		return NewSMTP(smtp)
+	case "sendgrid":
+		return NewSendGrid(sendGrid)
+	case "ses":
+		return NewSES(ses)
+	default:
+		return nil, fmt.Errorf("unknown delivery provider %s", provider)
 	}
-	return result
+}
+
+// isThrottle reports whether err is an SMTP reply asking the client to slow down.
+func isThrottle(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply) && (reply.Code == 421 || reply.Code == 450)
 }
@@ -1,9 +1,34 @@
 package email
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"runebird/internal/config"
+	"runebird/internal/logger"
 )
 
 func TestSender(t *testing.T) {
@@ -15,7 +40,7 @@ func TestSender(t *testing.T) {
 			Password:    "pass",
 			FromAddress: "from@example.com",
 		}
-		sender, err := New(cfg)
+		sender, err := NewSMTP(cfg)
 		if err != nil {
 			t.Fatalf("expected no error, got: %v", err)
 		}
@@ -32,7 +57,7 @@ func TestSender(t *testing.T) {
 			Password:    "",
 			FromAddress: "",
 		}
-		_, err := New(cfg)
+		_, err := NewSMTP(cfg)
 		if err == nil {
 			t.Fatal("expected error for invalid config, got none")
 		}
@@ -46,7 +71,7 @@ func TestSender(t *testing.T) {
 			Password:    "pass",
 			FromAddress: "from@example.com",
 		}
-		sender, err := New(cfg)
+		sender, err := NewSMTP(cfg)
 		if err != nil {
 			t.Fatalf("expected no error, got: %v", err)
 		}
@@ -57,7 +82,1256 @@ func TestSender(t *testing.T) {
 		}
 	})
 
+	t.Run("SendThrottled", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer func() {
+			_ = ln.Close()
+		}()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = fmt.Fprint(conn, "421 4.7.0 Too many connections, try again later\r\n")
+			_ = conn.Close()
+		}()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		sender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: addr.Port, Username: "user", Password: "pass", FromAddress: "from@example.com"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		err = sender.Send([]string{"to@example.com"}, "Test Subject", "<p>Test Body</p>")
+		if !errors.Is(err, ErrThrottled) {
+			t.Errorf("expected ErrThrottled for a 421 reply, got: %v", err)
+		}
+	})
+
+	t.Run("SendRetriesTransientErrors", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer func() {
+			_ = ln.Close()
+		}()
+		// The first connection is refused with a transient 421 reply and the second succeeds.
+		// A later connection gets a permanent 554 reply.
+		received := make(chan string, 1)
+		go func() {
+			for i := 0; ; i++ {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				switch i {
+				case 0:
+					_, _ = fmt.Fprint(conn, "421 4.3.2 Service not available\r\n")
+					_ = conn.Close()
+				case 1:
+					received <- serveSMTP(conn, "AUTH PLAIN")
+				default:
+					_, _ = fmt.Fprint(conn, "554 5.7.1 No service\r\n")
+					_ = conn.Close()
+				}
+			}
+		}()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		sender, err := NewSMTP(&config.SMTPConfig{
+			Host:        "127.0.0.1",
+			Port:        addr.Port,
+			Username:    "user",
+			Password:    "pass",
+			FromAddress: "from@example.com",
+			TLSMode:     "none",
+			Retry:       config.RetryConfig{MaxAttempts: 3, InitialDelay: 10 * time.Millisecond, Multiplier: 2},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		var delays []time.Duration
+		sender.sleep = func(_ context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		}
+
+		result, err := sender.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, Subject: "Test Subject", HTMLBody: "<p>Test Body</p>"})
+		if err != nil {
+			t.Fatalf("expected the retry to succeed, got: %v", err)
+		}
+		if result.Attempts != 2 || len(delays) != 1 || delays[0] != 10*time.Millisecond {
+			t.Errorf("expected one retry after 10ms, got %d attempts and delays %v", result.Attempts, delays)
+		}
+		if data := <-received; !strings.Contains(data, "Subject: Test Subject") {
+			t.Errorf("expected the message to be delivered, got: %q", data)
+		}
+
+		_, err = sender.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, Subject: "Test Subject", HTMLBody: "<p>Test Body</p>"})
+		var sendErr *SendError
+		if !errors.As(err, &sendErr) || sendErr.Transient || sendErr.Attempts != 1 || IsTransient(err) {
+			t.Errorf("expected a permanent failure without retries, got: %+v", err)
+		}
+	})
+
+	t.Run("UpdateCredentials", func(t *testing.T) {
+		cfg := config.SMTPConfig{Host: "127.0.0.1", Port: 587, Username: "user", Password: "old", FromAddress: "from@example.com"}
+		sender, err := NewSMTP(&cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		cfg.Password = "new"
+		if err := sender.UpdateCredentials(&cfg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		_, resp, err := sender.profiles[0].auth.Start(&smtp.ServerInfo{Name: "127.0.0.1", TLS: true, Auth: []string{"PLAIN"}})
+		if err != nil || string(resp) != "\x00user\x00new" {
+			t.Errorf("expected the new password to be used, got %q and %v", resp, err)
+		}
+
+		cfg.Fallbacks = []config.SMTPConfig{{Host: "backup.example.com", Port: 587, Username: "user", Password: "pass"}}
+		if err := sender.UpdateCredentials(&cfg); err == nil {
+			t.Error("expected error for a configuration with other profiles, got none")
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		cfg := config.SMTPConfig{Host: "127.0.0.1", Port: 587, Username: "user", Password: "pass", FromAddress: "from@example.com"}
+		sender, err := NewSMTP(&cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		sender.profiles[0].sends.Store(3)
+
+		cfg.Retry = config.RetryConfig{MaxAttempts: 4}
+		cfg.Fallbacks = []config.SMTPConfig{{Name: "backup", Host: "backup.example.com", Port: 587, Username: "user", Password: "pass"}}
+		if err := sender.Reload(&cfg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		profiles, retry := sender.settings()
+		if len(profiles) != 2 || profiles[1].name != "backup" || profiles[1].cfg.FromAddress != "from@example.com" {
+			t.Fatalf("expected the primary and backup profiles, got %d profiles", len(profiles))
+		}
+		if profiles[0].sends.Load() != 3 || retry.MaxAttempts != 4 {
+			t.Errorf("expected the primary to keep its sends and the retry policy to change, got %d sends and %d attempts", profiles[0].sends.Load(), retry.MaxAttempts)
+		}
+
+		cfg.Host = ""
+		if err := sender.Reload(&cfg); err == nil {
+			t.Error("expected error for an invalid configuration, got none")
+		}
+		if profiles, _ := sender.settings(); len(profiles) != 2 {
+			t.Errorf("expected the profiles to be kept after a failed reload, got %d", len(profiles))
+		}
+	})
+
+	t.Run("NewSenderInvalidCAFile", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+			t.Fatalf("failed to write CA file: %v", err)
+		}
+		_, err := NewSMTP(&config.SMTPConfig{Host: "smtp.example.com", Port: 587, Username: "user", Password: "pass", FromAddress: "from@example.com", CAFile: caFile})
+		if err == nil {
+			t.Fatal("expected error for a CA file without certificates, got none")
+		}
+	})
+
+	t.Run("SendStartTLSUnsupported", func(t *testing.T) {
+		port, received := fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "starttls"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		err = sender.Send([]string{"to@example.com"}, "Test Subject", "<p>Test Body</p>")
+		if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+			t.Errorf("expected an error for a server without STARTTLS, got: %v", err)
+		}
+		if data := <-received; data != "" {
+			t.Errorf("expected no message to be sent in the clear, got: %q", data)
+		}
+	})
+
+	t.Run("SendTLSModeNone", func(t *testing.T) {
+		port, received := fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := sender.Send([]string{"to@example.com"}, "Test Subject", "<p>Test Body</p>"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if data := <-received; !strings.Contains(data, "Subject: Test Subject") {
+			t.Errorf("expected the message to be delivered, got: %q", data)
+		}
+	})
+
+	t.Run("SendEnvelopeFrom", func(t *testing.T) {
+		port, received := fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "RuneBird <no-reply@runebird.app>", EnvelopeFrom: "bounces@runebird.app", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := sender.Send([]string{"to@example.com"}, "Test Subject", "<p>Test Body</p>"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data := <-received
+		if !strings.HasPrefix(data, "MAIL FROM:<bounces@runebird.app>") {
+			t.Errorf("expected the envelope sender in MAIL FROM, got: %q", data)
+		}
+		if !strings.Contains(data, "From: RuneBird <no-reply@runebird.app>") {
+			t.Errorf("expected the From header to be unchanged, got: %q", data)
+		}
+
+		port, received = fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err = NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "RuneBird <no-reply@runebird.app>", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := sender.Send([]string{"to@example.com"}, "Test Subject", "<p>Test Body</p>"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if data := <-received; !strings.HasPrefix(data, "MAIL FROM:<no-reply@runebird.app>") {
+			t.Errorf("expected the from address in MAIL FROM, got: %q", data)
+		}
+
+		port, received = fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err = NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "RuneBird <no-reply@runebird.app>", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := sender.SendMessage(context.Background(), Message{From: "Billing <billing@runebird.app>", Recipients: []string{"to@example.com"}, HTMLBody: "<p>Hi</p>"}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data = <-received
+		if !strings.HasPrefix(data, "MAIL FROM:<billing@runebird.app>") {
+			t.Errorf("expected the overriding from address in MAIL FROM, got: %q", data)
+		}
+		if !strings.Contains(data, "From: Billing <billing@runebird.app>") {
+			t.Errorf("expected the overriding from address in the From header, got: %q", data)
+		}
+	})
+
+	t.Run("SendResult", func(t *testing.T) {
+		port, received := fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		result, err := sender.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com", "nobody@reject.example.com"}, Subject: "Hi", HTMLBody: "<p>Hi</p>"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		<-received
+		if len(result.Accepted) != 1 || result.Accepted[0] != "to@example.com" {
+			t.Errorf("expected to@example.com to be accepted, got: %v", result.Accepted)
+		}
+		if len(result.Rejected) != 1 || result.Rejected[0] != (Rejection{Recipient: "nobody@reject.example.com", Code: 550, Message: "5.1.1 User unknown"}) {
+			t.Errorf("expected nobody@reject.example.com to be rejected, got: %+v", result.Rejected)
+		}
+		if result.ResponseCode != 250 || result.Response != "2.0.0 OK queued as 4F2A1" {
+			t.Errorf("expected the reply to DATA, got: %d %q", result.ResponseCode, result.Response)
+		}
+		if result.Duration <= 0 {
+			t.Errorf("expected the send duration, got: %s", result.Duration)
+		}
+
+		port, received = fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err = NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		_, err = sender.SendMessage(context.Background(), Message{Recipients: []string{"nobody@reject.example.com"}, HTMLBody: "<p>Hi</p>"})
+		if err == nil || IsTransient(err) || !strings.Contains(err.Error(), "User unknown") {
+			t.Errorf("expected a permanent error when every recipient is rejected, got: %v", err)
+		}
+		if data := <-received; strings.Contains(data, "Subject:") {
+			t.Errorf("expected no message data to be sent, got: %q", data)
+		}
+	})
+
+	t.Run("Punycode", func(t *testing.T) {
+		for domain, want := range map[string]string{
+			"example.com":  "example.com",
+			"bücher.de":    "xn--bcher-kva.de",
+			"München.de":   "xn--mnchen-3ya.de",
+			"ドメイン名例.jp":    "xn--eckwd4c7cu47r2wf.jp",
+			"mail.例子.test": "mail.xn--fsqu00a.test",
+		} {
+			if got := ASCIIDomain(domain); got != want {
+				t.Errorf("expected %s to be %s, got: %s", domain, want, got)
+			}
+		}
+	})
+
+	t.Run("SendInternationalized", func(t *testing.T) {
+		port, received := fakeSMTPServer(t, "AUTH PLAIN", "SMTPUTF8")
+		sender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		result, err := sender.SendMessage(context.Background(), Message{Recipients: []string{"zoë@bücher.de"}, HTMLBody: "<p>Hi</p>"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data := <-received
+		if !strings.Contains(data, "SMTPUTF8") || !strings.Contains(data, "RCPT TO:<zoë@bücher.de>") || !strings.Contains(data, "To: <zoë@bücher.de>") {
+			t.Errorf("expected the address to be sent as is with SMTPUTF8, got: %q", data)
+		}
+		if len(result.Accepted) != 1 {
+			t.Errorf("expected the recipient to be accepted, got: %+v", result)
+		}
+
+		port, received = fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err = NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "RuneBird <no-reply@rünebird.app>", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		result, err = sender.SendMessage(context.Background(), Message{Recipients: []string{"Zoë <zoe@bücher.de>", "zoë@example.com"}, HTMLBody: "<p>Hi</p>"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data = <-received
+		if !strings.Contains(data, "MAIL FROM:<no-reply@xn--rnebird-n2a.app>") || !strings.Contains(data, "RCPT TO:<zoe@xn--bcher-kva.de>") || strings.Contains(data, "zoë@") {
+			t.Errorf("expected ASCII domains without SMTPUTF8, got: %q", data)
+		}
+		if !isASCII(data) {
+			t.Errorf("expected an ASCII message without SMTPUTF8, got: %q", data)
+		}
+		if len(result.Accepted) != 1 || result.Accepted[0] != "Zoë <zoe@bücher.de>" {
+			t.Errorf("expected the IDN recipient to be accepted, got: %v", result.Accepted)
+		}
+		if len(result.Rejected) != 1 || result.Rejected[0].Recipient != "zoë@example.com" || result.Rejected[0].Code != 553 {
+			t.Errorf("expected the non-ASCII local part to be rejected, got: %+v", result.Rejected)
+		}
+	})
+
+	t.Run("SendHungServer", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer func() {
+			_ = ln.Close()
+		}()
+		// The server accepts connections but never greets the client.
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer func() {
+					_ = conn.Close()
+				}()
+			}
+		}()
+		port := ln.Addr().(*net.TCPAddr).Port
+
+		sender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none", Retry: config.RetryConfig{MaxAttempts: 3, InitialDelay: time.Second}})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = sender.SendMessage(ctx, Message{Recipients: []string{"to@example.com"}, HTMLBody: "<p>Hi</p>"})
+		if !errors.Is(err, context.DeadlineExceeded) || !IsTransient(err) {
+			t.Errorf("expected a transient deadline error, got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the send to be abandoned with the context, took %s", elapsed)
+		}
+
+		sender, err = NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none", SendTimeout: 100 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		start = time.Now()
+		if _, err := sender.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, HTMLBody: "<p>Hi</p>"}); err == nil {
+			t.Error("expected error for a server that never answers, got none")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the send timeout to apply, took %s", elapsed)
+		}
+	})
+
+	t.Run("SendXOAUTH2", func(t *testing.T) {
+		var refreshes atomic.Int32
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			refreshes.Add(1)
+			if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" || r.FormValue("client_id") != "client" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = fmt.Fprint(w, `{"error":"invalid_grant"}`)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"access_token":"access","expires_in":3600}`)
+		}))
+		defer tokenServer.Close()
+
+		port, received := fakeSMTPServer(t, "AUTH XOAUTH2")
+		sender, err := NewSMTP(&config.SMTPConfig{
+			Host:        "127.0.0.1",
+			Port:        port,
+			Username:    "user@example.com",
+			FromAddress: "from@example.com",
+			TLSMode:     "none",
+			AuthMethod:  "xoauth2",
+			OAuth2:      config.OAuth2Config{ClientID: "client", RefreshToken: "refresh", TokenURL: tokenServer.URL},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := sender.Send([]string{"to@example.com"}, "Test Subject", "<p>Test Body</p>"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if data := <-received; !strings.Contains(data, "Subject: Test Subject") {
+			t.Errorf("expected the message to be delivered, got: %q", data)
+		}
+
+		// The cached token is reused until it expires.
+		mech, resp, err := sender.profiles[0].auth.Start(&smtp.ServerInfo{Name: "127.0.0.1"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if want := "user=user@example.com\x01auth=Bearer access\x01\x01"; mech != "XOAUTH2" || string(resp) != want {
+			t.Errorf("expected XOAUTH2 response %q, got %s %q", want, mech, resp)
+		}
+		if n := refreshes.Load(); n != 1 {
+			t.Errorf("expected 1 token refresh, got %d", n)
+		}
+
+		if _, _, err := sender.profiles[0].auth.Start(&smtp.ServerInfo{Name: "smtp.example.com"}); err == nil {
+			t.Error("expected error for an unencrypted connection to a remote server, got none")
+		}
+	})
+
+	t.Run("SendFailover", func(t *testing.T) {
+		port, received := fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err := NewSMTP(&config.SMTPConfig{
+			Host:        "127.0.0.1",
+			Port:        1,
+			Username:    "user",
+			Password:    "pass",
+			FromAddress: "from@example.com",
+			TLSMode:     "none",
+			Fallbacks: []config.SMTPConfig{
+				{Name: "backup", Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", TLSMode: "none"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := sender.Send([]string{"to@example.com"}, "Test Subject", "<p>Test Body</p>"); err != nil {
+			t.Fatalf("expected the fallback to deliver, got: %v", err)
+		}
+		if data := <-received; !strings.Contains(data, "From: from@example.com") {
+			t.Errorf("expected the fallback to inherit the from address, got: %q", data)
+		}
+
+		primary, backup := sender.profiles[0], sender.profiles[1]
+		if backup.name != "backup" || backup.sends.Load() != 1 || primary.sends.Load() != 0 {
+			t.Errorf("expected one send through backup, got %s=%d %s=%d", primary.name, primary.sends.Load(), backup.name, backup.sends.Load())
+		}
+		now := time.Now()
+		if primary.healthy(now) {
+			t.Error("expected the unreachable primary to be marked unhealthy")
+		}
+		if order := order(sender.profiles, now); order[0] != backup {
+			t.Errorf("expected the healthy backup to be tried first, got %s", order[0].name)
+		}
+		if !primary.healthy(now.Add(profileCooldown)) {
+			t.Error("expected the primary to be healthy again after the cooldown")
+		}
+	})
+
+	t.Run("SendGrid", func(t *testing.T) {
+		var got map[string]interface{}
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v3/mail/send" || r.Header.Get("Authorization") != "Bearer key" {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = fmt.Fprint(w, `{"errors":[{"message":"authorization required"}]}`)
+				return
+			}
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if got["subject"] == "Slow down" {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("X-Message-Id", "sg-123")
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer api.Close()
+
+		sender, err := NewSendGrid(&config.SendGridConfig{APIKey: "key", FromAddress: "RuneBird <from@example.com>", BaseURL: api.URL})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		result, err := sender.SendMessage(context.Background(), Message{
+			Recipients:  []string{"to@example.com"},
+			Subject:     "Hi",
+			HTMLBody:    "<p>Hi</p>",
+			ReplyTo:     "support@example.com",
+			Attachments: []Attachment{{Filename: "a.txt", Content: []byte("hi")}},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if result.Provider != "sendgrid" || result.MessageID != "sg-123" {
+			t.Errorf("expected the SendGrid message ID, got: %+v", result)
+		}
+		if from := got["from"].(map[string]interface{}); from["email"] != "from@example.com" || from["name"] != "RuneBird" {
+			t.Errorf("expected the parsed from address, got: %v", from)
+		}
+		if content := got["content"].([]interface{}); len(content) != 2 || content[0].(map[string]interface{})["value"] != "Hi" {
+			t.Errorf("expected plain text and HTML content, got: %v", content)
+		}
+		if attachments := got["attachments"].([]interface{}); attachments[0].(map[string]interface{})["content"] != base64.StdEncoding.EncodeToString([]byte("hi")) {
+			t.Errorf("expected a base64 attachment, got: %v", attachments)
+		}
+
+		_, err = sender.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, Subject: "Slow down", HTMLBody: "<p>Hi</p>"})
+		if !errors.Is(err, ErrThrottled) {
+			t.Errorf("expected ErrThrottled for a 429 response, got: %v", err)
+		}
+
+		unauthorized, err := NewSendGrid(&config.SendGridConfig{APIKey: "wrong", FromAddress: "from@example.com", BaseURL: api.URL})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := unauthorized.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, HTMLBody: "<p>Hi</p>"}); err == nil || !strings.Contains(err.Error(), "authorization required") {
+			t.Errorf("expected the API error message, got: %v", err)
+		}
+	})
+
+	t.Run("SES", func(t *testing.T) {
+		var got sesRequest
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v2/email/outbound-emails" || !strings.Contains(r.Header.Get("Authorization"), "Credential=AKID/") || r.Header.Get("X-Amz-Security-Token") != "session" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = fmt.Fprint(w, `{"message":"The security token included in the request is invalid."}`)
+				return
+			}
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"MessageId":"0100018f-ses"}`)
+		}))
+		defer api.Close()
+
+		sender, err := NewSES(&config.SESConfig{
+			Region:           "eu-west-1",
+			AccessKeyID:      "AKID",
+			SecretAccessKey:  "secret",
+			SessionToken:     "session",
+			ConfigurationSet: "tracking",
+			FromAddress:      "from@example.com",
+			Endpoint:         api.URL,
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		result, err := sender.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, Subject: "Hi", HTMLBody: "<p>Hi</p>"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if result.Provider != "ses" || result.MessageID != "0100018f-ses" {
+			t.Errorf("expected the SES message ID, got: %+v", result)
+		}
+		if got.ConfigurationSetName != "tracking" || got.Destination.ToAddresses[0] != "to@example.com" {
+			t.Errorf("expected the configuration set and destination, got: %+v", got)
+		}
+		if !bytes.Contains(got.Content.Raw.Data, []byte("Subject: Hi")) {
+			t.Errorf("expected the raw message to be sent, got: %q", got.Content.Raw.Data)
+		}
+
+		sender.creds.SessionToken = ""
+		if _, err := sender.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, HTMLBody: "<p>Hi</p>"}); err == nil || !strings.Contains(err.Error(), "security token") {
+			t.Errorf("expected the API error message, got: %v", err)
+		}
+	})
+
+	t.Run("BuildWithAttachments", func(t *testing.T) {
+		data, err := build(Message{
+			Recipients:  []string{"to@example.com"},
+			Subject:     "Report",
+			HTMLBody:    "<p>See attached</p>",
+			Attachments: []Attachment{{Filename: "report.csv", ContentType: "text/csv", Content: []byte("a,b\n1,2\n")}},
+		}, "from@example.com", "")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse built message: %v", err)
+		}
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/mixed" {
+			t.Fatalf("expected a multipart/mixed message, got: %s (err=%v)", mediaType, err)
+		}
+		reader := multipart.NewReader(msg.Body, params["boundary"])
+		body, err := reader.NextPart()
+		if err != nil || !strings.HasPrefix(body.Header.Get("Content-Type"), "multipart/alternative") {
+			t.Fatalf("expected the message body as the first part, got: %v (err=%v)", body, err)
+		}
+		attachment, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("expected an attachment part, got: %v", err)
+		}
+		if attachment.FileName() != "report.csv" {
+			t.Errorf("expected attachment filename report.csv, got: %s", attachment.FileName())
+		}
+		encoded, _ := io.ReadAll(attachment)
+		content, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+		if err != nil || string(content) != "a,b\n1,2\n" {
+			t.Errorf("expected attachment content to round-trip, got: %q (err=%v)", content, err)
+		}
+	})
+
+	t.Run("BuildAlternative", func(t *testing.T) {
+		data, err := build(Message{Recipients: []string{"to@example.com"}, Subject: "Hi", HTMLBody: "<p>Hello &amp; welcome</p>"}, "from@example.com", "")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse built message: %v", err)
+		}
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("expected a multipart/alternative message, got: %s (err=%v)", mediaType, err)
+		}
+		// The multipart reader decodes quoted-printable parts.
+		reader := multipart.NewReader(msg.Body, params["boundary"])
+		var parts []string
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			content, _ := io.ReadAll(part)
+			parts = append(parts, part.Header.Get("Content-Type")+": "+string(content))
+		}
+		if len(parts) != 2 || parts[0] != "text/plain; charset=UTF-8: Hello & welcome" || parts[1] != "text/html; charset=UTF-8: <p>Hello &amp; welcome</p>" {
+			t.Errorf("expected plain text and HTML parts, got: %q", parts)
+		}
+	})
+
+	t.Run("BuildEncodesNonASCII", func(t *testing.T) {
+		subject := "Willkommen, Zoë 🎉 " + strings.Repeat("lange Betreffzeile ", 5)
+		text := strings.Repeat("ようこそ", 10)
+		data, err := build(Message{
+			Recipients: []string{"Zoë Müller <zoe@example.com>"},
+			Subject:    subject,
+			HTMLBody:   "<p>Grüße</p>",
+			TextBody:   text,
+		}, "Rünebird <no-reply@runebird.app>", "")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\r\n") {
+			if len(line) > 78 && !strings.HasPrefix(line, "Content-Type:") {
+				t.Errorf("expected lines of at most 78 characters, got: %q", line)
+			}
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse built message: %v", err)
+		}
+		if raw := msg.Header.Get("Subject"); !isASCII(raw) {
+			t.Errorf("expected an encoded subject, got: %q", raw)
+		}
+		if got, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); got != subject {
+			t.Errorf("expected subject %q, got: %q", subject, got)
+		}
+		if from, err := msg.Header.AddressList("From"); err != nil || from[0].Name != "Rünebird" || from[0].Address != "no-reply@runebird.app" {
+			t.Errorf("expected an encoded From display name, got: %v (err=%v)", from, err)
+		}
+		if to, err := msg.Header.AddressList("To"); err != nil || to[0].Name != "Zoë Müller" {
+			t.Errorf("expected an encoded To display name, got: %v (err=%v)", to, err)
+		}
+
+		_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		reader := multipart.NewReader(msg.Body, params["boundary"])
+		encodings := map[string]string{}
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			content, _ := io.ReadAll(part)
+			encodings[part.Header.Get("Content-Type")] = part.Header.Get("Content-Transfer-Encoding")
+			if part.Header.Get("Content-Transfer-Encoding") == "base64" {
+				content, _ = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(content), "\r\n", ""))
+			}
+			if strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain") && string(content) != text {
+				t.Errorf("expected plain text %q, got: %q", text, content)
+			}
+		}
+		// The multipart reader drops the header of quoted-printable parts as it decodes them.
+		if encodings["text/plain; charset=UTF-8"] != "base64" || encodings["text/html; charset=UTF-8"] == "base64" {
+			t.Errorf("expected base64 for mostly non-ASCII text and quoted-printable otherwise, got: %v", encodings)
+		}
+	})
+
+	t.Run("BuildWithHeaders", func(t *testing.T) {
+		data, err := build(Message{
+			Recipients: []string{"to@example.com"},
+			Subject:    "Hi",
+			HTMLBody:   "<p>Hi</p>",
+			ReplyTo:    "Support <support@example.com>",
+			Headers:    map[string]string{"X-Campaign-ID": "spring-2025", "X-Note": "Grüße"},
+		}, "from@example.com", "")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse built message: %v", err)
+		}
+		if got := msg.Header.Get("Reply-To"); got != "Support <support@example.com>" {
+			t.Errorf("expected Reply-To header, got: %q", got)
+		}
+		if got := msg.Header.Get("X-Campaign-ID"); got != "spring-2025" {
+			t.Errorf("expected X-Campaign-ID header, got: %q", got)
+		}
+		if got, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("X-Note")); got != "Grüße" {
+			t.Errorf("expected non-ASCII header to round-trip, got: %q", got)
+		}
+
+		if _, err := build(Message{Recipients: []string{"to@example.com"}, Headers: map[string]string{"X-Tag": "a\r\nBcc: victim@example.com"}}, "from@example.com", ""); err == nil {
+			t.Error("expected error for a header value with a line break, got none")
+		}
+	})
+
+	t.Run("BuildMessageID", func(t *testing.T) {
+		id := newMessageID("", "RuneBird <no-reply@runebird.app>")
+		if !strings.HasSuffix(id, "@runebird.app") || id == newMessageID("", "no-reply@runebird.app") {
+			t.Errorf("expected a unique ID in the from address domain, got: %s", id)
+		}
+		if id := newMessageID("mail.example.com", "no-reply@runebird.app"); !strings.HasSuffix(id, "@mail.example.com") {
+			t.Errorf("expected the configured domain, got: %s", id)
+		}
+
+		data, err := build(Message{Recipients: []string{"to@example.com"}, Subject: "Hi", HTMLBody: "<p>Hi</p>"}, "from@example.com", id)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse built message: %v", err)
+		}
+		if got := msg.Header.Get("Message-ID"); got != "<"+id+">" {
+			t.Errorf("expected Message-ID <%s>, got: %q", id, got)
+		}
+		if _, err := msg.Header.Date(); err != nil {
+			t.Errorf("expected a valid Date header, got: %v", err)
+		}
+		if got := msg.Header.Get("MIME-Version"); got != "1.0" {
+			t.Errorf("expected MIME-Version 1.0, got: %q", got)
+		}
+
+		if err := ValidateHeaders("", map[string]string{"Message-ID": "<forged@example.com>"}); err == nil {
+			t.Error("expected error for a custom Message-ID header, got none")
+		}
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		log, err := logger.New(&config.LoggingConfig{Level: "info"})
+		if err != nil {
+			t.Fatalf("failed to create logger: %v", err)
+		}
+		next := &countingSender{}
+		cfg := &config.Config{SMTP: config.SMTPConfig{FromAddress: "no-reply@runebird.app"}}
+		cfg.Delivery.CaptureDir = filepath.Join(t.TempDir(), "captured")
+		sender := NewDryRun(next, cfg, log)
+
+		msg := Message{Recipients: []string{"to@example.com"}, Subject: "Hi", HTMLBody: "<p>Hi</p>"}
+		if _, err := sender.SendMessage(context.Background(), msg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if next.calls != 1 {
+			t.Fatalf("expected the message to be delivered, got %d deliveries", next.calls)
+		}
+
+		msg.DryRun = true
+		result, err := sender.SendMessage(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if next.calls != 1 {
+			t.Errorf("expected a dry-run message not to be delivered, got %d deliveries", next.calls)
+		}
+		if result.Provider != DryRunProvider || result.MessageID == "" {
+			t.Errorf("expected a dry-run result with a message ID, got: %+v", result)
+		}
+		files, err := filepath.Glob(filepath.Join(cfg.Delivery.CaptureDir, "*.eml"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("expected one captured message, got: %v (%v)", files, err)
+		}
+		data, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatalf("failed to read captured message: %v", err)
+		}
+		captured, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse captured message: %v", err)
+		}
+		if got := captured.Header.Get("Message-ID"); got != "<"+result.MessageID+">" {
+			t.Errorf("expected Message-ID <%s>, got: %q", result.MessageID, got)
+		}
+
+		cfg.Delivery.DryRun = true
+		cfg.Delivery.CaptureDir = ""
+		core, logs := observer.New(zap.InfoLevel)
+		sender = NewDryRun(next, cfg, &logger.Logger{Logger: zap.New(core)})
+		msg.DryRun = false
+		if _, err := sender.SendMessage(context.Background(), msg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if next.calls != 1 {
+			t.Errorf("expected global dry-run mode to skip delivery, got %d deliveries", next.calls)
+		}
+		// Without a capture directory, only the headers and size are logged at info level.
+		entries := logs.FilterMessage("Dry run: email not delivered").All()
+		if len(entries) != 1 || logs.Len() != 1 {
+			t.Fatalf("expected a single info line for the dry run, got: %v", logs.All())
+		}
+		fields := entries[0].ContextMap()
+		if headers, _ := fields["headers"].(string); !strings.Contains(headers, "Subject: Hi") || strings.Contains(headers, "<p>Hi</p>") {
+			t.Errorf("expected the headers without the body, got: %q", headers)
+		}
+		if _, ok := fields["message"]; ok || fields["size"] == nil {
+			t.Errorf("expected the size instead of the message, got: %v", fields)
+		}
+	})
+
+	t.Run("Archive", func(t *testing.T) {
+		archive := &config.ArchiveConfig{Address: "archive@runebird.app", ExcludeTemplates: []string{"password_reset"}}
+		port, received := fakeSMTPServer(t, "AUTH PLAIN")
+		smtpSender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		sender := NewArchive(smtpSender, archive)
+		result, err := sender.SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, Template: "welcome", HTMLBody: "<p>Hi</p>"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data := <-received
+		if !strings.Contains(data, "RCPT TO:<archive@runebird.app>") {
+			t.Errorf("expected the archive address in the envelope, got: %q", data)
+		}
+		if strings.Count(data, "archive@runebird.app") != 1 {
+			t.Errorf("expected the archive address to appear in the envelope only, got: %q", data)
+		}
+		if len(result.Accepted) != 1 || result.Accepted[0] != "to@example.com" {
+			t.Errorf("expected only the recipient to be reported, got: %v", result.Accepted)
+		}
+
+		port, received = fakeSMTPServer(t, "AUTH PLAIN")
+		smtpSender, err = NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := NewArchive(smtpSender, archive).SendMessage(context.Background(), Message{Recipients: []string{"to@example.com"}, Template: "password_reset", HTMLBody: "<p>Hi</p>"}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if data := <-received; strings.Contains(data, "archive@runebird.app") {
+			t.Errorf("expected excluded templates not to be archived, got: %q", data)
+		}
+
+		if s := NewArchive(smtpSender, &config.ArchiveConfig{}); s != Sender(smtpSender) {
+			t.Error("expected the sender to be returned unchanged without an archive address")
+		}
+	})
+
+	t.Run("MessageSize", func(t *testing.T) {
+		msg := Message{Recipients: []string{"to@example.com"}, Subject: "Hi", HTMLBody: "<p>Hi</p>", Attachments: []Attachment{{Filename: "a.bin", Content: make([]byte, 3000)}}}
+		size, err := MessageSize(msg, "from@example.com")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		// The attachment grows by a third when base64-encoded.
+		if size < 4000 {
+			t.Errorf("expected the encoded attachment to be counted, got: %d bytes", size)
+		}
+		if err := CheckSize(msg, "from@example.com", size); err != nil {
+			t.Errorf("expected a message at the limit to pass, got: %v", err)
+		}
+
+		next := &countingSender{}
+		sender := NewSizeLimit(next, &config.Config{Server: config.ServerConfig{MaxMessageSize: 4000}, SMTP: config.SMTPConfig{FromAddress: "from@example.com"}})
+		_, err = sender.SendMessage(context.Background(), msg)
+		if !errors.Is(err, ErrMessageTooLarge) || IsTransient(err) {
+			t.Errorf("expected a permanent ErrMessageTooLarge, got: %v", err)
+		}
+		msg.Attachments = nil
+		if _, err := sender.SendMessage(context.Background(), msg); err != nil || next.calls != 1 {
+			t.Errorf("expected a small message to be sent, got: %v", err)
+		}
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		next := &countingSender{}
+		sender := NewMetrics(next, &config.Config{SMTP: config.SMTPConfig{FromAddress: "from@example.com"}})
+		msg := Message{Recipients: []string{"to@example.com"}, Subject: "Hi", Template: "welcome", HTMLBody: "<p>Hi</p>"}
+		if _, err := sender.SendMessage(context.Background(), msg); err != nil || next.calls != 1 {
+			t.Fatalf("expected the message to be sent, got: %v", err)
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(sender.Collectors()...)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("failed to gather metrics: %v", err)
+		}
+		observed := make(map[string]string)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, label := range m.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				if m.GetHistogram().GetSampleCount() == 1 && labels["template"] == "welcome" && labels["provider"] == "smtp" {
+					observed[family.GetName()] = labels["status"]
+				}
+			}
+		}
+		if status, ok := observed["runebird_send_duration_seconds"]; !ok || status != "sent" {
+			t.Errorf("expected the send to be observed as sent, got: %v", observed)
+		}
+		if _, ok := observed["runebird_message_size_bytes"]; !ok {
+			t.Errorf("expected the message size to be observed, got: %v", observed)
+		}
+	})
+
+	t.Run("DomainFilter", func(t *testing.T) {
+		log, err := logger.New(&config.LoggingConfig{Level: "info"})
+		if err != nil {
+			t.Fatalf("failed to create logger: %v", err)
+		}
+		next := &countingSender{}
+		if NewDomainFilter(next, &config.Config{}, log) != Sender(next) {
+			t.Error("expected no filter without restricted domains")
+		}
+
+		cfg := &config.Config{Delivery: config.DeliveryConfig{RecipientDomains: config.RecipientDomainsConfig{
+			Allow: []string{"Example.com"},
+			Deny:  []string{"blocked.example.com"},
+		}}}
+		sender := NewDomainFilter(next, cfg, log)
+		msg := Message{Recipients: []string{"Alice <alice@mail.example.com>", "bob@other.org", "eve@blocked.example.com", "carol@EXAMPLE.com"}, Subject: "Hi", HTMLBody: "<p>Hi</p>"}
+		if _, err := sender.SendMessage(context.Background(), msg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if want := []string{"Alice <alice@mail.example.com>", "carol@EXAMPLE.com"}; !reflect.DeepEqual(next.last.Recipients, want) {
+			t.Errorf("expected recipients %v, got: %v", want, next.last.Recipients)
+		}
+
+		msg.Recipients = []string{"bob@other.org"}
+		_, err = sender.SendMessage(context.Background(), msg)
+		if !errors.Is(err, ErrRecipientDomain) || IsTransient(err) || Retryable(err) {
+			t.Errorf("expected a permanent ErrRecipientDomain, got: %v", err)
+		}
+		if next.calls != 1 {
+			t.Errorf("expected the blocked message not to be sent, got %d sends", next.calls)
+		}
+
+		if reason := CheckRecipientDomain(&cfg.Delivery.RecipientDomains, "eve@blocked.example.com", BlockedAtRequest); reason != "domain blocked.example.com may not be emailed" {
+			t.Errorf("expected the denied domain to be reported, got: %q", reason)
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(sender.Collectors()...)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("failed to gather metrics: %v", err)
+		}
+		blocked := make(map[string]float64)
+		for _, family := range families {
+			if family.GetName() != "runebird_recipients_blocked_total" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, label := range m.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				blocked[labels["stage"]+"/"+labels["list"]] = m.GetCounter().GetValue()
+			}
+		}
+		if blocked["send/allow"] != 2 || blocked["send/deny"] != 1 || blocked["request/deny"] != 1 {
+			t.Errorf("expected the blocked recipients counted by stage and list, got: %v", blocked)
+		}
+	})
+
+	t.Run("Router", func(t *testing.T) {
+		var sendGridCalls int
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sendGridCalls++
+			w.Header().Set("X-Message-Id", "sg-456")
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer api.Close()
+
+		def, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: 1, Username: "user", Password: "pass", FromAddress: "from@example.com", Name: "primary"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		router, err := NewRouter(def, []config.DeliveryProfile{
+			{Name: "marketing", Provider: "sendgrid", SendGrid: config.SendGridConfig{APIKey: "key", FromAddress: "news@example.com", BaseURL: api.URL}},
+			{Name: "relay", Provider: "smtp", SMTP: config.SMTPConfig{Host: "127.0.0.1", Port: 1, Username: "user", Password: "pass", FromAddress: "from@example.com", Name: "relay"}},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if router.Default() != def {
+			t.Error("expected the default sender to be kept")
+		}
+
+		msg := Message{Recipients: []string{"to@example.com"}, Subject: "News", HTMLBody: "<p>News</p>", Profile: "marketing"}
+		result, err := router.SendMessage(context.Background(), msg)
+		if err != nil || result.Provider != "sendgrid" || sendGridCalls != 1 {
+			t.Errorf("expected the message sent through the marketing profile, got: %+v (err=%v)", result, err)
+		}
+		msg.Profile = "missing"
+		if _, err := router.SendMessage(context.Background(), msg); !errors.Is(err, ErrUnknownProfile) {
+			t.Errorf("expected ErrUnknownProfile, got: %v", err)
+		}
+
+		// The SMTP profiles of the default sender and of the relay share one collector.
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(router.Collectors()...)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("failed to gather metrics: %v", err)
+		}
+		for _, family := range families {
+			if family.GetName() == "runebird_smtp_sends_total" && len(family.GetMetric()) != 2 {
+				t.Errorf("expected sends of the primary and relay profiles, got %d series", len(family.GetMetric()))
+			}
+		}
+	})
+
+	t.Run("HealthCheck", func(t *testing.T) {
+		port, received := fakeSMTPServer(t, "AUTH PLAIN")
+		sender, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: port, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := sender.Probe(context.Background()); err != nil {
+			t.Errorf("expected the probe to succeed, got: %v", err)
+		}
+		if data := <-received; data != "" {
+			t.Errorf("expected no message to be sent, got: %q", data)
+		}
+
+		down, err := NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: 1, Username: "user", Password: "pass", FromAddress: "from@example.com", TLSMode: "none"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := down.Probe(context.Background()); err == nil {
+			t.Error("expected the probe of an unreachable server to fail")
+		}
+
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v3/scopes" || r.Header.Get("Authorization") != "Bearer key" {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = fmt.Fprint(w, `{"errors":[{"message":"authorization required"}]}`)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"scopes":["mail.send"]}`)
+		}))
+		defer api.Close()
+		for key, ok := range map[string]bool{"key": true, "wrong": false} {
+			sg, err := NewSendGrid(&config.SendGridConfig{APIKey: key, FromAddress: "from@example.com", BaseURL: api.URL})
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if err := sg.Probe(context.Background()); (err == nil) != ok {
+				t.Errorf("expected the probe with key %q to succeed: %t, got: %v", key, ok, err)
+			}
+		}
+
+		log, err := logger.New(&config.LoggingConfig{Level: "info"})
+		if err != nil {
+			t.Fatalf("failed to create logger: %v", err)
+		}
+		provider := &countingSender{}
+		checker := NewHealthChecker(provider, &config.HealthCheckConfig{Enabled: true, Interval: time.Minute, Timeout: time.Second}, log)
+		if health := checker.Health(); !health.Up || !health.CheckedAt.IsZero() {
+			t.Errorf("expected the provider to be assumed up before the first check, got: %+v", health)
+		}
+		provider.probeErr = errors.New("connection refused")
+		if health := checker.Check(); health.Up || health.Error != "connection refused" || health.CheckedAt.IsZero() {
+			t.Errorf("expected the provider to be down, got: %+v", health)
+		}
+		provider.probeErr = nil
+		if health := checker.Check(); !health.Up || health.Error != "" {
+			t.Errorf("expected the provider to be up again, got: %+v", health)
+		}
+	})
+
+	t.Run("ValidateHeaders", func(t *testing.T) {
+		if err := ValidateHeaders("reply@example.com", map[string]string{"X-Campaign-ID": "42"}); err != nil {
+			t.Errorf("expected valid headers, got: %v", err)
+		}
+		for _, tc := range []struct {
+			name    string
+			replyTo string
+			headers map[string]string
+		}{
+			{"InvalidReplyTo", "not an address", nil},
+			{"ReplyToInjection", "a@example.com\r\nBcc: b@example.com", nil},
+			{"ReservedHeader", "", map[string]string{"bcc": "b@example.com"}},
+			{"InvalidName", "", map[string]string{"X Campaign": "42"}},
+			{"NameInjection", "", map[string]string{"X-A\r\nBcc": "b@example.com"}},
+		} {
+			if err := ValidateHeaders(tc.replyTo, tc.headers); err == nil {
+				t.Errorf("%s: expected error, got none", tc.name)
+			}
+		}
+	})
+
+	t.Run("HTMLToText", func(t *testing.T) {
+		html := `<html><head><style>p { color: red; }</style></head><body>
+<h1>Welcome,   Alice</h1><p>Thanks for joining.<br>Start <a href="https://runebird.app/start">here</a>.</p>
+<ul><li>One</li><li>Two</li></ul></body></html>`
+		want := "Welcome, Alice\nThanks for joining.\nStart here (https://runebird.app/start).\n\n- One\n- Two"
+		if got := HTMLToText(html); got != want {
+			t.Errorf("expected %q, got: %q", want, got)
+		}
+	})
+
+	t.Run("ValidateAttachments", func(t *testing.T) {
+		if err := ValidateAttachments([]Attachment{{Filename: "ok.txt", ContentType: "text/plain"}}); err != nil {
+			t.Errorf("expected a valid attachment, got: %v", err)
+		}
+		if err := ValidateAttachments([]Attachment{{Filename: "bad\r\n.txt"}}); err == nil {
+			t.Error("expected error for a filename with a line break, got none")
+		}
+		if err := ValidateAttachments([]Attachment{{Filename: "ok.txt", ContentType: "not a type"}}); err == nil {
+			t.Error("expected error for an invalid content type, got none")
+		}
+	})
+
 	t.Run("SendEmailMock", func(t *testing.T) {
 		t.Skip("Skipping actual SMTP send test; requires mock server setup")
 	})
 }
+
+// fakeSMTPServer accepts a single plain-text SMTP session that advertises the given EHLO
+// extensions and accepts every command. The MAIL and RCPT commands and message data, or "" if
+// none was sent, are delivered on the returned channel when the session ends.
+func fakeSMTPServer(t *testing.T, extensions ...string) (int, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		received <- serveSMTP(conn, extensions...)
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, received
+}
+
+// serveSMTP runs an SMTP session on conn that accepts every command, except for recipients
+// at reject.example.com, and returns the MAIL and RCPT commands followed by the message data,
+// or "" if none was sent.
+func serveSMTP(conn net.Conn, extensions ...string) string {
+	var data strings.Builder
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	_, _ = fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return data.String()
+		}
+		verb := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch verb {
+		case "EHLO":
+			_, _ = fmt.Fprint(conn, "250-localhost\r\n")
+			for _, ext := range extensions {
+				_, _ = fmt.Fprintf(conn, "250-%s\r\n", ext)
+			}
+			_, _ = fmt.Fprint(conn, "250 8BITMIME\r\n")
+		case "AUTH":
+			_, _ = fmt.Fprint(conn, "235 2.7.0 Authentication successful\r\n")
+		case "MAIL":
+			data.WriteString(line)
+			_, _ = fmt.Fprint(conn, "250 2.0.0 OK\r\n")
+		case "RCPT":
+			data.WriteString(line)
+			if strings.Contains(line, "@reject.example.com>") {
+				_, _ = fmt.Fprint(conn, "550 5.1.1 User unknown\r\n")
+			} else {
+				_, _ = fmt.Fprint(conn, "250 2.1.5 OK\r\n")
+			}
+		case "DATA":
+			_, _ = fmt.Fprint(conn, "354 End data with <CR><LF>.<CR><LF>\r\n")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return data.String()
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			_, _ = fmt.Fprint(conn, "250 2.0.0 OK queued as 4F2A1\r\n")
+		case "QUIT":
+			_, _ = fmt.Fprint(conn, "221 2.0.0 Bye\r\n")
+			return data.String()
+		default:
+			_, _ = fmt.Fprint(conn, "250 2.0.0 OK\r\n")
+		}
+	}
+}
+
+// countingSender is a Sender that counts the messages passed to it, keeping the last one.
+// Probes fail with probeErr.
+type countingSender struct {
+	calls    int
+	last     Message
+	probeErr error
+}
+
+func (s *countingSender) SendMessage(_ context.Context, msg Message) (Result, error) {
+	s.calls++
+	s.last = msg
+	return Result{Provider: "test"}, nil
+}
+
+func (s *countingSender) Probe(context.Context) error {
+	return s.probeErr
+}
+
+func (s *countingSender) Collectors() []prometheus.Collector {
+	return nil
+}
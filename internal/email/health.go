@@ -0,0 +1,144 @@
+package email
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/logger"
+)
+
+// Health is the outcome of the latest provider probe. CheckedAt is zero until the first probe
+// has finished, and the provider is assumed to be up until then.
+type Health struct {
+	Up        bool
+	Error     string
+	CheckedAt time.Time
+}
+
+// HealthChecker probes the email provider periodically, so that the service can report itself
+// unready while the provider is down instead of accepting emails it cannot deliver.
+type HealthChecker struct {
+	sender    Sender
+	cfg       *config.HealthCheckConfig
+	logger    *logger.Logger
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	health    Health
+	isRunning bool
+}
+
+func NewHealthChecker(sender Sender, cfg *config.HealthCheckConfig, log *logger.Logger) *HealthChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &HealthChecker{
+		sender: sender,
+		cfg:    cfg,
+		logger: log,
+		ctx:    ctx,
+		cancel: cancel,
+		health: Health{Up: true},
+	}
+}
+
+// Start begins probing the provider, immediately and then every interval. It does nothing if
+// health checks are disabled.
+func (h *HealthChecker) Start() {
+	if !h.cfg.Enabled {
+		return
+	}
+	h.mu.Lock()
+	if h.isRunning {
+		h.mu.Unlock()
+		return
+	}
+	h.isRunning = true
+	h.mu.Unlock()
+
+	go h.run()
+	h.logger.Info("Email provider health checks started", zap.Duration("interval", h.cfg.Interval))
+}
+
+// Stop halts the probing.
+func (h *HealthChecker) Stop() {
+	h.mu.Lock()
+	if !h.isRunning {
+		h.mu.Unlock()
+		return
+	}
+	h.isRunning = false
+	h.mu.Unlock()
+
+	h.cancel()
+	h.logger.Info("Email provider health checks stopped")
+}
+
+func (h *HealthChecker) run() {
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		h.Check()
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check probes the provider once and records the outcome.
+func (h *HealthChecker) Check() Health {
+	ctx, cancel := context.WithTimeout(h.ctx, h.cfg.Timeout)
+	defer cancel()
+	err := h.sender.Probe(ctx)
+	if h.ctx.Err() != nil {
+		return h.Health()
+	}
+
+	health := Health{Up: err == nil, CheckedAt: time.Now().UTC()}
+	if err != nil {
+		health.Error = err.Error()
+	}
+
+	h.mu.Lock()
+	wasUp := h.health.Up
+	h.health = health
+	h.mu.Unlock()
+
+	switch {
+	case wasUp && !health.Up:
+		h.logger.Error("Email provider health check failed", zap.Error(err))
+	case !wasUp && health.Up:
+		h.logger.Info("Email provider is reachable again")
+	}
+	return health
+}
+
+// Health returns the outcome of the latest probe.
+func (h *HealthChecker) Health() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health
+}
+
+// Collectors returns the gauge reporting whether the provider is up, to be registered
+// alongside the server metrics.
+func (h *HealthChecker) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "runebird_email_provider_up",
+				Help: "Whether the latest health check reached the email provider (1) or not (0)",
+			},
+			func() float64 {
+				if h.Health().Up {
+					return 1
+				}
+				return 0
+			},
+		),
+	}
+}
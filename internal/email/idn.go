@@ -0,0 +1,157 @@
+package email
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Punycode parameters from RFC 3492.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// needsSMTPUTF8 reports whether addr, a bare address, has a non-ASCII local part, which can
+// only be delivered with the SMTPUTF8 extension. A non-ASCII domain can be converted instead.
+func needsSMTPUTF8(addr string) bool {
+	local, _ := splitAddress(addr)
+	return !isASCII(local)
+}
+
+// asciiAddress converts the domain of addr, a bare address, to its ASCII form. ok is false if
+// the local part is not ASCII, in which case addr cannot be sent without SMTPUTF8.
+func asciiAddress(addr string) (ascii string, ok bool) {
+	if needsSMTPUTF8(addr) {
+		return addr, false
+	}
+	local, domain := splitAddress(addr)
+	return local + "@" + ASCIIDomain(domain), true
+}
+
+// asciiHeaderAddress is asciiAddress for an address as written in a header, with an optional
+// display name, which is kept.
+func asciiHeaderAddress(a string) (string, bool) {
+	if isASCII(a) {
+		return a, true
+	}
+	addr, err := mail.ParseAddress(a)
+	if err != nil {
+		return a, false
+	}
+	ascii, ok := asciiAddress(addr.Address)
+	if !ok {
+		return a, false
+	}
+	if addr.Name == "" {
+		return ascii, true
+	}
+	return (&mail.Address{Name: addr.Name, Address: ascii}).String(), true
+}
+
+// splitAddress splits addr at its last @ sign.
+func splitAddress(addr string) (local, domain string) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, ""
+	}
+	return addr[:at], addr[at+1:]
+}
+
+// ASCIIDomain returns the ASCII form of an internationalized domain name, with every
+// non-ASCII label lowercased and Punycode-encoded behind the xn-- prefix.
+func ASCIIDomain(domain string) string {
+	if isASCII(domain) {
+		return domain
+	}
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			labels[i] = "xn--" + punycode(strings.ToLower(label))
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// punycode encodes s as described in RFC 3492.
+func punycode(s string) string {
+	runes := []rune(s)
+	var out []byte
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(runes) {
+		m := rune(0x10FFFF)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
@@ -0,0 +1,336 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Attachment is a file sent along with an email. In JSON, Content is base64-encoded.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Content     []byte `json:"content"`
+}
+
+// Message is an email to be sent. If TextBody is empty, a plain-text alternative is derived
+// from HTMLBody. Headers holds extra header fields such as X-Campaign-ID. From, if set,
+// replaces the sender's configured from address. Bcc lists envelope-only recipients, which
+// appear neither in the message nor in its Result. Template names the template the message
+// was rendered from, if any, and ID identifies it in RuneBird's message log; neither is sent.
+// Profile names the delivery profile a Router sends the message through, the default one if
+// it is empty. A DryRun message is only delivered by a DryRunSender, which captures it instead.
+type Message struct {
+	ID          string
+	From        string
+	Recipients  []string
+	Bcc         []string
+	Template    string
+	Profile     string
+	Subject     string
+	HTMLBody    string
+	TextBody    string
+	ReplyTo     string
+	Headers     map[string]string
+	Attachments []Attachment
+	DryRun      bool
+}
+
+// sender returns the From address of the message, which is from unless the message sets one.
+func (m Message) sender(from string) string {
+	if m.From != "" {
+		return m.From
+	}
+	return from
+}
+
+// reservedHeaders are set by the sender and cannot be overridden through Message.Headers.
+var reservedHeaders = map[string]bool{
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"From":                      true,
+	"Sender":                    true,
+	"Subject":                   true,
+	"Reply-To":                  true,
+	"Message-Id":                true,
+	"Date":                      true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Content-Disposition":       true,
+}
+
+// ValidateHeaders checks a Reply-To address and custom header fields before they are written
+// into a message. Names must be valid RFC 5322 field names that the sender does not set itself,
+// and neither names nor values may contain line breaks, which would allow header injection.
+func ValidateHeaders(replyTo string, headers map[string]string) error {
+	if replyTo != "" {
+		if strings.ContainsAny(replyTo, "\r\n") {
+			return fmt.Errorf("reply-to address must not contain line breaks")
+		}
+		if _, err := mail.ParseAddress(replyTo); err != nil {
+			return fmt.Errorf("invalid reply-to address %q: %v", replyTo, err)
+		}
+	}
+	for name, value := range headers {
+		if name == "" {
+			return fmt.Errorf("header name must not be empty")
+		}
+		for _, c := range name {
+			if c < 33 || c > 126 || c == ':' {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+		}
+		if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("header %s cannot be set", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %s must not contain line breaks", name)
+		}
+	}
+	return nil
+}
+
+// writeHeader writes an unstructured header field such as Subject, encoding non-ASCII values
+// as RFC 2047 encoded-words. Line breaks are replaced by spaces.
+func writeHeader(w io.Writer, name, value string) {
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+	if !isASCII(value) {
+		value = mime.QEncoding.Encode("UTF-8", value)
+	}
+	foldHeader(w, name, value)
+}
+
+// writeAddressHeader writes an address list header field such as From or To. Non-ASCII display
+// names are encoded as RFC 2047 encoded-words; the addresses themselves are left as they are.
+func writeAddressHeader(w io.Writer, name string, addrs []string) {
+	formatted := make([]string, len(addrs))
+	for i, a := range addrs {
+		formatted[i] = a
+		if isASCII(a) {
+			continue
+		}
+		if addr, err := mail.ParseAddress(a); err == nil {
+			formatted[i] = addr.String()
+		}
+	}
+	foldHeader(w, name, strings.Join(formatted, ", "))
+}
+
+// foldHeader writes a header field, folding lines longer than 78 characters at spaces.
+func foldHeader(w io.Writer, name, value string) {
+	line := name + ":"
+	for _, word := range strings.Split(value, " ") {
+		// A word is moved to a continuation line even right after the field name if it fits
+		// there, which keeps long encoded-words within the line length limit.
+		if len(line)+1+len(word) > 78 && (len(line) > len(name)+1 || len(word) < 78) {
+			fmt.Fprintf(w, "%s\r\n", line)
+			line = ""
+		}
+		line += " " + word
+	}
+	fmt.Fprintf(w, "%s\r\n", line)
+}
+
+// AttachmentSize returns the total decoded size of the attachments in bytes.
+func AttachmentSize(attachments []Attachment) int {
+	total := 0
+	for _, a := range attachments {
+		total += len(a.Content)
+	}
+	return total
+}
+
+// ValidateAttachments checks that every attachment has a usable filename and content type.
+func ValidateAttachments(attachments []Attachment) error {
+	for i, a := range attachments {
+		if a.Filename == "" {
+			return fmt.Errorf("attachment %d has no filename", i)
+		}
+		if strings.ContainsAny(a.Filename, "\r\n\"/\\") {
+			return fmt.Errorf("attachment %d has an invalid filename %q", i, a.Filename)
+		}
+		if a.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(a.ContentType); err != nil {
+				return fmt.Errorf("attachment %s has an invalid content type %q: %v", a.Filename, a.ContentType, err)
+			}
+		}
+	}
+	return nil
+}
+
+// build renders msg as an RFC 5322 message. The body is a multipart/alternative of the plain
+// text and HTML versions; with attachments, that becomes the first part of a multipart/mixed.
+// If messageID is empty, the Message-ID header is left for the provider to add.
+func build(msg Message, from, messageID string) ([]byte, error) {
+	if err := ValidateAttachments(msg.Attachments); err != nil {
+		return nil, err
+	}
+	if err := ValidateHeaders(msg.ReplyTo, msg.Headers); err != nil {
+		return nil, err
+	}
+	text := msg.TextBody
+	if text == "" {
+		text = HTMLToText(msg.HTMLBody)
+	}
+
+	var alternative bytes.Buffer
+	contentType, err := writeAlternative(&alternative, text, msg.HTMLBody)
+	if err != nil {
+		return nil, err
+	}
+	body := &alternative
+	if len(msg.Attachments) > 0 {
+		body = &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(alternative.Bytes()); err != nil {
+			return nil, err
+		}
+		for _, a := range msg.Attachments {
+			contentType := a.ContentType
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {contentType},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+				"Content-Transfer-Encoding": {"base64"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			writeBase64(part, a.Content)
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+		contentType = mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()})
+	}
+
+	var buf bytes.Buffer
+	writeAddressHeader(&buf, "To", msg.Recipients)
+	writeAddressHeader(&buf, "From", []string{from})
+	writeHeader(&buf, "Subject", msg.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if messageID != "" {
+		fmt.Fprintf(&buf, "Message-ID: <%s>\r\n", messageID)
+	}
+	if msg.ReplyTo != "" {
+		writeAddressHeader(&buf, "Reply-To", []string{msg.ReplyTo})
+	}
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(&buf, name, msg.Headers[name])
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: %s\r\n\r\n", contentType)
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// newMessageID generates a globally unique Message-ID, without angle brackets, in domain. If
+// domain is empty, the domain of the from address is used.
+func newMessageID(domain, from string) string {
+	if domain == "" {
+		domain = "localhost"
+		if addr, err := mail.ParseAddress(from); err == nil {
+			if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+				domain = ASCIIDomain(addr.Address[at+1:])
+			}
+		}
+	}
+	random := make([]byte, 8)
+	_, _ = rand.Read(random)
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(random), domain)
+}
+
+// writeAlternative writes a multipart/alternative body with the plain text and HTML versions
+// of a message, in that order of preference, and returns its content type.
+func writeAlternative(w io.Writer, text, html string) (string, error) {
+	mw := multipart.NewWriter(w)
+	for _, p := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", text},
+		{"text/html; charset=UTF-8", html},
+	} {
+		encoding := transferEncoding(p.content)
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {encoding},
+		})
+		if err != nil {
+			return "", err
+		}
+		if encoding == "base64" {
+			writeBase64(part, []byte(p.content))
+			continue
+		}
+		qp := quotedprintable.NewWriter(part)
+		if _, err := io.WriteString(qp, p.content); err != nil {
+			return "", err
+		}
+		if err := qp.Close(); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}), nil
+}
+
+// transferEncoding returns the Content-Transfer-Encoding for a text body: quoted-printable,
+// which keeps mostly ASCII text readable, or base64 if more than a third of the bytes are
+// not ASCII, as in most non-Latin scripts, where quoted-printable would triple the size.
+func transferEncoding(content string) string {
+	nonASCII := 0
+	for i := 0; i < len(content); i++ {
+		if content[i] > 126 {
+			nonASCII++
+		}
+	}
+	if nonASCII*3 > len(content) {
+		return "base64"
+	}
+	return "quoted-printable"
+}
+
+// isASCII reports whether s has no bytes above the printable ASCII range and so needs no
+// encoding in a header.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeBase64 writes content base64-encoded in lines of 76 characters, as RFC 2045 requires.
+func writeBase64(w io.Writer, content []byte) {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		_, _ = w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	_, _ = w.Write([]byte(encoded + "\r\n"))
+}
@@ -0,0 +1,85 @@
+package email
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"runebird/internal/config"
+)
+
+// MetricsSender wraps a Sender to observe the time each send takes, including the retries of
+// the provider, and the size of each message offered to it, labelled with the template the
+// message was rendered from and the delivery provider, that of its delivery profile if it
+// names one.
+type MetricsSender struct {
+	next      Sender
+	provider  string
+	providers map[string]string
+	from      string
+	duration  *prometheus.HistogramVec
+	size      *prometheus.HistogramVec
+}
+
+// NewMetrics wraps next, the sender of the delivery provider, in a MetricsSender.
+func NewMetrics(next Sender, cfg *config.Config) Sender {
+	provider := cfg.Delivery.Provider
+	if provider == "" {
+		provider = "smtp"
+	}
+	providers := make(map[string]string, len(cfg.Delivery.Profiles))
+	for _, p := range cfg.Delivery.Profiles {
+		providers[p.Name] = p.Provider
+	}
+	return &MetricsSender{
+		next:      next,
+		provider:  provider,
+		providers: providers,
+		from:      cfg.SMTP.FromAddress,
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "runebird_send_duration_seconds",
+				Help:    "Time taken to send emails through the delivery provider, by outcome",
+				Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+			},
+			[]string{"template", "provider", "status"},
+		),
+		size: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "runebird_message_size_bytes",
+				Help:    "Size of the emails offered to the delivery provider, including headers and attachments",
+				Buckets: prometheus.ExponentialBuckets(1<<10, 4, 9),
+			},
+			[]string{"template", "provider"},
+		),
+	}
+}
+
+// SendMessage sends msg and observes its size and the duration and outcome of the send.
+func (s *MetricsSender) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	provider := s.provider
+	if p, ok := s.providers[msg.Profile]; ok {
+		provider = p
+	}
+	if size, err := MessageSize(msg, s.from); err == nil {
+		s.size.WithLabelValues(msg.Template, provider).Observe(float64(size))
+	}
+	start := time.Now()
+	result, err := s.next.SendMessage(ctx, msg)
+	status := "sent"
+	if err != nil {
+		status = "failed"
+	}
+	s.duration.WithLabelValues(msg.Template, provider, status).Observe(time.Since(start).Seconds())
+	return result, err
+}
+
+// Probe probes the wrapped sender.
+func (s *MetricsSender) Probe(ctx context.Context) error {
+	return s.next.Probe(ctx)
+}
+
+// Collectors returns the histograms along with the collectors of the wrapped sender.
+func (s *MetricsSender) Collectors() []prometheus.Collector {
+	return append([]prometheus.Collector{s.duration, s.size}, s.next.Collectors()...)
+}
@@ -0,0 +1,116 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sync"
+	"time"
+
+	"runebird/internal/config"
+)
+
+// tokenExpiryMargin is how long before its reported expiry an access token is refreshed, so
+// that a token does not expire in the middle of an SMTP conversation.
+const tokenExpiryMargin = time.Minute
+
+// tokenSource exchanges a refresh token for access tokens at an OAuth2 token endpoint and
+// caches each access token until shortly before it expires.
+type tokenSource struct {
+	cfg    config.OAuth2Config
+	http   *http.Client
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newTokenSource(cfg config.OAuth2Config) *tokenSource {
+	return &tokenSource{cfg: cfg, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Token returns a valid access token, refreshing it if needed.
+func (ts *tokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Now().Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {ts.cfg.RefreshToken},
+		"client_id":     {ts.cfg.ClientID},
+	}
+	if ts.cfg.ClientSecret != "" {
+		form.Set("client_secret", ts.cfg.ClientSecret)
+	}
+	resp, err := ts.http.PostForm(ts.cfg.TokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh OAuth2 token: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode OAuth2 token response (status %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", fmt.Errorf("failed to refresh OAuth2 token: status %d: %s %s", resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+
+	ts.token = body.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return ts.token, nil
+}
+
+// invalidate drops the cached access token so that the next call to Token refreshes it.
+func (ts *tokenSource) invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.token = ""
+}
+
+// xoauth2Auth implements smtp.Auth for the XOAUTH2 mechanism used by Gmail and Microsoft 365.
+type xoauth2Auth struct {
+	username string
+	tokens   *tokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like smtp.PlainAuth, refuse to send the bearer token over an unencrypted connection,
+	// except to a local server.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	token, err := a.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server rejected the token and sent a JSON error challenge. The token may have
+		// been revoked, so fetch a new one next time, and answer with an empty response to
+		// receive the final error reply.
+		a.tokens.invalidate()
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
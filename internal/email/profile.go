@@ -0,0 +1,432 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"runebird/internal/config"
+)
+
+const (
+	// defaultSendTimeout bounds a whole SMTP conversation, from dialing to QUIT, unless the
+	// profile configures its own, and every HTTP API request.
+	defaultSendTimeout = time.Minute
+	// defaultDialTimeout bounds connecting to an SMTP server unless the profile configures
+	// its own.
+	defaultDialTimeout = 10 * time.Second
+	// profileCooldown is how long a profile that failed to connect or authenticate is tried
+	// only after the healthy profiles.
+	profileCooldown = 30 * time.Second
+)
+
+// sessionError marks a failure to set up an SMTP session, before any message was offered,
+// which makes it safe to retry the message with another profile.
+type sessionError struct {
+	err error
+}
+
+func (e *sessionError) Error() string { return e.err.Error() }
+
+func (e *sessionError) Unwrap() error { return e.err }
+
+// profile is a single SMTP server the sender can deliver through, along with its health.
+type profile struct {
+	name        string
+	cfg         *config.SMTPConfig
+	envelope    string
+	dialTimeout time.Duration
+	sendTimeout time.Duration
+	tlsConfig   *tls.Config
+	sends       atomic.Int64
+	// mu guards auth, which changes when the credentials are renewed, and downUntil.
+	mu        sync.Mutex
+	auth      smtp.Auth
+	downUntil time.Time
+}
+
+// newAuth returns the authentication of the credentials in cfg.
+func newAuth(cfg *config.SMTPConfig) (smtp.Auth, error) {
+	switch cfg.AuthMethod {
+	case "", "plain":
+		if cfg.Password == "" {
+			return nil, fmt.Errorf("invalid SMTP configuration: missing required fields")
+		}
+		return smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host), nil
+	case "xoauth2":
+		if cfg.OAuth2.ClientID == "" || cfg.OAuth2.RefreshToken == "" || cfg.OAuth2.TokenURL == "" {
+			return nil, fmt.Errorf("invalid SMTP configuration: xoauth2 requires a client ID, refresh token and token URL")
+		}
+		return &xoauth2Auth{username: cfg.Username, tokens: newTokenSource(cfg.OAuth2)}, nil
+	default:
+		return nil, fmt.Errorf("invalid SMTP configuration: unknown auth method %s", cfg.AuthMethod)
+	}
+}
+
+// newProfile validates cfg and prepares its authentication and TLS settings. defaultName is
+// used if cfg does not name the profile.
+func newProfile(cfg *config.SMTPConfig, defaultName string) (*profile, error) {
+	if cfg.Host == "" || cfg.Port == 0 || cfg.Username == "" || cfg.FromAddress == "" {
+		return nil, fmt.Errorf("invalid SMTP configuration: missing required fields")
+	}
+
+	auth, err := newAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.Host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SMTP CA file %s: %v", cfg.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in SMTP CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = defaultName
+	}
+	// Bounces go to the envelope sender, which defaults to the bare address of the From header.
+	envelope := cfg.EnvelopeFrom
+	if envelope == "" {
+		envelope = cfg.FromAddress
+	}
+	addr, err := mail.ParseAddress(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP envelope sender %q: %v", envelope, err)
+	}
+	dialTimeout, sendTimeout := cfg.DialTimeout, cfg.SendTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	if sendTimeout == 0 {
+		sendTimeout = defaultSendTimeout
+	}
+	return &profile{
+		name:        name,
+		cfg:         cfg,
+		envelope:    addr.Address,
+		dialTimeout: dialTimeout,
+		sendTimeout: sendTimeout,
+		auth:        auth,
+		tlsConfig:   tlsConfig,
+	}, nil
+}
+
+// healthy reports whether the profile has not failed within the last cooldown.
+func (p *profile) healthy(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !now.Before(p.downUntil)
+}
+
+// failed marks the profile unhealthy for the cooldown after a session failure.
+func (p *profile) failed(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downUntil = now.Add(profileCooldown)
+}
+
+// succeeded counts a delivered email and marks the profile healthy again.
+func (p *profile) succeeded() {
+	p.sends.Add(1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downUntil = time.Time{}
+}
+
+// deliver runs one SMTP conversation for data. Depending on the TLS mode, the connection is
+// either plain, upgraded with STARTTLS before authenticating, or TLS from the start. Unlike
+// smtp.SendMail, starttls mode fails when the server does not offer STARTTLS instead of
+// silently sending in the clear. Failures up to and including authentication are returned
+// as a *sessionError.
+//
+// Recipients the server permanently refuses are reported in the result while the message is
+// delivered to the others; the send fails only if every recipient is refused, or if one is
+// refused temporarily, so that the message can be retried for all of them. Bcc recipients are
+// added to the envelope after the others. A permanent refusal of one is not reported, as it
+// must not show up in the result, but a temporary one fails the send like any other.
+//
+// data is msg built with messageID. Internationalized addresses are sent as they are if the
+// server supports SMTPUTF8, which smtp.Client then requests for the transaction. Otherwise
+// the message is rebuilt with their domains converted to ASCII, and recipients whose local
+// part is not ASCII are rejected, as there is no ASCII form for them.
+func (p *profile) deliver(ctx context.Context, msg Message, messageID string, data []byte) (Result, error) {
+	c, stop, err := p.connect(ctx)
+	if err != nil {
+		return Result{}, &sessionError{err: err}
+	}
+	defer func() {
+		stop()
+		_ = c.Close()
+	}()
+
+	var result Result
+	var refused error
+	envelope, recipients := p.envelope, msg.Recipients
+	if msg.From != "" && p.cfg.EnvelopeFrom == "" {
+		// Without a dedicated bounce address, bounces go to the overriding from address.
+		envelope = rcptAddress(msg.From)
+	}
+	from := msg.sender(p.cfg.FromAddress)
+	utf8, _ := c.Extension("SMTPUTF8")
+	if !utf8 && !isASCII(envelope+from+msg.ReplyTo+strings.Join(msg.Recipients, "")+strings.Join(msg.Bcc, "")) {
+		bounces := envelope
+		var ok bool
+		if envelope, ok = asciiAddress(bounces); !ok {
+			return Result{}, fmt.Errorf("envelope sender %s requires SMTPUTF8, which the server does not support", bounces)
+		}
+		if from, ok = asciiHeaderAddress(from); !ok {
+			return Result{}, fmt.Errorf("from address %s requires SMTPUTF8, which the server does not support", from)
+		}
+		msg, recipients, result.Rejected = asciiMessage(msg)
+		if len(result.Rejected) > 0 {
+			refused = &textproto.Error{Code: result.Rejected[0].Code, Msg: result.Rejected[0].Message}
+		}
+		if data, err = build(msg, from, messageID); err != nil {
+			return Result{}, err
+		}
+	}
+
+	if err := c.Mail(envelope); err != nil {
+		return Result{}, err
+	}
+	for i, rcpt := range msg.Recipients {
+		err := c.Rcpt(rcptAddress(rcpt))
+		var reply *textproto.Error
+		if errors.As(err, &reply) && reply.Code >= 500 {
+			result.Rejected = append(result.Rejected, Rejection{Recipient: recipients[i], Code: reply.Code, Message: reply.Msg})
+			refused = err
+			continue
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		result.Accepted = append(result.Accepted, recipients[i])
+	}
+	if len(result.Accepted) == 0 {
+		return Result{}, fmt.Errorf("all recipients were rejected: %w", refused)
+	}
+	for _, bcc := range msg.Bcc {
+		err := c.Rcpt(rcptAddress(bcc))
+		var reply *textproto.Error
+		if err != nil && !(errors.As(err, &reply) && reply.Code >= 500) {
+			return Result{}, err
+		}
+	}
+
+	// The DATA exchange is run on the underlying connection, since smtp.Client discards the
+	// server's reply to the message, which often carries the server's queue ID.
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return Result{}, err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return Result{}, err
+	}
+	w := c.Text.DotWriter()
+	if _, err := w.Write(data); err != nil {
+		return Result{}, err
+	}
+	if err := w.Close(); err != nil {
+		return Result{}, err
+	}
+	result.ResponseCode, result.Response, err = c.Text.ReadResponse(250)
+	if err != nil {
+		return Result{}, err
+	}
+	// The message has been accepted, so a failure to end the session no longer matters.
+	_ = c.Quit()
+	return result, nil
+}
+
+// asciiMessage prepares msg for a server without SMTPUTF8, converting internationalized
+// domains to ASCII. Recipients with a non-ASCII local part are left out of the message and
+// returned as rejections, except for Bcc recipients, which are dropped silently; recipients
+// lists the original form of the ones that are kept.
+func asciiMessage(msg Message) (ascii Message, recipients []string, rejected []Rejection) {
+	ascii = msg
+	ascii.Recipients = nil
+	for _, r := range msg.Recipients {
+		converted, ok := asciiHeaderAddress(r)
+		if !ok {
+			rejected = append(rejected, Rejection{Recipient: r, Code: 553, Message: "5.6.7 address requires SMTPUTF8, which the server does not support"})
+			continue
+		}
+		ascii.Recipients = append(ascii.Recipients, converted)
+		recipients = append(recipients, r)
+	}
+	ascii.Bcc = nil
+	for _, b := range msg.Bcc {
+		if converted, ok := asciiHeaderAddress(b); ok {
+			ascii.Bcc = append(ascii.Bcc, converted)
+		}
+	}
+	if converted, ok := asciiHeaderAddress(msg.ReplyTo); ok {
+		ascii.ReplyTo = converted
+	}
+	return ascii, recipients, rejected
+}
+
+// rcptAddress returns the bare address of a recipient, which may include a display name.
+func rcptAddress(recipient string) string {
+	if addr, err := mail.ParseAddress(recipient); err == nil {
+		return addr.Address
+	}
+	return recipient
+}
+
+// probe opens a session with the server and ends it after a NOOP.
+func (p *profile) probe(ctx context.Context) error {
+	c, stop, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	defer func() {
+		_ = c.Close()
+	}()
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// connect dials the server and returns an authenticated client. The conversation must finish
+// within the send timeout, and is aborted when ctx is done until the returned stop function
+// is called.
+func (p *profile) connect(ctx context.Context) (*smtp.Client, func() bool, error) {
+	addr := net.JoinHostPort(p.cfg.Host, fmt.Sprint(p.cfg.Port))
+	dialer := &net.Dialer{Timeout: p.dialTimeout}
+	var conn net.Conn
+	var err error
+	if p.cfg.TLSMode == "implicit" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: p.tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(p.sendTimeout))
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+
+	c, err := smtp.NewClient(conn, p.cfg.Host)
+	if err != nil {
+		stop()
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if err := p.handshake(c, addr); err != nil {
+		stop()
+		_ = c.Close()
+		return nil, nil, err
+	}
+	return c, stop, nil
+}
+
+// handshake greets the server, upgrades the connection as the TLS mode requires and
+// authenticates.
+func (p *profile) handshake(c *smtp.Client, addr string) error {
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	// An empty TLS mode is treated as starttls, the configured default.
+	if p.cfg.TLSMode == "" || p.cfg.TLSMode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server %s does not support STARTTLS", addr)
+		}
+		if err := c.StartTLS(p.tlsConfig); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	auth := p.auth
+	p.mu.Unlock()
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("server %s does not support AUTH", addr)
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collectors returns the Prometheus collectors describing the SMTP profiles, to be registered
+// alongside the server metrics. They describe the profiles in effect at each scrape.
+func (s *SMTPSender) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{newProfileCollector(s)}
+}
+
+// newProfileCollector returns the collector of the profiles of senders, which must have
+// distinct profile names.
+func newProfileCollector(senders ...*SMTPSender) *profileCollector {
+	return &profileCollector{
+		senders: senders,
+		sends: prometheus.NewDesc(
+			"runebird_smtp_sends_total",
+			"Total number of emails delivered through each SMTP profile",
+			[]string{"profile"}, nil,
+		),
+		healthy: prometheus.NewDesc(
+			"runebird_smtp_profile_healthy",
+			"Whether each SMTP profile is healthy (1) or cooling down after a connection or authentication failure (0)",
+			[]string{"profile"}, nil,
+		),
+	}
+}
+
+// profileCollector collects the send count and health of each profile of senders.
+type profileCollector struct {
+	senders []*SMTPSender
+	sends   *prometheus.Desc
+	healthy *prometheus.Desc
+}
+
+func (c *profileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sends
+	ch <- c.healthy
+}
+
+func (c *profileCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, sender := range c.senders {
+		profiles, _ := sender.settings()
+		for _, p := range profiles {
+			ch <- prometheus.MustNewConstMetric(c.sends, prometheus.CounterValue, float64(p.sends.Load()), p.name)
+			healthy := 0.0
+			if p.healthy(now) {
+				healthy = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.healthy, prometheus.GaugeValue, healthy, p.name)
+		}
+	}
+}
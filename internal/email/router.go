@@ -0,0 +1,97 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"runebird/internal/config"
+)
+
+// ErrUnknownProfile is wrapped by errors for messages naming a delivery profile that is not
+// configured.
+var ErrUnknownProfile = errors.New("unknown delivery profile")
+
+// Router sends each message through the sender of the delivery profile named by its Profile,
+// or through the default sender if it names none.
+type Router struct {
+	def      Sender
+	profiles map[string]Sender
+	// names lists the profiles in configured order, for probes.
+	names []string
+}
+
+// NewRouter creates a Router sending through def and the senders of profiles.
+func NewRouter(def Sender, profiles []config.DeliveryProfile) (*Router, error) {
+	r := &Router{def: def, profiles: make(map[string]Sender, len(profiles))}
+	for i := range profiles {
+		p := &profiles[i]
+		sender, err := newProvider(p.Provider, &p.SMTP, &p.SendGrid, &p.SES)
+		if err != nil {
+			return nil, fmt.Errorf("delivery profile %s: %v", p.Name, err)
+		}
+		r.profiles[p.Name] = sender
+		r.names = append(r.names, p.Name)
+	}
+	return r, nil
+}
+
+// Default returns the sender of messages naming no profile.
+func (r *Router) Default() Sender {
+	return r.def
+}
+
+// SendMessage sends msg through the sender of its profile.
+func (r *Router) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	if msg.Profile == "" {
+		return r.def.SendMessage(ctx, msg)
+	}
+	sender, ok := r.profiles[msg.Profile]
+	if !ok {
+		return Result{}, fmt.Errorf("%w %s", ErrUnknownProfile, msg.Profile)
+	}
+	return sender.SendMessage(ctx, msg)
+}
+
+// Probe probes the default sender and the sender of each profile, failing if any of them
+// fails.
+func (r *Router) Probe(ctx context.Context) error {
+	var errs []error
+	if err := r.def.Probe(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	for _, name := range r.names {
+		if err := r.profiles[name].Probe(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("delivery profile %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Collectors returns the collectors of the default sender and of the profiles. The SMTP
+// profiles of every sender are described by a single collector, as they share metrics.
+func (r *Router) Collectors() []prometheus.Collector {
+	var collectors []prometheus.Collector
+	var smtp []*SMTPSender
+	for _, sender := range append([]Sender{r.def}, r.senders()...) {
+		if s, ok := sender.(*SMTPSender); ok {
+			smtp = append(smtp, s)
+			continue
+		}
+		collectors = append(collectors, sender.Collectors()...)
+	}
+	if len(smtp) > 0 {
+		collectors = append(collectors, newProfileCollector(smtp...))
+	}
+	return collectors
+}
+
+// senders returns the senders of the profiles in configured order.
+func (r *Router) senders() []Sender {
+	senders := make([]Sender, 0, len(r.names))
+	for _, name := range r.names {
+		senders = append(senders, r.profiles[name])
+	}
+	return senders
+}
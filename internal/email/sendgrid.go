@@ -0,0 +1,212 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"runebird/internal/config"
+)
+
+// SendGridSender delivers emails through the SendGrid v3 mail/send API.
+type SendGridSender struct {
+	cfg  *config.SendGridConfig
+	from *mail.Address
+	http *http.Client
+}
+
+func NewSendGrid(cfg *config.SendGridConfig) (*SendGridSender, error) {
+	if cfg.APIKey == "" || cfg.FromAddress == "" || cfg.BaseURL == "" {
+		return nil, fmt.Errorf("invalid SendGrid configuration: missing required fields")
+	}
+	from, err := mail.ParseAddress(cfg.FromAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SendGrid from address %q: %v", cfg.FromAddress, err)
+	}
+	return &SendGridSender{
+		cfg:  cfg,
+		from: from,
+		http: &http.Client{Timeout: defaultSendTimeout},
+	}, nil
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     []byte `json:"content"`
+	Filename    string `json:"filename"`
+	Type        string `json:"type,omitempty"`
+	Disposition string `json:"disposition"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+// SendMessage sends msg with a single API request. Like the SMTP sender, all recipients share
+// one personalization, so each of them sees the others in the To header.
+func (s *SendGridSender) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	if len(msg.Recipients) == 0 {
+		return Result{}, fmt.Errorf("no recipients provided")
+	}
+	start := time.Now()
+	payload, err := s.request(msg)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to build email: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.cfg.BaseURL, "/")+"/v3/mail/send", bytes.NewReader(payload))
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to send email: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.cfg.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to send email: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return Result{}, fmt.Errorf("failed to send email: %w: SendGrid responded with status %d", ErrThrottled, resp.StatusCode)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Result{}, fmt.Errorf("failed to send email: SendGrid responded with status %d: %s", resp.StatusCode, sendGridError(resp.Body))
+	}
+	return Result{
+		Provider:     "sendgrid",
+		MessageID:    resp.Header.Get("X-Message-Id"),
+		Accepted:     msg.Recipients,
+		ResponseCode: resp.StatusCode,
+		Response:     http.StatusText(resp.StatusCode),
+		Duration:     time.Since(start),
+	}, nil
+}
+
+// Probe lists the scopes of the API key, which fails if SendGrid cannot be reached or the key
+// is not valid.
+func (s *SendGridSender) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(s.cfg.BaseURL, "/")+"/v3/scopes", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.cfg.APIKey)
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("SendGrid responded with status %d: %s", resp.StatusCode, sendGridError(resp.Body))
+	}
+	return nil
+}
+
+// request encodes msg as a mail/send request body.
+func (s *SendGridSender) request(msg Message) ([]byte, error) {
+	if err := ValidateAttachments(msg.Attachments); err != nil {
+		return nil, err
+	}
+	if err := ValidateHeaders(msg.ReplyTo, msg.Headers); err != nil {
+		return nil, err
+	}
+	text := msg.TextBody
+	if text == "" {
+		text = HTMLToText(msg.HTMLBody)
+	}
+
+	from := s.from
+	if msg.From != "" {
+		addr, err := mail.ParseAddress(msg.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from address %q: %v", msg.From, err)
+		}
+		from = addr
+	}
+	body := sendGridRequest{
+		From:    sendGridAddress{Email: from.Address, Name: from.Name},
+		Subject: msg.Subject,
+		Content: []sendGridContent{
+			{Type: "text/plain", Value: text},
+			{Type: "text/html", Value: msg.HTMLBody},
+		},
+		Headers: msg.Headers,
+	}
+	var to []sendGridAddress
+	for _, rcpt := range msg.Recipients {
+		to = append(to, sendGridAddress{Email: rcpt})
+	}
+	var bcc []sendGridAddress
+	for _, rcpt := range msg.Bcc {
+		bcc = append(bcc, sendGridAddress{Email: rcpt})
+	}
+	body.Personalizations = []sendGridPersonalization{{To: to, Bcc: bcc}}
+	if msg.ReplyTo != "" {
+		// ValidateHeaders has already checked that the address parses.
+		replyTo, _ := mail.ParseAddress(msg.ReplyTo)
+		body.ReplyTo = &sendGridAddress{Email: replyTo.Address, Name: replyTo.Name}
+	}
+	for _, a := range msg.Attachments {
+		body.Attachments = append(body.Attachments, sendGridAttachment{
+			Content:     a.Content,
+			Filename:    a.Filename,
+			Type:        a.ContentType,
+			Disposition: "attachment",
+		})
+	}
+	return json.Marshal(body)
+}
+
+// sendGridError extracts the error messages from a failed API response.
+func sendGridError(r io.Reader) string {
+	var body struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r, 64<<10)).Decode(&body); err != nil || len(body.Errors) == 0 {
+		return "no error details"
+	}
+	messages := make([]string, len(body.Errors))
+	for i, e := range body.Errors {
+		messages[i] = e.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Collectors returns no collectors; SendGrid sends are counted by the server metrics.
+func (s *SendGridSender) Collectors() []prometheus.Collector {
+	return nil
+}
@@ -0,0 +1,153 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"runebird/internal/config"
+	"runebird/internal/sigv4"
+)
+
+// SESSender delivers emails through the Amazon SES v2 SendEmail API. Messages are built like
+// SMTP messages and sent as raw content, so attachments and custom headers work unchanged.
+type SESSender struct {
+	cfg      *config.SESConfig
+	endpoint string
+	creds    sigv4.Credentials
+	http     *http.Client
+	now      func() time.Time
+}
+
+func NewSES(cfg *config.SESConfig) (*SESSender, error) {
+	if cfg.Region == "" || cfg.FromAddress == "" {
+		return nil, fmt.Errorf("invalid SES configuration: missing required fields")
+	}
+	creds := sigv4.Resolve(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken)
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("invalid SES configuration: no AWS credentials configured")
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://email.%s.amazonaws.com", cfg.Region)
+	}
+	return &SESSender{
+		cfg:      cfg,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    creds,
+		http:     &http.Client{Timeout: defaultSendTimeout},
+		now:      time.Now,
+	}, nil
+}
+
+type sesRequest struct {
+	FromEmailAddress string `json:"FromEmailAddress"`
+	Destination      struct {
+		ToAddresses  []string `json:"ToAddresses"`
+		BccAddresses []string `json:"BccAddresses,omitempty"`
+	} `json:"Destination"`
+	Content struct {
+		Raw struct {
+			Data []byte `json:"Data"`
+		} `json:"Raw"`
+	} `json:"Content"`
+	ConfigurationSetName string `json:"ConfigurationSetName,omitempty"`
+}
+
+// SendMessage sends msg and returns the SES message ID, which SES also reports in bounce and
+// complaint notifications.
+func (s *SESSender) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	if len(msg.Recipients) == 0 {
+		return Result{}, fmt.Errorf("no recipients provided")
+	}
+	start := time.Now()
+	// SES replaces the Message-ID header with its own, so none is generated here.
+	from := msg.sender(s.cfg.FromAddress)
+	data, err := build(msg, from, "")
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to build email: %v", err)
+	}
+
+	var body sesRequest
+	body.FromEmailAddress = from
+	body.Destination.ToAddresses = msg.Recipients
+	body.Destination.BccAddresses = msg.Bcc
+	body.Content.Raw.Data = data
+	body.ConfigurationSetName = s.cfg.ConfigurationSet
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to build email: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/v2/email/outbound-emails", bytes.NewReader(payload))
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to send email: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	sigv4.Sign(req, payload, s.creds, s.cfg.Region, "ses", s.now())
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to send email: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var reply struct {
+		MessageID string `json:"MessageId"`
+		Message   string `json:"message"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&reply)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return Result{}, fmt.Errorf("failed to send email: %w: SES responded with status %d: %s", ErrThrottled, resp.StatusCode, reply.Message)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Result{}, fmt.Errorf("failed to send email: SES responded with status %d: %s %s", resp.StatusCode, resp.Header.Get("X-Amzn-ErrorType"), reply.Message)
+	}
+	return Result{
+		Provider:     "ses",
+		MessageID:    reply.MessageID,
+		Accepted:     msg.Recipients,
+		ResponseCode: resp.StatusCode,
+		Response:     http.StatusText(resp.StatusCode),
+		Duration:     time.Since(start),
+	}, nil
+}
+
+// Probe fetches the SES account details, which fails if SES cannot be reached or the
+// credentials are not valid.
+func (s *SESSender) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpoint+"/v2/email/account", nil)
+	if err != nil {
+		return err
+	}
+	sigv4.Sign(req, nil, s.creds, s.cfg.Region, "ses", s.now())
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var reply struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&reply)
+		return fmt.Errorf("SES responded with status %d: %s %s", resp.StatusCode, resp.Header.Get("X-Amzn-ErrorType"), reply.Message)
+	}
+	return nil
+}
+
+// Collectors returns no collectors; SES sends are counted by the server metrics.
+func (s *SESSender) Collectors() []prometheus.Collector {
+	return nil
+}
@@ -0,0 +1,76 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"runebird/internal/config"
+)
+
+// ErrMessageTooLarge is wrapped by errors for messages over the configured maximum size.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// MessageSize returns the size in bytes of msg built with the given from address, including
+// its headers and encoded attachments.
+func MessageSize(msg Message, from string) (int, error) {
+	data, err := build(msg, msg.sender(from), newMessageID("", msg.sender(from)))
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// CheckSize returns an error wrapping ErrMessageTooLarge if msg built with the given from
+// address exceeds limit bytes. A limit of zero or less means no limit.
+func CheckSize(msg Message, from string, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	size, err := MessageSize(msg, from)
+	if err != nil {
+		return err
+	}
+	if size > limit {
+		return fmt.Errorf("%w: %d bytes exceeds the maximum of %d bytes", ErrMessageTooLarge, size, limit)
+	}
+	return nil
+}
+
+// SizeLimitSender wraps a Sender to refuse messages over the maximum size before they are
+// offered to the provider, which would otherwise reject them with a less helpful error such as
+// an SMTP 552 reply.
+type SizeLimitSender struct {
+	next  Sender
+	limit int
+	from  string
+}
+
+// NewSizeLimit wraps next in a SizeLimitSender enforcing server.max_message_size. It returns
+// next unchanged if there is no limit.
+func NewSizeLimit(next Sender, cfg *config.Config) Sender {
+	if cfg.Server.MaxMessageSize <= 0 {
+		return next
+	}
+	return &SizeLimitSender{next: next, limit: cfg.Server.MaxMessageSize, from: cfg.SMTP.FromAddress}
+}
+
+// SendMessage sends msg if it is within the maximum size. Otherwise it fails with a permanent
+// *SendError wrapping ErrMessageTooLarge, as the message would never be accepted.
+func (s *SizeLimitSender) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	if err := CheckSize(msg, s.from, s.limit); errors.Is(err, ErrMessageTooLarge) {
+		return Result{}, &SendError{Err: fmt.Errorf("failed to send email: %w", err)}
+	}
+	return s.next.SendMessage(ctx, msg)
+}
+
+// Probe probes the wrapped sender.
+func (s *SizeLimitSender) Probe(ctx context.Context) error {
+	return s.next.Probe(ctx)
+}
+
+// Collectors returns the collectors of the wrapped sender.
+func (s *SizeLimitSender) Collectors() []prometheus.Collector {
+	return s.next.Collectors()
+}
@@ -0,0 +1,251 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"runebird/internal/config"
+)
+
+// SMTPSender sends emails through the primary SMTP profile, failing over to the configured
+// fallbacks in order when a profile cannot be reached or refuses to authenticate.
+type SMTPSender struct {
+	// mu guards profiles and retry, which change when the configuration is reloaded.
+	mu       sync.RWMutex
+	profiles []*profile
+	retry    config.RetryConfig
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+func NewSMTP(cfg *config.SMTPConfig) (*SMTPSender, error) {
+	profiles, retry, err := newProfiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &SMTPSender{profiles: profiles, retry: retry, sleep: sleep}, nil
+}
+
+// newProfiles returns the primary and fallback profiles of cfg, and its retry policy.
+func newProfiles(cfg *config.SMTPConfig) ([]*profile, config.RetryConfig, error) {
+	primary, err := newProfile(cfg, "primary")
+	if err != nil {
+		return nil, config.RetryConfig{}, err
+	}
+	profiles := []*profile{primary}
+	for i := range cfg.Fallbacks {
+		fallback := cfg.Fallbacks[i]
+		if fallback.FromAddress == "" {
+			fallback.FromAddress = cfg.FromAddress
+		}
+		if fallback.EnvelopeFrom == "" {
+			fallback.EnvelopeFrom = cfg.EnvelopeFrom
+		}
+		p, err := newProfile(&fallback, fmt.Sprintf("fallback-%d", i+1))
+		if err != nil {
+			return nil, config.RetryConfig{}, fmt.Errorf("SMTP fallback %d: %v", i+1, err)
+		}
+		profiles = append(profiles, p)
+	}
+	retry := cfg.Retry
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	if retry.Multiplier < 1 {
+		retry.Multiplier = 1
+	}
+	return profiles, retry, nil
+}
+
+// settings returns the profiles and retry policy in effect.
+func (s *SMTPSender) settings() ([]*profile, config.RetryConfig) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.profiles, s.retry
+}
+
+// Reload replaces the profiles and retry policy with those of cfg, as on a configuration
+// reload, for the sends started from now on. Profiles keep their send count and cooldown
+// across the reload if they keep their name.
+func (s *SMTPSender) Reload(cfg *config.SMTPConfig) error {
+	profiles, retry, err := newProfiles(cfg)
+	if err != nil {
+		return err
+	}
+	previous, _ := s.settings()
+	for _, p := range profiles {
+		for _, old := range previous {
+			if old.name == p.name {
+				p.sends.Store(old.sends.Load())
+				old.mu.Lock()
+				p.downUntil = old.downUntil
+				old.mu.Unlock()
+			}
+		}
+	}
+	s.mu.Lock()
+	s.profiles, s.retry = profiles, retry
+	s.mu.Unlock()
+	return nil
+}
+
+// UpdateCredentials replaces the credentials of the profiles with those in cfg, as renewed from
+// Vault, for the sessions started from now on. cfg must have the profiles the sender has.
+func (s *SMTPSender) UpdateCredentials(cfg *config.SMTPConfig) error {
+	profiles, _ := s.settings()
+	if len(cfg.Fallbacks)+1 != len(profiles) {
+		return fmt.Errorf("SMTP configuration has %d profiles, the sender has %d", len(cfg.Fallbacks)+1, len(profiles))
+	}
+	auths := make([]smtp.Auth, 0, len(profiles))
+	for i, c := range append([]config.SMTPConfig{*cfg}, cfg.Fallbacks...) {
+		auth, err := newAuth(&c)
+		if err != nil {
+			return fmt.Errorf("SMTP profile %s: %v", profiles[i].name, err)
+		}
+		auths = append(auths, auth)
+	}
+	for i, p := range profiles {
+		p.mu.Lock()
+		p.auth = auths[i]
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// Send sends an HTML email to the given recipients.
+func (s *SMTPSender) Send(recipients []string, subject, htmlBody string) error {
+	_, err := s.SendMessage(context.Background(), Message{Recipients: recipients, Subject: subject, HTMLBody: htmlBody})
+	return err
+}
+
+// SendMessage sends msg, including any attachments. Transient failures, such as 4xx replies
+// and network errors, are retried with backoff up to the configured number of attempts; a
+// failed send returns a *SendError saying whether the last failure was transient. A send
+// cancelled through ctx is transient, as it was not refused by the server.
+func (s *SMTPSender) SendMessage(ctx context.Context, msg Message) (Result, error) {
+	if len(msg.Recipients) == 0 {
+		return Result{}, fmt.Errorf("no recipients provided")
+	}
+
+	profiles, retry := s.settings()
+	start := time.Now()
+	delay := retry.InitialDelay
+	for attempt := 1; ; attempt++ {
+		result, err := s.attempt(ctx, profiles, msg)
+		if err == nil {
+			result.Attempts = attempt
+			result.Duration = time.Since(start)
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return Result{}, &SendError{Err: fmt.Errorf("failed to send email: %w", ctx.Err()), Transient: true, Attempts: attempt}
+		}
+		if !err.Transient || attempt >= retry.MaxAttempts {
+			err.Attempts = attempt
+			return Result{}, err
+		}
+		if err := s.sleep(ctx, delay); err != nil {
+			return Result{}, &SendError{Err: fmt.Errorf("failed to send email: %w", err), Transient: true, Attempts: attempt}
+		}
+		delay = time.Duration(float64(delay) * retry.Multiplier)
+		if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+			delay = retry.MaxDelay
+		}
+	}
+}
+
+// attempt tries to send msg once. Healthy profiles are tried first, in configured order, and
+// profiles that recently failed last. Only connection and authentication failures move on to
+// the next profile; once a server has accepted the session, its answer to the message is
+// final. The failure is transient if any profile failed transiently.
+func (s *SMTPSender) attempt(ctx context.Context, profiles []*profile, msg Message) (Result, *SendError) {
+	var errs []error
+	isTransient := false
+	for _, p := range order(profiles, time.Now()) {
+		messageID := newMessageID(p.cfg.MessageIDDomain, msg.sender(p.cfg.FromAddress))
+		data, err := build(msg, msg.sender(p.cfg.FromAddress), messageID)
+		if err != nil {
+			return Result{}, &SendError{Err: fmt.Errorf("failed to build email: %v", err)}
+		}
+
+		result, err := p.deliver(ctx, msg, messageID, data)
+		if err == nil {
+			p.succeeded()
+			result.Provider = "smtp"
+			result.MessageID = messageID
+			return result, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.name, err))
+		isTransient = isTransient || transient(err)
+		var session *sessionError
+		if !errors.As(err, &session) || ctx.Err() != nil {
+			break
+		}
+		p.failed(time.Now())
+	}
+
+	err := errors.Join(errs...)
+	if isThrottle(err) {
+		return Result{}, &SendError{Err: fmt.Errorf("failed to send email: %w: %v", ErrThrottled, err), Transient: isTransient}
+	}
+	return Result{}, &SendError{Err: fmt.Errorf("failed to send email: %v", err), Transient: isTransient}
+}
+
+// Probe connects and authenticates to each profile in turn and checks the session with a
+// NOOP. The sender is healthy as long as one of its profiles is.
+func (s *SMTPSender) Probe(ctx context.Context) error {
+	var errs []error
+	profiles, _ := s.settings()
+	for _, p := range profiles {
+		err := p.probe(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// sleep waits for d, returning early with the context's error once ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// order returns the profiles to try for a send, healthy ones first.
+func order(profiles []*profile, now time.Time) []*profile {
+	ordered := make([]*profile, 0, len(profiles))
+	var down []*profile
+	for _, p := range profiles {
+		if p.healthy(now) {
+			ordered = append(ordered, p)
+		} else {
+			down = append(down, p)
+		}
+	}
+	return append(ordered, down...)
+}
+
+// transient reports whether err may succeed if the send is tried again later: a 4xx SMTP
+// reply, or a network failure such as a refused connection or a timeout. Other SMTP replies
+// and protocol errors, like a missing STARTTLS extension, are permanent.
+func transient(err error) bool {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code >= 400 && reply.Code < 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
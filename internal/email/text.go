@@ -0,0 +1,43 @@
+package email
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	hiddenElements = regexp.MustCompile(`(?is)<(head|style|script)\b.*?</(head|style|script)>`)
+	links          = regexp.MustCompile(`(?is)<a\b[^>]*\bhref\s*=\s*["']([^"']+)["'][^>]*>(.*?)</a>`)
+	lineBreaks     = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|h[1-6]|li|tr|table|blockquote)>`)
+	listItems      = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	tags           = regexp.MustCompile(`(?s)<[^>]*>`)
+	spaces         = regexp.MustCompile(`[ \t]+`)
+	blankLines     = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToText derives a plain-text version of an HTML body for clients that do not display
+// HTML. Block elements become line breaks, links keep their target in parentheses and all
+// other markup is dropped.
+func HTMLToText(body string) string {
+	text := hiddenElements.ReplaceAllString(body, "")
+	text = links.ReplaceAllStringFunc(text, func(link string) string {
+		m := links.FindStringSubmatch(link)
+		label := strings.TrimSpace(tags.ReplaceAllString(m[2], ""))
+		if label == "" || label == m[1] {
+			return m[1]
+		}
+		return label + " (" + m[1] + ")"
+	})
+	text = lineBreaks.ReplaceAllString(text, "\n")
+	text = listItems.ReplaceAllString(text, "- ")
+	text = tags.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(spaces.ReplaceAllString(line, " "))
+	}
+	text = strings.Join(lines, "\n")
+	return strings.TrimSpace(blankLines.ReplaceAllString(text, "\n\n"))
+}
@@ -0,0 +1,77 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+
+	"runebird/internal/config"
+)
+
+// UnsubscribeToken returns a token authenticating an unsubscribe request for recipients, so
+// that an unsubscribe link cannot be forged for other addresses. The order and case of the
+// addresses do not matter.
+func UnsubscribeToken(secret string, recipients []string) string {
+	addrs := make([]string, len(recipients))
+	for i, r := range recipients {
+		addrs[i] = strings.ToLower(strings.TrimSpace(r))
+	}
+	sort.Strings(addrs)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(addrs, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyUnsubscribeToken reports whether token was issued by UnsubscribeToken for recipients.
+func VerifyUnsubscribeToken(secret string, recipients []string, token string) bool {
+	return hmac.Equal([]byte(UnsubscribeToken(secret, recipients)), []byte(token))
+}
+
+// UnsubscribeURL returns the unsubscribe URL for an email to recipients: the configured URL
+// with the recipients as email parameters and their token as a token parameter.
+func UnsubscribeURL(cfg *config.UnsubscribeConfig, recipients []string) (string, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for _, r := range recipients {
+		query.Add("email", r)
+	}
+	query.Set("token", UnsubscribeToken(cfg.Secret, recipients))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// UnsubscribeHeaders returns the List-Unsubscribe header field for an email to recipients, with
+// a mailto and an https URL as configured. With an https URL, List-Unsubscribe-Post is added as
+// well to allow one-click unsubscribing as described in RFC 8058. The URL is that of
+// UnsubscribeURL.
+func UnsubscribeHeaders(cfg *config.UnsubscribeConfig, recipients []string) map[string]string {
+	var uris []string
+	if cfg.Mailto != "" {
+		subject := "unsubscribe"
+		if cfg.Secret != "" {
+			subject += " " + UnsubscribeToken(cfg.Secret, recipients)
+		}
+		uris = append(uris, "<mailto:"+cfg.Mailto+"?subject="+url.PathEscape(subject)+">")
+	}
+	if cfg.URL != "" {
+		if u, err := UnsubscribeURL(cfg, recipients); err == nil {
+			uris = append(uris, "<"+u+">")
+		}
+	}
+	if len(uris) == 0 {
+		return nil
+	}
+
+	headers := map[string]string{"List-Unsubscribe": strings.Join(uris, ", ")}
+	if cfg.URL != "" {
+		headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	}
+	return headers
+}
@@ -0,0 +1,259 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: emailer.proto
+
+package emailerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Emailer_Send_FullMethodName       = "/runebird.v1.Emailer/Send"
+	Emailer_Schedule_FullMethodName   = "/runebird.v1.Emailer/Schedule"
+	Emailer_ListTasks_FullMethodName  = "/runebird.v1.Emailer/ListTasks"
+	Emailer_CancelTask_FullMethodName = "/runebird.v1.Emailer/CancelTask"
+)
+
+// EmailerClient is the client API for Emailer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Emailer serves the sends, scheduled emails and task listings of the HTTP API to internal
+// services, with the same validation and errors: a request the HTTP API rejects with 400
+// fails with INVALID_ARGUMENT, invalid recipients are listed in a google.rpc.BadRequest
+// detail, and a request rejected by the rate limit fails with RESOURCE_EXHAUSTED and a
+// google.rpc.RetryInfo detail.
+type EmailerClient interface {
+	// Send sends an email now, or queues it if the rate limit is reached.
+	Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	// Schedule schedules an email to be sent at send_at.
+	Schedule(ctx context.Context, in *ScheduleRequest, opts ...grpc.CallOption) (*ScheduleResponse, error)
+	// ListTasks streams the scheduled emails matching the request, ordered by send time.
+	ListTasks(ctx context.Context, in *ListTasksRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Task], error)
+	// CancelTask cancels a pending scheduled email.
+	CancelTask(ctx context.Context, in *CancelTaskRequest, opts ...grpc.CallOption) (*Task, error)
+}
+
+type emailerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEmailerClient(cc grpc.ClientConnInterface) EmailerClient {
+	return &emailerClient{cc}
+}
+
+func (c *emailerClient) Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, Emailer_Send_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *emailerClient) Schedule(ctx context.Context, in *ScheduleRequest, opts ...grpc.CallOption) (*ScheduleResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ScheduleResponse)
+	err := c.cc.Invoke(ctx, Emailer_Schedule_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *emailerClient) ListTasks(ctx context.Context, in *ListTasksRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Task], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Emailer_ServiceDesc.Streams[0], Emailer_ListTasks_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ListTasksRequest, Task]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Emailer_ListTasksClient = grpc.ServerStreamingClient[Task]
+
+func (c *emailerClient) CancelTask(ctx context.Context, in *CancelTaskRequest, opts ...grpc.CallOption) (*Task, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Task)
+	err := c.cc.Invoke(ctx, Emailer_CancelTask_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EmailerServer is the server API for Emailer service.
+// All implementations must embed UnimplementedEmailerServer
+// for forward compatibility.
+//
+// Emailer serves the sends, scheduled emails and task listings of the HTTP API to internal
+// services, with the same validation and errors: a request the HTTP API rejects with 400
+// fails with INVALID_ARGUMENT, invalid recipients are listed in a google.rpc.BadRequest
+// detail, and a request rejected by the rate limit fails with RESOURCE_EXHAUSTED and a
+// google.rpc.RetryInfo detail.
+type EmailerServer interface {
+	// Send sends an email now, or queues it if the rate limit is reached.
+	Send(context.Context, *SendRequest) (*SendResponse, error)
+	// Schedule schedules an email to be sent at send_at.
+	Schedule(context.Context, *ScheduleRequest) (*ScheduleResponse, error)
+	// ListTasks streams the scheduled emails matching the request, ordered by send time.
+	ListTasks(*ListTasksRequest, grpc.ServerStreamingServer[Task]) error
+	// CancelTask cancels a pending scheduled email.
+	CancelTask(context.Context, *CancelTaskRequest) (*Task, error)
+	mustEmbedUnimplementedEmailerServer()
+}
+
+// UnimplementedEmailerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedEmailerServer struct{}
+
+func (UnimplementedEmailerServer) Send(context.Context, *SendRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
+}
+func (UnimplementedEmailerServer) Schedule(context.Context, *ScheduleRequest) (*ScheduleResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Schedule not implemented")
+}
+func (UnimplementedEmailerServer) ListTasks(*ListTasksRequest, grpc.ServerStreamingServer[Task]) error {
+	return status.Errorf(codes.Unimplemented, "method ListTasks not implemented")
+}
+func (UnimplementedEmailerServer) CancelTask(context.Context, *CancelTaskRequest) (*Task, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelTask not implemented")
+}
+func (UnimplementedEmailerServer) mustEmbedUnimplementedEmailerServer() {}
+func (UnimplementedEmailerServer) testEmbeddedByValue()                 {}
+
+// UnsafeEmailerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EmailerServer will
+// result in compilation errors.
+type UnsafeEmailerServer interface {
+	mustEmbedUnimplementedEmailerServer()
+}
+
+func RegisterEmailerServer(s grpc.ServiceRegistrar, srv EmailerServer) {
+	// If the following call pancis, it indicates UnimplementedEmailerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Emailer_ServiceDesc, srv)
+}
+
+func _Emailer_Send_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EmailerServer).Send(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Emailer_Send_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EmailerServer).Send(ctx, req.(*SendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Emailer_Schedule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScheduleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EmailerServer).Schedule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Emailer_Schedule_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EmailerServer).Schedule(ctx, req.(*ScheduleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Emailer_ListTasks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListTasksRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EmailerServer).ListTasks(m, &grpc.GenericServerStream[ListTasksRequest, Task]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Emailer_ListTasksServer = grpc.ServerStreamingServer[Task]
+
+func _Emailer_CancelTask_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelTaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EmailerServer).CancelTask(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Emailer_CancelTask_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EmailerServer).CancelTask(ctx, req.(*CancelTaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Emailer_ServiceDesc is the grpc.ServiceDesc for Emailer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Emailer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "runebird.v1.Emailer",
+	HandlerType: (*EmailerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Send",
+			Handler:    _Emailer_Send_Handler,
+		},
+		{
+			MethodName: "Schedule",
+			Handler:    _Emailer_Schedule_Handler,
+		},
+		{
+			MethodName: "CancelTask",
+			Handler:    _Emailer_CancelTask_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListTasks",
+			Handler:       _Emailer_ListTasks_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "emailer.proto",
+}
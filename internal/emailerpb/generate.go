@@ -0,0 +1,5 @@
+// Package emailerpb holds the protobuf definitions of the gRPC API, with the code generated
+// from them by protoc-gen-go and protoc-gen-go-grpc.
+package emailerpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative emailer.proto
@@ -10,22 +10,15 @@ import (
 
 type Logger struct {
 	*zap.Logger
+	level zap.AtomicLevel
 }
 
 func New(cfg *config.LoggingConfig) (*Logger, error) {
-	var level zapcore.Level
-	switch cfg.Level {
-	case "debug":
-		level = zapcore.DebugLevel
-	case "info":
-		level = zapcore.InfoLevel
-	case "warn":
-		level = zapcore.WarnLevel
-	case "error":
-		level = zapcore.ErrorLevel
-	default:
-		return nil, fmt.Errorf("invalid log level: %s", cfg.Level)
+	l, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
 	}
+	level := zap.NewAtomicLevelAt(l)
 
 	encoderCfg := zap.NewProductionEncoderConfig()
 	encoderCfg.TimeKey = "timestamp"
@@ -49,7 +42,36 @@ func New(cfg *config.LoggingConfig) (*Logger, error) {
 	core := zapcore.NewTee(cores...)
 
 	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
-	return &Logger{logger}, nil
+	return &Logger{Logger: logger, level: level}, nil
+}
+
+func parseLevel(level string) (zapcore.Level, error) {
+	switch level {
+	case "debug":
+		return zapcore.DebugLevel, nil
+	case "info":
+		return zapcore.InfoLevel, nil
+	case "warn":
+		return zapcore.WarnLevel, nil
+	case "error":
+		return zapcore.ErrorLevel, nil
+	default:
+		return 0, fmt.Errorf("invalid log level: %s", level)
+	}
+}
+
+// SetLevel changes the level of the entries logged from now on, as on a configuration reload.
+// Only loggers created by New have a level that can change.
+func (l *Logger) SetLevel(level string) error {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if l.level == (zap.AtomicLevel{}) {
+		return fmt.Errorf("log level cannot be changed")
+	}
+	l.level.SetLevel(lvl)
+	return nil
 }
 
 func (l *Logger) Close() error {
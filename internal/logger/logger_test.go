@@ -60,6 +60,25 @@ func TestNewLogger(t *testing.T) {
 		}
 	})
 
+	t.Run("SetLevel", func(t *testing.T) {
+		logger, err := New(&config.LoggingConfig{Level: "info"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if logger.Core().Enabled(zap.DebugLevel) {
+			t.Fatal("expected debug entries to be dropped at info level")
+		}
+		if err := logger.SetLevel("debug"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if !logger.Core().Enabled(zap.DebugLevel) {
+			t.Error("expected debug entries to be logged after SetLevel")
+		}
+		if err := logger.SetLevel("verbose"); err == nil {
+			t.Error("expected error for invalid log level, got none")
+		}
+	})
+
 	t.Run("InvalidFilePath", func(t *testing.T) {
 		cfg := &config.LoggingConfig{
 			Level:    "info",
@@ -0,0 +1,272 @@
+// Package messages records the lifecycle of every email RuneBird sends, from the request that
+// accepted it to its delivery or failure, so that the outcome of a send can be looked up by its
+// ID after the request returned.
+package messages
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"runebird/internal/email"
+	"runebird/internal/logger"
+)
+
+// ErrMessageNotFound is returned when no message with an ID is recorded, or its record expired.
+var ErrMessageNotFound = errors.New("message not found")
+
+// Status is a stage in the lifecycle of a message.
+type Status string
+
+const (
+	StatusAccepted   Status = "accepted"
+	StatusQueued     Status = "queued"
+	StatusSent       Status = "sent"
+	StatusFailed     Status = "failed"
+	StatusBounced    Status = "bounced"
+	StatusComplained Status = "complained"
+)
+
+// Event records when a message entered a status, with the provider's reply or the error that
+// caused it. Recipient names the recipient a bounce or complaint is about.
+type Event struct {
+	Status       Status    `json:"status"`
+	At           time.Time `json:"at"`
+	Recipient    string    `json:"recipient,omitempty"`
+	ResponseCode int       `json:"response_code,omitempty"`
+	Response     string    `json:"response,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Message is the record of an email. MessageID is the provider's ID for the email once sent,
+// and Provider, Accepted, Rejected, Suppressed, ResponseCode and Response describe its delivery as in
+// email.Result. Opens counts the times the tracking pixel of the email was loaded, and
+// RecipientOpens the opens of each recipient the pixel named. Clicks counts the times a tracked
+// link of the email was followed, LinkClicks the clicks on each link and RecipientClicks those
+// of each recipient the link named.
+type Message struct {
+	ID              string            `json:"id"`
+	Template        string            `json:"template,omitempty"`
+	Recipients      []string          `json:"recipients"`
+	Status          Status            `json:"status"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+	Provider        string            `json:"provider,omitempty"`
+	MessageID       string            `json:"message_id,omitempty"`
+	Accepted        []string          `json:"accepted,omitempty"`
+	Rejected        []email.Rejection `json:"rejected,omitempty"`
+	Suppressed      []string          `json:"suppressed,omitempty"`
+	ResponseCode    int               `json:"response_code,omitempty"`
+	Response        string            `json:"response,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Opens           int               `json:"opens,omitempty"`
+	RecipientOpens  map[string]int    `json:"recipient_opens,omitempty"`
+	LastOpenedAt    *time.Time        `json:"last_opened_at,omitempty"`
+	Clicks          int               `json:"clicks,omitempty"`
+	LinkClicks      map[string]int    `json:"link_clicks,omitempty"`
+	RecipientClicks map[string]int    `json:"recipient_clicks,omitempty"`
+	LastClickedAt   *time.Time        `json:"last_clicked_at,omitempty"`
+	Events          []Event           `json:"events"`
+}
+
+// Log records the lifecycle of messages in a Store. Messages without an ID are not recorded,
+// and a nil Log records nothing.
+type Log struct {
+	store     Store
+	logger    *logger.Logger
+	observers []func(Message, Event)
+	mu        sync.Mutex
+}
+
+func NewLog(store Store, log *logger.Logger) *Log {
+	return &Log{store: store, logger: log}
+}
+
+// Observe registers fn to be called with the record of a message and the event that changed it
+// every time a status is recorded. It must be called before the Log is used.
+func (l *Log) Observe(fn func(Message, Event)) {
+	l.observers = append(l.observers, fn)
+}
+
+// Accept records msg as accepted for sending.
+func (l *Log) Accept(msg email.Message) {
+	l.record(msg, Event{Status: StatusAccepted}, nil)
+}
+
+// Queue records that msg is waiting in the rate limit queue. A message put back on the queue
+// while it waits for tokens stays queued without another event.
+func (l *Log) Queue(msg email.Message) {
+	l.record(msg, Event{Status: StatusQueued}, nil)
+}
+
+// Sent records that msg was delivered to the provider as described by result.
+func (l *Log) Sent(msg email.Message, result email.Result) {
+	l.record(msg, Event{Status: StatusSent, ResponseCode: result.ResponseCode, Response: result.Response}, func(m *Message) {
+		m.Provider = result.Provider
+		m.MessageID = result.MessageID
+		m.Accepted = result.Accepted
+		m.Rejected = result.Rejected
+		m.Suppressed = result.Suppressed
+		m.ResponseCode = result.ResponseCode
+		m.Response = result.Response
+		m.Error = ""
+	})
+	// The provider's ID is indexed so that its bounce and complaint notifications can be
+	// traced to the message.
+	if l != nil && msg.ID != "" && result.MessageID != "" {
+		if err := l.store.Index(ProviderID(result.MessageID), msg.ID); err != nil {
+			l.logger.Error("Failed to index message", zap.String("id", msg.ID), zap.String("message_id", result.MessageID), zap.Error(err))
+		}
+	}
+}
+
+// Bounce records event, a bounce or a complaint, for the message the provider knows by
+// messageID, and returns the updated record.
+func (l *Log) Bounce(messageID string, event Event) (Message, error) {
+	if l == nil || messageID == "" {
+		return Message{}, ErrMessageNotFound
+	}
+	id, ok, err := l.store.Lookup(ProviderID(messageID))
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, ErrMessageNotFound
+	}
+	l.record(email.Message{ID: id}, event, nil)
+	return l.Get(id)
+}
+
+// ProviderID returns the provider's ID for a message in the form it is indexed under, without
+// the angle brackets of a Message-ID header.
+func ProviderID(messageID string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(messageID), "<"), ">")
+}
+
+// Fail records that sending msg failed with err. A later attempt may still send it.
+func (l *Log) Fail(msg email.Message, err error) {
+	l.record(msg, Event{Status: StatusFailed, Error: err.Error()}, func(m *Message) {
+		m.Error = err.Error()
+	})
+}
+
+// Open records that the email with the given ID was opened by recipient, or by a recipient it
+// cannot tell if recipient is empty or not one of the recipients of the email, and returns the
+// updated record. Opens are counted without an event, since an email can be opened many times.
+func (l *Log) Open(id, recipient string) (Message, error) {
+	return l.update(id, func(m *Message, now time.Time) {
+		m.Opens++
+		m.LastOpenedAt = &now
+		if slices.Contains(m.Recipients, recipient) {
+			m.RecipientOpens = increment(m.RecipientOpens, recipient)
+		}
+	})
+}
+
+// Click records that recipient followed the link to target in the email with the given ID, as
+// Open records opens.
+func (l *Log) Click(id, recipient, target string) (Message, error) {
+	return l.update(id, func(m *Message, now time.Time) {
+		m.Clicks++
+		m.LastClickedAt = &now
+		m.LinkClicks = increment(m.LinkClicks, target)
+		if slices.Contains(m.Recipients, recipient) {
+			m.RecipientClicks = increment(m.RecipientClicks, recipient)
+		}
+	})
+}
+
+// update applies fn to the record of the message with the given ID and saves it.
+func (l *Log) update(id string, fn func(m *Message, now time.Time)) (Message, error) {
+	if l == nil {
+		return Message{}, ErrMessageNotFound
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m, ok, err := l.store.Get(id)
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, ErrMessageNotFound
+	}
+	fn(&m, time.Now().UTC())
+	if err := l.store.Save(m); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// increment adds one to counts[key], creating counts if it is nil.
+func increment(counts map[string]int, key string) map[string]int {
+	if counts == nil {
+		counts = make(map[string]int)
+	}
+	counts[key]++
+	return counts
+}
+
+// Get returns the record of the message with the given ID.
+func (l *Log) Get(id string) (Message, error) {
+	if l == nil {
+		return Message{}, ErrMessageNotFound
+	}
+	msg, ok, err := l.store.Get(id)
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, ErrMessageNotFound
+	}
+	return msg, nil
+}
+
+// record adds event to the record of msg, creating it if msg was not recorded yet, as for the
+// emails of scheduled tasks, applies update to it and notifies the observers. Store errors are
+// logged rather than returned since the send itself is unaffected.
+func (l *Log) record(msg email.Message, event Event, update func(*Message)) {
+	if l == nil || msg.ID == "" {
+		return
+	}
+	m, event, ok := l.save(msg, event, update)
+	if !ok {
+		return
+	}
+	for _, fn := range l.observers {
+		fn(m, event)
+	}
+}
+
+// save adds event to the record of msg as record does, reporting false if the record was left
+// unchanged.
+func (l *Log) save(msg email.Message, event Event, update func(*Message)) (Message, Event, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UTC()
+	m, ok, err := l.store.Get(msg.ID)
+	if err != nil {
+		l.logger.Error("Failed to load message record", zap.String("id", msg.ID), zap.Error(err))
+		return Message{}, event, false
+	}
+	if !ok {
+		m = Message{ID: msg.ID, Template: msg.Template, Recipients: msg.Recipients, CreatedAt: now}
+	} else if m.Status == StatusQueued && event.Status == StatusQueued {
+		return Message{}, event, false
+	}
+	event.At = now
+	m.Status = event.Status
+	m.UpdatedAt = now
+	m.Events = append(m.Events, event)
+	if update != nil {
+		update(&m)
+	}
+	if err := l.store.Save(m); err != nil {
+		l.logger.Error("Failed to record message status", zap.String("id", msg.ID), zap.String("status", string(event.Status)), zap.Error(err))
+	}
+	return m, event, true
+}
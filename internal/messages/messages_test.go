@@ -0,0 +1,217 @@
+package messages
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+	"runebird/internal/config"
+	"runebird/internal/email"
+	"runebird/internal/logger"
+	"runebird/internal/rate"
+)
+
+// stubSender fails every send while err is set, and otherwise reports result.
+type stubSender struct {
+	result email.Result
+	err    error
+}
+
+func (s *stubSender) SendMessage(ctx context.Context, msg email.Message) (email.Result, error) {
+	return s.result, s.err
+}
+
+func (s *stubSender) Probe(ctx context.Context) error { return nil }
+
+func (s *stubSender) Collectors() []prometheus.Collector { return nil }
+
+func TestLog(t *testing.T) {
+	newLog := func(t *testing.T) *Log {
+		return NewLog(NewMemoryStore(time.Hour), &logger.Logger{Logger: zaptest.NewLogger(t)})
+	}
+	msg := email.Message{ID: "msg-1", Template: "welcome", Recipients: []string{"test@example.com"}}
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		log := newLog(t)
+		stub := &stubSender{err: errors.New("connection refused")}
+		sender := NewSender(stub, log)
+		queue := NewQueue(rate.NewMemoryQueue(), log)
+
+		log.Accept(msg)
+		if err := queue.Push(rate.EmailTask{ID: "queued-1", MessageID: msg.ID, Recipients: msg.Recipients}); err != nil {
+			t.Fatalf("failed to queue: %v", err)
+		}
+		if err := queue.Push(rate.EmailTask{ID: "queued-1", MessageID: msg.ID, Recipients: msg.Recipients}); err != nil {
+			t.Fatalf("failed to requeue: %v", err)
+		}
+		if _, err := sender.SendMessage(context.Background(), msg); err == nil {
+			t.Fatal("expected the send to fail")
+		}
+		stub.result, stub.err = email.Result{Provider: "smtp", MessageID: "<1@example.com>", ResponseCode: 250, Response: "2.0.0 OK"}, nil
+		if _, err := sender.SendMessage(context.Background(), msg); err != nil {
+			t.Fatalf("expected the send to succeed, got: %v", err)
+		}
+
+		got, err := log.Get(msg.ID)
+		if err != nil {
+			t.Fatalf("expected the message to be recorded, got: %v", err)
+		}
+		var statuses []Status
+		for _, event := range got.Events {
+			statuses = append(statuses, event.Status)
+		}
+		want := []Status{StatusAccepted, StatusQueued, StatusFailed, StatusSent}
+		if len(statuses) != len(want) {
+			t.Fatalf("expected events %v, got: %v", want, statuses)
+		}
+		for i := range want {
+			if statuses[i] != want[i] {
+				t.Fatalf("expected events %v, got: %v", want, statuses)
+			}
+		}
+		if got.Status != StatusSent || got.MessageID != "<1@example.com>" || got.ResponseCode != 250 || got.Error != "" {
+			t.Errorf("expected the delivery of the last attempt, got: %+v", got)
+		}
+		if got.Template != "welcome" {
+			t.Errorf("expected the template of the accepted message, got: %q", got.Template)
+		}
+	})
+
+	t.Run("QueueFlushedOnShutdown", func(t *testing.T) {
+		log := newLog(t)
+		sender := NewSender(&stubSender{result: email.Result{Provider: "smtp"}}, log)
+		limits := &config.RateLimitConfig{PerHour: 3600, Burst: 1}
+		limiter, err := rate.New(limits, log.logger, sender, NewQueue(rate.NewMemoryQueue(), log), rate.NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("failed to create rate limiter: %v", err)
+		}
+		if err := limiter.QueueEmail("welcome", msg, rate.PriorityNormal); err != nil {
+			t.Fatalf("failed to queue: %v", err)
+		}
+		limiter.Start()
+
+		// The wrapped memory queue is still flushed, rather than dropped, on shutdown.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		limiter.Shutdown(ctx)
+		if sent := limiter.QueuedSent(); sent != 1 || limiter.QueueLen() != 0 {
+			t.Errorf("expected the queued email to be sent on shutdown, got %d sent and %d left", sent, limiter.QueueLen())
+		}
+		if got, err := log.Get(msg.ID); err != nil || got.Status != StatusSent {
+			t.Errorf("expected the flushed email to be recorded as sent, got: %+v (%v)", got, err)
+		}
+	})
+
+	t.Run("RecordedOnFirstSend", func(t *testing.T) {
+		log := newLog(t)
+		if _, err := NewSender(&stubSender{}, log).SendMessage(context.Background(), msg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		got, err := log.Get(msg.ID)
+		if err != nil || got.Status != StatusSent || len(got.Events) != 1 {
+			t.Errorf("expected a sent message with one event, got: %+v (%v)", got, err)
+		}
+	})
+
+	t.Run("WithoutID", func(t *testing.T) {
+		log := newLog(t)
+		log.Accept(email.Message{Recipients: msg.Recipients})
+		if _, err := log.Get(""); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("expected a message without an ID not to be recorded, got: %v", err)
+		}
+	})
+
+	t.Run("Observers", func(t *testing.T) {
+		log := newLog(t)
+		var statuses []Status
+		log.Observe(func(m Message, event Event) {
+			if m.ID != msg.ID || m.Status != event.Status {
+				t.Errorf("expected the message as of the event, got: %+v for %+v", m, event)
+			}
+			statuses = append(statuses, event.Status)
+		})
+		log.Accept(msg)
+		if _, err := NewSender(&stubSender{}, log).SendMessage(context.Background(), msg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(statuses) != 2 || statuses[0] != StatusAccepted || statuses[1] != StatusSent {
+			t.Errorf("expected the observer to see every event, got: %v", statuses)
+		}
+	})
+
+	t.Run("Opens", func(t *testing.T) {
+		log := newLog(t)
+		if _, err := log.Open(msg.ID, "test@example.com"); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("expected %v for an unrecorded message, got: %v", ErrMessageNotFound, err)
+		}
+		log.Accept(msg)
+		for _, recipient := range []string{"test@example.com", "test@example.com", "", "other@example.com"} {
+			if _, err := log.Open(msg.ID, recipient); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+		got, err := log.Get(msg.ID)
+		if err != nil || got.Opens != 4 || got.LastOpenedAt == nil || len(got.Events) != 1 {
+			t.Fatalf("expected four opens without events, got: %+v (%v)", got, err)
+		}
+		if len(got.RecipientOpens) != 1 || got.RecipientOpens["test@example.com"] != 2 {
+			t.Errorf("expected opens counted for the recipient of the message only, got: %v", got.RecipientOpens)
+		}
+	})
+
+	t.Run("Clicks", func(t *testing.T) {
+		log := newLog(t)
+		log.Accept(msg)
+		for _, recipient := range []string{"test@example.com", ""} {
+			if _, err := log.Click(msg.ID, recipient, "https://example.com/"); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+		got, err := log.Click(msg.ID, "test@example.com", "https://example.com/shop")
+		if err != nil || got.Clicks != 3 || got.LastClickedAt == nil || got.Opens != 0 {
+			t.Fatalf("expected three clicks, got: %+v (%v)", got, err)
+		}
+		if got.LinkClicks["https://example.com/"] != 2 || got.LinkClicks["https://example.com/shop"] != 1 || got.RecipientClicks["test@example.com"] != 2 {
+			t.Errorf("expected clicks counted per link and recipient, got: %v and %v", got.LinkClicks, got.RecipientClicks)
+		}
+	})
+
+	t.Run("Bounce", func(t *testing.T) {
+		log := newLog(t)
+		if _, err := NewSender(&stubSender{result: email.Result{MessageID: "<1@example.com>"}}, log).SendMessage(context.Background(), msg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := log.Bounce("2@example.com", Event{Status: StatusBounced}); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("expected %v for an unknown provider ID, got: %v", ErrMessageNotFound, err)
+		}
+		got, err := log.Bounce("1@example.com", Event{Status: StatusBounced, Recipient: "test@example.com", Response: "550 user unknown"})
+		if err != nil || got.ID != msg.ID || got.Status != StatusBounced || len(got.Events) != 2 || got.Events[1].Recipient != "test@example.com" {
+			t.Errorf("expected the bounce to be recorded on the message sent with the provider ID, got: %+v (%v)", got, err)
+		}
+	})
+
+	t.Run("NilLog", func(t *testing.T) {
+		var log *Log
+		log.Accept(msg)
+		if _, err := log.Get(msg.ID); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("expected %v, got: %v", ErrMessageNotFound, err)
+		}
+	})
+
+	t.Run("Retention", func(t *testing.T) {
+		store := NewMemoryStore(10 * time.Millisecond)
+		if err := store.Save(Message{ID: "msg-1"}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, ok, _ := store.Get("msg-1"); !ok {
+			t.Fatal("expected the message to be kept within the retention period")
+		}
+		time.Sleep(20 * time.Millisecond)
+		if _, ok, _ := store.Get("msg-1"); ok {
+			t.Error("expected the message to expire after the retention period")
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package messages
+
+import (
+	"sync"
+	"time"
+)
+
+// Store persists message records, each for the retention period of the store after it was
+// last saved.
+type Store interface {
+	// Get returns the record of the message with the given ID, or false if there is none.
+	Get(id string) (Message, bool, error)
+	// Save stores msg, replacing any record with the same ID.
+	Save(msg Message) error
+	// Index records that the provider knows the message with the given ID by messageID, for as
+	// long as the record of the message is kept.
+	Index(messageID, id string) error
+	// Lookup returns the ID of the message the provider knows by messageID, or false if there is
+	// none.
+	Lookup(messageID string) (string, bool, error)
+}
+
+type memoryEntry struct {
+	msg       Message
+	expiresAt time.Time
+	// indexed are the provider's IDs for the message, dropped along with it.
+	indexed []string
+}
+
+type expiringID struct {
+	id string
+	at time.Time
+}
+
+type memoryStore struct {
+	messages  map[string]*memoryEntry
+	index     map[string]string
+	expiry    []expiringID
+	retention time.Duration
+	mu        sync.Mutex
+}
+
+// NewMemoryStore creates a Store that keeps message records in process memory for the given
+// retention period.
+func NewMemoryStore(retention time.Duration) Store {
+	return &memoryStore{messages: make(map[string]*memoryEntry), index: make(map[string]string), retention: retention}
+}
+
+func (m *memoryStore) Get(id string) (Message, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prune(time.Now())
+	entry, ok := m.messages[id]
+	if !ok {
+		return Message{}, false, nil
+	}
+	return entry.msg, true, nil
+}
+
+func (m *memoryStore) Save(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.prune(now)
+	expiresAt := now.Add(m.retention)
+	entry := &memoryEntry{msg: msg, expiresAt: expiresAt}
+	if prev, ok := m.messages[msg.ID]; ok {
+		entry.indexed = prev.indexed
+	}
+	m.messages[msg.ID] = entry
+	m.expiry = append(m.expiry, expiringID{id: msg.ID, at: expiresAt})
+	return nil
+}
+
+func (m *memoryStore) Index(messageID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prune(time.Now())
+	entry, ok := m.messages[id]
+	if !ok {
+		return nil
+	}
+	entry.indexed = append(entry.indexed, messageID)
+	m.index[messageID] = id
+	return nil
+}
+
+func (m *memoryStore) Lookup(messageID string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prune(time.Now())
+	id, ok := m.index[messageID]
+	return id, ok, nil
+}
+
+// prune drops the records that expired by now. A record saved again since an expiry was
+// queued for it is kept until its latest expiry.
+func (m *memoryStore) prune(now time.Time) {
+	for len(m.expiry) > 0 && !m.expiry[0].at.After(now) {
+		next := m.expiry[0]
+		m.expiry = m.expiry[1:]
+		if entry, ok := m.messages[next.id]; ok && !entry.expiresAt.After(now) {
+			delete(m.messages, next.id)
+			for _, messageID := range entry.indexed {
+				delete(m.index, messageID)
+			}
+		}
+	}
+}
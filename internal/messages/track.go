@@ -0,0 +1,66 @@
+package messages
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"runebird/internal/email"
+	"runebird/internal/rate"
+)
+
+// Sender wraps an email.Sender to record the outcome of every send in a Log, whichever of
+// the server, the scheduler or the rate limit queue sends the message.
+type Sender struct {
+	next email.Sender
+	log  *Log
+}
+
+// NewSender wraps next in a Sender recording sends in log.
+func NewSender(next email.Sender, log *Log) email.Sender {
+	return &Sender{next: next, log: log}
+}
+
+// SendMessage sends msg and records whether it was sent or failed.
+func (s *Sender) SendMessage(ctx context.Context, msg email.Message) (email.Result, error) {
+	result, err := s.next.SendMessage(ctx, msg)
+	if err != nil {
+		// A send abandoned on shutdown is retried later, so it is not a failure of the message.
+		if ctx.Err() == nil {
+			s.log.Fail(msg, err)
+		}
+		return result, err
+	}
+	s.log.Sent(msg, result)
+	return result, nil
+}
+
+// Probe probes the wrapped sender.
+func (s *Sender) Probe(ctx context.Context) error {
+	return s.next.Probe(ctx)
+}
+
+// Collectors returns the collectors of the wrapped sender.
+func (s *Sender) Collectors() []prometheus.Collector {
+	return s.next.Collectors()
+}
+
+// queue wraps a rate.Queue to record every message pushed onto it, including retries, as
+// queued. Its other methods are those of the wrapped queue, so that whether the queue is
+// persistent, and must be flushed on shutdown, is still known.
+type queue struct {
+	rate.Queue
+	log *Log
+}
+
+// NewQueue wraps next in a rate.Queue recording queued messages in log.
+func NewQueue(next rate.Queue, log *Log) rate.Queue {
+	return &queue{Queue: next, log: log}
+}
+
+func (q *queue) Push(task rate.EmailTask) error {
+	if err := q.Queue.Push(task); err != nil {
+		return err
+	}
+	q.log.Queue(email.Message{ID: task.MessageID, Template: task.Template, Recipients: task.Recipients})
+	return nil
+}
@@ -0,0 +1,128 @@
+package rate
+
+import (
+	"sync"
+	"time"
+
+	"runebird/internal/config"
+)
+
+// Circuit breaker states, as reported by BreakerState.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// breaker stops sends after the email provider has failed repeatedly, so that an unreachable
+// server is not hammered with attempts. It opens after threshold consecutive failures and holds
+// every send for the cooldown. It then half-opens and lets a single trial send through: if the
+// trial succeeds the breaker closes, and if it fails the breaker opens for another cooldown. A
+// trial whose outcome is never reported is replaced by a new one after a cooldown. A nil
+// breaker never holds sends.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	until     time.Time
+	mu        sync.Mutex
+}
+
+// newBreaker creates a breaker for cfg, or returns nil if the circuit breaker is disabled.
+func newBreaker(cfg *config.RateLimitConfig) *breaker {
+	if !cfg.CircuitBreaker.Enabled {
+		return nil
+	}
+	return &breaker{
+		threshold: cfg.CircuitBreaker.Failures,
+		cooldown:  cfg.CircuitBreaker.Cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+// allow reports whether a send may go ahead. Once the cooldown of an open breaker has passed,
+// the first caller is allowed through as the trial.
+func (b *breaker) allow(now time.Time) bool {
+	ok, _ := b.begin(now)
+	return ok
+}
+
+// begin is allow, also reporting whether the send allowed is the trial, which cancelTrial
+// withdraws if the send does not go ahead after all.
+func (b *breaker) begin(now time.Time) (ok, trial bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerClosed {
+		return true, false
+	}
+	if now.Before(b.until) {
+		return false, false
+	}
+	b.state = BreakerHalfOpen
+	b.until = now.Add(b.cooldown)
+	return true, true
+}
+
+// cancelTrial withdraws the trial begun at now that was not sent, such as for lack of tokens,
+// so that the next caller may make the trial instead of waiting for another cooldown.
+func (b *breaker) cancelTrial(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.state = BreakerOpen
+		b.until = now
+	}
+}
+
+// failure counts a failed send and reports whether it opened the breaker.
+func (b *breaker) failure(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == BreakerClosed && b.failures < b.threshold {
+		return false
+	}
+	opened := b.state != BreakerOpen
+	b.state = BreakerOpen
+	b.until = now.Add(b.cooldown)
+	return opened
+}
+
+// success resets the failure count and reports whether it closed the breaker.
+func (b *breaker) success() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	closed := b.state != BreakerClosed
+	b.failures = 0
+	b.state = BreakerClosed
+	return closed
+}
+
+// status returns the state of the breaker and, unless it is closed, when the next trial send
+// is allowed.
+func (b *breaker) status() (string, time.Time) {
+	if b == nil {
+		return BreakerClosed, time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerClosed {
+		return BreakerClosed, time.Time{}
+	}
+	return b.state, b.until
+}
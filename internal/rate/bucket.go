@@ -0,0 +1,129 @@
+package rate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"runebird/internal/config"
+)
+
+// Bucket is the token bucket that paces sends. Implementations may share their tokens
+// between several RuneBird instances so that the configured rate is honoured cluster-wide.
+type Bucket interface {
+	// Take removes n tokens if they are available at now and reports whether it did. More
+	// tokens than the burst size are taken once the bucket is full, leaving it in debt for the
+	// rest, which is refilled before any more tokens can be taken.
+	Take(now time.Time, n int) (bool, error)
+	// Wait blocks until n tokens are available and removes them, or until ctx is done.
+	Wait(ctx context.Context, n int) error
+	// Tokens estimates the number of tokens available at now without taking any.
+	Tokens(now time.Time) (float64, error)
+}
+
+// BucketState is a snapshot of a token bucket: the tokens it held at a point in time.
+type BucketState struct {
+	Tokens float64   `json:"tokens"`
+	At     time.Time `json:"at"`
+}
+
+// BucketStore saves token bucket snapshots so that a restart does not hand out a fresh burst.
+type BucketStore interface {
+	// Save replaces the stored snapshot.
+	Save(state BucketState) error
+	// Load returns the stored snapshot, or false if none has been saved.
+	Load() (BucketState, bool, error)
+}
+
+// Resizer is implemented by buckets whose refill rate and capacity can change while they are
+// in use, to perHour tokens per hour up to burst tokens.
+type Resizer interface {
+	Resize(perHour, burst int)
+}
+
+// snapshotter is implemented by buckets that keep their state in process memory and can save
+// it to a BucketStore.
+type snapshotter interface {
+	snapshot(now time.Time) error
+}
+
+type memoryBucket struct {
+	limiter *rate.Limiter
+	store   BucketStore
+	// mu makes checking and taking the tokens of a take over the burst size atomic.
+	mu sync.Mutex
+}
+
+// NewMemoryBucket creates a Bucket that keeps its tokens in process memory, refilling at
+// cfg.PerHour tokens per hour up to cfg.Burst tokens.
+func NewMemoryBucket(cfg *config.RateLimitConfig) Bucket {
+	// Calculate rate per second from per hour limit
+	ratePerSecond := float64(cfg.PerHour) / 3600.0
+	return &memoryBucket{limiter: rate.NewLimiter(rate.Limit(ratePerSecond), cfg.Burst)}
+}
+
+// NewPersistentBucket creates a memory bucket like NewMemoryBucket, restored from the snapshot in
+// store if there is one. The limiter saves the bucket back to store while it runs and when it
+// stops.
+func NewPersistentBucket(cfg *config.RateLimitConfig, store BucketStore) (Bucket, error) {
+	b := NewMemoryBucket(cfg).(*memoryBucket)
+	b.store = store
+
+	state, ok, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rate limit bucket state: %v", err)
+	}
+	if ok {
+		// Spend the tokens that were missing at the time of the snapshot; the limiter then
+		// refills them from that time onwards. Partial tokens are rounded against the caller.
+		if used := cfg.Burst - int(math.Floor(state.Tokens)); used > 0 {
+			reserveN(b.limiter, state.At, used)
+		}
+	}
+	return b, nil
+}
+
+func (b *memoryBucket) Take(now time.Time, n int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if burst := b.limiter.Burst(); n > burst {
+		if b.limiter.TokensAt(now) < float64(burst) {
+			return false, nil
+		}
+		reserveN(b.limiter, now, n)
+		return true, nil
+	}
+	return b.limiter.AllowN(now, n), nil
+}
+
+// reserveN takes n tokens from limiter at now whether or not they are available, leaving it in
+// debt for those missing. The tokens are reserved in chunks of at most the burst size, as
+// limiter refuses larger reservations.
+func reserveN(limiter *rate.Limiter, now time.Time, n int) {
+	for burst := limiter.Burst(); n > 0 && burst > 0; n -= burst {
+		limiter.ReserveN(now, min(n, burst))
+	}
+}
+
+func (b *memoryBucket) Wait(ctx context.Context, n int) error {
+	return b.limiter.WaitN(ctx, n)
+}
+
+func (b *memoryBucket) Tokens(now time.Time) (float64, error) {
+	return b.limiter.TokensAt(now), nil
+}
+
+func (b *memoryBucket) Resize(perHour, burst int) {
+	b.limiter.SetLimit(rate.Limit(float64(perHour) / 3600.0))
+	b.limiter.SetBurst(burst)
+}
+
+func (b *memoryBucket) snapshot(now time.Time) error {
+	if b.store == nil {
+		return nil
+	}
+	return b.store.Save(BucketState{Tokens: b.limiter.TokensAt(now), At: now})
+}
@@ -0,0 +1,80 @@
+package rate
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// newDeferralWait creates the histogram of how long queued emails waited before a send attempt,
+// with buckets from one second to a few days to cover both rate limit and send window delays.
+func newDeferralWait() prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "runebird_deferral_wait_seconds",
+		Help:    "Time queued emails waited before a send attempt",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	})
+}
+
+// Collectors returns the Prometheus collectors describing the limiter, to be registered
+// alongside the server metrics.
+func (l *Limiter) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "runebird_queue_depth",
+				Help: "Number of rate-limited emails waiting in the queue, including spilled emails",
+			},
+			func() float64 { return float64(l.QueueLen()) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "runebird_rate_limit_tokens",
+				Help: "Estimated number of rate limit tokens currently available",
+			},
+			func() float64 { return l.Tokens() },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "runebird_rate_limit_factor",
+				Help: "Fraction of the configured send rate in effect after adaptive throttling",
+			},
+			l.RateFactor,
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "runebird_circuit_breaker_open",
+				Help: "Whether the circuit breaker is holding sends (1), including while a trial send is made, or not (0)",
+			},
+			func() float64 {
+				if l.BreakerState() == BreakerClosed {
+					return 0
+				}
+				return 1
+			},
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "runebird_emails_deferred_total",
+				Help: "Total number of emails deferred to the queue by the rate limit, quotas or send window",
+			},
+			func() float64 { return float64(l.Deferred()) },
+		),
+		l.deferralWait,
+	}
+}
+
+// Tokens estimates the number of rate limit tokens currently available.
+func (l *Limiter) Tokens() float64 {
+	tokens, err := l.bucket.Tokens(time.Now())
+	if err != nil {
+		l.logger.Error("Failed to read rate limiter tokens", zap.Error(err))
+	}
+	return tokens
+}
+
+// Deferred returns the number of emails added to the queue so far.
+func (l *Limiter) Deferred() int64 {
+	return l.deferred.Load()
+}
@@ -0,0 +1,46 @@
+package rate
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Priority determines the order in which emails compete for rate limit tokens.
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// ParsePriority validates a priority name. An empty name selects PriorityNormal.
+func ParsePriority(name string) (Priority, error) {
+	switch p := Priority(name); p {
+	case "":
+		return PriorityNormal, nil
+	case PriorityHigh, PriorityNormal, PriorityLow:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid priority %q, expected high, normal or low", name)
+	}
+}
+
+// Rank orders priorities, with lower ranks sent first. Unset priorities rank as PriorityNormal.
+func (p Priority) Rank() int {
+	switch p {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// sortByPriority orders tasks by priority, keeping the existing order within a priority.
+func sortByPriority(tasks []EmailTask) {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].Priority.Rank() < tasks[j].Priority.Rank()
+	})
+}
@@ -0,0 +1,90 @@
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+// Queue stores deferred email tasks ordered by their retry time.
+type Queue interface {
+	// Push adds a task to the queue.
+	Push(task EmailTask) error
+	// PopReady atomically removes and returns all tasks whose RetryAt is before now.
+	PopReady(now time.Time) ([]EmailTask, error)
+	// PopOldest removes and returns the task with the earliest retry time, or false if the
+	// queue is empty.
+	PopOldest() (EmailTask, bool, error)
+	// Len returns the number of tasks currently queued.
+	Len() (int, error)
+	// Persistent reports whether the tasks outlive the process, so that they need not be
+	// flushed on shutdown.
+	Persistent() bool
+}
+
+type memoryQueue struct {
+	tasks []EmailTask
+	mu    sync.Mutex
+}
+
+// NewMemoryQueue creates a Queue that keeps tasks in process memory.
+func NewMemoryQueue() Queue {
+	return &memoryQueue{
+		tasks: make([]EmailTask, 0),
+	}
+}
+
+func (m *memoryQueue) Push(task EmailTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tasks = append(m.tasks, task)
+	return nil
+}
+
+func (m *memoryQueue) PopReady(now time.Time) ([]EmailTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ready []EmailTask
+	var remaining []EmailTask
+
+	for _, task := range m.tasks {
+		if now.After(task.RetryAt) {
+			ready = append(ready, task)
+		} else {
+			remaining = append(remaining, task)
+		}
+	}
+
+	m.tasks = remaining
+	return ready, nil
+}
+
+func (m *memoryQueue) PopOldest() (EmailTask, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.tasks) == 0 {
+		return EmailTask{}, false, nil
+	}
+	oldest := 0
+	for i, task := range m.tasks {
+		if task.RetryAt.Before(m.tasks[oldest].RetryAt) {
+			oldest = i
+		}
+	}
+	task := m.tasks[oldest]
+	m.tasks = append(m.tasks[:oldest], m.tasks[oldest+1:]...)
+	return task, true, nil
+}
+
+func (m *memoryQueue) Persistent() bool {
+	return false
+}
+
+func (m *memoryQueue) Len() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.tasks), nil
+}
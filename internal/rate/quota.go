@@ -0,0 +1,84 @@
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+// quotaHours is the length of the rolling monthly window, in hourly buckets.
+const quotaHours = 30 * 24
+
+// QuotaUsage reports sends counted against a quota window. A Limit of zero means the window
+// is unlimited.
+type QuotaUsage struct {
+	Limit int
+	Used  int
+}
+
+// Remaining returns how many sends are left in the window, or -1 if it is unlimited.
+func (u QuotaUsage) Remaining() int {
+	if u.Limit == 0 {
+		return -1
+	}
+	if u.Used >= u.Limit {
+		return 0
+	}
+	return u.Limit - u.Used
+}
+
+// quota counts sends in hourly buckets covering a rolling 30-day window, from which both the
+// rolling 24-hour and 30-day totals are derived.
+type quota struct {
+	daily    int
+	monthly  int
+	buckets  [quotaHours]int
+	lastHour int64
+	mu       sync.Mutex
+}
+
+func newQuota(daily, monthly int) *quota {
+	return &quota{daily: daily, monthly: monthly}
+}
+
+// advance clears the buckets of hours that passed since the last call.
+func (q *quota) advance(now time.Time) int64 {
+	hour := now.Unix() / 3600
+	if hour > q.lastHour {
+		for h, n := q.lastHour+1, 0; h <= hour && n < quotaHours; h, n = h+1, n+1 {
+			q.buckets[h%quotaHours] = 0
+		}
+		q.lastHour = hour
+	}
+	return hour
+}
+
+func (q *quota) usage(now time.Time) (daily, monthly QuotaUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	hour := q.advance(now)
+	daily.Limit, monthly.Limit = q.daily, q.monthly
+	for i := 0; i < quotaHours; i++ {
+		n := q.buckets[(hour-int64(i)+quotaHours)%quotaHours]
+		if i < 24 {
+			daily.Used += n
+		}
+		monthly.Used += n
+	}
+	return daily, monthly
+}
+
+// allows reports whether another send fits within both windows.
+func (q *quota) allows(now time.Time) bool {
+	daily, monthly := q.usage(now)
+	return daily.Remaining() != 0 && monthly.Remaining() != 0
+}
+
+// record counts n sends made at now.
+func (q *quota) record(now time.Time, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	hour := q.advance(now)
+	q.buckets[hour%quotaHours] += n
+}
@@ -3,55 +3,234 @@ package rate
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
-	"golang.org/x/time/rate"
 	"runebird/internal/config"
+	"runebird/internal/email"
 	"runebird/internal/logger"
 )
 
+// Overflow policies applied when the queue reaches its maximum size.
+const (
+	OverflowReject     = "reject"
+	OverflowDropOldest = "drop_oldest"
+	OverflowSpill      = "spill"
+)
+
+// ErrQueueFull is returned by QueueEmail when the queue is full and the overflow policy
+// rejects new emails.
+var ErrQueueFull = errors.New("rate limit queue is full")
+
+// ErrDropped is reported to the observers of a queued email that was dropped to make room
+// for a newer one under the drop_oldest overflow policy.
+var ErrDropped = errors.New("dropped from the full rate limit queue")
+
 // EmailTask represents a delayed email sending task.
 type EmailTask struct {
-	Recipients []string
-	Subject    string
-	Body       string
-	RetryAt    time.Time
+	ID          string             `json:"id"`
+	MessageID   string             `json:"message_id,omitempty"`
+	TaskID      string             `json:"task_id,omitempty"`
+	From        string             `json:"from,omitempty"`
+	Recipients  []string           `json:"recipients"`
+	Subject     string             `json:"subject"`
+	Body        string             `json:"body"`
+	TextBody    string             `json:"text_body,omitempty"`
+	ReplyTo     string             `json:"reply_to,omitempty"`
+	Headers     map[string]string  `json:"headers,omitempty"`
+	Attachments []email.Attachment `json:"attachments,omitempty"`
+	Template    string             `json:"template,omitempty"`
+	Profile     string             `json:"profile,omitempty"`
+	Priority    Priority           `json:"priority,omitempty"`
+	DryRun      bool               `json:"dry_run,omitempty"`
+	Attempts    int                `json:"attempts,omitempty"`
+	QueuedAt    time.Time          `json:"queued_at"`
+	RetryAt     time.Time          `json:"retry_at"`
+}
+
+// message returns the email the task delivers.
+func (t EmailTask) message() email.Message {
+	return email.Message{
+		ID:          t.MessageID,
+		From:        t.From,
+		Recipients:  t.Recipients,
+		Template:    t.Template,
+		Profile:     t.Profile,
+		Subject:     t.Subject,
+		HTMLBody:    t.Body,
+		TextBody:    t.TextBody,
+		ReplyTo:     t.ReplyTo,
+		Headers:     t.Headers,
+		Attachments: t.Attachments,
+		DryRun:      t.DryRun,
+	}
 }
 
 // Limiter manages rate limiting for email sending with delayed retries.
 type Limiter struct {
-	limiter   *rate.Limiter
-	queue     []EmailTask
-	mu        sync.Mutex
-	logger    *logger.Logger
-	isRunning bool
-	ctx       context.Context
-	cancel    context.CancelFunc
+	bucket Bucket
+	// interval, the time it takes to refill a token, and burst change when the limits are
+	// reloaded.
+	interval      atomic.Int64
+	burst         atomic.Int64
+	profiles      map[string]profileBucket
+	perRecipient  bool
+	snapshotEvery time.Duration
+	retry         config.RetryConfig
+	quota         *quota
+	window        *window
+	throttle      *throttle
+	breaker       *breaker
+	queue         Queue
+	spill         Queue
+	maxQueue      int
+	overflow      string
+	queueMu       sync.Mutex
+	sender        email.Sender
+	observers     []func(EmailTask, email.Result, error)
+	mu            sync.Mutex
+	logger        *logger.Logger
+	sent          atomic.Int64
+	failed        atomic.Int64
+	dropped       atomic.Int64
+	deferred      atomic.Int64
+	deferralWait  prometheus.Histogram
+	isRunning     bool
+	stop          chan struct{}
+	done          chan struct{}
+	ctx           context.Context
+	cancel        context.CancelFunc
 }
 
 // New creates a new Limiter instance based on the provided rate limit configuration.
-func New(cfg *config.RateLimitConfig, log *logger.Logger) (*Limiter, error) {
+// Tokens are drawn from bucket; deferred emails are kept in the given queue and delivered
+// with sender once tokens are available. With the spill overflow policy, emails that do not
+// fit in a full queue go to spill instead, which is otherwise unused and may be nil.
+func New(cfg *config.RateLimitConfig, log *logger.Logger, sender email.Sender, queue Queue, bucket Bucket, spill Queue) (*Limiter, error) {
 	if cfg.PerHour <= 0 || cfg.Burst <= 0 {
 		return nil, fmt.Errorf("invalid rate limit configuration: per_hour=%d, burst=%d", cfg.PerHour, cfg.Burst)
 	}
+	if cfg.DailyLimit < 0 || cfg.MonthlyLimit < 0 {
+		return nil, fmt.Errorf("invalid quota configuration: daily_limit=%d, monthly_limit=%d", cfg.DailyLimit, cfg.MonthlyLimit)
+	}
+	if cfg.OverflowPolicy == OverflowSpill && spill == nil {
+		return nil, fmt.Errorf("invalid queue configuration: the spill overflow policy requires a spill queue")
+	}
 
-	// Calculate rate per second from per hour limit
-	ratePerSecond := float64(cfg.PerHour) / 3600.0
-	limiter := rate.NewLimiter(rate.Limit(ratePerSecond), cfg.Burst)
+	if cfg.Adaptive.Enabled && (cfg.Adaptive.Backoff <= 0 || cfg.Adaptive.Backoff >= 1 || cfg.Adaptive.MinFactor <= 0 || cfg.Adaptive.Cooldown <= 0) {
+		return nil, fmt.Errorf("invalid adaptive throttling configuration: backoff=%g, min_factor=%g, cooldown=%s", cfg.Adaptive.Backoff, cfg.Adaptive.MinFactor, cfg.Adaptive.Cooldown)
+	}
+
+	if cfg.CircuitBreaker.Enabled && (cfg.CircuitBreaker.Failures < 1 || cfg.CircuitBreaker.Cooldown <= 0) {
+		return nil, fmt.Errorf("invalid circuit breaker configuration: failures=%d, cooldown=%s", cfg.CircuitBreaker.Failures, cfg.CircuitBreaker.Cooldown)
+	}
+
+	window, err := newWindow(&cfg.SendWindow)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Limiter{
-		limiter:   limiter,
-		queue:     make([]EmailTask, 0),
-		logger:    log,
-		isRunning: false,
-		ctx:       ctx,
-		cancel:    cancel,
-	}, nil
+	l := &Limiter{
+		bucket:        bucket,
+		profiles:      make(map[string]profileBucket),
+		perRecipient:  cfg.PerRecipient,
+		snapshotEvery: cfg.SnapshotInterval,
+		retry:         retryPolicy(cfg.Retry),
+		quota:         newQuota(cfg.DailyLimit, cfg.MonthlyLimit),
+		window:        window,
+		throttle:      newThrottle(cfg),
+		breaker:       newBreaker(cfg),
+		queue:         queue,
+		spill:         spill,
+		maxQueue:      cfg.MaxQueueSize,
+		overflow:      cfg.OverflowPolicy,
+		sender:        sender,
+		logger:        log,
+		deferralWait:  newDeferralWait(),
+		isRunning:     false,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	l.interval.Store(int64(time.Hour / time.Duration(cfg.PerHour)))
+	l.burst.Store(int64(cfg.Burst))
+	return l, nil
+}
+
+// SetLimits changes the send rate and burst size to those of cfg, as on a configuration
+// reload. The bucket keeps the tokens it holds, up to the new burst size; a bucket that cannot
+// change its limits while in use keeps the previous ones.
+func (l *Limiter) SetLimits(cfg *config.RateLimitConfig) error {
+	if cfg.PerHour <= 0 || cfg.Burst <= 0 {
+		return fmt.Errorf("invalid rate limit configuration: per_hour=%d, burst=%d", cfg.PerHour, cfg.Burst)
+	}
+	b, ok := l.bucket.(Resizer)
+	if !ok {
+		return fmt.Errorf("rate limit bucket does not support changing its limits")
+	}
+	b.Resize(cfg.PerHour, cfg.Burst)
+	l.interval.Store(int64(time.Hour / time.Duration(cfg.PerHour)))
+	l.burst.Store(int64(cfg.Burst))
+	return nil
+}
+
+// profileBucket is the token bucket of the emails of a delivery profile, with its limits.
+type profileBucket struct {
+	bucket   Bucket
+	interval time.Duration
+	burst    int
+}
+
+// AddProfile draws the tokens of the emails of the delivery profile name from bucket, which
+// refills at cfg.PerHour tokens per hour up to cfg.Burst tokens, instead of the limiter's own
+// bucket. Quotas, the send window and the circuit breaker still apply to them. It must be
+// called before the limiter is started or used.
+func (l *Limiter) AddProfile(name string, cfg *config.ProfileRateLimitConfig, bucket Bucket) error {
+	if cfg.PerHour <= 0 || cfg.Burst <= 0 {
+		return fmt.Errorf("invalid rate limit configuration for delivery profile %s: per_hour=%d, burst=%d", name, cfg.PerHour, cfg.Burst)
+	}
+	l.profiles[name] = profileBucket{bucket: bucket, interval: time.Hour / time.Duration(cfg.PerHour), burst: cfg.Burst}
+	return nil
+}
+
+// bucketFor returns the token bucket of the emails of the delivery profile named profile, the
+// time it takes to refill a token and its burst size. Emails of the default profile, or of
+// one without a bucket of its own, use the limiter's.
+func (l *Limiter) bucketFor(profile string) (Bucket, time.Duration, int) {
+	if p, ok := l.profiles[profile]; ok {
+		return p.bucket, p.interval, p.burst
+	}
+	return l.bucket, time.Duration(l.interval.Load()), int(l.burst.Load())
+}
+
+// defaultRetryDelay is how long a queued email waits before its first send attempt if no
+// initial retry delay is configured.
+const defaultRetryDelay = 10 * time.Second
+
+// retryPolicy fills in the retry settings left at their zero values: a single attempt with the
+// default delay and no growth between retries.
+func retryPolicy(cfg config.RetryConfig) config.RetryConfig {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.InitialDelay <= 0 {
+		cfg.InitialDelay = defaultRetryDelay
+	}
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = 1
+	}
+	return cfg
 }
 
 // Start begins processing the delayed email queue in a non-blocking manner.
@@ -68,8 +247,19 @@ func (l *Limiter) Start() {
 	l.logger.Info("Rate limiter queue processing started")
 }
 
-// Stop halts the processing of the delayed email queue.
+// Stop halts the processing of the delayed email queue, abandoning sends in progress.
 func (l *Limiter) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.Shutdown(ctx)
+}
+
+// Shutdown halts the processing of the delayed email queue, letting sends in progress finish
+// until ctx is done. Emails held in memory are then flushed, sent as far as the rate limit
+// and send window allow until ctx is done, since they would otherwise be lost; a persistent
+// queue keeps them for the next start. Sends still in progress once ctx is done are abandoned
+// and their emails put back on the queue.
+func (l *Limiter) Shutdown(ctx context.Context) {
 	l.mu.Lock()
 	if !l.isRunning {
 		l.mu.Unlock()
@@ -78,77 +268,301 @@ func (l *Limiter) Stop() {
 	l.isRunning = false
 	l.mu.Unlock()
 
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.cancel()
+		case <-finished:
+		}
+	}()
+
+	close(l.stop)
+	<-l.done
+	if !l.queue.Persistent() {
+		l.flush()
+		if n, _ := l.queue.Len(); n > 0 {
+			l.logger.Warn("Queued emails could not be sent before shutdown and are lost", zap.Int("emails", n))
+		}
+	}
 	l.cancel()
+	l.snapshot()
 	l.logger.Info("Rate limiter queue processing stopped")
 }
 
-// CanSend checks if an email can be sent immediately based on the rate limit.
-// Returns true if a token is available now without waiting, false if it should be queued.
-func (l *Limiter) CanSend() bool {
-	reservation := l.limiter.ReserveN(time.Now(), 1)
-	if reservation.OK() {
-		// If reservation is OK and delay is zero or negative, a token is available now
-		if reservation.Delay() <= 0 {
-			return true
+// CanSend checks if an email of the delivery profile named profile, empty for the default one,
+// to the given number of recipients can be sent immediately based on the rate limit and
+// quotas. Returns true if its tokens are available now without waiting,
+// the daily and monthly quotas are not used up, the SMTP server has not asked to slow down and
+// the circuit breaker is not holding sends, false if it should be queued. A true result takes
+// the tokens of the email and counts them against the quotas, so the email must then be sent
+// without charging it again.
+func (l *Limiter) CanSend(profile string, recipients int) bool {
+	now := time.Now()
+	if !l.quota.allows(now) {
+		return false
+	}
+	// The throttle token and the breaker trial are given back if the bucket refuses the send.
+	throttled, reservation := l.throttle.reserve(now)
+	if !throttled {
+		return false
+	}
+	allowed, trial := l.breaker.begin(now)
+	if !allowed {
+		l.throttle.cancel(reservation, now)
+		return false
+	}
+	bucket, _, _ := l.bucketFor(profile)
+	cost := l.cost(recipients)
+	ok, err := bucket.Take(now, cost)
+	if err != nil {
+		l.logger.Error("Failed to take rate limiter token", zap.Error(err))
+		ok = false
+	}
+	if !ok {
+		l.throttle.cancel(reservation, now)
+		if trial {
+			l.breaker.cancelTrial(now)
 		}
-		// Cancel the reservation since we won't use it (we're not waiting)
-		reservation.Cancel()
+		return false
 	}
-	return false
+	l.quota.record(now, cost)
+	return true
 }
 
-// ConsumeToken consumes a token from the rate limiter, blocking if necessary until one is available.
-func (l *Limiter) ConsumeToken() error {
-	return l.limiter.WaitN(l.ctx, 1)
+// RetryAfter estimates how long a caller turned away by CanSend for an email of profile should
+// wait before trying again: until the next hourly quota bucket rolls over if a quota is used
+// up, until the next trial send if the circuit breaker is open, otherwise the time it takes to
+// refill one token of the bucket of profile.
+func (l *Limiter) RetryAfter(profile string) time.Duration {
+	now := time.Now()
+	if !l.quota.allows(now) {
+		return now.Truncate(time.Hour).Add(time.Hour).Sub(now)
+	}
+	if state, trialAt := l.breaker.status(); state == BreakerOpen && trialAt.After(now) {
+		return trialAt.Sub(now)
+	}
+	_, interval, _ := l.bucketFor(profile)
+	return time.Duration(float64(interval) / l.throttle.rateFactor(now))
 }
 
-// QueueEmail adds an email task to the delayed queue if the rate limit is exceeded.
-func (l *Limiter) QueueEmail(recipients []string, subject, body string) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// ObserveSendError lets the limiter react to a failed send. If the SMTP server asked to slow
+// down, the effective rate is reduced for a cooldown period when adaptive throttling is
+// enabled. Other transient failures, such as an unreachable server, count towards opening the
+// circuit breaker, while permanent failures show that the server is answering.
+func (l *Limiter) ObserveSendError(err error) {
+	now := time.Now()
+	switch {
+	case errors.Is(err, email.ErrThrottled):
+		if l.throttle == nil {
+			return
+		}
+		l.throttle.slowDown(now)
+		l.logger.Warn("SMTP server is throttling, reducing send rate", zap.Float64("rate_factor", l.throttle.rateFactor(now)), zap.Error(err))
+	case email.IsTransient(err):
+		if l.breaker.failure(now) {
+			_, trialAt := l.breaker.status()
+			l.logger.Warn("Circuit breaker opened after repeated send failures, holding emails in the queue", zap.Time("trial_at", trialAt), zap.Error(err))
+		}
+	default:
+		l.ObserveSendSuccess()
+	}
+}
+
+// ObserveSendSuccess lets the limiter know that a send reached the provider, closing the
+// circuit breaker if it was open.
+func (l *Limiter) ObserveSendSuccess() {
+	if l.breaker.success() {
+		l.logger.Info("Circuit breaker closed, sends resumed")
+	}
+}
+
+// BreakerState returns the state of the circuit breaker: BreakerClosed, BreakerOpen or
+// BreakerHalfOpen. It is always BreakerClosed if the circuit breaker is disabled.
+func (l *Limiter) BreakerState() string {
+	state, _ := l.breaker.status()
+	return state
+}
+
+// RateFactor returns the fraction of the configured send rate currently in effect, which is
+// below 1 while adaptive throttling has slowed sending down.
+func (l *Limiter) RateFactor() float64 {
+	return l.throttle.rateFactor(time.Now())
+}
+
+// Quota returns the sends counted against the rolling 24-hour and 30-day quotas.
+func (l *Limiter) Quota() (daily, monthly QuotaUsage) {
+	return l.quota.usage(time.Now())
+}
 
+// cost returns the number of tokens an email to the given number of recipients uses. With
+// per_recipient set, each envelope recipient costs a token; an email to more recipients than
+// the burst size is sent once the bucket is full, and leaves it in debt for the rest.
+func (l *Limiter) cost(recipients int) int {
+	if !l.perRecipient || recipients < 1 {
+		return 1
+	}
+	return recipients
+}
+
+// WindowOpen reports whether emails rendered from template may be sent now under the configured
+// send window. It is always true if no window is configured or the template is exempt.
+func (l *Limiter) WindowOpen(template string) bool {
+	return l.window.allows(template, time.Now())
+}
+
+// QueueEmail adds an email task to the delayed queue if the rate limit is exceeded or the send
+// window is closed, in which case the email is held until the window opens. If the queue is
+// full, the configured overflow policy decides whether the email is rejected with
+// ErrQueueFull, replaces the oldest queued email, or is spilled to the overflow queue.
+func (l *Limiter) QueueEmail(template string, msg email.Message, priority Priority) error {
+	return l.QueueTask("", template, msg, priority)
+}
+
+// QueueTask queues msg like QueueEmail on behalf of the scheduled task with the given ID, which
+// the observers are given with the outcome of the send.
+func (l *Limiter) QueueTask(taskID, template string, msg email.Message, priority Priority) error {
+	now := time.Now()
 	task := EmailTask{
-		Recipients: recipients,
-		Subject:    subject,
-		Body:       body,
-		RetryAt:    time.Now().Add(time.Second * 10), // Retry after a short delay
+		ID:          newQueuedID(now),
+		MessageID:   msg.ID,
+		TaskID:      taskID,
+		From:        msg.From,
+		Recipients:  msg.Recipients,
+		Subject:     msg.Subject,
+		Body:        msg.HTMLBody,
+		TextBody:    msg.TextBody,
+		ReplyTo:     msg.ReplyTo,
+		Headers:     msg.Headers,
+		Attachments: msg.Attachments,
+		Template:    template,
+		Profile:     msg.Profile,
+		Priority:    priority,
+		DryRun:      msg.DryRun,
+		QueuedAt:    now,
+		RetryAt:     now.Add(l.retry.InitialDelay),
+	}
+	deferred := !l.window.allows(template, now)
+	if deferred {
+		task.RetryAt = l.window.opens(now)
+	}
+	if err := l.enqueue(task); err != nil {
+		l.logger.Error("Failed to queue email", zap.Any("recipients", msg.Recipients), zap.Error(err))
+		return err
+	}
+	l.deferred.Add(1)
+	if deferred {
+		l.logger.Info("Email deferred until the send window opens", zap.Any("recipients", msg.Recipients), zap.Time("retry_at", task.RetryAt))
+		return nil
+	}
+	l.logger.Info("Email queued due to rate limit", zap.Any("recipients", msg.Recipients), zap.String("priority", string(priority)))
+	return nil
+}
+
+// newQueuedID returns an ID for an email queued at now. The random suffix keeps the IDs of
+// emails queued at the same instant by instances sharing a queue apart.
+func newQueuedID(now time.Time) string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("queued-%d-%s", now.UnixNano(), hex.EncodeToString(b))
+}
+
+// enqueue pushes task onto the queue, applying the overflow policy if the queue is full.
+func (l *Limiter) enqueue(task EmailTask) error {
+	l.queueMu.Lock()
+	defer l.queueMu.Unlock()
+
+	if l.maxQueue > 0 {
+		n, err := l.queue.Len()
+		if err != nil {
+			return err
+		}
+		if n >= l.maxQueue {
+			switch l.overflow {
+			case OverflowDropOldest:
+				dropped, ok, err := l.queue.PopOldest()
+				if err != nil {
+					return err
+				}
+				if ok {
+					l.dropped.Add(1)
+					l.logger.Warn("Dropped oldest queued email because the queue is full", zap.String("id", dropped.ID), zap.Any("recipients", dropped.Recipients))
+					l.report(dropped, email.Result{}, ErrDropped)
+				}
+			case OverflowSpill:
+				return l.spill.Push(task)
+			default:
+				return ErrQueueFull
+			}
+		}
 	}
-	l.queue = append(l.queue, task)
-	l.logger.Info("Email queued due to rate limit", zap.Any("recipients", recipients))
+	return l.queue.Push(task)
 }
 
 // GetQueuedEmails retrieves emails from the queue that are ready to be sent.
-// Returns a slice of tasks ready for retry.
+// Returns a slice of tasks ready for retry, highest priority first.
 func (l *Limiter) GetQueuedEmails() []EmailTask {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
 	now := time.Now()
-	var ready []EmailTask
-	var remaining []EmailTask
+	ready, err := l.queue.PopReady(now)
+	if err != nil {
+		l.logger.Error("Failed to read queued emails", zap.Error(err))
+	}
+	if l.spill != nil {
+		spilled, err := l.spill.PopReady(now)
+		if err != nil {
+			l.logger.Error("Failed to read spilled emails", zap.Error(err))
+		}
+		ready = append(ready, spilled...)
+	}
+	sortByPriority(ready)
+	return ready
+}
 
-	for _, task := range l.queue {
-		if now.After(task.RetryAt) {
-			ready = append(ready, task)
-		} else {
-			remaining = append(remaining, task)
+// QueueLen returns the number of emails waiting in the queue, including spilled emails.
+func (l *Limiter) QueueLen() int {
+	n, err := l.queue.Len()
+	if err != nil {
+		l.logger.Error("Failed to count queued emails", zap.Error(err))
+	}
+	if l.spill != nil {
+		spilled, err := l.spill.Len()
+		if err != nil {
+			l.logger.Error("Failed to count spilled emails", zap.Error(err))
 		}
+		n += spilled
 	}
+	return n
+}
 
-	l.queue = remaining
-	return ready
+// QueuedDropped returns the number of queued emails dropped to make room for newer ones.
+func (l *Limiter) QueuedDropped() int64 {
+	return l.dropped.Load()
 }
 
-// processQueue runs a background loop to process queued emails when the rate limit allows.
+// QueuedSent returns the number of queued emails delivered so far.
+func (l *Limiter) QueuedSent() int64 {
+	return l.sent.Load()
+}
+
+// QueuedFailed returns the number of queued emails that could not be delivered.
+func (l *Limiter) QueuedFailed() int64 {
+	return l.failed.Load()
+}
+
+// processQueue runs a background loop to process queued emails when the rate limit allows,
+// saving the token bucket every snapshot interval if it is persistent.
 func (l *Limiter) processQueue() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
+	defer close(l.done)
+	var lastSnapshot time.Time
 	for {
 		select {
-		case <-l.ctx.Done():
+		case <-l.stop:
 			return
-		case <-ticker.C:
+		case now := <-ticker.C:
 			l.mu.Lock()
 			if !l.isRunning {
 				l.mu.Unlock()
@@ -156,19 +570,126 @@ func (l *Limiter) processQueue() {
 			}
 			l.mu.Unlock()
 
-			readyTasks := l.GetQueuedEmails()
-			for _, task := range readyTasks {
-				if l.CanSend() {
-					// Here, in a real integration, we would trigger sending the email.
-					// For now, log the attempt (integration will be handled in server/email packages).
-					l.logger.Info("Processing queued email", zap.Any("recipients", task.Recipients))
-					// Reserve a token for sending (in real usage, this would be tied to actual send).
-					_ = l.limiter.WaitN(l.ctx, 1)
-				} else {
-					// Re-queue if still rate-limited
-					l.QueueEmail(task.Recipients, task.Subject, task.Body)
-				}
+			l.sendReady()
+			if now.Sub(lastSnapshot) >= l.snapshotEvery {
+				l.snapshot()
+				lastSnapshot = now
 			}
 		}
 	}
 }
+
+// snapshot saves the token bucket state if the bucket supports it.
+func (l *Limiter) snapshot() {
+	s, ok := l.bucket.(snapshotter)
+	if !ok {
+		return
+	}
+	if err := s.snapshot(time.Now()); err != nil {
+		l.logger.Error("Failed to save rate limit bucket state", zap.Error(err))
+	}
+}
+
+// sendReady delivers the queued emails that are ready.
+func (l *Limiter) sendReady() {
+	l.send(l.GetQueuedEmails())
+}
+
+// flush delivers all the emails in the queue, including those not due for another attempt yet.
+func (l *Limiter) flush() {
+	tasks, err := l.queue.PopReady(endOfTime)
+	if err != nil {
+		l.logger.Error("Failed to read queued emails", zap.Error(err))
+	}
+	sortByPriority(tasks)
+	l.send(tasks)
+}
+
+// endOfTime is later than any email is queued until.
+var endOfTime = time.Date(9999, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// send delivers tasks while tokens are available and the send window is open, in the order
+// given, and puts the rest back on the queue. Failed sends are retried with exponential
+// backoff until the configured number of attempts is used up. Once the limiter is stopped,
+// the remaining emails are put back untouched.
+func (l *Limiter) send(tasks []EmailTask) {
+	for _, task := range tasks {
+		if l.ctx.Err() != nil {
+			l.requeue(task, task.RetryAt)
+			continue
+		}
+		if now := time.Now(); !l.window.allows(task.Template, now) {
+			l.requeue(task, l.window.opens(now))
+			continue
+		}
+		if !l.CanSend(task.Profile, len(task.Recipients)) {
+			l.requeue(task, time.Now().Add(l.retry.InitialDelay))
+			continue
+		}
+
+		if !task.QueuedAt.IsZero() {
+			l.deferralWait.Observe(time.Since(task.QueuedAt).Seconds())
+		}
+		task.Attempts++
+		result, err := l.sender.SendMessage(l.ctx, task.message())
+		if err != nil && l.ctx.Err() != nil {
+			// The send was abandoned because the limiter stopped, so it does not count.
+			task.Attempts--
+			l.requeue(task, time.Now())
+			continue
+		}
+		if err != nil {
+			l.ObserveSendError(err)
+			if task.Attempts < l.retry.MaxAttempts && email.Retryable(err) {
+				delay := l.backoff(task.Attempts)
+				l.logger.Warn("Failed to send queued email, will retry", zap.String("id", task.ID), zap.Any("recipients", task.Recipients), zap.Int("attempt", task.Attempts), zap.Duration("delay", delay), zap.Error(err))
+				l.requeue(task, time.Now().Add(delay))
+				continue
+			}
+			l.failed.Add(1)
+			l.logger.Error("Failed to send queued email", zap.String("id", task.ID), zap.Any("recipients", task.Recipients), zap.Int("attempt", task.Attempts), zap.Error(err))
+			l.report(task, result, err)
+			continue
+		}
+		l.ObserveSendSuccess()
+		l.sent.Add(1)
+		l.logger.Info("Queued email sent successfully", append([]zap.Field{zap.String("id", task.ID), zap.Any("recipients", task.Recipients)}, result.LogFields()...)...)
+		l.report(task, result, nil)
+	}
+}
+
+// Observe registers fn to be called with every queued email once it is sent, with a nil
+// error, or has failed for good.
+func (l *Limiter) Observe(fn func(EmailTask, email.Result, error)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.observers = append(l.observers, fn)
+}
+
+// report passes the outcome of task to the observers.
+func (l *Limiter) report(task EmailTask, result email.Result, err error) {
+	l.mu.Lock()
+	observers := l.observers
+	l.mu.Unlock()
+	for _, fn := range observers {
+		fn(task, result, err)
+	}
+}
+
+// requeue puts task back on the queue to be retried at the given time.
+func (l *Limiter) requeue(task EmailTask, at time.Time) {
+	task.RetryAt = at
+	if err := l.queue.Push(task); err != nil {
+		l.logger.Error("Failed to requeue email", zap.String("id", task.ID), zap.Any("recipients", task.Recipients), zap.Error(err))
+		l.report(task, email.Result{}, err)
+	}
+}
+
+// backoff returns the delay before the retry following the given failed attempt.
+func (l *Limiter) backoff(attempt int) time.Duration {
+	delay := float64(l.retry.InitialDelay) * math.Pow(l.retry.Multiplier, float64(attempt-1))
+	if l.retry.MaxDelay > 0 && delay > float64(l.retry.MaxDelay) {
+		return l.retry.MaxDelay
+	}
+	return time.Duration(delay)
+}
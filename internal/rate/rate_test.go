@@ -1,10 +1,14 @@
 package rate
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"runebird/internal/config"
+	"runebird/internal/email"
 	"runebird/internal/logger"
 )
 
@@ -25,8 +29,14 @@ func TestLimiter(t *testing.T) {
 		t.Fatalf("failed to create logger: %v", err)
 	}
 
+	// Nothing listens on port 1, so every send fails immediately.
+	sender, err := email.NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: 1, Username: "user", Password: "pass", FromAddress: "from@example.com"})
+	if err != nil {
+		t.Fatalf("failed to create email sender: %v", err)
+	}
+
 	t.Run("NewLimiterValidConfig", func(t *testing.T) {
-		limiter, err := New(&cfg.RateLimit, log)
+		limiter, err := New(&cfg.RateLimit, log, sender, NewMemoryQueue(), NewMemoryBucket(&cfg.RateLimit), nil)
 		if err != nil {
 			t.Fatalf("expected no error, got: %v", err)
 		}
@@ -41,32 +51,86 @@ func TestLimiter(t *testing.T) {
 			PerHour: 0,
 			Burst:   0,
 		}
-		_, err := New(invalidCfg, log)
+		_, err := New(invalidCfg, log, sender, NewMemoryQueue(), NewMemoryBucket(invalidCfg), nil)
 		if err == nil {
 			t.Fatal("expected error for invalid config, got none")
 		}
 	})
 
+	t.Run("SetLimits", func(t *testing.T) {
+		limiter, err := New(&cfg.RateLimit, log, sender, NewMemoryQueue(), NewMemoryBucket(&cfg.RateLimit), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		if err := limiter.SetLimits(&config.RateLimitConfig{PerHour: 3600, Burst: 4}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		// The bucket took the new burst size: four sends go through at once after the refill.
+		for i := 0; i < 4; i++ {
+			if !limiter.bucket.(*memoryBucket).limiter.AllowN(time.Now().Add(time.Minute), 1) {
+				t.Fatalf("expected send %d of the new burst to be allowed", i+1)
+			}
+		}
+		if got := limiter.RetryAfter(""); got != time.Second {
+			t.Errorf("expected one token per second at 3600 per hour, got %s", got)
+		}
+		if err := limiter.SetLimits(&config.RateLimitConfig{PerHour: 0, Burst: 1}); err == nil {
+			t.Error("expected error for invalid limits, got none")
+		}
+	})
+
+	t.Run("ProfileBuckets", func(t *testing.T) {
+		limiter, err := New(&cfg.RateLimit, log, sender, NewMemoryQueue(), NewMemoryBucket(&cfg.RateLimit), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		marketing := &config.ProfileRateLimitConfig{PerHour: 3600, Burst: 1}
+		if err := limiter.AddProfile("marketing", marketing, NewMemoryBucket(marketing.Bucket())); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if !limiter.CanSend("marketing", 1) {
+			t.Error("expected the first marketing send to be allowed")
+		}
+		if limiter.CanSend("marketing", 1) {
+			t.Error("expected the marketing bucket to be empty after its burst of 1")
+		}
+		if !limiter.CanSend("", 1) {
+			t.Error("expected the default bucket to be unaffected by marketing sends")
+		}
+		if got := limiter.RetryAfter("marketing"); got != time.Second {
+			t.Errorf("expected one marketing token per second, got %s", got)
+		}
+		if err := limiter.AddProfile("broken", &config.ProfileRateLimitConfig{}, NewMemoryBucket(&cfg.RateLimit)); err == nil {
+			t.Error("expected error for invalid profile limits, got none")
+		}
+	})
+
 	t.Run("CanSendAndQueue", func(t *testing.T) {
-		limiter, err := New(&cfg.RateLimit, log)
+		limiter, err := New(&cfg.RateLimit, log, sender, NewMemoryQueue(), NewMemoryBucket(&cfg.RateLimit), nil)
 		if err != nil {
 			t.Fatalf("expected no error, got: %v", err)
 		}
 		defer limiter.Stop()
 
-		if !limiter.CanSend() {
+		if !limiter.CanSend("", 1) {
 			t.Error("expected CanSend to return true for initial burst")
 		}
-		if !limiter.CanSend() {
+		if !limiter.CanSend("", 1) {
 			t.Error("expected CanSend to return true for second burst")
 		}
 
-		if limiter.CanSend() {
+		if limiter.CanSend("", 1) {
 			t.Error("expected CanSend to return false after burst is used")
 		}
 
 		recipients := []string{"test@example.com"}
-		limiter.QueueEmail(recipients, "Test Subject", "<p>Test Body</p>")
+		if err := limiter.QueueEmail("welcome", email.Message{Recipients: recipients, Subject: "Test Subject", HTMLBody: "<p>Test Body</p>"}, PriorityNormal); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
 
 		queued := limiter.GetQueuedEmails()
 		if len(queued) != 0 {
@@ -74,8 +138,552 @@ func TestLimiter(t *testing.T) {
 		}
 	})
 
+	t.Run("QueuedIDsUnique", func(t *testing.T) {
+		now := time.Now()
+		if newQueuedID(now) == newQueuedID(now) {
+			t.Error("expected emails queued at the same instant to get distinct IDs")
+		}
+	})
+
+	t.Run("QueuedEmailsByPriority", func(t *testing.T) {
+		queue := NewMemoryQueue()
+		limiter, err := New(&cfg.RateLimit, log, sender, queue, NewMemoryBucket(&cfg.RateLimit), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		ready := time.Now().Add(-time.Second)
+		for _, task := range []EmailTask{
+			{ID: "low", Priority: PriorityLow, RetryAt: ready},
+			{ID: "normal", Priority: PriorityNormal, RetryAt: ready},
+			{ID: "high", Priority: PriorityHigh, RetryAt: ready},
+			{ID: "unset", RetryAt: ready},
+		} {
+			if err := queue.Push(task); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		queued := limiter.GetQueuedEmails()
+		var order []string
+		for _, task := range queued {
+			order = append(order, task.ID)
+		}
+		if len(order) != 4 || order[0] != "high" || order[1] != "normal" || order[2] != "unset" || order[3] != "low" {
+			t.Errorf("expected queued emails ordered high, normal, unset, low, got: %v", order)
+		}
+	})
+
+	t.Run("SendReadyDeliversQueuedEmails", func(t *testing.T) {
+		queue := NewMemoryQueue()
+		limits := &config.RateLimitConfig{PerHour: 3600, Burst: 1}
+		limiter, err := New(limits, log, sender, queue, NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		ready := time.Now().Add(-time.Second)
+		for _, id := range []string{"first", "second"} {
+			if err := queue.Push(EmailTask{ID: id, Recipients: []string{"test@example.com"}, Subject: "Test", Body: "<p>Test</p>", RetryAt: ready}); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		// The single token goes to the first email, whose send fails; the second waits for a token.
+		limiter.sendReady()
+		if limiter.QueuedFailed() != 1 || limiter.QueuedSent() != 0 {
+			t.Errorf("expected one failed queued send, got %d failed and %d sent", limiter.QueuedFailed(), limiter.QueuedSent())
+		}
+		if n, _ := queue.Len(); n != 1 {
+			t.Errorf("expected the rate-limited email to be requeued, got queue length: %d", n)
+		}
+	})
+
+	t.Run("SendReadyRetriesWithBackoff", func(t *testing.T) {
+		queue := NewMemoryQueue()
+		limits := &config.RateLimitConfig{PerHour: 3600, Burst: 2, Retry: config.RetryConfig{
+			MaxAttempts: 2, InitialDelay: time.Minute, Multiplier: 2, MaxDelay: 3 * time.Minute,
+		}}
+		limiter, err := New(limits, log, sender, queue, NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		if limiter.backoff(1) != time.Minute || limiter.backoff(2) != 2*time.Minute || limiter.backoff(3) != 3*time.Minute {
+			t.Errorf("expected backoff of 1m, 2m and a 3m cap, got: %s, %s, %s", limiter.backoff(1), limiter.backoff(2), limiter.backoff(3))
+		}
+
+		if err := queue.Push(EmailTask{ID: "retry", Recipients: []string{"test@example.com"}, Subject: "Test", Body: "<p>Test</p>", RetryAt: time.Now().Add(-time.Second)}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		limiter.sendReady()
+		task, ok, _ := queue.PopOldest()
+		if !ok || task.Attempts != 1 || task.RetryAt.Before(time.Now().Add(50*time.Second)) {
+			t.Fatalf("expected the failed email to be requeued after its first attempt, got: %+v (ok=%v)", task, ok)
+		}
+		if limiter.QueuedFailed() != 0 {
+			t.Errorf("expected no failed emails while attempts remain, got: %d", limiter.QueuedFailed())
+		}
+
+		task.RetryAt = time.Now().Add(-time.Second)
+		if err := queue.Push(task); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		limiter.sendReady()
+		if n, _ := queue.Len(); n != 0 || limiter.QueuedFailed() != 1 {
+			t.Errorf("expected the email to be dropped after its last attempt, got %d queued and %d failed", n, limiter.QueuedFailed())
+		}
+	})
+
+	t.Run("QuotaDefersSendsPastDailyLimit", func(t *testing.T) {
+		limits := &config.RateLimitConfig{PerHour: 3600, Burst: 10, DailyLimit: 2, MonthlyLimit: 100}
+		limiter, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		if !limiter.CanSend("", 1) || !limiter.CanSend("", 1) {
+			t.Fatal("expected sends within the daily quota to be allowed")
+		}
+		if limiter.CanSend("", 1) {
+			t.Error("expected send past the daily quota to be deferred")
+		}
+
+		daily, monthly := limiter.Quota()
+		if daily.Used != 2 || daily.Remaining() != 0 {
+			t.Errorf("expected daily quota to be used up, got: %+v", daily)
+		}
+		if monthly.Used != 2 || monthly.Remaining() != 98 {
+			t.Errorf("expected 98 sends left this month, got: %+v", monthly)
+		}
+	})
+
+	t.Run("RetryAfter", func(t *testing.T) {
+		limits := &config.RateLimitConfig{PerHour: 360, Burst: 1, DailyLimit: 1}
+		limiter, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		if got := limiter.RetryAfter(""); got != 10*time.Second {
+			t.Errorf("expected to retry after one token interval of 10s, got: %v", got)
+		}
+		limiter.CanSend("", 1)
+		if got := limiter.RetryAfter(""); got <= 0 || got > time.Hour {
+			t.Errorf("expected to retry within the hour once the daily quota is used up, got: %v", got)
+		}
+	})
+
+	t.Run("QuotaRollingWindows", func(t *testing.T) {
+		q := newQuota(0, 0)
+		now := time.Now()
+		q.record(now.Add(-25*time.Hour), 1)
+		q.record(now.Add(-time.Hour), 1)
+		q.record(now, 1)
+
+		daily, monthly := q.usage(now)
+		if daily.Used != 2 || monthly.Used != 3 {
+			t.Errorf("expected 2 sends in the last day and 3 in the last month, got %d and %d", daily.Used, monthly.Used)
+		}
+		if daily.Remaining() != -1 {
+			t.Errorf("expected unlimited quota to report -1 remaining, got: %d", daily.Remaining())
+		}
+
+		_, monthly = q.usage(now.Add(31 * 24 * time.Hour))
+		if monthly.Used != 0 {
+			t.Errorf("expected sends older than 30 days to roll off, got: %d", monthly.Used)
+		}
+	})
+
+	t.Run("ParsePriority", func(t *testing.T) {
+		if p, err := ParsePriority(""); err != nil || p != PriorityNormal {
+			t.Errorf("expected empty priority to default to normal, got: %q (err=%v)", p, err)
+		}
+		if p, err := ParsePriority("high"); err != nil || p != PriorityHigh {
+			t.Errorf("expected high priority, got: %q (err=%v)", p, err)
+		}
+		if _, err := ParsePriority("urgent"); err == nil {
+			t.Error("expected error for unknown priority, got none")
+		}
+	})
+
+	t.Run("QueueFullRejects", func(t *testing.T) {
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 1, MaxQueueSize: 1, OverflowPolicy: OverflowReject}
+		limiter, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		recipients := []string{"test@example.com"}
+		if err := limiter.QueueEmail("welcome", email.Message{Recipients: recipients, Subject: "First", HTMLBody: "<p>First</p>"}, PriorityNormal); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := limiter.QueueEmail("welcome", email.Message{Recipients: recipients, Subject: "Second", HTMLBody: "<p>Second</p>"}, PriorityNormal); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("expected ErrQueueFull, got: %v", err)
+		}
+		if n := limiter.QueueLen(); n != 1 {
+			t.Errorf("expected 1 queued email, got: %d", n)
+		}
+	})
+
+	t.Run("QueueFullDropsOldest", func(t *testing.T) {
+		queue := NewMemoryQueue()
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 1, MaxQueueSize: 1, OverflowPolicy: OverflowDropOldest}
+		limiter, err := New(limits, log, sender, queue, NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		recipients := []string{"test@example.com"}
+		for _, subject := range []string{"First", "Second"} {
+			if err := limiter.QueueEmail("welcome", email.Message{Recipients: recipients, Subject: subject, HTMLBody: "<p>Test</p>"}, PriorityNormal); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+		if limiter.QueuedDropped() != 1 {
+			t.Errorf("expected 1 dropped email, got: %d", limiter.QueuedDropped())
+		}
+		task, ok, err := queue.PopOldest()
+		if err != nil || !ok || task.Subject != "Second" {
+			t.Errorf("expected the newest email to remain queued, got: %+v (ok=%v, err=%v)", task, ok, err)
+		}
+	})
+
+	t.Run("QueueFullSpills", func(t *testing.T) {
+		spill := NewMemoryQueue()
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 1, MaxQueueSize: 1, OverflowPolicy: OverflowSpill}
+		if _, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil); err == nil {
+			t.Error("expected error for spill policy without a spill queue, got none")
+		}
+		limiter, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), spill)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		recipients := []string{"test@example.com"}
+		for _, subject := range []string{"First", "Second"} {
+			if err := limiter.QueueEmail("welcome", email.Message{Recipients: recipients, Subject: subject, HTMLBody: "<p>Test</p>"}, PriorityNormal); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+		if n, _ := spill.Len(); n != 1 {
+			t.Errorf("expected 1 spilled email, got: %d", n)
+		}
+		if n := limiter.QueueLen(); n != 2 {
+			t.Errorf("expected queue length to include spilled emails, got: %d", n)
+		}
+	})
+
+	t.Run("SendWindow", func(t *testing.T) {
+		w, err := newWindow(&config.SendWindowConfig{Start: "08:00", End: "20:00", Timezone: "UTC", ExemptTemplates: []string{"password_reset"}})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		night := time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)
+		if w.allows("welcome", night) {
+			t.Error("expected the window to be closed at 22:30")
+		}
+		if !w.allows("password_reset", night) {
+			t.Error("expected exempt template to be allowed outside the window")
+		}
+		if !w.allows("welcome", time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)) {
+			t.Error("expected the window to be open at 08:00")
+		}
+		if opens := w.opens(night); !opens.Equal(time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected the window to open at 08:00 the next day, got: %s", opens)
+		}
+
+		overnight, err := newWindow(&config.SendWindowConfig{Start: "22:00", End: "06:00"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if !overnight.allows("welcome", night) || overnight.allows("welcome", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+			t.Error("expected a window spanning midnight to be open at 22:30 and closed at noon")
+		}
+
+		if _, err := newWindow(&config.SendWindowConfig{Start: "8am", End: "20:00"}); err == nil {
+			t.Error("expected error for malformed window start, got none")
+		}
+	})
+
+	t.Run("QueueEmailDefersOutsideWindow", func(t *testing.T) {
+		queue := NewMemoryQueue()
+		// A one-minute window that has just closed stays closed for almost a day.
+		closed := time.Now().UTC().Add(-2 * time.Minute)
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 1, SendWindow: config.SendWindowConfig{
+			Start:    closed.Format("15:04"),
+			End:      closed.Add(time.Minute).Format("15:04"),
+			Timezone: "UTC",
+		}}
+		limiter, err := New(limits, log, sender, queue, NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		if limiter.WindowOpen("welcome") {
+			t.Fatal("expected the send window to be closed")
+		}
+		if err := limiter.QueueEmail("welcome", email.Message{Recipients: []string{"test@example.com"}, Subject: "Test", HTMLBody: "<p>Test</p>"}, PriorityNormal); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		task, ok, _ := queue.PopOldest()
+		if !ok || task.RetryAt.Before(time.Now().Add(time.Hour)) {
+			t.Errorf("expected the email to be held until the window opens, got: %+v", task)
+		}
+	})
+
+	t.Run("MetricsTrackQueueAndTokens", func(t *testing.T) {
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 2}
+		limiter, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		if tokens := limiter.Tokens(); tokens != 2 {
+			t.Errorf("expected a full bucket of 2 tokens, got: %g", tokens)
+		}
+		limiter.CanSend("", 1)
+		if tokens := limiter.Tokens(); tokens >= 2 {
+			t.Errorf("expected a token to be taken, got: %g", tokens)
+		}
+		if err := limiter.QueueEmail("welcome", email.Message{Recipients: []string{"test@example.com"}, Subject: "Test", HTMLBody: "<p>Test</p>"}, PriorityNormal); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if limiter.Deferred() != 1 || limiter.QueueLen() != 1 {
+			t.Errorf("expected 1 deferred and queued email, got %d deferred and %d queued", limiter.Deferred(), limiter.QueueLen())
+		}
+		if n := len(limiter.Collectors()); n != 6 {
+			t.Errorf("expected 6 collectors, got: %d", n)
+		}
+	})
+
+	t.Run("ThrottleBacksOffAndRecovers", func(t *testing.T) {
+		th := newThrottle(&config.RateLimitConfig{PerHour: 3600, Burst: 5, Adaptive: config.AdaptiveConfig{
+			Enabled: true, Backoff: 0.5, MinFactor: 0.2, Cooldown: time.Minute,
+		}})
+		now := time.Now()
+		if !th.allow(now) || !th.allow(now) {
+			t.Error("expected sends to be unrestricted before any pushback")
+		}
+
+		th.slowDown(now)
+		if f := th.rateFactor(now); f != 0.5 {
+			t.Errorf("expected rate factor 0.5 after one slowdown, got: %g", f)
+		}
+		th.slowDown(now)
+		th.slowDown(now)
+		if f := th.rateFactor(now); f != 0.2 {
+			t.Errorf("expected rate factor to bottom out at 0.2, got: %g", f)
+		}
+		if !th.allow(now) || th.allow(now) {
+			t.Error("expected only one send at a time while throttled")
+		}
+
+		if f := th.rateFactor(now.Add(time.Minute)); f != 0.4 {
+			t.Errorf("expected rate factor to double after one cooldown, got: %g", f)
+		}
+		if f := th.rateFactor(now.Add(3 * time.Minute)); f != 1 {
+			t.Errorf("expected full rate after enough cooldowns, got: %g", f)
+		}
+	})
+
+	t.Run("ObserveSendErrorThrottles", func(t *testing.T) {
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 2, Adaptive: config.AdaptiveConfig{
+			Enabled: true, Backoff: 0.5, MinFactor: 0.1, Cooldown: time.Minute,
+		}}
+		limiter, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		limiter.ObserveSendError(errors.New("connection refused"))
+		if f := limiter.RateFactor(); f != 1 {
+			t.Errorf("expected other errors not to throttle, got rate factor: %g", f)
+		}
+		limiter.ObserveSendError(fmt.Errorf("failed to send email: %w", email.ErrThrottled))
+		if f := limiter.RateFactor(); f != 0.5 {
+			t.Errorf("expected rate factor 0.5 after SMTP pushback, got: %g", f)
+		}
+		if limiter.RetryAfter("") != 12*time.Second {
+			t.Errorf("expected retry after to reflect the reduced rate, got: %s", limiter.RetryAfter(""))
+		}
+
+		single := *limits
+		single.Burst = 1
+		empty, err := New(&single, log, sender, NewMemoryQueue(), NewMemoryBucket(&single), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer empty.Stop()
+		if !empty.CanSend("", 1) {
+			t.Fatal("expected the first send to take the only token")
+		}
+		empty.ObserveSendError(email.ErrThrottled)
+		if empty.CanSend("", 1) {
+			t.Error("expected no send while the bucket is empty")
+		}
+		if !empty.throttle.allow(time.Now()) {
+			t.Error("expected a send refused by the bucket not to use the throttle token")
+		}
+	})
+
+	t.Run("CircuitBreaker", func(t *testing.T) {
+		b := newBreaker(&config.RateLimitConfig{CircuitBreaker: config.BreakerConfig{Enabled: true, Failures: 2, Cooldown: time.Minute}})
+		now := time.Now()
+		if b.failure(now) || !b.allow(now) {
+			t.Error("expected the breaker to stay closed below the failure threshold")
+		}
+		if !b.failure(now) || b.allow(now) {
+			t.Error("expected the breaker to open at the failure threshold")
+		}
+		if !b.allow(now.Add(time.Minute)) || b.allow(now.Add(time.Minute)) {
+			t.Error("expected a single trial send after the cooldown")
+		}
+		if state, _ := b.status(); state != BreakerHalfOpen {
+			t.Errorf("expected the breaker to be half-open during the trial, got: %s", state)
+		}
+		b.failure(now.Add(time.Minute))
+		if b.allow(now.Add(90 * time.Second)) {
+			t.Error("expected a failed trial to reopen the breaker for another cooldown")
+		}
+		if !b.allow(now.Add(2*time.Minute)) || !b.success() || !b.allow(now.Add(2*time.Minute)) {
+			t.Error("expected a successful trial to close the breaker")
+		}
+
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 2, CircuitBreaker: config.BreakerConfig{Enabled: true, Failures: 1, Cooldown: time.Minute}}
+		limiter, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		limiter.ObserveSendError(&email.SendError{Err: errors.New("recipient rejected")})
+		if limiter.BreakerState() != BreakerClosed {
+			t.Error("expected permanent failures not to open the breaker")
+		}
+		limiter.ObserveSendError(&email.SendError{Err: errors.New("connection refused"), Transient: true})
+		if limiter.BreakerState() != BreakerOpen || limiter.CanSend("", 1) {
+			t.Error("expected a transient failure to open the breaker and hold sends")
+		}
+		if retryAfter := limiter.RetryAfter(""); retryAfter <= 0 || retryAfter > time.Minute {
+			t.Errorf("expected retry after to wait for the trial send, got: %s", retryAfter)
+		}
+		limiter.ObserveSendSuccess()
+		if limiter.BreakerState() != BreakerClosed || !limiter.CanSend("", 1) {
+			t.Error("expected a successful send to close the breaker")
+		}
+
+		// A trial the bucket has no tokens for is not sent, so it does not hold sends for
+		// another cooldown.
+		limits = &config.RateLimitConfig{PerHour: 600, Burst: 1, CircuitBreaker: config.BreakerConfig{Enabled: true, Failures: 1, Cooldown: time.Millisecond}}
+		empty, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer empty.Stop()
+		if !empty.CanSend("", 1) {
+			t.Fatal("expected the burst to be available")
+		}
+		empty.ObserveSendError(&email.SendError{Err: errors.New("connection refused"), Transient: true})
+		time.Sleep(5 * time.Millisecond)
+		if empty.CanSend("", 1) {
+			t.Error("expected the trial to wait for a token")
+		}
+		if state, trialAt := empty.breaker.status(); state != BreakerOpen || trialAt.After(time.Now()) {
+			t.Errorf("expected the trial without tokens to be withdrawn, got %s until %s", state, trialAt)
+		}
+	})
+
+	t.Run("PerRecipientCost", func(t *testing.T) {
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 5, PerRecipient: true}
+		limiter, err := New(limits, log, sender, NewMemoryQueue(), NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer limiter.Stop()
+
+		if !limiter.CanSend("", 3) {
+			t.Error("expected a send to 3 recipients to fit in a burst of 5")
+		}
+		if limiter.CanSend("", 3) {
+			t.Error("expected a second send to 3 recipients to exceed the remaining tokens")
+		}
+		if !limiter.CanSend("", 2) {
+			t.Error("expected a send to 2 recipients to use the remaining tokens")
+		}
+		if cost := limiter.cost(500); cost != 500 {
+			t.Errorf("expected a token per recipient of a large send, got: %d", cost)
+		}
+		if daily, _ := limiter.Quota(); daily.Used != 5 {
+			t.Errorf("expected the quota to count a send per recipient, got: %+v", daily)
+		}
+
+		bucket := NewMemoryBucket(limits)
+		now := time.Now()
+		if ok, _ := bucket.Take(now, 12); !ok {
+			t.Fatal("expected a full bucket to take more tokens than its burst")
+		}
+		if tokens, _ := bucket.Tokens(now); tokens != -7 {
+			t.Errorf("expected the bucket to be 7 tokens in debt, got: %v", tokens)
+		}
+		if ok, _ := bucket.Take(now.Add(time.Minute), 12); ok {
+			t.Error("expected a bucket in debt to refuse a large send until it is full again")
+		}
+		if ok, _ := bucket.Take(now.Add(72*time.Second), 5); !ok {
+			t.Error("expected the debt to be refilled at the configured rate")
+		}
+
+		flat, err := New(&cfg.RateLimit, log, sender, NewMemoryQueue(), NewMemoryBucket(&cfg.RateLimit), nil)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer flat.Stop()
+		if cost := flat.cost(500); cost != 1 {
+			t.Errorf("expected one token per send without per_recipient, got: %d", cost)
+		}
+	})
+
+	t.Run("PersistentBucketRestoresState", func(t *testing.T) {
+		limits := &config.RateLimitConfig{PerHour: 600, Burst: 3}
+		store := &stateStore{}
+		first, err := NewPersistentBucket(limits, store)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		now := time.Now()
+		if ok, _ := first.Take(now, 3); !ok {
+			t.Fatal("expected the initial burst to be available")
+		}
+		if err := first.(snapshotter).snapshot(now); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		restored, err := NewPersistentBucket(limits, store)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if ok, _ := restored.Take(now, 1); ok {
+			t.Error("expected the restored bucket to be empty instead of granting a fresh burst")
+		}
+		// At 600 per hour, one token is refilled every 6 seconds.
+		if ok, _ := restored.Take(now.Add(6*time.Second), 1); !ok {
+			t.Error("expected the restored bucket to refill from the snapshot time")
+		}
+	})
+
 	t.Run("StartAndStop", func(t *testing.T) {
-		limiter, err := New(&cfg.RateLimit, log)
+		limiter, err := New(&cfg.RateLimit, log, sender, NewMemoryQueue(), NewMemoryBucket(&cfg.RateLimit), nil)
 		if err != nil {
 			t.Fatalf("expected no error, got: %v", err)
 		}
@@ -94,14 +702,16 @@ func TestLimiter(t *testing.T) {
 	})
 
 	t.Run("QueueProcessing", func(t *testing.T) {
-		limiter, err := New(&cfg.RateLimit, log)
+		limiter, err := New(&cfg.RateLimit, log, sender, NewMemoryQueue(), NewMemoryBucket(&cfg.RateLimit), nil)
 		if err != nil {
 			t.Fatalf("expected no error, got: %v", err)
 		}
 		defer limiter.Stop()
 
 		recipients := []string{"test@example.com"}
-		limiter.QueueEmail(recipients, "Test Subject", "<p>Test Body</p>")
+		if err := limiter.QueueEmail("welcome", email.Message{Recipients: recipients, Subject: "Test Subject", HTMLBody: "<p>Test Body</p>"}, PriorityNormal); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
 
 		limiter.Start()
 		time.Sleep(11 * time.Second)
@@ -111,4 +721,53 @@ func TestLimiter(t *testing.T) {
 			t.Logf("queued emails still present, may not have been processed yet: %d", len(queued))
 		}
 	})
+
+	t.Run("ShutdownFlushesMemoryQueue", func(t *testing.T) {
+		dryRun := email.NewDryRun(sender, cfg, log)
+		for _, tc := range []struct {
+			name    string
+			timeout time.Duration
+			sent    int64
+		}{
+			{"Shutdown", 5 * time.Second, 1},
+			{"TimedOut", 0, 0},
+		} {
+			limiter, err := New(&cfg.RateLimit, log, dryRun, NewMemoryQueue(), NewMemoryBucket(&cfg.RateLimit), nil)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			msg := email.Message{Recipients: []string{"test@example.com"}, Subject: "Test Subject", HTMLBody: "<p>Test Body</p>", DryRun: true}
+			if err := limiter.QueueEmail("welcome", msg, PriorityNormal); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			limiter.Start()
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			limiter.Shutdown(ctx)
+			cancel()
+			if sent := limiter.QueuedSent(); sent != tc.sent {
+				t.Errorf("%s: expected %d queued emails to be sent, got %d", tc.name, tc.sent, sent)
+			}
+			if n := limiter.QueueLen(); n != 1-int(tc.sent) {
+				t.Errorf("%s: expected %d emails left in the queue, got %d", tc.name, 1-tc.sent, n)
+			}
+		}
+	})
+}
+
+// stateStore is an in-memory BucketStore for tests.
+type stateStore struct {
+	state *BucketState
+}
+
+func (s *stateStore) Save(state BucketState) error {
+	s.state = &state
+	return nil
+}
+
+func (s *stateStore) Load() (BucketState, bool, error) {
+	if s.state == nil {
+		return BucketState{}, false, nil
+	}
+	return *s.state, true, nil
 }
@@ -0,0 +1,116 @@
+package rate
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"runebird/internal/config"
+)
+
+// throttle lowers the effective send rate after the SMTP server pushes back, then ramps it
+// up again. Each slowdown multiplies the rate factor by backoff, down to minFactor, and every
+// cooldown without further pushback divides it by backoff until the full rate is restored.
+// A nil throttle never limits sends.
+type throttle struct {
+	base      float64
+	backoff   float64
+	minFactor float64
+	cooldown  time.Duration
+	factor    float64
+	until     time.Time
+	limiter   *rate.Limiter
+	mu        sync.Mutex
+}
+
+// newThrottle creates a throttle for cfg, or returns nil if adaptive throttling is disabled.
+func newThrottle(cfg *config.RateLimitConfig) *throttle {
+	if !cfg.Adaptive.Enabled {
+		return nil
+	}
+	base := float64(cfg.PerHour) / 3600.0
+	return &throttle{
+		base:      base,
+		backoff:   cfg.Adaptive.Backoff,
+		minFactor: cfg.Adaptive.MinFactor,
+		cooldown:  cfg.Adaptive.Cooldown,
+		factor:    1,
+		limiter:   rate.NewLimiter(rate.Limit(base), 1),
+	}
+}
+
+// allow reports whether a send may go ahead at the current, possibly reduced, rate.
+func (t *throttle) allow(now time.Time) bool {
+	ok, _ := t.reserve(now)
+	return ok
+}
+
+// reserve is allow, also returning the reservation of the token the send uses while the rate
+// is reduced, or nil, for cancel to give back if the send does not go ahead after all.
+func (t *throttle) reserve(now time.Time) (bool, *rate.Reservation) {
+	if t == nil {
+		return true, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.recover(now)
+	if t.factor >= 1 {
+		return true, nil
+	}
+	reservation := t.limiter.ReserveN(now, 1)
+	if reservation.DelayFrom(now) > 0 {
+		reservation.CancelAt(now)
+		return false, nil
+	}
+	return true, reservation
+}
+
+// cancel gives back the token of a reservation made at now for a send that did not go ahead.
+func (t *throttle) cancel(reservation *rate.Reservation, now time.Time) {
+	if reservation == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reservation.CancelAt(now)
+}
+
+// slowDown reduces the rate factor and restarts the cooldown.
+func (t *throttle) slowDown(now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.factor = math.Max(t.factor*t.backoff, t.minFactor)
+	t.until = now.Add(t.cooldown)
+	t.limiter.SetLimitAt(now, rate.Limit(t.base*t.factor))
+}
+
+// rateFactor returns the fraction of the configured rate currently in effect.
+func (t *throttle) rateFactor(now time.Time) float64 {
+	if t == nil {
+		return 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.recover(now)
+	return t.factor
+}
+
+// recover steps the rate factor back up for each cooldown that has passed. The caller must hold t.mu.
+func (t *throttle) recover(now time.Time) {
+	changed := false
+	for t.factor < 1 && !now.Before(t.until) {
+		t.factor = math.Min(t.factor/t.backoff, 1)
+		t.until = t.until.Add(t.cooldown)
+		changed = true
+	}
+	if changed {
+		t.limiter.SetLimitAt(now, rate.Limit(t.base*t.factor))
+	}
+}
@@ -0,0 +1,80 @@
+package rate
+
+import (
+	"fmt"
+	"time"
+
+	"runebird/internal/config"
+)
+
+// window restricts sending to a daily range of local times. A nil window allows sending at
+// any time.
+type window struct {
+	start  time.Duration
+	end    time.Duration
+	loc    *time.Location
+	exempt map[string]bool
+}
+
+// newWindow parses the send window configuration. It returns nil if no window is configured.
+func newWindow(cfg *config.SendWindowConfig) (*window, error) {
+	if cfg.Start == "" && cfg.End == "" {
+		return nil, nil
+	}
+	start, err := parseClock(cfg.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid send window start %q: %v", cfg.Start, err)
+	}
+	end, err := parseClock(cfg.End)
+	if err != nil {
+		return nil, fmt.Errorf("invalid send window end %q: %v", cfg.End, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("send window start and end must differ, got %s", cfg.Start)
+	}
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid send window timezone %q: %v", cfg.Timezone, err)
+	}
+
+	exempt := make(map[string]bool, len(cfg.ExemptTemplates))
+	for _, name := range cfg.ExemptTemplates {
+		exempt[name] = true
+	}
+	return &window{start: start, end: end, loc: loc, exempt: exempt}, nil
+}
+
+// parseClock parses a time of day in HH:MM form into the offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// allows reports whether an email rendered from template may be sent at now. Windows whose
+// end is before their start span midnight.
+func (w *window) allows(template string, now time.Time) bool {
+	if w == nil || w.exempt[template] {
+		return true
+	}
+	local := now.In(w.loc)
+	offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// opens returns the next time after now at which the window opens.
+func (w *window) opens(now time.Time) time.Time {
+	local := now.In(w.loc)
+	y, m, d := local.Date()
+	for day := 0; ; day++ {
+		start := time.Date(y, m, d+day, 0, int(w.start/time.Minute), 0, 0, w.loc)
+		if start.After(now) {
+			return start
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package scheduler
+
+import "sync"
+
+// workerPool runs jobs concurrently with at most size jobs in flight at a time.
+type workerPool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &workerPool{slots: make(chan struct{}, size)}
+}
+
+// submit runs job on a worker, blocking while all workers are busy. Jobs start in the
+// order they are submitted.
+func (p *workerPool) submit(job func()) {
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.slots
+			p.wg.Done()
+		}()
+		job()
+	}()
+}
+
+// wait blocks until all submitted jobs have finished.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
@@ -4,46 +4,160 @@ import (
 	"context"
 	"fmt"
 	"go.uber.org/zap"
+	"math"
+	"runebird/internal/config"
 	"runebird/internal/email"
 	"runebird/internal/logger"
 	"runebird/internal/rate"
 	"runebird/internal/templates"
+	"runebird/internal/webhook"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// maxIdleWait bounds how long the dispatch loop sleeps between store checks.
+const maxIdleWait = time.Minute
+
+// TaskStatus is a stage in the lifecycle of a scheduled task.
+type TaskStatus string
+
+const (
+	StatusPending   TaskStatus = "pending"
+	StatusRendering TaskStatus = "rendering"
+	StatusSending   TaskStatus = "sending"
+	StatusQueued    TaskStatus = "queued"
+	StatusSent      TaskStatus = "sent"
+	StatusFailed    TaskStatus = "failed"
+	StatusCancelled TaskStatus = "cancelled"
+	StatusExpired   TaskStatus = "expired"
+)
+
+// StatusChange records when a task entered a status.
+type StatusChange struct {
+	Status TaskStatus `json:"status"`
+	At     time.Time  `json:"at"`
+	Error  string     `json:"error,omitempty"`
+}
+
 type ScheduledTask struct {
-	ID         string
-	Template   string
-	Recipients []string
-	Data       map[string]interface{}
-	SendAt     time.Time
+	ID              string                 `json:"id"`
+	Template        string                 `json:"template"`
+	TemplateVersion int                    `json:"template_version,omitempty"`
+	Locale          string                 `json:"locale,omitempty"`
+	From            string                 `json:"from,omitempty"`
+	Profile         string                 `json:"profile,omitempty"`
+	Recipients      []string               `json:"recipients"`
+	Data            map[string]interface{} `json:"data"`
+	SendAt          time.Time              `json:"send_at"`
+	ExpiresAt       *time.Time             `json:"expires_at,omitempty"`
+	CreatedAt       time.Time              `json:"created_at"`
+	Status          TaskStatus             `json:"status"`
+	UpdatedAt       time.Time              `json:"updated_at"`
+	LastError       string                 `json:"last_error,omitempty"`
+	Attempts        int                    `json:"attempts"`
+	CallbackURL     string                 `json:"callback_url,omitempty"`
+	Priority        rate.Priority          `json:"priority,omitempty"`
+	ReplyTo         string                 `json:"reply_to,omitempty"`
+	Headers         map[string]string      `json:"headers,omitempty"`
+	Attachments     []email.Attachment     `json:"attachments,omitempty"`
+	DryRun          bool                   `json:"dry_run,omitempty"`
+	MessageID       string                 `json:"message_id,omitempty"`
+	Rejected        []email.Rejection      `json:"rejected,omitempty"`
+	Suppressed      []string               `json:"suppressed,omitempty"`
+	History         []StatusChange         `json:"history"`
+	// Content is the email to send as given by the request, for a task without a template.
+	Content *Content `json:"content,omitempty"`
+}
+
+// Content is the subject and bodies of an email rendered by the caller rather than from a
+// template. Without a TextBody, the plain-text version is derived from HTMLBody.
+type Content struct {
+	Subject  string `json:"subject"`
+	HTMLBody string `json:"html_body"`
+	TextBody string `json:"text_body,omitempty"`
+}
+
+// TaskEvent is the webhook payload describing a task that finished.
+type TaskEvent struct {
+	TaskID   string     `json:"task_id"`
+	Template string     `json:"template"`
+	Status   TaskStatus `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Attempts int        `json:"attempts"`
+}
+
+// setStatus moves the task to status, recording the transition and any error.
+func (t *ScheduledTask) setStatus(status TaskStatus, err error) {
+	now := time.Now().UTC()
+	change := StatusChange{Status: status, At: now}
+	if err != nil {
+		change.Error = err.Error()
+		t.LastError = change.Error
+	}
+	t.Status = status
+	t.UpdatedAt = now
+	t.History = append(t.History, change)
+}
+
+// ListOptions filters and paginates the tasks returned by List.
+type ListOptions struct {
+	Template string
+	From     time.Time
+	To       time.Time
+	Offset   int
+	Limit    int
 }
 
 type Scheduler struct {
-	tasks       map[string]ScheduledTask
+	cfg         *config.SchedulerConfig
+	store       Store
 	mu          sync.Mutex
 	logger      *logger.Logger
-	sender      *email.Sender
+	sender      email.Sender
 	templates   *templates.TemplateManager
 	rateLimiter *rate.Limiter
+	webhooks    *webhook.Client
+	workers     *workerPool
+	expired     atomic.Int64
+	failed      atomic.Int64
 	isRunning   bool
+	paused      bool
+	wake        chan struct{}
+	stop        chan struct{}
+	done        chan struct{}
 	ctx         context.Context
 	cancel      context.CancelFunc
 }
 
-func New(log *logger.Logger, sender *email.Sender, templates *templates.TemplateManager, rateLimiter *rate.Limiter) *Scheduler {
+// TaskUpdate describes changes to a pending task. Nil fields are left unchanged.
+type TaskUpdate struct {
+	SendAt     *time.Time
+	Recipients []string
+	Data       map[string]interface{}
+}
+
+func New(cfg *config.SchedulerConfig, log *logger.Logger, sender email.Sender, templates *templates.TemplateManager, rateLimiter *rate.Limiter, store Store, webhooks *webhook.Client) *Scheduler {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Scheduler{
-		tasks:       make(map[string]ScheduledTask),
+	s := &Scheduler{
+		cfg:         cfg,
+		store:       store,
 		logger:      log,
 		sender:      sender,
 		templates:   templates,
 		rateLimiter: rateLimiter,
+		webhooks:    webhooks,
+		workers:     newWorkerPool(cfg.Workers),
 		isRunning:   false,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
 		ctx:         ctx,
 		cancel:      cancel,
 	}
+	// Tasks handed to the rate limit queue are finished once the queue sends them.
+	rateLimiter.Observe(s.finishQueued)
+	return s
 }
 
 func (s *Scheduler) Start() {
@@ -59,7 +173,18 @@ func (s *Scheduler) Start() {
 	s.logger.Info("Scheduler started")
 }
 
+// Stop halts dispatching, interrupting tasks that are already being sent, and waits for them
+// to be put back in the store.
 func (s *Scheduler) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+}
+
+// Shutdown halts dispatching and waits for tasks that are already being sent to finish, until
+// ctx is done. Tasks claimed but not started yet are put back in the store untouched, and
+// sends still in progress once ctx is done are interrupted and retried later.
+func (s *Scheduler) Shutdown(ctx context.Context) {
 	s.mu.Lock()
 	if !s.isRunning {
 		s.mu.Unlock()
@@ -68,87 +193,527 @@ func (s *Scheduler) Stop() {
 	s.isRunning = false
 	s.mu.Unlock()
 
+	close(s.stop)
+	finished := make(chan struct{})
+	go func() {
+		<-s.done
+		s.workers.wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		s.cancel()
+		<-finished
+	}
 	s.cancel()
+
+	if _, inMemory := s.store.(*memoryStore); inMemory {
+		if pending, err := s.store.List(time.Time{}, time.Time{}); err == nil && len(pending) > 0 {
+			s.logger.Warn("Scheduled emails are kept in memory and lost on shutdown", zap.Int("tasks", len(pending)))
+		}
+	}
 	s.logger.Info("Scheduler stopped")
 }
 
-func (s *Scheduler) Schedule(id, template string, recipients []string, data map[string]interface{}, sendAt time.Time) error {
+// Pause stops dispatching due tasks until Resume is called. Tasks keep accumulating in the
+// store and tasks that are already being sent are not interrupted.
+func (s *Scheduler) Pause() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.paused = true
+	s.mu.Unlock()
+	s.logger.Info("Scheduler dispatching paused")
+}
 
-	if _, exists := s.tasks[id]; exists {
-		return fmt.Errorf("task with ID %s already exists", id)
-	}
+// Resume restarts dispatching, immediately sending any tasks that fell due while paused.
+func (s *Scheduler) Resume() {
+	s.mu.Lock()
+	s.paused = false
+	s.mu.Unlock()
+	s.reschedule()
+	s.logger.Info("Scheduler dispatching resumed")
+}
 
-	sendAt = sendAt.UTC()
+// Paused reports whether dispatching is currently paused.
+func (s *Scheduler) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
 
-	task := ScheduledTask{
+func (s *Scheduler) Schedule(id, template string, recipients []string, data map[string]interface{}, sendAt time.Time) error {
+	return s.ScheduleTask(ScheduledTask{
 		ID:         id,
 		Template:   template,
 		Recipients: recipients,
 		Data:       data,
 		SendAt:     sendAt,
+	})
+}
+
+// ScheduleTask adds a new pending task. Only the request fields of task are used; its
+// status, timestamps and attempt count are initialised by the scheduler, and an unset
+// priority defaults to normal.
+func (s *Scheduler) ScheduleTask(task ScheduledTask) error {
+	task.SendAt = task.SendAt.UTC()
+	if task.ExpiresAt != nil {
+		expiresAt := task.ExpiresAt.UTC()
+		if !expiresAt.After(task.SendAt) {
+			return fmt.Errorf("%w: expiry time %s must be after the send time", ErrInvalidTask, expiresAt.Format(time.RFC3339))
+		}
+		task.ExpiresAt = &expiresAt
 	}
+	task.CreatedAt = time.Now().UTC()
+	if task.Priority == "" {
+		task.Priority = rate.PriorityNormal
+	}
+	task.Attempts = 0
+	task.LastError = ""
+	task.History = nil
+	task.setStatus(StatusPending, nil)
 
-	s.tasks[id] = task
-	s.logger.Info("Scheduled email task", zap.String("id", id), zap.Time("send_at", sendAt))
+	if err := s.store.Add(task); err != nil {
+		return err
+	}
+	s.reschedule()
+	s.logger.Info("Scheduled email task", zap.String("id", task.ID), zap.Time("send_at", task.SendAt))
 	return nil
 }
 
+// Update applies the given changes to a pending task and returns the updated task.
+func (s *Scheduler) Update(id string, update TaskUpdate) (ScheduledTask, error) {
+	task, ok, err := s.store.Get(id)
+	if err != nil {
+		return ScheduledTask{}, fmt.Errorf("failed to load task %s: %v", id, err)
+	}
+	if !ok || task.Status != StatusPending {
+		return ScheduledTask{}, ErrTaskNotFound
+	}
+
+	if update.SendAt != nil {
+		sendAt := update.SendAt.UTC()
+		if !sendAt.After(time.Now().UTC()) {
+			return ScheduledTask{}, fmt.Errorf("%w: send time %s must be in the future", ErrInvalidTask, sendAt.Format(time.RFC3339))
+		}
+		if task.ExpiresAt != nil && !task.ExpiresAt.After(sendAt) {
+			return ScheduledTask{}, fmt.Errorf("%w: send time %s must be before the task expires at %s", ErrInvalidTask, sendAt.Format(time.RFC3339), task.ExpiresAt.Format(time.RFC3339))
+		}
+		task.SendAt = sendAt
+	}
+	if update.Recipients != nil {
+		if len(update.Recipients) == 0 {
+			return ScheduledTask{}, fmt.Errorf("%w: at least one recipient is required", ErrInvalidTask)
+		}
+		task.Recipients = update.Recipients
+	}
+	if update.Data != nil {
+		task.Data = update.Data
+	}
+
+	if err := s.store.Update(task); err != nil {
+		return ScheduledTask{}, err
+	}
+	s.reschedule()
+	s.logger.Info("Updated scheduled email task", zap.String("id", id), zap.Time("send_at", task.SendAt))
+	return task, nil
+}
+
+// Get returns the current record of a task, including tasks that are no longer pending.
+func (s *Scheduler) Get(id string) (ScheduledTask, error) {
+	task, ok, err := s.store.Get(id)
+	if err != nil {
+		return ScheduledTask{}, fmt.Errorf("failed to load task %s: %v", id, err)
+	}
+	if !ok {
+		return ScheduledTask{}, ErrTaskNotFound
+	}
+	return task, nil
+}
+
+// Cancel withdraws a pending task so it is never sent and returns its cancelled record.
+func (s *Scheduler) Cancel(id string) (ScheduledTask, error) {
+	task, ok, err := s.store.Get(id)
+	if err != nil {
+		return ScheduledTask{}, fmt.Errorf("failed to load task %s: %v", id, err)
+	}
+	if !ok || task.Status != StatusPending {
+		return ScheduledTask{}, ErrTaskNotFound
+	}
+
+	removed, err := s.store.Remove(id)
+	if err != nil {
+		return ScheduledTask{}, fmt.Errorf("failed to cancel task %s: %v", id, err)
+	}
+	if !removed {
+		return ScheduledTask{}, ErrTaskNotFound
+	}
+	s.reschedule()
+
+	task.setStatus(StatusCancelled, nil)
+	s.saveStatus(task)
+	s.logger.Info("Cancelled scheduled email task", zap.String("id", id))
+	return task, nil
+}
+
+// RunNow withdraws a pending task from its slot and sends it immediately, returning the task's
+// record once the attempt has finished. A failed attempt is retried as usual if attempts remain.
+// Tasks are run even while dispatching is paused.
+func (s *Scheduler) RunNow(id string) (ScheduledTask, error) {
+	task, ok, err := s.store.Get(id)
+	if err != nil {
+		return ScheduledTask{}, fmt.Errorf("failed to load task %s: %v", id, err)
+	}
+	if !ok || task.Status != StatusPending {
+		return ScheduledTask{}, ErrTaskNotFound
+	}
+
+	removed, err := s.store.Remove(id)
+	if err != nil {
+		return ScheduledTask{}, fmt.Errorf("failed to claim task %s: %v", id, err)
+	}
+	if !removed {
+		return ScheduledTask{}, ErrTaskNotFound
+	}
+	s.reschedule()
+
+	s.logger.Info("Running scheduled email task now", zap.String("id", id), zap.Time("send_at", task.SendAt))
+	s.processTask(id, task)
+	return s.Get(id)
+}
+
+// Expired returns the number of tasks this scheduler has marked expired instead of sending.
+func (s *Scheduler) Expired() int64 {
+	return s.expired.Load()
+}
+
+// Failed returns the number of tasks this scheduler has marked failed once their retries, if
+// any, were exhausted.
+func (s *Scheduler) Failed() int64 {
+	return s.failed.Load()
+}
+
+// Backlog returns the number of pending tasks and how long the earliest of them has been due,
+// which is zero if none is due yet.
+func (s *Scheduler) Backlog() (int, time.Duration, error) {
+	pending, err := s.store.Len()
+	if err != nil {
+		return 0, 0, err
+	}
+	next, ok, err := s.store.NextDue()
+	if err != nil || !ok {
+		return pending, 0, err
+	}
+	return pending, max(time.Since(next), 0), nil
+}
+
+// List returns the page of pending tasks matching opts, ordered by send time,
+// along with the total number of matching tasks.
+func (s *Scheduler) List(opts ListOptions) ([]ScheduledTask, int, error) {
+	tasks, err := s.store.List(opts.From, opts.To)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list scheduled tasks: %v", err)
+	}
+
+	matched := make([]ScheduledTask, 0, len(tasks))
+	for _, task := range tasks {
+		if opts.Template != "" && task.Template != opts.Template {
+			continue
+		}
+		matched = append(matched, task)
+	}
+
+	total := len(matched)
+	if opts.Offset >= total {
+		return []ScheduledTask{}, total, nil
+	}
+	end := total
+	if opts.Limit > 0 && opts.Offset+opts.Limit < total {
+		end = opts.Offset + opts.Limit
+	}
+	return matched[opts.Offset:end], total, nil
+}
+
 func (s *Scheduler) processTasks() {
-	ticker := time.NewTicker(time.Minute)
-	defer ticker.Stop()
+	defer close(s.done)
+	timer := time.NewTimer(s.nextWait())
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.stop:
 			return
-		case <-ticker.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
 			s.mu.Lock()
 			if !s.isRunning {
 				s.mu.Unlock()
 				return
 			}
+			paused := s.paused
+			s.mu.Unlock()
 
-			now := time.Now().UTC()
-			var toDelete []string
-			for id, task := range s.tasks {
-				if now.After(task.SendAt) || now.Equal(task.SendAt) {
-					s.mu.Unlock()
-					s.processTask(id, task)
-					s.mu.Lock()
-					toDelete = append(toDelete, id)
-				}
-			}
-			for _, id := range toDelete {
-				delete(s.tasks, id)
+			if !paused {
+				s.dispatchDue()
 			}
-			s.mu.Unlock()
 		}
+		timer.Reset(s.nextWait())
 	}
 }
 
-func (s *Scheduler) processTask(id string, task ScheduledTask) {
-	s.logger.Info("Processing scheduled email", zap.String("id", id), zap.Any("recipients", task.Recipients))
+// dispatchDue claims the tasks that are due and hands them to the worker pool.
+func (s *Scheduler) dispatchDue() {
+	due, err := s.store.ClaimDue(time.Now().UTC())
+	if err != nil {
+		s.logger.Error("Failed to claim due scheduled tasks", zap.Error(err))
+	}
+	// Higher priority tasks are started first so they get any remaining rate limit tokens.
+	sortByPriority(due)
+	for _, task := range due {
+		select {
+		case <-s.stop:
+			if err := s.store.Requeue(task); err != nil {
+				s.logger.Error("Failed to return scheduled email to the store on shutdown", zap.String("id", task.ID), zap.Error(err))
+			}
+			continue
+		default:
+		}
+		s.workers.submit(func() {
+			s.processTask(task.ID, task)
+		})
+	}
+}
 
-	body, subject, err := s.templates.Render(task.Template, task.Data)
+// nextWait returns how long to sleep until the earliest pending task is due. It never waits
+// longer than maxIdleWait so tasks added to a shared store by other instances are still picked up.
+// While paused it idles for maxIdleWait, relying on Resume to wake the loop.
+func (s *Scheduler) nextWait() time.Duration {
+	if s.Paused() {
+		return maxIdleWait
+	}
+	next, ok, err := s.store.NextDue()
 	if err != nil {
-		s.logger.Error("Failed to render template for scheduled email", zap.String("id", id), zap.Any("recipients", task.Recipients), zap.Error(err))
+		s.logger.Error("Failed to determine next due scheduled task", zap.Error(err))
+		return maxIdleWait
+	}
+	if !ok {
+		return maxIdleWait
+	}
+	wait := time.Until(next)
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxIdleWait {
+		return maxIdleWait
+	}
+	return wait
+}
+
+// reschedule wakes the dispatch loop so it can re-arm its timer after the set of tasks changed.
+func (s *Scheduler) reschedule() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) processTask(id string, task ScheduledTask) {
+	if task.ExpiresAt != nil && time.Now().UTC().After(*task.ExpiresAt) {
+		s.logger.Warn("Scheduled email expired before it could be sent", zap.String("id", id), zap.Time("expires_at", *task.ExpiresAt))
+		s.expired.Add(1)
+		s.finish(task, StatusExpired, fmt.Errorf("task expired at %s", task.ExpiresAt.Format(time.RFC3339)))
 		return
 	}
 
-	if subject == "" {
-		subject = fmt.Sprintf("Scheduled email from RuneBird (%s)", task.Template)
+	s.logger.Info("Processing scheduled email", zap.String("id", id), zap.Any("recipients", task.Recipients))
+
+	task.setStatus(StatusRendering, nil)
+	s.saveStatus(task)
+
+	variant := s.templates.Resolve(task.Template, task.Locale)
+	var body, subject, text string
+	if task.Content != nil {
+		subject, body, text = task.Content.Subject, task.Content.HTMLBody, task.Content.TextBody
+	} else {
+		// The version is recorded so that the email can be traced to the template it was sent with.
+		task.TemplateVersion = s.templates.Version(variant)
+		var err error
+		body, subject, err = s.templates.Render(variant, task.Data)
+		if err != nil {
+			s.logger.Error("Failed to render template for scheduled email", zap.String("id", id), zap.Any("recipients", task.Recipients), zap.Error(err))
+			s.finish(task, StatusFailed, err)
+			return
+		}
+
+		if subject == "" {
+			subject = fmt.Sprintf("Scheduled email from RuneBird (%s)", task.Template)
+		}
+
+		text, err = s.templates.RenderText(variant, task.Data)
+		if err != nil {
+			s.logger.Error("Failed to render template text for scheduled email", zap.String("id", id), zap.Any("recipients", task.Recipients), zap.Error(err))
+			s.finish(task, StatusFailed, err)
+			return
+		}
 	}
 
-	if s.rateLimiter.CanSend() {
-		if err := s.sender.Send(task.Recipients, subject, body); err != nil {
-			s.logger.Error("Failed to send scheduled email", zap.String("id", id), zap.Any("recipients", task.Recipients), zap.Error(err))
+	from := task.From
+	if from == "" {
+		from = s.templates.Metadata(variant).From
+	}
+	profile := task.Profile
+	if profile == "" {
+		profile = s.templates.Metadata(variant).Profile
+	}
+	msg := email.Message{
+		ID:          task.ID,
+		From:        from,
+		Recipients:  task.Recipients,
+		Template:    task.Template,
+		Profile:     profile,
+		Subject:     subject,
+		HTMLBody:    body,
+		TextBody:    text,
+		ReplyTo:     task.ReplyTo,
+		Headers:     s.templates.Headers(task.Template, task.Recipients, task.Headers),
+		Attachments: task.Attachments,
+		DryRun:      task.DryRun,
+	}
+	msg.HTMLBody = s.templates.Track(msg.Template, msg.ID, msg.Recipients, msg.HTMLBody)
+	if s.rateLimiter.WindowOpen(task.Template) && s.rateLimiter.CanSend(msg.Profile, len(task.Recipients)) {
+		task.Attempts++
+		task.setStatus(StatusSending, nil)
+		s.saveStatus(task)
+		result, err := s.sender.SendMessage(s.ctx, msg)
+		if err != nil && s.ctx.Err() != nil {
+			// The send was abandoned because the scheduler stopped, so it does not count.
+			s.logger.Warn("Scheduled email interrupted by shutdown", zap.String("id", id), zap.Error(err))
+			task.Attempts--
+			s.retry(task, err)
+			return
+		}
+		if err != nil {
+			s.rateLimiter.ObserveSendError(err)
+			s.logger.Error("Failed to send scheduled email", zap.String("id", id), zap.Any("recipients", task.Recipients), zap.Int("attempt", task.Attempts), zap.Error(err))
+			// An oversized message or one to suppressed recipients would fail again, so it is
+			// not retried.
+			if task.Attempts < s.cfg.Retry.MaxAttempts && email.Retryable(err) {
+				s.retry(task, err)
+				return
+			}
+			s.finish(task, StatusFailed, err)
 			return
 		}
+		s.rateLimiter.ObserveSendSuccess()
+		task.MessageID = result.MessageID
+		task.Rejected = result.Rejected
+		task.Suppressed = append(task.Suppressed, result.Suppressed...)
+		s.logger.Info("Scheduled email sent successfully", append([]zap.Field{zap.String("id", id), zap.Any("recipients", task.Recipients)}, result.LogFields()...)...)
+		s.finish(task, StatusSent, nil)
 	} else {
-		s.rateLimiter.QueueEmail(task.Recipients, subject, body)
+		if err := s.rateLimiter.QueueTask(task.ID, task.Template, msg, task.Priority); err != nil {
+			s.logger.Error("Failed to queue scheduled email", zap.String("id", id), zap.Any("recipients", task.Recipients), zap.Int("attempt", task.Attempts), zap.Error(err))
+			if task.Attempts < s.cfg.Retry.MaxAttempts {
+				s.retry(task, err)
+				return
+			}
+			s.finish(task, StatusFailed, err)
+			return
+		}
 		s.logger.Info("Scheduled email queued due to rate limit", zap.String("id", id), zap.String("subject", subject))
+		task.setStatus(StatusQueued, nil)
+		s.saveStatus(task)
 	}
+}
 
+// finish records the final status of a task and notifies its callback URL, if any.
+func (s *Scheduler) finish(task ScheduledTask, status TaskStatus, cause error) {
+	task.setStatus(status, cause)
+	s.saveStatus(task)
+	if status == StatusFailed {
+		s.failed.Add(1)
+	}
+
+	if task.CallbackURL == "" {
+		return
+	}
+	event := TaskEvent{
+		TaskID:   task.ID,
+		Template: task.Template,
+		Status:   status,
+		Attempts: task.Attempts,
+	}
+	if cause != nil {
+		event.Error = cause.Error()
+	}
+	s.webhooks.Send(task.CallbackURL, webhook.Event{
+		ID:        fmt.Sprintf("evt-%d", time.Now().UnixNano()),
+		Type:      "task." + string(status),
+		CreatedAt: task.UpdatedAt,
+		Data:      event,
+	})
+}
+
+// finishQueued records the outcome of an email the rate limit queue sent, or gave up on, for
+// the task it was queued for, if any.
+func (s *Scheduler) finishQueued(queued rate.EmailTask, result email.Result, cause error) {
+	if queued.TaskID == "" {
+		return
+	}
+	task, ok, err := s.store.Get(queued.TaskID)
+	if err != nil {
+		s.logger.Error("Failed to read scheduled task of queued email", zap.String("id", queued.TaskID), zap.Error(err))
+		return
+	}
+	if !ok || task.Status != StatusQueued {
+		return
+	}
+	task.Attempts += queued.Attempts
+	if cause != nil {
+		s.logger.Error("Queued scheduled email failed", zap.String("id", task.ID), zap.Any("recipients", task.Recipients), zap.Int("attempt", task.Attempts), zap.Error(cause))
+		s.finish(task, StatusFailed, cause)
+		return
+	}
+	task.MessageID = result.MessageID
+	task.Rejected = result.Rejected
+	task.Suppressed = append(task.Suppressed, result.Suppressed...)
+	s.finish(task, StatusSent, nil)
+}
+
+// retry returns a task whose send failed to the pending set, due again after the backoff
+// delay for its attempt count.
+func (s *Scheduler) retry(task ScheduledTask, cause error) {
+	delay := s.backoff(task.Attempts)
+	task.SendAt = time.Now().UTC().Add(delay)
+	task.setStatus(StatusPending, cause)
+
+	if err := s.store.Requeue(task); err != nil {
+		s.logger.Error("Failed to requeue scheduled email for retry", zap.String("id", task.ID), zap.Error(err))
+		s.finish(task, StatusFailed, cause)
+		return
+	}
+	s.reschedule()
+	s.logger.Info("Scheduled email will be retried", zap.String("id", task.ID), zap.Int("attempt", task.Attempts), zap.Duration("delay", delay))
+}
+
+// backoff returns the delay before the retry following the given attempt.
+func (s *Scheduler) backoff(attempt int) time.Duration {
+	delay := float64(s.cfg.Retry.InitialDelay) * math.Pow(s.cfg.Retry.Multiplier, float64(attempt-1))
+	if delay > float64(s.cfg.Retry.MaxDelay) {
+		return s.cfg.Retry.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// saveStatus persists the task's current status, logging rather than failing on store errors
+// since the outcome of the send itself is unaffected.
+func (s *Scheduler) saveStatus(task ScheduledTask) {
+	if err := s.store.SaveStatus(task); err != nil {
+		s.logger.Error("Failed to record scheduled task status", zap.String("id", task.ID), zap.String("status", string(task.Status)), zap.Error(err))
+	}
 }
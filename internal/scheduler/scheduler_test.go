@@ -1,6 +1,14 @@
 package scheduler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
@@ -9,9 +17,10 @@ import (
 	"runebird/internal/logger"
 	"runebird/internal/rate"
 	"runebird/internal/templates"
+	"runebird/internal/webhook"
 )
 
-func setupTestScheduler(t *testing.T) (*Scheduler, *email.Sender, *templates.TemplateManager, *rate.Limiter) {
+func setupTestScheduler(t *testing.T) (*Scheduler, email.Sender, *templates.TemplateManager, *rate.Limiter) {
 	cfg := &config.Config{
 		SMTP: config.SMTPConfig{
 			Host:        "smtp.example.com",
@@ -24,6 +33,14 @@ func setupTestScheduler(t *testing.T) (*Scheduler, *email.Sender, *templates.Tem
 			PerHour: 600,
 			Burst:   2,
 		},
+		Scheduler: config.SchedulerConfig{
+			Retry: config.RetryConfig{
+				MaxAttempts:  3,
+				InitialDelay: time.Second,
+				Multiplier:   2,
+				MaxDelay:     3 * time.Second,
+			},
+		},
 		Logging: config.LoggingConfig{
 			Level:    "info",
 			FilePath: "",
@@ -35,19 +52,19 @@ func setupTestScheduler(t *testing.T) (*Scheduler, *email.Sender, *templates.Tem
 		t.Fatalf("failed to create logger: %v", err)
 	}
 
-	sender, err := email.New(&cfg.SMTP)
+	sender, err := email.NewSMTP(&cfg.SMTP)
 	if err != nil {
 		t.Fatalf("failed to create email sender: %v", err)
 	}
 
 	tm := &templates.TemplateManager{}
 
-	rl, err := rate.New(&cfg.RateLimit, log)
+	rl, err := rate.New(&cfg.RateLimit, log, sender, rate.NewMemoryQueue(), rate.NewMemoryBucket(&cfg.RateLimit), nil)
 	if err != nil {
 		t.Fatalf("failed to create rate limiter: %v", err)
 	}
 
-	scheduler := New(log, sender, tm, rl)
+	scheduler := New(&cfg.Scheduler, log, sender, tm, rl, NewMemoryStore(time.Hour), webhook.New(&cfg.Webhooks, log))
 
 	return scheduler, sender, tm, rl
 }
@@ -88,16 +105,16 @@ func TestScheduler(t *testing.T) {
 			t.Fatalf("expected no error, got: %v", err)
 		}
 
-		scheduler.mu.Lock()
-		if _, exists := scheduler.tasks[id]; !exists {
+		task, exists, err := scheduler.store.Get(id)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if !exists {
 			t.Error("expected task to be scheduled, but it was not found")
 		}
-		if task, exists := scheduler.tasks[id]; exists {
-			if task.SendAt != sendAt.UTC() {
-				t.Errorf("expected SendAt to be %v, got: %v", sendAt, task.SendAt)
-			}
+		if exists && task.SendAt != sendAt.UTC() {
+			t.Errorf("expected SendAt to be %v, got: %v", sendAt, task.SendAt)
 		}
-		scheduler.mu.Unlock()
 	})
 
 	t.Run("ScheduleDuplicateTask", func(t *testing.T) {
@@ -132,11 +149,682 @@ func TestScheduler(t *testing.T) {
 			t.Fatalf("expected no error, got: %v", err)
 		}
 
-		scheduler.mu.Lock()
-		task, exists := scheduler.tasks[id]
-		scheduler.mu.Unlock()
-		if exists {
-			scheduler.processTask(id, task)
+		due, err := scheduler.store.ClaimDue(time.Now().UTC())
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		for _, task := range due {
+			scheduler.processTask(task.ID, task)
+		}
+
+		task, err := scheduler.Get(id)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if task.Status != StatusFailed || task.LastError == "" {
+			t.Errorf("expected task to fail with an error, got status %s and error %q", task.Status, task.LastError)
+		}
+		var statuses []TaskStatus
+		for _, change := range task.History {
+			statuses = append(statuses, change.Status)
+		}
+		if fmt.Sprint(statuses) != fmt.Sprint([]TaskStatus{StatusPending, StatusRendering, StatusFailed}) {
+			t.Errorf("unexpected status history: %v", statuses)
+		}
+	})
+
+	t.Run("ClaimDueTasks", func(t *testing.T) {
+		store := NewMemoryStore(time.Hour)
+		now := time.Now().UTC()
+		for i, offset := range []time.Duration{-time.Minute, -2 * time.Minute, time.Minute} {
+			task := ScheduledTask{ID: fmt.Sprintf("claim-%d", i), Template: "welcome", SendAt: now.Add(offset)}
+			if err := store.Add(task); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		due, err := store.ClaimDue(now)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(due) != 2 {
+			t.Fatalf("expected 2 due tasks, got: %d", len(due))
+		}
+		if due[0].ID != "claim-1" {
+			t.Errorf("expected earliest task first, got: %s", due[0].ID)
+		}
+
+		again, err := store.ClaimDue(now)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(again) != 0 {
+			t.Errorf("expected claimed tasks to be removed, got: %d", len(again))
+		}
+		if _, exists, _ := store.Get("claim-2"); !exists {
+			t.Error("expected future task to remain in the store")
+		}
+	})
+
+	t.Run("ListTasks", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		base := time.Now().UTC().Add(time.Hour)
+		for i := 0; i < 5; i++ {
+			template := "welcome"
+			if i%2 == 1 {
+				template = "digest"
+			}
+			id := fmt.Sprintf("list-%d", i)
+			if err := scheduler.Schedule(id, template, []string{"test@example.com"}, nil, base.Add(time.Duration(i)*time.Minute)); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		tasks, total, err := scheduler.List(ListOptions{Template: "welcome", Limit: 2})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if total != 3 || len(tasks) != 2 {
+			t.Fatalf("expected 2 of 3 welcome tasks, got %d of %d", len(tasks), total)
+		}
+		if tasks[0].ID != "list-0" || tasks[1].ID != "list-2" {
+			t.Errorf("expected tasks ordered by send time, got: %s, %s", tasks[0].ID, tasks[1].ID)
+		}
+		if tasks[0].CreatedAt.IsZero() {
+			t.Error("expected CreatedAt to be set")
+		}
+
+		tasks, total, err = scheduler.List(ListOptions{From: base.Add(90 * time.Second), To: base.Add(3 * time.Minute), Offset: 1})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if total != 2 || len(tasks) != 1 || tasks[0].ID != "list-3" {
+			t.Errorf("expected second task in time range to be list-3, got %d of %d: %+v", len(tasks), total, tasks)
+		}
+	})
+
+	t.Run("UpdateTask", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		id := "test-task-update"
+		if err := scheduler.Schedule(id, "welcome", []string{"test@example.com"}, map[string]interface{}{"Name": "Alice"}, time.Now().UTC().Add(time.Hour)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		newSendAt := time.Now().UTC().Add(3 * time.Hour)
+		task, err := scheduler.Update(id, TaskUpdate{SendAt: &newSendAt, Data: map[string]interface{}{"Name": "Bob"}})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if !task.SendAt.Equal(newSendAt) || task.Data["Name"] != "Bob" {
+			t.Errorf("expected updated task, got: %+v", task)
+		}
+		if len(task.Recipients) != 1 || task.Recipients[0] != "test@example.com" {
+			t.Errorf("expected recipients to be unchanged, got: %v", task.Recipients)
+		}
+
+		past := time.Now().UTC().Add(-time.Minute)
+		if _, err := scheduler.Update(id, TaskUpdate{SendAt: &past}); err == nil {
+			t.Error("expected error for send time in the past, got none")
+		}
+		if _, err := scheduler.Update("missing", TaskUpdate{Data: map[string]interface{}{}}); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("expected ErrTaskNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("DispatchesAtSendTime", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		id := "test-task-timer"
+		if err := scheduler.Schedule(id, "nonexistent", []string{"test@example.com"}, nil, time.Now().UTC().Add(200*time.Millisecond)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if task, _ := scheduler.Get(id); task.Status == StatusFailed {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Error("expected task to be dispatched shortly after its send time")
+	})
+
+	t.Run("MemoryStoreHeapOrdering", func(t *testing.T) {
+		store := NewMemoryStore(time.Hour)
+		now := time.Now().UTC()
+		for i, offset := range []time.Duration{3 * time.Minute, time.Minute, 2 * time.Minute} {
+			if err := store.Add(ScheduledTask{ID: fmt.Sprintf("heap-%d", i), SendAt: now.Add(offset)}); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		next, ok, _ := store.NextDue()
+		if !ok || !next.Equal(now.Add(time.Minute)) {
+			t.Errorf("expected next due in one minute, got: %v", next)
+		}
+
+		if removed, _ := store.Remove("heap-1"); !removed {
+			t.Fatal("expected heap-1 to be removed")
+		}
+		next, _, _ = store.NextDue()
+		if !next.Equal(now.Add(2 * time.Minute)) {
+			t.Errorf("expected next due in two minutes after removal, got: %v", next)
+		}
+
+		if err := store.Update(ScheduledTask{ID: "heap-0", SendAt: now.Add(30 * time.Second)}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		next, _, _ = store.NextDue()
+		if !next.Equal(now.Add(30 * time.Second)) {
+			t.Errorf("expected rescheduled task to be next due, got: %v", next)
+		}
+	})
+
+	t.Run("CancelTask", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		id := "test-task-cancel"
+		if err := scheduler.Schedule(id, "welcome", []string{"test@example.com"}, nil, time.Now().UTC().Add(time.Hour)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		task, err := scheduler.Cancel(id)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if task.Status != StatusCancelled {
+			t.Errorf("expected status %s, got: %s", StatusCancelled, task.Status)
+		}
+
+		if _, total, _ := scheduler.List(ListOptions{}); total != 0 {
+			t.Errorf("expected cancelled task to no longer be pending, got %d pending", total)
+		}
+		if task, err := scheduler.Get(id); err != nil || task.Status != StatusCancelled {
+			t.Errorf("expected cancelled record to remain available, got %s (err=%v)", task.Status, err)
+		}
+		if _, err := scheduler.Cancel(id); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("expected ErrTaskNotFound when cancelling twice, got: %v", err)
+		}
+		if _, err := scheduler.Update(id, TaskUpdate{Data: map[string]interface{}{}}); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("expected ErrTaskNotFound when updating a cancelled task, got: %v", err)
+		}
+	})
+
+	t.Run("MemoryStoreRetention", func(t *testing.T) {
+		store := NewMemoryStore(50 * time.Millisecond)
+		task := ScheduledTask{ID: "retained", SendAt: time.Now().UTC().Add(-time.Second)}
+		if err := store.Add(task); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := store.ClaimDue(time.Now().UTC()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, exists, _ := store.Get(task.ID); !exists {
+			t.Fatal("expected claimed record to be retained")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if _, exists, _ := store.Get(task.ID); exists {
+			t.Error("expected record to be dropped after the retention period")
+		}
+	})
+
+	t.Run("RetryFailedSendWithBackoff", func(t *testing.T) {
+		scheduler, _, tm, _ := setupTestScheduler(t)
+		// Nothing listens on port 1, so every send fails immediately.
+		unreachable, err := email.NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: 1, Username: "user", Password: "pass", FromAddress: "from@example.com"})
+		if err != nil {
+			t.Fatalf("failed to create email sender: %v", err)
+		}
+		scheduler.sender = unreachable
+		tm.Templates = map[string]*htmltemplate.Template{
+			"welcome": htmltemplate.Must(htmltemplate.New("welcome").Parse("<p>Hi {{ .Name }}</p>")),
+		}
+		limits := &config.RateLimitConfig{PerHour: 3600, Burst: 10}
+		scheduler.rateLimiter, err = rate.New(limits, scheduler.logger, unreachable, rate.NewMemoryQueue(), rate.NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("failed to create rate limiter: %v", err)
+		}
+
+		id := "test-task-retry"
+		if err := scheduler.Schedule(id, "welcome", []string{"test@example.com"}, map[string]interface{}{"Name": "Alice"}, time.Now().UTC().Add(-time.Second)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		dispatch := func() ScheduledTask {
+			due, err := scheduler.store.ClaimDue(time.Now().UTC().Add(time.Hour))
+			if err != nil || len(due) != 1 {
+				t.Fatalf("expected one due task, got %d (err=%v)", len(due), err)
+			}
+			before := time.Now().UTC()
+			scheduler.processTask(due[0].ID, due[0])
+			task, err := scheduler.Get(id)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if task.Status == StatusPending && task.SendAt.Before(before) {
+				t.Errorf("expected retry to be scheduled in the future, got: %v", task.SendAt)
+			}
+			return task
+		}
+
+		task := dispatch()
+		if task.Status != StatusPending || task.Attempts != 1 || task.LastError == "" {
+			t.Errorf("expected pending retry after first failure, got status %s, attempts %d, error %q", task.Status, task.Attempts, task.LastError)
+		}
+		if delay := time.Until(task.SendAt); delay > time.Second || delay < 500*time.Millisecond {
+			t.Errorf("expected first retry in about one second, got: %v", delay)
+		}
+
+		task = dispatch()
+		if delay := time.Until(task.SendAt); delay > 2*time.Second || delay < 1500*time.Millisecond {
+			t.Errorf("expected second retry in about two seconds, got: %v", delay)
+		}
+
+		task = dispatch()
+		if task.Status != StatusFailed || task.Attempts != 3 {
+			t.Errorf("expected task to fail after 3 attempts, got status %s, attempts %d", task.Status, task.Attempts)
+		}
+	})
+
+	t.Run("FailedTaskPostsCallback", func(t *testing.T) {
+		scheduler, _, tm, _ := setupTestScheduler(t)
+		unreachable, err := email.NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: 1, Username: "user", Password: "pass", FromAddress: "from@example.com"})
+		if err != nil {
+			t.Fatalf("failed to create email sender: %v", err)
+		}
+		scheduler.sender = unreachable
+		scheduler.cfg.Retry.MaxAttempts = 1
+		tm.Templates = map[string]*htmltemplate.Template{
+			"welcome": htmltemplate.Must(htmltemplate.New("welcome").Parse("<p>Hi {{ .Name }}</p>")),
+		}
+		limits := &config.RateLimitConfig{PerHour: 3600, Burst: 10}
+		scheduler.rateLimiter, err = rate.New(limits, scheduler.logger, unreachable, rate.NewMemoryQueue(), rate.NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("failed to create rate limiter: %v", err)
+		}
+
+		events := make(chan webhook.Event, 1)
+		endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event webhook.Event
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				t.Errorf("failed to decode webhook event: %v", err)
+			}
+			events <- event
+		}))
+		defer endpoint.Close()
+		scheduler.webhooks = webhook.New(&config.WebhookConfig{Secret: "secret", MaxAttempts: 1, Timeout: time.Second}, scheduler.logger)
+		defer scheduler.webhooks.Stop()
+
+		task := ScheduledTask{
+			ID:          "test-task-callback",
+			Template:    "welcome",
+			Recipients:  []string{"test@example.com"},
+			Data:        map[string]interface{}{"Name": "Alice"},
+			SendAt:      time.Now().UTC().Add(-time.Second),
+			CallbackURL: endpoint.URL,
+		}
+		if err := scheduler.ScheduleTask(task); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		due, err := scheduler.store.ClaimDue(time.Now().UTC())
+		if err != nil || len(due) != 1 {
+			t.Fatalf("expected one due task, got %d (err=%v)", len(due), err)
+		}
+		scheduler.processTask(due[0].ID, due[0])
+
+		select {
+		case event := <-events:
+			if event.Type != "task.failed" {
+				t.Errorf("expected task.failed event, got: %s", event.Type)
+			}
+			data, _ := event.Data.(map[string]interface{})
+			if data["task_id"] != task.ID || data["error"] == "" {
+				t.Errorf("expected event data for %s with an error, got: %+v", task.ID, event.Data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected webhook callback, got none")
+		}
+		if scheduler.Failed() != 1 {
+			t.Errorf("expected 1 failed task to be counted, got: %d", scheduler.Failed())
 		}
 	})
+
+	t.Run("Backlog", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		if pending, age, err := scheduler.Backlog(); err != nil || pending != 0 || age != 0 {
+			t.Errorf("expected no backlog, got %d tasks due for %s (err=%v)", pending, age, err)
+		}
+		now := time.Now().UTC()
+		for i, sendAt := range []time.Time{now.Add(-time.Minute), now.Add(time.Hour)} {
+			task := ScheduledTask{ID: fmt.Sprintf("test-task-backlog-%d", i), Template: "welcome", Recipients: []string{"test@example.com"}, SendAt: sendAt}
+			if err := scheduler.ScheduleTask(task); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+		pending, age, err := scheduler.Backlog()
+		if err != nil || pending != 2 || age < time.Minute || age > 2*time.Minute {
+			t.Errorf("expected 2 tasks, the earliest due for a minute, got %d due for %s (err=%v)", pending, age, err)
+		}
+	})
+
+	t.Run("HighPriorityDispatchedFirst", func(t *testing.T) {
+		scheduler, _, tm, _ := setupTestScheduler(t)
+		unreachable, err := email.NewSMTP(&config.SMTPConfig{Host: "127.0.0.1", Port: 1, Username: "user", Password: "pass", FromAddress: "from@example.com"})
+		if err != nil {
+			t.Fatalf("failed to create email sender: %v", err)
+		}
+		scheduler.sender = unreachable
+		tm.Templates = map[string]*htmltemplate.Template{
+			"welcome": htmltemplate.Must(htmltemplate.New("welcome").Parse("<p>Hi {{ .Name }}</p>")),
+		}
+		// A single token means only the first task processed can be sent; the other is queued.
+		limits := &config.RateLimitConfig{PerHour: 1, Burst: 1}
+		scheduler.rateLimiter, err = rate.New(limits, scheduler.logger, unreachable, rate.NewMemoryQueue(), rate.NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("failed to create rate limiter: %v", err)
+		}
+
+		sendAt := time.Now().UTC().Add(-time.Second)
+		for _, task := range []ScheduledTask{
+			{ID: "low", Template: "welcome", Recipients: []string{"low@example.com"}, SendAt: sendAt.Add(-time.Second), Priority: rate.PriorityLow},
+			{ID: "high", Template: "welcome", Recipients: []string{"high@example.com"}, SendAt: sendAt, Priority: rate.PriorityHigh},
+		} {
+			if err := scheduler.ScheduleTask(task); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		scheduler.Start()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if low, _ := scheduler.Get("low"); low.Status == StatusQueued {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		scheduler.Stop()
+
+		high, _ := scheduler.Get("high")
+		low, _ := scheduler.Get("low")
+		if high.Attempts != 1 {
+			t.Errorf("expected high priority task to get the token, got %d attempts", high.Attempts)
+		}
+		if low.Status != StatusQueued || low.Attempts != 0 {
+			t.Errorf("expected low priority task to be queued, got status %s with %d attempts", low.Status, low.Attempts)
+		}
+	})
+
+	t.Run("QueuedTaskFinishedByQueue", func(t *testing.T) {
+		scheduler, sender, tm, _ := setupTestScheduler(t)
+		recorder := &recordingSender{Sender: sender}
+		scheduler.sender = recorder
+		tm.Templates = map[string]*htmltemplate.Template{
+			"welcome": htmltemplate.Must(htmltemplate.New("welcome").Parse("<p>Hi {{ .Name }}</p>")),
+		}
+		limits := &config.RateLimitConfig{PerHour: 3600, Burst: 1, Retry: config.RetryConfig{InitialDelay: 10 * time.Millisecond}}
+		rl, err := rate.New(limits, scheduler.logger, recorder, rate.NewMemoryQueue(), rate.NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("failed to create rate limiter: %v", err)
+		}
+		rl.Observe(scheduler.finishQueued)
+		scheduler.rateLimiter = rl
+		// The only token is used up, so the task goes to the rate limit queue.
+		rl.CanSend("", 1)
+
+		id := "test-task-queued"
+		if err := scheduler.Schedule(id, "welcome", []string{"test@example.com"}, map[string]interface{}{"Name": "Alice"}, time.Now().UTC().Add(time.Hour)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if task, err := scheduler.RunNow(id); err != nil || task.Status != StatusQueued {
+			t.Fatalf("expected the task to be queued, got status %s (err=%v)", task.Status, err)
+		}
+
+		rl.Start()
+		defer rl.Stop()
+		var task ScheduledTask
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if task, _ = scheduler.Get(id); task.Status != StatusQueued {
+				break
+			}
+		}
+		if task.Status != StatusSent || task.Attempts != 1 || task.MessageID != "msg-1" {
+			t.Errorf("expected the queue to finish the task as sent, got status %s with %d attempts and message ID %q", task.Status, task.Attempts, task.MessageID)
+		}
+	})
+
+	t.Run("WorkerPoolLimitsInFlight", func(t *testing.T) {
+		pool := newWorkerPool(3)
+		var mu sync.Mutex
+		inFlight, maxInFlight, finished := 0, 0, 0
+		for i := 0; i < 10; i++ {
+			pool.submit(func() {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				finished++
+				mu.Unlock()
+			})
+		}
+		pool.wait()
+
+		if finished != 10 {
+			t.Errorf("expected all 10 jobs to finish, got: %d", finished)
+		}
+		if maxInFlight != 3 {
+			t.Errorf("expected at most 3 jobs in flight concurrently, got: %d", maxInFlight)
+		}
+	})
+
+	t.Run("PauseAndResume", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		scheduler.Pause()
+		if !scheduler.Paused() {
+			t.Fatal("expected scheduler to be paused")
+		}
+
+		id := "test-task-paused"
+		if err := scheduler.Schedule(id, "welcome", []string{"test@example.com"}, nil, time.Now().UTC().Add(50*time.Millisecond)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		time.Sleep(200 * time.Millisecond)
+		if task, _ := scheduler.Get(id); task.Status != StatusPending {
+			t.Errorf("expected task to stay pending while paused, got: %s", task.Status)
+		}
+
+		scheduler.Resume()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if task, _ := scheduler.Get(id); task.Status != StatusPending {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("expected task to be dispatched after resume")
+	})
+
+	t.Run("ExpiredTaskNotSent", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		now := time.Now().UTC()
+		expiresAt := now.Add(20 * time.Millisecond)
+		task := ScheduledTask{
+			ID:         "test-task-expired",
+			Template:   "welcome",
+			Recipients: []string{"test@example.com"},
+			SendAt:     now.Add(10 * time.Millisecond),
+			ExpiresAt:  &expiresAt,
+		}
+		if err := scheduler.ScheduleTask(task); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		invalid := task
+		invalid.ID = "test-task-invalid-expiry"
+		invalid.ExpiresAt = &now
+		if err := scheduler.ScheduleTask(invalid); !errors.Is(err, ErrInvalidTask) {
+			t.Errorf("expected ErrInvalidTask for expiry before send time, got: %v", err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		due, err := scheduler.store.ClaimDue(time.Now().UTC())
+		if err != nil || len(due) != 1 {
+			t.Fatalf("expected one due task, got %d (err=%v)", len(due), err)
+		}
+		scheduler.processTask(due[0].ID, due[0])
+
+		got, err := scheduler.Get(task.ID)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if got.Status != StatusExpired || got.Attempts != 0 {
+			t.Errorf("expected task to expire without a send attempt, got status %s with %d attempts", got.Status, got.Attempts)
+		}
+		if scheduler.Expired() != 1 {
+			t.Errorf("expected 1 expired task to be counted, got: %d", scheduler.Expired())
+		}
+	})
+
+	t.Run("RunNow", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		id := "test-task-run-now"
+		if err := scheduler.Schedule(id, "missing", []string{"test@example.com"}, nil, time.Now().UTC().Add(time.Hour)); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		scheduler.Pause()
+
+		task, err := scheduler.RunNow(id)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if task.Status != StatusFailed {
+			t.Errorf("expected run to fail rendering a missing template, got status: %s", task.Status)
+		}
+		if pending, _ := scheduler.store.List(time.Time{}, time.Time{}); len(pending) != 0 {
+			t.Errorf("expected task to be removed from its original slot, got %d pending", len(pending))
+		}
+		if _, err := scheduler.RunNow(id); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("expected ErrTaskNotFound for a task that already ran, got: %v", err)
+		}
+	})
+
+	t.Run("RawContent", func(t *testing.T) {
+		scheduler, sender, _, _ := setupTestScheduler(t)
+		recorder := &recordingSender{Sender: sender}
+		scheduler.sender = recorder
+		id := "test-task-raw"
+		err := scheduler.ScheduleTask(ScheduledTask{
+			ID:         id,
+			Recipients: []string{"test@example.com"},
+			SendAt:     time.Now().UTC().Add(time.Hour),
+			Content:    &Content{Subject: "Your receipt", HTMLBody: "<p>Thanks</p>"},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		task, err := scheduler.RunNow(id)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if task.Status != StatusSent {
+			t.Fatalf("expected the raw email to be sent without a template, got status: %s (%s)", task.Status, task.LastError)
+		}
+		if len(recorder.sent) != 1 || recorder.sent[0].Subject != "Your receipt" || recorder.sent[0].HTMLBody != "<p>Thanks</p>" {
+			t.Errorf("expected the given subject and body to be sent, got: %+v", recorder.sent)
+		}
+	})
+
+	t.Run("BackoffCappedAtMaxDelay", func(t *testing.T) {
+		scheduler, _, _, _ := setupTestScheduler(t)
+		for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 3 * time.Second, 10: 3 * time.Second} {
+			if got := scheduler.backoff(attempt); got != want {
+				t.Errorf("attempt %d: expected backoff %v, got: %v", attempt, want, got)
+			}
+		}
+	})
+
+	t.Run("ShutdownDrainsSends", func(t *testing.T) {
+		for _, tc := range []struct {
+			name    string
+			timeout time.Duration
+			status  TaskStatus
+		}{
+			{"Drained", 5 * time.Second, StatusSent},
+			{"TimedOut", 50 * time.Millisecond, StatusPending},
+		} {
+			scheduler, sender, tm, _ := setupTestScheduler(t)
+			blocking := &blockingSender{Sender: sender, started: make(chan struct{}, 1), release: make(chan struct{})}
+			scheduler.sender = blocking
+			tm.Templates = map[string]*htmltemplate.Template{
+				"welcome": htmltemplate.Must(htmltemplate.New("welcome").Parse("<p>Hi {{ .Name }}</p>")),
+			}
+			id := "test-task-shutdown"
+			if err := scheduler.Schedule(id, "welcome", []string{"test@example.com"}, map[string]interface{}{"Name": "Alice"}, time.Now().UTC().Add(-time.Second)); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			scheduler.Start()
+			select {
+			case <-blocking.started:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s: expected the task to be sent", tc.name)
+			}
+			if tc.status == StatusSent {
+				time.AfterFunc(100*time.Millisecond, func() { close(blocking.release) })
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			scheduler.Shutdown(ctx)
+			cancel()
+			task, err := scheduler.Get(id)
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if task.Status != tc.status {
+				t.Errorf("%s: expected status %s after shutdown, got %s", tc.name, tc.status, task.Status)
+			}
+		}
+	})
+}
+
+// blockingSender holds sends until release is closed or their context is done.
+type blockingSender struct {
+	email.Sender
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSender) SendMessage(ctx context.Context, msg email.Message) (email.Result, error) {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return email.Result{}, nil
+	case <-ctx.Done():
+		return email.Result{}, ctx.Err()
+	}
+}
+
+// recordingSender records the messages sent instead of sending them.
+type recordingSender struct {
+	email.Sender
+	mu   sync.Mutex
+	sent []email.Message
+}
+
+func (s *recordingSender) SendMessage(ctx context.Context, msg email.Message) (email.Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, msg)
+	return email.Result{MessageID: fmt.Sprintf("msg-%d", len(s.sent))}, nil
 }
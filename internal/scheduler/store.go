@@ -0,0 +1,277 @@
+package scheduler
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTaskNotFound is returned when a task does not exist or has already been dispatched.
+var ErrTaskNotFound = errors.New("task not found")
+
+// ErrInvalidTask is returned when a task or task update fails validation.
+var ErrInvalidTask = errors.New("invalid task")
+
+// Store persists scheduled tasks ordered by their send time. Tasks are pending until they
+// are claimed for dispatch or removed; afterwards their latest record stays available
+// through Get until the store's retention period elapses.
+type Store interface {
+	// Add stores a new pending task, failing if a task with the same ID already exists.
+	Add(task ScheduledTask) error
+	// Update replaces a pending task, failing with ErrTaskNotFound if it is no longer pending.
+	Update(task ScheduledTask) error
+	// Get returns the latest record of the task with the given ID, pending or not.
+	Get(id string) (ScheduledTask, bool, error)
+	// Requeue returns a task that is no longer pending to the pending set, e.g. to retry it.
+	Requeue(task ScheduledTask) error
+	// Remove withdraws a pending task from dispatch and reports whether it was pending.
+	Remove(id string) (bool, error)
+	// SaveStatus records the state of a task that is no longer pending.
+	SaveStatus(task ScheduledTask) error
+	// List returns pending tasks with a send time within [from, to], ordered by send time.
+	// A zero from or to leaves that side of the range unbounded.
+	List(from, to time.Time) ([]ScheduledTask, error)
+	// NextDue returns the earliest send time of any pending task, or false if there is none.
+	NextDue() (time.Time, bool, error)
+	// Len returns the number of pending tasks.
+	Len() (int, error)
+	// ClaimDue atomically withdraws and returns all pending tasks due at or before now,
+	// so that a task is only ever handed to one scheduler instance.
+	ClaimDue(now time.Time) ([]ScheduledTask, error)
+}
+
+// taskEntry holds a task record. index is its position in the pending heap, or -1 once the
+// task is no longer pending, in which case expiresAt marks when the record is dropped.
+type taskEntry struct {
+	task      ScheduledTask
+	index     int
+	expiresAt time.Time
+}
+
+// taskHeap is a min-heap of tasks ordered by send time.
+type taskHeap []*taskEntry
+
+func (h taskHeap) Len() int { return len(h) }
+
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].task.SendAt.Equal(h[j].task.SendAt) {
+		return h[i].task.ID < h[j].task.ID
+	}
+	return h[i].task.SendAt.Before(h[j].task.SendAt)
+}
+
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *taskHeap) Push(x interface{}) {
+	entry := x.(*taskEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	entry.index = -1
+	return entry
+}
+
+type expiringRecord struct {
+	entry *taskEntry
+	at    time.Time
+}
+
+type memoryStore struct {
+	tasks     map[string]*taskEntry
+	due       taskHeap
+	expiry    []expiringRecord
+	retention time.Duration
+	mu        sync.Mutex
+}
+
+// NewMemoryStore creates a Store that keeps tasks in process memory. Records of tasks that
+// are no longer pending are kept for the given retention period.
+func NewMemoryStore(retention time.Duration) Store {
+	return &memoryStore{
+		tasks:     make(map[string]*taskEntry),
+		retention: retention,
+	}
+}
+
+func (m *memoryStore) Add(task ScheduledTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.tasks[task.ID]; exists {
+		return fmt.Errorf("task with ID %s already exists", task.ID)
+	}
+	entry := &taskEntry{task: task}
+	m.tasks[task.ID] = entry
+	heap.Push(&m.due, entry)
+	return nil
+}
+
+func (m *memoryStore) Update(task ScheduledTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, exists := m.tasks[task.ID]
+	if !exists || entry.index < 0 {
+		return ErrTaskNotFound
+	}
+	entry.task = task
+	heap.Fix(&m.due, entry.index)
+	return nil
+}
+
+func (m *memoryStore) Get(id string) (ScheduledTask, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pruneExpired(time.Now())
+	entry, ok := m.tasks[id]
+	if !ok {
+		return ScheduledTask{}, false, nil
+	}
+	return entry.task, true, nil
+}
+
+func (m *memoryStore) Requeue(task ScheduledTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.tasks[task.ID]
+	if ok && entry.index >= 0 {
+		return fmt.Errorf("task with ID %s is already pending", task.ID)
+	}
+	if !ok {
+		entry = &taskEntry{}
+		m.tasks[task.ID] = entry
+	}
+	entry.task = task
+	heap.Push(&m.due, entry)
+	return nil
+}
+
+func (m *memoryStore) Remove(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.tasks[id]
+	if !ok || entry.index < 0 {
+		return false, nil
+	}
+	heap.Remove(&m.due, entry.index)
+	m.retain(entry)
+	return true, nil
+}
+
+func (m *memoryStore) SaveStatus(task ScheduledTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.tasks[task.ID]
+	if ok && entry.index >= 0 {
+		return fmt.Errorf("task with ID %s is still pending", task.ID)
+	}
+	if !ok {
+		entry = &taskEntry{index: -1}
+		m.tasks[task.ID] = entry
+	}
+	entry.task = task
+	m.retain(entry)
+	m.pruneExpired(time.Now())
+	return nil
+}
+
+func (m *memoryStore) List(from, to time.Time) ([]ScheduledTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tasks []ScheduledTask
+	for _, entry := range m.due {
+		if !from.IsZero() && entry.task.SendAt.Before(from) {
+			continue
+		}
+		if !to.IsZero() && entry.task.SendAt.After(to) {
+			continue
+		}
+		tasks = append(tasks, entry.task)
+	}
+	sortBySendAt(tasks)
+	return tasks, nil
+}
+
+func (m *memoryStore) NextDue() (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.due) == 0 {
+		return time.Time{}, false, nil
+	}
+	return m.due[0].task.SendAt, true, nil
+}
+
+func (m *memoryStore) Len() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.due), nil
+}
+
+func (m *memoryStore) ClaimDue(now time.Time) ([]ScheduledTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []ScheduledTask
+	for len(m.due) > 0 && !m.due[0].task.SendAt.After(now) {
+		entry := heap.Pop(&m.due).(*taskEntry)
+		m.retain(entry)
+		due = append(due, entry.task)
+	}
+	return due, nil
+}
+
+// retain schedules a record that is no longer pending for removal after the retention period.
+func (m *memoryStore) retain(entry *taskEntry) {
+	entry.expiresAt = time.Now().Add(m.retention)
+	m.expiry = append(m.expiry, expiringRecord{entry: entry, at: entry.expiresAt})
+}
+
+// pruneExpired drops records whose retention period has elapsed. Since the retention period is
+// fixed, expiry is ordered by expiration time; records that were retained again since are kept.
+func (m *memoryStore) pruneExpired(now time.Time) {
+	n := 0
+	for n < len(m.expiry) && m.expiry[n].at.Before(now) {
+		entry := m.expiry[n].entry
+		if entry.index < 0 && entry.expiresAt.Equal(m.expiry[n].at) && m.tasks[entry.task.ID] == entry {
+			delete(m.tasks, entry.task.ID)
+		}
+		n++
+	}
+	m.expiry = m.expiry[n:]
+}
+
+func sortBySendAt(tasks []ScheduledTask) {
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].SendAt.Equal(tasks[j].SendAt) {
+			return tasks[i].ID < tasks[j].ID
+		}
+		return tasks[i].SendAt.Before(tasks[j].SendAt)
+	})
+}
+
+// sortByPriority orders tasks by priority, keeping the existing order within a priority.
+func sortByPriority(tasks []ScheduledTask) {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].Priority.Rank() < tasks[j].Priority.Rank()
+	})
+}
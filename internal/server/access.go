@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// statusResponseWriter captures the status and size of the response written by a handler.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAccessLog logs a line for every request once it has been served, and observes how long
+// it took in the request duration histogram by route and status class. The route is the
+// pattern the request matched, so that paths with IDs share a series.
+func (s *Server) withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// The mux sets the pattern on the request it routed; requests it found no route for
+		// share one series.
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		s.httpRequestDuration.WithLabelValues(route, fmt.Sprintf("%dxx", status/100)).Observe(duration.Seconds())
+		s.log(r.Context()).Info("HTTP request",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.String("route", route),
+			zap.Int("status", status),
+			zap.Int("bytes", rec.bytes),
+			zap.Duration("duration", duration),
+			zap.String("remote_ip", remoteIP(r.RemoteAddr)),
+		)
+	})
+}
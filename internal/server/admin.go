@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// StartAdmin serves the operational endpoints on admin.port until Shutdown, over TLS with the
+// HTTPS certificate if the API is served over HTTPS. It does nothing if there is no admin port.
+func (s *Server) StartAdmin() error {
+	if s.adminServer == nil {
+		return nil
+	}
+	if s.certs == nil {
+		s.logger.Info("Starting admin HTTP server", zap.String("address", s.adminServer.Addr))
+		if err := s.adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("failed to start admin HTTP server: %v", err)
+		}
+		return nil
+	}
+
+	tlsConfig, err := newTLSConfig(&s.cfg.Server.TLS)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %v", err)
+	}
+	if err := s.certs.reload(); err != nil {
+		return err
+	}
+	tlsConfig.GetCertificate = s.certs.getCertificate
+	s.adminServer.TLSConfig = tlsConfig
+	s.logger.Info("Starting admin HTTPS server", zap.String("address", s.adminServer.Addr))
+	if err := s.adminServer.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to start admin HTTPS server: %v", err)
+	}
+	return nil
+}
+
+// shutdownAdmin stops the admin server, waiting for the requests in progress until ctx is done
+// and then closing their connections.
+func (s *Server) shutdownAdmin(ctx context.Context) error {
+	if s.adminServer == nil {
+		return nil
+	}
+	s.logger.Info("Shutting down admin HTTP server")
+	err := s.adminServer.Shutdown(ctx)
+	if err != nil && ctx.Err() != nil {
+		err = s.adminServer.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to shutdown admin HTTP server: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"runebird/internal/auth"
+)
+
+// authorize wraps next so that it is only served for requests from an allowed client
+// certificate, when client certificates are required, and, when bearer-token authentication
+// is enabled, with a valid token granting scope. Requests are then counted against the request
+// limit of their client, whose name next finds in the request context.
+func (s *Server) authorize(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.verifyClient(r.TLS); err != nil {
+			writeError(w, err)
+			return
+		}
+		claims, err := s.verifyToken(r.Context(), r.Header.Get("Authorization"), scope)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		ctx := withClient(r.Context(), clientName(claims, r.TLS, r.RemoteAddr))
+		if err := s.allowRequest(ctx); err != nil {
+			writeError(w, err)
+			return
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// allowRequest counts a request against the request limit of its client, failing with a
+// *requestError if the client is over it.
+func (s *Server) allowRequest(ctx context.Context) error {
+	err := s.clients.allowRequest(ctx)
+	if err != nil {
+		s.log(ctx).Info("Request rejected due to client request limit", zap.String("client", client(ctx)))
+		s.clientLimitedTotal.WithLabelValues("requests").Inc()
+	}
+	return err
+}
+
+// allowEmails counts n emails against the daily email limit of the client of ctx, failing with
+// a *requestError if they do not fit.
+func (s *Server) allowEmails(ctx context.Context, n int) error {
+	err := s.clients.allowEmails(ctx, n)
+	if err != nil {
+		s.log(ctx).Info("Email rejected due to client email limit", zap.String("client", client(ctx)), zap.Int("emails", n))
+		s.clientLimitedTotal.WithLabelValues("emails").Inc()
+	}
+	return err
+}
+
+// refundEmails returns n emails counted by allowEmails to the daily email limit of the client
+// of ctx, once the request they were counted for has failed.
+func (s *Server) refundEmails(ctx context.Context, n int) {
+	s.clients.refundEmails(ctx, n)
+}
+
+// verifyToken checks the bearer token in the authorization header of a request when
+// bearer-token authentication is enabled, returning its claims, or nil if authentication is
+// disabled. It fails with a *requestError if the token is missing, invalid or does not grant
+// scope.
+func (s *Server) verifyToken(ctx context.Context, authorization, scope string) (*auth.Claims, error) {
+	if s.auth == nil {
+		return nil, nil
+	}
+	token, ok := bearerToken(authorization)
+	if !ok {
+		return nil, &requestError{status: http.StatusUnauthorized, message: "Bearer token is required", challenge: `Bearer realm="runebird"`}
+	}
+	claims, err := s.auth.Verify(ctx, token)
+	if errors.Is(err, auth.ErrKeysUnavailable) {
+		s.log(ctx).Error("Failed to fetch token signing keys", zap.Error(err))
+		return nil, requestErrorf(http.StatusServiceUnavailable, "Token signing keys are unavailable")
+	}
+	if err != nil {
+		return nil, &requestError{status: http.StatusUnauthorized, message: fmt.Sprintf("Invalid bearer token: %v", err), challenge: `Bearer realm="runebird", error="invalid_token"`}
+	}
+	if !claims.HasScope(scope) {
+		return nil, &requestError{
+			status:    http.StatusForbidden,
+			message:   fmt.Sprintf("Token does not grant the %s scope", scope),
+			challenge: fmt.Sprintf(`Bearer realm="runebird", error="insufficient_scope", scope=%q`, scope),
+		}
+	}
+	return claims, nil
+}
+
+// bearerToken returns the token of an Authorization header using the Bearer scheme.
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+	"runebird/internal/bounce"
+)
+
+// handleBounces receives the bounce and complaint notifications posted by the email provider
+// named by the path. Notifications are authenticated by the provider's signature rather than a
+// token, and answered with 204 No Content once they are recorded.
+func (s *Server) handleBounces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	provider := r.PathValue("provider")
+	if limit := s.cfg.Server.HTTP.MaxBodySize; limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	notifications, err := s.bounces.Receive(r.Context(), provider, r.Header, body)
+	switch {
+	case err == nil:
+		s.log(r.Context()).Debug("Bounce notifications received", zap.String("provider", provider), zap.Int("count", len(notifications)))
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, bounce.ErrProviderDisabled):
+		http.NotFound(w, r)
+	case errors.Is(err, bounce.ErrInvalidSignature):
+		s.log(r.Context()).Warn("Rejected bounce notification", zap.String("provider", provider), zap.Error(err))
+		httpError(w, "Invalid notification signature", http.StatusUnauthorized)
+	case errors.Is(err, bounce.ErrInvalidNotification):
+		s.log(r.Context()).Warn("Invalid bounce notification", zap.String("provider", provider), zap.Error(err))
+		httpError(w, "Invalid notification", http.StatusBadRequest)
+	default:
+		// Providers retry notifications that are not accepted, so a failure here is not lost.
+		s.log(r.Context()).Error("Failed to handle bounce notification", zap.String("provider", provider), zap.Error(err))
+		httpError(w, "Failed to handle notification", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"runebird/internal/auth"
+	"runebird/internal/config"
+)
+
+// clientEmailWindow is the rolling window over which the emails of a client are counted.
+const clientEmailWindow = 24 * time.Hour
+
+type clientKey struct{}
+
+// withClient returns ctx tagged with the name of the client making the request.
+func withClient(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, clientKey{}, name)
+}
+
+// client returns the name of the client making the request of ctx, or "" outside of a request.
+func client(ctx context.Context) string {
+	name, _ := ctx.Value(clientKey{}).(string)
+	return name
+}
+
+// clientName identifies the client of a request by the subject of its bearer token, the common
+// name of its verified client certificate, or else the IP address of remoteAddr.
+func clientName(claims *auth.Claims, state *tls.ConnectionState, remoteAddr string) string {
+	if claims != nil && claims.Subject != "" {
+		return claims.Subject
+	}
+	if state != nil && len(state.VerifiedChains) > 0 {
+		if name := state.VerifiedChains[0][0].Subject.CommonName; name != "" {
+			return name
+		}
+	}
+	return remoteIP(remoteAddr)
+}
+
+// remoteIP returns the IP address of the host:port address of a peer.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// sentEmails is a number of emails accepted for a client within the same minute.
+type sentEmails struct {
+	minute int64
+	n      int
+}
+
+// clientUsage is what a client used of its limits.
+type clientUsage struct {
+	requests *rate.Limiter
+	// emails counts the emails of the client in the rolling window by minute, oldest first.
+	emails   []sentEmails
+	lastSeen time.Time
+}
+
+// clientLimiter enforces the request and email limits of each client. A nil clientLimiter
+// limits nothing.
+type clientLimiter struct {
+	cfg       *config.ClientLimitsConfig
+	clients   map[string]*clientUsage
+	lastPrune time.Time
+	mu        sync.Mutex
+}
+
+func newClientLimiter(cfg *config.ClientLimitsConfig) *clientLimiter {
+	return &clientLimiter{cfg: cfg, clients: make(map[string]*clientUsage)}
+}
+
+// limit returns the limits of the named client.
+func (l *clientLimiter) limit(name string) config.ClientLimit {
+	if limit, ok := l.cfg.Clients[name]; ok {
+		return limit
+	}
+	return config.ClientLimit{RequestsPerMinute: l.cfg.RequestsPerMinute, EmailsPerDay: l.cfg.EmailsPerDay}
+}
+
+// usage returns the usage of the named client, forgetting the clients that have been idle for
+// longer than the windows of their limits.
+func (l *clientLimiter) usage(name string, limit config.ClientLimit, now time.Time) *clientUsage {
+	if now.Sub(l.lastPrune) > time.Minute {
+		for other, u := range l.clients {
+			if now.Sub(u.lastSeen) > clientEmailWindow {
+				delete(l.clients, other)
+			}
+		}
+		l.lastPrune = now
+	}
+	u, ok := l.clients[name]
+	if !ok {
+		u = &clientUsage{}
+		l.clients[name] = u
+	}
+	if limit.RequestsPerMinute > 0 {
+		perSecond := rate.Limit(float64(limit.RequestsPerMinute) / 60)
+		if u.requests == nil {
+			u.requests = rate.NewLimiter(perSecond, limit.RequestsPerMinute)
+		} else if u.requests.Burst() != limit.RequestsPerMinute {
+			u.requests.SetLimitAt(now, perSecond)
+			u.requests.SetBurstAt(now, limit.RequestsPerMinute)
+		}
+	}
+	u.lastSeen = now
+	return u
+}
+
+// allowRequest counts a request of the client of ctx, failing with a *requestError if the
+// client made as many requests as its limit allows in the last minute.
+func (l *clientLimiter) allowRequest(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	name := client(ctx)
+	limit := l.limit(name)
+	if limit.RequestsPerMinute == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	u := l.usage(name, limit, now)
+	reservation := u.requests.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return &requestError{status: http.StatusTooManyRequests, message: "Client request limit exceeded", retryAfter: retrySeconds(delay)}
+	}
+	return nil
+}
+
+// allowEmails counts n emails of the client of ctx, failing with a *requestError without
+// counting them if they would take the client past its daily limit, or could never fit in it.
+func (l *clientLimiter) allowEmails(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	name := client(ctx)
+	limit := l.limit(name)
+	if limit.EmailsPerDay == 0 {
+		return nil
+	}
+	if n > limit.EmailsPerDay {
+		return requestErrorf(http.StatusBadRequest, "Email has more recipients than the client's daily limit of %d emails", limit.EmailsPerDay)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	minute := now.Unix() / 60
+	oldest := minute - int64(clientEmailWindow/time.Minute) + 1
+	u := l.usage(name, limit, now)
+	for len(u.emails) > 0 && u.emails[0].minute < oldest {
+		u.emails = u.emails[1:]
+	}
+	used := 0
+	for _, e := range u.emails {
+		used += e.n
+	}
+	if used+n > limit.EmailsPerDay {
+		// The emails fit once enough of those counted have left the window.
+		excess, at := used+n-limit.EmailsPerDay, now
+		for _, e := range u.emails {
+			excess -= e.n
+			if excess <= 0 {
+				at = time.Unix(e.minute*60, 0).Add(clientEmailWindow)
+				break
+			}
+		}
+		return &requestError{status: http.StatusTooManyRequests, message: "Client daily email limit exceeded", retryAfter: retrySeconds(at.Sub(now))}
+	}
+	if last := len(u.emails) - 1; last >= 0 && u.emails[last].minute == minute {
+		u.emails[last].n += n
+	} else {
+		u.emails = append(u.emails, sentEmails{minute: minute, n: n})
+	}
+	return nil
+}
+
+// refundEmails uncounts n emails of the client of ctx that allowEmails counted, for a request
+// that failed afterwards.
+func (l *clientLimiter) refundEmails(ctx context.Context, n int) {
+	if l == nil || n == 0 {
+		return
+	}
+	name := client(ctx)
+	if l.limit(name).EmailsPerDay == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u, ok := l.clients[name]
+	if !ok {
+		return
+	}
+	for i := len(u.emails) - 1; i >= 0 && n > 0; i-- {
+		refund := min(n, u.emails[i].n)
+		u.emails[i].n -= refund
+		n -= refund
+	}
+}
+
+// retrySeconds converts a delay into the whole seconds of a Retry-After header.
+func retrySeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
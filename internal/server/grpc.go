@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"runebird/internal/email"
+	"runebird/internal/emailerpb"
+	"runebird/internal/scheduler"
+	"runebird/internal/webhook"
+)
+
+// grpcService implements the gRPC API with the same validation, sending and scheduling as the
+// HTTP API.
+type grpcService struct {
+	emailerpb.UnimplementedEmailerServer
+	s *Server
+}
+
+// StartGRPC serves the gRPC API on server.grpc.port until Shutdown. It does nothing if the
+// gRPC API is disabled.
+func (s *Server) StartGRPC() error {
+	port := s.cfg.Server.GRPC.Port
+	if port == 0 {
+		return nil
+	}
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for gRPC: %v", err)
+	}
+	s.logger.Info("Starting gRPC server", zap.Int("port", port), zap.Bool("tls", s.certs != nil))
+	return s.serveGRPC(lis)
+}
+
+// serveGRPC serves the gRPC API on lis, over TLS with the HTTPS certificate if the API is
+// served over HTTPS.
+func (s *Server) serveGRPC(lis net.Listener) error {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, id := grpcRequestID(ctx)
+			_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, id))
+			ctx, err := s.authorizeGRPC(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, id := grpcRequestID(stream.Context())
+			_ = stream.SetHeader(metadata.Pairs(requestIDMetadata, id))
+			ctx, err := s.authorizeGRPC(ctx, info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &requestIDStream{ServerStream: stream, ctx: ctx})
+		}),
+	}
+	if s.certs != nil {
+		tlsConfig, err := newTLSConfig(&s.cfg.Server.TLS)
+		if err != nil {
+			_ = lis.Close()
+			return fmt.Errorf("failed to configure TLS: %v", err)
+		}
+		if err := s.certs.reload(); err != nil {
+			_ = lis.Close()
+			return err
+		}
+		tlsConfig.GetCertificate = s.certs.getCertificate
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	if limit := s.cfg.Server.HTTP.MaxBodySize; limit > 0 {
+		// Calls are bounded like HTTP request bodies.
+		opts = append(opts, grpc.MaxRecvMsgSize(limit))
+	}
+
+	srv := grpc.NewServer(opts...)
+	emailerpb.RegisterEmailerServer(srv, &grpcService{s: s})
+	s.grpcMu.Lock()
+	s.grpcServer = srv
+	s.grpcMu.Unlock()
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("failed to start gRPC server: %v", err)
+	}
+	return nil
+}
+
+// shutdownGRPC stops the gRPC server, waiting for the calls in progress until ctx is done. The
+// returned channel is closed once it has stopped.
+func (s *Server) shutdownGRPC(ctx context.Context) <-chan struct{} {
+	stopped := make(chan struct{})
+	s.grpcMu.Lock()
+	srv := s.grpcServer
+	s.grpcMu.Unlock()
+	if srv == nil {
+		close(stopped)
+		return stopped
+	}
+
+	s.logger.Info("Shutting down gRPC server")
+	go func() {
+		defer close(stopped)
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			s.logger.Warn("gRPC calls still in progress after the shutdown timeout, abandoning them")
+			srv.Stop()
+		}
+	}()
+	return stopped
+}
+
+// requestIDMetadata is the metadata key carrying the ID of a gRPC call, as the X-Request-ID
+// header does for HTTP requests.
+const requestIDMetadata = "x-request-id"
+
+// grpcRequestID returns ctx tagged with the ID of its call, taken from the x-request-id
+// metadata as withRequestID does for HTTP requests, and the ID.
+func grpcRequestID(ctx context.Context) (context.Context, string) {
+	var id string
+	if values := metadata.ValueFromIncomingContext(ctx, requestIDMetadata); len(values) > 0 {
+		id = values[0]
+	}
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return withRequestIDContext(ctx, id), id
+}
+
+// requestIDStream is a server stream whose context carries the ID of its call.
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorizeGRPC checks the client certificate and bearer token of a call and counts it against
+// the request limit of its client as authorize does for HTTP requests, with the token taken from
+// the authorization metadata. Sends require the send scope and the other methods the schedule
+// scope. It returns ctx tagged with the name of the client.
+func (s *Server) authorizeGRPC(ctx context.Context, method string) (context.Context, error) {
+	var state *tls.ConnectionState
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+		if p.Addr != nil {
+			addr = p.Addr.String()
+		}
+	}
+	if err := s.verifyClient(state); err != nil {
+		return ctx, grpcError(err)
+	}
+
+	scopes := s.cfg.Server.Auth.JWT.Scopes
+	scope := scopes.Schedule
+	if method == emailerpb.Emailer_Send_FullMethodName {
+		scope = scopes.Send
+	}
+	var authorization string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	claims, err := s.verifyToken(ctx, authorization, scope)
+	if err != nil {
+		return ctx, grpcError(err)
+	}
+	ctx = withClient(ctx, clientName(claims, state, addr))
+	if err := s.allowRequest(ctx); err != nil {
+		return ctx, grpcError(err)
+	}
+	return ctx, nil
+}
+
+func (g *grpcService) Send(ctx context.Context, req *emailerpb.SendRequest) (*emailerpb.SendResponse, error) {
+	resp, queued, err := g.s.sendEmail(ctx, SendRequest{
+		Template:        req.GetTemplate(),
+		Locale:          req.GetLocale(),
+		From:            req.GetFrom(),
+		Recipients:      req.GetRecipients(),
+		Data:            dataFromProto(req),
+		Priority:        req.GetPriority(),
+		OnLimit:         req.GetOnLimit(),
+		ClientReference: req.GetClientReference(),
+		ReplyTo:         req.GetReplyTo(),
+		Headers:         req.GetHeaders(),
+		Attachments:     attachmentsFromProto(req.GetAttachments()),
+		DryRun:          req.GetDryRun(),
+	}, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if queued {
+		return &emailerpb.SendResponse{Queued: true}, nil
+	}
+	return &emailerpb.SendResponse{
+		MessageId:       resp.MessageID,
+		TemplateVersion: int32(resp.TemplateVersion),
+		DryRun:          resp.DryRun,
+		Provider:        resp.Provider,
+		Accepted:        resp.Accepted,
+		Rejected:        rejectionsToProto(resp.Rejected),
+		ResponseCode:    int32(resp.ResponseCode),
+		Response:        resp.Response,
+		DurationMs:      resp.DurationMS,
+	}, nil
+}
+
+func (g *grpcService) Schedule(ctx context.Context, req *emailerpb.ScheduleRequest) (*emailerpb.ScheduleResponse, error) {
+	schedule := ScheduleRequest{
+		Template:        req.GetTemplate(),
+		Locale:          req.GetLocale(),
+		From:            req.GetFrom(),
+		Recipients:      req.GetRecipients(),
+		Data:            dataFromProto(req),
+		Priority:        req.GetPriority(),
+		ClientReference: req.GetClientReference(),
+		CallbackURL:     req.GetCallbackUrl(),
+		ReplyTo:         req.GetReplyTo(),
+		Headers:         req.GetHeaders(),
+		Attachments:     attachmentsFromProto(req.GetAttachments()),
+		DryRun:          req.GetDryRun(),
+	}
+	if req.SendAt != nil {
+		schedule.SendAt = req.GetSendAt().AsTime()
+	}
+	if req.ExpiresAt != nil {
+		expiresAt := req.GetExpiresAt().AsTime()
+		schedule.ExpiresAt = &expiresAt
+	}
+	id, _, err := g.s.scheduleEmail(ctx, schedule, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &emailerpb.ScheduleResponse{TaskId: id}, nil
+}
+
+func (g *grpcService) ListTasks(req *emailerpb.ListTasksRequest, stream grpc.ServerStreamingServer[emailerpb.Task]) error {
+	if req.GetLimit() < 0 {
+		return status.Error(codes.InvalidArgument, "Limit must not be negative")
+	}
+	if req.GetOffset() < 0 {
+		return status.Error(codes.InvalidArgument, "Offset must not be negative")
+	}
+	opts := scheduler.ListOptions{
+		Template: req.GetTemplate(),
+		Offset:   int(req.GetOffset()),
+		Limit:    int(req.GetLimit()),
+	}
+	if req.From != nil {
+		opts.From = req.GetFrom().AsTime()
+	}
+	if req.To != nil {
+		opts.To = req.GetTo().AsTime()
+	}
+
+	tasks, _, err := g.s.scheduler.List(opts)
+	if err != nil {
+		g.s.log(stream.Context()).Error("Failed to list scheduled tasks", zap.Error(err))
+		return status.Errorf(codes.Internal, "Failed to list scheduled tasks: %v", err)
+	}
+	for _, task := range tasks {
+		if err := stream.Send(taskToProto(task)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *grpcService) CancelTask(ctx context.Context, req *emailerpb.CancelTaskRequest) (*emailerpb.Task, error) {
+	task, err := g.s.scheduler.Cancel(req.GetId())
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		return nil, status.Error(codes.NotFound, "Scheduled task not found")
+	}
+	if err != nil {
+		g.s.log(ctx).Error("Failed to cancel scheduled email", zap.String("id", req.GetId()), zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to cancel scheduled email: %v", err)
+	}
+	g.s.log(ctx).Info("Scheduled email cancelled successfully", zap.String("id", req.GetId()))
+	g.s.webhooks.Publish(webhook.EventTaskCancelled, newTaskResponse(task))
+	return taskToProto(task), nil
+}
+
+// dataFromProto returns the template data of a request, or nil if it has none, as for a JSON
+// request without data.
+func dataFromProto(req interface{ GetData() *structpb.Struct }) map[string]interface{} {
+	if req.GetData() == nil {
+		return nil
+	}
+	return req.GetData().AsMap()
+}
+
+func attachmentsFromProto(attachments []*emailerpb.Attachment) []email.Attachment {
+	if len(attachments) == 0 {
+		return nil
+	}
+	out := make([]email.Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		out = append(out, email.Attachment{Filename: a.GetFilename(), ContentType: a.GetContentType(), Content: a.GetContent()})
+	}
+	return out
+}
+
+func rejectionsToProto(rejected []email.Rejection) []*emailerpb.Rejection {
+	out := make([]*emailerpb.Rejection, 0, len(rejected))
+	for _, r := range rejected {
+		out = append(out, &emailerpb.Rejection{Recipient: r.Recipient, Code: int32(r.Code), Message: r.Message})
+	}
+	return out
+}
+
+func taskToProto(task scheduler.ScheduledTask) *emailerpb.Task {
+	out := &emailerpb.Task{
+		Id:              task.ID,
+		Template:        task.Template,
+		Recipients:      task.Recipients,
+		SendAt:          timestamppb.New(task.SendAt),
+		CreatedAt:       timestamppb.New(task.CreatedAt),
+		Priority:        string(task.Priority),
+		Status:          string(task.Status),
+		TemplateVersion: int32(task.TemplateVersion),
+		UpdatedAt:       timestamppb.New(task.UpdatedAt),
+		LastError:       task.LastError,
+		MessageId:       task.MessageID,
+		Rejected:        rejectionsToProto(task.Rejected),
+	}
+	if task.ExpiresAt != nil {
+		out.ExpiresAt = timestamppb.New(*task.ExpiresAt)
+	}
+	for _, change := range task.History {
+		out.History = append(out.History, &emailerpb.StatusChange{Status: string(change.Status), At: timestamppb.New(change.At), Error: change.Error})
+	}
+	return out
+}
+
+// grpcError returns the gRPC status of a call that failed with err, translating the HTTP
+// status of a *requestError. Invalid fields are listed in a BadRequest detail, and the wait
+// before retrying a call rejected by the rate limit in a RetryInfo detail.
+func grpcError(err error) error {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	code := codes.Internal
+	switch reqErr.status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	st := status.New(code, reqErr.message)
+
+	var detailed *status.Status
+	switch {
+	case reqErr.fields != nil:
+		badRequest := &errdetails.BadRequest{}
+		for _, field := range slices.Sorted(maps.Keys(reqErr.fields)) {
+			badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: field, Description: reqErr.fields[field]})
+		}
+		detailed, err = st.WithDetails(badRequest)
+	case reqErr.status == http.StatusTooManyRequests:
+		detailed, err = st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(reqErr.retryAfter) * time.Second)})
+	}
+	if detailed != nil && err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
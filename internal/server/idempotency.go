@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyEntry is the stored outcome of a request made with an idempotency key.
+// While the original request is still running, done is false.
+type idempotencyEntry struct {
+	bodyHash  [sha256.Size]byte
+	done      bool
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+type expiringKey struct {
+	key string
+	at  time.Time
+}
+
+// idempotencyCache remembers responses by idempotency key so that retried requests
+// receive the original response instead of being executed twice.
+type idempotencyCache struct {
+	ttl     time.Duration
+	entries map[string]*idempotencyEntry
+	expiry  []expiringKey
+	mu      sync.Mutex
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// begin reserves key for a new request. If the key is already known, the existing entry is
+// returned instead and ok is false.
+func (c *idempotencyCache) begin(key string, bodyHash [sha256.Size]byte) (existing idempotencyEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pruneExpired(time.Now())
+	if entry, found := c.entries[key]; found {
+		return *entry, false
+	}
+	c.entries[key] = &idempotencyEntry{bodyHash: bodyHash}
+	return idempotencyEntry{}, true
+}
+
+// finish stores the response for key, making it available to later duplicates.
+func (c *idempotencyCache) finish(key string, status int, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[key]
+	if !found {
+		return
+	}
+	entry.done = true
+	entry.status = status
+	entry.header = header
+	entry.body = body
+	entry.expiresAt = time.Now().Add(c.ttl)
+	c.expiry = append(c.expiry, expiringKey{key: key, at: entry.expiresAt})
+}
+
+// abandon releases key without storing a response, so the request can be retried.
+func (c *idempotencyCache) abandon(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// pruneExpired drops stored responses whose TTL elapsed. With a fixed TTL, expiry is
+// ordered by expiration time.
+func (c *idempotencyCache) pruneExpired(now time.Time) {
+	n := 0
+	for n < len(c.expiry) && c.expiry[n].at.Before(now) {
+		if entry, found := c.entries[c.expiry[n].key]; found && entry.done && entry.expiresAt.Equal(c.expiry[n].at) {
+			delete(c.entries, c.expiry[n].key)
+		}
+		n++
+	}
+	c.expiry = c.expiry[n:]
+}
+
+// recordingResponseWriter captures the status and body written by a handler.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// withIdempotency wraps a POST handler so that requests carrying an Idempotency-Key header or
+// a client_reference body field are executed at most once per client and key within the cache
+// TTL.
+// Duplicates receive the original response; reusing a key with a different body is rejected.
+func (s *Server) withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		if limit := s.cfg.Server.HTTP.MaxBodySize; limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			var ref struct {
+				ClientReference string `json:"client_reference"`
+			}
+			if json.Unmarshal(body, &ref) == nil {
+				key = ref.ClientReference
+			}
+		}
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		// A retry of a request is recognized whether it uses the versioned path or not. Keys are
+		// scoped to the client, so that one client cannot replay the response of another.
+		scopedKey := client(r.Context()) + "\x00" + strings.TrimPrefix(r.URL.Path, apiV1) + "\x00" + key
+		bodyHash := sha256.Sum256(body)
+		existing, ok := s.idempotency.begin(scopedKey, bodyHash)
+		if !ok {
+			switch {
+			case existing.bodyHash != bodyHash:
+				httpError(w, "Idempotency key was already used with a different request", http.StatusUnprocessableEntity)
+			case !existing.done:
+				httpError(w, "A request with this idempotency key is already in progress", http.StatusConflict)
+			default:
+				s.log(r.Context()).Info("Replaying response for duplicate request", zap.String("path", r.URL.Path), zap.String("idempotency_key", key))
+				// The replayed response keeps the ID of this request, so that it can be told
+				// apart from the original in the logs.
+				for name, values := range existing.header {
+					if name != requestIDHeader {
+						w.Header()[name] = values
+					}
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.status)
+				_, _ = w.Write(existing.body)
+			}
+			return
+		}
+
+		rec := &recordingResponseWriter{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// Responses that invite a retry are not remembered, so that the retry is served.
+		if retryableStatus(rec.status) {
+			s.idempotency.abandon(scopedKey)
+			return
+		}
+		s.idempotency.finish(scopedKey, rec.status, w.Header().Clone(), rec.body.Bytes())
+	}
+}
+
+// retryableStatus reports whether a response with the given status asks the client to retry
+// the request later: a server error, or a request refused for now, such as by a rate limit.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= http.StatusInternalServerError
+}
@@ -0,0 +1,473 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"runebird/internal/email"
+	"runebird/internal/messages"
+	"runebird/internal/suppression"
+	"runebird/internal/webhook"
+)
+
+//go:generate go run openapi_gen.go
+
+// openAPIDocument is the OpenAPI document served at /api/openapi.json. It is generated from
+// the operations and the request and response types by OpenAPI, so that it follows the
+// structs; a test fails if it was not regenerated after they changed.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIDocument)
+}
+
+// operation describes an endpoint method for the OpenAPI document. Request and the values of
+// Responses are values of the JSON types read and written, or nil for a plain-text error; a
+// response that is one of several types lists a value of each, and a 204 response has no body.
+// Scope names the scope group required when bearer-token authentication is enabled, and
+// Versioned serves the operation under apiV1.
+type operation struct {
+	Method    string
+	Path      string
+	Summary   string
+	Scope     string
+	Versioned bool
+	Query     []queryParameter
+	Request   interface{}
+	Responses map[int]interface{}
+}
+
+type queryParameter struct {
+	Name        string
+	Type        string
+	Format      string
+	Description string
+}
+
+// operations describe every endpoint the server handles, those of the API as served under
+// apiV1. Their unversioned aliases are left out of the document.
+var operations = []operation{
+	{Method: http.MethodPost, Path: "/send", Summary: "Send an email now, or queue it if the rate limit is reached", Scope: "send", Versioned: true,
+		Query: []queryParameter{
+			{Name: "async", Type: "boolean", Description: "Return once the email is handed to the workers instead of waiting for it to be sent, server.async_send by default"},
+		},
+		Request: SendRequest{}, Responses: map[int]interface{}{200: SendResponse{}, 202: []interface{}{QueuedResponse{}, AcceptedResponse{}}, 400: ValidationErrorResponse{}, 403: nil, 413: nil, 422: nil, 429: nil, 500: nil, 503: nil}},
+	{Method: http.MethodPost, Path: "/send/batch", Summary: "Send a template to each recipient of a batch, rendered with the data of its item", Scope: "send", Versioned: true,
+		Request: BatchSendRequest{}, Responses: map[int]interface{}{200: BatchSendResponse{}, 400: nil, 413: nil, 422: nil}},
+	{Method: http.MethodPost, Path: "/send/raw", Summary: "Send or schedule an email with a subject and bodies rendered by the caller", Scope: "send", Versioned: true,
+		Request: RawSendRequest{}, Responses: map[int]interface{}{200: []interface{}{SendResponse{}, ScheduleResponse{}}, 202: QueuedResponse{}, 400: ValidationErrorResponse{}, 403: nil, 413: nil, 422: nil, 429: nil, 500: nil, 503: nil}},
+	{Method: http.MethodGet, Path: "/schedule", Summary: "List scheduled emails", Scope: "schedule", Versioned: true,
+		Query: []queryParameter{
+			{Name: "template", Type: "string", Description: "Only emails rendered from this template"},
+			{Name: "from", Type: "string", Format: "date-time", Description: "Only emails to be sent at or after this time"},
+			{Name: "to", Type: "string", Format: "date-time", Description: "Only emails to be sent at or before this time"},
+			{Name: "limit", Type: "integer", Description: fmt.Sprintf("The number of emails to return, from 1 to %d, %d by default", maxListLimit, defaultListLimit)},
+			{Name: "offset", Type: "integer", Description: "The number of emails to skip"},
+		},
+		Responses: map[int]interface{}{200: ListScheduleResponse{}, 400: nil, 500: nil}},
+	{Method: http.MethodPost, Path: "/schedule", Summary: "Schedule an email to be sent later", Scope: "schedule", Versioned: true,
+		Request: ScheduleRequest{}, Responses: map[int]interface{}{200: ScheduleResponse{}, 400: ValidationErrorResponse{}, 403: nil, 422: nil, 500: nil}},
+	{Method: http.MethodPatch, Path: "/schedule/{id}", Summary: "Update a pending scheduled email", Scope: "schedule", Versioned: true,
+		Request: UpdateScheduleRequest{}, Responses: map[int]interface{}{200: UpdateScheduleResponse{}, 400: ValidationErrorResponse{}, 404: nil, 422: nil, 500: nil}},
+	{Method: http.MethodDelete, Path: "/schedule/{id}", Summary: "Cancel a pending scheduled email", Scope: "schedule", Versioned: true,
+		Responses: map[int]interface{}{200: TaskResponse{}, 404: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/messages/{id}", Summary: "Get the lifecycle of a sent email", Scope: "send", Versioned: true,
+		Responses: map[int]interface{}{200: messages.Message{}, 404: nil, 500: nil}},
+	{Method: http.MethodPost, Path: "/schedule/{id}/run", Summary: "Send a pending scheduled email now", Scope: "schedule", Versioned: true,
+		Responses: map[int]interface{}{200: RunScheduleResponse{}, 404: nil, 500: RunScheduleResponse{}}},
+	{Method: http.MethodGet, Path: "/tasks/{id}", Summary: "Get the status of a scheduled email", Scope: "schedule", Versioned: true,
+		Responses: map[int]interface{}{200: TaskResponse{}, 404: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/quota", Summary: "Get the usage of the daily and monthly quotas", Scope: "send", Versioned: true,
+		Responses: map[int]interface{}{200: QuotaResponse{}}},
+	{Method: http.MethodGet, Path: "/templates", Summary: "List the templates", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: ListTemplatesResponse{}}},
+	{Method: http.MethodGet, Path: "/templates/{name}", Summary: "Get the source of a template", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: TemplateResponse{}, 404: nil, 500: nil}},
+	{Method: http.MethodPut, Path: "/templates/{name}", Summary: "Create or update a template", Scope: "admin", Versioned: true,
+		Request: TemplateRequest{}, Responses: map[int]interface{}{200: TemplateStatusResponse{}, 201: TemplateStatusResponse{}, 400: nil, 500: nil}},
+	{Method: http.MethodDelete, Path: "/templates/{name}", Summary: "Delete a template", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: TemplateStatusResponse{}, 404: nil, 500: nil}},
+	{Method: http.MethodPost, Path: "/templates/{name}/preview", Summary: "Render a template without sending it", Scope: "admin", Versioned: true,
+		Request: PreviewRequest{}, Responses: map[int]interface{}{200: PreviewResponse{}, 400: nil, 404: nil, 500: nil}},
+	{Method: http.MethodPost, Path: "/templates/{name}/validate", Summary: "Check a template for errors, optionally against sample data", Scope: "admin", Versioned: true,
+		Request: ValidateTemplateRequest{}, Responses: map[int]interface{}{200: ValidateTemplateResponse{}, 400: nil, 404: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/templates/{name}/variables", Summary: "List the data fields a template uses", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: TemplateVariablesResponse{}, 404: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/templates/{name}/versions", Summary: "List the stored versions of a template", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: TemplateVersionsResponse{}, 404: nil, 500: nil}},
+	{Method: http.MethodPost, Path: "/templates/{name}/versions/{version}/activate", Summary: "Make a stored version of a template the active one", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: TemplateStatusResponse{}, 400: nil, 404: nil, 500: nil}},
+	{Method: http.MethodPost, Path: "/admin/scheduler/pause", Summary: "Pause dispatching scheduled emails", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: SchedulerStateResponse{}}},
+	{Method: http.MethodPost, Path: "/admin/scheduler/resume", Summary: "Resume dispatching scheduled emails", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: SchedulerStateResponse{}}},
+	{Method: http.MethodGet, Path: "/webhooks", Summary: "List the webhook subscriptions, without their secrets", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: ListWebhooksResponse{}, 500: nil}},
+	{Method: http.MethodPost, Path: "/webhooks", Summary: "Subscribe a URL to events", Scope: "admin", Versioned: true,
+		Request: WebhookRequest{}, Responses: map[int]interface{}{201: webhook.Subscription{}, 400: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/webhooks/{id}", Summary: "Get a webhook subscription, without its secret", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: webhook.Subscription{}, 404: nil, 500: nil}},
+	{Method: http.MethodPut, Path: "/webhooks/{id}", Summary: "Update a webhook subscription", Scope: "admin", Versioned: true,
+		Request: WebhookRequest{}, Responses: map[int]interface{}{200: webhook.Subscription{}, 400: nil, 404: nil, 500: nil}},
+	{Method: http.MethodDelete, Path: "/webhooks/{id}", Summary: "Delete a webhook subscription", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{204: nil, 404: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/webhooks/{id}/deliveries", Summary: "List the latest attempts to deliver events to a webhook subscription", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: WebhookDeliveriesResponse{}, 404: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/suppressions", Summary: "List the suppressed addresses, most recently added first", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: ListSuppressionsResponse{}, 500: nil}},
+	{Method: http.MethodPost, Path: "/suppressions", Summary: "Suppress an address, leaving it out of every email", Scope: "admin", Versioned: true,
+		Request: SuppressionRequest{}, Responses: map[int]interface{}{201: suppression.Entry{}, 400: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/suppressions/{address}", Summary: "Get why an address is suppressed", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{200: suppression.Entry{}, 404: nil, 500: nil}},
+	{Method: http.MethodDelete, Path: "/suppressions/{address}", Summary: "Take an address off the suppression list", Scope: "admin", Versioned: true,
+		Responses: map[int]interface{}{204: nil, 404: nil, 500: nil}},
+	{Method: http.MethodGet, Path: "/health", Summary: "Report whether the service can accept emails",
+		Responses: map[int]interface{}{200: HealthResponse{}, 503: HealthResponse{}}},
+}
+
+// requiredFields lists the fields a request must have. The fields of response types are
+// required unless they are omitted when empty.
+var requiredFields = map[reflect.Type][]string{
+	reflect.TypeOf(SendRequest{}):             {"template", "recipients"},
+	reflect.TypeOf(BatchSendRequest{}):        {"template", "items"},
+	reflect.TypeOf(BatchItem{}):               {"recipient"},
+	reflect.TypeOf(RawSendRequest{}):          {"recipients", "subject", "html_body"},
+	reflect.TypeOf(ScheduleRequest{}):         {"template", "recipients", "send_at"},
+	reflect.TypeOf(UpdateScheduleRequest{}):   nil,
+	reflect.TypeOf(TemplateRequest{}):         {"content"},
+	reflect.TypeOf(PreviewRequest{}):          nil,
+	reflect.TypeOf(ValidateTemplateRequest{}): nil,
+	reflect.TypeOf(WebhookRequest{}):          {"url", "events"},
+	reflect.TypeOf(SuppressionRequest{}):      {"address"},
+	reflect.TypeOf(email.Attachment{}):        {"filename", "content"},
+}
+
+var pathParameter = regexp.MustCompile(`\{([^}]+)\}`)
+
+// OpenAPI returns the OpenAPI 3 document describing the API, as embedded in the server by go
+// generate.
+func OpenAPI() ([]byte, error) {
+	g := &schemaGenerator{schemas: make(map[string]interface{}), types: make(map[string]reflect.Type)}
+	paths := make(map[string]map[string]interface{})
+	for _, op := range operations {
+		path := op.Path
+		if op.Versioned {
+			path = apiV1 + path
+		}
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(op.Method)] = g.operation(op)
+	}
+	paths["/metrics"] = map[string]interface{}{"get": map[string]interface{}{
+		"summary":   "Get Prometheus metrics",
+		"responses": map[string]interface{}{"200": textResponse("The metrics in the Prometheus text format")},
+	}}
+	unsubscribe := func(summary string) map[string]interface{} {
+		return map[string]interface{}{
+			"summary": summary,
+			"parameters": []interface{}{
+				map[string]interface{}{"name": "email", "in": "query", "required": true, "description": "An address the link was made for, repeated for each", "schema": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}},
+				map[string]interface{}{"name": "token", "in": "query", "required": true, "description": "The token signing the addresses of the link", "schema": map[string]interface{}{"type": "string"}},
+			},
+			"responses": map[string]interface{}{
+				"200": htmlResponse("The confirmation page"),
+				"400": htmlResponse("The link is invalid"),
+				"404": map[string]interface{}{"$ref": "#/components/responses/Error"},
+				"500": htmlResponse("The addresses could not be unsubscribed"),
+			},
+		}
+	}
+	paths["/unsubscribe"] = map[string]interface{}{
+		"get":  unsubscribe("Unsubscribe the addresses of a signed unsubscribe link"),
+		"post": unsubscribe("Unsubscribe the addresses of a signed unsubscribe link in one click, as described in RFC 8058"),
+	}
+	paths["/t/open/{id}.gif"] = map[string]interface{}{"get": map[string]interface{}{
+		"summary": "Load the open-tracking pixel of an email, recording that it was opened",
+		"parameters": []interface{}{
+			map[string]interface{}{"name": "id", "in": "path", "required": true, "description": "The ID of the email", "schema": map[string]interface{}{"type": "string"}},
+			map[string]interface{}{"name": "r", "in": "query", "description": "The recipient the email was sent to", "schema": map[string]interface{}{"type": "string"}},
+		},
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{"description": "A transparent 1x1 GIF", "content": map[string]interface{}{"image/gif": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}},
+			"404": map[string]interface{}{"$ref": "#/components/responses/Error"},
+		},
+	}}
+	paths["/t/click/{id}"] = map[string]interface{}{"get": map[string]interface{}{
+		"summary": "Follow a tracked link of an email, recording the click",
+		"parameters": []interface{}{
+			map[string]interface{}{"name": "id", "in": "path", "required": true, "description": "The ID of the email", "schema": map[string]interface{}{"type": "string"}},
+			map[string]interface{}{"name": "u", "in": "query", "required": true, "description": "The target of the link", "schema": map[string]interface{}{"type": "string"}},
+			map[string]interface{}{"name": "r", "in": "query", "description": "The recipient the email was sent to", "schema": map[string]interface{}{"type": "string"}},
+			map[string]interface{}{"name": "t", "in": "query", "required": true, "description": "The token signing the link", "schema": map[string]interface{}{"type": "string"}},
+		},
+		"responses": map[string]interface{}{
+			"302": map[string]interface{}{"description": "A redirect to the target of the link"},
+			"400": map[string]interface{}{"$ref": "#/components/responses/Error"},
+			"404": map[string]interface{}{"$ref": "#/components/responses/Error"},
+		},
+	}}
+	paths["/bounces/{provider}"] = map[string]interface{}{"post": map[string]interface{}{
+		"summary":     "Receive the bounce and complaint notifications of an email provider",
+		"description": "Notifications are authenticated by the signature of the provider: an SNS message signature for ses, the signed event webhook headers for sendgrid and the webhook signature for mailgun.",
+		"parameters": []interface{}{
+			map[string]interface{}{"name": "provider", "in": "path", "required": true, "description": "The provider posting the notification", "schema": map[string]interface{}{"type": "string", "enum": []string{"ses", "sendgrid", "mailgun"}}},
+		},
+		"requestBody": map[string]interface{}{"required": true, "content": map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"description": "The notification, in the format of the provider"}}}},
+		"responses": map[string]interface{}{
+			"204": map[string]interface{}{"description": "The notification was recorded"},
+			"400": map[string]interface{}{"$ref": "#/components/responses/Error"},
+			"401": map[string]interface{}{"$ref": "#/components/responses/Error"},
+			"404": map[string]interface{}{"$ref": "#/components/responses/Error"},
+			"413": map[string]interface{}{"$ref": "#/components/responses/Error"},
+			"500": map[string]interface{}{"$ref": "#/components/responses/Error"},
+		},
+	}}
+	paths["/api/openapi.json"] = map[string]interface{}{"get": map[string]interface{}{
+		"summary":   "Get this OpenAPI document",
+		"responses": map[string]interface{}{"200": map[string]interface{}{"description": "The OpenAPI document", "content": map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}}}},
+	}}
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "RuneBird API",
+			"version":     "1",
+			"description": "Sends and schedules templated emails. Errors are reported as plain text, and invalid recipients as a JSON object listing them.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"responses": map[string]interface{}{
+				"Error": textResponse("The error, as plain text"),
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "Required when server.auth.mode is jwt. Each operation names the scope its token must grant.",
+				},
+			},
+		},
+	}
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func htmlResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content":     map[string]interface{}{"text/html": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+	}
+}
+
+func textResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+	}
+}
+
+// schemaGenerator derives JSON schemas from Go types, collecting those of named structs as
+// components.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+	types   map[string]reflect.Type
+	err     error
+}
+
+func (g *schemaGenerator) operation(op operation) map[string]interface{} {
+	out := map[string]interface{}{"summary": op.Summary}
+
+	var parameters []interface{}
+	for _, match := range pathParameter.FindAllStringSubmatch(op.Path, -1) {
+		parameters = append(parameters, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+	}
+	for _, q := range op.Query {
+		schema := map[string]interface{}{"type": q.Type}
+		if q.Format != "" {
+			schema["format"] = q.Format
+		}
+		parameters = append(parameters, map[string]interface{}{"name": q.Name, "in": "query", "description": q.Description, "schema": schema})
+	}
+	if op.Method == http.MethodPost && (op.Path == "/send" || op.Path == "/send/batch" || op.Path == "/send/raw" || op.Path == "/schedule") {
+		parameters = append(parameters, map[string]interface{}{
+			"name":        idempotencyKeyHeader,
+			"in":          "header",
+			"description": "Replays the original response to a retried request with the same key and body",
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(parameters) > 0 {
+		out["parameters"] = parameters
+	}
+
+	if op.Request != nil {
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.Request))}},
+		}
+	}
+
+	responses := make(map[string]interface{})
+	codes := make([]int, 0, len(op.Responses))
+	for code := range op.Responses {
+		codes = append(codes, code)
+	}
+	if op.Request != nil {
+		// Request bodies are bounded by server.http.max_body_size.
+		codes = append(codes, http.StatusRequestEntityTooLarge)
+	}
+	if op.Scope != "" {
+		// Scoped operations are authorized and counted against the request limit of the client.
+		codes = append(codes, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests)
+		out["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+		out["description"] = fmt.Sprintf("Requires the %s scope when bearer-token authentication is enabled.", op.Scope)
+		out["x-required-scope"] = op.Scope
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		key := fmt.Sprint(code)
+		body, ok := op.Responses[code]
+		if code == http.StatusNoContent {
+			responses[key] = map[string]interface{}{"description": http.StatusText(code)}
+			continue
+		}
+		if !ok || body == nil {
+			if _, exists := responses[key]; !exists {
+				responses[key] = map[string]interface{}{"$ref": "#/components/responses/Error"}
+			}
+			continue
+		}
+		var schema map[string]interface{}
+		if alternatives, ok := body.([]interface{}); ok {
+			var oneOf []interface{}
+			for _, alternative := range alternatives {
+				oneOf = append(oneOf, g.schema(reflect.TypeOf(alternative)))
+			}
+			schema = map[string]interface{}{"oneOf": oneOf}
+		} else {
+			schema = g.schema(reflect.TypeOf(body))
+		}
+		responses[key] = map[string]interface{}{
+			"description": http.StatusText(code),
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+		}
+	}
+	out["responses"] = responses
+	return out
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the JSON schema of values of type t as encoded by encoding/json.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		schema := g.schema(t.Elem())
+		if _, ref := schema["$ref"]; ref {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		return g.component(t)
+	}
+	g.err = fmt.Errorf("cannot describe type %s in the OpenAPI document", t)
+	return map[string]interface{}{}
+}
+
+// component adds the schema of struct type t to the components, returning a reference to it.
+func (g *schemaGenerator) component(t reflect.Type) map[string]interface{} {
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	if existing, ok := g.types[t.Name()]; ok {
+		if existing != t {
+			g.err = fmt.Errorf("types %s and %s have the same name in the OpenAPI document", existing, t)
+		}
+		return ref
+	}
+	g.types[t.Name()] = t
+
+	properties := make(map[string]interface{})
+	var required []string
+	g.fields(t, properties, &required)
+	if fields, ok := requiredFields[t]; ok {
+		required = fields
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	g.schemas[t.Name()] = schema
+	return ref
+}
+
+// fields adds the properties of the fields of struct type t, including those of embedded
+// structs, marking those not omitted when empty as required.
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.fields(field.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build ignore
+
+// This program writes the OpenAPI document of the API to openapi.json. Run it with go generate
+// after changing the operations or the request and response types.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"runebird/internal/server"
+)
+
+func main() {
+	doc, err := server.OpenAPI()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate the OpenAPI document: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile("openapi.json", doc, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the OpenAPI document: %v\n", err)
+		os.Exit(1)
+	}
+}
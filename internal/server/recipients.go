@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"runebird/internal/config"
+	"runebird/internal/email"
+)
+
+// mxEntry is a cached answer to whether a domain accepts email.
+type mxEntry struct {
+	reason    string
+	expiresAt time.Time
+}
+
+// recipientValidator checks recipient addresses before an email is accepted. Addresses must
+// parse as RFC 5322 addresses and be in a domain that may be emailed; with MX checking
+// enabled, their domain must also have a mail server, which is looked up once per domain and
+// cached.
+type recipientValidator struct {
+	domains    *config.RecipientDomainsConfig
+	checkMX    bool
+	ttl        time.Duration
+	lookupMX   func(ctx context.Context, domain string) ([]*net.MX, error)
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	entries    map[string]mxEntry
+	mu         sync.Mutex
+}
+
+func newRecipientValidator(domains *config.RecipientDomainsConfig, checkMX bool, ttl time.Duration) *recipientValidator {
+	return &recipientValidator{
+		domains:    domains,
+		checkMX:    checkMX,
+		ttl:        ttl,
+		lookupMX:   net.DefaultResolver.LookupMX,
+		lookupHost: net.DefaultResolver.LookupHost,
+		entries:    make(map[string]mxEntry),
+	}
+}
+
+// validate returns the problems with recipients, keyed by the field of the request, such as
+// "recipients[1]". It returns nil if every recipient is valid.
+func (v *recipientValidator) validate(ctx context.Context, recipients []string) map[string]string {
+	var problems map[string]string
+	for i, r := range recipients {
+		reason := v.check(ctx, r)
+		if reason == "" {
+			continue
+		}
+		if problems == nil {
+			problems = make(map[string]string)
+		}
+		problems[fmt.Sprintf("recipients[%d]", i)] = reason
+	}
+	return problems
+}
+
+// check returns why recipient is invalid, or "" if it is valid.
+func (v *recipientValidator) check(ctx context.Context, recipient string) string {
+	addr, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return fmt.Sprintf("invalid email address %q", recipient)
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	domain := strings.ToLower(email.ASCIIDomain(addr.Address[at+1:]))
+	if reason := email.CheckRecipientDomain(v.domains, addr.Address, email.BlockedAtRequest); reason != "" {
+		return reason
+	}
+	if !v.checkMX {
+		return ""
+	}
+	return v.checkDomain(ctx, domain)
+}
+
+// checkDomain returns why domain cannot receive email, or "" if it can. A domain without MX
+// records can still receive email at its address records, as RFC 5321 allows. Temporary DNS
+// failures are not held against the domain, and are not cached.
+func (v *recipientValidator) checkDomain(ctx context.Context, domain string) string {
+	now := time.Now()
+	v.mu.Lock()
+	entry, ok := v.entries[domain]
+	v.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.reason
+	}
+
+	records, err := v.lookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		_, err = v.lookupHost(ctx, domain)
+	}
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		entry.reason = fmt.Sprintf("domain %s has no mail server", domain)
+	case err != nil:
+		return ""
+	case len(records) == 1 && records[0].Host == ".":
+		// A null MX record (RFC 7505) declares that the domain accepts no email.
+		entry.reason = fmt.Sprintf("domain %s does not accept email", domain)
+	default:
+		entry.reason = ""
+	}
+	entry.expiresAt = now.Add(v.ttl)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.pruneExpired(now)
+	v.entries[domain] = entry
+	return entry.reason
+}
+
+// pruneExpired removes expired entries. v.mu must be held.
+func (v *recipientValidator) pruneExpired(now time.Time) {
+	for domain, entry := range v.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(v.entries, domain)
+		}
+	}
+}
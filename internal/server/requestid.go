@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+	"runebird/internal/logger"
+)
+
+// requestIDHeader is the header carrying the ID of a request, with which its log lines can be
+// found from a response or an error reported by a client.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length of the longest request ID accepted from a client.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID tags every request with an ID: the X-Request-ID header of the request if it
+// has a usable one, or a new random ID otherwise. The ID is echoed in the X-Request-ID header
+// of the response and added to the log lines of the request by log.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(withRequestIDContext(r.Context(), id)))
+	})
+}
+
+func withRequestIDContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the ID of the request of ctx, or "" outside of a request.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// log returns the logger for the request of ctx, which adds its ID to every line.
+func (s *Server) log(ctx context.Context) *logger.Logger {
+	id := requestID(ctx)
+	if id == "" {
+		return s.logger
+	}
+	return &logger.Logger{Logger: s.logger.With(zap.String("request_id", id))}
+}
+
+// validRequestID reports whether id, taken from a client, can be used as a request ID. It must
+// be short and printable so that it cannot break the log lines and headers it is copied into.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// httpError answers a request with a plain text error as http.Error does, adding the ID of the
+// request so that a client reporting the error can tell which request it was.
+func httpError(w http.ResponseWriter, message string, status int) {
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		message = fmt.Sprintf("%s (request ID: %s)", message, id)
+	}
+	http.Error(w, message, status)
+}
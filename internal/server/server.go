@@ -1,51 +1,399 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"runebird/internal/auth"
+	"runebird/internal/bounce"
 	"runebird/internal/config"
 	"runebird/internal/email"
 	"runebird/internal/logger"
+	"runebird/internal/messages"
 	"runebird/internal/rate"
 	"runebird/internal/scheduler"
+	"runebird/internal/suppression"
 	"runebird/internal/templates"
+	"runebird/internal/webhook"
 )
 
+// apiV1 is the path prefix of version 1 of the API.
+const apiV1 = "/api/v1"
+
 type Server struct {
 	cfg         *config.Config
 	logger      *logger.Logger
-	sender      *email.Sender
+	sender      email.Sender
 	templates   *templates.TemplateManager
 	rateLimiter *rate.Limiter
 	scheduler   *scheduler.Scheduler
+	health      *email.HealthChecker
 	httpServer  *http.Server
+	idempotency *idempotencyCache
+	recipients  *recipientValidator
+	messages    *messages.Log
+	clients     *clientLimiter
+	webhooks    *webhook.Subscriptions
+	// suppressions lists the addresses left out of every email.
+	suppressions *suppression.List
+	// bounces receives the bounce and complaint notifications of email providers.
+	bounces *bounce.Receiver
+	// auth validates bearer tokens, or is nil if requests are not authenticated.
+	auth *auth.Verifier
+	// certs serves the TLS certificate, or is nil if the API is served over plain HTTP.
+	certs *certReloader
+	// adminServer serves the operational endpoints, or is nil if there is no admin port.
+	adminServer *http.Server
+	// grpcServer serves the gRPC API once StartGRPC is called.
+	grpcMu     sync.Mutex
+	grpcServer *grpc.Server
+	// ctx is the base context of every request. It is cancelled on shutdown to abandon
+	// sends that are still in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	emailsSentTotal      *prometheus.CounterVec
 	emailsFailedTotal    *prometheus.CounterVec
+	emailsQueuedTotal    *prometheus.CounterVec
 	emailsScheduledTotal *prometheus.CounterVec
+	emailsOpenedTotal    *prometheus.CounterVec
+	linkClicksTotal      *prometheus.CounterVec
+	clientLimitedTotal   *prometheus.CounterVec
+	httpRequestDuration  *prometheus.HistogramVec
 }
 
 type SendRequest struct {
-	Template   string                 `json:"template"`
-	Recipients []string               `json:"recipients"`
-	Data       map[string]interface{} `json:"data"`
+	Template        string                 `json:"template"`
+	Locale          string                 `json:"locale,omitempty"`
+	From            string                 `json:"from,omitempty"`
+	Profile         string                 `json:"profile,omitempty"`
+	Recipients      []string               `json:"recipients"`
+	Data            map[string]interface{} `json:"data"`
+	Priority        string                 `json:"priority,omitempty"`
+	OnLimit         string                 `json:"on_limit,omitempty"`
+	ClientReference string                 `json:"client_reference,omitempty"`
+	ReplyTo         string                 `json:"reply_to,omitempty"`
+	Headers         map[string]string      `json:"headers,omitempty"`
+	Attachments     []email.Attachment     `json:"attachments,omitempty"`
+	DryRun          bool                   `json:"dry_run,omitempty"`
+}
+
+// BatchSendRequest sends template to each recipient of Items, rendered with the data of the
+// item. The other fields apply to every email, as in SendRequest.
+type BatchSendRequest struct {
+	Template        string             `json:"template"`
+	Locale          string             `json:"locale,omitempty"`
+	From            string             `json:"from,omitempty"`
+	Profile         string             `json:"profile,omitempty"`
+	Items           []BatchItem        `json:"items"`
+	Priority        string             `json:"priority,omitempty"`
+	OnLimit         string             `json:"on_limit,omitempty"`
+	ClientReference string             `json:"client_reference,omitempty"`
+	ReplyTo         string             `json:"reply_to,omitempty"`
+	Headers         map[string]string  `json:"headers,omitempty"`
+	Attachments     []email.Attachment `json:"attachments,omitempty"`
+	DryRun          bool               `json:"dry_run,omitempty"`
+}
+
+// RawSendRequest sends an email whose subject and bodies the caller rendered, rather than one
+// rendered from a template. Without a TextBody, the plain-text version is derived from
+// HTMLBody. With SendAt set, the email is scheduled instead, as by ScheduleRequest.
+type RawSendRequest struct {
+	From            string             `json:"from,omitempty"`
+	Profile         string             `json:"profile,omitempty"`
+	Recipients      []string           `json:"recipients"`
+	Subject         string             `json:"subject"`
+	HTMLBody        string             `json:"html_body"`
+	TextBody        string             `json:"text_body,omitempty"`
+	SendAt          *time.Time         `json:"send_at,omitempty"`
+	ExpiresAt       *time.Time         `json:"expires_at,omitempty"`
+	Priority        string             `json:"priority,omitempty"`
+	OnLimit         string             `json:"on_limit,omitempty"`
+	ClientReference string             `json:"client_reference,omitempty"`
+	CallbackURL     string             `json:"callback_url,omitempty"`
+	ReplyTo         string             `json:"reply_to,omitempty"`
+	Headers         map[string]string  `json:"headers,omitempty"`
+	Attachments     []email.Attachment `json:"attachments,omitempty"`
+	DryRun          bool               `json:"dry_run,omitempty"`
+}
+
+type BatchItem struct {
+	Recipient string                 `json:"recipient"`
+	Data      map[string]interface{} `json:"data"`
 }
 
 type ScheduleRequest struct {
-	Template   string                 `json:"template"`
+	Template        string                 `json:"template"`
+	Locale          string                 `json:"locale,omitempty"`
+	From            string                 `json:"from,omitempty"`
+	Profile         string                 `json:"profile,omitempty"`
+	Recipients      []string               `json:"recipients"`
+	SendAt          time.Time              `json:"send_at"`
+	ExpiresAt       *time.Time             `json:"expires_at,omitempty"`
+	Data            map[string]interface{} `json:"data"`
+	Priority        string                 `json:"priority,omitempty"`
+	ClientReference string                 `json:"client_reference,omitempty"`
+	CallbackURL     string                 `json:"callback_url,omitempty"`
+	ReplyTo         string                 `json:"reply_to,omitempty"`
+	Headers         map[string]string      `json:"headers,omitempty"`
+	Attachments     []email.Attachment     `json:"attachments,omitempty"`
+	DryRun          bool                   `json:"dry_run,omitempty"`
+}
+
+type UpdateScheduleRequest struct {
+	SendAt     *time.Time             `json:"send_at"`
 	Recipients []string               `json:"recipients"`
-	SendAt     time.Time              `json:"send_at"`
 	Data       map[string]interface{} `json:"data"`
 }
 
-func New(cfg *config.Config, log *logger.Logger, sender *email.Sender, tm *templates.TemplateManager, rl *rate.Limiter, sched *scheduler.Scheduler) *Server {
+type ScheduledTaskResponse struct {
+	ID         string               `json:"id"`
+	Template   string               `json:"template"`
+	Recipients []string             `json:"recipients"`
+	SendAt     time.Time            `json:"send_at"`
+	ExpiresAt  *time.Time           `json:"expires_at,omitempty"`
+	CreatedAt  time.Time            `json:"created_at"`
+	Priority   rate.Priority        `json:"priority"`
+	Status     scheduler.TaskStatus `json:"status"`
+}
+
+type TaskResponse struct {
+	ScheduledTaskResponse
+	TemplateVersion int                      `json:"template_version,omitempty"`
+	UpdatedAt       time.Time                `json:"updated_at"`
+	LastError       string                   `json:"last_error,omitempty"`
+	MessageID       string                   `json:"message_id,omitempty"`
+	Rejected        []email.Rejection        `json:"rejected,omitempty"`
+	Suppressed      []string                 `json:"suppressed,omitempty"`
+	History         []scheduler.StatusChange `json:"history"`
+}
+
+// SendResponse reports a sent email. Rejected lists recipients the SMTP server refused while
+// accepting the email for the others, Suppressed those left out because they are on the
+// suppression list, and Response is the provider's reply to the email.
+// TemplateVersion is the stored template version the email was rendered from, if any. ID
+// identifies the email at /messages/{id}, while MessageID is the provider's ID for it.
+type SendResponse struct {
+	Status          string            `json:"status"`
+	ID              string            `json:"id"`
+	MessageID       string            `json:"message_id,omitempty"`
+	TemplateVersion int               `json:"template_version,omitempty"`
+	DryRun          bool              `json:"dry_run,omitempty"`
+	Provider        string            `json:"provider"`
+	Accepted        []string          `json:"accepted"`
+	Rejected        []email.Rejection `json:"rejected,omitempty"`
+	Suppressed      []string          `json:"suppressed,omitempty"`
+	ResponseCode    int               `json:"response_code,omitempty"`
+	Response        string            `json:"response,omitempty"`
+	DurationMS      int64             `json:"duration_ms"`
+}
+
+// QueuedResponse reports an email queued because the rate limit was reached, whose progress
+// is reported under ID. Suppressed lists the recipients left out of the email.
+type QueuedResponse struct {
+	Status     string   `json:"status"`
+	ID         string   `json:"id,omitempty"`
+	Suppressed []string `json:"suppressed,omitempty"`
+}
+
+// AcceptedResponse reports an email accepted by an asynchronous send. Its progress is reported
+// under ID at StatusURL. Suppressed lists the recipients left out of the email.
+type AcceptedResponse struct {
+	Status     string   `json:"status"`
+	ID         string   `json:"id"`
+	StatusURL  string   `json:"status_url"`
+	Suppressed []string `json:"suppressed,omitempty"`
+}
+
+// BatchSendResponse reports the outcome of each item of a batch send, in the order of the
+// request, along with how many were sent, queued and failed.
+type BatchSendResponse struct {
+	Sent    int               `json:"sent"`
+	Queued  int               `json:"queued"`
+	Failed  int               `json:"failed"`
+	Results []BatchItemResult `json:"results"`
+}
+
+// BatchItemResult reports one item of a batch send. Status is "success", "queued" or
+// "failed"; a failed item carries the HTTP status and error /send would have answered with,
+// along with any invalid fields.
+type BatchItemResult struct {
+	Recipient       string            `json:"recipient"`
+	Status          string            `json:"status"`
+	ID              string            `json:"id,omitempty"`
+	MessageID       string            `json:"message_id,omitempty"`
+	TemplateVersion int               `json:"template_version,omitempty"`
+	Code            int               `json:"code,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Fields          map[string]string `json:"fields,omitempty"`
+}
+
+// ScheduleResponse reports a scheduled email, whose progress is reported under its TaskID.
+// Suppressed lists the recipients left out of the email.
+type ScheduleResponse struct {
+	Status     string   `json:"status"`
+	TaskID     string   `json:"task_id"`
+	Suppressed []string `json:"suppressed,omitempty"`
+}
+
+// ValidationErrorResponse reports invalid fields of a request, keyed by field name, and the ID
+// of the request.
+type ValidationErrorResponse struct {
+	Error     string            `json:"error"`
+	Fields    map[string]string `json:"fields"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+type UpdateScheduleResponse struct {
+	Status     string                `json:"status"`
+	Task       ScheduledTaskResponse `json:"task"`
+	Suppressed []string              `json:"suppressed,omitempty"`
+}
+
+type RunScheduleResponse struct {
+	Status string       `json:"status"`
+	Task   TaskResponse `json:"task"`
+}
+
+type QuotaWindowResponse struct {
+	Limit     *int `json:"limit"`
+	Used      int  `json:"used"`
+	Remaining *int `json:"remaining"`
+}
+
+type QuotaResponse struct {
+	Daily   QuotaWindowResponse `json:"daily"`
+	Monthly QuotaWindowResponse `json:"monthly"`
+}
+
+// HealthResponse reports whether the service is ready to accept emails, which it is not while
+// the email provider cannot be reached.
+type HealthResponse struct {
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+type TemplateRequest struct {
+	Content string `json:"content"`
+}
+
+type TemplateResponse struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Version int    `json:"version,omitempty"`
+}
+
+type TemplateStatusResponse struct {
+	Status  string `json:"status"`
+	Name    string `json:"name"`
+	Version int    `json:"version,omitempty"`
+}
+
+type TemplateVersionsResponse struct {
+	Name     string              `json:"name"`
+	Versions []templates.Version `json:"versions"`
+}
+
+type TemplateVariablesResponse struct {
+	Name      string               `json:"name"`
+	Variables []templates.Variable `json:"variables"`
+}
+
+type PreviewRequest struct {
+	Locale string                 `json:"locale,omitempty"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+type PreviewResponse struct {
+	Template string `json:"template"`
+	Subject  string `json:"subject"`
+	HTML     string `json:"html"`
+	Text     string `json:"text"`
+}
+
+type ValidateTemplateRequest struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+type ValidateTemplateResponse struct {
+	Valid  bool              `json:"valid"`
+	Issues []templates.Issue `json:"issues"`
+}
+
+type ListTemplatesResponse struct {
+	Templates []string `json:"templates"`
+}
+
+type SchedulerStateResponse struct {
+	Status string `json:"status"`
+	Paused bool   `json:"paused"`
+}
+
+type ListScheduleResponse struct {
+	Tasks  []ScheduledTaskResponse `json:"tasks"`
+	Total  int                     `json:"total"`
+	Offset int                     `json:"offset"`
+	Limit  int                     `json:"limit"`
+}
+
+// WebhookRequest registers or updates a webhook subscription to the events listed, which are
+// signed with Secret. A secret is generated for a new subscription without one, and an update
+// without one keeps the current secret.
+type WebhookRequest struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+type ListWebhooksResponse struct {
+	Webhooks []webhook.Subscription `json:"webhooks"`
+}
+
+type WebhookDeliveriesResponse struct {
+	ID         string            `json:"id"`
+	Deliveries []webhook.Attempt `json:"deliveries"`
+}
+
+// SuppressionRequest adds Address to the suppression list, for a manual reason unless one is
+// given.
+type SuppressionRequest struct {
+	Address string             `json:"address"`
+	Reason  suppression.Reason `json:"reason,omitempty"`
+	Note    string             `json:"note,omitempty"`
+}
+
+type ListSuppressionsResponse struct {
+	Suppressions []suppression.Entry `json:"suppressions"`
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+	// maxBatchItems bounds the items of a batch send, which are sent within one request.
+	maxBatchItems = 1000
+)
+
+func New(cfg *config.Config, log *logger.Logger, sender email.Sender, tm *templates.TemplateManager, rl *rate.Limiter, sched *scheduler.Scheduler, msgs *messages.Log, hooks *webhook.Subscriptions, suppressions *suppression.List, health *email.HealthChecker) *Server {
 	emailsSentTotal := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "runebird_emails_sent_total",
@@ -60,6 +408,13 @@ func New(cfg *config.Config, log *logger.Logger, sender *email.Sender, tm *templ
 		},
 		[]string{"template"},
 	)
+	emailsQueuedTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runebird_emails_queued_total",
+			Help: "Total number of emails queued because the rate limit was reached",
+		},
+		[]string{"template"},
+	)
 	emailsScheduledTotal := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "runebird_emails_scheduled_total",
@@ -67,11 +422,122 @@ func New(cfg *config.Config, log *logger.Logger, sender *email.Sender, tm *templ
 		},
 		[]string{"template"},
 	)
+	emailsOpenedTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runebird_emails_opened_total",
+			Help: "Total number of opens of tracked emails",
+		},
+		[]string{"template"},
+	)
+	linkClicksTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runebird_link_clicks_total",
+			Help: "Total number of clicks on tracked links",
+		},
+		[]string{"template"},
+	)
+	clientLimitedTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runebird_client_limited_total",
+			Help: "Total number of requests and emails rejected by the per-client limits",
+		},
+		[]string{"limit"},
+	)
+	httpRequestDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "runebird_http_request_duration_seconds",
+			Help:    "Time taken to serve HTTP requests",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "status"},
+	)
+
+	tasksExpiredTotal := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "runebird_tasks_expired_total",
+			Help: "Total number of scheduled tasks that expired before they could be sent",
+		},
+		func() float64 { return float64(sched.Expired()) },
+	)
+
+	tasksFailedTotal := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "runebird_tasks_failed_total",
+			Help: "Total number of scheduled tasks that failed, after any retries",
+		},
+		func() float64 { return float64(sched.Failed()) },
+	)
+	// The backlog is read from the task store, which is shared by every instance with Redis.
+	pendingTasks := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "runebird_scheduler_pending_tasks",
+			Help: "Number of scheduled tasks waiting to be sent, including those due for a retry",
+		},
+		func() float64 {
+			pending, _, err := sched.Backlog()
+			if err != nil {
+				log.Error("Failed to read scheduler backlog", zap.Error(err))
+			}
+			return float64(pending)
+		},
+	)
+	oldestPendingAge := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "runebird_scheduler_oldest_pending_age_seconds",
+			Help: "How long the earliest pending scheduled task has been due, or 0 if none is due",
+		},
+		func() float64 {
+			_, age, err := sched.Backlog()
+			if err != nil {
+				log.Error("Failed to read scheduler backlog", zap.Error(err))
+			}
+			return age.Seconds()
+		},
+	)
+
+	queuedSentTotal := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "runebird_queued_emails_sent_total",
+			Help: "Total number of rate-limited emails sent from the queue",
+		},
+		func() float64 { return float64(rl.QueuedSent()) },
+	)
+	queuedFailedTotal := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "runebird_queued_emails_failed_total",
+			Help: "Total number of rate-limited emails that failed to send from the queue",
+		},
+		func() float64 { return float64(rl.QueuedFailed()) },
+	)
+
+	queuedDroppedTotal := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "runebird_queued_emails_dropped_total",
+			Help: "Total number of queued emails dropped because the queue was full",
+		},
+		func() float64 { return float64(rl.QueuedDropped()) },
+	)
 
 	prometheus.MustRegister(emailsSentTotal)
 	prometheus.MustRegister(emailsFailedTotal)
+	prometheus.MustRegister(emailsQueuedTotal)
 	prometheus.MustRegister(emailsScheduledTotal)
+	prometheus.MustRegister(emailsOpenedTotal)
+	prometheus.MustRegister(linkClicksTotal)
+	prometheus.MustRegister(clientLimitedTotal)
+	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(tasksExpiredTotal)
+	prometheus.MustRegister(tasksFailedTotal)
+	prometheus.MustRegister(pendingTasks)
+	prometheus.MustRegister(oldestPendingAge)
+	prometheus.MustRegister(queuedSentTotal)
+	prometheus.MustRegister(queuedFailedTotal)
+	prometheus.MustRegister(queuedDroppedTotal)
+	prometheus.MustRegister(rl.Collectors()...)
+	prometheus.MustRegister(sender.Collectors()...)
+	prometheus.MustRegister(health.Collectors()...)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	srv := &Server{
 		cfg:                  cfg,
 		logger:               log,
@@ -79,35 +545,206 @@ func New(cfg *config.Config, log *logger.Logger, sender *email.Sender, tm *templ
 		templates:            tm,
 		rateLimiter:          rl,
 		scheduler:            sched,
+		health:               health,
 		emailsSentTotal:      emailsSentTotal,
 		emailsFailedTotal:    emailsFailedTotal,
+		emailsQueuedTotal:    emailsQueuedTotal,
 		emailsScheduledTotal: emailsScheduledTotal,
+		emailsOpenedTotal:    emailsOpenedTotal,
+		linkClicksTotal:      linkClicksTotal,
+		clientLimitedTotal:   clientLimitedTotal,
+		httpRequestDuration:  httpRequestDuration,
+		idempotency:          newIdempotencyCache(cfg.Server.IdempotencyTTL),
+		recipients:           newRecipientValidator(&cfg.Delivery.RecipientDomains, cfg.Server.CheckMX, cfg.Server.MXCacheTTL),
+		messages:             msgs,
+		webhooks:             hooks,
+		suppressions:         suppressions,
+		bounces:              bounce.NewReceiver(&cfg.Bounces, msgs, suppressions, log),
+		clients:              newClientLimiter(&cfg.Server.ClientLimits),
+		ctx:                  ctx,
+		cancel:               cancel,
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/send", srv.handleSend)
-	mux.HandleFunc("/schedule", srv.handleSchedule)
-	mux.Handle("/metrics", promhttp.Handler())
+	if cfg.Server.Auth.Mode == "jwt" {
+		srv.auth = auth.New(&cfg.Server.Auth.JWT)
+	}
+	if cfg.Server.TLS.CertFile != "" {
+		srv.certs = newCertReloader(&cfg.Server.TLS, log)
+	}
 
+	public, admin := srv.handlers()
 	srv.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler: mux,
+		Addr:              fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:           public,
+		ReadHeaderTimeout: cfg.Server.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.Server.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.Server.HTTP.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	if admin != nil {
+		srv.adminServer = &http.Server{
+			Addr:              net.JoinHostPort(cfg.Admin.Address, strconv.Itoa(cfg.Admin.Port)),
+			Handler:           admin,
+			ReadHeaderTimeout: cfg.Server.HTTP.ReadHeaderTimeout,
+			IdleTimeout:       cfg.Server.HTTP.IdleTimeout,
+			BaseContext: func(net.Listener) context.Context {
+				return ctx
+			},
+		}
 	}
 
 	return srv
 }
 
+// handlers returns the handler of the API port and, if admin.port is set, that of the admin
+// port, which then serves the operational endpoints instead of the API port.
+func (s *Server) handlers() (http.Handler, http.Handler) {
+	public := http.NewServeMux()
+	ops := public
+	if s.cfg.Admin.Port != 0 {
+		ops = http.NewServeMux()
+		ops.HandleFunc("/health", s.handleHealth)
+		ops.HandleFunc("/debug/pprof/", pprof.Index)
+		ops.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		ops.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		ops.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		ops.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// The API is served under apiV1, and at the paths it had before it was versioned so that
+	// existing clients keep working.
+	for _, route := range s.routes() {
+		mux := public
+		if route.admin {
+			mux = ops
+		}
+		mux.HandleFunc(apiV1+route.pattern, route.handler)
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+	public.HandleFunc("/api/openapi.json", s.handleOpenAPI)
+	public.HandleFunc("/health", s.handleHealth)
+	// Unsubscribe links, tracking pixels and tracked links are followed by recipients, so they
+	// are served without authorization.
+	public.HandleFunc("/unsubscribe", s.handleUnsubscribe)
+	public.HandleFunc(templates.OpenPixelPath+"{file}", s.handleOpen)
+	public.HandleFunc(templates.ClickPath+"{id}", s.handleClick)
+	// Bounce notifications are posted by email providers, which sign them instead.
+	public.HandleFunc("/bounces/{provider}", s.handleBounces)
+	ops.Handle("/metrics", promhttp.Handler())
+
+	if ops == public {
+		return withRequestID(s.withAccessLog(public)), nil
+	}
+	return withRequestID(s.withAccessLog(public)), withRequestID(s.withAccessLog(ops))
+}
+
+// route is an endpoint of the API, with the pattern it is served at below apiV1.
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+	// admin marks the endpoints requiring the admin scope, which are served on the admin port
+	// if there is one.
+	admin bool
+}
+
+// routes returns the endpoints of the API, each requiring the scope of its group when
+// bearer-token authentication is enabled. The operations in the OpenAPI document describe them.
+func (s *Server) routes() []route {
+	scopes := s.cfg.Server.Auth.JWT.Scopes
+	send := func(h http.HandlerFunc) http.HandlerFunc { return s.authorize(scopes.Send, h) }
+	schedule := func(h http.HandlerFunc) http.HandlerFunc { return s.authorize(scopes.Schedule, h) }
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return s.authorize(scopes.Admin, h) }
+
+	return []route{
+		{"/send", send(s.withIdempotency(s.handleSend)), false},
+		{"/send/batch", send(s.withIdempotency(s.handleSendBatch)), false},
+		{"/send/raw", send(s.withIdempotency(s.handleSendRaw)), false},
+		{"/schedule", schedule(s.withIdempotency(s.handleSchedule)), false},
+		{"/schedule/{id}", schedule(s.handleScheduleTask), false},
+		{"/schedule/{id}/run", schedule(s.handleRunSchedule), false},
+		{"/tasks/{id}", schedule(s.handleTask), false},
+		{"/messages/{id}", send(s.handleMessage), false},
+		{"/quota", send(s.handleQuota), false},
+		{"/templates", admin(s.handleListTemplates), true},
+		{"/templates/{name}", admin(s.handleTemplate), true},
+		{"/templates/{name}/preview", admin(s.handlePreviewTemplate), true},
+		{"/templates/{name}/validate", admin(s.handleValidateTemplate), true},
+		{"/templates/{name}/variables", admin(s.handleTemplateVariables), true},
+		{"/templates/{name}/versions", admin(s.handleTemplateVersions), true},
+		{"/templates/{name}/versions/{version}/activate", admin(s.handleActivateTemplate), true},
+		{"/webhooks", admin(s.handleWebhooks), true},
+		{"/webhooks/{id}", admin(s.handleWebhook), true},
+		{"/webhooks/{id}/deliveries", admin(s.handleWebhookDeliveries), true},
+		{"/suppressions", admin(s.handleSuppressions), true},
+		{"/suppressions/{address}", admin(s.handleSuppression), true},
+		{"/admin/scheduler/pause", admin(s.handlePauseScheduler), true},
+		{"/admin/scheduler/resume", admin(s.handleResumeScheduler), true},
+	}
+}
+
 func (s *Server) Start() error {
-	s.logger.Info("Starting HTTP server", zap.Int("port", s.cfg.Server.Port))
-	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("failed to start HTTP server: %v", err)
+	tlsCfg := s.cfg.Server.TLS
+	if s.certs == nil {
+		s.logger.Info("Starting HTTP server", zap.Int("port", s.cfg.Server.Port))
+		if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("failed to start HTTP server: %v", err)
+		}
+		return nil
+	}
+
+	tlsConfig, err := newTLSConfig(&tlsCfg)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %v", err)
+	}
+	if err := s.certs.reload(); err != nil {
+		return err
+	}
+	tlsConfig.GetCertificate = s.certs.getCertificate
+	s.httpServer.TLSConfig = tlsConfig
+	if tlsCfg.ReloadInterval > 0 {
+		go s.certs.watch(s.ctx, tlsCfg.ReloadInterval)
+	}
+	s.logger.Info("Starting HTTPS server", zap.Int("port", s.cfg.Server.Port), zap.Bool("client_certificates", tlsCfg.ClientCAFile != ""))
+	if err := s.httpServer.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to start HTTPS server: %v", err)
 	}
 	return nil
 }
 
-func (s *Server) Shutdown() error {
+// ReloadCertificate loads the TLS certificate again from its files, as on SIGHUP. It does
+// nothing if the API is served over plain HTTP, and keeps the current certificate if the
+// files cannot be loaded.
+func (s *Server) ReloadCertificate() error {
+	if s.certs == nil {
+		return nil
+	}
+	return s.certs.reload()
+}
+
+// Shutdown stops accepting connections and waits for the requests and gRPC calls in progress
+// to finish until ctx is done, at which point the sends they are still waiting for are
+// abandoned and their connections closed.
+func (s *Server) Shutdown(ctx context.Context) error {
 	s.logger.Info("Shutting down HTTP server")
-	if err := s.httpServer.Close(); err != nil {
+	defer s.cancel()
+	grpcStopped := s.shutdownGRPC(ctx)
+	defer func() { <-grpcStopped }()
+	if err := s.shutdownAdmin(ctx); err != nil {
+		s.logger.Error("Failed to shut down admin server", zap.Error(err))
+	}
+	err := s.httpServer.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		s.logger.Warn("Requests still in progress after the shutdown timeout, abandoning them", zap.Error(err))
+		s.cancel()
+		err = s.httpServer.Close()
+	}
+	if err != nil {
 		return fmt.Errorf("failed to shutdown HTTP server: %v", err)
 	}
 	return nil
@@ -115,101 +752,1213 @@ func (s *Server) Shutdown() error {
 
 func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var req SendRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.logger.Error("Failed to decode request body", zap.Error(err))
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.log(r.Context()).Error("Failed to decode request body", zap.Error(err))
+		writeBodyError(w, err)
 		return
 	}
 
-	if req.Template == "" {
-		http.Error(w, "Template name is required", http.StatusBadRequest)
-		return
+	async := s.cfg.Server.AsyncSend
+	if value := r.URL.Query().Get("async"); value != "" {
+		var err error
+		if async, err = strconv.ParseBool(value); err != nil {
+			httpError(w, "Invalid async parameter, expected true or false", http.StatusBadRequest)
+			return
+		}
 	}
-	if len(req.Recipients) == 0 {
-		http.Error(w, "At least one recipient is required", http.StatusBadRequest)
+	if async {
+		id, suppressed, err := s.enqueueEmail(r.Context(), req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, AcceptedResponse{Status: "accepted", ID: id, StatusURL: apiV1 + "/messages/" + id, Suppressed: suppressed})
 		return
 	}
 
-	body, subject, err := s.templates.Render(req.Template, req.Data)
+	resp, queued, err := s.sendEmail(r.Context(), req, nil)
 	if err != nil {
-		s.logger.Error("Failed to render template", zap.String("template", req.Template), zap.Error(err))
-		s.emailsFailedTotal.WithLabelValues(req.Template).Inc()
-		http.Error(w, fmt.Sprintf("Failed to render template: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	if queued {
+		writeJSON(w, http.StatusAccepted, QueuedResponse{Status: "queued", ID: resp.ID, Suppressed: resp.Suppressed})
 		return
 	}
+	writeJSON(w, http.StatusOK, resp)
+}
 
-	if subject == "" {
-		subject = fmt.Sprintf("Email from RuneBird (%s)", req.Template)
+// sendEmail sends the email of req now, or queues it if the rate limit is reached or the send
+// window is closed, in which case it reports true. The email is rendered from the template of
+// req unless its content is given, as for a raw send, and is not sent to suppressed
+// recipients. Requests that cannot be served fail with a *requestError.
+func (s *Server) sendEmail(ctx context.Context, req SendRequest, content *scheduler.Content) (SendResponse, bool, error) {
+	if req.Template == "" && content == nil {
+		return SendResponse{}, false, requestErrorf(http.StatusBadRequest, "Template name is required")
+	}
+	if len(req.Recipients) == 0 {
+		return SendResponse{}, false, requestErrorf(http.StatusBadRequest, "At least one recipient is required")
+	}
+	if err := s.checkRecipients(ctx, req.Recipients); err != nil {
+		return SendResponse{}, false, err
+	}
+	recipients, suppressed, err := s.checkSuppressed(ctx, req.Recipients)
+	if err != nil {
+		return SendResponse{}, false, err
+	}
+	req.Recipients = recipients
+	variant := s.templates.Resolve(req.Template, req.Locale)
+	from := req.From
+	if from == "" {
+		from = s.templates.Metadata(variant).From
+	}
+	if err := s.checkFrom(from); err != nil {
+		return SendResponse{}, false, err
+	}
+	profile := req.Profile
+	if profile == "" {
+		profile = s.templates.Metadata(variant).Profile
+	}
+	if err := s.checkProfile(profile); err != nil {
+		return SendResponse{}, false, err
+	}
+	priority, err := rate.ParsePriority(req.Priority)
+	if err != nil {
+		return SendResponse{}, false, requestErrorf(http.StatusBadRequest, "Invalid priority: %v", err)
+	}
+	if err := s.checkAttachments(req.Attachments); err != nil {
+		return SendResponse{}, false, err
+	}
+	if err := email.ValidateHeaders(req.ReplyTo, req.Headers); err != nil {
+		return SendResponse{}, false, requestErrorf(http.StatusBadRequest, "Invalid headers: %v", err)
+	}
+
+	onLimit := req.OnLimit
+	if onLimit == "" {
+		onLimit = s.cfg.RateLimit.OnLimit
+	}
+	switch onLimit {
+	case "", "queue", "reject":
+	default:
+		return SendResponse{}, false, requestErrorf(http.StatusBadRequest, "OnLimit must be one of queue, reject")
 	}
 
-	if s.rateLimiter.CanSend() {
-		if err := s.sender.Send(req.Recipients, subject, body); err != nil {
-			s.logger.Error("Failed to send email", zap.String("template", req.Template), zap.Any("recipients", req.Recipients), zap.Error(err))
+	var version int
+	var body, subject, text string
+	if content != nil {
+		subject, body, text = content.Subject, content.HTMLBody, content.TextBody
+	} else {
+		version = s.templates.Version(variant)
+		body, subject, err = s.templates.Render(variant, req.Data)
+		if err != nil {
+			s.log(ctx).Error("Failed to render template", zap.String("template", req.Template), zap.Error(err))
 			s.emailsFailedTotal.WithLabelValues(req.Template).Inc()
-			http.Error(w, fmt.Sprintf("Failed to send email: %v", err), http.StatusInternalServerError)
-			return
+			if errors.Is(err, templates.ErrMissingData) {
+				return SendResponse{}, false, requestErrorf(http.StatusBadRequest, "Invalid template data: %v", err)
+			}
+			return SendResponse{}, false, requestErrorf(http.StatusInternalServerError, "Failed to render template: %v", err)
+		}
+
+		if subject == "" {
+			subject = fmt.Sprintf("Email from RuneBird (%s)", req.Template)
+		}
+
+		text, err = s.templates.RenderText(variant, req.Data)
+		if err != nil {
+			s.log(ctx).Error("Failed to render template text", zap.String("template", req.Template), zap.Error(err))
+			s.emailsFailedTotal.WithLabelValues(req.Template).Inc()
+			return SendResponse{}, false, requestErrorf(http.StatusInternalServerError, "Failed to render template: %v", err)
+		}
+	}
+
+	msg := email.Message{
+		ID:          fmt.Sprintf("msg-%d", time.Now().UnixNano()),
+		From:        from,
+		Recipients:  req.Recipients,
+		Template:    req.Template,
+		Profile:     profile,
+		Subject:     subject,
+		HTMLBody:    body,
+		TextBody:    text,
+		ReplyTo:     req.ReplyTo,
+		Headers:     s.templates.Headers(req.Template, req.Recipients, req.Headers),
+		Attachments: req.Attachments,
+		DryRun:      req.DryRun,
+	}
+	msg.HTMLBody = s.templates.Track(msg.Template, msg.ID, msg.Recipients, msg.HTMLBody)
+	if err := email.CheckSize(msg, s.cfg.SMTP.FromAddress, s.cfg.Server.MaxMessageSize); errors.Is(err, email.ErrMessageTooLarge) {
+		s.log(ctx).Error("Email exceeds the maximum message size", zap.String("template", req.Template), zap.Any("recipients", req.Recipients), zap.Error(err))
+		s.emailsFailedTotal.WithLabelValues(req.Template).Inc()
+		return SendResponse{}, false, requestErrorf(http.StatusRequestEntityTooLarge, "Email is too large: %v", err)
+	}
+	// The emails counted against the client's daily limit are given back if the request fails.
+	counted := 0
+	if !req.DryRun {
+		if err := s.allowEmails(ctx, len(req.Recipients)); err != nil {
+			return SendResponse{}, false, err
 		}
-		if err := s.rateLimiter.ConsumeToken(); err != nil {
-			s.logger.Error("Failed to consume rate limiter token", zap.String("template", req.Template), zap.Error(err))
+		counted = len(req.Recipients)
+	}
+	windowOpen := s.rateLimiter.WindowOpen(req.Template)
+	if windowOpen && s.rateLimiter.CanSend(profile, len(req.Recipients)) {
+		s.messages.Accept(msg)
+		result, err := s.sender.SendMessage(ctx, msg)
+		if err != nil {
+			s.rateLimiter.ObserveSendError(err)
+			s.log(ctx).Error("Failed to send email", zap.String("template", req.Template), zap.Any("recipients", req.Recipients), zap.Error(err))
+			s.emailsFailedTotal.WithLabelValues(req.Template).Inc()
+			s.refundEmails(ctx, counted)
+			return SendResponse{}, false, requestErrorf(http.StatusInternalServerError, "Failed to send email: %v", err)
 		}
-		s.logger.Info("Email sent successfully", zap.String("template", req.Template), zap.Any("recipients", req.Recipients))
+		s.rateLimiter.ObserveSendSuccess()
+		s.log(ctx).Info("Email sent successfully", append([]zap.Field{zap.String("template", req.Template), zap.Int("template_version", version), zap.Any("recipients", req.Recipients)}, result.LogFields()...)...)
 		s.emailsSentTotal.WithLabelValues(req.Template).Inc()
+		return SendResponse{
+			Status:          "success",
+			ID:              msg.ID,
+			MessageID:       result.MessageID,
+			TemplateVersion: version,
+			DryRun:          result.Provider == email.DryRunProvider,
+			Provider:        result.Provider,
+			Accepted:        result.Accepted,
+			Rejected:        result.Rejected,
+			Suppressed:      append(suppressed, result.Suppressed...),
+			ResponseCode:    result.ResponseCode,
+			Response:        result.Response,
+			DurationMS:      result.Duration.Milliseconds(),
+		}, false, nil
+	} else if windowOpen && onLimit == "reject" {
+		retryAfter := int(math.Ceil(s.rateLimiter.RetryAfter(profile).Seconds()))
+		s.log(ctx).Info("Email rejected due to rate limit", zap.String("template", req.Template), zap.Any("recipients", req.Recipients), zap.Int("retry_after", retryAfter))
+		s.refundEmails(ctx, counted)
+		return SendResponse{}, false, &requestError{status: http.StatusTooManyRequests, message: "Rate limit exceeded", retryAfter: retryAfter}
 	} else {
-		s.rateLimiter.QueueEmail(req.Recipients, subject, body)
-		s.logger.Info("Email queued due to rate limit", zap.String("template", req.Template), zap.Any("recipients", req.Recipients))
-		s.emailsSentTotal.WithLabelValues(req.Template).Inc()
+		s.messages.Accept(msg)
+		if err := s.rateLimiter.QueueEmail(req.Template, msg, priority); err != nil {
+			s.log(ctx).Error("Failed to queue email", zap.String("template", req.Template), zap.Any("recipients", req.Recipients), zap.Error(err))
+			s.messages.Fail(msg, err)
+			s.emailsFailedTotal.WithLabelValues(req.Template).Inc()
+			s.refundEmails(ctx, counted)
+			if errors.Is(err, rate.ErrQueueFull) {
+				return SendResponse{}, false, requestErrorf(http.StatusServiceUnavailable, "Rate limit queue is full")
+			}
+			return SendResponse{}, false, requestErrorf(http.StatusInternalServerError, "Failed to queue email: %v", err)
+		}
+		s.log(ctx).Info("Email queued due to rate limit", zap.String("template", req.Template), zap.Any("recipients", req.Recipients))
+		s.emailsQueuedTotal.WithLabelValues(req.Template).Inc()
+		return SendResponse{ID: msg.ID, Suppressed: suppressed}, true, nil
 	}
-
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(`{"status": "success"}`))
 }
 
-func (s *Server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleSendBatch(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req ScheduleRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.logger.Error("Failed to decode schedule request body", zap.Error(err))
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	var req BatchSendRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.log(r.Context()).Error("Failed to decode batch request body", zap.Error(err))
+		writeBodyError(w, err)
 		return
 	}
-
 	if req.Template == "" {
-		http.Error(w, "Template name is required", http.StatusBadRequest)
+		httpError(w, "Template name is required", http.StatusBadRequest)
 		return
 	}
-	if len(req.Recipients) == 0 {
-		http.Error(w, "At least one recipient is required", http.StatusBadRequest)
+	if len(req.Items) == 0 {
+		httpError(w, "At least one item is required", http.StatusBadRequest)
 		return
 	}
-	if req.SendAt.IsZero() {
-		http.Error(w, "SendAt time is required", http.StatusBadRequest)
+	if len(req.Items) > maxBatchItems {
+		httpError(w, fmt.Sprintf("A batch must not have more than %d items", maxBatchItems), http.StatusRequestEntityTooLarge)
 		return
 	}
-	if req.SendAt.Before(time.Now().UTC()) {
-		http.Error(w, "SendAt time must be in the future", http.StatusBadRequest)
+
+	// Each item is sent as a /send request of its own, so that it is rendered with its data and
+	// takes its turn at the rate limit. Items that do not fit are queued or rejected rather than
+	// waited for, and an item rejected or failing does not stop the others.
+	resp := BatchSendResponse{Results: make([]BatchItemResult, 0, len(req.Items))}
+	for _, item := range req.Items {
+		result := BatchItemResult{Recipient: item.Recipient}
+		sent, queued, err := s.sendEmail(r.Context(), SendRequest{
+			Template:        req.Template,
+			Locale:          req.Locale,
+			From:            req.From,
+			Profile:         req.Profile,
+			Recipients:      []string{item.Recipient},
+			Data:            item.Data,
+			Priority:        req.Priority,
+			OnLimit:         req.OnLimit,
+			ClientReference: req.ClientReference,
+			ReplyTo:         req.ReplyTo,
+			Headers:         req.Headers,
+			Attachments:     req.Attachments,
+			DryRun:          req.DryRun,
+		}, nil)
+		var reqErr *requestError
+		switch {
+		case errors.As(err, &reqErr):
+			result.Status, result.Code, result.Error, result.Fields = "failed", reqErr.status, reqErr.message, reqErr.fields
+			resp.Failed++
+		case err != nil:
+			result.Status, result.Code, result.Error = "failed", http.StatusInternalServerError, err.Error()
+			resp.Failed++
+		case queued:
+			result.Status, result.ID = "queued", sent.ID
+			resp.Queued++
+		default:
+			result.Status, result.ID, result.MessageID, result.TemplateVersion = "success", sent.ID, sent.MessageID, sent.TemplateVersion
+			resp.Sent++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	s.log(r.Context()).Info("Batch processed", zap.String("template", req.Template), zap.Int("sent", resp.Sent), zap.Int("queued", resp.Queued), zap.Int("failed", resp.Failed))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleSendRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	id := fmt.Sprintf("sched-%d", time.Now().UnixNano())
+	var req RawSendRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.log(r.Context()).Error("Failed to decode raw send request body", zap.Error(err))
+		writeBodyError(w, err)
+		return
+	}
+	if strings.TrimSpace(req.Subject) == "" {
+		httpError(w, "Subject is required", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.HTMLBody) == "" {
+		httpError(w, "HTML body is required", http.StatusBadRequest)
+		return
+	}
+	content := &scheduler.Content{Subject: req.Subject, HTMLBody: req.HTMLBody, TextBody: req.TextBody}
 
-	if err := s.scheduler.Schedule(id, req.Template, req.Recipients, req.Data, req.SendAt); err != nil {
-		s.logger.Error("Failed to schedule email", zap.String("id", id), zap.Error(err))
-		http.Error(w, fmt.Sprintf("Failed to schedule email: %v", err), http.StatusInternalServerError)
+	if req.SendAt != nil {
+		if req.OnLimit != "" {
+			httpError(w, "OnLimit is not supported for scheduled emails", http.StatusBadRequest)
+			return
+		}
+		id, suppressed, err := s.scheduleEmail(r.Context(), ScheduleRequest{
+			From:            req.From,
+			Profile:         req.Profile,
+			Recipients:      req.Recipients,
+			SendAt:          *req.SendAt,
+			ExpiresAt:       req.ExpiresAt,
+			Priority:        req.Priority,
+			ClientReference: req.ClientReference,
+			CallbackURL:     req.CallbackURL,
+			ReplyTo:         req.ReplyTo,
+			Headers:         req.Headers,
+			Attachments:     req.Attachments,
+			DryRun:          req.DryRun,
+		}, content)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ScheduleResponse{Status: "success", TaskID: id, Suppressed: suppressed})
 		return
 	}
 
-	s.emailsScheduledTotal.WithLabelValues(req.Template).Inc()
-	s.logger.Info("Email scheduled successfully", zap.String("id", id), zap.Any("recipients", req.Recipients), zap.Time("send_at", req.SendAt))
+	if req.ExpiresAt != nil || req.CallbackURL != "" {
+		httpError(w, "ExpiresAt and CallbackURL require SendAt", http.StatusBadRequest)
+		return
+	}
+	resp, queued, err := s.sendEmail(r.Context(), SendRequest{
+		From:            req.From,
+		Profile:         req.Profile,
+		Recipients:      req.Recipients,
+		Priority:        req.Priority,
+		OnLimit:         req.OnLimit,
+		ClientReference: req.ClientReference,
+		ReplyTo:         req.ReplyTo,
+		Headers:         req.Headers,
+		Attachments:     req.Attachments,
+		DryRun:          req.DryRun,
+	}, content)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if queued {
+		writeJSON(w, http.StatusAccepted, QueuedResponse{Status: "queued", ID: resp.ID, Suppressed: resp.Suppressed})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// checkRecipients validates the recipients of a request, failing with an error listing the
+// invalid ones if there are any.
+func (s *Server) checkRecipients(ctx context.Context, recipients []string) error {
+	problems := s.recipients.validate(ctx, recipients)
+	if problems == nil {
+		return nil
+	}
+	return &requestError{status: http.StatusBadRequest, message: "Invalid recipients", fields: problems}
+}
+
+// checkFrom validates the from address of a request, failing if it is malformed or not one of
+// the allowed sender addresses. An address is allowed if it is listed in delivery.allowed_from,
+// or its domain is listed as @domain.
+func (s *Server) checkFrom(from string) error {
+	if from == "" {
+		return nil
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil || strings.ContainsAny(from, "\r\n") {
+		return requestErrorf(http.StatusBadRequest, "Invalid from address %q", from)
+	}
+	domain := addr.Address[strings.LastIndex(addr.Address, "@"):]
+	for _, allowed := range s.cfg.Delivery.AllowedFrom {
+		if strings.EqualFold(allowed, addr.Address) || strings.EqualFold(allowed, domain) {
+			return nil
+		}
+	}
+	return requestErrorf(http.StatusForbidden, "From address %s is not allowed", addr.Address)
+}
+
+// checkProfile checks that the delivery profile a request or its template names, if any, is
+// configured.
+func (s *Server) checkProfile(profile string) error {
+	if profile == "" {
+		return nil
+	}
+	if _, ok := s.cfg.Delivery.Profile(profile); !ok {
+		return requestErrorf(http.StatusBadRequest, "Unknown delivery profile %s", profile)
+	}
+	return nil
+}
+
+// checkAttachments validates the attachments of a request, failing if they are malformed or
+// larger than the configured maximum in total.
+func (s *Server) checkAttachments(attachments []email.Attachment) error {
+	if err := email.ValidateAttachments(attachments); err != nil {
+		return requestErrorf(http.StatusBadRequest, "Invalid attachment: %v", err)
+	}
+	if limit := s.cfg.Server.MaxAttachmentSize; limit > 0 && email.AttachmentSize(attachments) > limit {
+		return requestErrorf(http.StatusRequestEntityTooLarge, "Attachments must not exceed %d bytes in total", limit)
+	}
+	return nil
+}
+
+func (s *Server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListSchedule(w, r)
+	case http.MethodPost:
+		s.handleCreateSchedule(w, r)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleListSchedule(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := scheduler.ListOptions{
+		Template: query.Get("template"),
+		Limit:    defaultListLimit,
+	}
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		if opts.From, err = time.Parse(time.RFC3339, v); err != nil {
+			httpError(w, "Invalid from time, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if opts.To, err = time.Parse(time.RFC3339, v); err != nil {
+			httpError(w, "Invalid to time, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit < 1 || opts.Limit > maxListLimit {
+			httpError(w, fmt.Sprintf("Limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if opts.Offset, err = strconv.Atoi(v); err != nil || opts.Offset < 0 {
+			httpError(w, "Offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tasks, total, err := s.scheduler.List(opts)
+	if err != nil {
+		s.log(r.Context()).Error("Failed to list scheduled tasks", zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to list scheduled tasks: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListScheduleResponse{
+		Tasks:  make([]ScheduledTaskResponse, 0, len(tasks)),
+		Total:  total,
+		Offset: opts.Offset,
+		Limit:  opts.Limit,
+	}
+	for _, task := range tasks {
+		resp.Tasks = append(resp.Tasks, newScheduledTaskResponse(task))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleScheduleTask(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPatch:
+		s.handleUpdateSchedule(w, r)
+	case http.MethodDelete:
+		s.handleCancelSchedule(w, r)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	var req UpdateScheduleRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.log(r.Context()).Error("Failed to decode update schedule request body", zap.String("id", id), zap.Error(err))
+		writeBodyError(w, err)
+		return
+	}
+
+	if req.SendAt == nil && req.Recipients == nil && req.Data == nil {
+		httpError(w, "At least one of send_at, recipients or data is required", http.StatusBadRequest)
+		return
+	}
+	if req.SendAt != nil && !req.SendAt.After(time.Now().UTC()) {
+		httpError(w, "SendAt time must be in the future", http.StatusBadRequest)
+		return
+	}
+	if req.Recipients != nil && len(req.Recipients) == 0 {
+		httpError(w, "At least one recipient is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkRecipients(r.Context(), req.Recipients); err != nil {
+		writeError(w, err)
+		return
+	}
+	var suppressed []string
+	if req.Recipients != nil {
+		recipients, left, err := s.checkSuppressed(r.Context(), req.Recipients)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		req.Recipients, suppressed = recipients, left
+	}
+
+	task, err := s.scheduler.Update(id, scheduler.TaskUpdate{
+		SendAt:     req.SendAt,
+		Recipients: req.Recipients,
+		Data:       req.Data,
+	})
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		httpError(w, "Scheduled task not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, scheduler.ErrInvalidTask) {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to update scheduled email", zap.String("id", id), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to update scheduled email: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.log(r.Context()).Info("Scheduled email updated successfully", zap.String("id", id), zap.Any("recipients", task.Recipients), zap.Time("send_at", task.SendAt))
+	writeJSON(w, http.StatusOK, UpdateScheduleResponse{Status: "success", Task: newScheduledTaskResponse(task), Suppressed: suppressed})
+}
+
+func (s *Server) handleCancelSchedule(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	task, err := s.scheduler.Cancel(id)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		httpError(w, "Scheduled task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to cancel scheduled email", zap.String("id", id), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to cancel scheduled email: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.log(r.Context()).Info("Scheduled email cancelled successfully", zap.String("id", id))
+	s.webhooks.Publish(webhook.EventTaskCancelled, newTaskResponse(task))
+	writeJSON(w, http.StatusOK, newTaskResponse(task))
+}
+
+func (s *Server) handleRunSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	task, err := s.scheduler.RunNow(id)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		httpError(w, "Scheduled task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to run scheduled email", zap.String("id", id), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to run scheduled email: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	switch task.Status {
+	case scheduler.StatusSent, scheduler.StatusQueued:
+		writeJSON(w, http.StatusOK, RunScheduleResponse{Status: "success", Task: newTaskResponse(task)})
+	default:
+		writeJSON(w, http.StatusInternalServerError, RunScheduleResponse{Status: "failed", Task: newTaskResponse(task)})
+	}
+}
+
+func (s *Server) handleTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	task, err := s.scheduler.Get(id)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		httpError(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to load task", zap.String("id", id), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to load task: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newTaskResponse(task))
+}
+
+// handleMessage reports the lifecycle of a sent email, from the request that accepted it to its
+// delivery.
+func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	msg, err := s.messages.Get(id)
+	if errors.Is(err, messages.ErrMessageNotFound) {
+		httpError(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to load message", zap.String("id", id), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to load message: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func (s *Server) handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	daily, monthly := s.rateLimiter.Quota()
+	writeJSON(w, http.StatusOK, QuotaResponse{
+		Daily:   newQuotaWindowResponse(daily),
+		Monthly: newQuotaWindowResponse(monthly),
+	})
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	health := s.health.Health()
+	resp := HealthResponse{Status: "ok", Error: health.Error}
+	if !health.CheckedAt.IsZero() {
+		resp.CheckedAt = &health.CheckedAt
+	}
+	if !health.Up {
+		resp.Status = "unavailable"
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	names := s.templates.ListTemplates()
+	slices.Sort(names)
+	writeJSON(w, http.StatusOK, ListTemplatesResponse{Templates: names})
+}
+
+func (s *Server) handleTemplate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetTemplate(w, r)
+	case http.MethodPut:
+		s.handleSaveTemplate(w, r)
+	case http.MethodDelete:
+		s.handleDeleteTemplate(w, r)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	content, err := s.templates.Source(name)
+	if errors.Is(err, templates.ErrTemplateNotFound) {
+		httpError(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to load template", zap.String("name", name), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to load template: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TemplateResponse{Name: name, Content: content, Version: s.templates.Version(name)})
+}
+
+func (s *Server) handleSaveTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var req TemplateRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.log(r.Context()).Error("Failed to decode template request body", zap.String("name", name), zap.Error(err))
+		writeBodyError(w, err)
+		return
+	}
+
+	created, err := s.templates.Save(name, req.Content)
+	if errors.Is(err, templates.ErrInvalidTemplate) {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to save template", zap.String("name", name), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to save template: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	version := s.templates.Version(name)
+	if created {
+		s.log(r.Context()).Info("Template created successfully", zap.String("name", name), zap.Int("version", version))
+		writeJSON(w, http.StatusCreated, TemplateStatusResponse{Status: "created", Name: name, Version: version})
+		return
+	}
+	s.log(r.Context()).Info("Template updated successfully", zap.String("name", name), zap.Int("version", version))
+	writeJSON(w, http.StatusOK, TemplateStatusResponse{Status: "updated", Name: name, Version: version})
+}
+
+func (s *Server) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	err := s.templates.Delete(name)
+	if errors.Is(err, templates.ErrTemplateNotFound) {
+		httpError(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to delete template", zap.String("name", name), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to delete template: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.log(r.Context()).Info("Template deleted successfully", zap.String("name", name))
+	writeJSON(w, http.StatusOK, TemplateStatusResponse{Status: "deleted", Name: name})
+}
+
+// handleTemplateVariables lists the data fields a template uses, for clients building forms
+// for its data.
+func (s *Server) handleTemplateVariables(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	variables, err := s.templates.Variables(name)
+	if errors.Is(err, templates.ErrTemplateNotFound) {
+		httpError(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to list template variables", zap.String("name", name), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to list template variables: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if variables == nil {
+		variables = []templates.Variable{}
+	}
+	writeJSON(w, http.StatusOK, TemplateVariablesResponse{Name: name, Variables: variables})
+}
+
+// handleTemplateVersions lists the saved versions of a stored template.
+func (s *Server) handleTemplateVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	versions, err := s.templates.Versions(name)
+	if !s.checkVersionsError(w, r, name, err) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TemplateVersionsResponse{Name: name, Versions: versions})
+}
+
+// handleActivateTemplate makes a saved version of a stored template the one that is sent, for
+// example to roll back a bad change.
+func (s *Server) handleActivateTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version < 1 {
+		httpError(w, "Version must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	err = s.templates.Activate(name, version)
+	if errors.Is(err, templates.ErrInvalidTemplate) {
+		httpError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if !s.checkVersionsError(w, r, name, err) {
+		return
+	}
+
+	s.log(r.Context()).Info("Template version activated", zap.String("name", name), zap.Int("version", version))
+	writeJSON(w, http.StatusOK, TemplateStatusResponse{Status: "activated", Name: name, Version: version})
+}
+
+// checkVersionsError writes the response for a failed template version operation, returning
+// false if err is set.
+func (s *Server) checkVersionsError(w http.ResponseWriter, r *http.Request, name string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, templates.ErrVersioningDisabled):
+		httpError(w, "Template versioning is not enabled, set templates.store.driver to bolt or redis", http.StatusNotFound)
+	case errors.Is(err, templates.ErrTemplateNotFound):
+		httpError(w, "Template not found", http.StatusNotFound)
+	case errors.Is(err, templates.ErrVersionNotFound):
+		httpError(w, "Template version not found", http.StatusNotFound)
+	default:
+		s.log(r.Context()).Error("Failed to access template versions", zap.String("name", name), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to access template versions: %v", err), http.StatusInternalServerError)
+	}
+	return false
+}
+
+// handlePreviewTemplate renders a template with the given data as it would be sent, without
+// sending anything.
+func (s *Server) handlePreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	var req PreviewRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.log(r.Context()).Error("Failed to decode preview request body", zap.String("name", name), zap.Error(err))
+		writeBodyError(w, err)
+		return
+	}
+
+	variant := s.templates.Resolve(name, req.Locale)
+	body, subject, err := s.templates.Render(variant, req.Data)
+	if err != nil {
+		writePreviewError(w, err)
+		return
+	}
+	text, err := s.templates.RenderText(variant, req.Data)
+	if err != nil {
+		writePreviewError(w, err)
+		return
+	}
+
+	if subject == "" {
+		subject = fmt.Sprintf("Email from RuneBird (%s)", name)
+	}
+	if text == "" {
+		text = email.HTMLToText(body)
+	}
+	writeJSON(w, http.StatusOK, PreviewResponse{Template: variant, Subject: subject, HTML: body, Text: text})
+}
+
+// handleValidateTemplate reports the problems found in a template, checked with the data in
+// the request or, without any, the sample data declared for the template.
+func (s *Server) handleValidateTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	var req ValidateTemplateRequest
+	if err := s.decodeJSON(w, r, &req); err != nil && !errors.Is(err, io.EOF) {
+		s.log(r.Context()).Error("Failed to decode validate request body", zap.String("name", name), zap.Error(err))
+		writeBodyError(w, err)
+		return
+	}
+
+	issues, err := s.templates.Validate(name, req.Data)
+	if errors.Is(err, templates.ErrTemplateNotFound) {
+		httpError(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(r.Context()).Error("Failed to validate template", zap.String("name", name), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to validate template: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if issues == nil {
+		issues = []templates.Issue{}
+	}
+	writeJSON(w, http.StatusOK, ValidateTemplateResponse{Valid: len(issues) == 0, Issues: issues})
+}
+
+// writePreviewError reports a template that could not be rendered for a preview. Rendering
+// errors are caused by the template or the data supplied with it, so they are not logged.
+func writePreviewError(w http.ResponseWriter, err error) {
+	if errors.Is(err, templates.ErrTemplateNotFound) {
+		httpError(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	httpError(w, fmt.Sprintf("Failed to render template: %v", err), http.StatusUnprocessableEntity)
+}
+
+func (s *Server) handlePauseScheduler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.scheduler.Pause()
+	writeJSON(w, http.StatusOK, SchedulerStateResponse{Status: "success", Paused: s.scheduler.Paused()})
+}
+
+func (s *Server) handleResumeScheduler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.scheduler.Resume()
+	writeJSON(w, http.StatusOK, SchedulerStateResponse{Status: "success", Paused: s.scheduler.Paused()})
+}
+
+func (s *Server) handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var req ScheduleRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.log(r.Context()).Error("Failed to decode schedule request body", zap.Error(err))
+		writeBodyError(w, err)
+		return
+	}
+
+	id, suppressed, err := s.scheduleEmail(r.Context(), req, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ScheduleResponse{Status: "success", TaskID: id, Suppressed: suppressed})
+}
+
+// scheduleEmail schedules the email of req, returning the ID of its task and the suppressed
+// recipients left out of it. The email is rendered from the template of req when it is sent,
+// unless its content is given. Requests that cannot be served fail with a *requestError.
+func (s *Server) scheduleEmail(ctx context.Context, req ScheduleRequest, content *scheduler.Content) (string, []string, error) {
+	if req.SendAt.IsZero() {
+		return "", nil, requestErrorf(http.StatusBadRequest, "SendAt time is required")
+	}
+	if req.SendAt.Before(time.Now().UTC()) {
+		return "", nil, requestErrorf(http.StatusBadRequest, "SendAt time must be in the future")
+	}
+
+	id, suppressed, err := s.addTask(ctx, "sched", req, content)
+	if err != nil {
+		return "", nil, err
+	}
+	s.emailsScheduledTotal.WithLabelValues(req.Template).Inc()
+	s.log(ctx).Info("Email scheduled successfully", zap.String("id", id), zap.Any("recipients", req.Recipients), zap.Time("send_at", req.SendAt))
+	if task, err := s.scheduler.Get(id); err == nil {
+		s.webhooks.Publish(webhook.EventTaskScheduled, newTaskResponse(task))
+	}
+	return id, suppressed, nil
+}
+
+// enqueueEmail hands the email of req to the scheduler's workers to be sent as soon as
+// possible, returning the ID under which its progress is reported and the suppressed
+// recipients left out of it. Unlike sendEmail, it does not wait for the email to be sent, and
+// the email is queued if the rate limit is reached.
+func (s *Server) enqueueEmail(ctx context.Context, req SendRequest) (string, []string, error) {
+	switch req.OnLimit {
+	case "", "queue":
+	case "reject":
+		return "", nil, requestErrorf(http.StatusBadRequest, "OnLimit reject cannot be used with asynchronous sends")
+	default:
+		return "", nil, requestErrorf(http.StatusBadRequest, "OnLimit must be one of queue, reject")
+	}
+
+	id, suppressed, err := s.addTask(ctx, "msg", ScheduleRequest{
+		Template:    req.Template,
+		Locale:      req.Locale,
+		From:        req.From,
+		Profile:     req.Profile,
+		Recipients:  req.Recipients,
+		SendAt:      time.Now().UTC(),
+		Data:        req.Data,
+		Priority:    req.Priority,
+		ReplyTo:     req.ReplyTo,
+		Headers:     req.Headers,
+		Attachments: req.Attachments,
+		DryRun:      req.DryRun,
+	}, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	s.messages.Accept(email.Message{ID: id, Template: req.Template, Recipients: req.Recipients})
+	s.log(ctx).Info("Email accepted for sending", zap.String("id", id), zap.String("template", req.Template), zap.Any("recipients", req.Recipients))
+	return id, suppressed, nil
+}
+
+// addTask validates req and adds it to the scheduler as a task whose ID starts with prefix,
+// returning the ID and the suppressed recipients left out of the task.
+func (s *Server) addTask(ctx context.Context, prefix string, req ScheduleRequest, content *scheduler.Content) (string, []string, error) {
+	if req.Template == "" && content == nil {
+		return "", nil, requestErrorf(http.StatusBadRequest, "Template name is required")
+	}
+	if len(req.Recipients) == 0 {
+		return "", nil, requestErrorf(http.StatusBadRequest, "At least one recipient is required")
+	}
+	if err := s.checkRecipients(ctx, req.Recipients); err != nil {
+		return "", nil, err
+	}
+	recipients, suppressed, err := s.checkSuppressed(ctx, req.Recipients)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Recipients = recipients
+	meta := s.templates.Metadata(s.templates.Resolve(req.Template, req.Locale))
+	from := req.From
+	if from == "" {
+		from = meta.From
+	}
+	if err := s.checkFrom(from); err != nil {
+		return "", nil, err
+	}
+	profile := req.Profile
+	if profile == "" {
+		profile = meta.Profile
+	}
+	if err := s.checkProfile(profile); err != nil {
+		return "", nil, err
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(req.SendAt) {
+		return "", nil, requestErrorf(http.StatusBadRequest, "ExpiresAt time must be after SendAt")
+	}
+
+	priority, err := rate.ParsePriority(req.Priority)
+	if err != nil {
+		return "", nil, requestErrorf(http.StatusBadRequest, "Invalid priority: %v", err)
+	}
+	if err := s.checkAttachments(req.Attachments); err != nil {
+		return "", nil, err
+	}
+	if err := email.ValidateHeaders(req.ReplyTo, req.Headers); err != nil {
+		return "", nil, requestErrorf(http.StatusBadRequest, "Invalid headers: %v", err)
+	}
+
+	if req.CallbackURL != "" {
+		u, err := url.Parse(req.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", nil, requestErrorf(http.StatusBadRequest, "Callback URL must be an absolute http or https URL")
+		}
+	}
+
+	counted := 0
+	if !req.DryRun {
+		if err := s.allowEmails(ctx, len(req.Recipients)); err != nil {
+			return "", nil, err
+		}
+		counted = len(req.Recipients)
+	}
+
+	id := fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+
+	task := scheduler.ScheduledTask{
+		ID:          id,
+		Template:    req.Template,
+		Locale:      req.Locale,
+		From:        req.From,
+		Profile:     req.Profile,
+		Recipients:  req.Recipients,
+		Suppressed:  suppressed,
+		Data:        req.Data,
+		SendAt:      req.SendAt,
+		ExpiresAt:   req.ExpiresAt,
+		Priority:    priority,
+		CallbackURL: req.CallbackURL,
+		ReplyTo:     req.ReplyTo,
+		Headers:     req.Headers,
+		Attachments: req.Attachments,
+		DryRun:      req.DryRun,
+		Content:     content,
+	}
+	if err = s.scheduler.ScheduleTask(task); err != nil {
+		s.refundEmails(ctx, counted)
+	}
+	if errors.Is(err, scheduler.ErrInvalidTask) {
+		return "", nil, &requestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	if err != nil {
+		s.log(ctx).Error("Failed to schedule email", zap.String("id", id), zap.Error(err))
+		return "", nil, requestErrorf(http.StatusInternalServerError, "Failed to schedule email: %v", err)
+	}
+	return id, suppressed, nil
+}
+
+func newScheduledTaskResponse(task scheduler.ScheduledTask) ScheduledTaskResponse {
+	return ScheduledTaskResponse{
+		ID:         task.ID,
+		Template:   task.Template,
+		Recipients: task.Recipients,
+		SendAt:     task.SendAt,
+		ExpiresAt:  task.ExpiresAt,
+		CreatedAt:  task.CreatedAt,
+		Priority:   task.Priority,
+		Status:     task.Status,
+	}
+}
+
+func newTaskResponse(task scheduler.ScheduledTask) TaskResponse {
+	return TaskResponse{
+		ScheduledTaskResponse: newScheduledTaskResponse(task),
+		TemplateVersion:       task.TemplateVersion,
+		UpdatedAt:             task.UpdatedAt,
+		LastError:             task.LastError,
+		MessageID:             task.MessageID,
+		Rejected:              task.Rejected,
+		Suppressed:            task.Suppressed,
+		History:               task.History,
+	}
+}
+
+// newQuotaWindowResponse reports an unlimited window with a null limit and remaining count.
+func newQuotaWindowResponse(usage rate.QuotaUsage) QuotaWindowResponse {
+	resp := QuotaWindowResponse{Used: usage.Used}
+	if usage.Limit > 0 {
+		limit, remaining := usage.Limit, usage.Remaining()
+		resp.Limit = &limit
+		resp.Remaining = &remaining
+	}
+	return resp
+}
+
+// requestError is a request that cannot be served, with the HTTP status and message it is
+// answered with. The fields are the invalid fields of the request, as for invalid recipients,
+// retryAfter how many seconds to wait before retrying a request rejected by the rate limit,
+// and challenge the WWW-Authenticate header of a request that failed authentication.
+type requestError struct {
+	status     int
+	message    string
+	fields     map[string]string
+	retryAfter int
+	challenge  string
+}
+
+func requestErrorf(status int, format string, args ...interface{}) *requestError {
+	return &requestError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// writeError answers a request that failed with err, as an internal error unless it is a
+// *requestError.
+func writeError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reqErr.status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", strconv.Itoa(reqErr.retryAfter))
+	}
+	if reqErr.challenge != "" {
+		w.Header().Set("WWW-Authenticate", reqErr.challenge)
+	}
+	if reqErr.fields != nil {
+		writeJSON(w, reqErr.status, ValidationErrorResponse{
+			Error:     reqErr.message,
+			Fields:    reqErr.fields,
+			RequestID: w.Header().Get(requestIDHeader),
+		})
+		return
+	}
+	httpError(w, reqErr.message, reqErr.status)
+}
+
+// decodeJSON decodes the JSON body of r into v, reading no more than the maximum body size.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if limit := s.cfg.Server.HTTP.MaxBodySize; limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// writeBodyError answers a request whose body could not be read or decoded, as too large if it
+// exceeded the maximum body size.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, fmt.Sprintf("Request body must not be larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	httpError(w, "Invalid request body", http.StatusBadRequest)
+}
 
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(fmt.Sprintf(`{"status": "success", "task_id": "%s"}`, id)))
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
 }
@@ -2,33 +2,69 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"runebird/internal/auth"
+	"runebird/internal/bounce"
 	"runebird/internal/config"
 	"runebird/internal/email"
+	"runebird/internal/emailerpb"
 	"runebird/internal/logger"
+	"runebird/internal/messages"
 	"runebird/internal/rate"
 	"runebird/internal/scheduler"
+	"runebird/internal/suppression"
 	"runebird/internal/templates"
+	"runebird/internal/webhook"
 )
 
-func setupTestServer(t *testing.T) *httptest.Server {
+func setupTestServer(t *testing.T) (*httptest.Server, *Server) {
 	cfg := &config.Config{
-		Server: config.ServerConfig{Port: 8080},
+		Server: config.ServerConfig{Port: 8080, IdempotencyTTL: time.Hour, MaxAttachmentSize: 16, MaxMessageSize: 4096},
+		// Nothing listens on port 1, so sends that get past the rate limiter fail immediately.
 		SMTP: config.SMTPConfig{
-			Host:        "smtp.example.com",
-			Port:        587,
+			Host:        "127.0.0.1",
+			Port:        1,
 			Username:    "user",
 			Password:    "pass",
 			FromAddress: "from@example.com",
 		},
+		Delivery:  config.DeliveryConfig{AllowedFrom: []string{"@example.com"}},
 		Templates: config.TemplatesConfig{Path: "./test_templates"},
 		RateLimit: config.RateLimitConfig{
 			PerHour: 600,
@@ -38,6 +74,9 @@ func setupTestServer(t *testing.T) *httptest.Server {
 			Level:    "info",
 			FilePath: "",
 		},
+		Scheduler: config.SchedulerConfig{
+			Retry: config.RetryConfig{MaxAttempts: 1},
+		},
 	}
 
 	log, err := logger.New(&cfg.Logging)
@@ -45,42 +84,41 @@ func setupTestServer(t *testing.T) *httptest.Server {
 		t.Fatalf("failed to create logger: %v", err)
 	}
 
-	sender, err := email.New(&cfg.SMTP)
+	smtp, err := email.NewSMTP(&cfg.SMTP)
 	if err != nil {
 		t.Fatalf("failed to create email sender: %v", err)
 	}
+	msgLog := messages.NewLog(messages.NewMemoryStore(time.Hour), log)
+	suppressions := suppression.NewList(suppression.NewMemoryStore(), log)
+	sender := messages.NewSender(suppression.NewSender(smtp, suppressions), msgLog)
 
-	tm := &templates.TemplateManager{}
+	tm := &templates.TemplateManager{Templates: map[string]*htmltemplate.Template{
+		"limited": htmltemplate.Must(htmltemplate.New("limited").Parse("<p>Hi {{ .Name }}</p>")),
+	}}
 
-	rl, err := rate.New(&cfg.RateLimit, log)
+	rl, err := rate.New(&cfg.RateLimit, log, sender, messages.NewQueue(rate.NewMemoryQueue(), msgLog), rate.NewMemoryBucket(&cfg.RateLimit), nil)
 	if err != nil {
 		t.Fatalf("failed to create rate limiter: %v", err)
 	}
 
-	sched := scheduler.New(log, sender, tm, rl)
+	webhooks := webhook.New(&cfg.Webhooks, log)
+	t.Cleanup(webhooks.Stop)
+	sched := scheduler.New(&cfg.Scheduler, log, sender, tm, rl, scheduler.NewMemoryStore(time.Hour), webhooks)
+	hooks := webhook.NewSubscriptions(webhook.NewMemoryStore(), webhooks, log)
 
-	srv := New(cfg, log, sender, tm, rl, sched)
+	srv := New(cfg, log, sender, tm, rl, sched, msgLog, hooks, suppressions, email.NewHealthChecker(sender, &cfg.Delivery.HealthCheck, log))
 
-	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.URL.Path {
-		case "/send":
-			srv.handleSend(w, r)
-		case "/schedule":
-			srv.handleSchedule(w, r)
-		case "/metrics":
-			promhttp.Handler().ServeHTTP(w, r)
-		default:
-			http.NotFound(w, r)
-		}
-	}))
+	testServer := httptest.NewServer(srv.httpServer.Handler)
 
-	return testServer
+	return testServer, srv
 }
 
 func TestServer(t *testing.T) {
-	testServer := setupTestServer(t)
+	testServer, srv := setupTestServer(t)
 	defer testServer.Close()
 
+	var scheduledID string
+
 	t.Run("SendEndpointInvalidMethod", func(t *testing.T) {
 		resp, err := http.Get(testServer.URL + "/send")
 		if err != nil {
@@ -116,6 +154,23 @@ func TestServer(t *testing.T) {
 		}
 	})
 
+	t.Run("SendEndpointBodyTooLarge", func(t *testing.T) {
+		srv.cfg.Server.HTTP.MaxBodySize = 64
+		defer func() { srv.cfg.Server.HTTP.MaxBodySize = 0 }()
+
+		payload, _ := json.Marshal(SendRequest{Template: "welcome", Recipients: []string{"test@example.com"}, Data: map[string]interface{}{"Name": strings.Repeat("A", 64)}})
+		for _, path := range []string{"/send", "/templates/welcome/preview"} {
+			resp, err := http.Post(testServer.URL+path, "application/json", bytes.NewBuffer(payload))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Errorf("%s: expected status %d, got: %d", path, http.StatusRequestEntityTooLarge, resp.StatusCode)
+			}
+		}
+	})
+
 	t.Run("SendEndpointMissingFields", func(t *testing.T) {
 		req := SendRequest{
 			Template:   "",
@@ -162,8 +217,486 @@ func TestServer(t *testing.T) {
 		}
 	})
 
+	t.Run("SendEndpointInvalidAttachments", func(t *testing.T) {
+		for _, tc := range []struct {
+			name        string
+			attachments []email.Attachment
+			status      int
+		}{
+			{"MissingFilename", []email.Attachment{{Content: []byte("hi")}}, http.StatusBadRequest},
+			{"HeaderInjection", []email.Attachment{{Filename: "a.txt\r\nBcc: x@example.com", Content: []byte("hi")}}, http.StatusBadRequest},
+			{"TooLarge", []email.Attachment{{Filename: "big.bin", Content: bytes.Repeat([]byte("x"), 17)}}, http.StatusRequestEntityTooLarge},
+		} {
+			req := SendRequest{
+				Template:    "limited",
+				Recipients:  []string{"test@example.com"},
+				Attachments: tc.attachments,
+			}
+			body, _ := json.Marshal(req)
+			resp, err := http.Post(testServer.URL+"/send", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Errorf("%s: expected status %d, got: %d", tc.name, tc.status, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("SendEndpointMessageTooLarge", func(t *testing.T) {
+		req := SendRequest{
+			Template:   "limited",
+			Recipients: []string{"test@example.com"},
+			Data:       map[string]interface{}{"Name": strings.Repeat("x", 8192)},
+		}
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(testServer.URL+"/send", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status %d, got: %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+		}
+		if msg, _ := io.ReadAll(resp.Body); !strings.Contains(string(msg), "exceeds the maximum of 4096 bytes") {
+			t.Errorf("expected the size limit in the error, got: %s", msg)
+		}
+	})
+
+	t.Run("SendEndpointInvalidHeaders", func(t *testing.T) {
+		req := SendRequest{
+			Template:   "limited",
+			Recipients: []string{"test@example.com"},
+			ReplyTo:    "support@example.com",
+			Headers:    map[string]string{"X-Campaign-ID": "42\r\nBcc: victim@example.com"},
+		}
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(testServer.URL+"/send", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("SendEndpointInvalidRecipients", func(t *testing.T) {
+		req := SendRequest{
+			Template:   "limited",
+			Recipients: []string{"test@example.com", "not-an-email"},
+		}
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(testServer.URL+"/send", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		var result ValidationErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(result.Fields) != 1 || result.Fields["recipients[1]"] == "" {
+			t.Errorf("expected an error for recipients[1] only, got: %v", result.Fields)
+		}
+	})
+
+	t.Run("SendEndpointFromNotAllowed", func(t *testing.T) {
+		for from, status := range map[string]int{
+			"billing@other.example.org": http.StatusForbidden,
+			"not-an-email":              http.StatusBadRequest,
+		} {
+			req := SendRequest{
+				Template:   "limited",
+				Recipients: []string{"test@example.com"},
+				From:       from,
+			}
+			body, _ := json.Marshal(req)
+			resp, err := http.Post(testServer.URL+"/send", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != status {
+				t.Errorf("expected status %d for from %q, got: %d", status, from, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("SendEndpointUnknownProfile", func(t *testing.T) {
+		srv.cfg.Delivery.Profiles = []config.DeliveryProfile{{Name: "marketing"}}
+		defer func() { srv.cfg.Delivery.Profiles = nil }()
+
+		for path, req := range map[string]interface{}{
+			"/send":     SendRequest{Template: "limited", Recipients: []string{"test@example.com"}, Profile: "transactional"},
+			"/schedule": ScheduleRequest{Template: "limited", Recipients: []string{"test@example.com"}, Profile: "transactional", SendAt: time.Now().Add(time.Hour)},
+		} {
+			body, _ := json.Marshal(req)
+			resp, err := http.Post(testServer.URL+path, "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			respBody, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(respBody), "Unknown delivery profile transactional") {
+				t.Errorf("expected status 400 for an unknown profile at %s, got: %d %s", path, resp.StatusCode, respBody)
+			}
+		}
+	})
+
+	t.Run("SendEndpointBlockedDomain", func(t *testing.T) {
+		srv.cfg.Delivery.RecipientDomains = config.RecipientDomainsConfig{Allow: []string{"example.com"}}
+		defer func() { srv.cfg.Delivery.RecipientDomains = config.RecipientDomainsConfig{} }()
+
+		for path, req := range map[string]interface{}{
+			"/send":     SendRequest{Template: "limited", Recipients: []string{"test@example.com", "bob@other.org"}},
+			"/schedule": ScheduleRequest{Template: "limited", Recipients: []string{"test@example.com", "bob@other.org"}, SendAt: time.Now().Add(time.Hour)},
+		} {
+			body, _ := json.Marshal(req)
+			resp, err := http.Post(testServer.URL+path, "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			respBody, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(respBody), "domain other.org is not allowed") {
+				t.Errorf("expected status 400 for a recipient outside the allowed domains at %s, got: %d %s", path, resp.StatusCode, respBody)
+			}
+		}
+	})
+
+	t.Run("RecipientValidatorMX", func(t *testing.T) {
+		v := newRecipientValidator(&config.RecipientDomainsConfig{}, true, time.Hour)
+		lookups := 0
+		v.lookupMX = func(_ context.Context, domain string) ([]*net.MX, error) {
+			lookups++
+			switch domain {
+			case "example.com":
+				return []*net.MX{{Host: "mx.example.com.", Pref: 10}}, nil
+			case "null.example.com":
+				return []*net.MX{{Host: ".", Pref: 0}}, nil
+			case "flaky.example.com":
+				return nil, &net.DNSError{Err: "timeout", Name: domain, IsTimeout: true}
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		}
+		v.lookupHost = func(_ context.Context, host string) ([]string, error) {
+			if host == "a-only.example.com" {
+				return []string{"192.0.2.1"}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+
+		problems := v.validate(context.Background(), []string{
+			"a@example.com",
+			"b@EXAMPLE.com",
+			"c@null.example.com",
+			"d@missing.example.com",
+			"e@a-only.example.com",
+			"f@flaky.example.com",
+		})
+		if len(problems) != 2 || problems["recipients[2]"] == "" || problems["recipients[3]"] == "" {
+			t.Errorf("expected errors for the null MX and missing domains, got: %v", problems)
+		}
+		if lookups != 5 {
+			t.Errorf("expected one lookup per domain, got %d", lookups)
+		}
+		v.validate(context.Background(), []string{"c@null.example.com", "f@flaky.example.com"})
+		if lookups != 6 {
+			t.Errorf("expected cached answers except for temporary failures, got %d lookups", lookups)
+		}
+	})
+
+	t.Run("SendEndpointRateLimited", func(t *testing.T) {
+		post := func(onLimit string) *http.Response {
+			body, _ := json.Marshal(SendRequest{
+				Template:   "limited",
+				Recipients: []string{"test@example.com"},
+				Data:       map[string]interface{}{"Name": "Alice"},
+				OnLimit:    onLimit,
+			})
+			resp, err := http.Post(testServer.URL+"/send", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+			return resp
+		}
+
+		// The burst of two tokens is spent on sends that fail against the unreachable SMTP server.
+		var resp *http.Response
+		for i := 0; i < 3; i++ {
+			if resp = post("reject"); resp.StatusCode == http.StatusTooManyRequests {
+				break
+			}
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("expected status %d once the limit is reached, got: %d", http.StatusTooManyRequests, resp.StatusCode)
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Error("expected a Retry-After header on a rate-limited response")
+		}
+
+		// A rate-limited response is not replayed to a retry with the same idempotency key.
+		body, _ := json.Marshal(SendRequest{Template: "limited", Recipients: []string{"test@example.com"}, OnLimit: "reject"})
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodPost, testServer.URL+"/send", bytes.NewBuffer(body))
+			req.Header.Set("Idempotency-Key", "limited-1")
+			retry, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = retry.Body.Close()
+			if retry.StatusCode != http.StatusTooManyRequests || retry.Header.Get("Idempotent-Replayed") != "" {
+				t.Errorf("expected a rate-limited retry to be served again, got status %d, replayed %q", retry.StatusCode, retry.Header.Get("Idempotent-Replayed"))
+			}
+		}
+
+		if resp := post(""); resp.StatusCode != http.StatusAccepted {
+			t.Errorf("expected status %d when queuing a rate-limited send, got: %d", http.StatusAccepted, resp.StatusCode)
+		}
+		if resp := post("drop"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for an invalid on_limit, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("SendEndpointAsync", func(t *testing.T) {
+		post := func(query string, req SendRequest) *http.Response {
+			body, _ := json.Marshal(req)
+			resp, err := http.Post(testServer.URL+"/send"+query, "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			return resp
+		}
+		req := SendRequest{Template: "welcome", Recipients: []string{"test@example.com"}, Data: map[string]interface{}{"Name": "Alice"}}
+
+		resp := post("?async=true", req)
+		var accepted AcceptedResponse
+		_ = json.NewDecoder(resp.Body).Decode(&accepted)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted || accepted.Status != "accepted" || accepted.ID == "" {
+			t.Fatalf("expected the email to be accepted, got: %d %+v", resp.StatusCode, accepted)
+		}
+		if accepted.StatusURL != "/api/v1/messages/"+accepted.ID {
+			t.Errorf("expected the status URL of the message, got: %q", accepted.StatusURL)
+		}
+		status, err := http.Get(testServer.URL + accepted.StatusURL)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = status.Body.Close()
+		if status.StatusCode != http.StatusOK {
+			t.Errorf("expected the accepted email to be reported at its status URL, got: %d", status.StatusCode)
+		}
+		// The scheduler is not running, so the task is withdrawn rather than left pending.
+		if _, err := srv.scheduler.Cancel(accepted.ID); err != nil {
+			t.Errorf("expected the accepted email to be a pending task, got: %v", err)
+		}
+
+		for query, req := range map[string]SendRequest{
+			"?async=maybe": req,
+			"?async=1":     {Template: "welcome", Recipients: []string{"test@example.com"}, OnLimit: "reject"},
+			"?async=yes":   {Template: "welcome", Recipients: []string{"not-an-email"}},
+		} {
+			resp := post(query, req)
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d for %s with %+v, got: %d", http.StatusBadRequest, query, req, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("MessageEndpoint", func(t *testing.T) {
+		body, _ := json.Marshal(SendRequest{Template: "welcome", Recipients: []string{"test@example.com"}})
+		resp, err := http.Post(testServer.URL+"/send?async=true", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var accepted AcceptedResponse
+		_ = json.NewDecoder(resp.Body).Decode(&accepted)
+		_ = resp.Body.Close()
+		defer func() { _, _ = srv.scheduler.Cancel(accepted.ID) }()
+
+		resp, err = http.Get(testServer.URL + "/api/v1/messages/" + accepted.ID)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var msg messages.Message
+		_ = json.NewDecoder(resp.Body).Decode(&msg)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+		if msg.ID != accepted.ID || msg.Status != messages.StatusAccepted || len(msg.Events) != 1 || !slices.Equal(msg.Recipients, []string{"test@example.com"}) {
+			t.Errorf("expected an accepted message with one event, got: %+v", msg)
+		}
+
+		resp, err = http.Get(testServer.URL + "/messages/msg-missing")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d for an unknown message, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("SendBatchEndpoint", func(t *testing.T) {
+		body, _ := json.Marshal(BatchSendRequest{
+			Template: "limited",
+			Items: []BatchItem{
+				{Recipient: "alice@example.com", Data: map[string]interface{}{"Name": "Alice"}},
+				{Recipient: "not-an-email", Data: map[string]interface{}{"Name": "Bob"}},
+				{Recipient: "carol@example.com", Data: map[string]interface{}{"Name": "Carol"}},
+			},
+		})
+		resp, err := http.Post(testServer.URL+"/send/batch", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+
+		// The rate limit was reached above, so the valid items are queued.
+		var result BatchSendResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if result.Queued != 2 || result.Failed != 1 || len(result.Results) != 3 {
+			t.Fatalf("expected two queued items and one failed item, got: %+v", result)
+		}
+		if r := result.Results[1]; r.Status != "failed" || r.Code != http.StatusBadRequest || r.Fields["recipients[0]"] == "" {
+			t.Errorf("expected the invalid recipient to fail validation, got: %+v", r)
+		}
+		if r := result.Results[2]; r.Recipient != "carol@example.com" || r.Status != "queued" {
+			t.Errorf("expected results in the order of the items, got: %+v", r)
+		}
+
+		// With a burst smaller than the batch, the items past it are rejected or queued at once
+		// instead of waiting for tokens. The sends within it succeed as dry runs.
+		limiter, sender := srv.rateLimiter, srv.sender
+		defer func() { srv.rateLimiter, srv.sender = limiter, sender }()
+		srv.sender = email.NewDryRun(sender, &config.Config{Delivery: config.DeliveryConfig{DryRun: true}}, srv.logger)
+		limits := &config.RateLimitConfig{PerHour: 1, Burst: 2}
+		srv.rateLimiter, err = rate.New(limits, srv.logger, srv.sender, rate.NewMemoryQueue(), rate.NewMemoryBucket(limits), nil)
+		if err != nil {
+			t.Fatalf("failed to create rate limiter: %v", err)
+		}
+		defer srv.rateLimiter.Stop()
+		for _, tc := range []struct {
+			onLimit string
+			status  string
+			code    int
+		}{{"reject", "failed", http.StatusTooManyRequests}, {"", "queued", 0}} {
+			items := make([]BatchItem, 4)
+			for i := range items {
+				items[i] = BatchItem{Recipient: fmt.Sprintf("user%d@example.com", i), Data: map[string]interface{}{"Name": "Alice"}}
+			}
+			body, _ := json.Marshal(BatchSendRequest{Template: "limited", Items: items, OnLimit: tc.onLimit})
+			start := time.Now()
+			resp, err := http.Post(testServer.URL+"/send/batch", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			var result BatchSendResponse
+			_ = json.NewDecoder(resp.Body).Decode(&result)
+			_ = resp.Body.Close()
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("expected the batch not to wait for the rate limit, took %s", elapsed)
+			}
+			if len(result.Results) != len(items) {
+				t.Fatalf("expected a result per item, got: %+v", result)
+			}
+			// The burst is only available to the first batch, whose first two items are sent.
+			from := 0
+			if tc.onLimit == "reject" {
+				from = 2
+				if result.Sent != 2 {
+					t.Errorf("expected the items within the burst to be sent, got: %+v", result)
+				}
+			}
+			for _, r := range result.Results[from:] {
+				if r.Status != tc.status || r.Code != tc.code {
+					t.Errorf("expected items past the burst to be %s with code %d, got: %+v", tc.status, tc.code, r)
+				}
+			}
+		}
+
+		for _, payload := range []string{`{"template": "limited", "items": []}`, `{"items": [{"recipient": "alice@example.com"}]}`} {
+			resp, err := http.Post(testServer.URL+"/send/batch", "application/json", bytes.NewBufferString(payload))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d for %s, got: %d", http.StatusBadRequest, payload, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("SendRawEndpoint", func(t *testing.T) {
+		post := func(req RawSendRequest) *http.Response {
+			body, _ := json.Marshal(req)
+			resp, err := http.Post(testServer.URL+"/send/raw", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			return resp
+		}
+
+		resp := post(RawSendRequest{Recipients: []string{"test@example.com"}, HTMLBody: "<p>Thanks</p>"})
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d without a subject, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		// The rate limit was reached above, so the email is queued.
+		resp = post(RawSendRequest{Recipients: []string{"test@example.com"}, Subject: "Your receipt", HTMLBody: "<p>Thanks</p>"})
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("expected status %d for a rate-limited raw send, got: %d", http.StatusAccepted, resp.StatusCode)
+		}
+
+		sendAt := time.Now().UTC().Add(time.Hour)
+		resp = post(RawSendRequest{Recipients: []string{"test@example.com"}, Subject: "Your receipt", HTMLBody: "<p>Thanks</p>", SendAt: &sendAt})
+		var scheduled ScheduleResponse
+		_ = json.NewDecoder(resp.Body).Decode(&scheduled)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || scheduled.TaskID == "" {
+			t.Fatalf("expected the raw email to be scheduled, got: %d %+v", resp.StatusCode, scheduled)
+		}
+		resp, err := http.Get(testServer.URL + "/tasks/" + scheduled.TaskID)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected the scheduled raw email to be tracked, got: %d", resp.StatusCode)
+		}
+	})
+
 	t.Run("ScheduleEndpointInvalidMethod", func(t *testing.T) {
-		resp, err := http.Get(testServer.URL + "/schedule")
+		req, err := http.NewRequest(http.MethodPut, testServer.URL+"/schedule", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			t.Fatalf("failed to make request: %v", err)
 		}
@@ -245,6 +778,64 @@ func TestServer(t *testing.T) {
 		}
 	})
 
+	t.Run("ScheduleEndpointInvalidCallbackURL", func(t *testing.T) {
+		for _, callback := range []string{"not a url", "ftp://example.com/hook", "/relative/hook"} {
+			payload, _ := json.Marshal(ScheduleRequest{
+				Template:    "welcome",
+				Recipients:  []string{"test@example.com"},
+				SendAt:      time.Now().UTC().Add(time.Hour),
+				CallbackURL: callback,
+			})
+			resp, err := http.Post(testServer.URL+"/schedule", "application/json", bytes.NewBuffer(payload))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d for callback %q, got: %d", http.StatusBadRequest, callback, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("ScheduleEndpointInvalidPriority", func(t *testing.T) {
+		payload, _ := json.Marshal(ScheduleRequest{
+			Template:   "welcome",
+			Recipients: []string{"test@example.com"},
+			SendAt:     time.Now().UTC().Add(time.Hour),
+			Priority:   "urgent",
+		})
+		resp, err := http.Post(testServer.URL+"/schedule", "application/json", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("ScheduleEndpointExpiresBeforeSendAt", func(t *testing.T) {
+		sendAt := time.Now().UTC().Add(time.Hour)
+		expiresAt := sendAt.Add(-time.Minute)
+		payload, _ := json.Marshal(ScheduleRequest{
+			Template:   "welcome",
+			Recipients: []string{"test@example.com"},
+			SendAt:     sendAt,
+			ExpiresAt:  &expiresAt,
+		})
+		resp, err := http.Post(testServer.URL+"/schedule", "application/json", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
 	t.Run("ScheduleEndpointSuccess", func(t *testing.T) {
 		req := ScheduleRequest{
 			Template:   "welcome",
@@ -276,11 +867,77 @@ func TestServer(t *testing.T) {
 			if _, ok := response["task_id"]; !ok {
 				t.Error("expected response to contain task_id, but it was not found")
 			}
+			scheduledID = response["task_id"]
 		}
 	})
 
-	t.Run("MetricsEndpoint", func(t *testing.T) {
-		resp, err := http.Get(testServer.URL + "/metrics")
+	patchSchedule := func(t *testing.T, id string, payload string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPatch, testServer.URL+"/schedule/"+id, bytes.NewBufferString(payload))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		return resp
+	}
+
+	t.Run("UpdateScheduleEndpointSuccess", func(t *testing.T) {
+		sendAt := time.Now().UTC().Add(2 * time.Hour).Truncate(time.Second)
+		payload := fmt.Sprintf(`{"send_at": "%s", "recipients": ["other@example.com"]}`, sendAt.Format(time.RFC3339))
+		resp := patchSchedule(t, scheduledID, payload)
+		defer func(Body io.ReadCloser) {
+			err := Body.Close()
+			if err != nil {
+				fmt.Printf("failed to close response body: %v", err)
+			}
+		}(resp.Body)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+
+		var response UpdateScheduleResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if !response.Task.SendAt.Equal(sendAt) {
+			t.Errorf("expected send_at %v, got: %v", sendAt, response.Task.SendAt)
+		}
+		if len(response.Task.Recipients) != 1 || response.Task.Recipients[0] != "other@example.com" {
+			t.Errorf("expected updated recipients, got: %v", response.Task.Recipients)
+		}
+	})
+
+	t.Run("UpdateScheduleEndpointInvalid", func(t *testing.T) {
+		past := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+		cases := map[string]string{
+			"empty":       `{}`,
+			"past":        fmt.Sprintf(`{"send_at": "%s"}`, past),
+			"nobody":      `{"recipients": []}`,
+			"invalidJSON": `not json`,
+		}
+		for name, payload := range cases {
+			resp := patchSchedule(t, scheduledID, payload)
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s: expected status %d, got: %d", name, http.StatusBadRequest, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("UpdateScheduleEndpointNotFound", func(t *testing.T) {
+		resp := patchSchedule(t, "sched-missing", `{"data": {"Name": "Bob"}}`)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("ListScheduleEndpoint", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/schedule?template=welcome&limit=10")
 		if err != nil {
 			t.Fatalf("failed to make request: %v", err)
 		}
@@ -292,7 +949,1416 @@ func TestServer(t *testing.T) {
 		}(resp.Body)
 
 		if resp.StatusCode != http.StatusOK {
-			t.Errorf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+			t.Fatalf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+
+		var response ListScheduleResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if response.Total != 1 || len(response.Tasks) != 1 {
+			t.Fatalf("expected 1 scheduled task, got: %+v", response)
+		}
+		if response.Tasks[0].Template != "welcome" || response.Tasks[0].CreatedAt.IsZero() {
+			t.Errorf("unexpected task in response: %+v", response.Tasks[0])
+		}
+		if response.Limit != 10 {
+			t.Errorf("expected limit 10, got: %d", response.Limit)
+		}
+	})
+
+	t.Run("ListScheduleEndpointInvalidQuery", func(t *testing.T) {
+		for _, query := range []string{"limit=0", "offset=-1", "from=yesterday"} {
+			resp, err := http.Get(testServer.URL + "/schedule?" + query)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d for %q, got: %d", http.StatusBadRequest, query, resp.StatusCode)
+			}
+		}
+	})
+
+	getTask := func(t *testing.T, id string) (*http.Response, TaskResponse) {
+		t.Helper()
+		resp, err := http.Get(testServer.URL + "/tasks/" + id)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer func(Body io.ReadCloser) {
+			err := Body.Close()
+			if err != nil {
+				fmt.Printf("failed to close response body: %v", err)
+			}
+		}(resp.Body)
+
+		var task TaskResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return resp, task
+	}
+
+	t.Run("TaskEndpointPending", func(t *testing.T) {
+		resp, task := getTask(t, scheduledID)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+		if task.Status != scheduler.StatusPending || len(task.History) != 1 {
+			t.Errorf("expected pending task with one status change, got: %+v", task)
+		}
+	})
+
+	t.Run("CancelScheduleEndpoint", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodDelete, testServer.URL+"/schedule/"+scheduledID, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+
+		resp, task := getTask(t, scheduledID)
+		if resp.StatusCode != http.StatusOK || task.Status != scheduler.StatusCancelled {
+			t.Errorf("expected cancelled task, got status %d and %+v", resp.StatusCode, task)
+		}
+
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d when cancelling twice, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("TaskEndpointNotFound", func(t *testing.T) {
+		resp, _ := getTask(t, "sched-missing")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	postSchedule := func(t *testing.T, key string, payload []byte) (*http.Response, map[string]string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, testServer.URL+"/schedule", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer func(Body io.ReadCloser) {
+			err := Body.Close()
+			if err != nil {
+				fmt.Printf("failed to close response body: %v", err)
+			}
+		}(resp.Body)
+
+		var response map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&response)
+		return resp, response
+	}
+
+	t.Run("ScheduleEndpointIdempotencyKey", func(t *testing.T) {
+		payload, _ := json.Marshal(ScheduleRequest{
+			Template:   "welcome",
+			Recipients: []string{"test@example.com"},
+			SendAt:     time.Now().UTC().Add(time.Hour),
+		})
+
+		first, firstBody := postSchedule(t, "retry-123", payload)
+		second, secondBody := postSchedule(t, "retry-123", payload)
+		if first.StatusCode != http.StatusOK || second.StatusCode != http.StatusOK {
+			t.Fatalf("expected both requests to succeed, got: %d and %d", first.StatusCode, second.StatusCode)
+		}
+		if firstBody["task_id"] == "" || firstBody["task_id"] != secondBody["task_id"] {
+			t.Errorf("expected duplicate request to return the original task_id, got: %q and %q", firstBody["task_id"], secondBody["task_id"])
+		}
+		if second.Header.Get("Idempotent-Replayed") != "true" {
+			t.Error("expected replayed response to be marked with Idempotent-Replayed")
+		}
+
+		other, _ := json.Marshal(ScheduleRequest{
+			Template:   "digest",
+			Recipients: []string{"test@example.com"},
+			SendAt:     time.Now().UTC().Add(time.Hour),
+		})
+		mismatch, _ := postSchedule(t, "retry-123", other)
+		if mismatch.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("expected status %d for reused key, got: %d", http.StatusUnprocessableEntity, mismatch.StatusCode)
+		}
+	})
+
+	t.Run("ScheduleEndpointClientReference", func(t *testing.T) {
+		payload, _ := json.Marshal(ScheduleRequest{
+			Template:        "welcome",
+			Recipients:      []string{"test@example.com"},
+			SendAt:          time.Now().UTC().Add(time.Hour),
+			ClientReference: "order-42",
+		})
+
+		_, firstBody := postSchedule(t, "", payload)
+		_, secondBody := postSchedule(t, "", payload)
+		if firstBody["task_id"] == "" || firstBody["task_id"] != secondBody["task_id"] {
+			t.Errorf("expected client_reference to deduplicate requests, got: %q and %q", firstBody["task_id"], secondBody["task_id"])
+		}
+	})
+
+	t.Run("IdempotencyKeyPerClient", func(t *testing.T) {
+		calls := 0
+		handler := srv.withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			fmt.Fprintf(w, "%s %d", client(r.Context()), calls)
+		})
+		post := func(name string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, "/schedule", strings.NewReader(`{}`))
+			req.Header.Set("Idempotency-Key", "shared-key")
+			rec := httptest.NewRecorder()
+			handler(rec, req.WithContext(withClient(req.Context(), name)))
+			return rec
+		}
+
+		alice := post("alice")
+		bob := post("bob")
+		if bob.Body.String() != "bob 2" || bob.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("expected another client's key not to replay the response, got: %q", bob.Body.String())
+		}
+		if again := post("alice"); again.Body.String() != alice.Body.String() || again.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected the client's own retry to be replayed, got: %q", again.Body.String())
+		}
+	})
+
+	t.Run("PauseAndResumeScheduler", func(t *testing.T) {
+		for _, tc := range []struct {
+			path   string
+			paused bool
+		}{
+			{"/admin/scheduler/pause", true},
+			{"/admin/scheduler/resume", false},
+		} {
+			resp, err := http.Post(testServer.URL+tc.path, "application/json", nil)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			var state SchedulerStateResponse
+			_ = json.NewDecoder(resp.Body).Decode(&state)
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status %d for %s, got: %d", http.StatusOK, tc.path, resp.StatusCode)
+			}
+			if state.Paused != tc.paused {
+				t.Errorf("expected paused=%v after %s, got: %v", tc.paused, tc.path, state.Paused)
+			}
+		}
+
+		resp, err := http.Get(testServer.URL + "/admin/scheduler/pause")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("expected status %d, got: %d", http.StatusMethodNotAllowed, resp.StatusCode)
+		}
+	})
+
+	t.Run("RunScheduleEndpoint", func(t *testing.T) {
+		payload, _ := json.Marshal(ScheduleRequest{
+			Template:   "missing",
+			Recipients: []string{"test@example.com"},
+			SendAt:     time.Now().UTC().Add(time.Hour),
+		})
+		_, created := postSchedule(t, "", payload)
+		id := created["task_id"]
+
+		resp, err := http.Post(testServer.URL+"/schedule/"+id+"/run", "application/json", nil)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var run RunScheduleResponse
+		_ = json.NewDecoder(resp.Body).Decode(&run)
+		_ = resp.Body.Close()
+
+		// The test template manager has no templates, so the run fails at rendering.
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("expected status %d, got: %d", http.StatusInternalServerError, resp.StatusCode)
+		}
+		if run.Status != "failed" || run.Task.ID != id || run.Task.Status != scheduler.StatusFailed || run.Task.LastError == "" {
+			t.Errorf("expected failed run result for %s, got: %+v", id, run)
+		}
+
+		again, err := http.Post(testServer.URL+"/schedule/"+id+"/run", "application/json", nil)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = again.Body.Close()
+		if again.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d for a task that already ran, got: %d", http.StatusNotFound, again.StatusCode)
+		}
+	})
+
+	t.Run("QuotaEndpoint", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/quota")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var quota QuotaResponse
+		_ = json.NewDecoder(resp.Body).Decode(&quota)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+		if quota.Daily.Limit != nil || quota.Monthly.Remaining != nil {
+			t.Errorf("expected unlimited quotas without limits configured, got: %+v", quota)
+		}
+	})
+
+	t.Run("ClientLimits", func(t *testing.T) {
+		clients := srv.clients
+		defer func() { srv.clients = clients }()
+
+		srv.clients = newClientLimiter(&config.ClientLimitsConfig{RequestsPerMinute: 2})
+		for i := 0; i < 3; i++ {
+			resp, err := http.Get(testServer.URL + "/quota")
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+			if i < 2 && resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected request %d within the limit to succeed, got status %d", i+1, resp.StatusCode)
+			}
+			if i == 2 && (resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "") {
+				t.Errorf("expected status %d with Retry-After over the request limit, got %d", http.StatusTooManyRequests, resp.StatusCode)
+			}
+		}
+
+		// The requests of the tests come from 127.0.0.1, whose own limits replace the default ones.
+		srv.clients = newClientLimiter(&config.ClientLimitsConfig{
+			RequestsPerMinute: 1,
+			Clients:           map[string]config.ClientLimit{"127.0.0.1": {EmailsPerDay: 2}},
+		})
+		schedule := func(recipients ...string) *http.Response {
+			body, _ := json.Marshal(ScheduleRequest{
+				Template:   "welcome",
+				Recipients: recipients,
+				SendAt:     time.Now().UTC().Add(time.Hour),
+				Data:       map[string]interface{}{"Name": "Alice"},
+			})
+			resp, err := http.Post(testServer.URL+"/schedule", "application/json", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			var response ScheduleResponse
+			_ = json.NewDecoder(resp.Body).Decode(&response)
+			_ = resp.Body.Close()
+			if response.TaskID != "" {
+				_, _ = srv.scheduler.Cancel(response.TaskID)
+			}
+			return resp
+		}
+		if resp := schedule("a@example.com", "b@example.com"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected emails within the limit to be scheduled, got status %d", resp.StatusCode)
+		}
+		if resp := schedule("c@example.com"); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("expected status %d with Retry-After over the email limit, got %d", http.StatusTooManyRequests, resp.StatusCode)
+		}
+		if resp := schedule("a@example.com", "b@example.com", "c@example.com"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for more recipients than the limit, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		// Emails of a request that fails after they were counted are given back.
+		limiter := newClientLimiter(&config.ClientLimitsConfig{EmailsPerDay: 2})
+		ctx := withClient(context.Background(), "refunded")
+		if err := limiter.allowEmails(ctx, 2); err != nil {
+			t.Fatalf("expected emails within the limit to be allowed, got: %v", err)
+		}
+		limiter.refundEmails(ctx, 2)
+		if err := limiter.allowEmails(ctx, 2); err != nil {
+			t.Errorf("expected refunded emails not to count against the limit, got: %v", err)
+		}
+		if err := limiter.allowEmails(ctx, 1); err == nil {
+			t.Error("expected the emails counted after the refund to use up the limit")
+		}
+	})
+
+	t.Run("Webhooks", func(t *testing.T) {
+		type delivery struct {
+			event     webhook.Event
+			signature string
+			body      []byte
+		}
+		deliveries := make(chan delivery, 4)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			var event webhook.Event
+			_ = json.Unmarshal(body, &event)
+			deliveries <- delivery{event: event, signature: r.Header.Get(webhook.SignatureHeader), body: body}
+		}))
+		defer receiver.Close()
+
+		do := func(method, path string, payload string) *http.Response {
+			req, _ := http.NewRequest(method, testServer.URL+path, strings.NewReader(payload))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			return resp
+		}
+
+		resp := do(http.MethodPost, "/webhooks", `{"url": "https://example.com/hooks", "events": ["email.opened"]}`)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for an unknown event type, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		resp = do(http.MethodPost, "/webhooks", fmt.Sprintf(`{"url": %q, "events": ["task.scheduled", "task.cancelled"]}`, receiver.URL))
+		var sub webhook.Subscription
+		_ = json.NewDecoder(resp.Body).Decode(&sub)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated || sub.ID == "" || sub.Secret == "" {
+			t.Fatalf("expected the subscription to be created with a secret, got: %d %+v", resp.StatusCode, sub)
+		}
+
+		resp = do(http.MethodGet, "/webhooks", "")
+		var list ListWebhooksResponse
+		_ = json.NewDecoder(resp.Body).Decode(&list)
+		_ = resp.Body.Close()
+		if len(list.Webhooks) != 1 || list.Webhooks[0].ID != sub.ID || list.Webhooks[0].Secret != "" {
+			t.Errorf("expected the subscription without its secret, got: %+v", list)
+		}
+
+		id, _, err := srv.scheduleEmail(context.Background(), ScheduleRequest{Template: "welcome", Recipients: []string{"test@example.com"}, SendAt: time.Now().UTC().Add(time.Hour)}, nil)
+		if err != nil {
+			t.Fatalf("failed to schedule email: %v", err)
+		}
+		resp = do(http.MethodDelete, "/schedule/"+id, "")
+		_ = resp.Body.Close()
+
+		for _, want := range []string{webhook.EventTaskScheduled, webhook.EventTaskCancelled} {
+			select {
+			case d := <-deliveries:
+				var ts int64
+				_, _ = fmt.Sscanf(d.signature, "t=%d,", &ts)
+				if d.signature != webhook.Sign(sub.Secret, time.Unix(ts, 0), d.body) {
+					t.Errorf("expected the delivery to be signed with the subscription secret, got: %q", d.signature)
+				}
+				// The events are delivered concurrently, in either order.
+				if d.event.Type != webhook.EventTaskScheduled && d.event.Type != webhook.EventTaskCancelled {
+					t.Errorf("expected a task event, got: %q", d.event.Type)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("expected a %s delivery, got none", want)
+			}
+		}
+
+		var attempts WebhookDeliveriesResponse
+		for deadline := time.Now().Add(2 * time.Second); len(attempts.Deliveries) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			resp = do(http.MethodGet, "/webhooks/"+sub.ID+"/deliveries", "")
+			_ = json.NewDecoder(resp.Body).Decode(&attempts)
+			_ = resp.Body.Close()
+		}
+		if len(attempts.Deliveries) != 2 || attempts.Deliveries[0].StatusCode != http.StatusOK {
+			t.Errorf("expected two successful delivery attempts, got: %+v", attempts)
+		}
+
+		resp = do(http.MethodDelete, "/webhooks/"+sub.ID, "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("expected status %d, got: %d", http.StatusNoContent, resp.StatusCode)
+		}
+		resp = do(http.MethodGet, "/webhooks/"+sub.ID, "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d after the subscription was deleted, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("Suppressions", func(t *testing.T) {
+		do := func(method, path string, payload string) *http.Response {
+			req, _ := http.NewRequest(method, testServer.URL+path, strings.NewReader(payload))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			return resp
+		}
+
+		for _, payload := range []string{`{"address": "not-an-email"}`, `{"address": "user@example.com", "reason": "disliked"}`} {
+			resp := do(http.MethodPost, "/suppressions", payload)
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d for %s, got: %d", http.StatusBadRequest, payload, resp.StatusCode)
+			}
+		}
+
+		resp := do(http.MethodPost, "/suppressions", `{"address": "Bounced <Bounced@Example.com>", "reason": "bounced", "note": "mailbox full"}`)
+		var entry suppression.Entry
+		_ = json.NewDecoder(resp.Body).Decode(&entry)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated || entry.Address != "bounced@example.com" || entry.Reason != suppression.ReasonBounced {
+			t.Fatalf("expected the normalized address to be suppressed, got: %d %+v", resp.StatusCode, entry)
+		}
+
+		resp = do(http.MethodGet, "/suppressions", "")
+		var list ListSuppressionsResponse
+		_ = json.NewDecoder(resp.Body).Decode(&list)
+		_ = resp.Body.Close()
+		if len(list.Suppressions) != 1 || list.Suppressions[0].Address != entry.Address {
+			t.Errorf("expected the suppressed address to be listed, got: %+v", list)
+		}
+
+		resp = do(http.MethodPost, "/send", `{"template": "welcome", "recipients": ["bounced@example.com"]}`)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(body), "suppressed") {
+			t.Errorf("expected status %d for a suppressed recipient, got: %d %s", http.StatusUnprocessableEntity, resp.StatusCode, body)
+		}
+
+		sendAt := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+		resp = do(http.MethodPost, "/schedule", fmt.Sprintf(`{"template": "welcome", "recipients": ["user@example.com", "BOUNCED@example.com"], "send_at": %q}`, sendAt))
+		var scheduled ScheduleResponse
+		_ = json.NewDecoder(resp.Body).Decode(&scheduled)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !slices.Equal(scheduled.Suppressed, []string{"BOUNCED@example.com"}) {
+			t.Fatalf("expected the suppressed recipient to be reported, got: %d %+v", resp.StatusCode, scheduled)
+		}
+		task, err := srv.scheduler.Get(scheduled.TaskID)
+		if err != nil || !slices.Equal(task.Recipients, []string{"user@example.com"}) {
+			t.Errorf("expected the task to leave out the suppressed recipient, got: %+v (%v)", task.Recipients, err)
+		}
+		_, _ = srv.scheduler.Cancel(scheduled.TaskID)
+
+		resp = do(http.MethodDelete, "/suppressions/bounced@example.com", "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("expected status %d, got: %d", http.StatusNoContent, resp.StatusCode)
+		}
+		resp = do(http.MethodGet, "/suppressions/bounced@example.com", "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d after the address was removed, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("Unsubscribe", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/unsubscribe?email=user@example.com&token=x")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d without unsubscribe links, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+
+		srv.cfg.Templates.Unsubscribe = config.UnsubscribeConfig{URL: testServer.URL + "/unsubscribe", Secret: "secret"}
+		defer func() { srv.cfg.Templates.Unsubscribe = config.UnsubscribeConfig{} }()
+		if _, err := srv.suppressions.Add(suppression.Entry{Address: "bounced@example.com", Reason: suppression.ReasonBounced}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		defer func() {
+			for _, address := range []string{"user@example.com", "other@example.com", "bounced@example.com"} {
+				_ = srv.suppressions.Remove(address)
+			}
+		}()
+
+		resp, err = http.Get(testServer.URL + "/unsubscribe?email=user@example.com&token=forged")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for a forged token, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		if _, err := srv.suppressions.Get("user@example.com"); !errors.Is(err, suppression.ErrNotSuppressed) {
+			t.Errorf("expected a forged link not to unsubscribe, got: %v", err)
+		}
+
+		link, err := email.UnsubscribeURL(&srv.cfg.Templates.Unsubscribe, []string{"user@example.com", "bounced@example.com"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		resp, err = http.Get(link)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "user@example.com") {
+			t.Errorf("expected a confirmation page, got: %d %s", resp.StatusCode, body)
+		}
+		if entry, err := srv.suppressions.Get("user@example.com"); err != nil || entry.Reason != suppression.ReasonUnsubscribed {
+			t.Errorf("expected the address to be unsubscribed, got: %+v (%v)", entry, err)
+		}
+		if entry, err := srv.suppressions.Get("bounced@example.com"); err != nil || entry.Reason != suppression.ReasonBounced {
+			t.Errorf("expected a suppressed address to keep its reason, got: %+v (%v)", entry, err)
+		}
+
+		link, _ = email.UnsubscribeURL(&srv.cfg.Templates.Unsubscribe, []string{"other@example.com"})
+		resp, err = http.Post(link, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d for a one-click unsubscribe, got: %d", http.StatusOK, resp.StatusCode)
+		}
+		if _, err := srv.suppressions.Get("other@example.com"); err != nil {
+			t.Errorf("expected the address to be unsubscribed in one click, got: %v", err)
+		}
+	})
+
+	t.Run("Tracking", func(t *testing.T) {
+		srv.messages.Accept(email.Message{ID: "msg-tracked", Template: "welcome", Recipients: []string{"test@example.com"}})
+		pixel := testServer.URL + "/t/open/msg-tracked.gif?r=test%40example.com"
+
+		resp, err := http.Get(pixel)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d without open tracking, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+
+		srv.cfg.Templates.Tracking.Opens = true
+		defer func() { srv.cfg.Templates.Tracking.Opens = false }()
+		for _, u := range []string{pixel, pixel, testServer.URL + "/t/open/msg-unknown.gif"} {
+			resp, err := http.Get(u)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/gif" || !bytes.HasPrefix(body, []byte("GIF89a")) {
+				t.Errorf("expected the tracking pixel for %s, got: %d %s", u, resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+		}
+
+		resp, err = http.Get(testServer.URL + "/messages/msg-tracked")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var msg messages.Message
+		_ = json.NewDecoder(resp.Body).Decode(&msg)
+		_ = resp.Body.Close()
+		if msg.Opens != 2 || msg.RecipientOpens["test@example.com"] != 2 || msg.LastOpenedAt == nil {
+			t.Errorf("expected two opens by the recipient, got: %+v", msg)
+		}
+
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		target := "https://example.com/shop?item=1"
+		click := func(recipient, token string) *http.Response {
+			query := url.Values{"u": {target}, "r": {recipient}, "t": {token}}
+			resp, err := client.Get(testServer.URL + "/t/click/msg-tracked?" + query.Encode())
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+			return resp
+		}
+		token := templates.ClickToken("secret", "msg-tracked", "test@example.com", target)
+		if resp := click("test@example.com", token); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d without click tracking, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+
+		srv.cfg.Templates.Tracking.Secret = "secret"
+		defer func() { srv.cfg.Templates.Tracking.Secret = "" }()
+		if resp := click("other@example.com", token); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for a link altered to name another recipient, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		if resp := click("test@example.com", token); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != target {
+			t.Errorf("expected a redirect to %s, got: %d %s", target, resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if msg, err := srv.messages.Get("msg-tracked"); err != nil || msg.Clicks != 1 || msg.LinkClicks[target] != 1 || msg.RecipientClicks["test@example.com"] != 1 {
+			t.Errorf("expected one click by the recipient, got: %+v (%v)", msg, err)
+		}
+	})
+
+	t.Run("Bounces", func(t *testing.T) {
+		msg := email.Message{ID: "msg-bounced", Template: "welcome", Recipients: []string{"bounce@example.com"}}
+		srv.messages.Accept(msg)
+		srv.messages.Sent(msg, email.Result{Provider: "mailgun", MessageID: "<1718031600.bounce@example.com>"})
+		defer func() { _ = srv.suppressions.Remove("bounce@example.com") }()
+
+		post := func(signature string) *http.Response {
+			body := `{"signature":{"timestamp":"1718031600","token":"tok","signature":"` + signature + `"},"event-data":{"event":"failed","severity":"permanent",` +
+				`"recipient":"bounce@example.com","message":{"headers":{"message-id":"1718031600.bounce@example.com"}},"delivery-status":{"code":550,"message":"No such user"}}}`
+			resp, err := http.Post(testServer.URL+"/bounces/mailgun", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+			return resp
+		}
+		signature := bounce.MailgunSignature("key", "1718031600", "tok")
+		if resp := post(signature); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d while the provider is disabled, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+
+		srv.cfg.Bounces.Mailgun = config.MailgunBouncesConfig{Enabled: true, SigningKey: "key"}
+		defer func() { srv.cfg.Bounces.Mailgun = config.MailgunBouncesConfig{} }()
+		if resp := post("forged"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status %d for a forged signature, got: %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+		if resp := post(signature); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status %d, got: %d", http.StatusNoContent, resp.StatusCode)
+		}
+		if msg, err := srv.messages.Get("msg-bounced"); err != nil || msg.Status != messages.StatusBounced {
+			t.Errorf("expected the message to be bounced, got: %+v (%v)", msg, err)
+		}
+		if entry, err := srv.suppressions.Get("bounce@example.com"); err != nil || entry.Reason != suppression.ReasonBounced {
+			t.Errorf("expected the address to be suppressed, got: %+v (%v)", entry, err)
+		}
+	})
+
+	t.Run("VersionedAPI", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/api/v1/quota")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d for the versioned quota path, got: %d", http.StatusOK, resp.StatusCode)
+		}
+
+		payload, _ := json.Marshal(ScheduleRequest{
+			Template:   "welcome",
+			Recipients: []string{"test@example.com"},
+			SendAt:     time.Now().UTC().Add(time.Hour),
+		})
+		req, _ := http.NewRequest(http.MethodPost, testServer.URL+"/api/v1/schedule", bytes.NewBuffer(payload))
+		req.Header.Set("Idempotency-Key", "versioned-1")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var created map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&created)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || created["task_id"] == "" {
+			t.Fatalf("expected the versioned schedule path to create a task, got: %d %v", resp.StatusCode, created)
+		}
+
+		legacy, replayed := postSchedule(t, "versioned-1", payload)
+		if legacy.StatusCode != http.StatusOK || replayed["task_id"] != created["task_id"] {
+			t.Errorf("expected a retry on the unversioned path to replay the task, got: %d %v", legacy.StatusCode, replayed)
+		}
+
+		resp, err = http.Get(testServer.URL + "/api/v1/tasks/" + created["task_id"])
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d for the versioned task path, got: %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("RequestID", func(t *testing.T) {
+		get := func(id string) *http.Response {
+			req, _ := http.NewRequest(http.MethodGet, testServer.URL+"/quota", nil)
+			if id != "" {
+				req.Header.Set(requestIDHeader, id)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			_ = resp.Body.Close()
+			return resp
+		}
+		if id := get("support-1234").Header.Get(requestIDHeader); id != "support-1234" {
+			t.Errorf("expected the incoming request ID to be echoed, got: %q", id)
+		}
+		generated := get("").Header.Get(requestIDHeader)
+		if len(generated) != 32 {
+			t.Errorf("expected a generated request ID, got: %q", generated)
+		}
+		if id := get("not a valid id"); id.Header.Get(requestIDHeader) == "not a valid id" {
+			t.Error("expected an unusable request ID to be replaced")
+		}
+
+		req, _ := http.NewRequest(http.MethodPost, testServer.URL+"/send", strings.NewReader("{"))
+		req.Header.Set(requestIDHeader, "support-5678")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "request ID: support-5678") {
+			t.Errorf("expected the request ID in the error body, got: %d %q", resp.StatusCode, body)
+		}
+
+		payload, _ := json.Marshal(SendRequest{Template: "limited", Recipients: []string{"not-an-email"}})
+		req, _ = http.NewRequest(http.MethodPost, testServer.URL+"/send", bytes.NewBuffer(payload))
+		req.Header.Set(requestIDHeader, "support-9012")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var invalid ValidationErrorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&invalid)
+		_ = resp.Body.Close()
+		if invalid.RequestID != "support-9012" {
+			t.Errorf("expected the request ID in the validation error, got: %+v", invalid)
+		}
+
+		core, logs := observer.New(zap.InfoLevel)
+		logged := &Server{logger: &logger.Logger{Logger: zap.New(core)}}
+		logged.log(withRequestIDContext(context.Background(), "support-3456")).Info("Handled")
+		if entries := logs.All(); len(entries) != 1 || entries[0].ContextMap()["request_id"] != "support-3456" {
+			t.Errorf("expected the request ID on the log line, got: %v", entries)
+		}
+	})
+
+	t.Run("AccessLog", func(t *testing.T) {
+		core, logs := observer.New(zap.InfoLevel)
+		original := srv.logger
+		srv.logger = &logger.Logger{Logger: zap.New(core)}
+		defer func() { srv.logger = original }()
+
+		req, _ := http.NewRequest(http.MethodGet, testServer.URL+"/api/v1/tasks/missing", nil)
+		req.Header.Set(requestIDHeader, "support-7890")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		entries := logs.FilterMessage("HTTP request").All()
+		if len(entries) != 1 {
+			t.Fatalf("expected one access log line, got: %v", logs.All())
+		}
+		fields := entries[0].ContextMap()
+		if fields["method"] != http.MethodGet || fields["path"] != "/api/v1/tasks/missing" || fields["route"] != "/api/v1/tasks/{id}" ||
+			fields["status"] != int64(http.StatusNotFound) || fields["request_id"] != "support-7890" || fields["remote_ip"] != "127.0.0.1" {
+			t.Errorf("expected the request on the access log line, got: %v", fields)
+		}
+		if _, ok := fields["duration"]; !ok {
+			t.Errorf("expected the duration on the access log line, got: %v", fields)
+		}
+
+		resp, err = http.Get(testServer.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		metrics, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if !strings.Contains(string(metrics), `runebird_http_request_duration_seconds_count{route="/api/v1/tasks/{id}",status="4xx"} 1`) {
+			t.Error("expected the request to be observed by route and status class")
+		}
+	})
+
+	t.Run("OpenAPIDocument", func(t *testing.T) {
+		generated, err := OpenAPI()
+		if err != nil {
+			t.Fatalf("failed to generate the OpenAPI document: %v", err)
+		}
+		if !bytes.Equal(generated, openAPIDocument) {
+			t.Fatal("expected openapi.json to match the request and response types, run go generate ./internal/server")
+		}
+
+		resp, err := http.Get(testServer.URL + "/api/openapi.json")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("expected the OpenAPI document as JSON, got: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		var doc struct {
+			OpenAPI string                     `json:"openapi"`
+			Paths   map[string]json.RawMessage `json:"paths"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			t.Fatalf("failed to decode the OpenAPI document: %v", err)
+		}
+		if doc.OpenAPI != "3.0.3" {
+			t.Errorf("expected OpenAPI version 3.0.3, got: %s", doc.OpenAPI)
+		}
+		for _, r := range srv.routes() {
+			if _, ok := doc.Paths[apiV1+r.pattern]; !ok {
+				t.Errorf("expected the OpenAPI document to describe %s", apiV1+r.pattern)
+			}
+		}
+		for _, path := range []string{"/health", "/metrics", "/api/openapi.json"} {
+			if _, ok := doc.Paths[path]; !ok {
+				t.Errorf("expected the OpenAPI document to describe %s", path)
+			}
+		}
+	})
+
+	t.Run("GRPC", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		go func() { _ = srv.serveGRPC(lis) }()
+		defer func() { <-srv.shutdownGRPC(context.Background()) }()
+
+		conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("failed to create gRPC client: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+		client := emailerpb.NewEmailerClient(conn)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_, err = client.Send(ctx, &emailerpb.SendRequest{Template: "welcome", Recipients: []string{"test@example.com", "not-an-email"}})
+		st := status.Convert(err)
+		if st.Code() != codes.InvalidArgument {
+			t.Fatalf("expected invalid recipients to fail with %s, got: %v", codes.InvalidArgument, err)
+		}
+		var violations []*errdetails.BadRequest_FieldViolation
+		for _, detail := range st.Details() {
+			if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+				violations = badRequest.GetFieldViolations()
+			}
+		}
+		if len(violations) != 1 || violations[0].GetField() != "recipients[1]" {
+			t.Errorf("expected a field violation for recipients[1], got: %v", violations)
+		}
+
+		data, _ := structpb.NewStruct(map[string]interface{}{"Name": "Alice"})
+		var header metadata.MD
+		scheduled, err := client.Schedule(metadata.AppendToOutgoingContext(ctx, requestIDMetadata, "support-1234"), &emailerpb.ScheduleRequest{
+			Template:   "welcome",
+			Recipients: []string{"test@example.com"},
+			SendAt:     timestamppb.New(time.Now().Add(3 * time.Hour)),
+			Data:       data,
+		}, grpc.Header(&header))
+		if err != nil {
+			t.Fatalf("failed to schedule email: %v", err)
+		}
+		if ids := header.Get(requestIDMetadata); len(ids) != 1 || ids[0] != "support-1234" {
+			t.Errorf("expected the request ID to be echoed in the response metadata, got: %v", ids)
+		}
+		if _, err := client.Schedule(ctx, &emailerpb.ScheduleRequest{Template: "welcome", Recipients: []string{"test@example.com"}}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected a schedule without send_at to fail with %s, got: %v", codes.InvalidArgument, err)
+		}
+
+		stream, err := client.ListTasks(ctx, &emailerpb.ListTasksRequest{Template: "welcome"})
+		if err != nil {
+			t.Fatalf("failed to list tasks: %v", err)
+		}
+		var found bool
+		for {
+			task, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to receive task: %v", err)
+			}
+			if task.GetId() == scheduled.GetTaskId() {
+				found = task.GetStatus() == string(scheduler.StatusPending)
+			}
+		}
+		if !found {
+			t.Errorf("expected task %s to be listed as pending", scheduled.GetTaskId())
+		}
+
+		cancelled, err := client.CancelTask(ctx, &emailerpb.CancelTaskRequest{Id: scheduled.GetTaskId()})
+		if err != nil {
+			t.Fatalf("failed to cancel task: %v", err)
+		}
+		if cancelled.GetStatus() != string(scheduler.StatusCancelled) {
+			t.Errorf("expected the task to be cancelled, got: %s", cancelled.GetStatus())
+		}
+		if _, err := client.CancelTask(ctx, &emailerpb.CancelTaskRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+			t.Errorf("expected cancelling an unknown task to fail with %s, got: %v", codes.NotFound, err)
+		}
+	})
+
+	t.Run("HealthEndpoint", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/health")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var health HealthResponse
+		_ = json.NewDecoder(resp.Body).Decode(&health)
+		_ = resp.Body.Close()
+
+		// Health checks are disabled, so the provider is assumed to be up.
+		if resp.StatusCode != http.StatusOK || health.Status != "ok" {
+			t.Errorf("expected status %d and ok, got: %d %+v", http.StatusOK, resp.StatusCode, health)
+		}
+	})
+
+	t.Run("TemplateVersionsEndpoint", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/templates/limited/versions")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d without a template store, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+
+		resp, err = http.Post(testServer.URL+"/templates/limited/versions/latest/activate", "application/json", nil)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for an invalid version, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		resp, err = http.Get(testServer.URL + "/templates/limited/versions/1/activate")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("expected status %d, got: %d", http.StatusMethodNotAllowed, resp.StatusCode)
+		}
+	})
+
+	t.Run("TemplatesEndpoint", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/templates")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var list ListTemplatesResponse
+		_ = json.NewDecoder(resp.Body).Decode(&list)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !slices.Contains(list.Templates, "limited") {
+			t.Errorf("expected status %d and the limited template, got: %d %+v", http.StatusOK, resp.StatusCode, list)
+		}
+
+		resp, err = http.Get(testServer.URL + "/templates/missing")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d for an unknown template, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+
+		body, _ := json.Marshal(TemplateRequest{Content: "<p>Hi {{ .Name </p>"})
+		req, _ := http.NewRequest(http.MethodPut, testServer.URL+"/templates/limited", bytes.NewReader(body))
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for a template that does not parse, got: %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		req, _ = http.NewRequest(http.MethodDelete, testServer.URL+"/templates/missing", nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d for deleting an unknown template, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("PreviewEndpoint", func(t *testing.T) {
+		body, _ := json.Marshal(PreviewRequest{Data: map[string]interface{}{"Name": "Alice"}})
+		resp, err := http.Post(testServer.URL+"/templates/limited/preview", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var preview PreviewResponse
+		_ = json.NewDecoder(resp.Body).Decode(&preview)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+		if preview.HTML != "<p>Hi Alice</p>" || !strings.Contains(preview.Text, "Hi Alice") || preview.Subject != "Email from RuneBird (limited)" {
+			t.Errorf("expected the rendered email, got: %+v", preview)
+		}
+
+		resp, err = http.Post(testServer.URL+"/templates/missing/preview", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d for an unknown template, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("VariablesEndpoint", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/templates/limited/variables")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var variables TemplateVariablesResponse
+		_ = json.NewDecoder(resp.Body).Decode(&variables)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(variables.Variables) != 1 || variables.Variables[0].Name != "Name" {
+			t.Errorf("expected the Name field, got: %d %+v", resp.StatusCode, variables)
+		}
+
+		resp, err = http.Get(testServer.URL + "/templates/missing/variables")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d for an unknown template, got: %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("ValidateEndpoint", func(t *testing.T) {
+		resp, err := http.Post(testServer.URL+"/templates/limited/validate", "application/json", strings.NewReader(`{"data": {}}`))
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		var validation ValidateTemplateResponse
+		_ = json.NewDecoder(resp.Body).Decode(&validation)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || validation.Valid || len(validation.Issues) != 1 {
+			t.Errorf("expected the missing Name field to be reported, got: %d %+v", resp.StatusCode, validation)
+		}
+
+		resp, err = http.Post(testServer.URL+"/templates/limited/validate", "application/json", nil)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		validation = ValidateTemplateResponse{}
+		_ = json.NewDecoder(resp.Body).Decode(&validation)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !validation.Valid {
+			t.Errorf("expected the template to be valid without data, got: %d %+v", resp.StatusCode, validation)
+		}
+	})
+
+	t.Run("MetricsEndpoint", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer func(Body io.ReadCloser) {
+			err := Body.Close()
+			if err != nil {
+				fmt.Printf("failed to close response body: %v", err)
+			}
+		}(resp.Body)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+		metrics, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response body: %v", err)
+		}
+		for _, name := range []string{"runebird_queue_depth", "runebird_rate_limit_tokens", "runebird_emails_deferred_total"} {
+			if !strings.Contains(string(metrics), name) {
+				t.Errorf("expected rate limiter metric %s to be exposed", name)
+			}
+		}
+		if !strings.Contains(string(metrics), `runebird_smtp_profile_healthy{profile="primary"}`) {
+			t.Error("expected SMTP profile health to be exposed")
+		}
+		if !strings.Contains(string(metrics), "runebird_email_provider_up 1") {
+			t.Error("expected email provider health to be exposed")
+		}
+		for _, name := range []string{"runebird_scheduler_pending_tasks", "runebird_scheduler_oldest_pending_age_seconds", "runebird_tasks_failed_total"} {
+			if !strings.Contains(string(metrics), name) {
+				t.Errorf("expected scheduler metric %s to be exposed", name)
+			}
+		}
+	})
+
+	t.Run("AdminPort", func(t *testing.T) {
+		srv.cfg.Admin.Port = 9090
+		defer func() { srv.cfg.Admin.Port = 0 }()
+		public, admin := srv.handlers()
+		if admin == nil {
+			t.Fatal("expected an admin handler with an admin port")
+		}
+
+		for _, tc := range []struct {
+			path   string
+			public int
+			admin  int
+		}{
+			{"/health", http.StatusOK, http.StatusOK},
+			{"/metrics", http.StatusNotFound, http.StatusOK},
+			{"/debug/pprof/", http.StatusNotFound, http.StatusOK},
+			{"/api/v1/templates", http.StatusNotFound, http.StatusOK},
+			{"/templates", http.StatusNotFound, http.StatusOK},
+			{"/api/v1/quota", http.StatusOK, http.StatusNotFound},
+		} {
+			for _, h := range []struct {
+				name    string
+				handler http.Handler
+				want    int
+			}{{"public", public, tc.public}, {"admin", admin, tc.admin}} {
+				rec := httptest.NewRecorder()
+				h.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+				if rec.Code != h.want {
+					t.Errorf("expected status %d for %s on the %s port, got: %d", h.want, tc.path, h.name, rec.Code)
+				}
+			}
+		}
+
+		srv.cfg.Admin.Port = 0
+		if _, admin := srv.handlers(); admin != nil {
+			t.Error("expected no admin handler without an admin port")
+		}
+	})
+
+	t.Run("Authentication", func(t *testing.T) {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		keys := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": base64.RawURLEncoding.EncodeToString(public)},
+			}})
+		}))
+		defer keys.Close()
+		sign := func(scope string) string {
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","kid":"k1"}`))
+			claims, _ := json.Marshal(map[string]interface{}{"iss": "https://issuer.example.com", "exp": time.Now().Add(time.Hour).Unix(), "scope": scope})
+			signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+			return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(private, []byte(signed)))
+		}
+
+		log, err := logger.New(&config.LoggingConfig{Level: "info"})
+		if err != nil {
+			t.Fatalf("failed to create logger: %v", err)
+		}
+		jwtCfg := &config.JWTConfig{Issuer: "https://issuer.example.com", JWKSURL: keys.URL, RefreshInterval: time.Hour}
+		srv := &Server{cfg: &config.Config{}, logger: log, auth: auth.New(jwtCfg)}
+		handler := srv.authorize("send", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		tests := []struct {
+			name          string
+			authorization string
+			status        int
+			challenge     string
+		}{
+			{"NoToken", "", http.StatusUnauthorized, `Bearer realm="runebird"`},
+			{"InvalidToken", "Bearer not-a-token", http.StatusUnauthorized, `error="invalid_token"`},
+			{"InsufficientScope", "Bearer " + sign("schedule admin"), http.StatusForbidden, `error="insufficient_scope", scope="send"`},
+			{"Authorized", "Bearer " + sign("schedule send"), http.StatusNoContent, ""},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodPost, "/send", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.status, rec.Code, rec.Body.String())
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, tt.challenge) || (tt.challenge == "") != (challenge == "") {
+				t.Errorf("%s: expected challenge containing %q, got %q", tt.name, tt.challenge, challenge)
+			}
+		}
+
+		srv.auth = auth.New(&config.JWTConfig{Issuer: "https://issuer.example.com", JWKSURL: keys.URL + "/missing", RefreshInterval: time.Hour})
+		keys.Close()
+		req := httptest.NewRequest(http.MethodPost, "/send", nil)
+		req.Header.Set("Authorization", "Bearer "+sign("send"))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d when the keys cannot be fetched, got %d", http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+
+	t.Run("MutualTLS", func(t *testing.T) {
+		caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Test CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("failed to create CA certificate: %v", err)
+		}
+		ca, _ := x509.ParseCertificate(caDER)
+		issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				Subject:      pkix.Name{CommonName: name},
+				DNSNames:     []string{name},
+				IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			}, ca, &key.PublicKey, caKey)
+			if err != nil {
+				t.Fatalf("failed to create certificate: %v", err)
+			}
+			return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+		}
+
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600); err != nil {
+			t.Fatalf("failed to write CA file: %v", err)
+		}
+		tlsCfg := config.TLSConfig{CertFile: "server.pem", KeyFile: "server-key.pem", ClientCAFile: caFile, AllowedClients: []string{"billing"}}
+		tlsConfig, err := newTLSConfig(&tlsCfg)
+		if err != nil {
+			t.Fatalf("failed to create TLS config: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{issue(2, "localhost", x509.ExtKeyUsageServerAuth)}
+
+		log, err := logger.New(&config.LoggingConfig{Level: "info"})
+		if err != nil {
+			t.Fatalf("failed to create logger: %v", err)
+		}
+		srv := &Server{cfg: &config.Config{Server: config.ServerConfig{TLS: tlsCfg}}, logger: log}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/send", srv.authorize("send", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		httpsServer := httptest.NewUnstartedServer(mux)
+		httpsServer.TLS = tlsConfig
+		httpsServer.StartTLS()
+		defer httpsServer.Close()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		client := func(certs ...tls.Certificate) *http.Client {
+			return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		}
+		_, untrustedKey, _ := ed25519.GenerateKey(rand.Reader)
+		untrustedDER, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(5),
+			Subject:      pkix.Name{CommonName: "billing"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, &x509.Certificate{SerialNumber: big.NewInt(6), Subject: pkix.Name{CommonName: "Other CA"}}, untrustedKey.Public(), untrustedKey)
+		untrusted := client(tls.Certificate{Certificate: [][]byte{untrustedDER}, PrivateKey: untrustedKey})
+
+		tests := []struct {
+			name   string
+			client *http.Client
+			path   string
+			status int
+		}{
+			{"AllowedClient", client(issue(3, "billing", x509.ExtKeyUsageClientAuth)), "/send", http.StatusNoContent},
+			{"OtherClient", client(issue(4, "marketing", x509.ExtKeyUsageClientAuth)), "/send", http.StatusForbidden},
+			{"NoCertificate", client(), "/send", http.StatusUnauthorized},
+			{"UntrustedCertificate", untrusted, "/send", http.StatusUnauthorized},
+			{"HealthWithoutCertificate", client(), "/health", http.StatusOK},
+		}
+		for _, tt := range tests {
+			resp, err := tt.client.Post(httpsServer.URL+tt.path, "application/json", nil)
+			if err != nil {
+				t.Fatalf("%s: failed to make request: %v", tt.name, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("CertificateReload", func(t *testing.T) {
+		dir := t.TempDir()
+		tlsCfg := config.TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+		writeCert := func(serial int64, modTime time.Time) {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				Subject:      pkix.Name{CommonName: "localhost"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			if err != nil {
+				t.Fatalf("failed to create certificate: %v", err)
+			}
+			keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+			for path, block := range map[string]*pem.Block{
+				tlsCfg.CertFile: {Type: "CERTIFICATE", Bytes: der},
+				tlsCfg.KeyFile:  {Type: "PRIVATE KEY", Bytes: keyDER},
+			} {
+				if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+					t.Fatalf("failed to write %s: %v", path, err)
+				}
+				os.Chtimes(path, modTime, modTime)
+			}
+		}
+		serial := func(c *certReloader) int64 {
+			cert, err := c.getCertificate(nil)
+			if err != nil {
+				t.Fatalf("failed to get certificate: %v", err)
+			}
+			leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+			return leaf.SerialNumber.Int64()
+		}
+
+		log, err := logger.New(&config.LoggingConfig{Level: "info"})
+		if err != nil {
+			t.Fatalf("failed to create logger: %v", err)
+		}
+		reloader := newCertReloader(&tlsCfg, log)
+		if _, err := reloader.getCertificate(nil); err == nil {
+			t.Error("expected no certificate before the first load")
+		}
+		writeCert(1, time.Now().Add(-time.Minute))
+		if err := reloader.reload(); err != nil {
+			t.Fatalf("failed to load certificate: %v", err)
+		}
+		if got := serial(reloader); got != 1 {
+			t.Fatalf("expected certificate 1, got %d", got)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go reloader.watch(ctx, 10*time.Millisecond)
+
+		if err := os.WriteFile(tlsCfg.KeyFile, []byte("not a key"), 0o600); err != nil {
+			t.Fatalf("failed to write key: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := serial(reloader); got != 1 {
+			t.Errorf("expected the previous certificate to be kept when the new one is invalid, got %d", got)
+		}
+
+		writeCert(2, time.Now())
+		deadline := time.Now().Add(2 * time.Second)
+		for serial(reloader) != 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := serial(reloader); got != 2 {
+			t.Errorf("expected the rotated certificate to be loaded, got %d", got)
 		}
 	})
 }
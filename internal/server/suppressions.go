@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"runebird/internal/suppression"
+)
+
+// checkSuppressed leaves the suppressed recipients out of a request, returning the recipients
+// that remain and those left out. It fails with a *requestError if every recipient is
+// suppressed.
+func (s *Server) checkSuppressed(ctx context.Context, recipients []string) ([]string, []string, error) {
+	allowed, suppressed, err := s.suppressions.Filter(recipients)
+	if err != nil {
+		s.log(ctx).Error("Failed to check the suppression list", zap.Error(err))
+		return nil, nil, requestErrorf(http.StatusInternalServerError, "Failed to check the suppression list: %v", err)
+	}
+	if len(allowed) == 0 {
+		return nil, nil, requestErrorf(http.StatusUnprocessableEntity, "All recipients are suppressed: %s", strings.Join(suppressed, ", "))
+	}
+	if len(suppressed) > 0 {
+		s.log(ctx).Info("Suppressed recipients left out of email", zap.Strings("suppressed", suppressed))
+	}
+	return allowed, suppressed, nil
+}
+
+// handleSuppressions lists the suppressed addresses or adds one to the list.
+func (s *Server) handleSuppressions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := s.suppressions.Entries()
+		if err != nil {
+			s.log(r.Context()).Error("Failed to list suppressed addresses", zap.Error(err))
+			httpError(w, fmt.Sprintf("Failed to list suppressed addresses: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, ListSuppressionsResponse{Suppressions: entries})
+	case http.MethodPost:
+		var req SuppressionRequest
+		if err := s.decodeJSON(w, r, &req); err != nil {
+			s.log(r.Context()).Error("Failed to decode suppression request body", zap.Error(err))
+			writeBodyError(w, err)
+			return
+		}
+		entry, err := s.suppressions.Add(suppression.Entry{Address: req.Address, Reason: req.Reason, Note: req.Note})
+		if s.checkSuppressionError(w, r, req.Address, err) {
+			return
+		}
+		s.log(r.Context()).Info("Address suppressed", zap.String("address", entry.Address), zap.String("reason", string(entry.Reason)))
+		writeJSON(w, http.StatusCreated, entry)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSuppression returns the entry of a suppressed address, or takes it off the list.
+func (s *Server) handleSuppression(w http.ResponseWriter, r *http.Request) {
+	address := r.PathValue("address")
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, err := s.suppressions.Get(address)
+		if s.checkSuppressionError(w, r, address, err) {
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+	case http.MethodDelete:
+		if s.checkSuppressionError(w, r, address, s.suppressions.Remove(address)) {
+			return
+		}
+		s.log(r.Context()).Info("Address removed from the suppression list", zap.String("address", address))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkSuppressionError answers a suppression request that failed with err, reporting whether
+// it did.
+func (s *Server) checkSuppressionError(w http.ResponseWriter, r *http.Request, address string, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, suppression.ErrNotSuppressed):
+		httpError(w, "Address is not suppressed", http.StatusNotFound)
+	case errors.Is(err, suppression.ErrInvalidEntry):
+		httpError(w, err.Error(), http.StatusBadRequest)
+	default:
+		s.log(r.Context()).Error("Failed to manage the suppression list", zap.String("address", address), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to manage the suppression list: %v", err), http.StatusInternalServerError)
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/logger"
+)
+
+// certReloader serves the certificate in certFile and keyFile, loading it again when the
+// files change so that certificates rotated on disk are picked up by new connections.
+type certReloader struct {
+	certFile, keyFile string
+	logger            *logger.Logger
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	stamps [2]fileStamp
+}
+
+// fileStamp identifies a version of a certificate or key file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newCertReloader(cfg *config.TLSConfig, log *logger.Logger) *certReloader {
+	return &certReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile, logger: log}
+}
+
+// reload loads the certificate, keeping the previous one if it cannot be loaded.
+func (c *certReloader) reload() error {
+	stamps := c.stampFiles()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate %s: %v", c.certFile, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.stamps = stamps
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) stampFiles() [2]fileStamp {
+	var stamps [2]fileStamp
+	for i, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// watch reloads the certificate whenever its files change, until ctx is done. A certificate
+// and key written one after the other may not match in between, so a failed reload is tried
+// again once either file changes again.
+func (c *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var failed [2]fileStamp
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stamps := c.stampFiles()
+		c.mu.RLock()
+		unchanged := stamps == c.stamps
+		c.mu.RUnlock()
+		if unchanged || stamps == failed {
+			continue
+		}
+		if err := c.reload(); err != nil {
+			failed = stamps
+			c.logger.Error("Failed to reload TLS certificate, keeping the previous one", zap.Error(err))
+			continue
+		}
+		c.logger.Info("TLS certificate reloaded", zap.String("cert_file", c.certFile))
+	}
+}
+
+// newTLSConfig returns the TLS configuration of the HTTPS server. Client certificates issued
+// by the client CAs are verified when presented but not required by the handshake, so that
+// /health and /metrics stay reachable without one; verifyClient requires them for the API.
+func newTLSConfig(cfg *config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file %s: %v", cfg.ClientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// verifyClient checks the client certificate of a connection when client certificates are
+// required, failing with a *requestError if it is missing or not allowed.
+func (s *Server) verifyClient(state *tls.ConnectionState) error {
+	tlsCfg := s.cfg.Server.TLS
+	if tlsCfg.ClientCAFile == "" {
+		return nil
+	}
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return requestErrorf(http.StatusUnauthorized, "Client certificate is required")
+	}
+	if len(tlsCfg.AllowedClients) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	if slices.Contains(tlsCfg.AllowedClients, cert.Subject.CommonName) || slices.ContainsFunc(cert.DNSNames, func(name string) bool {
+		return slices.Contains(tlsCfg.AllowedClients, name)
+	}) {
+		return nil
+	}
+	return requestErrorf(http.StatusForbidden, "Client %s is not allowed", cert.Subject.CommonName)
+}
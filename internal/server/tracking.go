@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"runebird/internal/messages"
+	"runebird/internal/templates"
+)
+
+// openPixel is a transparent 1x1 GIF.
+var openPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// handleOpen serves the tracking pixel added to emails by templates.Track and records the
+// open of the email named by the path, and of the recipient in the r parameter if there is one.
+// The pixel is served whether or not the email is known, so that a mail client never shows a
+// broken image.
+func (s *Server) handleOpen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := strings.CutSuffix(r.PathValue("file"), ".gif")
+	if !ok || !s.cfg.Templates.Tracking.Opens {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		msg, err := s.messages.Open(id, r.URL.Query().Get("r"))
+		switch {
+		case err == nil:
+			s.emailsOpenedTotal.WithLabelValues(msg.Template).Inc()
+			s.log(r.Context()).Debug("Email opened", zap.String("id", id), zap.Int("opens", msg.Opens))
+		case errors.Is(err, messages.ErrMessageNotFound):
+			s.log(r.Context()).Debug("Open of an unknown email", zap.String("id", id))
+		default:
+			s.log(r.Context()).Error("Failed to record email open", zap.String("id", id), zap.Error(err))
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	// Every load of the pixel has to reach the server to be counted.
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Pragma", "no-cache")
+	_, _ = w.Write(openPixel)
+}
+
+// handleClick records the click on a link rewritten by templates.Track and redirects to the
+// link's target. The link must be signed, so that the endpoint cannot be used to redirect to
+// other sites.
+func (s *Server) handleClick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := s.cfg.Templates.Tracking.Secret
+	if secret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	id := r.PathValue("id")
+	query := r.URL.Query()
+	target, recipient := query.Get("u"), query.Get("r")
+	if !templates.VerifyClickToken(secret, id, recipient, target, query.Get("t")) {
+		s.log(r.Context()).Warn("Rejected tracked link with an invalid token", zap.String("id", id), zap.String("url", target))
+		httpError(w, "Invalid tracked link", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		msg, err := s.messages.Click(id, recipient, target)
+		switch {
+		case err == nil:
+			s.linkClicksTotal.WithLabelValues(msg.Template).Inc()
+			s.log(r.Context()).Debug("Tracked link clicked", zap.String("id", id), zap.String("url", target), zap.Int("clicks", msg.Clicks))
+		case errors.Is(err, messages.ErrMessageNotFound):
+			s.log(r.Context()).Debug("Click in an unknown email", zap.String("id", id), zap.String("url", target))
+		default:
+			s.log(r.Context()).Error("Failed to record link click", zap.String("id", id), zap.Error(err))
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+
+	"go.uber.org/zap"
+	"runebird/internal/email"
+	"runebird/internal/suppression"
+)
+
+// maxUnsubscribeForm bounds the form of an unsubscribe request, which only carries the
+// recipients and token of a link.
+const maxUnsubscribeForm = 16 << 10
+
+// unsubscribePage is the page shown to a recipient following an unsubscribe link.
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ .Title }}</title>
+<style>body{font-family:sans-serif;max-width:32rem;margin:4rem auto;padding:0 1rem;color:#222}</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+<p>{{ .Message }}</p>
+{{- if .Addresses }}
+<ul>{{ range .Addresses }}<li>{{ . }}</li>{{ end }}</ul>
+{{- end }}
+</body>
+</html>
+`))
+
+type unsubscribePageData struct {
+	Title     string
+	Message   string
+	Addresses []string
+}
+
+// handleUnsubscribe serves the links made by the unsubscribeURL template helper and the
+// List-Unsubscribe header. Both a GET from a browser and the one-click POST of RFC 8058 check the
+// token of the link, add its addresses to the suppression list and answer with a confirmation
+// page. Addresses already suppressed keep the reason they were suppressed for.
+func (s *Server) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := s.cfg.Templates.Unsubscribe
+	if cfg.URL == "" || cfg.Secret == "" {
+		httpError(w, "Unsubscribe links are not enabled", http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUnsubscribeForm)
+	if err := r.ParseForm(); err != nil {
+		s.log(r.Context()).Error("Failed to parse unsubscribe request", zap.Error(err))
+		writeUnsubscribePage(w, http.StatusBadRequest, unsubscribePageData{Title: "Unsubscribe failed", Message: "The unsubscribe request could not be read."})
+		return
+	}
+	addresses := r.Form["email"]
+	if len(addresses) == 0 || !email.VerifyUnsubscribeToken(cfg.Secret, addresses, r.Form.Get("token")) {
+		s.log(r.Context()).Warn("Rejected unsubscribe request with an invalid token", zap.Strings("addresses", addresses))
+		writeUnsubscribePage(w, http.StatusBadRequest, unsubscribePageData{Title: "Unsubscribe failed", Message: "This unsubscribe link is invalid. Please use the link from the email you received."})
+		return
+	}
+
+	for _, address := range addresses {
+		if _, err := s.suppressions.Get(address); err == nil {
+			continue
+		} else if !errors.Is(err, suppression.ErrNotSuppressed) {
+			s.log(r.Context()).Error("Failed to unsubscribe address", zap.String("address", address), zap.Error(err))
+			writeUnsubscribePage(w, http.StatusInternalServerError, unsubscribePageData{Title: "Unsubscribe failed", Message: "Your request could not be completed. Please try again later."})
+			return
+		}
+		if _, err := s.suppressions.Add(suppression.Entry{Address: address, Reason: suppression.ReasonUnsubscribed, Note: "unsubscribe link"}); err != nil {
+			s.log(r.Context()).Error("Failed to unsubscribe address", zap.String("address", address), zap.Error(err))
+			if errors.Is(err, suppression.ErrInvalidEntry) {
+				writeUnsubscribePage(w, http.StatusBadRequest, unsubscribePageData{Title: "Unsubscribe failed", Message: "This unsubscribe link is invalid. Please use the link from the email you received."})
+				return
+			}
+			writeUnsubscribePage(w, http.StatusInternalServerError, unsubscribePageData{Title: "Unsubscribe failed", Message: "Your request could not be completed. Please try again later."})
+			return
+		}
+	}
+	s.log(r.Context()).Info("Addresses unsubscribed", zap.Strings("addresses", addresses), zap.Bool("one_click", r.Form.Get("List-Unsubscribe") == "One-Click"))
+	writeUnsubscribePage(w, http.StatusOK, unsubscribePageData{Title: "You have been unsubscribed", Message: "You will no longer receive emails from us at:", Addresses: addresses})
+}
+
+func writeUnsubscribePage(w http.ResponseWriter, status int, data unsubscribePageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = unsubscribePage.Execute(w, data)
+}
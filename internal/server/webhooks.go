@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+	"runebird/internal/webhook"
+)
+
+// handleWebhooks lists the webhook subscriptions or registers a new one. The secret of a
+// subscription is only returned when it is registered.
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		subs, err := s.webhooks.List()
+		if err != nil {
+			s.log(r.Context()).Error("Failed to list webhook subscriptions", zap.Error(err))
+			httpError(w, fmt.Sprintf("Failed to list webhook subscriptions: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for i := range subs {
+			subs[i].Secret = ""
+		}
+		writeJSON(w, http.StatusOK, ListWebhooksResponse{Webhooks: subs})
+	case http.MethodPost:
+		var req WebhookRequest
+		if err := s.decodeJSON(w, r, &req); err != nil {
+			s.log(r.Context()).Error("Failed to decode webhook request body", zap.Error(err))
+			writeBodyError(w, err)
+			return
+		}
+		sub, err := s.webhooks.Create(webhook.Subscription{URL: req.URL, Events: req.Events, Secret: req.Secret, Description: req.Description})
+		if s.checkWebhookError(w, r, "", err) {
+			return
+		}
+		s.log(r.Context()).Info("Webhook subscription created", zap.String("id", sub.ID), zap.String("url", sub.URL), zap.Strings("events", sub.Events))
+		writeJSON(w, http.StatusCreated, sub)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWebhook returns, updates or deletes a webhook subscription.
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		sub, err := s.webhooks.Get(id)
+		if s.checkWebhookError(w, r, id, err) {
+			return
+		}
+		sub.Secret = ""
+		writeJSON(w, http.StatusOK, sub)
+	case http.MethodPut:
+		var req WebhookRequest
+		if err := s.decodeJSON(w, r, &req); err != nil {
+			s.log(r.Context()).Error("Failed to decode webhook request body", zap.String("id", id), zap.Error(err))
+			writeBodyError(w, err)
+			return
+		}
+		sub, err := s.webhooks.Update(id, webhook.Subscription{URL: req.URL, Events: req.Events, Secret: req.Secret, Description: req.Description})
+		if s.checkWebhookError(w, r, id, err) {
+			return
+		}
+		s.log(r.Context()).Info("Webhook subscription updated", zap.String("id", id), zap.String("url", sub.URL), zap.Strings("events", sub.Events))
+		sub.Secret = ""
+		writeJSON(w, http.StatusOK, sub)
+	case http.MethodDelete:
+		if s.checkWebhookError(w, r, id, s.webhooks.Delete(id)) {
+			return
+		}
+		s.log(r.Context()).Info("Webhook subscription deleted", zap.String("id", id))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWebhookDeliveries reports the latest attempts to deliver events to a webhook
+// subscription, newest first.
+func (s *Server) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	attempts, err := s.webhooks.Attempts(id)
+	if s.checkWebhookError(w, r, id, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, WebhookDeliveriesResponse{ID: id, Deliveries: attempts})
+}
+
+// checkWebhookError answers a webhook request that failed with err, reporting whether it did.
+func (s *Server) checkWebhookError(w http.ResponseWriter, r *http.Request, id string, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, webhook.ErrSubscriptionNotFound):
+		httpError(w, "Webhook subscription not found", http.StatusNotFound)
+	case errors.Is(err, webhook.ErrInvalidSubscription):
+		httpError(w, err.Error(), http.StatusBadRequest)
+	default:
+		s.log(r.Context()).Error("Failed to manage webhook subscription", zap.String("id", id), zap.Error(err))
+		httpError(w, fmt.Sprintf("Failed to manage webhook subscription: %v", err), http.StatusInternalServerError)
+	}
+	return true
+}
@@ -0,0 +1,22 @@
+package sigv4
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	t.Run("DocumentationExample", func(t *testing.T) {
+		// The example request from the AWS Signature Version 4 documentation.
+		req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		creds := Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+		Sign(req, nil, creds, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("expected Authorization %q, got %q", want, got)
+		}
+	})
+}
@@ -0,0 +1,418 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"runebird/internal/rate"
+	"runebird/internal/suppression"
+	"runebird/internal/templates"
+)
+
+var (
+	queueBucket    = []byte("queue")
+	stateBucket    = []byte("state")
+	bucketKey      = []byte("bucket")
+	templateBucket = []byte("templates")
+	activeBucket   = []byte("active_templates")
+	suppressBucket = []byte("suppressions")
+)
+
+// Bolt stores deferred emails, rate limiter state, template versions and the suppression list
+// in a local BoltDB file
+// so that they survive restarts of a single RuneBird instance.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// NewBolt opens the BoltDB file at path, creating it and its directory if needed.
+func NewBolt(path string) (*Bolt, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for bolt database at %s: %v", path, err)
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database at %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{queueBucket, stateBucket, templateBucket, activeBucket, suppressBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize bolt database at %s: %v", path, err)
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+// Close closes the underlying database file.
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// Queue returns a rate.Queue backed by this database.
+func (b *Bolt) Queue() rate.Queue {
+	return &boltQueue{db: b.db}
+}
+
+// BucketStore returns a rate.BucketStore backed by this database.
+func (b *Bolt) BucketStore() rate.BucketStore {
+	return &boltBucketStore{db: b.db}
+}
+
+// Templates returns a templates.VersionStore backed by this database.
+func (b *Bolt) Templates() templates.VersionStore {
+	return &boltTemplateStore{db: b.db}
+}
+
+// Suppressions returns a suppression.Store backed by this database.
+func (b *Bolt) Suppressions() suppression.Store {
+	return &boltSuppressionStore{db: b.db}
+}
+
+// boltBucketStore keeps the latest token bucket snapshot under a single key.
+type boltBucketStore struct {
+	db *bolt.DB
+}
+
+func (s *boltBucketStore) Save(state rate.BucketState) error {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode bucket state: %v", err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put(bucketKey, payload)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store bucket state: %v", err)
+	}
+	return nil
+}
+
+func (s *boltBucketStore) Load() (rate.BucketState, bool, error) {
+	var payload []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(stateBucket).Get(bucketKey); v != nil {
+			payload = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return rate.BucketState{}, false, fmt.Errorf("failed to read bucket state: %v", err)
+	}
+	if payload == nil {
+		return rate.BucketState{}, false, nil
+	}
+	var state rate.BucketState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return rate.BucketState{}, false, fmt.Errorf("failed to decode bucket state: %v", err)
+	}
+	return state, true, nil
+}
+
+// boltQueue keys each email by its retry time followed by its ID, so that a cursor walks
+// the queue in retry order.
+type boltQueue struct {
+	db *bolt.DB
+}
+
+func queueKey(task rate.EmailTask) []byte {
+	key := make([]byte, 8, 8+len(task.ID))
+	binary.BigEndian.PutUint64(key, uint64(task.RetryAt.UnixNano()))
+	return append(key, task.ID...)
+}
+
+func (q *boltQueue) Push(task rate.EmailTask) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("failed to encode queued email %s: %v", task.ID, err)
+	}
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).Put(queueKey(task), payload)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store queued email %s: %v", task.ID, err)
+	}
+	return nil
+}
+
+func (q *boltQueue) PopReady(now time.Time) ([]rate.EmailTask, error) {
+	limit := make([]byte, 8)
+	binary.BigEndian.PutUint64(limit, uint64(now.UnixNano()))
+
+	var tasks []rate.EmailTask
+	var decodeErr error
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queueBucket)
+		var keys [][]byte
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, v = c.Next() {
+			keys = append(keys, k)
+			var task rate.EmailTask
+			if err := json.Unmarshal(v, &task); err != nil {
+				decodeErr = fmt.Errorf("failed to decode queued email: %v", err)
+				continue
+			}
+			tasks = append(tasks, task)
+		}
+		// Deleting while iterating can make the cursor skip entries, so delete afterwards.
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to pop queued emails: %v", err)
+	}
+	return tasks, decodeErr
+}
+
+func (q *boltQueue) PopOldest() (rate.EmailTask, bool, error) {
+	var task rate.EmailTask
+	var found bool
+	var decodeErr error
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queueBucket)
+		k, v := bucket.Cursor().First()
+		if k == nil {
+			return nil
+		}
+		found = true
+		if err := json.Unmarshal(v, &task); err != nil {
+			decodeErr = fmt.Errorf("failed to decode queued email: %v", err)
+		}
+		return bucket.Delete(k)
+	})
+	if err != nil {
+		return rate.EmailTask{}, false, fmt.Errorf("failed to pop oldest queued email: %v", err)
+	}
+	return task, found, decodeErr
+}
+
+func (q *boltQueue) Persistent() bool {
+	return true
+}
+
+func (q *boltQueue) Len() (int, error) {
+	var n int
+	err := q.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(queueBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count queued emails: %v", err)
+	}
+	return n, nil
+}
+
+// boltTemplateStore keeps the versions of each template in a nested bucket named after the
+// template, keyed by version number, and the active version of each template in a bucket of
+// its own.
+type boltTemplateStore struct {
+	db *bolt.DB
+}
+
+func versionKey(version int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	return key
+}
+
+func (s *boltTemplateStore) Add(name, content string, now time.Time) (templates.Version, error) {
+	var v templates.Version
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		versions, err := tx.Bucket(templateBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		seq, err := versions.NextSequence()
+		if err != nil {
+			return err
+		}
+		v = templates.Version{Name: name, Version: int(seq), Content: content, CreatedAt: now}
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := versions.Put(versionKey(v.Version), payload); err != nil {
+			return err
+		}
+		return tx.Bucket(activeBucket).Put([]byte(name), versionKey(v.Version))
+	})
+	if err != nil {
+		return templates.Version{}, fmt.Errorf("failed to store template %s: %v", name, err)
+	}
+	v.Active = true
+	return v, nil
+}
+
+func (s *boltTemplateStore) Versions(name string) ([]templates.Version, error) {
+	var list []templates.Version
+	err := s.db.View(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(templateBucket).Bucket([]byte(name))
+		if versions == nil {
+			return nil
+		}
+		active := tx.Bucket(activeBucket).Get([]byte(name))
+		return versions.ForEach(func(k, payload []byte) error {
+			var v templates.Version
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return fmt.Errorf("failed to decode version: %v", err)
+			}
+			v.Active = bytes.Equal(k, active)
+			list = append(list, v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read versions of template %s: %v", name, err)
+	}
+	return list, nil
+}
+
+func (s *boltTemplateStore) Activate(name string, version int) error {
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(templateBucket).Bucket([]byte(name))
+		if versions == nil || versions.Get(versionKey(version)) == nil {
+			return nil
+		}
+		found = true
+		return tx.Bucket(activeBucket).Put([]byte(name), versionKey(version))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to activate version %d of template %s: %v", version, name, err)
+	}
+	if !found {
+		return templates.ErrVersionNotFound
+	}
+	return nil
+}
+
+func (s *boltTemplateStore) Active() ([]templates.Version, error) {
+	var list []templates.Version
+	err := s.db.View(func(tx *bolt.Tx) error {
+		all := tx.Bucket(templateBucket)
+		return tx.Bucket(activeBucket).ForEach(func(name, version []byte) error {
+			versions := all.Bucket(name)
+			if versions == nil {
+				return nil
+			}
+			payload := versions.Get(version)
+			if payload == nil {
+				return nil
+			}
+			var v templates.Version
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return fmt.Errorf("failed to decode active version of template %s: %v", name, err)
+			}
+			v.Active = true
+			list = append(list, v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read active templates: %v", err)
+	}
+	return list, nil
+}
+
+func (s *boltTemplateStore) Delete(name string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(templateBucket).DeleteBucket([]byte(name)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		return tx.Bucket(activeBucket).Delete([]byte(name))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete template %s: %v", name, err)
+	}
+	return nil
+}
+
+// boltSuppressionStore keeps the suppression list keyed by address.
+type boltSuppressionStore struct {
+	db *bolt.DB
+}
+
+func (s *boltSuppressionStore) List() ([]suppression.Entry, error) {
+	var entries []suppression.Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(suppressBucket).ForEach(func(address, payload []byte) error {
+			var entry suppression.Entry
+			if err := json.Unmarshal(payload, &entry); err != nil {
+				return fmt.Errorf("failed to decode suppressed address %s: %v", address, err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read suppressed addresses: %v", err)
+	}
+	return entries, nil
+}
+
+func (s *boltSuppressionStore) Get(address string) (suppression.Entry, bool, error) {
+	var payload []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(suppressBucket).Get([]byte(address)); v != nil {
+			payload = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return suppression.Entry{}, false, fmt.Errorf("failed to load suppressed address %s: %v", address, err)
+	}
+	if payload == nil {
+		return suppression.Entry{}, false, nil
+	}
+	var entry suppression.Entry
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return suppression.Entry{}, false, fmt.Errorf("failed to decode suppressed address %s: %v", address, err)
+	}
+	return entry, true, nil
+}
+
+func (s *boltSuppressionStore) Save(entry suppression.Entry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode suppressed address %s: %v", entry.Address, err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(suppressBucket).Put([]byte(entry.Address), payload)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save suppressed address %s: %v", entry.Address, err)
+	}
+	return nil
+}
+
+func (s *boltSuppressionStore) Delete(address string) (bool, error) {
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(suppressBucket)
+		found = b.Get([]byte(address)) != nil
+		return b.Delete([]byte(address))
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete suppressed address %s: %v", address, err)
+	}
+	return found, nil
+}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"runebird/internal/rate"
+	"runebird/internal/suppression"
+	"runebird/internal/templates"
+)
+
+func TestBolt(t *testing.T) {
+	t.Run("QueuePushPopReady", func(t *testing.T) {
+		bs, err := NewBolt(filepath.Join(t.TempDir(), "queue.db"))
+		if err != nil {
+			t.Fatalf("failed to open bolt store: %v", err)
+		}
+		defer func() {
+			_ = bs.Close()
+		}()
+
+		queue := bs.Queue()
+		now := time.Now()
+		for _, task := range []rate.EmailTask{
+			{ID: "waiting", Recipients: []string{"b@example.com"}, RetryAt: now.Add(time.Minute)},
+			{ID: "later", Recipients: []string{"a@example.com"}, RetryAt: now.Add(-time.Second)},
+			{ID: "earlier", Recipients: []string{"a@example.com"}, RetryAt: now.Add(-time.Minute)},
+		} {
+			if err := queue.Push(task); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		ready, err := queue.PopReady(now)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(ready) != 2 || ready[0].ID != "earlier" || ready[1].ID != "later" {
+			t.Errorf("expected ready tasks in retry order, got: %+v", ready)
+		}
+		if n, err := queue.Len(); err != nil || n != 1 {
+			t.Errorf("expected queue length 1 after pop, got: %d (err=%v)", n, err)
+		}
+	})
+
+	t.Run("QueuePopOldest", func(t *testing.T) {
+		bs, err := NewBolt(filepath.Join(t.TempDir(), "queue.db"))
+		if err != nil {
+			t.Fatalf("failed to open bolt store: %v", err)
+		}
+		defer func() {
+			_ = bs.Close()
+		}()
+
+		queue := bs.Queue()
+		if _, ok, err := queue.PopOldest(); err != nil || ok {
+			t.Errorf("expected nothing to pop from an empty queue, got ok=%v (err=%v)", ok, err)
+		}
+		now := time.Now()
+		for _, task := range []rate.EmailTask{
+			{ID: "newer", RetryAt: now.Add(time.Minute)},
+			{ID: "older", RetryAt: now.Add(time.Second)},
+		} {
+			if err := queue.Push(task); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		task, ok, err := queue.PopOldest()
+		if err != nil || !ok || task.ID != "older" {
+			t.Errorf("expected to pop the oldest task, got: %+v (ok=%v, err=%v)", task, ok, err)
+		}
+		if n, err := queue.Len(); err != nil || n != 1 {
+			t.Errorf("expected queue length 1 after pop, got: %d (err=%v)", n, err)
+		}
+	})
+
+	t.Run("BucketStateSaveLoad", func(t *testing.T) {
+		bs, err := NewBolt(filepath.Join(t.TempDir(), "state.db"))
+		if err != nil {
+			t.Fatalf("failed to open bolt store: %v", err)
+		}
+		defer func() {
+			_ = bs.Close()
+		}()
+
+		states := bs.BucketStore()
+		if _, ok, err := states.Load(); err != nil || ok {
+			t.Errorf("expected no bucket state before the first save, got ok=%v (err=%v)", ok, err)
+		}
+		saved := rate.BucketState{Tokens: 1.5, At: time.Now().UTC().Truncate(time.Second)}
+		if err := states.Save(saved); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		loaded, ok, err := states.Load()
+		if err != nil || !ok || loaded.Tokens != saved.Tokens || !loaded.At.Equal(saved.At) {
+			t.Errorf("expected saved bucket state %+v, got: %+v (ok=%v, err=%v)", saved, loaded, ok, err)
+		}
+	})
+
+	t.Run("QueueSurvivesReopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "queue.db")
+		bs, err := NewBolt(path)
+		if err != nil {
+			t.Fatalf("failed to open bolt store: %v", err)
+		}
+		task := rate.EmailTask{ID: "queued-1", Recipients: []string{"a@example.com"}, Subject: "Hi", Body: "<p>Hi</p>", Priority: rate.PriorityHigh, RetryAt: time.Now().Add(-time.Second)}
+		if err := bs.Queue().Push(task); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := bs.Close(); err != nil {
+			t.Fatalf("failed to close bolt store: %v", err)
+		}
+
+		bs, err = NewBolt(path)
+		if err != nil {
+			t.Fatalf("failed to reopen bolt store: %v", err)
+		}
+		defer func() {
+			_ = bs.Close()
+		}()
+
+		ready, err := bs.Queue().PopReady(time.Now())
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(ready) != 1 || ready[0].ID != task.ID || ready[0].Subject != task.Subject || ready[0].Priority != task.Priority {
+			t.Errorf("expected queued email to survive a restart, got: %+v", ready)
+		}
+	})
+
+	t.Run("SuppressionsSurviveReopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "suppressions.db")
+		bs, err := NewBolt(path)
+		if err != nil {
+			t.Fatalf("failed to open bolt store: %v", err)
+		}
+		if err := bs.Suppressions().Save(suppression.Entry{Address: "bounced@example.com", Reason: suppression.ReasonBounced}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := bs.Close(); err != nil {
+			t.Fatalf("failed to close bolt store: %v", err)
+		}
+
+		bs, err = NewBolt(path)
+		if err != nil {
+			t.Fatalf("failed to reopen bolt store: %v", err)
+		}
+		defer func() {
+			_ = bs.Close()
+		}()
+
+		store := bs.Suppressions()
+		if entry, ok, err := store.Get("bounced@example.com"); err != nil || !ok || entry.Reason != suppression.ReasonBounced {
+			t.Fatalf("expected the entry to survive a restart, got: %+v (ok=%v err=%v)", entry, ok, err)
+		}
+		if entries, err := store.List(); err != nil || len(entries) != 1 {
+			t.Errorf("expected one entry, got: %+v (%v)", entries, err)
+		}
+		if ok, err := store.Delete("bounced@example.com"); !ok || err != nil {
+			t.Errorf("expected the entry to be deleted, got ok=%v err=%v", ok, err)
+		}
+		if ok, _ := store.Delete("bounced@example.com"); ok {
+			t.Error("expected no entry after it was deleted")
+		}
+	})
+
+	t.Run("TemplateVersions", func(t *testing.T) {
+		bs, err := NewBolt(filepath.Join(t.TempDir(), "templates.db"))
+		if err != nil {
+			t.Fatalf("failed to open bolt store: %v", err)
+		}
+		defer func() {
+			_ = bs.Close()
+		}()
+
+		store := bs.Templates()
+		if _, err := store.Add("welcome", "<p>One</p>", time.Now()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		v, err := store.Add("welcome", "<p>Two</p>", time.Now())
+		if err != nil || v.Version != 2 || !v.Active {
+			t.Fatalf("expected version 2 to be added and active, got: %+v, %v", v, err)
+		}
+		if _, err := store.Add("active", "<p>Other</p>", time.Now()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		if err := store.Activate("welcome", 1); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := store.Activate("welcome", 3); !errors.Is(err, templates.ErrVersionNotFound) {
+			t.Errorf("expected ErrVersionNotFound, got: %v", err)
+		}
+		versions, err := store.Versions("welcome")
+		if err != nil || len(versions) != 2 || versions[0].Content != "<p>One</p>" || !versions[0].Active || versions[1].Active {
+			t.Errorf("expected two versions with the first active, got: %+v, %v", versions, err)
+		}
+		active, err := store.Active()
+		if err != nil || len(active) != 2 {
+			t.Fatalf("expected an active version of both templates, got: %+v, %v", active, err)
+		}
+		for _, v := range active {
+			if v.Name == "welcome" && v.Version != 1 {
+				t.Errorf("expected version 1 of welcome to be active, got: %+v", v)
+			}
+		}
+
+		if err := store.Delete("welcome"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if versions, err := store.Versions("welcome"); err != nil || len(versions) != 0 {
+			t.Errorf("expected no versions after delete, got: %+v, %v", versions, err)
+		}
+		if active, err := store.Active(); err != nil || len(active) != 1 || active[0].Name != "active" {
+			t.Errorf("expected only the other template to stay active, got: %+v, %v", active, err)
+		}
+	})
+}
@@ -0,0 +1,933 @@
+// Package store provides storage backends for scheduled tasks, deferred emails, message
+// records, webhook subscriptions and the suppression list. Redis lets several RuneBird instances
+// work from the same data without duplicating sends, and BoltDB keeps a single instance's
+// deferred emails and suppression list on local disk.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"runebird/internal/config"
+	"runebird/internal/messages"
+	"runebird/internal/rate"
+	"runebird/internal/scheduler"
+	"runebird/internal/suppression"
+	"runebird/internal/templates"
+	"runebird/internal/webhook"
+)
+
+// addScript inserts a member into a sorted set and stores its payload, refusing duplicates.
+var addScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 or redis.call('ZADD', KEYS[1], 'NX', ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[3])
+return 1
+`)
+
+// updateScript rescores an existing member and replaces its payload, refusing unknown members.
+var updateScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('SET', KEYS[2], ARGV[3])
+return 1
+`)
+
+// requeueScript adds a member back to the sorted set and stores its payload without expiry.
+var requeueScript = redis.NewScript(`
+if redis.call('ZADD', KEYS[1], 'NX', ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[3])
+return 1
+`)
+
+// saveScript stores the payload of an entry that is not a member of the sorted set,
+// expiring it after ARGV[2] milliseconds.
+var saveScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[3], 'PX', ARGV[2])
+return 1
+`)
+
+// removeScript deletes a member from a sorted set. Its payload is kept for ARGV[2]
+// milliseconds, or deleted immediately if that is not positive.
+var removeScript = redis.NewScript(`
+local removed = redis.call('ZREM', KEYS[1], ARGV[1])
+if removed == 1 then
+	if tonumber(ARGV[2]) > 0 then
+		redis.call('PEXPIRE', KEYS[2], ARGV[2])
+	else
+		redis.call('DEL', KEYS[2])
+	end
+end
+return removed
+`)
+
+// claimScript removes every member scored up to ARGV[1] and returns their payloads, which
+// are kept for ARGV[3] milliseconds or deleted if that is not positive. Running it as a
+// script guarantees each member is claimed by exactly one caller.
+var claimScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local out = {}
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+	local key = ARGV[2] .. id
+	local payload = redis.call('GET', key)
+	if payload then
+		table.insert(out, payload)
+		if tonumber(ARGV[3]) > 0 then
+			redis.call('PEXPIRE', key, ARGV[3])
+		else
+			redis.call('DEL', key)
+		end
+	end
+end
+return out
+`)
+
+// popFirstScript removes the lowest scored member of a sorted set and returns its payload,
+// deleting the payload key.
+var popFirstScript = redis.NewScript(`
+local popped = redis.call('ZPOPMIN', KEYS[1])
+if #popped == 0 then
+	return false
+end
+local key = ARGV[1] .. popped[1]
+local payload = redis.call('GET', key)
+redis.call('DEL', key)
+return payload
+`)
+
+// takeScript implements a token bucket stored in a hash with the current token count and the
+// time it was last refilled. ARGV holds the refill rate in tokens per millisecond, the bucket
+// capacity, the current time in milliseconds and the number of tokens to take. It returns
+// whether the tokens were taken and, if not, how many milliseconds until they are available.
+// More tokens than the capacity are taken once the bucket is full, leaving the count negative.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+local ts = tonumber(redis.call('HGET', KEYS[1], 'ts'))
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate)
+	ts = now
+end
+local taken = 0
+local wait = 0
+local need = math.min(cost, burst)
+if tokens >= need then
+	tokens = tokens - cost
+	taken = 1
+else
+	wait = math.ceil((need - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+return {taken, wait}
+`)
+
+// addVersionScript stores ARGV[2] as the next version of template ARGV[1] in the hash KEYS[1]
+// and records it as the active version in the hash KEYS[2], returning the version number.
+var addVersionScript = redis.NewScript(`
+local version = redis.call('HLEN', KEYS[1]) + 1
+redis.call('HSET', KEYS[1], version, ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[1], version)
+return version
+`)
+
+// activateVersionScript records version ARGV[2] of template ARGV[1] as the active one, refusing
+// versions missing from the hash KEYS[1].
+var activateVersionScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// Redis stores scheduled tasks and deferred emails in Redis sorted sets keyed by send time.
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis connects to the Redis server described by cfg and verifies the connection.
+func NewRedis(cfg *config.RedisConfig) (*Redis, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to redis at %s: %v", cfg.Addr, err)
+	}
+
+	return &Redis{
+		client: client,
+		prefix: cfg.KeyPrefix,
+	}, nil
+}
+
+// Close closes the underlying Redis connection pool.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// Tasks returns a scheduler.Store backed by this Redis connection. Records of tasks that are
+// no longer pending expire after the given retention period.
+func (r *Redis) Tasks(retention time.Duration) scheduler.Store {
+	return &redisTaskStore{sortedSet{client: r.client, key: r.prefix + ":scheduled", retention: retention}}
+}
+
+// Queue returns a rate.Queue backed by this Redis connection.
+func (r *Redis) Queue() rate.Queue {
+	return &redisQueue{sortedSet{client: r.client, key: r.prefix + ":queue"}}
+}
+
+// Messages returns a messages.Store backed by this Redis connection. Records expire after the
+// given retention period.
+func (r *Redis) Messages(retention time.Duration) messages.Store {
+	return &redisMessageStore{client: r.client, key: r.prefix + ":messages", retention: retention}
+}
+
+// Webhooks returns a webhook.SubscriptionStore shared by every instance using this Redis
+// connection.
+func (r *Redis) Webhooks() webhook.SubscriptionStore {
+	return &redisSubscriptionStore{client: r.client, key: r.prefix + ":webhooks"}
+}
+
+// Suppressions returns a suppression.Store shared by every instance using this Redis
+// connection.
+func (r *Redis) Suppressions() suppression.Store {
+	return &redisSuppressionStore{client: r.client, key: r.prefix + ":suppressions"}
+}
+
+// Bucket returns a rate.Bucket whose tokens are shared by every instance using this Redis
+// connection, refilling at cfg.PerHour tokens per hour up to cfg.Burst tokens.
+func (r *Redis) Bucket(cfg *config.RateLimitConfig) rate.Bucket {
+	return r.bucket(r.prefix+":ratelimit", cfg)
+}
+
+// ProfileBucket returns a rate.Bucket like Bucket for the emails of the delivery profile
+// named profile, with tokens of its own.
+func (r *Redis) ProfileBucket(profile string, cfg *config.RateLimitConfig) rate.Bucket {
+	return r.bucket(r.prefix+":ratelimit:profile:"+profile, cfg)
+}
+
+func (r *Redis) bucket(key string, cfg *config.RateLimitConfig) rate.Bucket {
+	return &redisBucket{
+		client: r.client,
+		key:    key,
+		rate:   float64(cfg.PerHour) / float64(time.Hour.Milliseconds()),
+		burst:  cfg.Burst,
+	}
+}
+
+// Templates returns a templates.VersionStore shared by every instance using this Redis
+// connection.
+func (r *Redis) Templates() templates.VersionStore {
+	return &redisTemplateStore{client: r.client, key: r.prefix + ":templates"}
+}
+
+// sortedSet pairs a sorted set of IDs with per-ID JSON payload keys. Payloads of entries
+// leaving the set are kept for retention, or deleted right away if it is zero.
+type sortedSet struct {
+	client    *redis.Client
+	key       string
+	retention time.Duration
+}
+
+func (z sortedSet) payloadKey(id string) string {
+	return z.key + ":" + id
+}
+
+func (z sortedSet) add(id string, at time.Time, value interface{}) (bool, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode %s: %v", id, err)
+	}
+	added, err := addScript.Run(context.Background(), z.client, []string{z.key, z.payloadKey(id)}, at.UnixMilli(), id, payload).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to store %s: %v", id, err)
+	}
+	return added == 1, nil
+}
+
+func (z sortedSet) requeue(id string, at time.Time, value interface{}) (bool, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode %s: %v", id, err)
+	}
+	added, err := requeueScript.Run(context.Background(), z.client, []string{z.key, z.payloadKey(id)}, at.UnixMilli(), id, payload).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to requeue %s: %v", id, err)
+	}
+	return added == 1, nil
+}
+
+func (z sortedSet) update(id string, at time.Time, value interface{}) (bool, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode %s: %v", id, err)
+	}
+	updated, err := updateScript.Run(context.Background(), z.client, []string{z.key, z.payloadKey(id)}, at.UnixMilli(), id, payload).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to update %s: %v", id, err)
+	}
+	return updated == 1, nil
+}
+
+func (z sortedSet) save(id string, value interface{}) (bool, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode %s: %v", id, err)
+	}
+	saved, err := saveScript.Run(context.Background(), z.client, []string{z.key, z.payloadKey(id)}, id, z.retention.Milliseconds(), payload).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to save %s: %v", id, err)
+	}
+	return saved == 1, nil
+}
+
+func (z sortedSet) get(id string, value interface{}) (bool, error) {
+	payload, err := z.client.Get(context.Background(), z.payloadKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load %s: %v", id, err)
+	}
+	if err := json.Unmarshal(payload, value); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %v", id, err)
+	}
+	return true, nil
+}
+
+func (z sortedSet) remove(id string) (bool, error) {
+	removed, err := removeScript.Run(context.Background(), z.client, []string{z.key, z.payloadKey(id)}, id, z.retention.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove %s: %v", id, err)
+	}
+	return removed == 1, nil
+}
+
+// list returns the payloads scored within [min, max], ordered by score.
+func (z sortedSet) list(min, max string) ([]string, error) {
+	ctx := context.Background()
+	ids, err := z.client.ZRangeByScore(ctx, z.key, &redis.ZRangeBy{Min: min, Max: max}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list entries from %s: %v", z.key, err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = z.payloadKey(id)
+	}
+	values, err := z.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load entries from %s: %v", z.key, err)
+	}
+
+	payloads := make([]string, 0, len(values))
+	for _, value := range values {
+		// Entries claimed between the two calls come back as nil and are skipped.
+		if payload, ok := value.(string); ok {
+			payloads = append(payloads, payload)
+		}
+	}
+	return payloads, nil
+}
+
+// first returns the lowest score in the set, or false if the set is empty.
+func (z sortedSet) first() (int64, bool, error) {
+	entries, err := z.client.ZRangeWithScores(context.Background(), z.key, 0, 0).Result()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read first entry from %s: %v", z.key, err)
+	}
+	if len(entries) == 0 {
+		return 0, false, nil
+	}
+	return int64(entries[0].Score), true, nil
+}
+
+// claim pops every payload scored at or before max, which may be an exclusive bound such as "(123".
+func (z sortedSet) claim(max string) ([]string, error) {
+	payloads, err := claimScript.Run(context.Background(), z.client, []string{z.key}, max, z.key+":", z.retention.Milliseconds()).StringSlice()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to claim entries from %s: %v", z.key, err)
+	}
+	return payloads, nil
+}
+
+// popFirst removes the lowest scored entry and decodes its payload into value, reporting
+// whether the set had an entry.
+func (z sortedSet) popFirst(value interface{}) (bool, error) {
+	payload, err := popFirstScript.Run(context.Background(), z.client, []string{z.key}, z.key+":").Text()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to pop first entry from %s: %v", z.key, err)
+	}
+	if err := json.Unmarshal([]byte(payload), value); err != nil {
+		return true, fmt.Errorf("failed to decode first entry from %s: %v", z.key, err)
+	}
+	return true, nil
+}
+
+type redisTaskStore struct {
+	set sortedSet
+}
+
+func (s *redisTaskStore) Add(task scheduler.ScheduledTask) error {
+	added, err := s.set.add(task.ID, task.SendAt, task)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return fmt.Errorf("task with ID %s already exists", task.ID)
+	}
+	return nil
+}
+
+func (s *redisTaskStore) Update(task scheduler.ScheduledTask) error {
+	updated, err := s.set.update(task.ID, task.SendAt, task)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return scheduler.ErrTaskNotFound
+	}
+	return nil
+}
+
+func (s *redisTaskStore) Get(id string) (scheduler.ScheduledTask, bool, error) {
+	var task scheduler.ScheduledTask
+	ok, err := s.set.get(id, &task)
+	return task, ok, err
+}
+
+func (s *redisTaskStore) Requeue(task scheduler.ScheduledTask) error {
+	added, err := s.set.requeue(task.ID, task.SendAt, task)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return fmt.Errorf("task with ID %s is already pending", task.ID)
+	}
+	return nil
+}
+
+func (s *redisTaskStore) Remove(id string) (bool, error) {
+	return s.set.remove(id)
+}
+
+func (s *redisTaskStore) SaveStatus(task scheduler.ScheduledTask) error {
+	saved, err := s.set.save(task.ID, task)
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return fmt.Errorf("task with ID %s is still pending", task.ID)
+	}
+	return nil
+}
+
+func (s *redisTaskStore) List(from, to time.Time) ([]scheduler.ScheduledTask, error) {
+	min, max := "-inf", "+inf"
+	if !from.IsZero() {
+		min = strconv.FormatInt(from.UnixMilli(), 10)
+	}
+	if !to.IsZero() {
+		max = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	payloads, err := s.set.list(min, max)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTasks(payloads)
+}
+
+func (s *redisTaskStore) NextDue() (time.Time, bool, error) {
+	ms, ok, err := s.set.first()
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	return time.UnixMilli(ms).UTC(), true, nil
+}
+
+func (s *redisTaskStore) Len() (int, error) {
+	n, err := s.set.client.ZCard(context.Background(), s.set.key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count scheduled tasks: %v", err)
+	}
+	return int(n), nil
+}
+
+func (s *redisTaskStore) ClaimDue(now time.Time) ([]scheduler.ScheduledTask, error) {
+	payloads, err := s.set.claim(strconv.FormatInt(now.UnixMilli(), 10))
+	if err != nil {
+		return nil, err
+	}
+	return decodeTasks(payloads)
+}
+
+func decodeTasks(payloads []string) ([]scheduler.ScheduledTask, error) {
+	tasks := make([]scheduler.ScheduledTask, 0, len(payloads))
+	var decodeErr error
+	for _, payload := range payloads {
+		var task scheduler.ScheduledTask
+		if err := json.Unmarshal([]byte(payload), &task); err != nil {
+			decodeErr = fmt.Errorf("failed to decode scheduled task: %v", err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, decodeErr
+}
+
+type redisMessageStore struct {
+	client    *redis.Client
+	key       string
+	retention time.Duration
+}
+
+func (s *redisMessageStore) Get(id string) (messages.Message, bool, error) {
+	var msg messages.Message
+	payload, err := s.client.Get(context.Background(), s.key+":"+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return msg, false, nil
+	}
+	if err != nil {
+		return msg, false, fmt.Errorf("failed to load message %s: %v", id, err)
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return msg, false, fmt.Errorf("failed to decode message %s: %v", id, err)
+	}
+	return msg, true, nil
+}
+
+func (s *redisMessageStore) Save(msg messages.Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message %s: %v", msg.ID, err)
+	}
+	if err := s.client.Set(context.Background(), s.key+":"+msg.ID, payload, s.retention).Err(); err != nil {
+		return fmt.Errorf("failed to save message %s: %v", msg.ID, err)
+	}
+	return nil
+}
+
+// Index keeps the ID of the message under the provider's ID for it, for the retention period like
+// the record itself.
+func (s *redisMessageStore) Index(messageID, id string) error {
+	if err := s.client.Set(context.Background(), s.key+":provider:"+messageID, id, s.retention).Err(); err != nil {
+		return fmt.Errorf("failed to index message %s: %v", id, err)
+	}
+	return nil
+}
+
+func (s *redisMessageStore) Lookup(messageID string) (string, bool, error) {
+	id, err := s.client.Get(context.Background(), s.key+":provider:"+messageID).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up message %s: %v", messageID, err)
+	}
+	return id, true, nil
+}
+
+// redisSubscriptionStore keeps webhook subscriptions in a hash keyed by subscription ID.
+type redisSubscriptionStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (s *redisSubscriptionStore) List() ([]webhook.Subscription, error) {
+	payloads, err := s.client.HGetAll(context.Background(), s.key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook subscriptions: %v", err)
+	}
+	subs := make([]webhook.Subscription, 0, len(payloads))
+	for id, payload := range payloads {
+		var sub webhook.Subscription
+		if err := json.Unmarshal([]byte(payload), &sub); err != nil {
+			return nil, fmt.Errorf("failed to decode webhook subscription %s: %v", id, err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (s *redisSubscriptionStore) Get(id string) (webhook.Subscription, bool, error) {
+	var sub webhook.Subscription
+	payload, err := s.client.HGet(context.Background(), s.key, id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return sub, false, nil
+	}
+	if err != nil {
+		return sub, false, fmt.Errorf("failed to load webhook subscription %s: %v", id, err)
+	}
+	if err := json.Unmarshal(payload, &sub); err != nil {
+		return sub, false, fmt.Errorf("failed to decode webhook subscription %s: %v", id, err)
+	}
+	return sub, true, nil
+}
+
+func (s *redisSubscriptionStore) Save(sub webhook.Subscription) error {
+	payload, err := json.Marshal(sub)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook subscription %s: %v", sub.ID, err)
+	}
+	if err := s.client.HSet(context.Background(), s.key, sub.ID, payload).Err(); err != nil {
+		return fmt.Errorf("failed to save webhook subscription %s: %v", sub.ID, err)
+	}
+	return nil
+}
+
+func (s *redisSubscriptionStore) Delete(id string) (bool, error) {
+	n, err := s.client.HDel(context.Background(), s.key, id).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook subscription %s: %v", id, err)
+	}
+	return n > 0, nil
+}
+
+// redisSuppressionStore keeps the suppression list in a hash keyed by address.
+type redisSuppressionStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (s *redisSuppressionStore) List() ([]suppression.Entry, error) {
+	payloads, err := s.client.HGetAll(context.Background(), s.key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read suppressed addresses: %v", err)
+	}
+	entries := make([]suppression.Entry, 0, len(payloads))
+	for address, payload := range payloads {
+		var entry suppression.Entry
+		if err := json.Unmarshal([]byte(payload), &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode suppressed address %s: %v", address, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *redisSuppressionStore) Get(address string) (suppression.Entry, bool, error) {
+	var entry suppression.Entry
+	payload, err := s.client.HGet(context.Background(), s.key, address).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, fmt.Errorf("failed to load suppressed address %s: %v", address, err)
+	}
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return entry, false, fmt.Errorf("failed to decode suppressed address %s: %v", address, err)
+	}
+	return entry, true, nil
+}
+
+func (s *redisSuppressionStore) Save(entry suppression.Entry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode suppressed address %s: %v", entry.Address, err)
+	}
+	if err := s.client.HSet(context.Background(), s.key, entry.Address, payload).Err(); err != nil {
+		return fmt.Errorf("failed to save suppressed address %s: %v", entry.Address, err)
+	}
+	return nil
+}
+
+func (s *redisSuppressionStore) Delete(address string) (bool, error) {
+	n, err := s.client.HDel(context.Background(), s.key, address).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete suppressed address %s: %v", address, err)
+	}
+	return n > 0, nil
+}
+
+type redisQueue struct {
+	set sortedSet
+}
+
+func (q *redisQueue) Push(task rate.EmailTask) error {
+	added, err := q.set.add(task.ID, task.RetryAt, task)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return fmt.Errorf("queued email with ID %s already exists", task.ID)
+	}
+	return nil
+}
+
+func (q *redisQueue) PopReady(now time.Time) ([]rate.EmailTask, error) {
+	payloads, err := q.set.claim("(" + strconv.FormatInt(now.UnixMilli(), 10))
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]rate.EmailTask, 0, len(payloads))
+	var decodeErr error
+	for _, payload := range payloads {
+		var task rate.EmailTask
+		if err := json.Unmarshal([]byte(payload), &task); err != nil {
+			decodeErr = fmt.Errorf("failed to decode queued email: %v", err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, decodeErr
+}
+
+func (q *redisQueue) PopOldest() (rate.EmailTask, bool, error) {
+	var task rate.EmailTask
+	ok, err := q.set.popFirst(&task)
+	return task, ok, err
+}
+
+func (q *redisQueue) Persistent() bool {
+	return true
+}
+
+func (q *redisQueue) Len() (int, error) {
+	n, err := q.set.client.ZCard(context.Background(), q.set.key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count queued emails: %v", err)
+	}
+	return int(n), nil
+}
+
+// redisTemplateStore keeps the versions of each template in a hash keyed by version number, and
+// the active version of every template in a hash keyed by template name. The version number is
+// not part of the stored payload.
+type redisTemplateStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (s *redisTemplateStore) versionsKey(name string) string {
+	return s.key + ":versions:" + name
+}
+
+func (s *redisTemplateStore) activeKey() string {
+	return s.key + ":active"
+}
+
+func (s *redisTemplateStore) Add(name, content string, now time.Time) (templates.Version, error) {
+	v := templates.Version{Name: name, Content: content, CreatedAt: now}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return templates.Version{}, fmt.Errorf("failed to encode template %s: %v", name, err)
+	}
+	version, err := addVersionScript.Run(context.Background(), s.client, []string{s.versionsKey(name), s.activeKey()}, name, payload).Int()
+	if err != nil {
+		return templates.Version{}, fmt.Errorf("failed to store template %s: %v", name, err)
+	}
+	v.Version = version
+	v.Active = true
+	return v, nil
+}
+
+func (s *redisTemplateStore) Versions(name string) ([]templates.Version, error) {
+	ctx := context.Background()
+	payloads, err := s.client.HGetAll(ctx, s.versionsKey(name)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read versions of template %s: %v", name, err)
+	}
+	active, err := s.client.HGet(ctx, s.activeKey(), name).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to read active version of template %s: %v", name, err)
+	}
+
+	versions := make([]templates.Version, 0, len(payloads))
+	for field, payload := range payloads {
+		v, err := decodeVersion(field, payload)
+		if err != nil {
+			return nil, err
+		}
+		v.Active = v.Version == active
+		versions = append(versions, v)
+	}
+	slices.SortFunc(versions, func(a, b templates.Version) int {
+		return a.Version - b.Version
+	})
+	return versions, nil
+}
+
+func (s *redisTemplateStore) Activate(name string, version int) error {
+	activated, err := activateVersionScript.Run(context.Background(), s.client, []string{s.versionsKey(name), s.activeKey()}, name, version).Int()
+	if err != nil {
+		return fmt.Errorf("failed to activate version %d of template %s: %v", version, name, err)
+	}
+	if activated == 0 {
+		return templates.ErrVersionNotFound
+	}
+	return nil
+}
+
+func (s *redisTemplateStore) Active() ([]templates.Version, error) {
+	ctx := context.Background()
+	active, err := s.client.HGetAll(ctx, s.activeKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read active templates: %v", err)
+	}
+
+	versions := make([]templates.Version, 0, len(active))
+	for name, field := range active {
+		payload, err := s.client.HGet(ctx, s.versionsKey(name), field).Result()
+		if errors.Is(err, redis.Nil) {
+			// The template was deleted after the active versions were read.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read active version of template %s: %v", name, err)
+		}
+		v, err := decodeVersion(field, payload)
+		if err != nil {
+			return nil, err
+		}
+		v.Active = true
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+func (s *redisTemplateStore) Delete(name string) error {
+	_, err := s.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Del(context.Background(), s.versionsKey(name))
+		pipe.HDel(context.Background(), s.activeKey(), name)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete template %s: %v", name, err)
+	}
+	return nil
+}
+
+// decodeVersion decodes a stored template version, whose number is the hash field it is kept in.
+func decodeVersion(field, payload string) (templates.Version, error) {
+	var v templates.Version
+	if err := json.Unmarshal([]byte(payload), &v); err != nil {
+		return templates.Version{}, fmt.Errorf("failed to decode template version: %v", err)
+	}
+	version, err := strconv.Atoi(field)
+	if err != nil {
+		return templates.Version{}, fmt.Errorf("failed to decode template version number %q: %v", field, err)
+	}
+	v.Version = version
+	return v, nil
+}
+
+type redisBucket struct {
+	client *redis.Client
+	key    string
+	// mu guards rate and burst, which change when the limits are reloaded.
+	mu    sync.Mutex
+	rate  float64
+	burst int
+}
+
+// limits returns the refill rate, in tokens per millisecond, and the burst size.
+func (b *redisBucket) limits() (float64, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate, b.burst
+}
+
+// Resize changes the limits of this instance; every instance sharing the bucket should be
+// given the same ones.
+func (b *redisBucket) Resize(perHour, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(perHour) / float64(time.Hour.Milliseconds())
+	b.burst = burst
+}
+
+// take runs takeScript and returns whether n tokens were taken and otherwise how long until they are available.
+func (b *redisBucket) take(ctx context.Context, now time.Time, n int) (bool, time.Duration, error) {
+	perMilli, burst := b.limits()
+	result, err := takeScript.Run(ctx, b.client, []string{b.key}, perMilli, burst, now.UnixMilli(), n).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to take rate limit token: %v", err)
+	}
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit script result: %v", result)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+func (b *redisBucket) Take(now time.Time, n int) (bool, error) {
+	ok, _, err := b.take(context.Background(), now, n)
+	return ok, err
+}
+
+func (b *redisBucket) Wait(ctx context.Context, n int) error {
+	for {
+		ok, wait, err := b.take(ctx, time.Now(), n)
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (b *redisBucket) Tokens(now time.Time) (float64, error) {
+	perMilli, burst := b.limits()
+	values, err := b.client.HMGet(context.Background(), b.key, "tokens", "ts").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read rate limit tokens: %v", err)
+	}
+	tokensStr, ok1 := values[0].(string)
+	tsStr, ok2 := values[1].(string)
+	if !ok1 || !ok2 {
+		// The bucket has not been used yet, or expired after refilling completely.
+		return float64(burst), nil
+	}
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode rate limit tokens: %v", err)
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode rate limit timestamp: %v", err)
+	}
+	if elapsed := now.UnixMilli() - ts; elapsed > 0 {
+		tokens += float64(elapsed) * perMilli
+	}
+	return math.Min(float64(burst), tokens), nil
+}
@@ -0,0 +1,368 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"runebird/internal/config"
+	"runebird/internal/messages"
+	"runebird/internal/rate"
+	"runebird/internal/scheduler"
+	"runebird/internal/suppression"
+	"runebird/internal/templates"
+	"runebird/internal/webhook"
+)
+
+func setupTestRedis(t *testing.T) *Redis {
+	mr := miniredis.RunT(t)
+
+	rs, err := NewRedis(&config.RedisConfig{Addr: mr.Addr(), KeyPrefix: "runebird-test"})
+	if err != nil {
+		t.Fatalf("failed to create redis store: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = rs.Close()
+	})
+	return rs
+}
+
+func TestRedis(t *testing.T) {
+	t.Run("NewRedisUnreachable", func(t *testing.T) {
+		_, err := NewRedis(&config.RedisConfig{Addr: "127.0.0.1:1"})
+		if err == nil {
+			t.Fatal("expected error for unreachable redis, got none")
+		}
+	})
+
+	t.Run("TaskStoreAddGetRemove", func(t *testing.T) {
+		tasks := setupTestRedis(t).Tasks(time.Hour)
+		task := scheduler.ScheduledTask{
+			ID:         "sched-1",
+			Template:   "welcome",
+			Recipients: []string{"test@example.com"},
+			Data:       map[string]interface{}{"Name": "Alice"},
+			SendAt:     time.Now().UTC().Add(time.Hour).Truncate(time.Millisecond),
+		}
+
+		if err := tasks.Add(task); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := tasks.Add(task); err == nil {
+			t.Fatal("expected error for duplicate task ID, got none")
+		}
+
+		got, ok, err := tasks.Get(task.ID)
+		if err != nil || !ok {
+			t.Fatalf("expected task to be found, got ok=%v err=%v", ok, err)
+		}
+		if got.Template != task.Template || !got.SendAt.Equal(task.SendAt) {
+			t.Errorf("expected %+v, got: %+v", task, got)
+		}
+
+		task.SendAt = task.SendAt.Add(time.Hour)
+		if err := tasks.Update(task); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if got, _, _ := tasks.Get(task.ID); !got.SendAt.Equal(task.SendAt) {
+			t.Errorf("expected updated send time %v, got: %v", task.SendAt, got.SendAt)
+		}
+		if err := tasks.Update(scheduler.ScheduledTask{ID: "missing"}); !errors.Is(err, scheduler.ErrTaskNotFound) {
+			t.Errorf("expected ErrTaskNotFound, got: %v", err)
+		}
+
+		removed, err := tasks.Remove(task.ID)
+		if err != nil || !removed {
+			t.Fatalf("expected task to be removed, got removed=%v err=%v", removed, err)
+		}
+		if removed, _ := tasks.Remove(task.ID); removed {
+			t.Error("expected second Remove to report the task was no longer pending")
+		}
+		if pending, _ := tasks.List(time.Time{}, time.Time{}); len(pending) != 0 {
+			t.Errorf("expected no pending tasks after Remove, got: %d", len(pending))
+		}
+
+		task.Status = scheduler.StatusCancelled
+		if err := tasks.SaveStatus(task); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if got, ok, _ := tasks.Get(task.ID); !ok || got.Status != scheduler.StatusCancelled {
+			t.Errorf("expected cancelled record to be retained, got: %+v", got)
+		}
+	})
+
+	t.Run("TaskStoreClaimDue", func(t *testing.T) {
+		rs := setupTestRedis(t)
+		now := time.Now().UTC()
+		for _, task := range []scheduler.ScheduledTask{
+			{ID: "late", Template: "welcome", SendAt: now.Add(-time.Minute)},
+			{ID: "later", Template: "welcome", SendAt: now.Add(-2 * time.Minute)},
+			{ID: "future", Template: "welcome", SendAt: now.Add(time.Hour)},
+		} {
+			if err := rs.Tasks(time.Hour).Add(task); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+
+		listed, err := rs.Tasks(time.Hour).List(time.Time{}, now)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(listed) != 2 || listed[0].ID != "later" {
+			t.Errorf("expected List to return due tasks ordered by send time, got: %+v", listed)
+		}
+
+		next, ok, err := rs.Tasks(time.Hour).NextDue()
+		if err != nil || !ok || next.UnixMilli() != now.Add(-2*time.Minute).UnixMilli() {
+			t.Errorf("expected next due to be the earliest task, got: %v (ok=%v err=%v)", next, ok, err)
+		}
+		if n, err := rs.Tasks(time.Hour).Len(); err != nil || n != 3 {
+			t.Errorf("expected 3 pending tasks, got: %d (%v)", n, err)
+		}
+
+		// A second instance sharing the same Redis must not receive the same tasks.
+		first, err := rs.Tasks(time.Hour).ClaimDue(now)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		second, err := rs.Tasks(time.Hour).ClaimDue(now)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		if len(first) != 2 || first[0].ID != "later" || first[1].ID != "late" {
+			t.Errorf("expected due tasks ordered by send time, got: %+v", first)
+		}
+		if len(second) != 0 {
+			t.Errorf("expected no tasks on second claim, got: %d", len(second))
+		}
+		if _, ok, _ := rs.Tasks(time.Hour).Get("future"); !ok {
+			t.Error("expected future task to remain")
+		}
+
+		retry := first[0]
+		retry.SendAt = now.Add(time.Minute)
+		if err := rs.Tasks(time.Hour).Requeue(retry); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := rs.Tasks(time.Hour).Requeue(retry); err == nil {
+			t.Error("expected error when requeueing a pending task, got none")
+		}
+		if pending, _ := rs.Tasks(time.Hour).List(time.Time{}, time.Time{}); len(pending) != 2 || pending[0].ID != retry.ID {
+			t.Errorf("expected requeued task to be pending before the future task, got: %+v", pending)
+		}
+	})
+
+	t.Run("MessageStoreSaveGet", func(t *testing.T) {
+		store := setupTestRedis(t).Messages(time.Hour)
+		if _, ok, err := store.Get("msg-1"); ok || err != nil {
+			t.Fatalf("expected no message before it is saved, got ok=%v err=%v", ok, err)
+		}
+
+		msg := messages.Message{ID: "msg-1", Template: "welcome", Recipients: []string{"test@example.com"}, Status: messages.StatusSent}
+		if err := store.Save(msg); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		got, ok, err := store.Get("msg-1")
+		if err != nil || !ok {
+			t.Fatalf("expected message to be found, got ok=%v err=%v", ok, err)
+		}
+		if got.Status != messages.StatusSent || got.Template != "welcome" {
+			t.Errorf("expected %+v, got: %+v", msg, got)
+		}
+
+		if err := store.Index("provider-1", "msg-1"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if id, ok, err := store.Lookup("provider-1"); err != nil || !ok || id != "msg-1" {
+			t.Errorf("expected the provider's ID to lead to msg-1, got: %q ok=%v err=%v", id, ok, err)
+		}
+		if _, ok, err := store.Lookup("provider-2"); ok || err != nil {
+			t.Errorf("expected an unknown provider's ID not to be found, got ok=%v err=%v", ok, err)
+		}
+	})
+
+	t.Run("WebhookStore", func(t *testing.T) {
+		store := setupTestRedis(t).Webhooks()
+		sub := webhook.Subscription{ID: "wh-1", URL: "https://example.com/hooks", Events: []string{webhook.EventEmailSent}, Secret: "secret"}
+		if err := store.Save(sub); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		got, ok, err := store.Get("wh-1")
+		if err != nil || !ok || got.URL != sub.URL || got.Secret != "secret" {
+			t.Fatalf("expected %+v, got: %+v (ok=%v err=%v)", sub, got, ok, err)
+		}
+		if subs, err := store.List(); err != nil || len(subs) != 1 {
+			t.Errorf("expected one subscription, got: %+v (%v)", subs, err)
+		}
+		if ok, err := store.Delete("wh-1"); !ok || err != nil {
+			t.Errorf("expected the subscription to be deleted, got ok=%v err=%v", ok, err)
+		}
+		if _, ok, _ := store.Get("wh-1"); ok {
+			t.Error("expected no subscription after it was deleted")
+		}
+	})
+
+	t.Run("SuppressionStore", func(t *testing.T) {
+		store := setupTestRedis(t).Suppressions()
+		entry := suppression.Entry{Address: "bounced@example.com", Reason: suppression.ReasonBounced}
+		if err := store.Save(entry); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		got, ok, err := store.Get("bounced@example.com")
+		if err != nil || !ok || got.Reason != suppression.ReasonBounced {
+			t.Fatalf("expected %+v, got: %+v (ok=%v err=%v)", entry, got, ok, err)
+		}
+		if entries, err := store.List(); err != nil || len(entries) != 1 {
+			t.Errorf("expected one entry, got: %+v (%v)", entries, err)
+		}
+		if ok, err := store.Delete("bounced@example.com"); !ok || err != nil {
+			t.Errorf("expected the entry to be deleted, got ok=%v err=%v", ok, err)
+		}
+		if _, ok, _ := store.Get("bounced@example.com"); ok {
+			t.Error("expected no entry after it was deleted")
+		}
+	})
+
+	t.Run("QueuePushPopReady", func(t *testing.T) {
+		queue := setupTestRedis(t).Queue()
+		now := time.Now()
+		if err := queue.Push(rate.EmailTask{ID: "ready", Recipients: []string{"a@example.com"}, RetryAt: now.Add(-time.Second)}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := queue.Push(rate.EmailTask{ID: "waiting", Recipients: []string{"b@example.com"}, RetryAt: now.Add(time.Minute)}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		n, err := queue.Len()
+		if err != nil || n != 2 {
+			t.Fatalf("expected queue length 2, got: %d (err=%v)", n, err)
+		}
+
+		ready, err := queue.PopReady(now)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(ready) != 1 || ready[0].ID != "ready" {
+			t.Errorf("expected only the ready task, got: %+v", ready)
+		}
+
+		n, _ = queue.Len()
+		if n != 1 {
+			t.Errorf("expected queue length 1 after pop, got: %d", n)
+		}
+	})
+
+	t.Run("QueuePopOldest", func(t *testing.T) {
+		queue := setupTestRedis(t).Queue()
+		if _, ok, err := queue.PopOldest(); err != nil || ok {
+			t.Errorf("expected nothing to pop from an empty queue, got ok=%v (err=%v)", ok, err)
+		}
+		now := time.Now()
+		if err := queue.Push(rate.EmailTask{ID: "newer", RetryAt: now.Add(time.Minute)}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := queue.Push(rate.EmailTask{ID: "older", RetryAt: now.Add(time.Second)}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		task, ok, err := queue.PopOldest()
+		if err != nil || !ok || task.ID != "older" {
+			t.Errorf("expected to pop the oldest task, got: %+v (ok=%v, err=%v)", task, ok, err)
+		}
+		if n, _ := queue.Len(); n != 1 {
+			t.Errorf("expected queue length 1 after pop, got: %d", n)
+		}
+	})
+
+	t.Run("BucketSharedBetweenInstances", func(t *testing.T) {
+		rs := setupTestRedis(t)
+		cfg := &config.RateLimitConfig{PerHour: 3600, Burst: 2}
+		first, second := rs.Bucket(cfg), rs.Bucket(cfg)
+		now := time.Now()
+		if tokens, err := first.Tokens(now); err != nil || tokens != 2 {
+			t.Errorf("expected a full bucket before the first take, got: %g (err=%v)", tokens, err)
+		}
+
+		for i, bucket := range []rate.Bucket{first, second} {
+			ok, err := bucket.Take(now, 1)
+			if err != nil || !ok {
+				t.Fatalf("expected token %d to be available, got ok=%v err=%v", i+1, ok, err)
+			}
+		}
+		if ok, _ := first.Take(now, 1); ok {
+			t.Error("expected the shared burst to be exhausted")
+		}
+		if tokens, err := second.Tokens(now); err != nil || tokens >= 1 {
+			t.Errorf("expected no tokens left, got: %g (err=%v)", tokens, err)
+		}
+		// At 3600 per hour, one token is refilled every second.
+		if ok, _ := second.Take(now.Add(time.Second), 1); !ok {
+			t.Error("expected a token to be refilled after one second")
+		}
+
+		if ok, _ := second.Take(now.Add(time.Second), 2); ok {
+			t.Error("expected a two-token take to wait for the bucket to refill")
+		}
+		if ok, _ := second.Take(now.Add(3*time.Second), 2); !ok {
+			t.Error("expected a two-token take to succeed once two tokens are refilled")
+		}
+
+		// A delivery profile has tokens of its own.
+		if ok, _ := rs.ProfileBucket("marketing", cfg).Take(now.Add(3*time.Second), 2); !ok {
+			t.Error("expected the profile bucket to be full while the shared one is empty")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := first.Wait(ctx, 1); err == nil {
+			t.Error("expected Wait to give up when the context is done before a token is refilled")
+		}
+	})
+
+	t.Run("TemplateVersions", func(t *testing.T) {
+		store := setupTestRedis(t).Templates()
+		if _, err := store.Add("welcome", "<p>One</p>", time.Now()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		v, err := store.Add("welcome", "<p>Two</p>", time.Now())
+		if err != nil || v.Version != 2 || !v.Active {
+			t.Fatalf("expected version 2 to be added and active, got: %+v, %v", v, err)
+		}
+		if _, err := store.Add("active", "<p>Other</p>", time.Now()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		if err := store.Activate("welcome", 1); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := store.Activate("welcome", 3); !errors.Is(err, templates.ErrVersionNotFound) {
+			t.Errorf("expected ErrVersionNotFound, got: %v", err)
+		}
+		versions, err := store.Versions("welcome")
+		if err != nil || len(versions) != 2 || versions[0].Content != "<p>One</p>" || !versions[0].Active || versions[1].Active {
+			t.Errorf("expected two versions with the first active, got: %+v, %v", versions, err)
+		}
+		active, err := store.Active()
+		if err != nil || len(active) != 2 {
+			t.Fatalf("expected an active version of both templates, got: %+v, %v", active, err)
+		}
+		for _, v := range active {
+			if v.Name == "welcome" && v.Version != 1 {
+				t.Errorf("expected version 1 of welcome to be active, got: %+v", v)
+			}
+		}
+
+		if err := store.Delete("welcome"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if versions, err := store.Versions("welcome"); err != nil || len(versions) != 0 {
+			t.Errorf("expected no versions after delete, got: %+v, %v", versions, err)
+		}
+		if active, err := store.Active(); err != nil || len(active) != 1 || active[0].Name != "active" {
+			t.Errorf("expected only the other template to stay active, got: %+v, %v", active, err)
+		}
+	})
+}
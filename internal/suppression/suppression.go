@@ -0,0 +1,251 @@
+// Package suppression keeps the list of addresses RuneBird must not send to, such as those that
+// bounced, complained or unsubscribed, and leaves them out of every email.
+package suppression
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"runebird/internal/email"
+	"runebird/internal/logger"
+)
+
+// Reason is why an address is suppressed.
+type Reason string
+
+const (
+	ReasonBounced      Reason = "bounced"
+	ReasonComplained   Reason = "complained"
+	ReasonUnsubscribed Reason = "unsubscribed"
+	ReasonManual       Reason = "manual"
+)
+
+// Reasons lists the reasons an address can be suppressed for.
+var Reasons = []Reason{ReasonBounced, ReasonComplained, ReasonUnsubscribed, ReasonManual}
+
+// ErrNotSuppressed is returned for an address that is not on the suppression list.
+var ErrNotSuppressed = errors.New("address is not suppressed")
+
+// ErrInvalidEntry is returned, wrapped with the reason, for an entry that cannot be added.
+var ErrInvalidEntry = errors.New("invalid suppression entry")
+
+// Entry is an address on the suppression list, with why and when it was added.
+type Entry struct {
+	Address   string    `json:"address"`
+	Reason    Reason    `json:"reason"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store persists the suppression list, keyed by normalized address.
+type Store interface {
+	// List returns every entry.
+	List() ([]Entry, error)
+	// Get returns the entry for the given address, or false if there is none.
+	Get(address string) (Entry, bool, error)
+	// Save stores entry, replacing any entry for the same address.
+	Save(entry Entry) error
+	// Delete removes the entry for the given address, reporting whether it existed.
+	Delete(address string) (bool, error)
+}
+
+type memoryStore struct {
+	entries map[string]Entry
+	mu      sync.Mutex
+}
+
+// NewMemoryStore creates a Store that keeps the suppression list in process memory.
+func NewMemoryStore() Store {
+	return &memoryStore{entries: make(map[string]Entry)}
+}
+
+func (m *memoryStore) List() ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]Entry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) Get(address string) (Entry, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[address]
+	return entry, ok, nil
+}
+
+func (m *memoryStore) Save(entry Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[entry.Address] = entry
+	return nil
+}
+
+func (m *memoryStore) Delete(address string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.entries[address]
+	delete(m.entries, address)
+	return ok, nil
+}
+
+// List manages the suppression list kept in a Store. A nil List suppresses nothing.
+type List struct {
+	store  Store
+	logger *logger.Logger
+}
+
+// NewList creates a List kept in store.
+func NewList(store Store, log *logger.Logger) *List {
+	return &List{store: store, logger: log}
+}
+
+// Normalize returns the address of recipient, which may have a display name, in the form it is
+// listed under: without the display name and in lower case.
+func Normalize(recipient string) string {
+	if addr, err := mail.ParseAddress(recipient); err == nil {
+		recipient = addr.Address
+	}
+	return strings.ToLower(strings.TrimSpace(recipient))
+}
+
+// Entries returns every entry, most recently added first.
+func (l *List) Entries() ([]Entry, error) {
+	entries, err := l.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list suppressed addresses: %v", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].CreatedAt.After(entries[j].CreatedAt)
+		}
+		return entries[i].Address < entries[j].Address
+	})
+	return entries, nil
+}
+
+// Get returns the entry for address.
+func (l *List) Get(address string) (Entry, error) {
+	address = Normalize(address)
+	entry, ok, err := l.store.Get(address)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to look up suppressed address %s: %v", address, err)
+	}
+	if !ok {
+		return Entry{}, ErrNotSuppressed
+	}
+	return entry, nil
+}
+
+// Add suppresses the address of entry, for a manual reason unless it has one, replacing any
+// entry for the address.
+func (l *List) Add(entry Entry) (Entry, error) {
+	addr, err := mail.ParseAddress(entry.Address)
+	if err != nil {
+		return Entry{}, fmt.Errorf("%w: invalid email address %q", ErrInvalidEntry, entry.Address)
+	}
+	entry.Address = strings.ToLower(addr.Address)
+	if entry.Reason == "" {
+		entry.Reason = ReasonManual
+	}
+	if !slices.Contains(Reasons, entry.Reason) {
+		return Entry{}, fmt.Errorf("%w: unknown reason %q", ErrInvalidEntry, entry.Reason)
+	}
+	entry.CreatedAt = time.Now().UTC()
+	if err := l.store.Save(entry); err != nil {
+		return Entry{}, fmt.Errorf("failed to save suppressed address %s: %v", entry.Address, err)
+	}
+	return entry, nil
+}
+
+// Remove takes address off the suppression list.
+func (l *List) Remove(address string) error {
+	address = Normalize(address)
+	ok, err := l.store.Delete(address)
+	if err != nil {
+		return fmt.Errorf("failed to delete suppressed address %s: %v", address, err)
+	}
+	if !ok {
+		return ErrNotSuppressed
+	}
+	return nil
+}
+
+// Filter splits recipients into those that may be sent to and those that are suppressed, each
+// in the order given.
+func (l *List) Filter(recipients []string) (allowed, suppressed []string, err error) {
+	if l == nil {
+		return recipients, nil, nil
+	}
+	for _, recipient := range recipients {
+		_, ok, err := l.store.Get(Normalize(recipient))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to look up suppressed address %s: %v", recipient, err)
+		}
+		if ok {
+			suppressed = append(suppressed, recipient)
+		} else {
+			allowed = append(allowed, recipient)
+		}
+	}
+	return allowed, suppressed, nil
+}
+
+// Sender wraps an email.Sender to leave suppressed recipients out of every message, whichever
+// of the server, the scheduler or the rate limit queue sends it, so that an address suppressed
+// after an email was scheduled or queued is still skipped.
+type Sender struct {
+	next email.Sender
+	list *List
+}
+
+// NewSender wraps next in a Sender filtering recipients through list.
+func NewSender(next email.Sender, list *List) email.Sender {
+	return &Sender{next: next, list: list}
+}
+
+// SendMessage sends msg to its recipients that are not suppressed, reporting the others in the
+// result. If every recipient is suppressed, it fails with a permanent *email.SendError wrapping
+// email.ErrSuppressed.
+func (s *Sender) SendMessage(ctx context.Context, msg email.Message) (email.Result, error) {
+	allowed, suppressed, err := s.list.Filter(msg.Recipients)
+	if err != nil {
+		return email.Result{}, &email.SendError{Err: err, Transient: true}
+	}
+	if len(suppressed) == 0 {
+		return s.next.SendMessage(ctx, msg)
+	}
+	s.list.logger.Info("Suppressed recipients left out of email", zap.String("id", msg.ID), zap.Strings("suppressed", suppressed))
+	if len(allowed) == 0 {
+		return email.Result{Suppressed: suppressed}, &email.SendError{Err: fmt.Errorf("failed to send email: %w", email.ErrSuppressed)}
+	}
+	msg.Recipients = allowed
+	result, err := s.next.SendMessage(ctx, msg)
+	result.Suppressed = suppressed
+	return result, err
+}
+
+// Probe probes the wrapped sender.
+func (s *Sender) Probe(ctx context.Context) error {
+	return s.next.Probe(ctx)
+}
+
+// Collectors returns the collectors of the wrapped sender.
+func (s *Sender) Collectors() []prometheus.Collector {
+	return s.next.Collectors()
+}
@@ -0,0 +1,101 @@
+package suppression
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+	"runebird/internal/email"
+	"runebird/internal/logger"
+)
+
+// stubSender records the recipients of the last message it was asked to send.
+type stubSender struct {
+	recipients []string
+}
+
+func (s *stubSender) SendMessage(ctx context.Context, msg email.Message) (email.Result, error) {
+	s.recipients = msg.Recipients
+	return email.Result{Provider: "stub", Accepted: msg.Recipients}, nil
+}
+
+func (s *stubSender) Probe(ctx context.Context) error { return nil }
+
+func (s *stubSender) Collectors() []prometheus.Collector { return nil }
+
+func TestList(t *testing.T) {
+	newList := func(t *testing.T) *List {
+		return NewList(NewMemoryStore(), &logger.Logger{Logger: zaptest.NewLogger(t)})
+	}
+
+	t.Run("AddGetRemove", func(t *testing.T) {
+		list := newList(t)
+		for _, invalid := range []Entry{{Address: "not-an-email"}, {Address: "user@example.com", Reason: "disliked"}} {
+			if _, err := list.Add(invalid); !errors.Is(err, ErrInvalidEntry) {
+				t.Errorf("expected %v for %+v, got: %v", ErrInvalidEntry, invalid, err)
+			}
+		}
+
+		entry, err := list.Add(Entry{Address: "User <User@Example.com>"})
+		if err != nil || entry.Address != "user@example.com" || entry.Reason != ReasonManual || entry.CreatedAt.IsZero() {
+			t.Fatalf("expected a manual entry for the normalized address, got: %+v (%v)", entry, err)
+		}
+		if got, err := list.Get("USER@example.com"); err != nil || got.Address != entry.Address {
+			t.Errorf("expected the address to be found whatever its case, got: %+v (%v)", got, err)
+		}
+		if err := list.Remove("user@example.com"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if err := list.Remove("user@example.com"); !errors.Is(err, ErrNotSuppressed) {
+			t.Errorf("expected %v, got: %v", ErrNotSuppressed, err)
+		}
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		list := newList(t)
+		if _, err := list.Add(Entry{Address: "bounced@example.com", Reason: ReasonBounced}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		allowed, suppressed, err := list.Filter([]string{"a@example.com", "Bounced <BOUNCED@example.com>", "b@example.com"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if !slices.Equal(allowed, []string{"a@example.com", "b@example.com"}) || !slices.Equal(suppressed, []string{"Bounced <BOUNCED@example.com>"}) {
+			t.Errorf("expected the bounced recipient to be suppressed, got: %v and %v", allowed, suppressed)
+		}
+
+		var nilList *List
+		if allowed, suppressed, _ := nilList.Filter([]string{"bounced@example.com"}); len(allowed) != 1 || len(suppressed) != 0 {
+			t.Errorf("expected a nil list to suppress nothing, got: %v and %v", allowed, suppressed)
+		}
+	})
+
+	t.Run("Sender", func(t *testing.T) {
+		list := newList(t)
+		if _, err := list.Add(Entry{Address: "unsubscribed@example.com", Reason: ReasonUnsubscribed}); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		stub := &stubSender{}
+		sender := NewSender(stub, list)
+
+		result, err := sender.SendMessage(context.Background(), email.Message{ID: "msg-1", Recipients: []string{"user@example.com", "unsubscribed@example.com"}})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if !slices.Equal(stub.recipients, []string{"user@example.com"}) || !slices.Equal(result.Suppressed, []string{"unsubscribed@example.com"}) {
+			t.Errorf("expected the suppressed recipient to be left out and reported, got: %v and %+v", stub.recipients, result)
+		}
+
+		stub.recipients = nil
+		_, err = sender.SendMessage(context.Background(), email.Message{ID: "msg-2", Recipients: []string{"unsubscribed@example.com"}})
+		if !errors.Is(err, email.ErrSuppressed) || email.Retryable(err) {
+			t.Errorf("expected a permanent %v, got: %v", email.ErrSuppressed, err)
+		}
+		if stub.recipients != nil {
+			t.Errorf("expected nothing to be sent, got: %v", stub.recipients)
+		}
+	})
+}
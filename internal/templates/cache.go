@@ -0,0 +1,152 @@
+package templates
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+// rendered is the output of rendering a template, cached by a renderCache.
+type rendered struct {
+	body, subject string
+}
+
+// renderCache keeps the most recently rendered emails, so that rendering a template again
+// with the same data, as for the recipients of a campaign, does not execute it again. Entries
+// are keyed by the template, the version of the templates it was rendered from and a digest
+// of the data, and the least recently used one is evicted once size is reached. A nil
+// renderCache caches nothing.
+type renderCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry struct {
+	key   string
+	value rendered
+}
+
+func newRenderCache(size int) *renderCache {
+	if size <= 0 {
+		return nil
+	}
+	return &renderCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// key returns the cache key for rendering part of template name, from the given generation of
+// the templates, with data. It reports false for data that cannot be digested.
+func (c *renderCache) key(part, name string, generation uint64, data interface{}) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", false
+	}
+	digest := sha256.Sum256(encoded)
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%s", part, name, generation, hex.EncodeToString(digest[:])), true
+}
+
+func (c *renderCache) get(key string) (rendered, bool) {
+	if c == nil {
+		return rendered{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return rendered{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+func (c *renderCache) add(key string, value rendered) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// timeFuncs are the helpers whose result depends on when a template is rendered, so that a
+// cached render would show the time it was first rendered at.
+var timeFuncs = map[string]bool{"now": true}
+
+// callsTime reports whether the template parsed as tree calls one of timeFuncs.
+func callsTime(tree *parse.Tree) bool {
+	return tree != nil && callsTimeNode(tree.Root)
+}
+
+// textCallsTime reports whether the plain-text template text, or one it defines, calls one of
+// timeFuncs.
+func textCallsTime(text *texttemplate.Template) bool {
+	for _, t := range text.Templates() {
+		if callsTime(t.Tree) {
+			return true
+		}
+	}
+	return false
+}
+
+func callsTimeNode(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.IdentifierNode:
+		return timeFuncs[n.Ident]
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if callsTimeNode(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return callsTimeNode(n.Pipe)
+	case *parse.TemplateNode:
+		return callsTimeNode(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if callsTimeNode(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if callsTimeNode(arg) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return callsTimeNode(n.Node)
+	case *parse.IfNode:
+		return callsTimeNode(n.Pipe) || callsTimeNode(n.List) || callsTimeNode(n.ElseList)
+	case *parse.RangeNode:
+		return callsTimeNode(n.Pipe) || callsTimeNode(n.List) || callsTimeNode(n.ElseList)
+	case *parse.WithNode:
+		return callsTimeNode(n.Pipe) || callsTimeNode(n.List) || callsTimeNode(n.ElseList)
+	}
+	return false
+}
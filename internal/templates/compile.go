@@ -0,0 +1,82 @@
+package templates
+
+import (
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"strings"
+
+	"runebird/internal/config"
+)
+
+// isTemplateFile reports whether path is a template file: HTML, or MJML or Markdown converted
+// to HTML, or a Mustache template.
+func isTemplateFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".html", ".mjml", ".md", ".mustache", ".hbs":
+		return true
+	}
+	return false
+}
+
+// templateName returns the name of the template in the file at path.
+func templateName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// compile returns the HTML of the template in the file at path: the content itself for an
+// .html file, the output of the MJML compiler for an .mjml file, and the Markdown converted to
+// HTML and wrapped in the layout for an .md file.
+func compile(path, content string, cfg *config.TemplatesConfig) (string, error) {
+	switch filepath.Ext(path) {
+	case ".mjml":
+		return compileMJML(content, cfg.MJMLCommand)
+	case ".md":
+		return compileMarkdown(content, &cfg.Markdown)
+	default:
+		return content, nil
+	}
+}
+
+// parseSource parses the content of template name, read from the file at path: the front
+// matter, if any, and the rest compiled to HTML and parsed by the engine it is written for,
+// with the helper functions for the locale in the name. It also returns the content without
+// the front matter.
+func parseSource(cfg *config.TemplatesConfig, name, path, content string) (*template.Template, Metadata, string, error) {
+	meta, body, err := splitFrontMatter(content)
+	if err != nil {
+		return nil, Metadata{}, "", fmt.Errorf("failed to parse front matter of template %s: %v", name, err)
+	}
+	source, err := compile(path, body, cfg)
+	if err != nil {
+		return nil, Metadata{}, "", fmt.Errorf("failed to compile template %s: %v", name, err)
+	}
+	engine, err := engineFor(path, meta)
+	if err != nil {
+		return nil, Metadata{}, "", fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+	_, locale := splitLocale(name)
+	funcs := funcMap(cfg, locale)
+	if engine != nil {
+		tmpl, err := parseWithEngine(engine, name, source, meta, funcs)
+		if err != nil {
+			return nil, Metadata{}, "", fmt.Errorf("failed to parse template %s: %v", name, err)
+		}
+		// The engine is given the helpers too, but its source cannot be walked for calls to now.
+		meta.timeDependent = true
+		return tmpl, meta, body, nil
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Parse(source)
+	if err != nil {
+		return nil, Metadata{}, "", fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+	if err := applyMetadata(tmpl, meta); err != nil {
+		return nil, Metadata{}, "", fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+	// The trees are read before the template is first executed, which escapes them in place.
+	for _, t := range tmpl.Templates() {
+		meta.timeDependent = meta.timeDependent || callsTime(t.Tree)
+	}
+	return tmpl, meta, body, nil
+}
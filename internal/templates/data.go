@@ -0,0 +1,47 @@
+package templates
+
+import (
+	"maps"
+	"reflect"
+	"time"
+
+	"runebird/internal/config"
+)
+
+// globalKey is the data field the configured global variables are passed under. It is
+// reserved: a field of that name in the request data is replaced.
+const globalKey = "Global"
+
+// withDefaults returns data with the global variables under .Global and the configured
+// defaults of template name, or of its unlocalized base, for the fields data does not set.
+// Data that is not a map with string keys is returned unchanged, as there is no way to add
+// fields to it.
+func withDefaults(cfg *config.TemplatesConfig, name string, data interface{}) interface{} {
+	defaults := cfg.Defaults[name]
+	if defaults == nil {
+		base, _ := splitLocale(name)
+		defaults = cfg.Defaults[base]
+	}
+
+	merged := make(map[string]interface{})
+	if data != nil {
+		v := reflect.ValueOf(data)
+		if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			return data
+		}
+		for iter := v.MapRange(); iter.Next(); {
+			merged[iter.Key().String()] = iter.Value().Interface()
+		}
+	}
+	for field, value := range defaults {
+		if _, ok := merged[field]; !ok {
+			merged[field] = value
+		}
+	}
+
+	// The current year is provided for copyright notices unless it is configured.
+	globals := map[string]interface{}{"Year": time.Now().Year()}
+	maps.Copy(globals, cfg.Globals)
+	merged[globalKey] = globals
+	return merged
+}
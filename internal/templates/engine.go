@@ -0,0 +1,126 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"sync"
+	texttemplate "text/template"
+)
+
+// DefaultEngine is the name of the engine for Go's html/template, used for templates that
+// name no other engine.
+const DefaultEngine = "html"
+
+// Engine parses templates written in a template language other than Go's html/template.
+type Engine interface {
+	// Parse parses source as template name, with funcs available to it if the language has
+	// functions. The template writes HTML, which is not escaped further.
+	Parse(name, source string, funcs template.FuncMap) (Executor, error)
+}
+
+// Executor executes a template parsed by an Engine, writing it to w with data.
+type Executor func(w io.Writer, data interface{}) error
+
+var (
+	enginesMu sync.RWMutex
+	engines   = map[string]Engine{
+		"text":     textEngine{},
+		"mustache": mustacheEngine{},
+	}
+)
+
+// engineExtensions are the file extensions of templates that use an engine other than the
+// default one unless their front matter names another.
+var engineExtensions = map[string]string{
+	".mustache": "mustache",
+	".hbs":      "mustache",
+}
+
+// RegisterEngine makes engine available to templates naming it in their front matter,
+// replacing any engine registered under the same name. The default engine cannot be replaced.
+func RegisterEngine(name string, engine Engine) {
+	if name == DefaultEngine {
+		panic("templates: cannot replace the default engine")
+	}
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	engines[name] = engine
+}
+
+// engineFor returns the engine of the template in the file at path with the given metadata,
+// or nil for the default engine.
+func engineFor(path string, meta Metadata) (Engine, error) {
+	name := meta.Engine
+	if name == "" {
+		name = engineExtensions[filepath.Ext(path)]
+	}
+	if name == "" || name == DefaultEngine {
+		return nil, nil
+	}
+	enginesMu.RLock()
+	engine, ok := engines[name]
+	enginesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown template engine %q", name)
+	}
+	return engine, nil
+}
+
+// usesDefaultEngine reports whether a template with the given metadata is written for Go's
+// html/template, so that its source can be parsed as a Go text template too.
+func usesDefaultEngine(meta Metadata) bool {
+	return meta.Engine == "" || meta.Engine == DefaultEngine
+}
+
+// parseWithEngine parses template name and the subject and preheader declared in its front
+// matter with engine, returning them as an html/template whose body, "subject" and "preheader"
+// templates execute them, so that they are rendered like any other template.
+func parseWithEngine(engine Engine, name, source string, meta Metadata, funcs template.FuncMap) (*template.Template, error) {
+	executors := make(map[string]Executor)
+	var err error
+	if executors[name], err = engine.Parse(name, source, funcs); err != nil {
+		return nil, err
+	}
+	for block, blockSource := range map[string]string{"subject": meta.Subject, "preheader": meta.Preheader} {
+		if blockSource == "" {
+			continue
+		}
+		if executors[block], err = engine.Parse(block, blockSource, funcs); err != nil {
+			return nil, fmt.Errorf("failed to parse front matter %s: %v", block, err)
+		}
+	}
+
+	execute := func(block string, data interface{}) (template.HTML, error) {
+		var buf bytes.Buffer
+		if err := executors[block](&buf, data); err != nil {
+			return "", err
+		}
+		return template.HTML(buf.String()), nil
+	}
+	tmpl := template.New(name).Funcs(template.FuncMap{"execute": execute})
+	for block := range executors {
+		t := tmpl
+		if block != name {
+			t = tmpl.New(block)
+		}
+		if _, err := t.Parse(fmt.Sprintf("{{ execute %q . }}", block)); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// textEngine parses templates with Go's text/template, which is like html/template without
+// the escaping, for templates whose data is HTML already.
+type textEngine struct{}
+
+func (textEngine) Parse(name, source string, funcs template.FuncMap) (Executor, error) {
+	tmpl, err := texttemplate.New(name).Funcs(texttemplate.FuncMap(funcs)).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Execute, nil
+}
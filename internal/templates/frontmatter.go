@@ -0,0 +1,131 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/mail"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrMissingData is wrapped by Render errors for data lacking fields a template requires.
+var ErrMissingData = errors.New("missing required template data")
+
+// frontMatterDelimiter opens and closes the front matter block of a template file.
+const frontMatterDelimiter = "---"
+
+// Metadata is declared in a YAML front matter block at the start of a template file:
+//
+//	---
+//	subject: "Welcome, {{ .Name }}"
+//	preheader: "Your account is ready"
+//	from: "RuneBird <hello@example.com>"
+//	required: [Name]
+//	inline_css: true
+//	track_clicks: false
+//	engine: mustache
+//	profile: marketing
+//	---
+//
+// Subject and Preheader are templates rendered with the email data. A "subject" block in the
+// template takes precedence over Subject. From is the sender used when a request names none,
+// and Required lists the data fields the template cannot be rendered without. InlineCSS
+// overrides templates.inline_css for the template, as TrackClicks does templates.tracking.clicks.
+// Engine names the Engine the template is written for, if it is not Go's html/template, and
+// Profile names the delivery profile emails are sent through when a request names none.
+type Metadata struct {
+	Subject     string   `yaml:"subject" json:"subject,omitempty"`
+	Preheader   string   `yaml:"preheader" json:"preheader,omitempty"`
+	From        string   `yaml:"from" json:"from,omitempty"`
+	Required    []string `yaml:"required" json:"required,omitempty"`
+	InlineCSS   *bool    `yaml:"inline_css" json:"inline_css,omitempty"`
+	TrackClicks *bool    `yaml:"track_clicks" json:"track_clicks,omitempty"`
+	Engine      string   `yaml:"engine" json:"engine,omitempty"`
+	Profile     string   `yaml:"profile" json:"profile,omitempty"`
+	// timeDependent is not declared but found when the template is parsed: it calls a helper
+	// returning the current time, so its renders are not cached. textTimeDependent is the same
+	// for its plain-text version, set when the companion text template is parsed.
+	timeDependent     bool
+	textTimeDependent bool
+}
+
+// splitFrontMatter separates the front matter block at the start of content, if there is one,
+// from the template that follows it.
+func splitFrontMatter(content string) (Metadata, string, error) {
+	var meta Metadata
+	normalized := strings.ReplaceAll(content, "\r\n", "\n")
+	if !strings.HasPrefix(normalized, frontMatterDelimiter+"\n") {
+		return meta, content, nil
+	}
+	rest := normalized[len(frontMatterDelimiter)+1:]
+	block, body, ok := strings.Cut(rest, "\n"+frontMatterDelimiter+"\n")
+	if !ok {
+		if block, ok = strings.CutSuffix(rest, "\n"+frontMatterDelimiter); !ok {
+			return meta, "", errors.New("front matter is not closed with ---")
+		}
+		body = ""
+	}
+	if err := yaml.Unmarshal([]byte(block), &meta); err != nil {
+		return meta, "", fmt.Errorf("invalid front matter: %v", err)
+	}
+	if meta.From != "" {
+		if _, err := mail.ParseAddress(meta.From); err != nil || strings.ContainsAny(meta.From, "\r\n") {
+			return meta, "", fmt.Errorf("invalid front matter: invalid from address %q", meta.From)
+		}
+	}
+	return meta, body, nil
+}
+
+// applyMetadata adds the subject and preheader declared in meta to tmpl as the "subject" and
+// "preheader" templates, unless tmpl defines them itself.
+func applyMetadata(tmpl *template.Template, meta Metadata) error {
+	for name, source := range map[string]string{"subject": meta.Subject, "preheader": meta.Preheader} {
+		if source == "" || tmpl.Lookup(name) != nil {
+			continue
+		}
+		if _, err := tmpl.New(name).Parse(source); err != nil {
+			return fmt.Errorf("failed to parse front matter %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// missingFields returns the fields of required that data, a map or a struct, does not have.
+func missingFields(required []string, data interface{}) []string {
+	var missing []string
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	for _, field := range required {
+		switch {
+		case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+			if v.MapIndex(reflect.ValueOf(field).Convert(v.Type().Key())).IsValid() {
+				continue
+			}
+		case v.Kind() == reflect.Struct:
+			if v.FieldByName(field).IsValid() {
+				continue
+			}
+		}
+		missing = append(missing, field)
+	}
+	return missing
+}
+
+// insertPreheader adds preheader to body as hidden text at the start of the body element, where
+// email clients pick it up for the preview shown next to the subject.
+func insertPreheader(body, preheader string) string {
+	hidden := `<div style="display:none;max-height:0;overflow:hidden;mso-hide:all">` + preheader + `</div>`
+	lower := strings.ToLower(body)
+	if i := strings.Index(lower, "<body"); i >= 0 {
+		if end := strings.IndexByte(body[i:], '>'); end >= 0 {
+			at := i + end + 1
+			return body[:at] + hidden + body[at:]
+		}
+	}
+	return hidden + body
+}
@@ -0,0 +1,213 @@
+package templates
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"runebird/internal/config"
+	"runebird/internal/email"
+)
+
+// currencySymbols are the symbols the currency helper writes amounts with. Amounts in other
+// currencies are prefixed with their code.
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"INR": "₹",
+}
+
+// zeroDecimalCurrencies are the currencies without minor units.
+var zeroDecimalCurrencies = map[string]bool{
+	"JPY": true,
+	"KRW": true,
+}
+
+// funcMap returns the helper functions available in every template, formatting dates and
+// numbers for locale and signing unsubscribe links as configured in cfg. The unsafe helpers,
+// which read the environment or bypass HTML escaping, are left out if cfg disables them.
+func funcMap(cfg *config.TemplatesConfig, locale string) template.FuncMap {
+	format := formatFor(locale)
+	funcs := template.FuncMap{
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"trim":    strings.TrimSpace,
+		"default": defaultValue,
+		"date": func(layout string, t interface{}) (string, error) {
+			return formatDate(format, layout, t)
+		},
+		"now": time.Now,
+		"number": func(decimals int, v interface{}) (string, error) {
+			return formatNumber(format, decimals, v)
+		},
+		"currency": func(code string, amount interface{}) (string, error) {
+			return formatCurrency(format, code, amount)
+		},
+		"pluralize": pluralize,
+		"url":       buildURL,
+		"unsubscribeURL": func(recipients ...string) (string, error) {
+			return unsubscribeURL(&cfg.Unsubscribe, recipients)
+		},
+	}
+	if !cfg.DisableUnsafeFuncs {
+		funcs["env"] = os.Getenv
+		funcs["safeHTML"] = func(s string) template.HTML { return template.HTML(s) }
+	}
+	return funcs
+}
+
+// defaultValue returns value, or def if value is empty: nil, false, zero, or an empty string,
+// slice or map.
+func defaultValue(def, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	if v := reflect.ValueOf(value); v.IsZero() || (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0 {
+		return def
+	}
+	return value
+}
+
+// formatDate formats t with the Go layout in the given format. t may be a time.Time, an RFC 3339
+// string or a Unix timestamp in seconds, as times arrive from JSON request data.
+func formatDate(format localeFormat, layout string, t interface{}) (string, error) {
+	switch v := t.(type) {
+	case time.Time:
+		return format.format(v, layout), nil
+	case *time.Time:
+		return format.format(*v, layout), nil
+	case string:
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", fmt.Errorf("date: %v", err)
+		}
+		return format.format(parsed, layout), nil
+	default:
+		seconds, err := toFloat(t)
+		if err != nil {
+			return "", fmt.Errorf("date: unsupported time %v", t)
+		}
+		return format.format(time.Unix(int64(seconds), 0).UTC(), layout), nil
+	}
+}
+
+// formatNumber formats v with the given number of decimals and the separators of the format,
+// for example "1,234.50" in English and "1.234,50" in German.
+func formatNumber(format localeFormat, decimals int, v interface{}) (string, error) {
+	value, err := toFloat(v)
+	if err != nil {
+		return "", fmt.Errorf("number: %v", err)
+	}
+	return format.number(value, decimals), nil
+}
+
+// formatCurrency formats amount in the currency with the given ISO 4217 code and the
+// separators of the format, for example "$1,234.50" in English and "1.234,50 €" in German.
+func formatCurrency(format localeFormat, code string, amount interface{}) (string, error) {
+	value, err := toFloat(amount)
+	if err != nil {
+		return "", fmt.Errorf("currency: %v", err)
+	}
+	code = strings.ToUpper(code)
+	decimals := 2
+	if zeroDecimalCurrencies[code] {
+		decimals = 0
+	}
+
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	digits := format.number(value, decimals)
+	symbol, ok := currencySymbols[code]
+	switch {
+	case !ok:
+		return sign + code + " " + digits, nil
+	case format.symbolBefore:
+		return sign + symbol + digits, nil
+	default:
+		return sign + digits + " " + symbol, nil
+	}
+}
+
+// pluralize returns singular if count is one and plural otherwise.
+func pluralize(count interface{}, singular, plural string) (string, error) {
+	n, err := toFloat(count)
+	if err != nil {
+		return "", fmt.Errorf("pluralize: %v", err)
+	}
+	if n == 1 {
+		return singular, nil
+	}
+	return plural, nil
+}
+
+// buildURL adds the query parameters given as name and value pairs to base.
+func buildURL(base string, pairs ...interface{}) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("url: query parameters must be name and value pairs, got %d arguments", len(pairs))
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("url: %v", err)
+	}
+	query := u.Query()
+	for i := 0; i < len(pairs); i += 2 {
+		query.Set(fmt.Sprint(pairs[i]), fmt.Sprint(pairs[i+1]))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// unsubscribeURL returns the signed unsubscribe URL of recipients, failing if no unsubscribe
+// URL is configured.
+func unsubscribeURL(cfg *config.UnsubscribeConfig, recipients []string) (string, error) {
+	if cfg.URL == "" {
+		return "", fmt.Errorf("unsubscribeURL: templates.unsubscribe.url is not set")
+	}
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("unsubscribeURL: at least one address is required")
+	}
+	u, err := email.UnsubscribeURL(cfg, recipients)
+	if err != nil {
+		return "", fmt.Errorf("unsubscribeURL: %v", err)
+	}
+	return u, nil
+}
+
+// toFloat converts the numbers found in template data, including numeric strings, to a float64.
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case uint:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("not a number: %q", n)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("not a number: %v", v)
+	}
+}
@@ -0,0 +1,713 @@
+package templates
+
+import (
+	"html"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// inlineCSS moves the rules of the <style> elements in body into the style attributes of the
+// elements they select, as many email clients drop <style> elements. Declarations already in
+// a style attribute take precedence over the stylesheet unless these are !important. Rules that
+// cannot be inlined, such as @media queries and selectors with pseudo-classes, are kept in
+// their <style> element, which is removed if nothing else is left of it. <style> elements with
+// a media or a data-no-inline attribute are left as they are.
+func inlineCSS(body string) string {
+	tokens := scanTags(body)
+
+	var edits []edit
+	var rules []cssRule
+	for i, tok := range tokens {
+		if tok.name != "style" || tok.closing || tok.selfClosing || tok.attr("media") != nil || tok.attr("data-no-inline") != nil {
+			continue
+		}
+		if i+1 >= len(tokens) || tokens[i+1].name != "style" || !tokens[i+1].closing {
+			continue
+		}
+		closing := tokens[i+1]
+		inlined, kept := parseStylesheet(body[tok.end:closing.start], len(rules))
+		rules = append(rules, inlined...)
+		if len(kept) == 0 {
+			edits = append(edits, edit{start: tok.start, end: closing.end})
+		} else {
+			edits = append(edits, edit{start: tok.end, end: closing.start, text: "\n" + strings.Join(kept, "\n") + "\n"})
+		}
+	}
+	if len(rules) == 0 {
+		return body
+	}
+
+	var stack []htmlElement
+	for _, tok := range tokens {
+		if tok.name == "" {
+			continue
+		}
+		if tok.closing {
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].tag == tok.name {
+					stack = stack[:i]
+					break
+				}
+			}
+			continue
+		}
+
+		el := newElement(tok)
+		path := append(stack, el)
+		if !tok.selfClosing && !voidElements[tok.name] {
+			stack = path
+		}
+		if unstyledElements[tok.name] {
+			continue
+		}
+		var matched []cssRule
+		for _, rule := range rules {
+			if rule.matches(path) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		style := tok.attr("style")
+		var inline []cssDecl
+		if style != nil {
+			inline = parseDeclarations(style.value)
+		}
+		value := html.EscapeString(cascade(matched, inline))
+		if style != nil {
+			edits = append(edits, edit{start: style.start, end: style.end, text: `style="` + value + `"`})
+		} else {
+			edits = append(edits, edit{start: tok.closeAt, end: tok.closeAt, text: ` style="` + value + `"`})
+		}
+	}
+
+	// Edits are made in the order of the document; a style element's content always comes before
+	// the tags that follow it.
+	slices.SortStableFunc(edits, func(a, b edit) int { return a.start - b.start })
+	return applyEdits(body, edits)
+}
+
+// edit replaces the part of a document between start and end by text.
+type edit struct {
+	start, end int
+	text       string
+}
+
+// applyEdits makes edits, in the order of the document, to doc. An edit overlapping the one
+// before it is skipped.
+func applyEdits(doc string, edits []edit) string {
+	var out strings.Builder
+	last := 0
+	for _, e := range edits {
+		if e.start < last {
+			continue
+		}
+		out.WriteString(doc[last:e.start])
+		out.WriteString(e.text)
+		last = e.end
+	}
+	out.WriteString(doc[last:])
+	return out.String()
+}
+
+// voidElements are the HTML elements that have no end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// unstyledElements are the elements that are not displayed, which styles are not added to.
+var unstyledElements = map[string]bool{
+	"html": true, "head": true, "title": true, "meta": true, "link": true, "style": true, "script": true, "base": true,
+}
+
+// rawTextElements hold text that is not markup, up to their end tag.
+var rawTextElements = map[string]bool{"style": true, "script": true, "textarea": true, "title": true}
+
+// htmlTag is a start or end tag found by scanTags, spanning start to end in the document.
+type htmlTag struct {
+	start, end  int
+	closeAt     int // offset of the > or /> ending a start tag
+	name        string
+	closing     bool
+	selfClosing bool
+	attrs       []htmlAttr
+}
+
+// htmlAttr is an attribute of a start tag, spanning start to end in the document.
+type htmlAttr struct {
+	name, value string
+	start, end  int
+}
+
+func (t htmlTag) attr(name string) *htmlAttr {
+	for i := range t.attrs {
+		if t.attrs[i].name == name {
+			return &t.attrs[i]
+		}
+	}
+	return nil
+}
+
+// scanTags returns the tags in doc, skipping text, comments, including conditional comments,
+// doctypes and the content of raw text elements.
+func scanTags(doc string) []htmlTag {
+	var tags []htmlTag
+	i := 0
+	for i < len(doc) {
+		lt := strings.IndexByte(doc[i:], '<')
+		if lt < 0 {
+			break
+		}
+		i += lt
+		switch {
+		case strings.HasPrefix(doc[i:], "<!--"):
+			end := strings.Index(doc[i+4:], "-->")
+			if end < 0 {
+				return tags
+			}
+			i += 4 + end + 3
+		case strings.HasPrefix(doc[i:], "<!") || strings.HasPrefix(doc[i:], "<?"):
+			end := strings.IndexByte(doc[i:], '>')
+			if end < 0 {
+				return tags
+			}
+			i += end + 1
+		case strings.HasPrefix(doc[i:], "</") && i+2 < len(doc) && isASCIILetter(doc[i+2]):
+			end := strings.IndexByte(doc[i:], '>')
+			if end < 0 {
+				return tags
+			}
+			name := doc[i+2 : i+end]
+			if j := strings.IndexAny(name, " \t\r\n/"); j >= 0 {
+				name = name[:j]
+			}
+			tags = append(tags, htmlTag{start: i, end: i + end + 1, name: strings.ToLower(name), closing: true})
+			i += end + 1
+		case i+1 < len(doc) && isASCIILetter(doc[i+1]):
+			tag := scanStartTag(doc, i)
+			tags = append(tags, tag)
+			i = tag.end
+			if rawTextElements[tag.name] && !tag.selfClosing {
+				end := strings.Index(strings.ToLower(doc[i:]), "</"+tag.name)
+				if end < 0 {
+					return tags
+				}
+				i += end
+			}
+		default:
+			i++
+		}
+	}
+	return tags
+}
+
+// scanStartTag reads the start tag at offset start of doc.
+func scanStartTag(doc string, start int) htmlTag {
+	tag := htmlTag{start: start}
+	i := start + 1
+	for i < len(doc) && !isTagSpace(doc[i]) && doc[i] != '>' && doc[i] != '/' {
+		i++
+	}
+	tag.name = strings.ToLower(doc[start+1 : i])
+	for i < len(doc) {
+		for i < len(doc) && isTagSpace(doc[i]) {
+			i++
+		}
+		if i >= len(doc) {
+			break
+		}
+		if doc[i] == '>' {
+			tag.closeAt, tag.end = i, i+1
+			return tag
+		}
+		if strings.HasPrefix(doc[i:], "/>") {
+			tag.closeAt, tag.end, tag.selfClosing = i, i+2, true
+			return tag
+		}
+		if doc[i] == '/' {
+			i++
+			continue
+		}
+
+		attrStart := i
+		for i < len(doc) && !isTagSpace(doc[i]) && doc[i] != '=' && doc[i] != '>' && !strings.HasPrefix(doc[i:], "/>") {
+			i++
+		}
+		attr := htmlAttr{name: strings.ToLower(doc[attrStart:i]), start: attrStart}
+		j := i
+		for j < len(doc) && isTagSpace(doc[j]) {
+			j++
+		}
+		if j < len(doc) && doc[j] == '=' {
+			j++
+			for j < len(doc) && isTagSpace(doc[j]) {
+				j++
+			}
+			if j < len(doc) && (doc[j] == '"' || doc[j] == '\'') {
+				end := strings.IndexByte(doc[j+1:], doc[j])
+				if end < 0 {
+					end = len(doc) - j - 1
+				}
+				attr.value = doc[j+1 : j+1+end]
+				i = min(j+1+end+1, len(doc))
+			} else {
+				k := j
+				for k < len(doc) && !isTagSpace(doc[k]) && doc[k] != '>' {
+					k++
+				}
+				attr.value = doc[j:k]
+				i = k
+			}
+		}
+		attr.value = html.UnescapeString(attr.value)
+		attr.end = i
+		tag.attrs = append(tag.attrs, attr)
+	}
+	tag.closeAt, tag.end = len(doc), len(doc)
+	return tag
+}
+
+func isTagSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// htmlElement is an element as seen by selectors.
+type htmlElement struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   map[string]string
+}
+
+func newElement(tag htmlTag) htmlElement {
+	el := htmlElement{tag: tag.name, attrs: make(map[string]string, len(tag.attrs))}
+	for _, attr := range tag.attrs {
+		el.attrs[attr.name] = attr.value
+	}
+	el.id = el.attrs["id"]
+	el.classes = strings.Fields(el.attrs["class"])
+	return el
+}
+
+// cssDecl is a declaration of a CSS rule or a style attribute.
+type cssDecl struct {
+	property, value string
+	important       bool
+}
+
+// cssRule is a rule with a single selector that can be inlined. Rules with a list of selectors
+// are split into one per selector.
+type cssRule struct {
+	selector    []cssCompound
+	specificity [3]int
+	order       int
+	decls       []cssDecl
+}
+
+// cssCompound is a part of a selector, such as p.note[title], and how it relates to the part
+// before it: ' ' for a descendant and '>' for a child.
+type cssCompound struct {
+	combinator byte
+	tag        string
+	id         string
+	classes    []string
+	attrs      []cssAttrSelector
+}
+
+// cssAttrSelector selects elements by an attribute, such as [target="_blank"]. Operator is
+// empty for selectors that only require the attribute.
+type cssAttrSelector struct {
+	name, operator, value string
+}
+
+var cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// parseStylesheet returns the rules in css that can be inlined, numbered from order on, and
+// the source of the ones that cannot.
+func parseStylesheet(css string, order int) (rules []cssRule, kept []string) {
+	css = cssComment.ReplaceAllString(css, "")
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			return rules, kept
+		}
+		// At-rules, such as @media and @font-face, only apply as a stylesheet.
+		if css[0] == '@' {
+			end := atRuleEnd(css)
+			kept = append(kept, strings.TrimSpace(css[:end]))
+			css = css[end:]
+			continue
+		}
+		open := strings.IndexByte(css, '{')
+		if open < 0 {
+			return rules, kept
+		}
+		closing := matchingBrace(css, open)
+		prelude, block := css[:open], css[open+1:closing]
+		css = css[min(closing+1, len(css)):]
+
+		decls := parseDeclarations(block)
+		var unsupported []string
+		for _, source := range strings.Split(prelude, ",") {
+			source = strings.TrimSpace(source)
+			selector, ok := parseSelector(source)
+			if !ok {
+				unsupported = append(unsupported, source)
+				continue
+			}
+			rules = append(rules, cssRule{selector: selector, specificity: specificity(selector), order: order, decls: decls})
+			order++
+		}
+		if len(unsupported) > 0 {
+			kept = append(kept, strings.Join(unsupported, ", ")+" {"+block+"}")
+		}
+	}
+}
+
+// atRuleEnd returns the end of the at-rule at the start of css, a statement ending with ; or
+// a block.
+func atRuleEnd(css string) int {
+	for i := 0; i < len(css); i++ {
+		switch css[i] {
+		case ';':
+			return i + 1
+		case '{':
+			return min(matchingBrace(css, i)+1, len(css))
+		}
+	}
+	return len(css)
+}
+
+// matchingBrace returns the offset of the } closing the { at offset open of css, or the length
+// of css if it is not closed.
+func matchingBrace(css string, open int) int {
+	depth := 0
+	var quote byte
+	for i := open; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(css)
+}
+
+// parseDeclarations parses the declarations of a rule or a style attribute.
+func parseDeclarations(block string) []cssDecl {
+	var decls []cssDecl
+	for _, source := range splitDeclarations(block) {
+		property, value, ok := strings.Cut(source, ":")
+		property, value = strings.ToLower(strings.TrimSpace(property)), strings.TrimSpace(value)
+		if !ok || property == "" || value == "" {
+			continue
+		}
+		decl := cssDecl{property: property, value: value}
+		if rest, ok := strings.CutSuffix(strings.ToLower(value), "important"); ok {
+			if rest = strings.TrimSpace(rest); strings.HasSuffix(rest, "!") {
+				decl.value, decl.important = strings.TrimSpace(value[:len(rest)-1]), true
+			}
+		}
+		decls = append(decls, decl)
+	}
+	return decls
+}
+
+// splitDeclarations splits block at the semicolons that are not in strings or parentheses, as
+// in url(data:image/png;base64,...).
+func splitDeclarations(block string) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(block); i++ {
+		c := block[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ';' && depth <= 0:
+			parts = append(parts, block[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, block[start:])
+}
+
+// parseSelector parses a selector made of type, class, ID and attribute selectors combined by
+// descendant and child combinators. It reports false for any other selector, such as one with
+// pseudo-classes, which cannot be inlined.
+func parseSelector(source string) ([]cssCompound, bool) {
+	var selector []cssCompound
+	i := 0
+	for {
+		space := false
+		for i < len(source) && isTagSpace(source[i]) {
+			i, space = i+1, true
+		}
+		if i >= len(source) {
+			break
+		}
+		var combinator byte
+		switch {
+		case source[i] == '>':
+			combinator = '>'
+			i++
+			for i < len(source) && isTagSpace(source[i]) {
+				i++
+			}
+		case len(selector) > 0 && space:
+			combinator = ' '
+		case len(selector) > 0:
+			return nil, false
+		}
+		if len(selector) == 0 && combinator != 0 {
+			return nil, false
+		}
+
+		compound := cssCompound{combinator: combinator}
+		start := i
+		if i < len(source) && source[i] == '*' {
+			i++
+		} else if n := identLength(source[i:]); n > 0 {
+			compound.tag = strings.ToLower(source[i : i+n])
+			i += n
+		}
+	parts:
+		for i < len(source) {
+			switch source[i] {
+			case '.', '#':
+				n := identLength(source[i+1:])
+				if n == 0 {
+					return nil, false
+				}
+				if source[i] == '.' {
+					compound.classes = append(compound.classes, source[i+1:i+1+n])
+				} else {
+					compound.id = source[i+1 : i+1+n]
+				}
+				i += 1 + n
+			case '[':
+				end := strings.IndexByte(source[i:], ']')
+				if end < 0 {
+					return nil, false
+				}
+				attr, ok := parseAttrSelector(source[i+1 : i+end])
+				if !ok {
+					return nil, false
+				}
+				compound.attrs = append(compound.attrs, attr)
+				i += end + 1
+			default:
+				break parts
+			}
+		}
+		if i == start || (i < len(source) && !isTagSpace(source[i]) && source[i] != '>') {
+			return nil, false
+		}
+		selector = append(selector, compound)
+	}
+	return selector, len(selector) > 0
+}
+
+// identLength returns the length of the CSS identifier at the start of s.
+func identLength(s string) int {
+	n := 0
+	for n < len(s) {
+		c := s[n]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c >= 0x80 {
+			n++
+			continue
+		}
+		break
+	}
+	return n
+}
+
+// parseAttrSelector parses the inside of an attribute selector.
+func parseAttrSelector(source string) (cssAttrSelector, bool) {
+	i := strings.IndexAny(source, "~^$*|=")
+	if i < 0 {
+		name := strings.TrimSpace(source)
+		return cssAttrSelector{name: strings.ToLower(name)}, identLength(name) == len(name) && name != ""
+	}
+	name := strings.TrimSpace(source[:i])
+	operator, value, ok := "=", source[i+1:], true
+	if source[i] != '=' {
+		operator = source[i : i+2]
+		value, ok = strings.CutPrefix(source[i+1:], "=")
+	}
+	if !ok || name == "" || identLength(name) != len(name) || operator == "|=" {
+		return cssAttrSelector{}, false
+	}
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return cssAttrSelector{name: strings.ToLower(name), operator: operator, value: value}, true
+}
+
+// specificity counts the ID, class and attribute, and type selectors of selector.
+func specificity(selector []cssCompound) [3]int {
+	var s [3]int
+	for _, c := range selector {
+		if c.id != "" {
+			s[0]++
+		}
+		s[1] += len(c.classes) + len(c.attrs)
+		if c.tag != "" {
+			s[2]++
+		}
+	}
+	return s
+}
+
+// matches reports whether the rule selects the last element of path, the elements from the
+// root of the document down to it.
+func (r cssRule) matches(path []htmlElement) bool {
+	return matchSelector(r.selector, path)
+}
+
+func matchSelector(selector []cssCompound, path []htmlElement) bool {
+	last := len(selector) - 1
+	if len(path) == 0 || !selector[last].matches(path[len(path)-1]) {
+		return false
+	}
+	if last == 0 {
+		return true
+	}
+	ancestors := path[:len(path)-1]
+	if selector[last].combinator == '>' {
+		return matchSelector(selector[:last], ancestors)
+	}
+	for i := len(ancestors); i > 0; i-- {
+		if matchSelector(selector[:last], ancestors[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c cssCompound) matches(el htmlElement) bool {
+	if c.tag != "" && c.tag != el.tag {
+		return false
+	}
+	if c.id != "" && c.id != el.id {
+		return false
+	}
+	for _, class := range c.classes {
+		if !slices.Contains(el.classes, class) {
+			return false
+		}
+	}
+	for _, attr := range c.attrs {
+		value, ok := el.attrs[attr.name]
+		if !ok {
+			return false
+		}
+		switch attr.operator {
+		case "=":
+			ok = value == attr.value
+		case "~=":
+			ok = slices.Contains(strings.Fields(value), attr.value)
+		case "^=":
+			ok = attr.value != "" && strings.HasPrefix(value, attr.value)
+		case "$=":
+			ok = attr.value != "" && strings.HasSuffix(value, attr.value)
+		case "*=":
+			ok = attr.value != "" && strings.Contains(value, attr.value)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// cascade returns the style attribute of an element selected by rules with the declarations
+// inline in its style attribute, following the CSS cascade: !important declarations win, then
+// inline ones, then those of the more specific selector and then of the later rule.
+func cascade(rules []cssRule, inline []cssDecl) string {
+	type entry struct {
+		decl        cssDecl
+		inline      bool
+		specificity [3]int
+		order       int
+	}
+	var entries []entry
+	for _, rule := range rules {
+		for _, decl := range rule.decls {
+			entries = append(entries, entry{decl: decl, specificity: rule.specificity, order: rule.order})
+		}
+	}
+	for i, decl := range inline {
+		entries = append(entries, entry{decl: decl, inline: true, order: i})
+	}
+	slices.SortStableFunc(entries, func(a, b entry) int {
+		if a.decl.important != b.decl.important {
+			return boolCompare(a.decl.important, b.decl.important)
+		}
+		if a.inline != b.inline {
+			return boolCompare(a.inline, b.inline)
+		}
+		for i := range a.specificity {
+			if a.specificity[i] != b.specificity[i] {
+				return a.specificity[i] - b.specificity[i]
+			}
+		}
+		return a.order - b.order
+	})
+
+	var properties []string
+	values := make(map[string]cssDecl)
+	for _, e := range entries {
+		if _, ok := values[e.decl.property]; !ok {
+			properties = append(properties, e.decl.property)
+		}
+		values[e.decl.property] = e.decl
+	}
+	declarations := make([]string, len(properties))
+	for i, property := range properties {
+		decl := values[property]
+		declarations[i] = property + ": " + decl.value
+		if decl.important {
+			declarations[i] += " !important"
+		}
+	}
+	return strings.Join(declarations, "; ")
+}
+
+func boolCompare(a, b bool) int {
+	if a == b {
+		return 0
+	}
+	if a {
+		return 1
+	}
+	return -1
+}
@@ -0,0 +1,194 @@
+package templates
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localePattern matches the locale part of a localized template name, such as "de" in
+// welcome.de or "pt-br" in welcome.pt-br.
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}([_-][A-Za-z0-9]{2,8})?$`)
+
+// normalizeLocale returns locale in the form used in template names: lower case, with a dash
+// between the language and the region.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
+
+// splitLocale splits a template name into the base name and its locale, which is empty for a
+// template that is not localized.
+func splitLocale(name string) (base, locale string) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 || !localePattern.MatchString(name[i+1:]) {
+		return name, ""
+	}
+	return name[:i], normalizeLocale(name[i+1:])
+}
+
+// canonicalName returns name with its locale, if any, normalized.
+func canonicalName(name string) string {
+	base, locale := splitLocale(name)
+	if locale == "" {
+		return name
+	}
+	return base + "." + locale
+}
+
+// Resolve returns the name of the variant of template name that best matches locale: the
+// variant for the locale itself, then for its language, then the template without a locale,
+// and finally the variants for the default locale. It returns name if there is no variant, so
+// that rendering reports the template as not found.
+func (tm *TemplateManager) Resolve(name, locale string) string {
+	var candidates []string
+	add := func(locale string) {
+		if locale == "" {
+			return
+		}
+		locale = normalizeLocale(locale)
+		candidates = append(candidates, name+"."+locale)
+		if language, _, ok := strings.Cut(locale, "-"); ok {
+			candidates = append(candidates, name+"."+language)
+		}
+	}
+	add(locale)
+	candidates = append(candidates, name)
+	add(tm.cfg.DefaultLocale)
+
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	for _, candidate := range candidates {
+		if _, ok := tm.Templates[candidate]; ok {
+			return candidate
+		}
+	}
+	return name
+}
+
+// localeFormat holds how numbers and dates are written in a language.
+type localeFormat struct {
+	thousands    string
+	decimal      string
+	symbolBefore bool
+	months       [12]string
+	days         [7]string
+}
+
+// localeFormats are the languages the formatting helpers know, keyed by language code. Other
+// locales are formatted as English.
+var localeFormats = map[string]localeFormat{
+	"en": {
+		thousands:    ",",
+		decimal:      ".",
+		symbolBefore: true,
+	},
+	"de": {
+		thousands: ".",
+		decimal:   ",",
+		months:    [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		days:      [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+	},
+	"fr": {
+		thousands: " ",
+		decimal:   ",",
+		months:    [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		days:      [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+	},
+	"es": {
+		thousands: ".",
+		decimal:   ",",
+		months:    [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		days:      [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+	},
+	"it": {
+		thousands: ".",
+		decimal:   ",",
+		months:    [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		days:      [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+	},
+	"nl": {
+		thousands: ".",
+		decimal:   ",",
+		months:    [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		days:      [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+	},
+	"pt": {
+		thousands: ".",
+		decimal:   ",",
+		months:    [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		days:      [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+	},
+}
+
+// formatFor returns the format of locale, falling back to English.
+func formatFor(locale string) localeFormat {
+	language, _, _ := strings.Cut(normalizeLocale(locale), "-")
+	if format, ok := localeFormats[language]; ok {
+		return format
+	}
+	return localeFormats["en"]
+}
+
+// dateNames are the layout elements of month and day names, longest first so that "January"
+// is not taken for "Jan".
+var dateNames = []string{"January", "Monday", "Jan", "Mon"}
+
+// format formats t with the Go layout, writing month and day names in the language.
+func (f localeFormat) format(t time.Time, layout string) string {
+	if f.months[0] == "" {
+		return t.Format(layout)
+	}
+
+	var b strings.Builder
+	for layout != "" {
+		i, element := -1, ""
+		for _, name := range dateNames {
+			if j := strings.Index(layout, name); j >= 0 && (i < 0 || j < i) {
+				i, element = j, name
+			}
+		}
+		if i < 0 {
+			b.WriteString(t.Format(layout))
+			break
+		}
+		b.WriteString(t.Format(layout[:i]))
+		switch element {
+		case "January":
+			b.WriteString(f.months[t.Month()-1])
+		case "Jan":
+			b.WriteString(abbreviate(f.months[t.Month()-1]))
+		case "Monday":
+			b.WriteString(f.days[t.Weekday()])
+		case "Mon":
+			b.WriteString(abbreviate(f.days[t.Weekday()]))
+		}
+		layout = layout[i+len(element):]
+	}
+	return b.String()
+}
+
+// abbreviate returns the first three letters of name.
+func abbreviate(name string) string {
+	runes := []rune(name)
+	if len(runes) > 3 {
+		runes = runes[:3]
+	}
+	return string(runes)
+}
+
+// number formats the non-negative value with the separators of the language.
+func (f localeFormat) number(value float64, decimals int) string {
+	whole, fraction, _ := strings.Cut(strconv.FormatFloat(value, 'f', max(decimals, 0), 64), ".")
+	var b strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(f.thousands)
+		}
+		b.WriteRune(r)
+	}
+	if fraction != "" {
+		b.WriteString(f.decimal + fraction)
+	}
+	return b.String()
+}
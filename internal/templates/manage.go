@@ -0,0 +1,197 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// ErrTemplateNotFound is returned for operations on a template that does not exist.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// ErrInvalidTemplate is wrapped by errors for template names or contents that cannot be saved.
+var ErrInvalidTemplate = errors.New("invalid template")
+
+// validName matches the template names that can be saved, which become file names: a base
+// name, optionally followed by a dot and a locale for a localized variant.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,100}(\.[A-Za-z]{2,3}([_-][A-Za-z0-9]{2,8})?)?$`)
+
+// Source returns the contents of the file template name was loaded from or, for a stored
+// template, of its active version.
+func (tm *TemplateManager) Source(name string) (string, error) {
+	name = canonicalName(name)
+	tm.mu.RLock()
+	path, ok := tm.files[name]
+	_, stored := tm.versions[name]
+	tm.mu.RUnlock()
+	if stored {
+		versions, err := tm.Versions(name)
+		if err != nil {
+			return "", err
+		}
+		for _, v := range versions {
+			if v.Active {
+				return v.Content, nil
+			}
+		}
+		return "", ErrTemplateNotFound
+	}
+	if !ok {
+		return "", ErrTemplateNotFound
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrTemplateNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read template file %s: %v", path, err)
+	}
+	return string(content), nil
+}
+
+// Save parses content as template name and, if it parses, writes it to the templates directory
+// and makes it available at once. An existing template is replaced in the file it was loaded
+// from, so the content of an MJML template is MJML and is compiled first, and content may
+// start with front matter. With a VersionStore, content is HTML and is stored as the new active
+// version instead. created reports whether the template is new.
+func (tm *TemplateManager) Save(name, content string) (created bool, err error) {
+	if !validName.MatchString(name) {
+		return false, fmt.Errorf("%w: name must consist of up to 100 letters, digits, dashes and underscores, optionally followed by a locale, got %q", ErrInvalidTemplate, name)
+	}
+	name = canonicalName(name)
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	path, ok := tm.files[name]
+	if !ok {
+		path = filepath.Join(tm.cfg.Path, name+".html")
+	}
+	sourcePath := path
+	if tm.store != nil {
+		sourcePath = name + ".html"
+	}
+	tmpl, meta, body, err := parseSource(&tm.cfg, name, sourcePath, content)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+	}
+	text := tm.texts[name]
+	if tm.store != nil {
+		text = nil
+	}
+	if tm.cfg.Strict {
+		if err := strictCheck(&tm.cfg, name, path, tmpl, text, meta.Required); err != nil {
+			return false, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+		}
+	}
+	_, existed := tm.Templates[name]
+	if tm.meta == nil {
+		tm.meta = make(map[string]Metadata)
+	}
+	if tm.store != nil {
+		v, err := tm.store.Add(name, content, time.Now())
+		if err != nil {
+			return false, fmt.Errorf("failed to store template %s: %v", name, err)
+		}
+		if tm.versions == nil {
+			tm.versions = make(map[string]int)
+		}
+		tm.versions[name] = v.Version
+		delete(tm.texts, name)
+		tm.Templates[name] = tmpl
+		tm.generation++
+		tm.meta[name] = meta
+		return !existed, nil
+	}
+	if tm.cfg.Path == "" {
+		return false, fmt.Errorf("no templates directory configured")
+	}
+	if err := writeFile(path, []byte(content)); err != nil {
+		return false, fmt.Errorf("failed to write template file %s: %v", path, err)
+	}
+
+	if tm.files == nil {
+		tm.files = make(map[string]string)
+	}
+	tm.files[name] = path
+	tm.Templates[name] = tmpl
+	tm.generation++
+	if text != nil {
+		meta.textTimeDependent = textCallsTime(text)
+	}
+	tm.meta[name] = meta
+	// As when loading, the Markdown is the plain-text version unless there is a companion file.
+	if filepath.Ext(path) == ".md" && usesDefaultEngine(meta) {
+		if _, err := os.Stat(strings.TrimSuffix(path, ".md") + ".txt"); errors.Is(err, os.ErrNotExist) {
+			_, locale := splitLocale(name)
+			if text, err := texttemplate.New(name).Funcs(texttemplate.FuncMap(funcMap(&tm.cfg, locale))).Parse(body); err == nil {
+				if tm.texts == nil {
+					tm.texts = make(map[string]*texttemplate.Template)
+				}
+				tm.texts[name] = text
+				meta.textTimeDependent = textCallsTime(text)
+				tm.meta[name] = meta
+			}
+		}
+	}
+	return !existed, nil
+}
+
+// Delete removes template name along with its file and companion .txt file and, for a stored
+// template, all its versions.
+func (tm *TemplateManager) Delete(name string) error {
+	name = canonicalName(name)
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	path, ok := tm.files[name]
+	_, stored := tm.versions[name]
+	if !ok && !stored {
+		return ErrTemplateNotFound
+	}
+	if stored {
+		if err := tm.store.Delete(name); err != nil {
+			return fmt.Errorf("failed to delete stored template %s: %v", name, err)
+		}
+		delete(tm.versions, name)
+	}
+	if ok {
+		textPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".txt"
+		for _, p := range []string{textPath, path} {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove template file %s: %v", p, err)
+			}
+		}
+	}
+	delete(tm.files, name)
+	delete(tm.texts, name)
+	delete(tm.meta, name)
+	delete(tm.Templates, name)
+	return nil
+}
+
+// writeFile replaces the file at path with data through a temporary file, so that the file is
+// never seen half-written.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".template-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
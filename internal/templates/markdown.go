@@ -0,0 +1,351 @@
+package templates
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"regexp"
+	"strings"
+
+	"runebird/internal/config"
+)
+
+// Markers in the Markdown layout replaced with the converted Markdown and the CSS.
+const (
+	contentMarker = "<!-- content -->"
+	styleMarker   = "<!-- style -->"
+)
+
+// defaultMarkdownLayout wraps converted Markdown when no layout is configured.
+const defaultMarkdownLayout = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<!-- style -->
+</head>
+<body>
+<div class="markdown">
+<!-- content -->
+</div>
+</body>
+</html>
+`
+
+// defaultMarkdownCSS styles converted Markdown when no CSS is configured.
+const defaultMarkdownCSS = `body { margin: 0; padding: 24px; background: #f4f4f5; }
+.markdown { max-width: 600px; margin: 0 auto; padding: 32px; background: #ffffff; border-radius: 8px; font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 16px; line-height: 1.5; color: #18181b; }
+.markdown h1, .markdown h2, .markdown h3 { line-height: 1.25; margin: 0 0 16px; }
+.markdown p, .markdown ul, .markdown ol, .markdown blockquote, .markdown pre { margin: 0 0 16px; }
+.markdown a { color: #2563eb; }
+.markdown blockquote { padding-left: 16px; border-left: 4px solid #d4d4d8; color: #52525b; }
+.markdown code { font-family: Menlo, Consolas, monospace; font-size: 14px; background: #f4f4f5; padding: 2px 4px; border-radius: 4px; }
+.markdown pre code { display: block; padding: 12px; overflow-x: auto; }
+.markdown hr { border: none; border-top: 1px solid #e4e4e7; margin: 24px 0; }
+.markdown img { max-width: 100%; }`
+
+// compileMarkdown converts the Markdown in content to HTML and wraps it in the configured
+// layout and CSS. The template actions in content are kept as they are, so that they are
+// executed, with HTML escaping, when the email is rendered.
+func compileMarkdown(content string, cfg *config.MarkdownConfig) (string, error) {
+	layout := defaultMarkdownLayout
+	if cfg.Layout != "" {
+		data, err := os.ReadFile(cfg.Layout)
+		if err != nil {
+			return "", fmt.Errorf("failed to read Markdown layout %s: %v", cfg.Layout, err)
+		}
+		layout = string(data)
+		if !strings.Contains(layout, contentMarker) {
+			return "", fmt.Errorf("layout %s has no %s marker", cfg.Layout, contentMarker)
+		}
+	}
+	css := defaultMarkdownCSS
+	if cfg.CSS != "" {
+		data, err := os.ReadFile(cfg.CSS)
+		if err != nil {
+			return "", fmt.Errorf("failed to read Markdown CSS %s: %v", cfg.CSS, err)
+		}
+		css = string(data)
+	}
+
+	layout = strings.Replace(layout, styleMarker, "<style>\n"+strings.TrimSpace(css)+"\n</style>", 1)
+	return strings.Replace(layout, contentMarker, markdownToHTML(content), 1), nil
+}
+
+var (
+	headingLine    = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	ruleLine       = regexp.MustCompile(`^ {0,3}([-*_])( *[-*_]){2,} *$`)
+	unorderedItem  = regexp.MustCompile(`^ {0,3}[-*+]\s+(.*)$`)
+	orderedItem    = regexp.MustCompile(`^ {0,3}\d{1,9}[.)]\s+(.*)$`)
+	actionPattern  = regexp.MustCompile(`\{\{.*?\}\}`)
+	blockquoteLine = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	fenceLine      = regexp.MustCompile("^ {0,3}(```|~~~)")
+	trailingSpaces = regexp.MustCompile(`  +$`)
+	wordChar       = regexp.MustCompile(`[A-Za-z0-9]`)
+)
+
+// isActionLine reports whether line holds nothing but template actions, such as
+// {{ range .Items }} or {{ define "subject" }}Welcome{{ end }}. Such lines are kept as they
+// are instead of becoming paragraphs.
+func isActionLine(line string) bool {
+	return strings.Contains(line, "{{") && strings.TrimSpace(actionPattern.ReplaceAllString(line, "")) == ""
+}
+
+// listKind returns "ul" or "ol" for a list item line, with the text of the item, or an empty
+// kind for other lines.
+func listKind(line string) (kind, text string) {
+	if ruleLine.MatchString(line) {
+		return "", ""
+	}
+	if m := unorderedItem.FindStringSubmatch(line); m != nil {
+		return "ul", m[1]
+	}
+	if m := orderedItem.FindStringSubmatch(line); m != nil {
+		return "ol", m[1]
+	}
+	return "", ""
+}
+
+// markdownToHTML converts Markdown to HTML: headings, paragraphs, emphasis, code, links,
+// images, lists, blockquotes and horizontal rules. Text is HTML-escaped, except for template
+// actions. Lines holding only template actions stay outside paragraphs, and inside a list that
+// they precede or follow, so that {{ range }} and {{ if }} can repeat or hide list items.
+func markdownToHTML(src string) string {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	var paragraph, item []string
+	list := ""
+
+	closeParagraph := func() {
+		if len(paragraph) > 0 {
+			b.WriteString("<p>" + strings.Join(paragraph, "\n") + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeItem := func() {
+		if len(item) > 0 {
+			b.WriteString("<li>" + strings.Join(item, "\n") + "</li>\n")
+			item = nil
+		}
+	}
+	closeList := func() {
+		closeItem()
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	closeBlocks := func() {
+		closeParagraph()
+		closeList()
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			closeBlocks()
+
+		case isActionLine(line):
+			closeParagraph()
+			closeItem()
+			if list == "" {
+				next := i + 1
+				for next < len(lines) && isActionLine(lines[next]) {
+					next++
+				}
+				if next < len(lines) {
+					list, _ = listKind(lines[next])
+					if list != "" {
+						b.WriteString("<" + list + ">\n")
+					}
+				}
+			}
+			b.WriteString(strings.TrimSpace(line) + "\n")
+
+		case fenceLine.MatchString(line):
+			closeBlocks()
+			fence := fenceLine.FindStringSubmatch(line)[1]
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimLeft(lines[i], " "), fence); i++ {
+				code = append(code, escapeText(lines[i]))
+			}
+			b.WriteString("<pre><code>" + strings.Join(code, "\n") + "</code></pre>\n")
+
+		case headingLine.MatchString(line):
+			closeBlocks()
+			m := headingLine.FindStringSubmatch(line)
+			level := len(m[1])
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", level, inlineMarkdown(m[2]), level)
+
+		case ruleLine.MatchString(line):
+			closeBlocks()
+			b.WriteString("<hr>\n")
+
+		case blockquoteLine.MatchString(line):
+			closeBlocks()
+			var quoted []string
+			for ; i < len(lines) && blockquoteLine.MatchString(lines[i]); i++ {
+				quoted = append(quoted, blockquoteLine.FindStringSubmatch(lines[i])[1])
+			}
+			i--
+			b.WriteString("<blockquote>\n" + markdownToHTML(strings.Join(quoted, "\n")) + "</blockquote>\n")
+
+		default:
+			kind, text := listKind(line)
+			switch {
+			case kind != "":
+				closeParagraph()
+				closeItem()
+				if list != kind {
+					closeList()
+					list = kind
+					b.WriteString("<" + list + ">\n")
+				}
+				item = append(item, inlineLine(text))
+			case len(item) > 0 && strings.HasPrefix(line, " "):
+				// An indented line continues the list item.
+				item = append(item, inlineLine(strings.TrimLeft(line, " \t")))
+			default:
+				closeList()
+				paragraph = append(paragraph, inlineLine(strings.TrimLeft(line, " \t")))
+			}
+		}
+	}
+	closeBlocks()
+	return b.String()
+}
+
+// inlineLine converts the inline Markdown of line, ending it with a line break if it ends with
+// two or more spaces.
+func inlineLine(line string) string {
+	if trailingSpaces.MatchString(line) {
+		return inlineMarkdown(trailingSpaces.ReplaceAllString(line, "")) + "<br>"
+	}
+	return inlineMarkdown(line)
+}
+
+// inlineMarkdown converts emphasis, code spans, links and images in s to HTML, escaping the
+// text around them.
+func inlineMarkdown(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case strings.HasPrefix(rest, "{{"):
+			end := strings.Index(rest, "}}")
+			if end < 0 {
+				b.WriteString(html.EscapeString(rest))
+				return b.String()
+			}
+			b.WriteString(rest[:end+2])
+			i += end + 2
+
+		case rest[0] == '\\' && len(rest) > 1 && strings.ContainsRune("\\`*_[]()#+-.!>", rune(rest[1])):
+			b.WriteString(html.EscapeString(rest[1:2]))
+			i += 2
+
+		case rest[0] == '`':
+			end := strings.IndexByte(rest[1:], '`')
+			if end < 0 {
+				b.WriteString("`")
+				i++
+				continue
+			}
+			b.WriteString("<code>" + escapeText(rest[1:end+1]) + "</code>")
+			i += end + 2
+
+		case strings.HasPrefix(rest, "!["):
+			if text, url, n, ok := parseLink(rest[1:]); ok {
+				b.WriteString(`<img src="` + escapeText(url) + `" alt="` + escapeText(text) + `">`)
+				i += n + 1
+				continue
+			}
+			b.WriteString("!")
+			i++
+
+		case rest[0] == '[':
+			if text, url, n, ok := parseLink(rest); ok {
+				b.WriteString(`<a href="` + escapeText(url) + `">` + inlineMarkdown(text) + "</a>")
+				i += n
+				continue
+			}
+			b.WriteString("[")
+			i++
+
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if end := strings.Index(rest[2:], rest[:2]); end > 0 {
+				b.WriteString("<strong>" + inlineMarkdown(rest[2:end+2]) + "</strong>")
+				i += end + 4
+				continue
+			}
+			b.WriteString(html.EscapeString(rest[:2]))
+			i += 2
+
+		case rest[0] == '*' || rest[0] == '_':
+			// An underscore within a word, as in snake_case, is not emphasis.
+			if rest[0] == '_' && i > 0 && wordChar.MatchString(s[i-1:i]) {
+				b.WriteByte('_')
+				i++
+				continue
+			}
+			if end := strings.IndexByte(rest[1:], rest[0]); end > 0 && rest[1] != ' ' {
+				b.WriteString("<em>" + inlineMarkdown(rest[1:end+1]) + "</em>")
+				i += end + 2
+				continue
+			}
+			b.WriteByte(rest[0])
+			i++
+
+		default:
+			end := strings.IndexAny(rest[1:], "{\\`![*_")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			b.WriteString(html.EscapeString(rest[:end+1]))
+			i += end + 1
+		}
+	}
+	return b.String()
+}
+
+// parseLink parses a link of the form [text](url) at the start of s, returning its text, its
+// URL and its length.
+func parseLink(s string) (text, url string, n int, ok bool) {
+	closeText := strings.Index(s, "](")
+	if !strings.HasPrefix(s, "[") || closeText < 0 {
+		return "", "", 0, false
+	}
+	closeURL := strings.IndexByte(s[closeText+2:], ')')
+	if closeURL < 0 {
+		return "", "", 0, false
+	}
+	// Template actions may contain parentheses, so the URL ends after the last of them.
+	url = s[closeText+2 : closeText+2+closeURL]
+	if open := strings.LastIndex(url, "{{"); open >= 0 && !strings.Contains(url[open:], "}}") {
+		end := strings.Index(s[closeText+2:], "}}")
+		if end < 0 {
+			return "", "", 0, false
+		}
+		closeURL = strings.IndexByte(s[closeText+2+end:], ')')
+		if closeURL < 0 {
+			return "", "", 0, false
+		}
+		closeURL += end
+		url = s[closeText+2 : closeText+2+closeURL]
+	}
+	return s[1:closeText], strings.TrimSpace(url), closeText + 3 + closeURL, true
+}
+
+// escapeText escapes s for HTML, keeping the template actions in it as they are.
+func escapeText(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range actionPattern.FindAllStringIndex(s, -1) {
+		b.WriteString(html.EscapeString(s[last:loc[0]]))
+		b.WriteString(s[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(html.EscapeString(s[last:]))
+	return b.String()
+}
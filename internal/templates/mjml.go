@@ -0,0 +1,37 @@
+package templates
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// mjmlTimeout bounds a single run of the MJML compiler, so that a hung compiler cannot block
+// loading the templates.
+const mjmlTimeout = 30 * time.Second
+
+// compileMJML returns the HTML the MJML compiler command produces from content.
+func compileMJML(content string, mjml []string) (string, error) {
+	if len(mjml) == 0 {
+		return "", errors.New("no MJML compiler configured, set templates.mjml_command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mjmlTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, mjml[0], mjml[1:]...)
+	cmd.Stdin = strings.NewReader(content)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("failed to compile MJML: %v: %s", err, msg)
+		}
+		return "", fmt.Errorf("failed to compile MJML: %v", err)
+	}
+	return stdout.String(), nil
+}
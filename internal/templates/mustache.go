@@ -0,0 +1,223 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// mustacheEngine parses Mustache templates, as written for Handlebars too as long as they do
+// not use helpers: variables, escaped by default and not with {{{name}}} or {{& name}},
+// sections, inverted sections, comments and set delimiters. Partials and lambdas are not
+// supported. Names are looked up in the data of the enclosing sections, innermost first.
+type mustacheEngine struct{}
+
+func (mustacheEngine) Parse(name, source string, funcs template.FuncMap) (Executor, error) {
+	p := &mustacheParser{src: source, open: "{{", close: "}}"}
+	nodes, err := p.parse("")
+	if err != nil {
+		return nil, err
+	}
+	return func(w io.Writer, data interface{}) error {
+		var b strings.Builder
+		renderMustache(&b, nodes, []interface{}{data})
+		_, err := io.WriteString(w, b.String())
+		return err
+	}, nil
+}
+
+// Kinds of Mustache nodes.
+const (
+	mustacheText = iota
+	mustacheVariable
+	mustacheRaw
+	mustacheSection
+	mustacheInverted
+)
+
+// mustacheNode is a piece of text, a variable or a section of a Mustache template. name is the
+// text itself for text.
+type mustacheNode struct {
+	kind     int
+	name     string
+	children []mustacheNode
+}
+
+type mustacheParser struct {
+	src         string
+	pos         int
+	open, close string
+}
+
+// parse parses the nodes up to the end of section, or of the template if section is empty.
+func (p *mustacheParser) parse(section string) ([]mustacheNode, error) {
+	var nodes []mustacheNode
+	for {
+		i := strings.Index(p.src[p.pos:], p.open)
+		if i < 0 {
+			if section != "" {
+				return nil, fmt.Errorf("section %q is not closed", section)
+			}
+			if p.pos < len(p.src) {
+				nodes = append(nodes, mustacheNode{kind: mustacheText, name: p.src[p.pos:]})
+			}
+			return nodes, nil
+		}
+		if i > 0 {
+			nodes = append(nodes, mustacheNode{kind: mustacheText, name: p.src[p.pos : p.pos+i]})
+		}
+		p.pos += i + len(p.open)
+
+		closing := p.close
+		if strings.HasPrefix(p.src[p.pos:], "{") {
+			closing = "}" + p.close
+		}
+		end := strings.Index(p.src[p.pos:], closing)
+		if end < 0 {
+			return nil, errors.New("tag is not closed")
+		}
+		tag := strings.TrimSpace(p.src[p.pos : p.pos+end])
+		p.pos += end + len(closing)
+		if tag == "" {
+			return nil, errors.New("empty tag")
+		}
+
+		name := strings.TrimSpace(tag[1:])
+		switch tag[0] {
+		case '!':
+		case '{', '&':
+			nodes = append(nodes, mustacheNode{kind: mustacheRaw, name: name})
+		case '#', '^':
+			children, err := p.parse(name)
+			if err != nil {
+				return nil, err
+			}
+			kind := mustacheSection
+			if tag[0] == '^' {
+				kind = mustacheInverted
+			}
+			nodes = append(nodes, mustacheNode{kind: kind, name: name, children: children})
+		case '/':
+			if name != section {
+				return nil, fmt.Errorf("unexpected closing tag %q", name)
+			}
+			return nodes, nil
+		case '>':
+			return nil, fmt.Errorf("partial %q: partials are not supported", name)
+		case '=':
+			delimiters := strings.Fields(strings.TrimSuffix(name, "="))
+			if !strings.HasSuffix(name, "=") || len(delimiters) != 2 {
+				return nil, fmt.Errorf("invalid delimiters %q", tag)
+			}
+			p.open, p.close = delimiters[0], delimiters[1]
+		default:
+			nodes = append(nodes, mustacheNode{kind: mustacheVariable, name: tag})
+		}
+	}
+}
+
+// renderMustache writes nodes to b with the data of the enclosing sections in stack.
+func renderMustache(b *strings.Builder, nodes []mustacheNode, stack []interface{}) {
+	for _, n := range nodes {
+		switch n.kind {
+		case mustacheText:
+			b.WriteString(n.name)
+		case mustacheVariable:
+			b.WriteString(html.EscapeString(mustacheString(mustacheLookup(stack, n.name))))
+		case mustacheRaw:
+			b.WriteString(mustacheString(mustacheLookup(stack, n.name)))
+		case mustacheSection:
+			value := mustacheLookup(stack, n.name)
+			if !mustacheTruthy(value) {
+				continue
+			}
+			if v := reflect.ValueOf(value); v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+				for i := 0; i < v.Len(); i++ {
+					renderMustache(b, n.children, append(stack, v.Index(i).Interface()))
+				}
+				continue
+			}
+			renderMustache(b, n.children, append(stack, value))
+		case mustacheInverted:
+			if !mustacheTruthy(mustacheLookup(stack, n.name)) {
+				renderMustache(b, n.children, stack)
+			}
+		}
+	}
+}
+
+// mustacheLookup returns the value of name, such as . for the current data or a dotted name
+// like user.name, in the innermost data of stack that has its first part.
+func mustacheLookup(stack []interface{}, name string) interface{} {
+	if name == "." {
+		return stack[len(stack)-1]
+	}
+	parts := strings.Split(name, ".")
+	for i := len(stack) - 1; i >= 0; i-- {
+		value, ok := mustacheField(stack[i], parts[0])
+		if !ok {
+			continue
+		}
+		for _, part := range parts[1:] {
+			if value, ok = mustacheField(value, part); !ok {
+				return nil
+			}
+		}
+		return value
+	}
+	return nil
+}
+
+// mustacheField returns the value of key in data, a map or a struct.
+func mustacheField(data interface{}, key string) (interface{}, bool) {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		if value := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())); value.IsValid() {
+			return value.Interface(), true
+		}
+	case reflect.Struct:
+		if field := v.FieldByName(key); field.IsValid() && field.CanInterface() {
+			return field.Interface(), true
+		}
+	}
+	return nil, false
+}
+
+// mustacheTruthy reports whether a section is rendered for value: it is not if value is
+// missing, false, or an empty string, list or map.
+func mustacheTruthy(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return false
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len() > 0
+	case reflect.Pointer, reflect.Interface:
+		return !v.IsNil()
+	}
+	return true
+}
+
+// mustacheString formats value for a variable, missing values as nothing.
+func mustacheString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,257 @@
+package templates
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/logger"
+	"runebird/internal/sigv4"
+)
+
+// remoteTimeout bounds a single request to the bucket.
+const remoteTimeout = 30 * time.Second
+
+// RemoteSource mirrors the template files under a prefix of an S3-compatible bucket into the
+// templates directory. Objects are listed on every sync and only those whose ETag changed are
+// downloaded; files of objects removed from the bucket since they were synced are deleted.
+type RemoteSource struct {
+	cfg       *config.RemoteConfig
+	dir       string
+	base      *url.URL
+	pathStyle bool
+	creds     sigv4.Credentials
+	http      *http.Client
+	now       func() time.Time
+	etags     map[string]string
+	syncMu    sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	isRunning bool
+}
+
+// NewRemote creates the remote source configured under templates.remote, syncing into the
+// templates directory.
+func NewRemote(cfg *config.TemplatesConfig) (*RemoteSource, error) {
+	remote := &cfg.Remote
+	creds := sigv4.Resolve(remote.AccessKeyID, remote.SecretAccessKey, remote.SessionToken)
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("invalid remote templates configuration: no credentials configured")
+	}
+
+	// The AWS endpoint addresses the bucket by host name; other services take it in the path.
+	endpoint, pathStyle := fmt.Sprintf("https://%s.s3.%s.amazonaws.com", remote.Bucket, remote.Region), false
+	if remote.Endpoint != "" {
+		endpoint, pathStyle = strings.TrimSuffix(remote.Endpoint, "/"), true
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote templates endpoint %s: %v", endpoint, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RemoteSource{
+		cfg:       remote,
+		dir:       cfg.Path,
+		base:      base,
+		pathStyle: pathStyle,
+		creds:     creds,
+		http:      &http.Client{Timeout: remoteTimeout},
+		now:       time.Now,
+		etags:     make(map[string]string),
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+// listBucketResult is the response of the S3 ListObjectsV2 API.
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Sync brings the templates directory up to date with the bucket and reports whether any file
+// changed.
+func (r *RemoteSource) Sync(ctx context.Context) (changed bool, err error) {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	objects := make(map[string]string)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {r.cfg.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := r.get(ctx, "", query)
+		if err != nil {
+			return false, fmt.Errorf("failed to list remote templates: %v", err)
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return false, fmt.Errorf("failed to list remote templates: %v", err)
+		}
+		for _, object := range result.Contents {
+			if r.localPath(object.Key) != "" {
+				objects[object.Key] = object.ETag
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	for key, etag := range objects {
+		if r.etags[key] == etag {
+			continue
+		}
+		content, err := r.get(ctx, key, nil)
+		if err != nil {
+			return changed, fmt.Errorf("failed to download remote template %s: %v", key, err)
+		}
+		local := r.localPath(key)
+		if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+			return changed, fmt.Errorf("failed to create directory for %s: %v", local, err)
+		}
+		if err := writeFile(local, content); err != nil {
+			return changed, fmt.Errorf("failed to write template file %s: %v", local, err)
+		}
+		r.etags[key] = etag
+		changed = true
+	}
+	for key := range r.etags {
+		if _, ok := objects[key]; ok {
+			continue
+		}
+		local := r.localPath(key)
+		if err := os.Remove(local); err != nil && !os.IsNotExist(err) {
+			return changed, fmt.Errorf("failed to remove template file %s: %v", local, err)
+		}
+		delete(r.etags, key)
+		changed = true
+	}
+	return changed, nil
+}
+
+// localPath returns the file in the templates directory that the object with the given key is
+// synced to, or an empty string for objects that are not template files or that would end up
+// outside the directory.
+func (r *RemoteSource) localPath(key string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, r.cfg.Prefix), "/")
+	switch path.Ext(rel) {
+	case ".html", ".mjml", ".md", ".mustache", ".hbs", ".txt", ".json":
+	default:
+		return ""
+	}
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return ""
+	}
+	return filepath.Join(r.dir, filepath.FromSlash(rel))
+}
+
+// get fetches the object with the given key, or the bucket itself if key is empty, with a
+// signed request.
+func (r *RemoteSource) get(ctx context.Context, key string, query url.Values) ([]byte, error) {
+	u := *r.base
+	if r.pathStyle {
+		u.Path = u.Path + "/" + r.cfg.Bucket + "/" + key
+	} else {
+		u.Path = u.Path + "/" + key
+	}
+	u.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, remoteTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Amz-Content-Sha256", sigv4.PayloadHash(nil))
+	sigv4.Sign(req, nil, r.creds, r.cfg.Region, "s3", r.now())
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// Start syncs the templates directory every sync interval and reloads tm whenever it changed,
+// until Stop is called. Sync and reload failures are logged, and the templates in use are kept.
+func (r *RemoteSource) Start(tm *TemplateManager, log *logger.Logger) {
+	r.mu.Lock()
+	if r.isRunning {
+		r.mu.Unlock()
+		return
+	}
+	r.isRunning = true
+	r.mu.Unlock()
+
+	go r.run(tm, log)
+	log.Info("Syncing templates from remote bucket", zap.String("bucket", r.cfg.Bucket), zap.String("prefix", r.cfg.Prefix), zap.Duration("interval", r.cfg.SyncInterval))
+}
+
+// Stop halts the syncing.
+func (r *RemoteSource) Stop() {
+	r.mu.Lock()
+	if !r.isRunning {
+		r.mu.Unlock()
+		return
+	}
+	r.isRunning = false
+	r.mu.Unlock()
+
+	r.cancel()
+}
+
+func (r *RemoteSource) run(tm *TemplateManager, log *logger.Logger) {
+	ticker := time.NewTicker(r.cfg.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// A sync that fails part way may still have changed some files, which are loaded.
+		changed, err := r.Sync(r.ctx)
+		if err != nil && r.ctx.Err() == nil {
+			log.Error("Failed to sync remote templates", zap.Error(err))
+		}
+		if !changed {
+			continue
+		}
+		if err := tm.Reload(); err != nil {
+			log.Error("Failed to reload synced templates, keeping the previous versions", zap.Error(err))
+			continue
+		}
+		log.Info("Templates synced from remote bucket", zap.Int("templates", len(tm.ListTemplates())))
+	}
+}
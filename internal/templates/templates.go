@@ -2,61 +2,350 @@ package templates
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"html"
 	"html/template"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
 
+	"go.uber.org/zap"
 	"runebird/internal/config"
+	"runebird/internal/email"
+	"runebird/internal/logger"
 )
 
+// TemplateManager renders the email templates in the templates directory, along with those
+// kept in a VersionStore, if one is used. The templates can be reloaded while the service runs,
+// either explicitly with Reload or by watching the directory for changes.
 type TemplateManager struct {
 	Templates map[string]*template.Template
+	cfg       config.TemplatesConfig
+	texts     map[string]*texttemplate.Template
+	files     map[string]string
+	meta      map[string]Metadata
+	store     VersionStore
+	versions  map[string]int
+	cache     *renderCache
+	// generation counts the changes to the templates, so that cached renders of a previous
+	// version are not used.
+	generation uint64
+	mu         sync.RWMutex
+	cancel     context.CancelFunc
 }
 
 func New(cfg *config.TemplatesConfig) (*TemplateManager, error) {
-	tm := &TemplateManager{
-		Templates: make(map[string]*template.Template),
+	return NewWithStore(cfg, nil)
+}
+
+// NewWithStore creates a TemplateManager that also renders the active version of every
+// template in store, and saves templates there from then on so that their history is kept. A
+// stored template takes precedence over a file of the same name in the templates directory.
+func NewWithStore(cfg *config.TemplatesConfig, store VersionStore) (*TemplateManager, error) {
+	parsed, err := parseDir(cfg)
+	if err == nil && store != nil {
+		err = loadStored(cfg, store, parsed)
 	}
+	if err == nil {
+		err = joinFailures(parsed.failed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load templates from %s: %v", cfg.Path, err)
+	}
+
+	if len(parsed.templates) == 0 {
+		return nil, fmt.Errorf("no templates found in directory %s", cfg.Path)
+	}
+
+	return &TemplateManager{
+		Templates: parsed.templates,
+		cfg:       *cfg,
+		texts:     parsed.texts,
+		files:     parsed.files,
+		meta:      parsed.meta,
+		store:     store,
+		versions:  parsed.versions,
+		cache:     newRenderCache(cfg.RenderCacheSize),
+	}, nil
+}
+
+// parsedDir holds the contents of a templates directory by template name: the templates, their
+// companion plain-text templates, the files the templates were read from, their front matter,
+// the active versions of the stored templates and the errors of the templates that failed to
+// load.
+type parsedDir struct {
+	templates map[string]*template.Template
+	texts     map[string]*texttemplate.Template
+	files     map[string]string
+	meta      map[string]Metadata
+	versions  map[string]int
+	failed    map[string]error
+}
 
+// parseDir parses every .html file in the templates directory, every .mjml file compiled with
+// the MJML command and every .md file converted from Markdown, along with the .txt file of the
+// same name next to it, if any.
+// Templates that fail to compile or parse are left out of the templates and reported as
+// failed, as are those with problems in strict mode; err is set if the directory cannot be
+// read. The helper functions are available in every template and format for the locale in its
+// name.
+func parseDir(cfg *config.TemplatesConfig) (*parsedDir, error) {
+	parsed := &parsedDir{
+		templates: make(map[string]*template.Template),
+		texts:     make(map[string]*texttemplate.Template),
+		files:     make(map[string]string),
+		meta:      make(map[string]Metadata),
+		versions:  make(map[string]int),
+		failed:    make(map[string]error),
+	}
 	err := filepath.Walk(cfg.Path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() || filepath.Ext(path) != ".html" {
+		if info.IsDir() || !isTemplateFile(path) && filepath.Ext(path) != ".txt" {
 			return nil
 		}
 
+		name := canonicalName(templateName(path))
+		_, locale := splitLocale(name)
+		funcs := funcMap(cfg, locale)
+		if filepath.Ext(path) == ".txt" {
+			// Files are walked in lexical order, so the template a .txt file belongs to has
+			// been seen already. A .txt file without a template next to it is ignored.
+			if other, ok := parsed.files[name]; !ok || filepath.Dir(other) != filepath.Dir(path) {
+				return nil
+			}
+		}
+
 		content, err := os.ReadFile(path)
 		if err != nil {
 			return fmt.Errorf("failed to read template file %s: %v", path, err)
 		}
 
-		name := filepath.Base(path[:len(path)-len(".html")])
-		tmpl, err := template.New(name).Parse(string(content))
+		if filepath.Ext(path) == ".txt" {
+			tmpl, err := texttemplate.New(name).Funcs(texttemplate.FuncMap(funcs)).Parse(string(content))
+			if err != nil {
+				parsed.failed[name] = errors.Join(parsed.failed[name], fmt.Errorf("failed to parse text template %s: %v", name, err))
+				return nil
+			}
+			parsed.texts[name] = tmpl
+			if meta, ok := parsed.meta[name]; ok {
+				meta.textTimeDependent = textCallsTime(tmpl)
+				parsed.meta[name] = meta
+			}
+			return nil
+		}
+		if other, ok := parsed.files[name]; ok {
+			delete(parsed.templates, name)
+			parsed.failed[name] = fmt.Errorf("template %s is defined by both %s and %s", name, other, path)
+			return nil
+		}
+		parsed.files[name] = path
+		tmpl, meta, body, err := parseSource(cfg, name, path, string(content))
 		if err != nil {
-			return fmt.Errorf("failed to parse template %s: %v", name, err)
+			parsed.failed[name] = err
+			return nil
 		}
 
-		tm.Templates[name] = tmpl
+		parsed.templates[name] = tmpl
+		if filepath.Ext(path) == ".md" && usesDefaultEngine(meta) {
+			// The Markdown reads well as the plain-text version, unless a companion .txt
+			// file, which is walked next, replaces it.
+			if text, err := texttemplate.New(name).Funcs(texttemplate.FuncMap(funcs)).Parse(body); err == nil {
+				parsed.texts[name] = text
+				meta.textTimeDependent = textCallsTime(text)
+			}
+		}
+		parsed.meta[name] = meta
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Strict {
+		for name, tmpl := range parsed.templates {
+			if err := strictCheck(cfg, name, parsed.files[name], tmpl, parsed.texts[name], parsed.meta[name].Required); err != nil {
+				delete(parsed.templates, name)
+				delete(parsed.texts, name)
+				parsed.failed[name] = err
+			}
+		}
+	}
+	return parsed, nil
+}
 
+// joinFailures joins the parse errors of the failed templates in name order.
+func joinFailures(failed map[string]error) error {
+	names := slices.Sorted(maps.Keys(failed))
+	errs := make([]error, len(names))
+	for i, name := range names {
+		errs[i] = failed[name]
+	}
+	return errors.Join(errs...)
+}
+
+// Reload parses the templates directory and the active stored versions again and swaps in the
+// new templates at once. A template that fails to parse keeps its previous version, and the
+// parse errors are returned. Templates whose files were removed are dropped. If the directory
+// or the store cannot be read, every template is kept.
+func (tm *TemplateManager) Reload() error {
+	parsed, err := parseDir(&tm.cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load templates from %s: %v", cfg.Path, err)
+		return fmt.Errorf("failed to load templates from %s: %v", tm.cfg.Path, err)
+	}
+	tm.mu.RLock()
+	store := tm.store
+	tm.mu.RUnlock()
+	if store != nil {
+		if err := loadStored(&tm.cfg, store, parsed); err != nil {
+			return err
+		}
 	}
 
-	if len(tm.Templates) == 0 {
-		return nil, fmt.Errorf("no templates found in directory %s", cfg.Path)
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for name := range parsed.failed {
+		if old, ok := tm.Templates[name]; ok {
+			parsed.templates[name] = old
+			if text, ok := tm.texts[name]; ok {
+				parsed.texts[name] = text
+			} else {
+				delete(parsed.texts, name)
+			}
+			if version, ok := tm.versions[name]; ok {
+				parsed.versions[name] = version
+			}
+			parsed.meta[name] = tm.meta[name]
+		}
 	}
+	tm.Templates = parsed.templates
+	tm.texts = parsed.texts
+	tm.files = parsed.files
+	tm.meta = parsed.meta
+	tm.versions = parsed.versions
+	tm.generation++
+	return joinFailures(parsed.failed)
+}
 
-	return tm, nil
+// Watch reloads the templates whenever a file in the templates directory changes, checking
+// every interval until Stop is called. Reload failures are logged.
+func (tm *TemplateManager) Watch(interval time.Duration, log *logger.Logger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tm.mu.Lock()
+	if tm.cancel != nil {
+		tm.mu.Unlock()
+		cancel()
+		return
+	}
+	tm.cancel = cancel
+	tm.mu.Unlock()
+
+	go tm.watch(ctx, interval, stampDir(tm.cfg.Path), log)
+	log.Info("Watching templates for changes", zap.String("path", tm.cfg.Path), zap.Duration("interval", interval))
 }
 
-func (tm *TemplateManager) Render(name string, data interface{}) (body string, subject string, err error) {
+// Stop stops watching the templates directory.
+func (tm *TemplateManager) Stop() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.cancel != nil {
+		tm.cancel()
+		tm.cancel = nil
+	}
+}
+
+// fileStamp identifies a version of a template file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watch reloads the templates whenever the stamps of their files differ from stamps.
+func (tm *TemplateManager) watch(ctx context.Context, interval time.Duration, stamps map[string]fileStamp, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := stampDir(tm.cfg.Path)
+		if maps.Equal(current, stamps) {
+			continue
+		}
+		stamps = current
+		if err := tm.Reload(); err != nil {
+			log.Error("Failed to reload templates, keeping the previous versions", zap.Error(err))
+			continue
+		}
+		log.Info("Templates reloaded", zap.Int("templates", len(tm.ListTemplates())))
+	}
+}
+
+// stampDir returns the stamps of the template files under dir, or nil if it cannot be read.
+func stampDir(dir string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (isTemplateFile(path) || filepath.Ext(path) == ".txt") {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	return stamps
+}
+
+// lookup returns the current version of template name and the generation of the templates it
+// belongs to.
+func (tm *TemplateManager) lookup(name string) (*template.Template, uint64, bool) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
 	tmpl, ok := tm.Templates[name]
+	return tmpl, tm.generation, ok
+}
+
+// Metadata returns what the front matter of template name declares.
+func (tm *TemplateManager) Metadata(name string) Metadata {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.meta[name]
+}
+
+// Render renders the body and subject of template name with data. The subject comes from the
+// "subject" block or the front matter, and is empty if neither declares one. The preheader, if
+// declared, is added to the body as hidden text, and the CSS is inlined if so configured. The
+// configured global variables and defaults are added to data first, and data still lacking a
+// field the front matter requires is refused with ErrMissingData. With a render cache, the
+// email is rendered only once for the same template and data, unless the template calls now.
+func (tm *TemplateManager) Render(name string, data interface{}) (body string, subject string, err error) {
+	tmpl, generation, ok := tm.lookup(name)
 	if !ok {
-		return "", "", fmt.Errorf("template %s not found", name)
+		return "", "", fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	data = withDefaults(&tm.cfg, name, data)
+	meta := tm.Metadata(name)
+	if missing := missingFields(meta.Required, data); len(missing) > 0 {
+		return "", "", fmt.Errorf("%w for template %s: %s", ErrMissingData, name, strings.Join(missing, ", "))
+	}
+	key, cacheable := tm.cache.key("html", name, generation, data)
+	cacheable = cacheable && !meta.timeDependent
+	if cached, ok := tm.cache.get(key); cacheable && ok {
+		return cached.body, cached.subject, nil
 	}
 
 	var bodyBuf bytes.Buffer
@@ -65,6 +354,23 @@ func (tm *TemplateManager) Render(name string, data interface{}) (body string, s
 	}
 	body = bodyBuf.String()
 
+	if preheaderTmpl := tmpl.Lookup("preheader"); preheaderTmpl != nil {
+		var preheaderBuf bytes.Buffer
+		if err := preheaderTmpl.Execute(&preheaderBuf, data); err != nil {
+			return "", "", fmt.Errorf("failed to render preheader for template %s: %v", name, err)
+		}
+		if preheader := strings.TrimSpace(preheaderBuf.String()); preheader != "" {
+			body = insertPreheader(body, preheader)
+		}
+	}
+	inline := tm.cfg.InlineCSS
+	if meta.InlineCSS != nil {
+		inline = *meta.InlineCSS
+	}
+	if inline {
+		body = inlineCSS(body)
+	}
+
 	subjectTmpl := tmpl.Lookup("subject")
 	if subjectTmpl != nil {
 		var subjectBuf bytes.Buffer
@@ -74,10 +380,92 @@ func (tm *TemplateManager) Render(name string, data interface{}) (body string, s
 		subject = subjectBuf.String()
 	}
 
+	if cacheable {
+		tm.cache.add(key, rendered{body: body, subject: subject})
+	}
 	return body, subject, nil
 }
 
+// RenderText renders the plain-text version of a template from its companion .txt file or the
+// source of a Markdown template or, without either, from its "text" block, if it defines one.
+// It returns an empty string otherwise, in which case the text is derived from the HTML.
+func (tm *TemplateManager) RenderText(name string, data interface{}) (string, error) {
+	tmpl, generation, ok := tm.lookup(name)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	data = withDefaults(&tm.cfg, name, data)
+	key, cacheable := tm.cache.key("text", name, generation, data)
+	tm.mu.RLock()
+	meta := tm.meta[name]
+	tm.mu.RUnlock()
+	cacheable = cacheable && !meta.timeDependent && !meta.textTimeDependent
+	if cached, ok := tm.cache.get(key); cacheable && ok {
+		return cached.body, nil
+	}
+	text, err := tm.renderText(name, tmpl, data)
+	if err == nil && cacheable {
+		tm.cache.add(key, rendered{body: text})
+	}
+	return text, err
+}
+
+// renderText renders the plain-text version of tmpl, the current version of template name.
+func (tm *TemplateManager) renderText(name string, tmpl *template.Template, data interface{}) (string, error) {
+	tm.mu.RLock()
+	companion := tm.texts[name]
+	tm.mu.RUnlock()
+	if companion != nil {
+		var textBuf bytes.Buffer
+		if err := companion.Execute(&textBuf, data); err != nil {
+			return "", fmt.Errorf("failed to render text for template %s: %v", name, err)
+		}
+		return textBuf.String(), nil
+	}
+
+	textTmpl := tmpl.Lookup("text")
+	if textTmpl == nil {
+		return "", nil
+	}
+
+	var textBuf bytes.Buffer
+	if err := textTmpl.Execute(&textBuf, data); err != nil {
+		return "", fmt.Errorf("failed to render text for template %s: %v", name, err)
+	}
+	// The block is executed as HTML, so undo the escaping for the plain-text part.
+	return html.UnescapeString(textBuf.String()), nil
+}
+
+// Headers returns the header fields for an email rendered from template name: the configured
+// List-Unsubscribe headers, if they apply to the template, overridden by any of extra.
+func (tm *TemplateManager) Headers(name string, recipients []string, extra map[string]string) map[string]string {
+	unsubscribe := tm.cfg.Unsubscribe.Mailto != "" || tm.cfg.Unsubscribe.URL != ""
+	if unsubscribe && len(tm.cfg.Unsubscribe.Templates) > 0 {
+		unsubscribe = false
+		for _, t := range tm.cfg.Unsubscribe.Templates {
+			if t == name {
+				unsubscribe = true
+				break
+			}
+		}
+	}
+	if !unsubscribe {
+		return extra
+	}
+
+	headers := email.UnsubscribeHeaders(&tm.cfg.Unsubscribe, recipients)
+	if headers == nil {
+		return extra
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+	return headers
+}
+
 func (tm *TemplateManager) ListTemplates() []string {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
 	names := make([]string, 0, len(tm.Templates))
 	for name := range tm.Templates {
 		names = append(names, name)
@@ -1,12 +1,25 @@
 package templates
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"runebird/internal/config"
+	"runebird/internal/email"
+	"runebird/internal/logger"
 )
 
 func TestTemplateManager(t *testing.T) {
@@ -22,6 +35,7 @@ func TestTemplateManager(t *testing.T) {
 `,
 		"notification.html": `
 {{ define "subject" }}Notification for {{ .User }}{{ end }}
+{{ define "text" }}You have a new notification, {{ .User }}.{{ end }}
 <html>
 <body>
 	<p>You have a new notification, {{ .User }}.</p>
@@ -102,6 +116,110 @@ func TestTemplateManager(t *testing.T) {
 		}
 	})
 
+	t.Run("RenderText", func(t *testing.T) {
+		tm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		text, err := tm.RenderText("notification", map[string]string{"User": "Tom & Jerry"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if text != "You have a new notification, Tom & Jerry." {
+			t.Errorf("expected unescaped text block, got: %q", text)
+		}
+
+		text, err = tm.RenderText("welcome", map[string]string{"Name": "Alice"})
+		if err != nil || text != "" {
+			t.Errorf("expected no text for a template without a text block, got: %q (err=%v)", text, err)
+		}
+	})
+
+	t.Run("UnsubscribeHeaders", func(t *testing.T) {
+		tm, err := New(&config.TemplatesConfig{
+			Path: tmpDir,
+			Unsubscribe: config.UnsubscribeConfig{
+				Mailto:    "unsubscribe@example.com",
+				URL:       "https://example.com/unsubscribe",
+				Secret:    "secret",
+				Templates: []string{"notification"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		headers := tm.Headers("notification", []string{"bob@example.com"}, map[string]string{"X-Campaign-ID": "42"})
+		token := email.UnsubscribeToken("secret", []string{"bob@example.com"})
+		want := "<mailto:unsubscribe@example.com?subject=unsubscribe%20" + token + ">, <https://example.com/unsubscribe?email=bob%40example.com&token=" + token + ">"
+		if headers["List-Unsubscribe"] != want {
+			t.Errorf("expected List-Unsubscribe %q, got: %q", want, headers["List-Unsubscribe"])
+		}
+		if headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" || headers["X-Campaign-ID"] != "42" {
+			t.Errorf("expected one-click and request headers, got: %v", headers)
+		}
+		if !email.VerifyUnsubscribeToken("secret", []string{"BOB@example.com"}, token) || email.VerifyUnsubscribeToken("secret", []string{"eve@example.com"}, token) {
+			t.Error("expected the token to verify only for its recipients")
+		}
+
+		if headers := tm.Headers("welcome", []string{"bob@example.com"}, nil); headers["List-Unsubscribe"] != "" {
+			t.Errorf("expected no unsubscribe headers for an unlisted template, got: %v", headers)
+		}
+	})
+
+	t.Run("Track", func(t *testing.T) {
+		tm, err := New(&config.TemplatesConfig{
+			Path:        tmpDir,
+			Unsubscribe: config.UnsubscribeConfig{URL: "https://example.com/unsubscribe", Secret: "secret"},
+			Tracking:    config.TrackingConfig{URL: "https://mail.example.com/", Opens: true, Templates: []string{"notification"}},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		body := tm.Track("notification", "msg-1", []string{"bob@example.com"}, "<html><body><p>Hi</p></BODY></html>")
+		want := `<html><body><p>Hi</p><img src="https://mail.example.com/t/open/msg-1.gif?r=bob%40example.com" width="1" height="1" alt="" style="border:0;width:1px;height:1px"></BODY></html>`
+		if body != want {
+			t.Errorf("expected the pixel before the end of the body, got: %q", body)
+		}
+		if body := tm.Track("notification", "msg-2", []string{"bob@example.com", "eve@example.com"}, "<p>Hi</p>"); !strings.HasSuffix(body, `src="https://mail.example.com/t/open/msg-2.gif" width="1" height="1" alt="" style="border:0;width:1px;height:1px">`) {
+			t.Errorf("expected a pixel naming no recipient appended to the body, got: %q", body)
+		}
+		if body := tm.Track("welcome", "msg-3", []string{"bob@example.com"}, "<p>Hi</p>"); body != "<p>Hi</p>" {
+			t.Errorf("expected no pixel for an untracked template, got: %q", body)
+		}
+
+		tm.cfg.Tracking = config.TrackingConfig{URL: "https://mail.example.com", Clicks: true, Secret: "secret", ClickDomains: []string{"example.com"}}
+		body = tm.Track("notification", "msg-4", []string{"bob@example.com"}, `<a href="https://shop.example.com/?a=1&amp;b=2">Shop</a> <a href="mailto:help@example.com">Help</a> `+
+			`<a href="https://example.com/unsubscribe?email=bob">Unsubscribe</a> <a href="https://other.org/">Other</a>`)
+		tags := scanTags(body)
+		u, err := url.Parse(tags[0].attr("href").value)
+		if err != nil || u.Host != "mail.example.com" || u.Path != "/t/click/msg-4" || u.Query().Get("u") != "https://shop.example.com/?a=1&b=2" || u.Query().Get("r") != "bob@example.com" {
+			t.Fatalf("expected the shop link to be tracked, got: %q", body)
+		}
+		if !VerifyClickToken("secret", "msg-4", "bob@example.com", "https://shop.example.com/?a=1&b=2", u.Query().Get("t")) {
+			t.Errorf("expected the tracked link to be signed, got: %q", body)
+		}
+		for i, want := range []string{"mailto:help@example.com", "https://example.com/unsubscribe?email=bob", "https://other.org/"} {
+			if got := tags[2*(i+1)].attr("href").value; got != want {
+				t.Errorf("expected %s not to be tracked, got: %s", want, got)
+			}
+		}
+
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "receipt.html"), []byte("---\ntrack_clicks: false\n---\n<p>Receipt</p>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		tm, err = New(&config.TemplatesConfig{Path: dir, Tracking: tm.cfg.Tracking})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if body := tm.Track("receipt", "msg-5", nil, `<a href="https://example.com/">Home</a>`); body != `<a href="https://example.com/">Home</a>` {
+			t.Errorf("expected the front matter to opt out of click tracking, got: %q", body)
+		}
+	})
+
 	t.Run("RenderNonExistentTemplate", func(t *testing.T) {
 		tm, err := New(cfg)
 		if err != nil {
@@ -114,6 +232,910 @@ func TestTemplateManager(t *testing.T) {
 		}
 	})
 
+	t.Run("Reload", func(t *testing.T) {
+		dir := t.TempDir()
+		write := func(name, content string) {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatalf("failed to write test template %s: %v", name, err)
+			}
+		}
+		write("welcome.html", "<p>Hello {{ .Name }}</p>")
+		write("goodbye.html", "<p>Bye</p>")
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		write("welcome.html", "<p>Hi {{ .Name }}</p>")
+		write("reminder.html", "<p>Reminder</p>")
+		if err := os.Remove(filepath.Join(dir, "goodbye.html")); err != nil {
+			t.Fatalf("failed to remove test template: %v", err)
+		}
+		if err := tm.Reload(); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if body, _, _ := tm.Render("welcome", map[string]string{"Name": "Alice"}); body != "<p>Hi Alice</p>" {
+			t.Errorf("expected the updated template, got: %q", body)
+		}
+		if len(tm.ListTemplates()) != 2 {
+			t.Errorf("expected the new template to be added and the removed one dropped, got: %v", tm.ListTemplates())
+		}
+
+		write("welcome.html", "<p>Hi {{ .Name </p>")
+		if err := tm.Reload(); err == nil || !strings.Contains(err.Error(), "welcome") {
+			t.Errorf("expected the parse error to be reported, got: %v", err)
+		}
+		if body, _, _ := tm.Render("welcome", map[string]string{"Name": "Alice"}); body != "<p>Hi Alice</p>" {
+			t.Errorf("expected the previous version to be kept, got: %q", body)
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "welcome.html")
+		if err := os.WriteFile(path, []byte("<p>Hello</p>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		log, err := logger.New(&config.LoggingConfig{Level: "info"})
+		if err != nil {
+			t.Fatalf("failed to create logger: %v", err)
+		}
+		tm.Watch(10*time.Millisecond, log)
+		defer tm.Stop()
+
+		if err := os.WriteFile(path, []byte("<p>Hello again</p>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if body, _, _ := tm.Render("welcome", nil); body == "<p>Hello again</p>" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("expected the changed template to be reloaded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("Manage", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "welcome.html"), []byte("<p>Hello</p>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		created, err := tm.Save("reminder", "<p>Reminder for {{ .Name }}</p>")
+		if err != nil || !created {
+			t.Fatalf("expected the template to be created, got: %v, %v", created, err)
+		}
+		if body, _, _ := tm.Render("reminder", map[string]string{"Name": "Alice"}); body != "<p>Reminder for Alice</p>" {
+			t.Errorf("expected the new template to be available at once, got: %q", body)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "reminder.html")); err != nil {
+			t.Errorf("expected the template to be written to disk, got: %v", err)
+		}
+
+		created, err = tm.Save("welcome", "<p>Hi</p>")
+		if err != nil || created {
+			t.Fatalf("expected the template to be updated, got: %v, %v", created, err)
+		}
+		if content, err := tm.Source("welcome"); err != nil || content != "<p>Hi</p>" {
+			t.Errorf("expected the updated source, got: %q, %v", content, err)
+		}
+
+		if _, err := tm.Save("welcome", "<p>Hi {{ .Name </p>"); !errors.Is(err, ErrInvalidTemplate) {
+			t.Errorf("expected ErrInvalidTemplate for a template that does not parse, got: %v", err)
+		}
+		if _, err := tm.Save("../escape", "<p>Hi</p>"); !errors.Is(err, ErrInvalidTemplate) {
+			t.Errorf("expected ErrInvalidTemplate for an invalid name, got: %v", err)
+		}
+		if body, _, _ := tm.Render("welcome", nil); body != "<p>Hi</p>" {
+			t.Errorf("expected a rejected update to keep the template, got: %q", body)
+		}
+
+		if err := tm.Delete("reminder"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := tm.Source("reminder"); !errors.Is(err, ErrTemplateNotFound) {
+			t.Errorf("expected ErrTemplateNotFound after delete, got: %v", err)
+		}
+		if err := tm.Delete("reminder"); !errors.Is(err, ErrTemplateNotFound) {
+			t.Errorf("expected ErrTemplateNotFound for a second delete, got: %v", err)
+		}
+		if err := tm.Reload(); err != nil || len(tm.ListTemplates()) != 1 {
+			t.Errorf("expected the deleted template to stay gone on reload, got: %v, %v", tm.ListTemplates(), err)
+		}
+	})
+
+	t.Run("Versions", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "welcome.html"), []byte("<p>Hello</p>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		store := &memoryVersionStore{}
+		if _, err := store.Add("welcome", "<p>Stored</p>", time.Now()); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		tm, err := NewWithStore(&config.TemplatesConfig{Path: dir}, store)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if body, _, _ := tm.Render("welcome", nil); body != "<p>Stored</p>" || tm.Version("welcome") != 1 {
+			t.Errorf("expected the stored template to replace the file, got: %q, version %d", body, tm.Version("welcome"))
+		}
+
+		if created, err := tm.Save("welcome", "<p>Broken</p>"); err != nil || created {
+			t.Fatalf("expected the template to be updated, got: %v, %v", created, err)
+		}
+		if content, _ := os.ReadFile(filepath.Join(dir, "welcome.html")); string(content) != "<p>Hello</p>" {
+			t.Errorf("expected the new version to be stored instead of written to disk, got: %q", content)
+		}
+		if body, _, _ := tm.Render("welcome", nil); body != "<p>Broken</p>" || tm.Version("welcome") != 2 {
+			t.Errorf("expected version 2 to be rendered, got: %q, version %d", body, tm.Version("welcome"))
+		}
+
+		if err := tm.Activate("welcome", 1); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if body, _, _ := tm.Render("welcome", nil); body != "<p>Stored</p>" || tm.Version("welcome") != 1 {
+			t.Errorf("expected the rollback to version 1 to apply at once, got: %q, version %d", body, tm.Version("welcome"))
+		}
+		versions, err := tm.Versions("welcome")
+		if err != nil || len(versions) != 2 || !versions[0].Active || versions[1].Active {
+			t.Errorf("expected two versions with the first active, got: %+v, %v", versions, err)
+		}
+		if content, err := tm.Source("welcome"); err != nil || content != "<p>Stored</p>" {
+			t.Errorf("expected the source of the active version, got: %q, %v", content, err)
+		}
+		if err := tm.Reload(); err != nil || tm.Version("welcome") != 1 {
+			t.Errorf("expected the active version to survive a reload, got: version %d, %v", tm.Version("welcome"), err)
+		}
+
+		if err := tm.Activate("welcome", 3); !errors.Is(err, ErrVersionNotFound) {
+			t.Errorf("expected ErrVersionNotFound, got: %v", err)
+		}
+		if _, err := tm.Versions("missing"); !errors.Is(err, ErrTemplateNotFound) {
+			t.Errorf("expected ErrTemplateNotFound, got: %v", err)
+		}
+		if _, err := (&TemplateManager{}).Versions("welcome"); !errors.Is(err, ErrVersioningDisabled) {
+			t.Errorf("expected ErrVersioningDisabled without a store, got: %v", err)
+		}
+
+		if err := tm.Delete("welcome"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if versions, _ := store.Versions("welcome"); len(versions) != 0 || tm.Version("welcome") != 0 {
+			t.Errorf("expected the versions to be deleted, got: %+v", versions)
+		}
+	})
+
+	t.Run("CompanionText", func(t *testing.T) {
+		dir := t.TempDir()
+		write := func(name, content string) {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatalf("failed to write test template %s: %v", name, err)
+			}
+		}
+		write("welcome.html", `{{ define "text" }}From the block{{ end }}<p>Hello {{ .Name }}</p>`)
+		write("welcome.txt", "Hello {{ .Name }} & co")
+		write("notes.txt", "Not a template {{")
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected a .txt file without a template to be ignored, got: %v", err)
+		}
+		if text, err := tm.RenderText("welcome", map[string]string{"Name": "<Alice>"}); err != nil || text != "Hello <Alice> & co" {
+			t.Errorf("expected the unescaped companion text, got: %q, %v", text, err)
+		}
+		if len(tm.ListTemplates()) != 1 {
+			t.Errorf("expected only the HTML template to be listed, got: %v", tm.ListTemplates())
+		}
+
+		if err := tm.Delete("welcome"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "welcome.txt")); !os.IsNotExist(err) {
+			t.Errorf("expected the companion text to be deleted with the template, got: %v", err)
+		}
+	})
+
+	t.Run("Funcs", func(t *testing.T) {
+		dir := t.TempDir()
+		content := `{{ upper .Name }} {{ default "friend" .Nick }} {{ date "2 Jan 2006" .Joined }} {{ currency "USD" .Total }} ` +
+			`{{ .Count }} {{ pluralize .Count "item" "items" }} <a href="{{ url "https://example.com/o" "id" .ID }}">`
+		if err := os.WriteFile(filepath.Join(dir, "order.html"), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data := map[string]interface{}{"Name": "alice", "Nick": "", "Joined": "2025-03-01T12:00:00Z", "Total": 1234.5, "Count": 3.0, "ID": "a b"}
+		body, _, err := tm.Render("order", data)
+		expected := `ALICE friend 1 Mar 2025 $1,234.50 3 items <a href="https://example.com/o?id=a&#43;b">`
+		if err != nil || body != expected {
+			t.Errorf("expected %q, got: %q, %v", expected, body, err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "unsafe.html"), []byte(`{{ env "HOME" }}`), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		if _, err := New(&config.TemplatesConfig{Path: dir}); err != nil {
+			t.Errorf("expected unsafe helpers to be available by default, got: %v", err)
+		}
+		if _, err := New(&config.TemplatesConfig{Path: dir, DisableUnsafeFuncs: true}); err == nil {
+			t.Error("expected a template using a disabled helper to fail to load, got none")
+		}
+	})
+
+	t.Run("UnsubscribeURL", func(t *testing.T) {
+		dir := t.TempDir()
+		content := `{{ define "text" }}{{ unsubscribeURL .Email }}{{ end }}<a href="{{ unsubscribeURL .Email }}">Unsubscribe</a>`
+		if err := os.WriteFile(filepath.Join(dir, "newsletter.html"), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		unsubscribe := config.UnsubscribeConfig{URL: "https://example.com/unsubscribe", Secret: "secret"}
+		tm, err := New(&config.TemplatesConfig{Path: dir, Unsubscribe: unsubscribe})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data := map[string]interface{}{"Email": "user@example.com"}
+		text, err := tm.RenderText("newsletter", data)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		u, err := url.Parse(text)
+		if err != nil || u.Host != "example.com" || u.Query().Get("email") != "user@example.com" {
+			t.Fatalf("expected the unsubscribe URL of the address, got: %q", text)
+		}
+		if !email.VerifyUnsubscribeToken("secret", []string{"user@example.com"}, u.Query().Get("token")) {
+			t.Errorf("expected the URL to carry a valid token, got: %q", text)
+		}
+
+		tm, err = New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, _, err := tm.Render("newsletter", data); err == nil || !strings.Contains(err.Error(), "templates.unsubscribe.url") {
+			t.Errorf("expected rendering to fail without an unsubscribe URL, got: %v", err)
+		}
+	})
+
+	t.Run("Locales", func(t *testing.T) {
+		dir := t.TempDir()
+		write := func(name, content string) {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatalf("failed to write test template %s: %v", name, err)
+			}
+		}
+		write("welcome.html", "<p>Welcome</p>")
+		write("welcome.de.html", `<p>{{ date "Monday, 2. January 2006" .Joined }} {{ currency "EUR" .Total }} {{ number 1 .Total }}</p>`)
+		write("welcome.pt_BR.html", "<p>Bem-vindo</p>")
+		write("goodbye.en.html", "<p>Goodbye</p>")
+		tm, err := New(&config.TemplatesConfig{Path: dir, DefaultLocale: "en"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		for _, c := range []struct{ name, locale, expected string }{
+			{"welcome", "de", "welcome.de"},
+			{"welcome", "de-AT", "welcome.de"},
+			{"welcome", "pt-BR", "welcome.pt-br"},
+			{"welcome", "fr", "welcome"},
+			{"welcome", "", "welcome"},
+			{"goodbye", "de", "goodbye.en"},
+			{"missing", "de", "missing"},
+		} {
+			if variant := tm.Resolve(c.name, c.locale); variant != c.expected {
+				t.Errorf("expected %s in %q to resolve to %s, got: %s", c.name, c.locale, c.expected, variant)
+			}
+		}
+
+		body, _, err := tm.Render("welcome.de", map[string]interface{}{"Joined": "2025-03-03T12:00:00Z", "Total": 1234.5})
+		expected := "<p>Montag, 3. März 2025 1.234,50 € 1.234,5</p>"
+		if err != nil || body != expected {
+			t.Errorf("expected %q, got: %q, %v", expected, body, err)
+		}
+		if _, err := tm.Save("goodbye.DE", "<p>Auf Wiedersehen</p>"); err != nil {
+			t.Fatalf("expected a localized variant to be saved, got: %v", err)
+		}
+		if variant := tm.Resolve("goodbye", "de"); variant != "goodbye.de" {
+			t.Errorf("expected the saved variant to be used, got: %s", variant)
+		}
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		dir := t.TempDir()
+		write := func(name, content string) {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatalf("failed to write test template %s: %v", name, err)
+			}
+		}
+		write("order.html", `{{ define "subject" }}Order {{ .ID }}{{ end }}<p>{{ .Name }}</p>{{ range .Items }}{{ .Title }}{{ end }}{{ template "footer" }}`)
+		write("receipt.html", `<p>{{ .Name }} {{ index .Items 3 }}</p>`)
+		write("receipt.json", `{"Name": "Alice", "Items": ["a"]}`)
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		issues, err := tm.Validate("order", map[string]interface{}{"ID": 1})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(issues) != 1 || issues[0].Kind != IssueUndefinedTemplate {
+			t.Errorf("expected the undefined footer to be reported, got: %+v", issues)
+		}
+
+		write("order.html", `{{ define "subject" }}Order {{ .ID }}{{ end }}<p>{{ .Name }}</p>{{ range .Items }}{{ .Title }}{{ end }}`)
+		if err := tm.Reload(); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		issues, _ = tm.Validate("order", map[string]interface{}{"ID": 1})
+		if len(issues) != 2 || issues[0].Message != `field "Items" is used but missing from the data` || issues[1].Kind != IssueMissingField {
+			t.Errorf("expected the missing Items and Name fields to be reported, got: %+v", issues)
+		}
+
+		issues, _ = tm.Validate("receipt", nil)
+		if len(issues) != 1 || issues[0].Kind != IssueExecution {
+			t.Errorf("expected the failing index with the declared sample to be reported, got: %+v", issues)
+		}
+		if _, err := tm.Validate("missing", nil); !errors.Is(err, ErrTemplateNotFound) {
+			t.Errorf("expected ErrTemplateNotFound, got: %v", err)
+		}
+
+		if _, err := New(&config.TemplatesConfig{Path: dir, Strict: true}); err == nil || !strings.Contains(err.Error(), "receipt") {
+			t.Errorf("expected strict mode to refuse the failing template, got: %v", err)
+		}
+	})
+
+	t.Run("Preflight", func(t *testing.T) {
+		dir := t.TempDir()
+		write := func(name, content string) {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatalf("failed to write test template %s: %v", name, err)
+			}
+		}
+		write("broken.html", `<p>{{ .Name </p>`)
+		write("receipt.html", `<p>{{ .Name }} {{ .Total }}</p>`)
+		write("receipt.json", `{"Name": "Alice"}`)
+		write("welcome.html", `<p>{{ .Name }}</p>`)
+
+		reports, err := Preflight(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(reports) != 3 || reports[0].Name != "broken" || reports[1].Name != "receipt" || reports[2].Name != "welcome" {
+			t.Fatalf("expected a report for every template in name order, got: %+v", reports)
+		}
+		if reports[0].Err == nil {
+			t.Errorf("expected the broken template to fail, got: %+v", reports[0])
+		}
+		if reports[1].Err != nil || len(reports[1].Issues) != 1 || reports[1].Issues[0].Message != `field "Total" is used but missing from the data` {
+			t.Errorf("expected the field missing from the sample to be reported, got: %+v", reports[1])
+		}
+		if reports[2].Err != nil || len(reports[2].Issues) != 0 {
+			t.Errorf("expected no problems without sample data, got: %+v", reports[2])
+		}
+
+		if _, err := Preflight(&config.TemplatesConfig{Path: t.TempDir()}); err == nil {
+			t.Error("expected an error for a directory without templates")
+		}
+	})
+
+	t.Run("Variables", func(t *testing.T) {
+		dir := t.TempDir()
+		source := `---
+required: [Plan]
+---
+{{ define "subject" }}Order {{ .ID }}{{ end }}
+{{ define "address" }}{{ .Street }}, {{ .City }}{{ end }}
+<p>{{ .User.Name | printf "%s" }} {{ .Global.Year }}</p>
+{{ range $i, $item := .Items }}{{ $item.Title }} {{ .Price }} {{ $.Currency }}{{ end }}
+{{ with .Shipping }}{{ template "address" .Address }}{{ end }}
+{{ range .Tags }}{{ . }}{{ end }}`
+		if err := os.WriteFile(filepath.Join(dir, "order.html"), []byte(source), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		variables, err := tm.Variables("order")
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		want := []Variable{
+			{Name: "Currency"},
+			{Name: "ID"},
+			{Name: "Items", List: true, Fields: []Variable{{Name: "Price"}, {Name: "Title"}}},
+			{Name: "Plan"},
+			{Name: "Shipping", Fields: []Variable{{Name: "Address", Fields: []Variable{{Name: "City"}, {Name: "Street"}}}}},
+			{Name: "Tags", List: true},
+			{Name: "User", Fields: []Variable{{Name: "Name"}}},
+		}
+		if !reflect.DeepEqual(variables, want) {
+			t.Errorf("expected %+v, got: %+v", want, variables)
+		}
+		if _, err := tm.Variables("missing"); !errors.Is(err, ErrTemplateNotFound) {
+			t.Errorf("expected ErrTemplateNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("RemoteSync", func(t *testing.T) {
+		var mu sync.Mutex
+		objects := map[string]string{
+			"emails/welcome.html": "<p>Hello</p>",
+			"emails/welcome.txt":  "Hello",
+			"emails/logo.png":     "not a template",
+			"other/ignored.html":  "<p>Other</p>",
+		}
+		downloads := 0
+		bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKID/") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.URL.Path == "/templates-bucket/" && r.URL.Query().Get("list-type") == "2" {
+				_, _ = fmt.Fprint(w, "<ListBucketResult>")
+				for _, key := range slices.Sorted(maps.Keys(objects)) {
+					if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+						_, _ = fmt.Fprintf(w, "<Contents><Key>%s</Key><ETag>\"%x\"</ETag></Contents>", key, objects[key])
+					}
+				}
+				_, _ = fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+				return
+			}
+			content, ok := objects[strings.TrimPrefix(r.URL.Path, "/templates-bucket/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			downloads++
+			_, _ = fmt.Fprint(w, content)
+		}))
+		defer bucket.Close()
+
+		cfg := &config.TemplatesConfig{Path: t.TempDir(), Remote: config.RemoteConfig{
+			Bucket:          "templates-bucket",
+			Prefix:          "emails/",
+			Region:          "auto",
+			Endpoint:        bucket.URL,
+			AccessKeyID:     "AKID",
+			SecretAccessKey: "secret",
+		}}
+		remote, err := NewRemote(cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if changed, err := remote.Sync(context.Background()); err != nil || !changed {
+			t.Fatalf("expected the templates to be synced, got: %v, %v", changed, err)
+		}
+		tm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if text, _ := tm.RenderText("welcome", nil); text != "Hello" || len(tm.ListTemplates()) != 1 {
+			t.Errorf("expected only the template files under the prefix to be synced, got: %v", tm.ListTemplates())
+		}
+
+		if changed, err := remote.Sync(context.Background()); err != nil || changed || downloads != 2 {
+			t.Errorf("expected unchanged objects not to be downloaded again, got: %v, %v, %d downloads", changed, err, downloads)
+		}
+
+		mu.Lock()
+		objects["emails/welcome.html"] = "<p>Hi</p>"
+		delete(objects, "emails/welcome.txt")
+		mu.Unlock()
+		if changed, err := remote.Sync(context.Background()); err != nil || !changed {
+			t.Fatalf("expected the changes to be synced, got: %v, %v", changed, err)
+		}
+		if err := tm.Reload(); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if body, _, _ := tm.Render("welcome", nil); body != "<p>Hi</p>" {
+			t.Errorf("expected the changed template, got: %q", body)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.Path, "welcome.txt")); !os.IsNotExist(err) {
+			t.Errorf("expected the removed object to be deleted, got: %v", err)
+		}
+	})
+
+	t.Run("MJML", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "promo.mjml"), []byte("<mj-text>Hello {{ .Name }}</mj-text>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+
+		// sed stands in for the MJML compiler, turning mj-text into paragraphs.
+		tm, err := New(&config.TemplatesConfig{Path: dir, MJMLCommand: []string{"sed", "s/mj-text/p/g"}})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if body, _, _ := tm.Render("promo", map[string]string{"Name": "Alice"}); body != "<p>Hello Alice</p>" {
+			t.Errorf("expected the compiled template, got: %q", body)
+		}
+		if _, err := tm.Save("promo", "<mj-text>Hi {{ .Name }}</mj-text>"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if body, _, _ := tm.Render("promo", map[string]string{"Name": "Alice"}); body != "<p>Hi Alice</p>" {
+			t.Errorf("expected the saved MJML to be compiled, got: %q", body)
+		}
+		if content, _ := tm.Source("promo"); content != "<mj-text>Hi {{ .Name }}</mj-text>" {
+			t.Errorf("expected the MJML source, got: %q", content)
+		}
+
+		if _, err := New(&config.TemplatesConfig{Path: dir}); err == nil || !strings.Contains(err.Error(), "mjml_command") {
+			t.Errorf("expected an error without an MJML compiler, got: %v", err)
+		}
+		if _, err := New(&config.TemplatesConfig{Path: dir, MJMLCommand: []string{"false"}}); err == nil {
+			t.Error("expected an error when the MJML compiler fails, got none")
+		}
+	})
+
+	t.Run("Markdown", func(t *testing.T) {
+		dir := t.TempDir()
+		source := `{{ define "subject" }}Your order{{ end }}
+# Hi {{ .Name }}
+
+Thanks for your **order** of _{{ len .Items }}_ items:
+
+{{ range .Items }}
+- {{ . }}
+{{ end }}
+
+[Track it]({{ .URL }}) & see ` + "`snake_case`" + `.
+`
+		if err := os.WriteFile(filepath.Join(dir, "order.md"), []byte(source), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		// The layout is kept out of the templates directory, so that it is not loaded as a template.
+		assets := t.TempDir()
+		layout := filepath.Join(assets, "layout.html")
+		if err := os.WriteFile(layout, []byte("<html><head><!-- style --></head><body><!-- content --></body></html>"), 0644); err != nil {
+			t.Fatalf("failed to write test layout: %v", err)
+		}
+		css := filepath.Join(assets, "email.css")
+		if err := os.WriteFile(css, []byte("p { color: red; }"), 0644); err != nil {
+			t.Fatalf("failed to write test CSS: %v", err)
+		}
+
+		tm, err := New(&config.TemplatesConfig{Path: dir, Markdown: config.MarkdownConfig{Layout: layout, CSS: css}})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data := map[string]interface{}{"Name": "<Alice>", "Items": []string{"Tea", "Cake"}, "URL": "https://example.com/track?id=1"}
+		body, subject, err := tm.Render("order", data)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		for _, want := range []string{
+			"<style>\np { color: red; }\n</style>",
+			"<h1>Hi &lt;Alice&gt;</h1>",
+			"<p>Thanks for your <strong>order</strong> of <em>2</em> items:</p>",
+			"<ul>\n\n<li>Tea</li>\n\n<li>Cake</li>\n\n</ul>",
+			`<a href="https://example.com/track?id=1">Track it</a> &amp; see <code>snake_case</code>.`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("expected the body to contain %q, got: %s", want, body)
+			}
+		}
+		if subject != "Your order" {
+			t.Errorf("expected the subject block to be kept, got: %q", subject)
+		}
+		if text, _ := tm.RenderText("order", data); !strings.Contains(text, "# Hi <Alice>") {
+			t.Errorf("expected the Markdown as the plain-text version, got: %q", text)
+		}
+
+		if _, err := New(&config.TemplatesConfig{Path: dir, Markdown: config.MarkdownConfig{Layout: css}}); err == nil || !strings.Contains(err.Error(), "marker") {
+			t.Errorf("expected an error for a layout without a content marker, got: %v", err)
+		}
+	})
+
+	t.Run("FrontMatter", func(t *testing.T) {
+		dir := t.TempDir()
+		source := `---
+subject: "Welcome, {{ .Name }}"
+preheader: "Your {{ .Plan }} account is ready"
+from: "RuneBird <hello@example.com>"
+required: [Name, Plan]
+---
+<html><body><p>Hello {{ .Name }}</p></body></html>`
+		if err := os.WriteFile(filepath.Join(dir, "welcome.html"), []byte(source), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		body, subject, err := tm.Render("welcome", map[string]string{"Name": "Alice", "Plan": "Pro"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if subject != "Welcome, Alice" {
+			t.Errorf("expected the front matter subject, got: %q", subject)
+		}
+		if !strings.HasPrefix(body, "<html><body><div") || !strings.Contains(body, ">Your Pro account is ready</div><p>Hello Alice</p>") {
+			t.Errorf("expected the preheader at the start of the body, got: %q", body)
+		}
+		if from := tm.Metadata("welcome").From; from != "RuneBird <hello@example.com>" {
+			t.Errorf("expected the front matter from address, got: %q", from)
+		}
+
+		if _, _, err := tm.Render("welcome", map[string]string{"Name": "Alice"}); !errors.Is(err, ErrMissingData) || !strings.Contains(err.Error(), "Plan") {
+			t.Errorf("expected ErrMissingData naming Plan, got: %v", err)
+		}
+		issues, err := tm.Validate("welcome", map[string]interface{}{"Name": "Alice"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if len(issues) != 1 || issues[0].Message != `field "Plan" is used but missing from the data` {
+			t.Errorf("expected the missing field to be reported once, got: %v", issues)
+		}
+
+		for _, content := range []string{
+			"---\nsubject: [\n---\n<p>Hi</p>",
+			"---\nsubject: Hi\n<p>Hi</p>",
+			"---\nfrom: not an address\n---\n<p>Hi</p>",
+		} {
+			if _, err := tm.Save("welcome", content); !errors.Is(err, ErrInvalidTemplate) {
+				t.Errorf("expected ErrInvalidTemplate for %q, got: %v", content, err)
+			}
+		}
+		if _, err := tm.Save("welcome", "<p>Hi {{ .Name }}</p>"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, subject, err := tm.Render("welcome", map[string]string{}); err != nil || subject != "" {
+			t.Errorf("expected the front matter to be dropped with the new content, got: %q, %v", subject, err)
+		}
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "welcome.html"), []byte("---\nrequired: [Plan]\n---\n<p>Hi {{ .Name }} ({{ .Plan }}), {{ .Global.Company }} {{ .Global.Year }}</p>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "welcome.de.html"), []byte("<p>Hallo {{ .Name }} ({{ .Plan }})</p>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+
+		tm, err := New(&config.TemplatesConfig{
+			Path:     dir,
+			Globals:  map[string]interface{}{"Company": "RuneBird"},
+			Defaults: map[string]map[string]interface{}{"welcome": {"Name": "there", "Plan": "Free"}},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		year := time.Now().Year()
+		body, _, err := tm.Render("welcome", map[string]string{"Name": "Alice", "Global": "ignored"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if want := fmt.Sprintf("<p>Hi Alice (Free), RuneBird %d</p>", year); body != want {
+			t.Errorf("expected %q, got: %q", want, body)
+		}
+		if body, _, _ := tm.Render("welcome", nil); body != fmt.Sprintf("<p>Hi there (Free), RuneBird %d</p>", year) {
+			t.Errorf("expected the defaults without data, got: %q", body)
+		}
+		if body, _, _ := tm.Render("welcome.de", map[string]interface{}{"Plan": "Pro"}); body != "<p>Hallo there (Pro)</p>" {
+			t.Errorf("expected the defaults of the base template for a variant, got: %q", body)
+		}
+		if issues, err := tm.Validate("welcome", map[string]interface{}{}); err != nil || len(issues) != 0 {
+			t.Errorf("expected the defaults to satisfy validation, got: %v, %v", issues, err)
+		}
+	})
+
+	t.Run("InlineCSS", func(t *testing.T) {
+		dir := t.TempDir()
+		source := `<html><head><style>
+/* layout */
+p { color: red; margin: 0 }
+.note, a:hover { color: blue }
+#footer > p.note { font-size: 12px !important }
+td[align="right"] { padding: 4px }
+div p { line-height: 1.5 }
+@media (max-width: 600px) { p { font-size: 18px } }
+</style></head><body>
+<p>Hi {{ .Name }}</p>
+<p class="note" style="color: green; font-size: 14px">Note</p>
+<div id="footer"><p class="note"><a href="/x">Link</a></p></div>
+<table><tr><td align="right">1</td></tr></table>
+</body></html>`
+		if err := os.WriteFile(filepath.Join(dir, "styled.html"), []byte(source), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "plain.html"), []byte("---\ninline_css: false\n---\n<style>p { color: red }</style><p>Hi</p>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+
+		tm, err := New(&config.TemplatesConfig{Path: dir, InlineCSS: true})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		body, _, err := tm.Render("styled", map[string]string{"Name": "Alice"})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		for _, want := range []string{
+			`<p style="color: red; margin: 0">Hi Alice</p>`,
+			`<p class="note" style="color: green; margin: 0; font-size: 14px">Note</p>`,
+			`<div id="footer"><p class="note" style="color: blue; margin: 0; line-height: 1.5; font-size: 12px !important"><a href="/x">Link</a></p></div>`,
+			`<td align="right" style="padding: 4px">1</td>`,
+			"<style>\na:hover { color: blue }\n@media (max-width: 600px) { p { font-size: 18px } }\n</style>",
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("expected the body to contain %q, got: %s", want, body)
+			}
+		}
+
+		if body, _, _ := tm.Render("plain", nil); body != "<style>p { color: red }</style><p>Hi</p>" {
+			t.Errorf("expected the front matter to turn inlining off, got: %q", body)
+		}
+	})
+
+	t.Run("Engines", func(t *testing.T) {
+		dir := t.TempDir()
+		mustache := `---
+subject: "Hi {{name}} & co"
+---
+<h1>{{greeting}}, {{name}}</h1>{{! a comment }}
+<ul>{{#items}}<li>{{title}} for {{name}}</li>{{/items}}</ul>
+{{^items}}<p>No items</p>{{/items}}
+{{#user}}<p>{{user.email}} {{{badge}}}</p>{{/user}}
+{{=<% %>=}}<p><% Global.Year %></p>`
+		if err := os.WriteFile(filepath.Join(dir, "order.mustache"), []byte(mustache), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "raw.html"), []byte("---\nengine: text\n---\n<div>{{ .Snippet }}</div>"), 0644); err != nil {
+			t.Fatalf("failed to write test template: %v", err)
+		}
+
+		tm, err := New(&config.TemplatesConfig{Path: dir})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		data := map[string]interface{}{
+			"greeting": "Hello",
+			"name":     "<Alice>",
+			"items":    []map[string]string{{"title": "Tea"}, {"title": "Cake", "name": "Bob"}},
+			"user":     map[string]string{"email": "alice@example.com"},
+			"badge":    "<b>VIP</b>",
+		}
+		body, subject, err := tm.Render("order", data)
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		want := fmt.Sprintf(`<h1>Hello, &lt;Alice&gt;</h1>
+<ul><li>Tea for &lt;Alice&gt;</li><li>Cake for Bob</li></ul>
+
+<p>alice@example.com <b>VIP</b></p>
+<p>%d</p>`, time.Now().Year())
+		if body != want {
+			t.Errorf("expected %q, got: %q", want, body)
+		}
+		if subject != "Hi &lt;Alice&gt; & co" {
+			t.Errorf("expected the front matter subject rendered as Mustache, got: %q", subject)
+		}
+		if body, _, _ := tm.Render("order", map[string]interface{}{"items": []string{}}); !strings.Contains(body, "<p>No items</p>") {
+			t.Errorf("expected the inverted section for no items, got: %q", body)
+		}
+
+		if body, _, _ := tm.Render("raw", map[string]string{"Snippet": "<b>bold</b>"}); body != "<div><b>bold</b></div>" {
+			t.Errorf("expected the text engine not to escape, got: %q", body)
+		}
+
+		for _, content := range []string{
+			"---\nengine: jinja\n---\n<p>Hi</p>",
+			"---\nengine: mustache\n---\n{{#items}}<p>Hi</p>",
+			"---\nengine: mustache\n---\n{{> footer}}",
+		} {
+			if _, err := tm.Save("other", content); !errors.Is(err, ErrInvalidTemplate) {
+				t.Errorf("expected ErrInvalidTemplate for %q, got: %v", content, err)
+			}
+		}
+	})
+
+	t.Run("RenderCache", func(t *testing.T) {
+		dir := t.TempDir()
+		for file, content := range map[string]string{
+			"promo.html":  "<p>{{ .Offer }}</p>",
+			"ticket.html": "<p>{{ .Offer }}</p>",
+			"ticket.txt":  `{{ .Offer }} at {{ now.Format "15:04:05.000000000" }}`,
+		} {
+			if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+				t.Fatalf("failed to write test template: %v", err)
+			}
+		}
+		tm, err := New(&config.TemplatesConfig{Path: dir, RenderCacheSize: 2})
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+
+		offer := &countingValue{text: "20% off"}
+		for range 3 {
+			if body, _, err := tm.Render("promo", map[string]interface{}{"Offer": offer}); err != nil || body != "<p>20% off</p>" {
+				t.Fatalf("expected the rendered offer, got: %q, %v", body, err)
+			}
+		}
+		if offer.calls != 1 {
+			t.Errorf("expected the template to be executed once for the same data, got: %d", offer.calls)
+		}
+
+		if _, err := tm.Save("promo", "<div>{{ .Offer }}</div>"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if body, _, _ := tm.Render("promo", map[string]interface{}{"Offer": offer}); body != "<div>20% off</div>" || offer.calls != 2 {
+			t.Errorf("expected the saved template to be rendered, got: %q after %d calls", body, offer.calls)
+		}
+
+		for _, other := range []string{"a", "b"} {
+			_, _, _ = tm.Render("promo", map[string]interface{}{"Offer": other})
+		}
+		_, _, _ = tm.Render("promo", map[string]interface{}{"Offer": offer})
+		if offer.calls != 3 {
+			t.Errorf("expected the least recently used entry to be evicted, got: %d calls", offer.calls)
+		}
+
+		// A template showing the current time is executed every time.
+		if _, err := tm.Save("clock", `<p>{{ .Offer }} at {{ now.Format "15:04:05.000000000" }}</p>`); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		clock := &countingValue{text: "20% off"}
+		for range 2 {
+			if _, _, err := tm.Render("clock", map[string]interface{}{"Offer": clock}); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+		if clock.calls != 2 {
+			t.Errorf("expected a template calling now not to be cached, got: %d calls", clock.calls)
+		}
+
+		// So is a template written for another engine, whose calls to now cannot be found.
+		if _, err := tm.Save("raw", "---\nengine: text\n---\n<p>{{ .Offer }}</p>"); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		raw := &countingValue{text: "20% off"}
+		for range 2 {
+			if _, _, err := tm.Render("raw", map[string]interface{}{"Offer": raw}); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+		}
+		if raw.calls != 2 {
+			t.Errorf("expected a template written for another engine not to be cached, got: %d calls", raw.calls)
+		}
+
+		// A companion text template calling now is found when it is parsed, and again when the
+		// template it belongs to is saved.
+		ticket := &countingValue{text: "20% off"}
+		for _, save := range []bool{false, true} {
+			if save {
+				if _, err := tm.Save("ticket", "<div>{{ .Offer }}</div>"); err != nil {
+					t.Fatalf("expected no error, got: %v", err)
+				}
+			}
+			for range 2 {
+				if _, err := tm.RenderText("ticket", map[string]interface{}{"Offer": ticket}); err != nil {
+					t.Fatalf("expected no error, got: %v", err)
+				}
+			}
+		}
+		if ticket.calls != 4 {
+			t.Errorf("expected a companion text template calling now not to be cached, got: %d calls", ticket.calls)
+		}
+	})
+
 	t.Run("EmptyTemplateDirectory", func(t *testing.T) {
 		emptyDir := t.TempDir()
 		emptyCfg := &config.TemplatesConfig{
@@ -125,3 +1147,63 @@ func TestTemplateManager(t *testing.T) {
 		}
 	})
 }
+
+// memoryVersionStore is a VersionStore keeping the template versions in memory.
+type memoryVersionStore struct {
+	versions map[string][]Version
+}
+
+func (s *memoryVersionStore) Add(name, content string, now time.Time) (Version, error) {
+	if s.versions == nil {
+		s.versions = make(map[string][]Version)
+	}
+	for i := range s.versions[name] {
+		s.versions[name][i].Active = false
+	}
+	v := Version{Name: name, Version: len(s.versions[name]) + 1, Content: content, Active: true, CreatedAt: now}
+	s.versions[name] = append(s.versions[name], v)
+	return v, nil
+}
+
+func (s *memoryVersionStore) Versions(name string) ([]Version, error) {
+	return slices.Clone(s.versions[name]), nil
+}
+
+func (s *memoryVersionStore) Activate(name string, version int) error {
+	if version < 1 || version > len(s.versions[name]) {
+		return ErrVersionNotFound
+	}
+	for i := range s.versions[name] {
+		s.versions[name][i].Active = s.versions[name][i].Version == version
+	}
+	return nil
+}
+
+func (s *memoryVersionStore) Active() ([]Version, error) {
+	var active []Version
+	for _, versions := range s.versions {
+		for _, v := range versions {
+			if v.Active {
+				active = append(active, v)
+			}
+		}
+	}
+	return active, nil
+}
+
+func (s *memoryVersionStore) Delete(name string) error {
+	delete(s.versions, name)
+	return nil
+}
+
+// countingValue counts how often it is formatted into a template. It is encoded as an empty
+// JSON object, so each instance is the same data to the render cache.
+type countingValue struct {
+	text  string
+	calls int
+}
+
+func (v *countingValue) String() string {
+	v.calls++
+	return v.text
+}
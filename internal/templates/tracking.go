@@ -0,0 +1,129 @@
+package templates
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// OpenPixelPath is the path below the tracking URL that open-tracking pixels are served at,
+// followed by the ID of the message and ".gif".
+const OpenPixelPath = "/t/open/"
+
+// ClickPath is the path below the tracking URL that tracked links are redirected through,
+// followed by the ID of the message.
+const ClickPath = "/t/click/"
+
+// tracked reports whether emails rendered from template name are tracked.
+func (tm *TemplateManager) tracked(name string) bool {
+	return tm.cfg.Tracking.URL != "" && (len(tm.cfg.Tracking.Templates) == 0 || slices.Contains(tm.cfg.Tracking.Templates, name))
+}
+
+// Track prepares body, the HTML of the email with the given ID rendered from template name, for
+// tracking as configured: its links are rewritten to go through ClickPath, unless the front
+// matter of the template opts out, and an open-tracking pixel is added. The links and the pixel
+// name the recipient of an email to a single recipient, so that its opens and clicks are
+// counted for them.
+func (tm *TemplateManager) Track(name, messageID string, recipients []string, body string) string {
+	if !tm.tracked(name) || body == "" || messageID == "" {
+		return body
+	}
+	var recipient string
+	if len(recipients) == 1 {
+		recipient = recipients[0]
+	}
+	base := strings.TrimSuffix(tm.cfg.Tracking.URL, "/")
+
+	clicks := tm.cfg.Tracking.Clicks
+	if meta := tm.Metadata(name); meta.TrackClicks != nil {
+		clicks = *meta.TrackClicks
+	}
+	// Links are only rewritten with a secret to sign them, which the config requires for clicks.
+	if clicks && tm.cfg.Tracking.Secret != "" {
+		body = tm.trackClicks(base, messageID, recipient, body)
+	}
+	if tm.cfg.Tracking.Opens {
+		body = trackOpens(base, messageID, recipient, body)
+	}
+	return body
+}
+
+// trackOpens adds an open-tracking pixel to the end of body.
+func trackOpens(base, messageID, recipient, body string) string {
+	pixel := base + OpenPixelPath + url.PathEscape(messageID) + ".gif"
+	if recipient != "" {
+		pixel += "?" + url.Values{"r": {recipient}}.Encode()
+	}
+	img := `<img src="` + html.EscapeString(pixel) + `" width="1" height="1" alt="" style="border:0;width:1px;height:1px">`
+
+	// The pixel goes at the end of the body, where it does not affect the layout.
+	if i := strings.LastIndex(strings.ToLower(body), "</body>"); i >= 0 {
+		return body[:i] + img + body[i:]
+	}
+	return body + img
+}
+
+// trackClicks rewrites the href of every link in body that is tracked to go through ClickPath.
+func (tm *TemplateManager) trackClicks(base, messageID, recipient, body string) string {
+	var edits []edit
+	for _, tok := range scanTags(body) {
+		if tok.closing || (tok.name != "a" && tok.name != "area") {
+			continue
+		}
+		href := tok.attr("href")
+		if href == nil || !tm.trackLink(href.value) {
+			continue
+		}
+		query := url.Values{"u": {href.value}, "t": {ClickToken(tm.cfg.Tracking.Secret, messageID, recipient, href.value)}}
+		if recipient != "" {
+			query.Set("r", recipient)
+		}
+		link := base + ClickPath + url.PathEscape(messageID) + "?" + query.Encode()
+		edits = append(edits, edit{start: href.start, end: href.end, text: `href="` + html.EscapeString(link) + `"`})
+	}
+	return applyEdits(body, edits)
+}
+
+// trackLink reports whether the link to target is rewritten: it must be an http or https URL to
+// one of the click domains, if any are configured, and not lead to the unsubscribe URL or
+// RuneBird itself.
+func (tm *TemplateManager) trackLink(target string) bool {
+	u, err := url.Parse(strings.TrimSpace(target))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	for _, prefix := range []string{tm.cfg.Unsubscribe.URL, tm.cfg.Tracking.URL} {
+		if prefix != "" && strings.HasPrefix(target, prefix) {
+			return false
+		}
+	}
+	if len(tm.cfg.Tracking.ClickDomains) == 0 {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range tm.cfg.Tracking.ClickDomains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClickToken returns a token authenticating a tracked link to target in the email with the given
+// ID, naming recipient if it is not empty, so that the click endpoint cannot be used to redirect
+// to other sites.
+func ClickToken(secret, messageID, recipient, target string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(messageID + "\n" + recipient + "\n" + target))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyClickToken reports whether token was issued by ClickToken for the link.
+func VerifyClickToken(secret, messageID, recipient, target, token string) bool {
+	return hmac.Equal([]byte(ClickToken(secret, messageID, recipient, target)), []byte(token))
+}
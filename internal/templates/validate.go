@@ -0,0 +1,282 @@
+package templates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+
+	"runebird/internal/config"
+)
+
+// Kinds of problems reported by Validate.
+const (
+	IssueMissingField      = "missing_field"
+	IssueUndefinedTemplate = "undefined_template"
+	IssueExecution         = "execution_error"
+)
+
+// Issue is a problem found in a template by Validate.
+type Issue struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Validate checks template name for references to templates that are not defined and, given
+// sample data, for fields it uses that the data does not have and for actions that fail when
+// it is executed, without sending anything. Without data, the sample in the JSON file next to
+// the template, such as welcome.json for welcome.html, is used if there is one, along with the
+// configured global variables and defaults.
+func (tm *TemplateManager) Validate(name string, data map[string]interface{}) ([]Issue, error) {
+	name = canonicalName(name)
+	tm.mu.RLock()
+	tmpl, ok := tm.Templates[name]
+	text := tm.texts[name]
+	path := tm.files[name]
+	required := tm.meta[name].Required
+	tm.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+
+	if data == nil && path != "" {
+		sample, err := loadSample(path)
+		if err != nil {
+			return nil, err
+		}
+		data = sample
+	}
+	if data != nil {
+		data = withDefaults(&tm.cfg, name, data).(map[string]interface{})
+	}
+	return check(tmpl, text, required, data), nil
+}
+
+// Report is the outcome of checking a template with Preflight: the error it failed to load
+// with, or the problems Validate finds in it with its sample data.
+type Report struct {
+	Name   string
+	Err    error
+	Issues []Issue
+}
+
+// Preflight loads every template in the templates directory without creating a
+// TemplateManager, and reports on each in name order, so that all of them can be checked
+// before the service is started. err is set only if the directory cannot be read or holds no
+// templates.
+func Preflight(cfg *config.TemplatesConfig) ([]Report, error) {
+	parsed, err := parseDir(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load templates from %s: %v", cfg.Path, err)
+	}
+	names := slices.Sorted(maps.Keys(parsed.files))
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no templates found in directory %s", cfg.Path)
+	}
+
+	reports := make([]Report, len(names))
+	for i, name := range names {
+		reports[i].Name = name
+		// A template whose text version failed to parse is loaded, but failed all the same.
+		if err, ok := parsed.failed[name]; ok {
+			reports[i].Err = err
+			continue
+		}
+		data, err := loadSample(parsed.files[name])
+		if err != nil {
+			reports[i].Err = err
+			continue
+		}
+		if data != nil {
+			data = withDefaults(cfg, name, data).(map[string]interface{})
+		}
+		reports[i].Issues = check(parsed.templates[name], parsed.texts[name], parsed.meta[name].Required, data)
+	}
+	return reports, nil
+}
+
+// loadSample reads the sample data declared for the template in the file at path, returning
+// nil if there is none.
+func loadSample(path string) (map[string]interface{}, error) {
+	samplePath := strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+	content, err := os.ReadFile(samplePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sample data %s: %v", samplePath, err)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse sample data %s: %v", samplePath, err)
+	}
+	return data, nil
+}
+
+// check returns the problems in tmpl and its companion text template, which may be nil. Fields,
+// including those the front matter requires, and execution are checked only if data is given.
+func check(tmpl *template.Template, text *texttemplate.Template, required []string, data map[string]interface{}) []Issue {
+	var trees []*parse.Tree
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			trees = append(trees, t.Tree)
+		}
+	}
+	if text != nil {
+		for _, t := range text.Templates() {
+			if t.Tree != nil {
+				trees = append(trees, t.Tree)
+			}
+		}
+	}
+
+	var issues []Issue
+	undefined := make(map[string]bool)
+	for _, tree := range trees {
+		walk(tree.Root, true, func(n parse.Node, root bool) {
+			if n, ok := n.(*parse.TemplateNode); ok && tmpl.Lookup(n.Name) == nil && (text == nil || text.Lookup(n.Name) == nil) {
+				undefined[n.Name] = true
+			}
+		})
+	}
+	for _, name := range slices.Sorted(maps.Keys(undefined)) {
+		issues = append(issues, Issue{Kind: IssueUndefinedTemplate, Message: fmt.Sprintf("template %q is not defined", name)})
+	}
+	if data == nil || len(undefined) > 0 {
+		return issues
+	}
+
+	// The body, subject, preheader and text are executed with the data as their dot; fields are checked
+	// only where dot is the data, outside range and with blocks.
+	var entries []*parse.Tree
+	for _, t := range []*template.Template{tmpl, tmpl.Lookup("subject"), tmpl.Lookup("preheader"), tmpl.Lookup("text")} {
+		if t != nil && t.Tree != nil {
+			entries = append(entries, t.Tree)
+		}
+	}
+	if text != nil && text.Tree != nil {
+		entries = append(entries, text.Tree)
+	}
+	used := make(map[string]bool)
+	for _, tree := range entries {
+		walk(tree.Root, true, func(n parse.Node, root bool) {
+			switch n := n.(type) {
+			case *parse.FieldNode:
+				if root {
+					used[n.Ident[0]] = true
+				}
+			case *parse.VariableNode:
+				if n.Ident[0] == "$" && len(n.Ident) > 1 {
+					used[n.Ident[1]] = true
+				}
+			}
+		})
+	}
+	for _, field := range slices.Sorted(maps.Keys(used)) {
+		if _, ok := data[field]; !ok {
+			issues = append(issues, Issue{Kind: IssueMissingField, Message: fmt.Sprintf("field %q is used but missing from the data", field)})
+		}
+	}
+	for _, field := range missingFields(required, data) {
+		if !used[field] {
+			issues = append(issues, Issue{Kind: IssueMissingField, Message: fmt.Sprintf("field %q is required but missing from the data", field)})
+		}
+	}
+
+	execute := []func() error{func() error { return tmpl.Execute(io.Discard, data) }}
+	for _, block := range []string{"subject", "preheader", "text"} {
+		if t := tmpl.Lookup(block); t != nil {
+			execute = append(execute, func() error { return t.Execute(io.Discard, data) })
+		}
+	}
+	if text != nil {
+		execute = append(execute, func() error { return text.Execute(io.Discard, data) })
+	}
+	for _, run := range execute {
+		if err := run(); err != nil {
+			issues = append(issues, Issue{Kind: IssueExecution, Message: err.Error()})
+		}
+	}
+	return issues
+}
+
+// walk calls visit for node and every node below it, along with whether dot is still the data
+// the template was executed with there.
+func walk(node parse.Node, root bool, visit func(n parse.Node, root bool)) {
+	if node == nil || isNilNode(node) {
+		return
+	}
+	visit(node, root)
+	switch n := node.(type) {
+	case *parse.ListNode:
+		for _, child := range n.Nodes {
+			walk(child, root, visit)
+		}
+	case *parse.ActionNode:
+		walk(n.Pipe, root, visit)
+	case *parse.PipeNode:
+		for _, cmd := range n.Cmds {
+			walk(cmd, root, visit)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walk(arg, root, visit)
+		}
+	case *parse.ChainNode:
+		walk(n.Node, root, visit)
+	case *parse.IfNode:
+		walk(n.Pipe, root, visit)
+		walk(n.List, root, visit)
+		walk(n.ElseList, root, visit)
+	case *parse.RangeNode:
+		walk(n.Pipe, root, visit)
+		walk(n.List, false, visit)
+		walk(n.ElseList, root, visit)
+	case *parse.WithNode:
+		walk(n.Pipe, root, visit)
+		walk(n.List, false, visit)
+		walk(n.ElseList, root, visit)
+	case *parse.TemplateNode:
+		walk(n.Pipe, root, visit)
+	}
+}
+
+// strictCheck returns an error describing the problems found in tmpl and its companion text
+// template with the sample data declared next to the file at path, if any.
+func strictCheck(cfg *config.TemplatesConfig, name, path string, tmpl *template.Template, text *texttemplate.Template, required []string) error {
+	data, err := loadSample(path)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		data = withDefaults(cfg, name, data).(map[string]interface{})
+	}
+	issues := check(tmpl, text, required, data)
+	if len(issues) == 0 {
+		return nil
+	}
+	messages := make([]string, len(issues))
+	for i, issue := range issues {
+		messages[i] = issue.Message
+	}
+	return fmt.Errorf("template %s is invalid: %s", name, strings.Join(messages, "; "))
+}
+
+// isNilNode reports whether node is a typed nil, as the optional parts of parse nodes are.
+func isNilNode(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		return n == nil
+	case *parse.PipeNode:
+		return n == nil
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package templates
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"text/template/parse"
+)
+
+// Variable is a data field used by a template. A list is ranged over, and Fields are the
+// fields used of its elements rather than of the value itself.
+type Variable struct {
+	Name   string     `json:"name"`
+	List   bool       `json:"list,omitempty"`
+	Fields []Variable `json:"fields,omitempty"`
+}
+
+// maxTemplateDepth bounds how deep Variables follows templates invoking other templates.
+const maxTemplateDepth = 10
+
+// Variables returns the data fields template name uses in its body, subject, preheader and
+// plain-text version, along with the fields its front matter requires, sorted by name. The
+// global variables passed under .Global are left out. Fields are found in the parsed template,
+// so those of templates written for another engine are not.
+func (tm *TemplateManager) Variables(name string) ([]Variable, error) {
+	name = canonicalName(name)
+	tm.mu.RLock()
+	tmpl, ok := tm.Templates[name]
+	text := tm.texts[name]
+	required := tm.meta[name].Required
+	tm.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+
+	c := &variableCollector{root: &variableNode{}, vars: make(map[string]scope), lookup: func(name string) *parse.Tree {
+		if t := tmpl.Lookup(name); t != nil {
+			return t.Tree
+		}
+		if text != nil {
+			if t := text.Lookup(name); t != nil {
+				return t.Tree
+			}
+		}
+		return nil
+	}}
+	for _, entry := range []string{name, "subject", "preheader", "text"} {
+		if t := tmpl.Lookup(entry); t != nil && t.Tree != nil {
+			c.walk(t.Tree.Root, scope{known: true}, 0)
+		}
+	}
+	if text != nil && text.Tree != nil {
+		c.walk(text.Tree.Root, scope{known: true}, 0)
+	}
+	for _, field := range required {
+		c.add(scope{known: true}, []string{field})
+	}
+	delete(c.root.fields, globalKey)
+	return c.root.variables(), nil
+}
+
+// scope is the data dot refers to, as the path of fields leading to it from the data the
+// template is executed with. An element of a list is the path of the list followed by "[]".
+// The fields of a scope that is not known, such as the result of a function, are not
+// collected.
+type scope struct {
+	path  []string
+	known bool
+}
+
+func (s scope) field(idents []string) scope {
+	if !s.known {
+		return s
+	}
+	return scope{path: append(slices.Clip(s.path), idents...), known: true}
+}
+
+// variableNode is a field found by a variableCollector, with the fields found below it.
+type variableNode struct {
+	list   bool
+	fields map[string]*variableNode
+}
+
+func (n *variableNode) variables() []Variable {
+	var variables []Variable
+	for _, name := range slices.Sorted(maps.Keys(n.fields)) {
+		child := n.fields[name]
+		variables = append(variables, Variable{Name: name, List: child.list, Fields: child.variables()})
+	}
+	return variables
+}
+
+// variableCollector walks parse trees collecting the fields used.
+type variableCollector struct {
+	root   *variableNode
+	vars   map[string]scope
+	lookup func(name string) *parse.Tree
+}
+
+// add records the fields of path below s, returning the node of the last one.
+func (c *variableCollector) add(s scope, path []string) *variableNode {
+	node := c.root
+	for _, name := range append(slices.Clip(s.path), path...) {
+		if name == "[]" {
+			node.list = true
+			continue
+		}
+		if node.fields == nil {
+			node.fields = make(map[string]*variableNode)
+		}
+		child, ok := node.fields[name]
+		if !ok {
+			child = &variableNode{}
+			node.fields[name] = child
+		}
+		node = child
+	}
+	return node
+}
+
+// target returns the data a pipeline evaluates to, if it is known data or a field of it.
+func (c *variableCollector) target(pipe *parse.PipeNode, dot scope) scope {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return scope{}
+	}
+	switch n := pipe.Cmds[0].Args[0].(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return dot.field(n.Ident)
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" {
+			return scope{known: true}.field(n.Ident[1:])
+		}
+		if v, ok := c.vars[n.Ident[0]]; ok {
+			return v.field(n.Ident[1:])
+		}
+	}
+	return scope{}
+}
+
+func (c *variableCollector) walk(node parse.Node, dot scope, depth int) {
+	if node == nil || isNilNode(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		for _, child := range n.Nodes {
+			c.walk(child, dot, depth)
+		}
+	case *parse.ActionNode:
+		c.walk(n.Pipe, dot, depth)
+		if len(n.Pipe.Decl) == 1 {
+			c.vars[n.Pipe.Decl[0].Ident[0]] = c.target(n.Pipe, dot)
+		}
+	case *parse.PipeNode:
+		for _, cmd := range n.Cmds {
+			c.walk(cmd, dot, depth)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			c.walk(arg, dot, depth)
+		}
+	case *parse.ChainNode:
+		c.walk(n.Node, dot, depth)
+	case *parse.FieldNode:
+		if dot.known {
+			c.add(dot, n.Ident)
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			c.add(scope{known: true}, n.Ident[1:])
+		} else if v, ok := c.vars[n.Ident[0]]; ok && v.known && len(n.Ident) > 1 {
+			c.add(v, n.Ident[1:])
+		}
+	case *parse.IfNode:
+		c.walk(n.Pipe, dot, depth)
+		c.walk(n.List, dot, depth)
+		c.walk(n.ElseList, dot, depth)
+	case *parse.RangeNode:
+		c.walk(n.Pipe, dot, depth)
+		element := scope{}
+		if list := c.target(n.Pipe, dot); list.known {
+			c.add(list, nil).list = true
+			element = list.field([]string{"[]"})
+		}
+		// The last variable declared by the range is the element, as in $i, $item := .Items.
+		if decl := n.Pipe.Decl; len(decl) > 0 {
+			c.vars[decl[len(decl)-1].Ident[0]] = element
+		}
+		c.walk(n.List, element, depth)
+		c.walk(n.ElseList, dot, depth)
+	case *parse.WithNode:
+		c.walk(n.Pipe, dot, depth)
+		c.walk(n.List, c.target(n.Pipe, dot), depth)
+		c.walk(n.ElseList, dot, depth)
+	case *parse.TemplateNode:
+		c.walk(n.Pipe, dot, depth)
+		if tree := c.lookup(n.Name); tree != nil && depth < maxTemplateDepth {
+			c.walk(tree.Root, c.target(n.Pipe, dot), depth+1)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"runebird/internal/config"
+)
+
+// ErrVersionNotFound is returned for operations on a template version that does not exist.
+var ErrVersionNotFound = errors.New("template version not found")
+
+// ErrVersioningDisabled is returned by the version operations when templates are not kept in a
+// VersionStore.
+var ErrVersioningDisabled = errors.New("template versioning is not enabled")
+
+// Version is a saved revision of a template. The versions of a template are numbered from 1 in
+// the order they were saved, and the active one is the one that is rendered.
+type Version struct {
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	Content   string    `json:"content"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// VersionStore keeps every version of the templates saved through the TemplateManager in a
+// database, along with which version of each template is active.
+type VersionStore interface {
+	// Add stores content as the next version of template name and makes it the active one.
+	Add(name, content string, now time.Time) (Version, error)
+	// Versions returns the versions of template name, oldest first, or none if it is unknown.
+	Versions(name string) ([]Version, error)
+	// Activate makes the given version of template name the active one, failing with
+	// ErrVersionNotFound if there is no such version.
+	Activate(name string, version int) error
+	// Active returns the active version of every template.
+	Active() ([]Version, error)
+	// Delete removes template name along with all its versions.
+	Delete(name string) error
+}
+
+// loadStored adds the active versions in store to parsed, replacing the templates of the same
+// name read from files. Stored templates have no companion text file.
+func loadStored(cfg *config.TemplatesConfig, store VersionStore, parsed *parsedDir) error {
+	active, err := store.Active()
+	if err != nil {
+		return fmt.Errorf("failed to load stored templates: %v", err)
+	}
+	for _, v := range active {
+		tmpl, meta, _, err := parseSource(cfg, v.Name, v.Name+".html", v.Content)
+		if err != nil {
+			parsed.failed[v.Name] = fmt.Errorf("version %d: %v", v.Version, err)
+			continue
+		}
+		delete(parsed.failed, v.Name)
+		delete(parsed.texts, v.Name)
+		parsed.templates[v.Name] = tmpl
+		parsed.meta[v.Name] = meta
+		parsed.versions[v.Name] = v.Version
+	}
+	return nil
+}
+
+// Version returns the active version of template name, or 0 if it is not a stored template.
+func (tm *TemplateManager) Version(name string) int {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.versions[name]
+}
+
+// Versions returns the saved versions of template name, oldest first.
+func (tm *TemplateManager) Versions(name string) ([]Version, error) {
+	name = canonicalName(name)
+	tm.mu.RLock()
+	store := tm.store
+	tm.mu.RUnlock()
+	if store == nil {
+		return nil, ErrVersioningDisabled
+	}
+	versions, err := store.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrTemplateNotFound
+	}
+	return versions, nil
+}
+
+// Activate makes the given version of template name the one that is rendered, for example to
+// roll back a bad change.
+func (tm *TemplateManager) Activate(name string, version int) error {
+	versions, err := tm.Versions(name)
+	if err != nil {
+		return err
+	}
+	name = canonicalName(name)
+	var target *Version
+	for i := range versions {
+		if versions[i].Version == version {
+			target = &versions[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("%w: version %d of template %s", ErrVersionNotFound, version, name)
+	}
+	tmpl, meta, _, err := parseSource(&tm.cfg, name, name+".html", target.Content)
+	if err != nil {
+		return fmt.Errorf("%w: version %d: %v", ErrInvalidTemplate, version, err)
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if err := tm.store.Activate(name, version); err != nil {
+		return err
+	}
+	tm.Templates[name] = tmpl
+	tm.generation++
+	tm.versions[name] = version
+	if tm.meta == nil {
+		tm.meta = make(map[string]Metadata)
+	}
+	tm.meta[name] = meta
+	delete(tm.texts, name)
+	return nil
+}
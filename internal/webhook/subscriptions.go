@@ -0,0 +1,305 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"runebird/internal/logger"
+)
+
+// The event types consumers can subscribe to.
+const (
+	EventEmailSent       = "email.sent"
+	EventEmailFailed     = "email.failed"
+	EventEmailQueued     = "email.queued"
+	EventEmailBounced    = "email.bounced"
+	EventEmailComplained = "email.complained"
+	EventTaskScheduled   = "task.scheduled"
+	EventTaskCancelled   = "task.cancelled"
+)
+
+// deliveryLogCapacity is the number of delivery attempts kept for each subscription.
+const deliveryLogCapacity = 100
+
+// EventTypes lists the event types consumers can subscribe to.
+var EventTypes = []string{EventEmailSent, EventEmailFailed, EventEmailQueued, EventEmailBounced, EventEmailComplained, EventTaskScheduled, EventTaskCancelled}
+
+// ErrSubscriptionNotFound is returned for an ID no subscription is registered under.
+var ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+
+// ErrInvalidSubscription is returned, wrapped with the reason, for a subscription that cannot
+// be registered.
+var ErrInvalidSubscription = errors.New("invalid webhook subscription")
+
+// Subscription registers URL to receive the events of the types in Events, signed with Secret
+// as described for SignatureHeader.
+type Subscription struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Secret      string    `json:"secret,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Attempt records an attempt to deliver an event to a subscription, with the status the
+// endpoint responded with or the error that prevented the delivery.
+type Attempt struct {
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// SubscriptionStore persists webhook subscriptions.
+type SubscriptionStore interface {
+	// List returns every subscription.
+	List() ([]Subscription, error)
+	// Get returns the subscription with the given ID, or false if there is none.
+	Get(id string) (Subscription, bool, error)
+	// Save stores sub, replacing any subscription with the same ID.
+	Save(sub Subscription) error
+	// Delete removes the subscription with the given ID, reporting whether it existed.
+	Delete(id string) (bool, error)
+}
+
+type memoryStore struct {
+	subscriptions map[string]Subscription
+	mu            sync.Mutex
+}
+
+// NewMemoryStore creates a SubscriptionStore that keeps subscriptions in process memory.
+func NewMemoryStore() SubscriptionStore {
+	return &memoryStore{subscriptions: make(map[string]Subscription)}
+}
+
+func (m *memoryStore) List() ([]Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subs := make([]Subscription, 0, len(m.subscriptions))
+	for _, sub := range m.subscriptions {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (m *memoryStore) Get(id string) (Subscription, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.subscriptions[id]
+	return sub, ok, nil
+}
+
+func (m *memoryStore) Save(sub Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subscriptions[sub.ID] = sub
+	return nil
+}
+
+func (m *memoryStore) Delete(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.subscriptions[id]
+	delete(m.subscriptions, id)
+	return ok, nil
+}
+
+// Subscriptions manages the webhook subscriptions of consumers and publishes events to them
+// through a Client, keeping the latest delivery attempts of each subscription in memory. A nil
+// Subscriptions publishes nothing.
+type Subscriptions struct {
+	store    SubscriptionStore
+	client   *Client
+	logger   *logger.Logger
+	attempts map[string][]Attempt
+	mu       sync.Mutex
+}
+
+// NewSubscriptions creates a Subscriptions registering subscriptions in store and delivering
+// events with client.
+func NewSubscriptions(store SubscriptionStore, client *Client, log *logger.Logger) *Subscriptions {
+	return &Subscriptions{store: store, client: client, logger: log, attempts: make(map[string][]Attempt)}
+}
+
+// List returns every subscription, oldest first.
+func (s *Subscriptions) List() ([]Subscription, error) {
+	subs, err := s.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook subscriptions: %v", err)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if !subs[i].CreatedAt.Equal(subs[j].CreatedAt) {
+			return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+		}
+		return subs[i].ID < subs[j].ID
+	})
+	return subs, nil
+}
+
+// Get returns the subscription with the given ID.
+func (s *Subscriptions) Get(id string) (Subscription, error) {
+	sub, ok, err := s.store.Get(id)
+	if err != nil {
+		return Subscription{}, fmt.Errorf("failed to load webhook subscription %s: %v", id, err)
+	}
+	if !ok {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// Create registers sub under a new ID, with a random secret if it has none.
+func (s *Subscriptions) Create(sub Subscription) (Subscription, error) {
+	if err := validate(sub); err != nil {
+		return Subscription{}, err
+	}
+	now := time.Now().UTC()
+	sub.ID = newID("wh")
+	sub.CreatedAt, sub.UpdatedAt = now, now
+	if sub.Secret == "" {
+		sub.Secret = newSecret()
+	}
+	if err := s.store.Save(sub); err != nil {
+		return Subscription{}, fmt.Errorf("failed to save webhook subscription: %v", err)
+	}
+	return sub, nil
+}
+
+// Update replaces the URL, events and description of the subscription with the given ID, and
+// its secret if sub has one.
+func (s *Subscriptions) Update(id string, sub Subscription) (Subscription, error) {
+	if err := validate(sub); err != nil {
+		return Subscription{}, err
+	}
+	existing, err := s.Get(id)
+	if err != nil {
+		return Subscription{}, err
+	}
+	existing.URL, existing.Events, existing.Description = sub.URL, sub.Events, sub.Description
+	if sub.Secret != "" {
+		existing.Secret = sub.Secret
+	}
+	existing.UpdatedAt = time.Now().UTC()
+	if err := s.store.Save(existing); err != nil {
+		return Subscription{}, fmt.Errorf("failed to save webhook subscription %s: %v", id, err)
+	}
+	return existing, nil
+}
+
+// Delete removes the subscription with the given ID and its delivery attempts.
+func (s *Subscriptions) Delete(id string) error {
+	ok, err := s.store.Delete(id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook subscription %s: %v", id, err)
+	}
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+	s.mu.Lock()
+	delete(s.attempts, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// Attempts returns the latest delivery attempts to the subscription with the given ID, newest
+// first. Attempts are kept in memory, so they are those made by this instance since it started.
+func (s *Subscriptions) Attempts(id string) ([]Attempt, error) {
+	if _, err := s.Get(id); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := make([]Attempt, 0, len(s.attempts[id]))
+	for i := len(s.attempts[id]) - 1; i >= 0; i-- {
+		attempts = append(attempts, s.attempts[id][i])
+	}
+	return attempts, nil
+}
+
+// Publish delivers an event of the given type, carrying data, to every subscription to the
+// type, in the background.
+func (s *Subscriptions) Publish(eventType string, data interface{}) {
+	if s == nil {
+		return
+	}
+	subs, err := s.store.List()
+	if err != nil {
+		s.logger.Error("Failed to list webhook subscriptions", zap.String("type", eventType), zap.Error(err))
+		return
+	}
+	var event Event
+	for _, sub := range subs {
+		if !slices.Contains(sub.Events, eventType) {
+			continue
+		}
+		if event.ID == "" {
+			event = Event{ID: newID("evt"), Type: eventType, CreatedAt: time.Now().UTC(), Data: data}
+		}
+		id := sub.ID
+		s.client.send(sub.URL, sub.Secret, event, func(attempt Attempt) {
+			s.record(id, attempt)
+		})
+	}
+}
+
+// record adds attempt to the log of the subscription with the given ID, dropping the oldest
+// attempt once the log is full.
+func (s *Subscriptions) record(id string, attempt Attempt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := append(s.attempts[id], attempt)
+	if len(attempts) > deliveryLogCapacity {
+		attempts = attempts[len(attempts)-deliveryLogCapacity:]
+	}
+	s.attempts[id] = attempts
+}
+
+// validate checks that sub has an absolute http or https URL and subscribes to known events.
+func validate(sub Subscription) error {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: URL must be an absolute http or https URL", ErrInvalidSubscription)
+	}
+	if len(sub.Events) == 0 {
+		return fmt.Errorf("%w: at least one event type is required", ErrInvalidSubscription)
+	}
+	for _, eventType := range sub.Events {
+		if !slices.Contains(EventTypes, eventType) {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidSubscription, eventType)
+		}
+	}
+	return nil
+}
+
+func newSecret() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newID returns a random ID with the given prefix. Unlike a timestamp, it cannot collide with
+// the ID of a subscription created at the same instant by another instance sharing the store.
+func newID(prefix string) string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return prefix + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,146 @@
+// Package webhook delivers signed JSON event notifications to HTTP endpoints for the RuneBird emailer service.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"runebird/internal/config"
+	"runebird/internal/logger"
+)
+
+// SignatureHeader carries the HMAC signature of a delivery, formatted as "t=<unix time>,v1=<hex digest>".
+// The digest is HMAC-SHA256 over "<unix time>.<request body>" keyed with the configured secret.
+const SignatureHeader = "X-Runebird-Signature"
+
+// Event is the JSON document posted to webhook endpoints.
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Client posts events to webhook endpoints in the background, retrying failed deliveries.
+type Client struct {
+	cfg    *config.WebhookConfig
+	logger *logger.Logger
+	http   *http.Client
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates a new Client based on the provided webhook configuration.
+func New(cfg *config.WebhookConfig, log *logger.Logger) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		cfg:    cfg,
+		logger: log,
+		http:   &http.Client{Timeout: cfg.Timeout},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Send delivers the event to url asynchronously, signed with the configured secret. Failed
+// deliveries are retried with exponential backoff up to the configured number of attempts.
+func (c *Client) Send(url string, event Event) {
+	c.send(url, c.cfg.Secret, event, nil)
+}
+
+// send delivers the event to url asynchronously as Send does, signed with secret, and passes
+// every delivery attempt to record if it is not nil.
+func (c *Client) send(url, secret string, event Event, record func(Attempt)) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		c.logger.Error("Failed to encode webhook event", zap.String("event_id", event.ID), zap.Error(err))
+		return
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.deliverWithRetry(url, secret, event, body, record)
+	}()
+}
+
+// Stop abandons pending retries and waits for in-flight deliveries to finish.
+func (c *Client) Stop() {
+	c.cancel()
+	c.wg.Wait()
+}
+
+func (c *Client) deliverWithRetry(url, secret string, event Event, body []byte, record func(Attempt)) {
+	delay := c.cfg.RetryDelay
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		status, err := c.deliver(url, secret, body)
+		if record != nil {
+			a := Attempt{EventID: event.ID, EventType: event.Type, Attempt: attempt, At: start.UTC(), StatusCode: status, DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				a.Error = err.Error()
+			}
+			record(a)
+		}
+		if err == nil {
+			c.logger.Info("Webhook delivered", zap.String("url", url), zap.String("event_id", event.ID), zap.String("type", event.Type), zap.Int("attempt", attempt))
+			return
+		}
+		if attempt >= c.cfg.MaxAttempts {
+			c.logger.Error("Webhook delivery failed permanently", zap.String("url", url), zap.String("event_id", event.ID), zap.Int("attempts", attempt), zap.Error(err))
+			return
+		}
+		c.logger.Warn("Webhook delivery failed, retrying", zap.String("url", url), zap.String("event_id", event.ID), zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// deliver posts body to url, returning the status the endpoint responded with, if it did.
+func (c *Client) deliver(url, secret string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RuneBird-Webhook/1.0")
+	if secret != "" {
+		req.Header.Set(SignatureHeader, Sign(secret, time.Now(), body))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to post webhook: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook endpoint responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign computes the SignatureHeader value for body sent at the given time.
+func Sign(secret string, at time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
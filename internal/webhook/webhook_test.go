@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"runebird/internal/config"
+	"runebird/internal/logger"
+)
+
+func setupTestClient(t *testing.T, cfg *config.WebhookConfig) *Client {
+	log, err := logger.New(&config.LoggingConfig{Level: "info"})
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	c := New(cfg, log)
+	t.Cleanup(c.Stop)
+	return c
+}
+
+func TestWebhook(t *testing.T) {
+	t.Run("SignDeterministic", func(t *testing.T) {
+		at := time.Unix(1700000000, 0)
+		sig := Sign("secret", at, []byte(`{"id":"evt-1"}`))
+		if !strings.HasPrefix(sig, "t=1700000000,v1=") {
+			t.Errorf("expected signature to start with timestamp, got: %s", sig)
+		}
+		if sig != Sign("secret", at, []byte(`{"id":"evt-1"}`)) {
+			t.Error("expected identical signatures for identical input")
+		}
+		if sig == Sign("other", at, []byte(`{"id":"evt-1"}`)) {
+			t.Error("expected different signatures for different secrets")
+		}
+	})
+
+	t.Run("DeliversSignedEvent", func(t *testing.T) {
+		received := make(chan *http.Request, 1)
+		bodies := make(chan []byte, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			received <- r
+			bodies <- body
+		}))
+		defer srv.Close()
+
+		c := setupTestClient(t, &config.WebhookConfig{Secret: "secret", Timeout: time.Second, MaxAttempts: 1})
+		c.Send(srv.URL, Event{ID: "evt-1", Type: "task.sent", CreatedAt: time.Now().UTC(), Data: map[string]string{"task_id": "sched-1"}})
+
+		select {
+		case r := <-received:
+			body := <-bodies
+			var event Event
+			if err := json.Unmarshal(body, &event); err != nil || event.ID != "evt-1" {
+				t.Errorf("expected event evt-1, got: %s (err=%v)", body, err)
+			}
+			sig := r.Header.Get(SignatureHeader)
+			var ts int64
+			if _, err := fmt.Sscanf(sig, "t=%d,", &ts); err != nil {
+				t.Fatalf("expected signature header, got: %q", sig)
+			}
+			if sig != Sign("secret", time.Unix(ts, 0), body) {
+				t.Errorf("expected signature to match body, got: %s", sig)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected webhook delivery, got none")
+		}
+	})
+
+	t.Run("RetriesUntilSuccess", func(t *testing.T) {
+		var calls int32
+		done := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			close(done)
+		}))
+		defer srv.Close()
+
+		c := setupTestClient(t, &config.WebhookConfig{Timeout: time.Second, MaxAttempts: 5, RetryDelay: 10 * time.Millisecond})
+		c.Send(srv.URL, Event{ID: "evt-2", Type: "task.failed"})
+
+		select {
+		case <-done:
+			if n := atomic.LoadInt32(&calls); n != 3 {
+				t.Errorf("expected 3 delivery attempts, got: %d", n)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected delivery to succeed after retries, got %d attempts", atomic.LoadInt32(&calls))
+		}
+	})
+	t.Run("Subscriptions", func(t *testing.T) {
+		var calls int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+
+		c := setupTestClient(t, &config.WebhookConfig{Timeout: time.Second, MaxAttempts: 3, RetryDelay: 10 * time.Millisecond})
+		subs := NewSubscriptions(NewMemoryStore(), c, c.logger)
+
+		for _, invalid := range []Subscription{
+			{URL: "example.com/hooks", Events: []string{EventEmailSent}},
+			{URL: srv.URL},
+			{URL: srv.URL, Events: []string{"email.opened"}},
+		} {
+			if _, err := subs.Create(invalid); !errors.Is(err, ErrInvalidSubscription) {
+				t.Errorf("expected %v for %+v, got: %v", ErrInvalidSubscription, invalid, err)
+			}
+		}
+
+		sub, err := subs.Create(Subscription{URL: srv.URL, Events: []string{EventEmailSent}})
+		if err != nil || sub.Secret == "" {
+			t.Fatalf("expected the subscription to be created with a secret, got: %+v (%v)", sub, err)
+		}
+		if other, err := subs.Create(Subscription{URL: srv.URL, Events: []string{EventEmailQueued}}); err != nil || other.ID == sub.ID {
+			t.Errorf("expected each subscription to get its own ID, got: %q and %q (%v)", sub.ID, other.ID, err)
+		} else if err := subs.Delete(other.ID); err != nil {
+			t.Fatalf("expected no error deleting the second subscription, got: %v", err)
+		}
+		updated, err := subs.Update(sub.ID, Subscription{URL: srv.URL, Events: []string{EventEmailSent, EventEmailFailed}})
+		if err != nil || updated.Secret != sub.Secret || len(updated.Events) != 2 {
+			t.Errorf("expected the events to be updated and the secret kept, got: %+v (%v)", updated, err)
+		}
+
+		subs.Publish(EventEmailQueued, map[string]string{"id": "msg-1"})
+		subs.Publish(EventEmailFailed, map[string]string{"id": "msg-1"})
+
+		var attempts []Attempt
+		for deadline := time.Now().Add(2 * time.Second); len(attempts) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			attempts, _ = subs.Attempts(sub.ID)
+		}
+		if len(attempts) != 2 {
+			t.Fatalf("expected two delivery attempts, got: %+v", attempts)
+		}
+		if attempts[0].Attempt != 2 || attempts[0].StatusCode != http.StatusOK || attempts[0].EventType != EventEmailFailed {
+			t.Errorf("expected the successful retry first, got: %+v", attempts[0])
+		}
+		if attempts[1].Attempt != 1 || attempts[1].StatusCode != http.StatusServiceUnavailable || attempts[1].Error == "" {
+			t.Errorf("expected the failed first attempt last, got: %+v", attempts[1])
+		}
+
+		if err := subs.Delete(sub.ID); err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if _, err := subs.Attempts(sub.ID); !errors.Is(err, ErrSubscriptionNotFound) {
+			t.Errorf("expected %v after the subscription was deleted, got: %v", ErrSubscriptionNotFound, err)
+		}
+	})
+}